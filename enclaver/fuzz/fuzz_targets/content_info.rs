@@ -0,0 +1,18 @@
+#![no_main]
+
+use enclaver::keypair::{KeyPair, KeyType};
+use enclaver::proxy::pkcs7::ContentInfo;
+use lazy_static::lazy_static;
+use libfuzzer_sys::fuzz_target;
+
+lazy_static! {
+    static ref KEY: KeyPair = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+}
+
+// A ContentInfo as KMS would send it, parsed in whole
+fuzz_target!(|ber: &[u8]| {
+    if let Ok(ci) = ContentInfo::parse_ber(ber) {
+        _ = ci.recipients();
+        _ = ci.decrypt_content(&*KEY);
+    }
+});
@@ -0,0 +1,20 @@
+#![no_main]
+
+use std::io::Read;
+
+use enclaver::keypair::{KeyPair, KeyType};
+use enclaver::proxy::pkcs7::ContentReader;
+use lazy_static::lazy_static;
+use libfuzzer_sys::fuzz_target;
+
+lazy_static! {
+    static ref KEY: KeyPair = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+}
+
+// The same, as a stream
+fuzz_target!(|ber: &[u8]| {
+    if let Ok(mut reader) = ContentReader::new(ber, &*KEY) {
+        let mut plaintext = Vec::new();
+        _ = reader.read_to_end(&mut plaintext);
+    }
+});
@@ -0,0 +1,14 @@
+#![no_main]
+
+use enclaver::proxy::pkcs7::SignedContentInfo;
+use libfuzzer_sys::fuzz_target;
+
+// A SignedData, verified against the certificates it embeds
+fuzz_target!(|ber: &[u8]| {
+    if let Ok(ci) = SignedContentInfo::parse_ber(ber) {
+        _ = ci.content();
+        let certificates = ci.certificates();
+        let trusted: Vec<&[u8]> = certificates.iter().map(Vec::as_slice).collect();
+        _ = ci.verify(&trusted);
+    }
+});
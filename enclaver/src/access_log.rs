@@ -0,0 +1,316 @@
+use std::net::SocketAddr;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use serde::Serialize;
+
+use crate::manifest::{AccessLogFormat, AccessLogSpec};
+
+// Access logs use a log target of their own so that they can be filtered
+// (or routed) separately, e.g. RUST_LOG=enclaver::access=info
+pub const LOG_TARGET: &str = "enclaver::access";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Verdict {
+    Allowed,
+    Denied,
+    // Allowed, but connecting to the destination failed
+    Failed,
+}
+
+impl Verdict {
+    // The closest HTTP status, for the common log format
+    fn status(&self) -> u16 {
+        match self {
+            Verdict::Allowed => 200,
+            Verdict::Denied => 403,
+            Verdict::Failed => 502,
+        }
+    }
+}
+
+pub struct AccessLog {
+    format: AccessLogFormat,
+    sample_percent: u8,
+    seen: AtomicU64,
+}
+
+impl AccessLog {
+    pub fn new(spec: &AccessLogSpec) -> Self {
+        Self {
+            format: spec.format.unwrap_or(AccessLogFormat::Json),
+            sample_percent: spec.sample_percent.unwrap_or(100).min(100),
+            seen: AtomicU64::new(0),
+        }
+    }
+
+    pub fn finish(&self, entry: Entry, verdict: Verdict) {
+        // Denials are rare and interesting, so they are never sampled out
+        if verdict != Verdict::Denied && !self.sampled() {
+            return;
+        }
+
+        let record = Record {
+            time: rfc3339(SystemTime::now()),
+            proxy: entry.proxy,
+            source: entry.source.map(|addr| addr.to_string()),
+            destination: entry.destination,
+            verdict,
+            bytes_upstream: entry.upstream,
+            bytes_downstream: entry.downstream,
+            duration_ms: entry.start.elapsed().as_millis() as u64,
+        };
+
+        let line = match self.format {
+            AccessLogFormat::Json => match serde_json::to_string(&record) {
+                Ok(line) => line,
+                Err(err) => {
+                    log::error!("failed to serialize an access log record: {err}");
+                    return;
+                }
+            },
+            AccessLogFormat::Clf => record.to_clf(),
+        };
+
+        log::info!(target: LOG_TARGET, "{line}");
+    }
+
+    // Spreads the sampled connections evenly, e.g. every 4th one at 25%
+    fn sampled(&self) -> bool {
+        let pct = self.sample_percent as u64;
+        let n = self.seen.fetch_add(1, Ordering::Relaxed);
+        (n + 1) * pct / 100 != n * pct / 100
+    }
+}
+
+pub struct Entry {
+    proxy: &'static str,
+    source: Option<SocketAddr>,
+    destination: String,
+    start: Instant,
+    upstream: u64,
+    downstream: u64,
+}
+
+impl Entry {
+    // Start recording a connection. Nothing is logged until it is finished.
+    pub fn new(proxy: &'static str, source: Option<SocketAddr>, destination: &str) -> Self {
+        Self {
+            proxy,
+            source,
+            destination: destination.to_string(),
+            start: Instant::now(),
+            upstream: 0,
+            downstream: 0,
+        }
+    }
+
+    // Records the result of tokio::io::copy_bidirectional(client, destination)
+    pub fn transferred(&mut self, res: &std::io::Result<(u64, u64)>) {
+        if let Ok((upstream, downstream)) = res {
+            self.upstream = *upstream;
+            self.downstream = *downstream;
+        }
+    }
+}
+
+// Requests made inside intercepted TLS tunnels are logged one by one, under
+// a target of their own, whether or not access logging is enabled
+pub const AUDIT_LOG_TARGET: &str = "enclaver::audit";
+
+pub struct Exchange {
+    source: Option<SocketAddr>,
+    host: String,
+    method: String,
+    path: String,
+    start: Instant,
+}
+
+impl Exchange {
+    pub fn new(source: Option<SocketAddr>, host: &str, method: &str, path: &str) -> Self {
+        Self {
+            source,
+            host: host.to_string(),
+            method: method.to_string(),
+            path: path.to_string(),
+            start: Instant::now(),
+        }
+    }
+
+    // Log the exchange, with the status of the response if there was one
+    pub fn finish(self, status: Option<u16>) {
+        let record = ExchangeRecord {
+            time: rfc3339(SystemTime::now()),
+            source: self.source.map(|addr| addr.to_string()),
+            host: self.host,
+            method: self.method,
+            path: self.path,
+            status,
+            duration_ms: self.start.elapsed().as_millis() as u64,
+        };
+
+        match serde_json::to_string(&record) {
+            Ok(line) => log::info!(target: AUDIT_LOG_TARGET, "{line}"),
+            Err(err) => log::error!("failed to serialize an audit log record: {err}"),
+        }
+    }
+}
+
+#[derive(Serialize)]
+struct ExchangeRecord {
+    time: String,
+    source: Option<String>,
+    host: String,
+    method: String,
+    path: String,
+    status: Option<u16>,
+    duration_ms: u64,
+}
+
+#[derive(Serialize)]
+struct Record {
+    time: String,
+    proxy: &'static str,
+    source: Option<String>,
+    destination: String,
+    verdict: Verdict,
+    bytes_upstream: u64,
+    bytes_downstream: u64,
+    duration_ms: u64,
+}
+
+impl Record {
+    // host ident authuser [date] "request" status bytes, with the proxy
+    // standing in for the protocol and the duration appended
+    fn to_clf(&self) -> String {
+        format!(
+            "{} - - [{}] \"CONNECT {} {}\" {} {} {}",
+            self.source.as_deref().unwrap_or("-"),
+            clf_time(&self.time),
+            self.destination,
+            self.proxy,
+            self.verdict.status(),
+            self.bytes_downstream,
+            self.duration_ms,
+        )
+    }
+}
+
+const MONTHS: [&str; 12] = [
+    "Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec",
+];
+
+// A UTC date and time, also used for the validity of certificates (see x509)
+pub(crate) struct CivilTime {
+    pub year: i64,
+    pub month: u32,
+    pub day: u32,
+    pub hour: u64,
+    pub min: u64,
+    pub sec: u64,
+}
+
+impl CivilTime {
+    pub fn from_unix(d: Duration) -> Self {
+        let secs = d.as_secs();
+        let (days, rem) = ((secs / 86400) as i64, secs % 86400);
+
+        // http://howardhinnant.github.io/date_algorithms.html#civil_from_days
+        let z = days + 719468;
+        let era = z.div_euclid(146097);
+        let doe = z.rem_euclid(146097);
+        let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+        let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+        let mp = (5 * doy + 2) / 153;
+        let day = (doy - (153 * mp + 2) / 5 + 1) as u32;
+        let month = (if mp < 10 { mp + 3 } else { mp - 9 }) as u32;
+        let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+
+        Self {
+            year,
+            month,
+            day,
+            hour: rem / 3600,
+            min: rem % 3600 / 60,
+            sec: rem % 60,
+        }
+    }
+}
+
+pub(crate) fn rfc3339(t: SystemTime) -> String {
+    let d = t.duration_since(UNIX_EPOCH).unwrap_or_default();
+    let c = CivilTime::from_unix(d);
+    format!(
+        "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}.{:03}Z",
+        c.year,
+        c.month,
+        c.day,
+        c.hour,
+        c.min,
+        c.sec,
+        d.subsec_millis()
+    )
+}
+
+// 2022-10-10T13:55:36.123Z -> 10/Oct/2022:13:55:36 +0000
+fn clf_time(rfc3339: &str) -> String {
+    let month = rfc3339
+        .get(5..7)
+        .and_then(|m| m.parse::<usize>().ok())
+        .and_then(|m| MONTHS.get(m.wrapping_sub(1)))
+        .unwrap_or(&"-");
+
+    match (rfc3339.get(0..4), rfc3339.get(8..10), rfc3339.get(11..19)) {
+        (Some(year), Some(day), Some(time)) => format!("{day}/{month}/{year}:{time} +0000"),
+        _ => rfc3339.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{clf_time, rfc3339, AccessLog, Record, Verdict};
+    use crate::manifest::{AccessLogFormat, AccessLogSpec};
+    use assert2::assert;
+    use std::time::{Duration, UNIX_EPOCH};
+
+    #[test]
+    fn test_time_format() {
+        let t = UNIX_EPOCH + Duration::from_millis(1665410136123);
+        assert!(rfc3339(t) == "2022-10-10T13:55:36.123Z");
+        assert!(clf_time("2022-10-10T13:55:36.123Z") == "10/Oct/2022:13:55:36 +0000");
+
+        let t = UNIX_EPOCH + Duration::from_secs(951782400);
+        assert!(rfc3339(t) == "2000-02-29T00:00:00.000Z");
+    }
+
+    #[test]
+    fn test_sampling() {
+        let log = AccessLog::new(&AccessLogSpec {
+            format: Some(AccessLogFormat::Clf),
+            sample_percent: Some(25),
+        });
+
+        let sampled = (0..100).filter(|_| log.sampled()).count();
+        assert!(sampled == 25);
+    }
+
+    #[test]
+    fn test_clf() {
+        let record = Record {
+            time: "2022-10-10T13:55:36.123Z".to_string(),
+            proxy: "egress_http",
+            source: Some("127.0.0.1:49152".to_string()),
+            destination: "kms.us-east-1.amazonaws.com:443".to_string(),
+            verdict: Verdict::Allowed,
+            bytes_upstream: 512,
+            bytes_downstream: 4096,
+            duration_ms: 42,
+        };
+
+        assert!(
+            record.to_clf()
+                == "127.0.0.1:49152 - - [10/Oct/2022:13:55:36 +0000] \"CONNECT kms.us-east-1.amazonaws.com:443 egress_http\" 200 4096 42"
+        );
+    }
+}
@@ -0,0 +1,428 @@
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use anyhow::{anyhow, Result};
+use async_trait::async_trait;
+use http::{Method, Request, Response};
+use hyper::body::Bytes;
+use hyper::{header, Body, StatusCode};
+use log::{debug, error, info, warn};
+use serde::Serialize;
+use tokio::net::{UnixListener, UnixStream};
+use tokio::sync::Notify;
+
+use crate::constants::API_VSOCK_PORT;
+use crate::http_util::{self, HttpHandler};
+use crate::nitro_cli::EnclaveInfo;
+use crate::policy::reload;
+use crate::policy::EgressPolicy;
+use crate::vsock::{self, DialOptions};
+
+const MIME_APPLICATION_JSON: &str = "application/json";
+const MIME_PROMETHEUS_TEXT: &str = "text/plain; version=0.0.4";
+
+const METRICS_NAMESPACE: &str = "enclaver_host";
+
+// A wedged enclave should not hold up the admin API
+const ENCLAVE_DIAL_TIMEOUT: Duration = Duration::from_secs(5);
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum EnclaveState {
+    Starting,
+    Running,
+    Restarting,
+    Stopped,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct EnclaveStatus {
+    pub state: EnclaveState,
+    pub enclave_id: Option<String>,
+    pub cid: Option<u32>,
+    pub restarts: u32,
+    // Whether the runtime inside the enclave answers heartbeats
+    pub healthy: bool,
+}
+
+// Shared between the enclave run loop (which updates it) and
+// the admin API (which reports on it and requests restarts).
+#[derive(Clone)]
+pub struct EnclaveHandle {
+    status: Arc<Mutex<EnclaveStatus>>,
+    restart: Arc<Notify>,
+    egress_policy: Option<Arc<EgressPolicy>>,
+    // Where egress rules are reloaded from
+    manifest_path: Option<PathBuf>,
+}
+
+impl EnclaveHandle {
+    pub fn new(egress_policy: Option<Arc<EgressPolicy>>) -> Self {
+        Self {
+            status: Arc::new(Mutex::new(EnclaveStatus {
+                state: EnclaveState::Starting,
+                enclave_id: None,
+                cid: None,
+                restarts: 0,
+                healthy: false,
+            })),
+            restart: Arc::new(Notify::new()),
+            egress_policy,
+            manifest_path: None,
+        }
+    }
+
+    pub fn with_manifest_path(mut self, path: PathBuf) -> Self {
+        self.manifest_path = Some(path);
+        self
+    }
+
+    pub fn status(&self) -> EnclaveStatus {
+        self.status.lock().unwrap().clone()
+    }
+
+    pub fn set_starting(&self) {
+        let mut status = self.status.lock().unwrap();
+        status.state = EnclaveState::Starting;
+        status.healthy = false;
+    }
+
+    pub fn set_healthy(&self, healthy: bool) {
+        self.status.lock().unwrap().healthy = healthy;
+    }
+
+    pub fn set_running(&self, info: &EnclaveInfo) {
+        let mut status = self.status.lock().unwrap();
+        status.state = EnclaveState::Running;
+        status.enclave_id = Some(info.id.clone());
+        status.cid = Some(info.cid);
+    }
+
+    pub fn set_restarting(&self) {
+        let mut status = self.status.lock().unwrap();
+        status.state = EnclaveState::Restarting;
+        status.enclave_id = None;
+        status.cid = None;
+        status.healthy = false;
+        status.restarts += 1;
+    }
+
+    pub fn set_stopped(&self) {
+        let mut status = self.status.lock().unwrap();
+        status.state = EnclaveState::Stopped;
+        status.enclave_id = None;
+        status.cid = None;
+        status.healthy = false;
+    }
+
+    pub fn request_restart(&self) {
+        self.restart.notify_one();
+    }
+
+    pub async fn restart_requested(&self) {
+        self.restart.notified().await
+    }
+}
+
+// The admin API of the wrapper. It is served over a unix socket that is
+// only accessible to the user running the wrapper (and root).
+pub struct AdminServer {
+    listener: UnixListener,
+    path: PathBuf,
+}
+
+impl AdminServer {
+    pub fn bind(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref().to_path_buf();
+
+        // Remove a stale socket left behind by a previous run
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+
+        let listener = UnixListener::bind(&path)
+            .map_err(|err| anyhow!("failed to bind admin socket {}: {err}", path.display()))?;
+        std::fs::set_permissions(&path, std::fs::Permissions::from_mode(0o600))?;
+
+        info!("admin API listening on {}", path.display());
+
+        Ok(Self { listener, path })
+    }
+
+    pub async fn serve(self, handle: EnclaveHandle) {
+        let handler = Arc::new(AdminHandler { handle });
+
+        loop {
+            match self.listener.accept().await {
+                Ok((conn, _)) => {
+                    if let Err(err) = authorize(&conn) {
+                        warn!("rejected admin API connection: {err}");
+                        continue;
+                    }
+
+                    let handler = handler.clone();
+                    tokio::task::spawn(async move {
+                        if let Err(err) = http_util::serve_connection(conn, handler).await {
+                            debug!("admin API connection failed: {err}");
+                        }
+                    });
+                }
+                Err(err) => {
+                    error!("admin API accept failed: {err}");
+                }
+            }
+        }
+    }
+}
+
+impl Drop for AdminServer {
+    fn drop(&mut self) {
+        _ = std::fs::remove_file(&self.path);
+    }
+}
+
+// The socket permissions already restrict access but double check
+// the credentials of the peer in case the socket is in a shared directory.
+fn authorize(conn: &UnixStream) -> Result<()> {
+    let cred = conn.peer_cred()?;
+    let euid = nix::unistd::geteuid().as_raw();
+
+    if cred.uid() == 0 || cred.uid() == euid {
+        Ok(())
+    } else {
+        Err(anyhow!("peer uid {} is not allowed", cred.uid()))
+    }
+}
+
+struct AdminHandler {
+    handle: EnclaveHandle,
+}
+
+impl AdminHandler {
+    fn handle_status(&self) -> Result<Response<Body>> {
+        json_response(StatusCode::OK, &self.handle.status())
+    }
+
+    fn handle_egress_denials(&self) -> Result<Response<Body>> {
+        match self.handle.egress_policy {
+            Some(ref policy) => json_response(StatusCode::OK, &policy.denials()),
+            None => Ok(http_util::not_found()),
+        }
+    }
+
+    async fn handle_egress_reload(&self) -> Result<Response<Body>> {
+        let (policy, path) = match (&self.handle.egress_policy, &self.handle.manifest_path) {
+            (Some(policy), Some(path)) => (policy, path),
+            _ => return Ok(http_util::not_found()),
+        };
+
+        info!("egress reload requested via the admin API");
+        match reload::reload(path, policy).await {
+            Ok(()) => Ok(Response::builder()
+                .status(StatusCode::NO_CONTENT)
+                .body(Body::empty())?),
+            Err(err) => Ok(http_util::bad_request(err.to_string())),
+        }
+    }
+
+    fn handle_restart(&self) -> Result<Response<Body>> {
+        let status = self.handle.status();
+        if status.state != EnclaveState::Running {
+            return Ok(http_util::conflict(format!(
+                "enclave is not running (state: {:?})",
+                status.state
+            )));
+        }
+
+        info!("enclave restart requested via the admin API");
+        self.handle.request_restart();
+
+        json_response(StatusCode::ACCEPTED, &status)
+    }
+
+    async fn handle_attestation(&self, body: Bytes) -> Result<Response<Body>> {
+        let cid = match self.handle.status().cid {
+            Some(cid) => cid,
+            None => return Ok(http_util::conflict("enclave is not running".to_string())),
+        };
+
+        // The request is passed through as is, odyn validates it
+        let req = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/attestation")
+            .header(header::HOST, "enclave")
+            .header(header::CONTENT_TYPE, MIME_APPLICATION_JSON)
+            .body(Body::from(body))?;
+
+        enclave_request(cid, req).await
+    }
+
+    // The runtime metrics of odyn, in JSON
+    async fn handle_snapshot(&self) -> Result<Response<Body>> {
+        let cid = match self.handle.status().cid {
+            Some(cid) => cid,
+            None => return Ok(http_util::conflict("enclave is not running".to_string())),
+        };
+
+        let snapshot: serde_json::Value =
+            serde_json::from_slice(&enclave_get(cid, "/v1/debug/snapshot").await?)?;
+        json_response(StatusCode::OK, &snapshot)
+    }
+
+    // The metrics of the proxies in the wrapper, followed by those of their
+    // counterparts inside the enclave (if it is running).
+    async fn handle_metrics(&self) -> Result<Response<Body>> {
+        let mut out = crate::metrics::PROXY.render(METRICS_NAMESPACE);
+
+        if let Some(cid) = self.handle.status().cid {
+            match enclave_metrics(cid).await {
+                Ok(metrics) => out.push_str(&metrics),
+                Err(err) => debug!("failed to fetch metrics from the enclave: {err}"),
+            }
+        }
+
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header(header::CONTENT_TYPE, MIME_PROMETHEUS_TEXT)
+            .body(Body::from(out))?)
+    }
+}
+
+async fn enclave_request(cid: u32, req: Request<Body>) -> Result<Response<Body>> {
+    let opts = DialOptions::default().with_timeout(ENCLAVE_DIAL_TIMEOUT);
+    let vsock = vsock::connect(cid, API_VSOCK_PORT, &opts).await?;
+    let (mut sender, conn) = hyper::client::conn::handshake(vsock).await?;
+
+    tokio::task::spawn(async move {
+        _ = conn.await;
+    });
+
+    Ok(sender.send_request(req).await?)
+}
+
+async fn enclave_get(cid: u32, path: &str) -> Result<Vec<u8>> {
+    let req = Request::builder()
+        .method(Method::GET)
+        .uri(path)
+        .header(header::HOST, "enclave")
+        .body(Body::empty())?;
+
+    let resp = enclave_request(cid, req).await?;
+    if resp.status() != StatusCode::OK {
+        return Err(anyhow!("unexpected status {}", resp.status()));
+    }
+
+    let body = hyper::body::to_bytes(resp.into_body()).await?;
+    Ok(body.to_vec())
+}
+
+async fn enclave_metrics(cid: u32) -> Result<String> {
+    Ok(String::from_utf8(enclave_get(cid, "/v1/metrics").await?)?)
+}
+
+#[async_trait]
+impl HttpHandler for AdminHandler {
+    async fn handle(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let (head, body) = req.into_parts();
+        let body = hyper::body::to_bytes(body).await?;
+
+        match head.uri.path() {
+            "/v1/status" => match head.method {
+                Method::GET => self.handle_status(),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/egress/denials" => match head.method {
+                Method::GET => self.handle_egress_denials(),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/egress/reload" => match head.method {
+                Method::POST => self.handle_egress_reload().await,
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/restart" => match head.method {
+                Method::POST => self.handle_restart(),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/attestation" => match head.method {
+                Method::POST => self.handle_attestation(body).await,
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/enclave/snapshot" => match head.method {
+                Method::GET => self.handle_snapshot().await,
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/metrics" => match head.method {
+                Method::GET => self.handle_metrics().await,
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            _ => Ok(http_util::not_found()),
+        }
+    }
+}
+
+fn json_response<T: Serialize>(status: StatusCode, val: &T) -> Result<Response<Body>> {
+    Ok(Response::builder()
+        .status(status)
+        .header(header::CONTENT_TYPE, MIME_APPLICATION_JSON)
+        .body(Body::from(serde_json::to_vec(val)?))?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use assert2::assert;
+
+    fn enclave_info() -> EnclaveInfo {
+        EnclaveInfo {
+            name: "test".to_string(),
+            id: "i-0123-enc4567".to_string(),
+            process_id: 1,
+            cid: 16,
+            state: None,
+            flags: None,
+            memory_mib: None,
+        }
+    }
+
+    async fn body_as_json(resp: Response<Body>) -> json::JsonValue {
+        let bytes = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+        json::parse(std::str::from_utf8(&bytes).unwrap()).unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_status_and_restart() {
+        let handle = EnclaveHandle::new(None);
+        let handler = AdminHandler {
+            handle: handle.clone(),
+        };
+
+        // Restart is refused until the enclave is running
+        let req = Request::post("/v1/restart").body(Body::empty()).unwrap();
+        let resp = handler.handle(req).await.unwrap();
+        assert!(resp.status() == StatusCode::CONFLICT);
+
+        handle.set_running(&enclave_info());
+
+        let req = Request::get("/v1/status").body(Body::empty()).unwrap();
+        let resp = handler.handle(req).await.unwrap();
+        assert!(resp.status() == StatusCode::OK);
+
+        let status = body_as_json(resp).await;
+        assert!(status["state"] == "running");
+        assert!(status["cid"] == 16);
+
+        let req = Request::post("/v1/restart").body(Body::empty()).unwrap();
+        let resp = handler.handle(req).await.unwrap();
+        assert!(resp.status() == StatusCode::ACCEPTED);
+
+        // The permit is stored so this should complete right away
+        tokio::time::timeout(
+            std::time::Duration::from_secs(1),
+            handle.restart_requested(),
+        )
+        .await
+        .unwrap();
+    }
+}
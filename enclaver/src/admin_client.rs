@@ -0,0 +1,111 @@
+use std::path::{Path, PathBuf};
+
+use anyhow::{anyhow, Result};
+use http::{Method, Request, StatusCode};
+use hyper::{header, Body};
+use tokio::net::UnixStream;
+
+const MIME_APPLICATION_JSON: &str = "application/json";
+
+// Talks to the admin API of enclaver-run over its unix socket, for host
+// tooling such as `enclaver attest fetch`
+pub struct AdminClient {
+    path: PathBuf,
+}
+
+impl AdminClient {
+    pub fn new(path: impl AsRef<Path>) -> Self {
+        Self {
+            path: path.as_ref().to_path_buf(),
+        }
+    }
+
+    // A fresh attestation document of the enclave, in CBOR. Verifiers pass a
+    // nonce of their own to know that the document is not a replay.
+    pub async fn attestation(&self, nonce: Option<&[u8]>) -> Result<Vec<u8>> {
+        let body = serde_json::json!({ "nonce": nonce.map(base64::encode) });
+        let req = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/attestation")
+            .header(header::HOST, "enclaver")
+            .header(header::CONTENT_TYPE, MIME_APPLICATION_JSON)
+            .body(Body::from(body.to_string()))?;
+
+        self.request(req).await
+    }
+
+    async fn request(&self, req: Request<Body>) -> Result<Vec<u8>> {
+        let conn = UnixStream::connect(&self.path).await.map_err(|err| {
+            anyhow!(
+                "failed to connect to the admin socket {}: {err}",
+                self.path.display()
+            )
+        })?;
+        let (mut sender, conn) = hyper::client::conn::handshake(conn).await?;
+
+        tokio::task::spawn(async move {
+            _ = conn.await;
+        });
+
+        let resp = sender.send_request(req).await?;
+        let status = resp.status();
+        let body = hyper::body::to_bytes(resp.into_body()).await?;
+        if status != StatusCode::OK {
+            return Err(anyhow!(
+                "admin API answered with {status}: {}",
+                String::from_utf8_lossy(&body)
+            ));
+        }
+
+        Ok(body.to_vec())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::AdminClient;
+    use crate::http_util::{self, HttpHandler};
+    use anyhow::Result;
+    use assert2::assert;
+    use async_trait::async_trait;
+    use hyper::{Body, Request, Response};
+    use std::sync::Arc;
+    use tokio::net::UnixListener;
+
+    struct Attester;
+
+    #[async_trait]
+    impl HttpHandler for Attester {
+        async fn handle(&self, req: Request<Body>) -> Result<Response<Body>> {
+            let body = hyper::body::to_bytes(req.into_body()).await?;
+            let body: serde_json::Value = serde_json::from_slice(&body)?;
+            match body["nonce"].as_str() {
+                Some(nonce) => Ok(Response::new(Body::from(base64::decode(nonce)?))),
+                None => Ok(http_util::conflict("enclave is not running".to_string())),
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_attestation() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("admin.sock");
+        let listener = UnixListener::bind(&path).unwrap();
+        let server = tokio::task::spawn(async move {
+            let handler = Arc::new(Attester);
+            while let Ok((conn, _)) = listener.accept().await {
+                _ = http_util::serve_connection(conn, handler.clone()).await;
+            }
+        });
+
+        // The test server echoes the nonce back as the document
+        let client = AdminClient::new(&path);
+        let doc = client.attestation(Some(b"the nonce")).await.unwrap();
+        assert!(doc == b"the nonce");
+
+        let err = client.attestation(None).await.unwrap_err();
+        assert!(err.to_string().contains("enclave is not running"));
+
+        server.abort();
+    }
+}
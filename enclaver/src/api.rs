@@ -5,35 +5,362 @@ use hyper::header;
 use hyper::{Body, StatusCode};
 use pkcs8::{DecodePublicKey, SubjectPublicKeyInfo};
 use serde::Deserialize;
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
 
+use crate::clock_sync::TrustedClock;
+use crate::credentials::HostCredentialsProvider;
+use crate::hpke::{HpkeKeyPair, SealedMessage};
 use crate::http_util::{self, HttpHandler};
-use crate::nsm::{AttestationParams, AttestationProvider};
+use crate::kdf::{self, MAX_KEY_LEN};
+use crate::keypair::{KeyPair, KeyType};
+use crate::nsm::{
+    AttestationParams, AttestationProvider, ErrorCode, KeyRotator, Measurements, Nsm, NsmError,
+};
+use crate::user_data::{check_len, MAX_NONCE_LEN, MAX_PUBLIC_KEY_LEN, MAX_USER_DATA_LEN};
+use crate::x509;
 
 const MIME_APPLICATION_CBOR: &str = "application/cbor";
+const MIME_APPLICATION_JSON: &str = "application/json";
+const MIME_PROMETHEUS_TEXT: &str = "text/plain; version=0.0.4";
+
+const DEFAULT_DERIVED_KEY_LEN: usize = 32;
+
+// The enclave side metrics are told apart from those of the wrapper by the name
+pub const METRICS_NAMESPACE: &str = "enclaver_enclave";
 
 pub struct ApiHandler {
     attester: Box<dyn AttestationProvider + Send + Sync>,
+    allow_bindings: bool,
+    key_rotators: Vec<Arc<KeyRotator>>,
+    nsm: Option<Arc<Nsm>>,
+    credentials: Option<HostCredentialsProvider>,
+    clock: Option<TrustedClock>,
+    hpke_key: Option<Arc<HpkeKeyPair>>,
+    manifest: Option<serde_json::Value>,
+    measurements: Option<Measurements>,
 }
 
 impl ApiHandler {
     pub fn new(attester: Box<dyn AttestationProvider + Send + Sync>) -> Self {
-        Self { attester }
+        Self {
+            attester,
+            allow_bindings: true,
+            key_rotators: Vec::new(),
+            nsm: None,
+            credentials: None,
+            clock: None,
+            hpke_key: None,
+            manifest: None,
+            measurements: None,
+        }
+    }
+
+    // The attested keys that POST /v1/keys/rotate replaces
+    pub fn with_key_rotators(mut self, key_rotators: Vec<Arc<KeyRotator>>) -> Self {
+        self.key_rotators = key_rotators;
+        self
+    }
+
+    // For /v1/nsm and /v1/pcrs, which are not found without it
+    pub fn with_nsm(mut self, nsm: Arc<Nsm>) -> Self {
+        self.nsm = Some(nsm);
+        self
+    }
+
+    // For /v1/aws/credentials, which AWS_CONTAINER_CREDENTIALS_FULL_URI can
+    // point the AWS SDKs at
+    pub fn with_credentials(mut self, credentials: HostCredentialsProvider) -> Self {
+        self.credentials = Some(credentials);
+        self
+    }
+
+    // For /v1/time
+    pub fn with_clock(mut self, clock: TrustedClock) -> Self {
+        self.clock = Some(clock);
+        self
+    }
+
+    // For /v1/hpke, which senders outside the enclave seal messages to
+    pub fn with_hpke_key(mut self, key: Arc<HpkeKeyPair>) -> Self {
+        self.hpke_key = Some(key);
+        self
+    }
+
+    // For /v1/manifest, the manifest as the runtime parsed it, in JSON
+    pub fn with_manifest(mut self, manifest: serde_json::Value) -> Self {
+        self.manifest = Some(manifest);
+        self
+    }
+
+    // For /v1/measurements
+    pub fn with_measurements(mut self, measurements: Measurements) -> Self {
+        self.measurements = Some(measurements);
+        self
+    }
+
+    // A handler for requests originating outside of the enclave. Only a nonce
+    // may be supplied: letting the host bind its own public key or user data
+    // into a document would allow it to impersonate the enclave (e.g. to KMS).
+    pub fn host_facing(attester: Box<dyn AttestationProvider + Send + Sync>) -> Self {
+        Self {
+            attester,
+            allow_bindings: false,
+            key_rotators: Vec::new(),
+            nsm: None,
+            credentials: None,
+            clock: None,
+            hpke_key: None,
+            manifest: None,
+            measurements: None,
+        }
     }
 
     async fn handle_attestation(
         &self,
-        _head: &http::request::Parts,
+        head: &http::request::Parts,
         body: &[u8],
     ) -> Result<Response<Body>> {
-        let attestation_req: AttestationRequest = match serde_json::from_slice(body) {
+        let params = match attestation_params(head, body) {
+            Ok(params) => params,
+            Err(resp) => return Ok(resp),
+        };
+
+        if !self.allow_bindings && (params.public_key.is_some() || params.user_data.is_some()) {
+            return Ok(http_util::bad_request(
+                "public_key and user_data cannot be set from outside the enclave".to_string(),
+            ));
+        }
+
+        let att_doc = self.attester.attestation(params)?;
+
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header(header::CONTENT_TYPE, MIME_APPLICATION_CBOR)
+            .body(Body::from(att_doc))?)
+    }
+
+    // A fresh key with an attested certificate for it, both in PEM, for apps
+    // to serve TLS that clients trust by the measurements of the enclave
+    fn handle_attested_certificate(&self, body: &[u8]) -> Result<Response<Body>> {
+        let req: AttestedCertificateRequest = match serde_json::from_slice(body) {
             Ok(req) => req,
             Err(err) => return Ok(http_util::bad_request(err.to_string())),
         };
 
-        let params = match attestation_req.into_params() {
-            Ok(params) => params,
+        let key = KeyPair::generate_with(req.key_type.unwrap_or_default())?;
+        let attestation = self.attester.attestation(AttestationParams {
+            nonce: None,
+            user_data: None,
+            public_key: Some(key.public_key_as_der()?),
+        })?;
+        let (cert, private_key) = x509::attested(&req.dns_names, &key, attestation)?;
+
+        let body = serde_json::json!({
+            "certificate": x509::pem("CERTIFICATE", &cert),
+            "private_key": x509::pem("PRIVATE KEY", &private_key),
+        });
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header(header::CONTENT_TYPE, MIME_APPLICATION_JSON)
+            .body(Body::from(body.to_string()))?)
+    }
+
+    // Responds with the new public keys, in PEM
+    fn handle_rotate_keys(&self) -> Result<Response<Body>> {
+        let mut public_keys = Vec::new();
+        for rotator in &self.key_rotators {
+            rotator.rotate()?;
+            public_keys.push(rotator.current().key.public_key_as_pem()?);
+        }
+
+        let body = serde_json::json!({ "public_keys": public_keys });
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header(header::CONTENT_TYPE, MIME_APPLICATION_JSON)
+            .body(Body::from(body.to_string()))?)
+    }
+
+    // The attested TLS keys in use, in PEM
+    fn handle_public_keys(&self) -> Result<Response<Body>> {
+        let mut public_keys = Vec::new();
+        for rotator in &self.key_rotators {
+            public_keys.push(rotator.current().key.public_key_as_pem()?);
+        }
+
+        json_response(serde_json::json!({ "public_keys": public_keys }))
+    }
+
+    // In the format of the container credentials endpoint of ECS
+    async fn handle_aws_credentials(
+        &self,
+        credentials: &HostCredentialsProvider,
+    ) -> Result<Response<Body>> {
+        let credentials = credentials.fetch().await?;
+        let expiration = credentials
+            .expiration
+            .map(|secs| crate::access_log::rfc3339(UNIX_EPOCH + Duration::from_secs(secs)));
+
+        json_response(serde_json::json!({
+            "AccessKeyId": credentials.access_key_id,
+            "SecretAccessKey": credentials.secret_access_key,
+            "Token": credentials.token,
+            "Expiration": expiration,
+        }))
+    }
+
+    // A key for the labels from a data key of the app's, bound to the image
+    // by its PCR0, which the app has no say in
+    fn handle_derive_key(&self, nsm: &Nsm, body: &[u8]) -> Result<Response<Body>> {
+        let req: DeriveKeyRequest = match serde_json::from_slice(body) {
+            Ok(req) => req,
+            Err(err) => return Ok(http_util::bad_request(err.to_string())),
+        };
+        let data_key = match base64::decode(&req.data_key) {
+            Ok(data_key) => data_key,
             Err(err) => return Ok(http_util::bad_request(err.to_string())),
         };
+        if req.labels.is_empty() {
+            return Ok(http_util::bad_request(
+                "at least one label is required, to tell what the key is for".to_string(),
+            ));
+        }
+        let len = req.length.unwrap_or(DEFAULT_DERIVED_KEY_LEN);
+        if len == 0 || len > MAX_KEY_LEN {
+            return Ok(http_util::bad_request(format!(
+                "length must be between 1 and {MAX_KEY_LEN}"
+            )));
+        }
+
+        let context = match nsm.key_context() {
+            Ok(context) => context,
+            Err(err) => return nsm_error(err),
+        };
+        let context = req
+            .labels
+            .iter()
+            .fold(context, |context, label| context.with_label(label));
+        let key = kdf::derive_key(&data_key, &context, len)?;
+
+        json_response(serde_json::json!({ "key": base64::encode(key) }))
+    }
+
+    fn handle_describe_nsm(&self, nsm: &Nsm) -> Result<Response<Body>> {
+        let description = match nsm.describe() {
+            Ok(description) => description,
+            Err(err) => return nsm_error(err),
+        };
+
+        let body = serde_json::json!({
+            "module_id": description.module_id,
+            "version": format!(
+                "{}.{}.{}",
+                description.version.0, description.version.1, description.version.2
+            ),
+            "max_pcrs": description.max_pcrs,
+            "locked_pcrs": description.locked_pcrs,
+            "digest": format!("{:?}", description.digest),
+        });
+        json_response(body)
+    }
+
+    // GET /v1/pcrs/<index>, and POST to /v1/pcrs/<index>/extend or
+    // /v1/pcrs/<index>/lock. Values are hex encoded.
+    fn handle_pcr(
+        &self,
+        nsm: &Nsm,
+        method: &Method,
+        path: &str,
+        body: &[u8],
+    ) -> Result<Response<Body>> {
+        let (index, action) = match path.split_once('/') {
+            Some((index, action)) => (index, Some(action)),
+            None => (path, None),
+        };
+        let index: u16 = match index.parse() {
+            Ok(index) => index,
+            Err(_) => return Ok(http_util::not_found()),
+        };
+
+        let res = match (action, method) {
+            (None, &Method::GET) => nsm.describe_pcr(index).map(|pcr| {
+                serde_json::json!({
+                    "index": index,
+                    "locked": pcr.locked,
+                    "value": hex(&pcr.value),
+                })
+            }),
+            (Some("extend"), &Method::POST) => {
+                let req: ExtendPcrRequest = match serde_json::from_slice(body) {
+                    Ok(req) => req,
+                    Err(err) => return Ok(http_util::bad_request(err.to_string())),
+                };
+                let data = match base64::decode(&req.data) {
+                    Ok(data) => data,
+                    Err(err) => return Ok(http_util::bad_request(err.to_string())),
+                };
+                nsm.extend_pcr(index, &data).map(|value| {
+                    serde_json::json!({
+                        "index": index,
+                        "value": hex(&value),
+                    })
+                })
+            }
+            (Some("lock"), &Method::POST) => nsm
+                .lock_pcr(index)
+                .map(|_| serde_json::json!({ "index": index, "locked": true })),
+            (None, _) | (Some("extend" | "lock"), _) => return Ok(http_util::method_not_allowed()),
+            _ => return Ok(http_util::not_found()),
+        };
+
+        match res {
+            Ok(body) => json_response(body),
+            Err(err) => nsm_error(err),
+        }
+    }
+
+    // The time by the host, with the bounds the enclave can vouch for, in
+    // milliseconds since the epoch
+    fn handle_time(&self, clock: &TrustedClock) -> Result<Response<Body>> {
+        let time = match clock.now() {
+            Ok(time) => time,
+            Err(err) => return Ok(http_util::service_unavailable(err.to_string())),
+        };
+        let unix_ms =
+            |t: SystemTime| t.duration_since(UNIX_EPOCH).unwrap_or_default().as_millis() as u64;
+
+        json_response(serde_json::json!({
+            "now_ms": unix_ms(time.now()),
+            "earliest_ms": unix_ms(time.earliest),
+            "latest_ms": unix_ms(time.latest),
+            "uncertainty_ms": time.uncertainty().as_millis() as u64,
+            "last_sync_age_ms": time.last_sync_age.as_millis() as u64,
+        }))
+    }
+
+    // A document binding the HPKE key, for senders to verify before they seal
+    // to it. The host may fetch it too, as it can do nothing with the key.
+    fn handle_hpke_attestation(
+        &self,
+        key: &HpkeKeyPair,
+        head: &http::request::Parts,
+        body: &[u8],
+    ) -> Result<Response<Body>> {
+        let mut params = match attestation_params(head, body) {
+            Ok(params) => params,
+            Err(resp) => return Ok(resp),
+        };
+        if params.public_key.is_some() {
+            return Ok(http_util::bad_request(
+                "public_key is that of the HPKE key".to_string(),
+            ));
+        }
+        if !self.allow_bindings && params.user_data.is_some() {
+            return Ok(http_util::bad_request(
+                "user_data cannot be set from outside the enclave".to_string(),
+            ));
+        }
+        params.public_key = Some(key.public_key());
 
         let att_doc = self.attester.attestation(params)?;
 
@@ -42,6 +369,53 @@ impl ApiHandler {
             .header(header::CONTENT_TYPE, MIME_APPLICATION_CBOR)
             .body(Body::from(att_doc))?)
     }
+
+    fn handle_hpke_open(&self, key: &HpkeKeyPair, body: &[u8]) -> Result<Response<Body>> {
+        let req: HpkeOpenRequest = match serde_json::from_slice(body) {
+            Ok(req) => req,
+            Err(err) => return Ok(http_util::bad_request(err.to_string())),
+        };
+        let (message, aad) = match (
+            base64::decode(&req.enc),
+            base64::decode(&req.ciphertext),
+            req.aad.as_deref().map(base64::decode).transpose(),
+        ) {
+            (Ok(enc), Ok(ciphertext), Ok(aad)) => {
+                (SealedMessage { enc, ciphertext }, aad.unwrap_or_default())
+            }
+            _ => return Ok(http_util::bad_request("invalid base64".to_string())),
+        };
+
+        match key.open(&message, &aad) {
+            Ok(plaintext) => json_response(serde_json::json!({
+                "plaintext": base64::encode(plaintext),
+            })),
+            Err(err) => Ok(http_util::bad_request(err.to_string())),
+        }
+    }
+
+    fn handle_measurements(&self, measurements: &Measurements) -> Result<Response<Body>> {
+        let pcrs: serde_json::Map<String, serde_json::Value> = measurements
+            .pcrs
+            .iter()
+            .map(|(index, value)| (index.to_string(), hex(value).into()))
+            .collect();
+
+        json_response(serde_json::json!({
+            "pcrs": pcrs,
+            "debug_mode": measurements.is_debug(),
+        }))
+    }
+
+    fn handle_metrics(&self) -> Result<Response<Body>> {
+        let mut out = crate::metrics::PROXY.render(METRICS_NAMESPACE);
+        out.push_str(&crate::metrics::RUNTIME.render(METRICS_NAMESPACE));
+
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header(header::CONTENT_TYPE, MIME_PROMETHEUS_TEXT)
+            .body(Body::from(out))?)
+    }
 }
 
 #[async_trait]
@@ -52,10 +426,91 @@ impl HttpHandler for ApiHandler {
 
         match head.uri.path() {
             "/v1/attestation" => match head.method {
-                Method::POST => self.handle_attestation(&head, &body).await,
-
+                Method::GET | Method::POST => self.handle_attestation(&head, &body).await,
                 _ => Ok(http_util::method_not_allowed()),
             },
+            "/v1/public_keys" => match head.method {
+                Method::GET => self.handle_public_keys(),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            // Up for as long as the API is
+            "/v1/healthz" => match head.method {
+                Method::GET => Ok(Response::new(Body::from("ok"))),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/metrics" => match head.method {
+                Method::GET => self.handle_metrics(),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            // Counts and timings only, nothing the host should not see
+            "/v1/debug/snapshot" => match head.method {
+                Method::GET => json_response(crate::metrics::RUNTIME.snapshot()),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            // The private key must not leave the enclave
+            "/v1/tls/attested_certificate" if self.allow_bindings => match head.method {
+                Method::POST => self.handle_attested_certificate(&body),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            // Not for the host to churn through keys
+            "/v1/keys/rotate" if self.allow_bindings => match head.method {
+                Method::POST => self.handle_rotate_keys(),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            // Extending and locking PCRs are for the app alone
+            "/v1/nsm" if self.allow_bindings && self.nsm.is_some() => match head.method {
+                Method::GET => self.handle_describe_nsm(self.nsm.as_ref().unwrap()),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/aws/credentials" if self.allow_bindings && self.credentials.is_some() => {
+                match head.method {
+                    Method::GET => {
+                        self.handle_aws_credentials(self.credentials.as_ref().unwrap())
+                            .await
+                    }
+                    _ => Ok(http_util::method_not_allowed()),
+                }
+            }
+            // Keys are for the app alone, as is the data key it sends
+            "/v1/keys/derive" if self.allow_bindings && self.nsm.is_some() => match head.method {
+                Method::POST => self.handle_derive_key(self.nsm.as_ref().unwrap(), &body),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/time" if self.allow_bindings && self.clock.is_some() => match head.method {
+                Method::GET => self.handle_time(self.clock.as_ref().unwrap()),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/hpke/attestation" if self.hpke_key.is_some() => match head.method {
+                Method::GET | Method::POST => {
+                    self.handle_hpke_attestation(self.hpke_key.as_ref().unwrap(), &head, &body)
+                }
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            // Only the app gets to see what was sent to it
+            "/v1/hpke/open" if self.allow_bindings && self.hpke_key.is_some() => {
+                match head.method {
+                    Method::POST => self.handle_hpke_open(self.hpke_key.as_ref().unwrap(), &body),
+                    _ => Ok(http_util::method_not_allowed()),
+                }
+            }
+            // For the app to go by its own configuration and identity
+            "/v1/manifest" if self.allow_bindings && self.manifest.is_some() => match head.method {
+                Method::GET => json_response(self.manifest.clone().unwrap()),
+                _ => Ok(http_util::method_not_allowed()),
+            },
+            "/v1/measurements" if self.allow_bindings && self.measurements.is_some() => {
+                match head.method {
+                    Method::GET => self.handle_measurements(self.measurements.as_ref().unwrap()),
+                    _ => Ok(http_util::method_not_allowed()),
+                }
+            }
+            path if self.allow_bindings && path.starts_with("/v1/pcrs/") => match self.nsm {
+                Some(ref nsm) => {
+                    let path = &path["/v1/pcrs/".len()..];
+                    self.handle_pcr(nsm, &head.method, path, &body)
+                }
+                None => Ok(http_util::not_found()),
+            },
             _ => Ok(http_util::not_found()),
         }
     }
@@ -68,13 +523,74 @@ struct AttestationRequest {
     user_data: Option<String>,
 }
 
+#[derive(Deserialize)]
+struct AttestedCertificateRequest {
+    #[serde(default)]
+    dns_names: Vec<String>,
+    key_type: Option<KeyType>,
+}
+
+#[derive(Deserialize)]
+struct DeriveKeyRequest {
+    // base64
+    data_key: String,
+    labels: Vec<String>,
+    length: Option<usize>,
+}
+
+#[derive(Deserialize)]
+struct HpkeOpenRequest {
+    // base64
+    enc: String,
+    ciphertext: String,
+    aad: Option<String>,
+}
+
+#[derive(Deserialize)]
+struct ExtendPcrRequest {
+    // base64
+    data: String,
+}
+
 impl AttestationRequest {
+    fn from_query(query: &str) -> Self {
+        let mut req = Self {
+            nonce: None,
+            public_key: None,
+            user_data: None,
+        };
+
+        for (k, v) in form_urlencoded::parse(query.as_bytes()) {
+            match k.as_ref() {
+                "nonce" => req.nonce = Some(v.into_owned()),
+                "public_key" => req.public_key = Some(v.into_owned()),
+                "user_data" => req.user_data = Some(v.into_owned()),
+                _ => {}
+            }
+        }
+
+        req
+    }
+
     fn into_params(self) -> Result<AttestationParams> {
-        Ok(AttestationParams {
+        let params = AttestationParams {
             nonce: self.nonce.map(|s| base64::decode(&s)).transpose()?,
             public_key: self.public_key.map(|s| pem_decode(&s)).transpose()?,
             user_data: self.user_data.map(|s| base64::decode(&s)).transpose()?,
-        })
+        };
+
+        let fields = [
+            ("nonce", &params.nonce, MAX_NONCE_LEN),
+            ("public_key", &params.public_key, MAX_PUBLIC_KEY_LEN),
+            ("user_data", &params.user_data, MAX_USER_DATA_LEN),
+        ];
+        for (field, data, max) in fields {
+            if let Some(data) = data {
+                check_len(field, data, max)?;
+            }
+        }
+
+        Ok(params)
     }
 }
 
@@ -100,11 +616,51 @@ impl DerPublicKey {
     }
 }
 
+// GET takes the same fields as POST, from the query string, for apps that
+// only have curl at hand
+fn attestation_params(
+    head: &http::request::Parts,
+    body: &[u8],
+) -> std::result::Result<AttestationParams, Response<Body>> {
+    let attestation_req = if head.method == Method::GET {
+        AttestationRequest::from_query(head.uri.query().unwrap_or_default())
+    } else {
+        serde_json::from_slice(body).map_err(|err| http_util::bad_request(err.to_string()))?
+    };
+
+    attestation_req
+        .into_params()
+        .map_err(|err| http_util::bad_request(err.to_string()))
+}
+
 fn pem_decode(pem: &str) -> Result<Vec<u8>> {
     let der = DerPublicKey::from_public_key_pem(pem)?;
     Ok(der.into_bytes())
 }
 
+fn json_response(body: serde_json::Value) -> Result<Response<Body>> {
+    Ok(Response::builder()
+        .status(StatusCode::OK)
+        .header(header::CONTENT_TYPE, MIME_APPLICATION_JSON)
+        .body(Body::from(body.to_string()))?)
+}
+
+// Tells the app apart from the NSM refusing a request (e.g. to extend a
+// locked PCR) and failing
+fn nsm_error(err: anyhow::Error) -> Result<Response<Body>> {
+    match err.downcast_ref::<NsmError>() {
+        Some(NsmError(
+            ErrorCode::InvalidIndex | ErrorCode::InvalidArgument | ErrorCode::InputTooLarge,
+        )) => Ok(http_util::bad_request(err.to_string())),
+        Some(NsmError(ErrorCode::ReadOnlyIndex)) => Ok(http_util::conflict(err.to_string())),
+        _ => Err(err),
+    }
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{b:02x}")).collect()
+}
+
 #[tokio::test]
 async fn test_attestation_handler() {
     use crate::nsm::StaticAttestationProvider;
@@ -139,3 +695,312 @@ async fn test_attestation_handler() {
     let resp = handler.handle(req).await.unwrap();
     assert!(resp.status() == StatusCode::OK);
 }
+
+#[tokio::test]
+async fn test_attestation_query() {
+    use crate::nsm::StaticAttestationProvider;
+    use assert2::assert;
+
+    let handler =
+        ApiHandler::host_facing(Box::new(StaticAttestationProvider::new(b"doc".to_vec())));
+    let get = |uri: &str| {
+        Request::builder()
+            .method("GET")
+            .uri(uri)
+            .body(Body::empty())
+            .unwrap()
+    };
+
+    // base64 has to be escaped for its + and /
+    let nonce: String =
+        form_urlencoded::byte_serialize(base64::encode("the nonce").as_bytes()).collect();
+    let resp = handler
+        .handle(get(&format!("/v1/attestation?nonce={nonce}")))
+        .await
+        .unwrap();
+    assert!(resp.status() == StatusCode::OK);
+    let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+    assert!(&body[..] == b"doc");
+
+    let resp = handler
+        .handle(get("/v1/attestation?nonce=%%%"))
+        .await
+        .unwrap();
+    assert!(resp.status() == StatusCode::BAD_REQUEST);
+
+    // More than the NSM takes
+    let nonce: String =
+        form_urlencoded::byte_serialize(base64::encode([0; 513]).as_bytes()).collect();
+    let resp = handler
+        .handle(get(&format!("/v1/attestation?nonce={nonce}")))
+        .await
+        .unwrap();
+    assert!(resp.status() == StatusCode::BAD_REQUEST);
+
+    let resp = handler.handle(get("/v1/healthz")).await.unwrap();
+    assert!(resp.status() == StatusCode::OK);
+}
+
+#[tokio::test]
+async fn test_host_facing_attestation_handler() {
+    use crate::nsm::StaticAttestationProvider;
+    use assert2::assert;
+
+    let handler = ApiHandler::host_facing(Box::new(StaticAttestationProvider::new(Vec::new())));
+
+    let body = json::object!(
+        nonce: base64::encode("the nonce"),
+    );
+
+    let req = Request::builder()
+        .method("POST")
+        .uri("/v1/attestation")
+        .body(Body::from(json::stringify(body)))
+        .unwrap();
+
+    let resp = handler.handle(req).await.unwrap();
+    assert!(resp.status() == StatusCode::OK);
+
+    let body = json::object!(
+        nonce: base64::encode("the nonce"),
+        user_data: base64::encode("my data"),
+    );
+
+    let req = Request::builder()
+        .method("POST")
+        .uri("/v1/attestation")
+        .body(Body::from(json::stringify(body)))
+        .unwrap();
+
+    let resp = handler.handle(req).await.unwrap();
+    assert!(resp.status() == StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn test_rotate_keys_handler() {
+    use crate::keypair::KeyType;
+    use crate::nsm::StaticAttestationProvider;
+    use assert2::assert;
+
+    let attester = Arc::new(StaticAttestationProvider::new(Vec::new()));
+    let rotator = Arc::new(KeyRotator::new(KeyType::Ed25519, attester).unwrap());
+    let before = rotator.current();
+    let rotate = || {
+        Request::builder()
+            .method("POST")
+            .uri("/v1/keys/rotate")
+            .body(Body::empty())
+            .unwrap()
+    };
+
+    let handler = ApiHandler::new(Box::new(StaticAttestationProvider::new(Vec::new())))
+        .with_key_rotators(vec![rotator.clone()]);
+    let resp = handler.handle(rotate()).await.unwrap();
+    assert!(resp.status() == StatusCode::OK);
+    assert!(!Arc::ptr_eq(&rotator.current(), &before));
+
+    let handler = ApiHandler::host_facing(Box::new(StaticAttestationProvider::new(Vec::new())));
+    let resp = handler.handle(rotate()).await.unwrap();
+    assert!(resp.status() == StatusCode::NOT_FOUND);
+}
+
+#[tokio::test]
+async fn test_attested_certificate_handler() {
+    use crate::nsm::StaticAttestationProvider;
+    use assert2::assert;
+
+    let request = || {
+        let body = serde_json::json!({
+            "dns_names": ["app.enclave"],
+            "key_type": "ecdsa_p384",
+        });
+        Request::builder()
+            .method("POST")
+            .uri("/v1/tls/attested_certificate")
+            .body(Body::from(body.to_string()))
+            .unwrap()
+    };
+
+    let handler = ApiHandler::new(Box::new(StaticAttestationProvider::new(b"doc".to_vec())));
+    let resp = handler.handle(request()).await.unwrap();
+    assert!(resp.status() == StatusCode::OK);
+
+    let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+    let body: serde_json::Value = serde_json::from_slice(&body).unwrap();
+    let pem = body["certificate"].as_str().unwrap();
+    let cert = rustls_pemfile::certs(&mut pem.as_bytes())
+        .unwrap()
+        .remove(0);
+    assert!(let Ok((_, Some(_))) = x509::attested_public_key(&cert));
+
+    // Never to the host
+    let handler = ApiHandler::host_facing(Box::new(StaticAttestationProvider::new(Vec::new())));
+    let resp = handler.handle(request()).await.unwrap();
+    assert!(resp.status() == StatusCode::NOT_FOUND);
+}
+
+#[tokio::test]
+async fn test_derive_key_handler() {
+    use crate::mock_nsm::MockNsm;
+    use crate::nsm::StaticAttestationProvider;
+    use assert2::assert;
+
+    let nsm = Arc::new(Nsm::mock(MockNsm::new().unwrap()));
+    let handler =
+        ApiHandler::new(Box::new(StaticAttestationProvider::new(Vec::new()))).with_nsm(nsm);
+    let derive = |body: serde_json::Value| {
+        let req = Request::builder()
+            .method("POST")
+            .uri("/v1/keys/derive")
+            .body(Body::from(body.to_string()))
+            .unwrap();
+        handler.handle(req)
+    };
+
+    let data_key = base64::encode([7; 32]);
+    let resp = derive(serde_json::json!({ "data_key": data_key, "labels": ["db"] }))
+        .await
+        .unwrap();
+    assert!(resp.status() == StatusCode::OK);
+    let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+    let body: serde_json::Value = serde_json::from_slice(&body).unwrap();
+    let key = base64::decode(body["key"].as_str().unwrap()).unwrap();
+    assert!(key.len() == 32);
+
+    let resp = derive(serde_json::json!({ "data_key": data_key, "labels": [] }))
+        .await
+        .unwrap();
+    assert!(resp.status() == StatusCode::BAD_REQUEST);
+}
+
+#[tokio::test]
+async fn test_time_handler() {
+    use crate::nsm::StaticAttestationProvider;
+    use assert2::assert;
+
+    let get = || {
+        Request::builder()
+            .method("GET")
+            .uri("/v1/time")
+            .body(Body::empty())
+            .unwrap()
+    };
+
+    let handler = ApiHandler::new(Box::new(StaticAttestationProvider::new(Vec::new())));
+    let resp = handler.handle(get()).await.unwrap();
+    assert!(resp.status() == StatusCode::NOT_FOUND);
+
+    // No bounds until the host pushed its time
+    let handler = handler.with_clock(TrustedClock::new());
+    let resp = handler.handle(get()).await.unwrap();
+    assert!(resp.status() == StatusCode::SERVICE_UNAVAILABLE);
+}
+
+#[tokio::test]
+async fn test_hpke_handlers() {
+    use crate::attestation_doc::AttestationDoc;
+    use crate::mock_nsm::MockNsm;
+    use crate::nsm::NsmAttestationProvider;
+    use assert2::assert;
+
+    let nsm = Arc::new(Nsm::mock(MockNsm::new().unwrap()));
+    let key = Arc::new(HpkeKeyPair::generate());
+    let handler = ApiHandler::new(Box::new(NsmAttestationProvider::new(nsm.clone())))
+        .with_hpke_key(key.clone());
+
+    let req = Request::builder()
+        .method("GET")
+        .uri("/v1/hpke/attestation")
+        .body(Body::empty())
+        .unwrap();
+    let resp = handler.handle(req).await.unwrap();
+    assert!(resp.status() == StatusCode::OK);
+    let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+    let doc = AttestationDoc::decode(&body).unwrap();
+    let public_key = doc.public_key.unwrap();
+    assert!(public_key == key.public_key());
+
+    let message = crate::hpke::seal(&public_key, b"secret", b"").unwrap();
+    let open = |body: serde_json::Value| {
+        let req = Request::builder()
+            .method("POST")
+            .uri("/v1/hpke/open")
+            .body(Body::from(body.to_string()))
+            .unwrap();
+        handler.handle(req)
+    };
+    let resp = open(message.to_json()).await.unwrap();
+    assert!(resp.status() == StatusCode::OK);
+    let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+    let body: serde_json::Value = serde_json::from_slice(&body).unwrap();
+    assert!(body["plaintext"] == base64::encode(b"secret"));
+
+    let mut wrong_aad = message.to_json();
+    wrong_aad["aad"] = base64::encode(b"aad").into();
+    let resp = open(wrong_aad).await.unwrap();
+    assert!(resp.status() == StatusCode::BAD_REQUEST);
+
+    // The host gets the document, but cannot open messages
+    let host =
+        ApiHandler::host_facing(Box::new(NsmAttestationProvider::new(nsm))).with_hpke_key(key);
+    let req = Request::builder()
+        .method("POST")
+        .uri("/v1/hpke/open")
+        .body(Body::from(message.to_json().to_string()))
+        .unwrap();
+    let resp = host.handle(req).await.unwrap();
+    assert!(resp.status() == StatusCode::NOT_FOUND);
+}
+
+#[tokio::test]
+async fn test_measurements_handler() {
+    use crate::mock_nsm::MockNsm;
+    use crate::nsm::StaticAttestationProvider;
+    use assert2::assert;
+
+    let get = |path: &str| {
+        Request::builder()
+            .method("GET")
+            .uri(path)
+            .body(Body::empty())
+            .unwrap()
+    };
+
+    let nsm = Nsm::mock(MockNsm::new().unwrap());
+    let handler = ApiHandler::new(Box::new(StaticAttestationProvider::new(Vec::new())))
+        .with_manifest(serde_json::json!({ "name": "app" }))
+        .with_measurements(Measurements::read(&nsm).unwrap());
+
+    let resp = handler.handle(get("/v1/measurements")).await.unwrap();
+    assert!(resp.status() == StatusCode::OK);
+    let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+    let body: serde_json::Value = serde_json::from_slice(&body).unwrap();
+    // The mock's PCRs are zero, as in debug mode
+    assert!(body["debug_mode"] == true);
+    assert!(body["pcrs"]["8"] == hex(&[0; 48]));
+
+    let resp = handler.handle(get("/v1/manifest")).await.unwrap();
+    let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+    let body: serde_json::Value = serde_json::from_slice(&body).unwrap();
+    assert!(body["name"] == "app");
+
+    let handler = ApiHandler::host_facing(Box::new(StaticAttestationProvider::new(Vec::new())))
+        .with_measurements(Measurements::read(&nsm).unwrap());
+    let resp = handler.handle(get("/v1/measurements")).await.unwrap();
+    assert!(resp.status() == StatusCode::NOT_FOUND);
+}
+
+#[test]
+fn test_nsm_error() {
+    use assert2::assert;
+
+    let resp = nsm_error(NsmError(ErrorCode::ReadOnlyIndex).into()).unwrap();
+    assert!(resp.status() == StatusCode::CONFLICT);
+
+    let resp = nsm_error(NsmError(ErrorCode::InvalidIndex).into()).unwrap();
+    assert!(resp.status() == StatusCode::BAD_REQUEST);
+
+    // Left to the server to answer with a 500
+    assert!(nsm_error(NsmError(ErrorCode::InternalError).into()).is_err());
+    assert!(nsm_error(anyhow::anyhow!("no NSM")).is_err());
+}
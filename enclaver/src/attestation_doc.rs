@@ -0,0 +1,245 @@
+use std::collections::BTreeMap;
+use std::fmt;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, Result};
+use serde::Deserialize;
+use serde_bytes::{ByteBuf, Bytes};
+use serde_json::json;
+
+use crate::access_log::rfc3339;
+use crate::pcr_policy;
+use crate::x509;
+
+// An attestation document as the NSM signs it: a COSE_Sign1 (RFC 8152,
+// 4.2) with the CBOR of the document as its payload. The unprotected
+// headers are empty, and are not kept.
+pub struct CoseSign1 {
+    pub protected: Vec<u8>,
+    pub payload: Vec<u8>,
+    pub signature: Vec<u8>,
+}
+
+impl CoseSign1 {
+    pub fn decode(doc: &[u8]) -> Result<Self> {
+        let (protected, _, payload, signature): (ByteBuf, serde_cbor::Value, ByteBuf, ByteBuf) =
+            serde_cbor::from_slice(doc)
+                .map_err(|err| anyhow!("not a COSE_Sign1 document: {err}"))?;
+
+        Ok(Self {
+            protected: protected.into_vec(),
+            payload: payload.into_vec(),
+            signature: signature.into_vec(),
+        })
+    }
+
+    // The alg of the protected headers, e.g. -35 for ES384
+    pub fn alg(&self) -> Result<Option<i128>> {
+        let headers: BTreeMap<i128, serde_cbor::Value> = serde_cbor::from_slice(&self.protected)?;
+        match headers.get(&1) {
+            Some(serde_cbor::Value::Integer(alg)) => Ok(Some(*alg)),
+            Some(_) => Err(anyhow!("invalid alg in the protected headers")),
+            None => Ok(None),
+        }
+    }
+
+    // What the signature is over, the Sig_structure with no external data
+    pub fn signed_data(&self) -> Result<Vec<u8>> {
+        let signed = (
+            "Signature1",
+            Bytes::new(&self.protected),
+            Bytes::new(&[]),
+            Bytes::new(&self.payload),
+        );
+        Ok(serde_cbor::to_vec(&signed)?)
+    }
+}
+
+// The payload of an attestation document, as is. Nothing here is verified,
+// which is for challenge::Verifier to do.
+#[derive(Debug, Clone)]
+pub struct AttestationDoc {
+    pub module_id: String,
+    pub digest: String,
+    pub timestamp: SystemTime,
+    pub pcrs: BTreeMap<u16, Vec<u8>>,
+    // In DER, the certificate of the NSM and the chain from the root to it
+    pub certificate: Vec<u8>,
+    pub cabundle: Vec<Vec<u8>>,
+    pub public_key: Option<Vec<u8>>,
+    pub user_data: Option<Vec<u8>>,
+    pub nonce: Option<Vec<u8>>,
+}
+
+// As the NSM encodes the payload of its documents
+#[derive(Deserialize)]
+struct Payload {
+    module_id: String,
+    digest: String,
+    timestamp: u64,
+    pcrs: BTreeMap<u16, ByteBuf>,
+    certificate: ByteBuf,
+    cabundle: Vec<ByteBuf>,
+    public_key: Option<ByteBuf>,
+    user_data: Option<ByteBuf>,
+    nonce: Option<ByteBuf>,
+}
+
+impl AttestationDoc {
+    pub fn decode(doc: &[u8]) -> Result<Self> {
+        Self::from_payload(&CoseSign1::decode(doc)?.payload)
+    }
+
+    pub fn from_payload(payload: &[u8]) -> Result<Self> {
+        let payload: Payload = serde_cbor::from_slice(payload)
+            .map_err(|err| anyhow!("invalid attestation document: {err}"))?;
+
+        Ok(Self {
+            module_id: payload.module_id,
+            digest: payload.digest,
+            timestamp: UNIX_EPOCH + Duration::from_millis(payload.timestamp),
+            pcrs: payload
+                .pcrs
+                .into_iter()
+                .map(|(index, value)| (index, value.into_vec()))
+                .collect(),
+            certificate: payload.certificate.into_vec(),
+            cabundle: payload
+                .cabundle
+                .into_iter()
+                .map(ByteBuf::into_vec)
+                .collect(),
+            public_key: payload.public_key.map(ByteBuf::into_vec),
+            user_data: payload.user_data.map(ByteBuf::into_vec),
+            nonce: payload.nonce.map(ByteBuf::into_vec),
+        })
+    }
+
+    pub fn is_debug(&self) -> bool {
+        pcr_policy::is_debug(&self.pcrs)
+    }
+
+    // For `enclaver attest decode --json`. Certificates that do not parse
+    // are shown as null rather than failing the whole document.
+    pub fn to_json(&self) -> serde_json::Value {
+        let pcrs: serde_json::Map<String, serde_json::Value> = self
+            .pcrs
+            .iter()
+            .map(|(index, value)| (index.to_string(), hex(value).into()))
+            .collect();
+        let cert_json = |cert: &[u8]| {
+            x509::describe(cert).ok().map(|info| {
+                json!({
+                    "subject": info.subject,
+                    "issuer": info.issuer,
+                    "not_before": info.not_before,
+                    "not_after": info.not_after,
+                })
+            })
+        };
+
+        json!({
+            "module_id": self.module_id,
+            "digest": self.digest,
+            "timestamp": rfc3339(self.timestamp),
+            "debug_mode": self.is_debug(),
+            "pcrs": pcrs,
+            "certificate": cert_json(&self.certificate),
+            "cabundle": self.cabundle.iter().map(|cert| cert_json(cert)).collect::<Vec<_>>(),
+            "public_key": self.public_key.as_deref().map(base64::encode),
+            "user_data": self.user_data.as_deref().map(base64::encode),
+            "nonce": self.nonce.as_deref().map(base64::encode),
+        })
+    }
+}
+
+// A table for people, e.g. to compare PCRs against a key policy that
+// keeps denying an enclave
+impl fmt::Display for AttestationDoc {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(f, "Module ID:   {}", self.module_id)?;
+        writeln!(f, "Timestamp:   {}", rfc3339(self.timestamp))?;
+        writeln!(f, "Digest:      {}", self.digest)?;
+        let debug = if self.is_debug() { "yes" } else { "no" };
+        writeln!(f, "Debug mode:  {debug}")?;
+
+        writeln!(f, "PCRs:")?;
+        for (index, value) in &self.pcrs {
+            writeln!(f, "  {index:<4}{}", hex(value))?;
+        }
+
+        writeln!(f, "Certificate:")?;
+        write_certificate(f, &self.certificate)?;
+        writeln!(f, "CA bundle:")?;
+        for cert in &self.cabundle {
+            write_certificate(f, cert)?;
+        }
+
+        write_bytes(f, "Nonce:", self.nonce.as_deref())?;
+        write_bytes(f, "User data:", self.user_data.as_deref())?;
+        write_bytes(f, "Public key:", self.public_key.as_deref())
+    }
+}
+
+fn write_certificate(f: &mut fmt::Formatter<'_>, cert: &[u8]) -> fmt::Result {
+    match x509::describe(cert) {
+        Ok(info) => {
+            writeln!(f, "  {}", info.subject)?;
+            writeln!(f, "    issuer:  {}", info.issuer)?;
+            writeln!(f, "    valid:   {} to {}", info.not_before, info.not_after)
+        }
+        Err(err) => writeln!(f, "  unreadable ({err})"),
+    }
+}
+
+// In base64, and as text too if that is what it is
+fn write_bytes(f: &mut fmt::Formatter<'_>, label: &str, bytes: Option<&[u8]>) -> fmt::Result {
+    let bytes = match bytes {
+        Some(bytes) => bytes,
+        None => return writeln!(f, "{label:<13}none"),
+    };
+
+    writeln!(f, "{label:<13}{}", base64::encode(bytes))?;
+    match std::str::from_utf8(bytes) {
+        Ok(text) if !text.chars().any(char::is_control) => writeln!(f, "{:<13}{text:?}", ""),
+        _ => Ok(()),
+    }
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{b:02x}")).collect()
+}
+
+#[cfg(all(test, feature = "odyn"))]
+mod tests {
+    use super::AttestationDoc;
+    use crate::mock_nsm::MockNsm;
+    use crate::nsm::{AttestationParams, Nsm};
+    use assert2::assert;
+
+    #[test]
+    fn test_decode() {
+        let nsm = Nsm::mock(MockNsm::new().unwrap());
+        let doc = nsm
+            .attestation(AttestationParams {
+                nonce: Some(vec![1, 2, 3]),
+                user_data: Some(b"user data".to_vec()),
+                public_key: None,
+            })
+            .unwrap();
+
+        let doc = AttestationDoc::decode(&doc).unwrap();
+        assert!(doc.nonce == Some(vec![1, 2, 3]));
+        assert!(doc.is_debug());
+
+        let json = doc.to_json();
+        assert!(json["user_data"] == base64::encode(b"user data"));
+        assert!(json["certificate"]["subject"].is_string());
+
+        let table = doc.to_string();
+        assert!(table.contains("\"user data\""));
+        assert!(table.contains(&format!("Module ID:   {}", doc.module_id)));
+
+        assert!(AttestationDoc::decode(b"not cbor").is_err());
+    }
+}
@@ -1,5 +1,7 @@
 use anyhow::Result;
 use clap::{Parser, Subcommand};
+use enclaver::admin::AdminServer;
+use enclaver::crash::CrashTarget;
 use enclaver::constants::{MANIFEST_FILE_NAME, RELEASE_BUNDLE_DIR, EIF_FILE_NAME};
 use enclaver::run::{Enclave, EnclaveExitStatus, EnclaveOpts};
 use enclaver::manifest::load_manifest_raw;
@@ -8,6 +10,7 @@ use log::info;
 use std::{
     path::PathBuf,
     process::{ExitCode, Termination},
+    time::Duration,
 };
 use tokio_util::sync::CancellationToken;
 use tokio::io::{stdout, AsyncWriteExt};
@@ -15,6 +18,8 @@ use tokio::io::{stdout, AsyncWriteExt};
 const ENCLAVE_SIGNALED_EXIT_CODE: u8 = 107;
 const ENCLAVE_FATAL: u8 = 108;
 const ENCLAVER_INTERRUPTED: u8 = 109;
+const ENCLAVE_DIED: u8 = 110;
+const ENCLAVE_BOOT_TIMEOUT: u8 = 111;
 
 #[derive(Debug, Parser)]
 #[clap(author, version, about, long_about = None)]
@@ -34,6 +39,30 @@ struct Cli {
     #[clap(long)]
     debug_mode: bool,
 
+    /// Seconds to wait for the enclave to boot before giving up on it
+    #[clap(long)]
+    boot_timeout: Option<u64>,
+
+    /// Seconds the app has to shut down before the enclave is terminated
+    #[clap(long)]
+    shutdown_grace: Option<u64>,
+
+    /// Save a crash report to this directory (or s3://bucket/prefix) on abnormal exit
+    #[clap(long)]
+    crash_dir: Option<CrashTarget>,
+
+    /// Reload the egress rules whenever the manifest file changes
+    #[clap(long)]
+    watch_manifest: bool,
+
+    /// Serve the admin API on a unix socket at this path
+    #[clap(long, parse(from_os_str))]
+    admin_socket: Option<PathBuf>,
+
+    /// Talk to a simulated enclave over vsock loopback instead of starting the EIF
+    #[clap(long, conflicts_with = "debug_mode")]
+    simulate: bool,
+
     #[clap(subcommand)]
     sub_command: Option<SubCommand>,
 }
@@ -55,23 +84,23 @@ enum CLISuccess {
 impl Termination for CLISuccess {
     fn report(self) -> ExitCode {
         match self {
-            CLISuccess::EnclaveStatus(EnclaveExitStatus::Exited(code)) => {
-                ExitCode::from(code as u8)
-            }
-            CLISuccess::EnclaveStatus(EnclaveExitStatus::Signaled(_signal)) => {
-                ExitCode::from(ENCLAVE_SIGNALED_EXIT_CODE)
-            }
-            CLISuccess::EnclaveStatus(EnclaveExitStatus::Fatal(_err)) => {
-                ExitCode::from(ENCLAVE_FATAL)
-            }
-            CLISuccess::EnclaveStatus(EnclaveExitStatus::Cancelled) => {
-                ExitCode::from(ENCLAVER_INTERRUPTED)
-            },
+            CLISuccess::EnclaveStatus(status) => ExitCode::from(exit_code(&status)),
             CLISuccess::Ok => ExitCode::SUCCESS,
         }
     }
 }
 
+fn exit_code(status: &EnclaveExitStatus) -> u8 {
+    match status {
+        EnclaveExitStatus::Exited(code) => *code as u8,
+        EnclaveExitStatus::Signaled(_signal) => ENCLAVE_SIGNALED_EXIT_CODE,
+        EnclaveExitStatus::Fatal(_err) => ENCLAVE_FATAL,
+        EnclaveExitStatus::Cancelled => ENCLAVER_INTERRUPTED,
+        EnclaveExitStatus::Died(_reason) => ENCLAVE_DIED,
+        EnclaveExitStatus::BootTimeout(_timeout) => ENCLAVE_BOOT_TIMEOUT,
+    }
+}
+
 async fn run(args: Cli) -> Result<CLISuccess> {
     let shutdown_signal = enclaver::utils::register_shutdown_signal_handler().await?;
 
@@ -81,9 +110,25 @@ async fn run(args: Cli) -> Result<CLISuccess> {
         cpu_count: args.cpu_count,
         memory_mb: args.memory_mb,
         debug_mode: args.debug_mode,
+        boot_timeout: args.boot_timeout.map(Duration::from_secs),
+        shutdown_grace: args.shutdown_grace.map(Duration::from_secs),
+        crash_target: args.crash_dir,
+        watch_manifest: args.watch_manifest,
+        simulate: args.simulate,
     })
     .await?;
 
+    let admin_task = match args.admin_socket {
+        Some(ref path) => {
+            let admin = AdminServer::bind(path)?;
+            let handle = enclave.handle();
+            Some(tokio::task::spawn(async move {
+                admin.serve(handle).await;
+            }))
+        }
+        None => None,
+    };
+
     let cancellation = CancellationToken::new();
 
     // Wait for the shutdown signal in a separate task. If the signal comes, cancel the
@@ -102,6 +147,11 @@ async fn run(args: Cli) -> Result<CLISuccess> {
     cancel_task.abort();
     _ = cancel_task.await;
 
+    if let Some(admin_task) = admin_task {
+        admin_task.abort();
+        _ = admin_task.await;
+    }
+
     Ok(CLISuccess::EnclaveStatus(status))
 }
 
@@ -135,3 +185,20 @@ async fn main() -> Result<CLISuccess> {
         Some(SubCommand::DescribeEif) => describe_eif().await,
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::{exit_code, ENCLAVE_BOOT_TIMEOUT, ENCLAVE_SIGNALED_EXIT_CODE};
+    use assert2::assert;
+    use enclaver::run::EnclaveExitStatus;
+    use std::time::Duration;
+
+    #[test]
+    fn test_exit_code() {
+        assert!(exit_code(&EnclaveExitStatus::Exited(3)) == 3);
+        assert!(exit_code(&EnclaveExitStatus::Signaled(9)) == ENCLAVE_SIGNALED_EXIT_CODE);
+        let timeout = EnclaveExitStatus::BootTimeout(Duration::from_secs(1));
+        assert!(exit_code(&timeout) == ENCLAVE_BOOT_TIMEOUT);
+        assert!(ENCLAVE_BOOT_TIMEOUT == 111);
+    }
+}
@@ -1,11 +1,25 @@
+use std::path::{Path, PathBuf};
+use std::time::{Duration, UNIX_EPOCH};
+
 use anyhow::{anyhow, Result};
 use clap::{Parser, Subcommand};
 use enclaver::{
-    build::EnclaveArtifactBuilder, constants::MANIFEST_FILE_NAME, manifest::load_manifest,
+    admin_client::AdminClient,
+    attestation_doc::AttestationDoc,
+    build::EnclaveArtifactBuilder,
+    challenge::{Attestation, Challenge, Verifier},
+    constants::MANIFEST_FILE_NAME,
+    hpke, kms_policy,
+    manifest::load_manifest,
+    nitro_cli::EIFInfo,
+    pcr_policy::PcrPolicy,
     run_container::RunWrapper,
 };
 use log::{debug, error};
-use tokio::io::{stdout, AsyncWriteExt};
+use tokio::io::{stdin, stdout, AsyncReadExt, AsyncWriteExt};
+
+#[cfg(feature = "proxy")]
+use enclaver::{keypair::KeyPair, proxy::pkcs7::ContentInfo};
 
 #[derive(Debug, Parser)]
 #[clap(author, version)]
@@ -62,6 +76,221 @@ enum Commands {
         #[clap(short = 'p', long = "publish")]
         /// Port to expose on the host machine, for example: 8080:80.
         port_forwards: Vec<String>,
+
+        #[clap(long = "simulate")]
+        /// Simulate the enclave with a container, rather than running it in a Nitro Enclave.
+        ///
+        /// The image of the enclave is built from the manifest, with odyn using a mock NSM,
+        /// and run next to the Enclaver image, which talks to it over vsock loopback. Needs
+        /// Linux with the vsock_loopback module loaded, but no Nitro Enclaves support.
+        simulate: bool,
+    },
+
+    #[clap(name = "attest", subcommand)]
+    /// Work with attestation documents of a running enclave.
+    Attest(AttestCommands),
+
+    #[cfg(feature = "proxy")]
+    #[clap(name = "cms", subcommand)]
+    /// Work with the CMS messages KMS encrypts to enclaves.
+    Cms(CmsCommands),
+}
+
+#[cfg(feature = "proxy")]
+#[derive(Debug, Subcommand)]
+enum CmsCommands {
+    #[clap(name = "decrypt")]
+    /// Decrypt a CiphertextForRecipient of KMS with a private key, to debug an integration.
+    ///
+    /// Prints who the recipients are and how the content is encrypted, then
+    /// the plaintext, quoted if it is text and in hex otherwise. Meant for keys
+    /// made outside an enclave for the purpose, e.g. with openssl genpkey, as
+    /// the key of an enclave never leaves it.
+    Decrypt {
+        #[clap(long = "key", parse(from_os_str))]
+        /// PEM file of the private key, in PKCS#8.
+        key: PathBuf,
+
+        #[clap(long = "certificate", parse(from_os_str))]
+        /// PEM file of the certificate of the key, for recipients identified by its issuer and serial number.
+        certificate: Option<PathBuf>,
+
+        #[clap(long = "hex")]
+        /// Print the plaintext in hex, even if it is text.
+        hex: bool,
+
+        #[clap(parse(from_os_str))]
+        /// File of the CiphertextForRecipient, in base64 as KMS returns it. Defaults to stdin.
+        ciphertext: Option<PathBuf>,
+    },
+}
+
+#[derive(Debug, Subcommand)]
+enum AttestCommands {
+    #[clap(name = "fetch")]
+    /// Fetch a fresh attestation document from a running enclave, in CBOR.
+    ///
+    /// The document is asked of the enclave through the admin API of the wrapper
+    /// (see the --admin-socket option of enclaver-run), so that verifiers need no
+    /// help from the application.
+    Fetch {
+        #[clap(long = "admin-socket", parse(from_os_str))]
+        /// Path to the admin socket of the wrapper running the enclave.
+        admin_socket: PathBuf,
+
+        #[clap(long = "nonce")]
+        /// Base64 encoded nonce to include in the document, to tell it from a replay.
+        nonce: Option<String>,
+
+        #[clap(long = "output", short = 'o', parse(from_os_str))]
+        /// File to write the document to. Defaults to stdout.
+        output: Option<PathBuf>,
+    },
+
+    #[clap(name = "challenge")]
+    /// Challenge a running enclave to prove that it is what it claims to be.
+    ///
+    /// Sends a random nonce to the enclave through the admin API of the wrapper
+    /// and verifies the attestation document it answers with: its certificate
+    /// chain up to the given root, the nonce, how fresh it is and the PCRs
+    /// expected. Prints what the document attests to.
+    Challenge {
+        #[clap(long = "admin-socket", parse(from_os_str))]
+        /// Path to the admin socket of the wrapper running the enclave.
+        admin_socket: PathBuf,
+
+        #[clap(long = "root", parse(from_os_str))]
+        /// PEM file of the root certificate, that of AWS Nitro Enclaves.
+        root: PathBuf,
+
+        #[clap(long = "pcr")]
+        /// PCR the enclave must have, as <index>=<hex value> or <index>=any. May be repeated.
+        pcrs: Vec<String>,
+
+        #[clap(long = "signing-cert", parse(from_os_str))]
+        /// PEM file of the certificate the EIF must have been signed with, as PCR8 attests.
+        signing_cert: Option<PathBuf>,
+
+        #[clap(long = "allow-debug")]
+        /// Accept enclaves in debug mode, whose PCR0-4 and PCR8 are zeros and go unchecked.
+        allow_debug: bool,
+    },
+
+    #[clap(name = "verify")]
+    /// Verify an attestation document fetched earlier, e.g. with fetch.
+    ///
+    /// Checks the certificate chain up to the given root, the nonce if given
+    /// and the PCRs expected, and how old the document is if --max-age is
+    /// given. Prints what the document attests to.
+    Verify {
+        #[clap(long = "root", parse(from_os_str))]
+        /// PEM file of the root certificate, that of AWS Nitro Enclaves.
+        root: PathBuf,
+
+        #[clap(long = "nonce")]
+        /// Base64 encoded nonce the document must include.
+        nonce: Option<String>,
+
+        #[clap(long = "max-age")]
+        /// Seconds the document may have been made ago, by the clock of this host.
+        max_age: Option<u64>,
+
+        #[clap(long = "pcr")]
+        /// PCR the enclave must have, as <index>=<hex value> or <index>=any. May be repeated.
+        pcrs: Vec<String>,
+
+        #[clap(long = "signing-cert", parse(from_os_str))]
+        /// PEM file of the certificate the EIF must have been signed with, as PCR8 attests.
+        signing_cert: Option<PathBuf>,
+
+        #[clap(long = "allow-debug")]
+        /// Accept enclaves in debug mode, whose PCR0-4 and PCR8 are zeros and go unchecked.
+        allow_debug: bool,
+
+        #[clap(parse(from_os_str))]
+        /// File of the document, in CBOR.
+        document: PathBuf,
+    },
+
+    #[clap(name = "seal")]
+    /// Encrypt a message from stdin to the HPKE key of an enclave.
+    ///
+    /// The document, from GET /v1/hpke/attestation, is verified as with
+    /// verify before anything is sealed to the key it binds. Prints the
+    /// message as POST /v1/hpke/open of the enclave takes it.
+    Seal {
+        #[clap(long = "root", parse(from_os_str))]
+        /// PEM file of the root certificate, that of AWS Nitro Enclaves.
+        root: PathBuf,
+
+        #[clap(long = "nonce")]
+        /// Base64 encoded nonce the document must include.
+        nonce: Option<String>,
+
+        #[clap(long = "max-age")]
+        /// Seconds the document may have been made ago, by the clock of this host.
+        max_age: Option<u64>,
+
+        #[clap(long = "pcr")]
+        /// PCR the enclave must have, as <index>=<hex value> or <index>=any. May be repeated.
+        pcrs: Vec<String>,
+
+        #[clap(long = "signing-cert", parse(from_os_str))]
+        /// PEM file of the certificate the EIF must have been signed with, as PCR8 attests.
+        signing_cert: Option<PathBuf>,
+
+        #[clap(long = "allow-debug")]
+        /// Accept enclaves in debug mode, whose PCR0-4 and PCR8 are zeros and go unchecked.
+        allow_debug: bool,
+
+        #[clap(long = "aad")]
+        /// Base64 encoded associated data, which the enclave must give to open the message.
+        aad: Option<String>,
+
+        #[clap(parse(from_os_str))]
+        /// File of the document, in CBOR.
+        document: PathBuf,
+    },
+
+    #[clap(name = "decode")]
+    /// Print what an attestation document says, without verifying it.
+    ///
+    /// Shows the module ID, timestamp, PCRs, certificate chain, nonce and
+    /// user data, e.g. to compare the PCRs with those a KMS key policy expects.
+    Decode {
+        #[clap(long = "json")]
+        /// Print JSON rather than a table.
+        json: bool,
+
+        #[clap(parse(from_os_str))]
+        /// File of the document, in CBOR. Defaults to stdin.
+        document: Option<PathBuf>,
+    },
+
+    #[clap(name = "kms-policy")]
+    /// Print the Condition of a KMS key policy statement for an enclave image.
+    ///
+    /// Only enclaves with these PCRs (in their attestation, as the KMS proxy
+    /// of the runtime sends it) are then allowed the actions of the statement.
+    /// The PCRs are those of the EIF info printed by build, or given with --pcr.
+    /// With --principal, prints the whole statement, which --apply-to merges
+    /// into the policy of a key.
+    KmsPolicy {
+        #[clap(long = "eif-info", parse(from_os_str))]
+        /// JSON file of the EIF info printed by build.
+        eif_info: Option<PathBuf>,
+
+        #[clap(long = "pcr")]
+        /// PCR the enclave must have, as <index>=<hex value>. May be repeated.
+        pcrs: Vec<String>,
+
+        #[clap(long = "principal")]
+        /// ARN of the AWS principal to allow, e.g. the role of the instances.
+        principal: Option<String>,
+
+        #[clap(long = "apply-to", requires = "principal")]
+        /// ID or ARN of a KMS key to add the statement to, with the AWS credentials of the environment.
+        apply_to: Option<String>,
     },
 }
 
@@ -110,7 +339,25 @@ async fn run(args: Cli) -> Result<()> {
             manifest_file,
             image_name,
             port_forwards,
+            simulate,
         } => {
+            // The image of a simulated enclave is built from the manifest
+            let simulation_image = match (simulate, &manifest_file, &image_name) {
+                (false, _, _) => None,
+                (true, _, Some(_)) => {
+                    return Err(anyhow!(
+                        "--simulate needs a manifest file rather than an image name"
+                    ))
+                }
+                (true, manifest_file, None) => {
+                    let manifest_file = manifest_file
+                        .clone()
+                        .unwrap_or_else(|| MANIFEST_FILE_NAME.to_string());
+                    let builder = EnclaveArtifactBuilder::new(false)?;
+                    Some(builder.build_simulation(&manifest_file).await?)
+                }
+            };
+
             let image_name = match (manifest_file, image_name) {
                 // If an image was specified, use it
                 (None, Some(image_name)) => Ok(image_name),
@@ -134,8 +381,19 @@ async fn run(args: Cli) -> Result<()> {
 
             let shutdown_signal = enclaver::utils::register_shutdown_signal_handler().await?;
 
+            let run = async {
+                match simulation_image {
+                    Some(ref image) => {
+                        runner
+                            .run_simulated_image(&image_name, image.to_str(), port_forwards)
+                            .await
+                    }
+                    None => runner.run_enclaver_image(&image_name, port_forwards).await,
+                }
+            };
+
             tokio::select! {
-                res = runner.run_enclaver_image(&image_name, port_forwards) => {
+                res = run => {
                     debug!("enclave exited");
                     match res {
                         Ok(_) => debug!("enclave exited successfully"),
@@ -151,9 +409,271 @@ async fn run(args: Cli) -> Result<()> {
 
             Ok(())
         }
+
+        // Fetch an attestation document through the admin API of the wrapper.
+        Commands::Attest(AttestCommands::Fetch {
+            admin_socket,
+            nonce,
+            output,
+        }) => {
+            let nonce = nonce
+                .map(base64::decode)
+                .transpose()
+                .map_err(|err| anyhow!("invalid nonce: {err}"))?;
+
+            let client = AdminClient::new(admin_socket);
+            let doc = client.attestation(nonce.as_deref()).await?;
+
+            match output {
+                Some(path) => tokio::fs::write(path, doc).await?,
+                None => {
+                    let mut stdout = stdout();
+                    stdout.write_all(&doc).await?;
+                    stdout.flush().await?;
+                }
+            }
+
+            Ok(())
+        }
+
+        // Verify a fresh attestation document against a challenge of our own.
+        Commands::Attest(AttestCommands::Challenge {
+            admin_socket,
+            root,
+            pcrs,
+            signing_cert,
+            allow_debug,
+        }) => {
+            let policy = pcr_policy(&pcrs, signing_cert.as_deref())
+                .await?
+                .with_debug(allow_debug);
+            let verifier = Verifier::new(read_certificate(&root).await?).with_policy(policy);
+
+            let challenge = Challenge::new();
+            let client = AdminClient::new(admin_socket);
+            let doc = client.attestation(Some(challenge.nonce())).await?;
+            let attestation = verifier.verify(&challenge, &doc)?;
+
+            print_attestation(attestation)
+        }
+
+        // Verify an attestation document from a file, with no challenge of our own.
+        Commands::Attest(AttestCommands::Verify {
+            root,
+            nonce,
+            max_age,
+            pcrs,
+            signing_cert,
+            allow_debug,
+            document,
+        }) => {
+            let nonce = nonce
+                .map(base64::decode)
+                .transpose()
+                .map_err(|err| anyhow!("invalid nonce: {err}"))?;
+
+            let policy = pcr_policy(&pcrs, signing_cert.as_deref())
+                .await?
+                .with_debug(allow_debug);
+            let mut verifier = Verifier::new(read_certificate(&root).await?).with_policy(policy);
+            if let Some(max_age) = max_age {
+                verifier = verifier.with_max_document_age(Duration::from_secs(max_age));
+            }
+
+            let doc = tokio::fs::read(&document).await?;
+            let attestation = verifier.verify_document(&doc, nonce.as_deref())?;
+
+            print_attestation(attestation)
+        }
+
+        // Seal a message to the key of a verified document.
+        Commands::Attest(AttestCommands::Seal {
+            root,
+            nonce,
+            max_age,
+            pcrs,
+            signing_cert,
+            allow_debug,
+            aad,
+            document,
+        }) => {
+            let nonce = nonce
+                .map(base64::decode)
+                .transpose()
+                .map_err(|err| anyhow!("invalid nonce: {err}"))?;
+            let aad = aad
+                .map(base64::decode)
+                .transpose()
+                .map_err(|err| anyhow!("invalid aad: {err}"))?
+                .unwrap_or_default();
+
+            let policy = pcr_policy(&pcrs, signing_cert.as_deref())
+                .await?
+                .with_debug(allow_debug);
+            let mut verifier = Verifier::new(read_certificate(&root).await?).with_policy(policy);
+            if let Some(max_age) = max_age {
+                verifier = verifier.with_max_document_age(Duration::from_secs(max_age));
+            }
+
+            let doc = tokio::fs::read(&document).await?;
+            let attestation = verifier.verify_document(&doc, nonce.as_deref())?;
+
+            let mut plaintext = Vec::new();
+            stdin().read_to_end(&mut plaintext).await?;
+            let message = hpke::seal_to(&attestation, &plaintext, &aad)?;
+            println!("{}", message.to_json());
+
+            Ok(())
+        }
+
+        // Print an attestation document as it is, verified or not.
+        Commands::Attest(AttestCommands::Decode { json, document }) => {
+            let doc = match document {
+                Some(path) => tokio::fs::read(path).await?,
+                None => {
+                    let mut doc = Vec::new();
+                    stdin().read_to_end(&mut doc).await?;
+                    doc
+                }
+            };
+            let doc = AttestationDoc::decode(&doc)?;
+
+            if json {
+                println!("{}", serde_json::to_string_pretty(&doc.to_json())?);
+            } else {
+                print!("{doc}");
+            }
+
+            Ok(())
+        }
+
+        // Print a KMS key policy condition on the PCRs of an enclave.
+        Commands::Attest(AttestCommands::KmsPolicy {
+            eif_info,
+            pcrs,
+            principal,
+            apply_to,
+        }) => {
+            let policy = match eif_info {
+                Some(path) => {
+                    let eif_info: EIFInfo = serde_json::from_slice(&tokio::fs::read(path).await?)?;
+                    eif_info.pcr_policy()?
+                }
+                None if pcrs.is_empty() => {
+                    return Err(anyhow!("either --eif-info or --pcr is required"))
+                }
+                None => PcrPolicy::new(),
+            };
+            let policy = pcrs
+                .iter()
+                .try_fold(policy, |policy, pcr| policy.with_arg(pcr))?;
+
+            let output = match principal {
+                Some(principal) => kms_policy::statement(&policy, &principal),
+                None => policy.kms_condition(),
+            };
+            println!("{}", serde_json::to_string_pretty(&output)?);
+
+            if let Some(key_id) = apply_to {
+                kms_policy::apply(&key_id, output).await?;
+            }
+
+            Ok(())
+        }
+
+        // Decrypt what KMS encrypted to a key, outside of any enclave.
+        #[cfg(feature = "proxy")]
+        Commands::Cms(CmsCommands::Decrypt {
+            key,
+            certificate,
+            hex: as_hex,
+            ciphertext,
+        }) => {
+            let ciphertext = match ciphertext {
+                Some(path) => tokio::fs::read(path).await?,
+                None => {
+                    let mut ciphertext = Vec::new();
+                    stdin().read_to_end(&mut ciphertext).await?;
+                    ciphertext
+                }
+            };
+            // Wrapped or not
+            let ciphertext: String = String::from_utf8(ciphertext)?.split_whitespace().collect();
+            let ber = base64::decode(ciphertext)
+                .map_err(|err| anyhow!("the ciphertext is not base64: {err}"))?;
+
+            let ci = ContentInfo::parse_ber(&ber)?;
+            print!("{ci}");
+
+            let key = read_private_key(&key).await?;
+            let plaintext = match certificate {
+                Some(path) => {
+                    ci.decrypt_content_with_certificate(&key, &read_certificate(&path).await?)?
+                }
+                None => ci.decrypt_content(&key)?,
+            };
+            match std::str::from_utf8(&plaintext) {
+                Ok(text) if !as_hex => println!("Plaintext:     {text:?}"),
+                _ => println!("Plaintext:     {}", hex(&plaintext)),
+            }
+
+            Ok(())
+        }
+    }
+}
+
+async fn pcr_policy(pcrs: &[String], signing_cert: Option<&Path>) -> Result<PcrPolicy> {
+    let policy = pcrs
+        .iter()
+        .try_fold(PcrPolicy::new(), |policy, pcr| policy.with_arg(pcr))?;
+
+    match signing_cert {
+        Some(path) => Ok(policy.with_signing_cert(&read_certificate(path).await?)),
+        None => Ok(policy),
     }
 }
 
+// The first certificate of a PEM file, in DER
+async fn read_certificate(path: &Path) -> Result<Vec<u8>> {
+    let pem = tokio::fs::read(path).await?;
+    rustls_pemfile::certs(&mut pem.as_slice())?
+        .into_iter()
+        .next()
+        .ok_or(anyhow!("no certificate in {}", path.display()))
+}
+
+// The first private key of a PEM file
+#[cfg(feature = "proxy")]
+async fn read_private_key(path: &Path) -> Result<KeyPair> {
+    let pem = tokio::fs::read(path).await?;
+    let der = rustls_pemfile::pkcs8_private_keys(&mut pem.as_slice())?
+        .into_iter()
+        .next()
+        .ok_or(anyhow!("no PKCS#8 private key in {}", path.display()))?;
+    KeyPair::from_pkcs8_der(&der)
+}
+
+fn print_attestation(attestation: Attestation) -> Result<()> {
+    let pcrs: serde_json::Map<String, serde_json::Value> = attestation
+        .pcrs
+        .iter()
+        .map(|(index, value)| (index.to_string(), hex(value).into()))
+        .collect();
+    let summary = serde_json::json!({
+        "module_id": attestation.module_id,
+        "timestamp": attestation.timestamp.duration_since(UNIX_EPOCH)?.as_millis() as u64,
+        "pcrs": pcrs,
+        "user_data": attestation.user_data.map(base64::encode),
+    });
+    println!("{}", serde_json::to_string_pretty(&summary)?);
+
+    Ok(())
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{b:02x}")).collect()
+}
+
 #[tokio::main]
 async fn main() -> Result<()> {
     enclaver::utils::init_logging();
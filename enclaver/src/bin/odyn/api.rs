@@ -5,21 +5,80 @@ use log::info;
 use tokio::task::JoinHandle;
 
 use crate::config::Configuration;
+use crate::runtime_files::RuntimeFiles;
 use enclaver::api::ApiHandler;
-use enclaver::http_util::HttpServer;
-use enclaver::nsm::{Nsm, NsmAttestationProvider};
+use enclaver::clock_sync::TrustedClock;
+use enclaver::constants::{API_VSOCK_PORT, CREDENTIALS_VSOCK_PORT};
+use enclaver::credentials::HostCredentialsProvider;
+use enclaver::hpke::HpkeKeyPair;
+use enclaver::http_util::{self, HttpServer};
+use enclaver::nsm::{
+    AttestationProvider, CachingAttestationProvider, KeyRotator, Measurements, Nsm,
+    NsmAttestationProvider,
+};
 
 pub struct ApiService {
     task: Option<JoinHandle<()>>,
+    vsock_task: JoinHandle<()>,
+    runtime_files: Option<RuntimeFiles>,
 }
 
 impl ApiService {
-    pub fn start(config: &Configuration, nsm: Arc<Nsm>) -> Result<Self> {
+    pub fn start(
+        config: &Configuration,
+        nsm: Arc<Nsm>,
+        key_rotators: Vec<Arc<KeyRotator>>,
+        clock: TrustedClock,
+    ) -> Result<Self> {
+        // Both APIs share the one cache
+        let attester: Arc<dyn AttestationProvider + Send + Sync> =
+            Arc::new(NsmAttestationProvider::new(nsm.clone()));
+        let attester: Arc<dyn AttestationProvider + Send + Sync> =
+            match config.attestation_cache_ttl() {
+                Some(ttl) => Arc::new(CachingAttestationProvider::new(attester, ttl)),
+                None => attester,
+            };
+
+        // Made anew at every boot, for senders to seal messages to
+        let hpke_key = Arc::new(HpkeKeyPair::generate());
+        let manifest = serde_json::to_value(&config.manifest)?;
+        let measurements = Measurements::read(&nsm)?;
+
+        // The app has the same API on the TCP port and on the socket of the
+        // runtime files
+        let app_handler = || {
+            ApiHandler::new(Box::new(attester.clone()))
+                .with_key_rotators(key_rotators.clone())
+                .with_nsm(nsm.clone())
+                .with_credentials(HostCredentialsProvider::new(CREDENTIALS_VSOCK_PORT))
+                .with_clock(clock.clone())
+                .with_hpke_key(hpke_key.clone())
+                .with_manifest(manifest.clone())
+                .with_measurements(measurements.clone())
+        };
+
+        let runtime_files = match config.runtime_files_dir() {
+            Some(dir) => Some(RuntimeFiles::write(
+                &dir,
+                config.runtime_files_key_type(),
+                attester.as_ref(),
+                app_handler(),
+            )?),
+            None => None,
+        };
+
         let task = if let Some(port) = config.api_port() {
             info!("Starting API on port {port}");
 
             let srv = HttpServer::bind(port)?;
-            let handler = ApiHandler::new(Box::new(NsmAttestationProvider::new(nsm)));
+            let handler = app_handler();
+
+            // Where the AWS SDKs look for credentials, once they found none
+            // in the environment or in a profile
+            std::env::set_var(
+                "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+                format!("http://127.0.0.1:{port}/v1/aws/credentials"),
+            );
 
             Some(tokio::task::spawn(async move {
                 _ = srv.serve(handler).await;
@@ -28,7 +87,27 @@ impl ApiService {
             None
         };
 
-        Ok(Self { task })
+        // Always serve the restricted API to the host so that the wrapper can
+        // fetch attestations on behalf of host tooling.
+        let mut incoming = enclaver::vsock::ListenConfig::new(API_VSOCK_PORT).listen()?;
+        let handler = Arc::new(ApiHandler::host_facing(Box::new(attester)).with_hpke_key(hpke_key));
+
+        let vsock_task = tokio::task::spawn(async move {
+            use futures::StreamExt;
+
+            while let Some(conn) = incoming.next().await {
+                let handler = handler.clone();
+                tokio::task::spawn(async move {
+                    _ = http_util::serve_connection(conn, handler).await;
+                });
+            }
+        });
+
+        Ok(Self {
+            task,
+            vsock_task,
+            runtime_files,
+        })
     }
 
     pub async fn stop(self) {
@@ -36,5 +115,12 @@ impl ApiService {
             task.abort();
             _ = task.await;
         }
+
+        self.vsock_task.abort();
+        _ = self.vsock_task.await;
+
+        if let Some(runtime_files) = self.runtime_files {
+            runtime_files.stop().await;
+        }
     }
 }
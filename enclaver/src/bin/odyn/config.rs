@@ -4,12 +4,19 @@ use log::debug;
 use std::collections::HashMap;
 use std::path::{Path, PathBuf};
 use std::sync::Arc;
+use std::time::Duration;
 
-use enclaver::constants::{HTTP_EGRESS_PROXY_PORT, MANIFEST_FILE_NAME};
+use enclaver::constants::{HTTP_EGRESS_PROXY_PORT, MANIFEST_FILE_NAME, RUNTIME_FILES_DIR};
+use enclaver::keypair::KeyType;
 use enclaver::manifest::{self, Manifest};
+use enclaver::policy::limits::Timeouts;
+use enclaver::proxy::ingress::DEFAULT_BACKLOG;
 use enclaver::proxy::kms::KmsEndpointProvider;
 use enclaver::tls;
 
+const DEFAULT_ATTESTATION_CACHE_SECS: u64 = 30;
+const DEFAULT_ENTROPY_RESEED_SECS: u64 = 300;
+
 pub struct Configuration {
     pub config_dir: PathBuf,
     pub manifest: Manifest,
@@ -20,6 +27,9 @@ pub struct Configuration {
 pub enum ListenerConfig {
     TCP,
     TLS(Arc<rustls::ServerConfig>),
+    // The DNS names for the certificate, which is issued at startup, and the
+    // type of its key
+    AttestedTLS(Vec<String>, KeyType),
 }
 
 impl Configuration {
@@ -27,6 +37,15 @@ impl Configuration {
         let mut manifest_path = config_dir.as_ref().to_path_buf();
         manifest_path.push(MANIFEST_FILE_NAME);
 
+        Configuration::load_with_manifest(config_dir, manifest_path).await
+    }
+
+    // With a manifest from elsewhere than config_dir, which still holds the
+    // TLS keys and certificates
+    pub async fn load_with_manifest<P: AsRef<Path>>(
+        config_dir: P,
+        manifest_path: PathBuf,
+    ) -> Result<Self> {
         let manifest = enclaver::manifest::load_manifest(manifest_path.to_str().unwrap()).await?;
 
         let mut tls_path = config_dir.as_ref().to_path_buf();
@@ -36,12 +55,16 @@ impl Configuration {
 
         if let Some(ref ingress) = manifest.ingress {
             for item in ingress {
-                let cfg = match item.tls {
-                    Some(_) => {
+                let cfg = match (&item.tls, &item.attested_tls) {
+                    (Some(_), _) => {
                         let tls_config = Configuration::load_tls_server_config(&tls_path, item)?;
                         ListenerConfig::TLS(tls_config)
                     }
-                    None => ListenerConfig::TCP,
+                    (None, Some(attested)) => ListenerConfig::AttestedTLS(
+                        attested.dns_names.clone().unwrap_or_default(),
+                        attested.key_type.unwrap_or_default(),
+                    ),
+                    (None, None) => ListenerConfig::TCP,
                 };
 
                 listener_configs.insert(item.listen_port, cfg);
@@ -106,6 +129,63 @@ impl Configuration {
         }
     }
 
+    // Transparent egress is only meaningful if egress is enabled at all
+    pub fn transparent_egress(&self) -> bool {
+        self.egress_proxy_uri().is_some()
+            && self
+                .manifest
+                .egress
+                .as_ref()
+                .and_then(|egress| egress.transparent)
+                .unwrap_or(false)
+    }
+
+    pub fn dns(&self) -> bool {
+        self.egress_proxy_uri().is_some()
+            && self
+                .manifest
+                .egress
+                .as_ref()
+                .and_then(|egress| egress.dns)
+                .unwrap_or(false)
+    }
+
+    fn ingress(&self, listen_port: u16) -> Option<&manifest::Ingress> {
+        self.manifest
+            .ingress
+            .iter()
+            .flatten()
+            .find(|ingress| ingress.listen_port == listen_port)
+    }
+
+    // Timeouts of the ingress proxy listening on the given port
+    pub fn timeouts(&self, listen_port: u16) -> Timeouts {
+        match self.ingress(listen_port) {
+            Some(ingress) => {
+                Timeouts::new(ingress.timeouts.as_ref()).with_buffer_kb(ingress.buffer_kb)
+            }
+            None => Timeouts::default(),
+        }
+    }
+
+    pub fn proxy_protocol(&self, listen_port: u16) -> bool {
+        self.ingress(listen_port)
+            .and_then(|ingress| ingress.proxy_protocol)
+            .unwrap_or(false)
+    }
+
+    pub fn max_connections(&self, listen_port: u16) -> Option<usize> {
+        self.ingress(listen_port)
+            .and_then(|ingress| ingress.max_connections)
+            .map(|max| max as usize)
+    }
+
+    pub fn backlog(&self, listen_port: u16) -> usize {
+        self.ingress(listen_port)
+            .and_then(|ingress| ingress.backlog)
+            .map_or(DEFAULT_BACKLOG, |backlog| backlog as usize)
+    }
+
     pub fn kms_proxy_port(&self) -> Option<u16> {
         self.manifest.kms_proxy.as_ref().map(|kp| kp.listen_port)
     }
@@ -113,6 +193,46 @@ impl Configuration {
     pub fn api_port(&self) -> Option<u16> {
         self.manifest.api.as_ref().map(|a| a.listen_port)
     }
+
+    // Where to write the runtime files, if at all
+    pub fn runtime_files_dir(&self) -> Option<PathBuf> {
+        self.manifest
+            .runtime_files
+            .as_ref()
+            .map(|files| PathBuf::from(files.dir.as_deref().unwrap_or(RUNTIME_FILES_DIR)))
+    }
+
+    pub fn runtime_files_key_type(&self) -> KeyType {
+        self.manifest
+            .runtime_files
+            .as_ref()
+            .and_then(|files| files.key_type)
+            .unwrap_or_default()
+    }
+
+    // How long attestation documents are reused for, if at all
+    pub fn attestation_cache_ttl(&self) -> Option<Duration> {
+        let secs = self
+            .manifest
+            .api
+            .as_ref()
+            .and_then(|a| a.attestation_cache_secs)
+            .unwrap_or(DEFAULT_ATTESTATION_CACHE_SECS);
+
+        Some(Duration::from_secs(secs)).filter(|ttl| !ttl.is_zero())
+    }
+
+    // How often the kernel is given more entropy from the NSM, if at all
+    pub fn entropy_reseed_interval(&self) -> Option<Duration> {
+        let secs = self
+            .manifest
+            .entropy
+            .as_ref()
+            .and_then(|e| e.reseed_secs)
+            .unwrap_or(DEFAULT_ENTROPY_RESEED_SECS);
+
+        Some(Duration::from_secs(secs)).filter(|interval| !interval.is_zero())
+    }
 }
 
 impl KmsEndpointProvider for Configuration {
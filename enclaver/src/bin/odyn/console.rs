@@ -1,13 +1,14 @@
 use anyhow::Result;
 use circbuf::CircBuf;
+use enclaver::vsock::Connection;
 use futures::Stream;
 use std::os::unix::io::AsRawFd;
 use std::sync::{Arc, Mutex};
 use tokio::io::{AsyncReadExt, AsyncWrite, AsyncWriteExt};
 use tokio::sync::watch::{Receiver, Sender};
+use tokio::sync::Notify;
 use tokio::task::JoinHandle;
 use tokio_pipe::{PipeRead, PipeWrite};
-use tokio_vsock::VsockStream;
 
 use crate::launcher::ExitStatus;
 
@@ -222,7 +223,7 @@ impl AppLog {
     }
 
     // serve the log over vsock
-    async fn serve_log(incoming: impl Stream<Item = VsockStream>, lr: LogReader) -> Result<()> {
+    async fn serve_log(incoming: impl Stream<Item = Connection>, lr: LogReader) -> Result<()> {
         use futures::stream::StreamExt;
 
         let mut incoming = Box::pin(incoming);
@@ -240,7 +241,7 @@ impl AppLog {
 
     // launch a task to service the pipe and serve the log over vsock
     pub fn start_serving(mut self, port: u32) -> JoinHandle<Result<()>> {
-        match enclaver::vsock::serve(port) {
+        match enclaver::vsock::ListenConfig::new(port).listen() {
             Ok(incoming) => tokio::task::spawn(async move {
                 tokio::try_join!(
                     self.servicer.run(),
@@ -257,6 +258,8 @@ enum EntrypointStatus {
     Running,
     Exited(ExitStatus),
     Fatal(String),
+    // The enclave is set up and the entrypoint about to be exec'd
+    Exec,
 }
 
 impl EntrypointStatus {
@@ -272,6 +275,7 @@ impl EntrypointStatus {
                 }
             },
             Self::Fatal(err) => format!("{{ \"status\": \"fatal\", \"error\": \"{err}\" }}\n"),
+            Self::Exec => "{ \"status\": \"exec\" }\n".to_string(),
         }
     }
 }
@@ -279,6 +283,9 @@ impl EntrypointStatus {
 struct AppStatusInner {
     status: EntrypointStatus,
     watches: WatchSet,
+    // Bumped with every change of status, and the latest one sent to a client
+    version: u64,
+    sent: Option<u64>,
 }
 
 impl AppStatusInner {
@@ -286,16 +293,14 @@ impl AppStatusInner {
         Self {
             status: EntrypointStatus::Running,
             watches: WatchSet::new(),
+            version: 0,
+            sent: None,
         }
     }
 
-    fn exited(&mut self, status: ExitStatus) {
-        self.status = EntrypointStatus::Exited(status);
-        self.watches.notify();
-    }
-
-    fn fatal(&mut self, err: String) {
-        self.status = EntrypointStatus::Fatal(err);
+    fn set(&mut self, status: EntrypointStatus) {
+        self.status = status;
+        self.version += 1;
         self.watches.notify();
     }
 }
@@ -303,27 +308,51 @@ impl AppStatusInner {
 #[derive(Clone)]
 pub struct AppStatus {
     inner: Arc<Mutex<AppStatusInner>>,
+    sent: Arc<Notify>,
 }
 
 impl AppStatus {
     pub fn new() -> Self {
         Self {
             inner: Arc::new(Mutex::new(AppStatusInner::new())),
+            sent: Arc::new(Notify::new()),
         }
     }
 
     pub fn exited(&self, status: ExitStatus) {
-        self.inner.lock().unwrap().exited(status);
+        self.inner
+            .lock()
+            .unwrap()
+            .set(EntrypointStatus::Exited(status));
     }
 
     pub fn fatal(&self, err: String) {
-        self.inner.lock().unwrap().fatal(err);
+        self.inner.lock().unwrap().set(EntrypointStatus::Fatal(err));
+    }
+
+    pub fn exec(&self) {
+        self.inner.lock().unwrap().set(EntrypointStatus::Exec);
+    }
+
+    // Resolves once the current status has been sent to a client, so that
+    // the runtime can tell the wrapper heard it before going away
+    pub async fn sent(&self) {
+        loop {
+            let notified = self.sent.notified();
+            {
+                let inner = self.inner.lock().unwrap();
+                if inner.sent == Some(inner.version) {
+                    return;
+                }
+            }
+            notified.await;
+        }
     }
 
     pub fn start_serving(&self, port: u32) -> JoinHandle<Result<()>> {
         use futures::stream::StreamExt;
 
-        match enclaver::vsock::serve(port) {
+        match enclaver::vsock::ListenConfig::new(port).listen() {
             Ok(incoming) => {
                 let mut incoming = Box::pin(incoming);
                 let app_status = self.clone();
@@ -341,12 +370,19 @@ impl AppStatus {
         }
     }
 
-    async fn stream(&self, mut sock: VsockStream) {
+    async fn stream(&self, mut sock: Connection) {
         let mut w = self.inner.lock().unwrap().watches.add();
 
         loop {
-            let json_str = self.inner.lock().unwrap().status.as_json();
-            _ = sock.write_all(json_str.as_bytes()).await;
+            let (json_str, version) = {
+                let inner = self.inner.lock().unwrap();
+                (inner.status.as_json(), inner.version)
+            };
+            if sock.write_all(json_str.as_bytes()).await.is_ok() {
+                let mut inner = self.inner.lock().unwrap();
+                inner.sent = inner.sent.max(Some(version));
+                self.sent.notify_waiters();
+            }
 
             // wait for new data
             // unwrap() since the sender never closes first
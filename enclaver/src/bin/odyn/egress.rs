@@ -1,20 +1,51 @@
+use std::net::{Ipv4Addr, SocketAddrV4};
 use std::sync::Arc;
 
-use anyhow::Result;
+use anyhow::{anyhow, Result};
 use log::info;
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
 use tokio::task::JoinHandle;
+use tokio_util::sync::CancellationToken;
 
 use crate::config::Configuration;
-use enclaver::constants::HTTP_EGRESS_VSOCK_PORT;
+use crate::enclave::{netlink_request, LO_INDEX};
+use enclaver::constants::{
+    DNS_STUB_PORT, DNS_VSOCK_PORT, EGRESS_MUX_VSOCK_PORT, HTTP_EGRESS_VSOCK_PORT,
+    TRANSPARENT_EGRESS_PORT, UDP_EGRESS_VSOCK_PORT,
+};
+use enclaver::manifest::{EgressTunnel, TunnelProtocol};
+use enclaver::metrics;
 use enclaver::policy::EgressPolicy;
+use enclaver::proxy::dns::{self, EnclaveDnsStub};
 use enclaver::proxy::egress_http::EnclaveHttpProxy;
+use enclaver::proxy::egress_mux;
+use enclaver::proxy::egress_transparent::EnclaveTransparentProxy;
+use enclaver::proxy::egress_tunnel::EnclaveTunnel;
+use enclaver::proxy::egress_udp::EnclaveUdpRelay;
+use enclaver::proxy::middleware::Chain;
+use enclaver::proxy::mitm::{self, Interceptor};
+use enclaver::proxy::vsock_pool;
+
+const ETC_HOSTS: &str = "/etc/hosts";
 
 pub struct EgressService {
     proxy: Option<JoinHandle<()>>,
+    transparent_proxy: Option<JoinHandle<()>>,
+    tunnels: Vec<JoinHandle<()>>,
+    dns_stub: Option<JoinHandle<()>>,
+    vsock_pool: Option<JoinHandle<()>>,
+    cancellation: CancellationToken,
 }
 
 impl EgressService {
     pub async fn start(config: &Configuration) -> Result<Self> {
+        let mut transparent_task = None;
+        let mut tunnel_tasks = Vec::new();
+        let mut dns_task = None;
+        let mut pool_task = None;
+        let cancellation = CancellationToken::new();
+
         let task = if let Some(proxy_uri) = config.egress_proxy_uri() {
             info!("Startng egress");
 
@@ -22,23 +53,331 @@ impl EgressService {
 
             set_proxy_env_var(&proxy_uri.to_string());
 
-            let proxy = EnclaveHttpProxy::bind(proxy_uri.port_u16().unwrap()).await?;
+            let egress = config.manifest.egress.as_ref().unwrap();
+            if egress.vsock_mux.unwrap_or(false) {
+                info!("Sharing vsock connections to the host between egress connections");
+                egress_mux::enable(HTTP_EGRESS_VSOCK_PORT, EGRESS_MUX_VSOCK_PORT);
+            }
+
+            if let Some(ref spec) = egress.vsock_pool {
+                info!("Keeping {} vsock connections to the host ready", spec.size);
+                pool_task = Some(vsock_pool::start(
+                    HTTP_EGRESS_VSOCK_PORT,
+                    spec,
+                    cancellation.clone(),
+                ));
+            }
+
+            let mut proxy = EnclaveHttpProxy::bind(proxy_uri.port_u16().unwrap()).await?;
+
+            if let Some(ref spec) = egress.mitm {
+                let interceptor = Interceptor::new(spec)?;
+                let path = spec
+                    .ca_cert_path
+                    .as_deref()
+                    .unwrap_or(mitm::DEFAULT_CA_CERT_PATH);
+                write_ca_cert(path, &interceptor.ca_cert_pem()).await?;
+                info!("Intercepting TLS to {:?}, the CA is in {path}", spec.hosts);
+
+                proxy = proxy.with_interceptor(Arc::new(interceptor));
+            }
+
+            if let Some(ref specs) = egress.middleware {
+                info!(
+                    "Running egress HTTP requests through {} middleware",
+                    specs.len()
+                );
+                proxy = proxy.with_middleware(Chain::new(specs)?);
+            }
+
+            if config.transparent_egress() {
+                info!("Starting transparent egress on port {TRANSPARENT_EGRESS_PORT}");
+
+                let transparent = EnclaveTransparentProxy::bind(TRANSPARENT_EGRESS_PORT).await?;
+                redirect_outbound_tcp(TRANSPARENT_EGRESS_PORT).await?;
 
+                let policy = policy.clone();
+                let cancellation = cancellation.clone();
+                transparent_task = Some(tokio::task::spawn(async move {
+                    let serve = transparent.serve(HTTP_EGRESS_VSOCK_PORT, policy, cancellation);
+                    metrics::RUNTIME
+                        .forwarder("egress_transparent".to_string(), serve)
+                        .await;
+                }));
+            }
+
+            if config.dns() {
+                info!("Starting DNS stub resolver");
+
+                let stub = EnclaveDnsStub::bind(DNS_STUB_PORT).await?;
+                dns::write_resolv_conf().await?;
+
+                let cancellation = cancellation.clone();
+                dns_task = Some(tokio::task::spawn(async move {
+                    let serve = async {
+                        tokio::select! {
+                            _ = stub.serve(DNS_VSOCK_PORT) => {},
+                            _ = cancellation.cancelled() => {},
+                        }
+                    };
+                    metrics::RUNTIME.forwarder("dns".to_string(), serve).await;
+                }));
+            }
+
+            let tunnels = config.manifest.egress.as_ref().unwrap().tunnels.as_ref();
+            add_tunnel_addresses(tunnels.into_iter().flatten(), config.transparent_egress())
+                .await?;
+            for (idx, tunnel) in tunnels.into_iter().flatten().enumerate() {
+                tunnel_tasks.push(start_tunnel(idx, tunnel, &policy, &cancellation).await?);
+            }
+
+            let cancellation = cancellation.clone();
             Some(tokio::task::spawn(async move {
-                proxy.serve(HTTP_EGRESS_VSOCK_PORT, policy).await;
+                let serve = proxy.serve(HTTP_EGRESS_VSOCK_PORT, policy, cancellation);
+                metrics::RUNTIME
+                    .forwarder("egress".to_string(), serve)
+                    .await;
             }))
         } else {
             None
         };
 
-        Ok(Self { proxy: task })
+        Ok(Self {
+            proxy: task,
+            transparent_proxy: transparent_task,
+            tunnels: tunnel_tasks,
+            dns_stub: dns_task,
+            vsock_pool: pool_task,
+            cancellation,
+        })
     }
 
+    // Every task stops accepting and closes its connections once cancelled,
+    // so waiting on them tears down egress completely.
     pub async fn stop(self) {
+        self.cancellation.cancel();
+
+        if let Some(stub) = self.dns_stub {
+            _ = stub.await;
+        }
+
+        for tunnel in self.tunnels {
+            _ = tunnel.await;
+        }
+
+        if let Some(proxy) = self.transparent_proxy {
+            _ = proxy.await;
+        }
+
         if let Some(proxy) = self.proxy {
-            proxy.abort();
             _ = proxy.await;
         }
+
+        if let Some(pool) = self.vsock_pool {
+            _ = pool.await;
+        }
+    }
+}
+
+// For the app to add to the CAs it trusts
+async fn write_ca_cert(path: &str, pem: &str) -> Result<()> {
+    if let Some(dir) = std::path::Path::new(path).parent() {
+        tokio::fs::create_dir_all(dir).await?;
+    }
+    tokio::fs::write(path, pem).await?;
+    Ok(())
+}
+
+// Each tunnel gets a loopback address of its own, so that it can listen on the
+// same port as the destination. Host names are pointed at that address in
+// /etc/hosts, letting the app connect to the usual host and port. Tunnels with
+// a listen_address listen on that instead.
+async fn start_tunnel(
+    idx: usize,
+    tunnel: &EgressTunnel,
+    policy: &Arc<EgressPolicy>,
+    cancellation: &CancellationToken,
+) -> Result<JoinHandle<()>> {
+    if let Err(denial) = policy.check(&tunnel.host, tunnel.port) {
+        return Err(anyhow!(
+            "egress tunnel to {}:{}: {denial}",
+            tunnel.host,
+            tunnel.port
+        ));
+    }
+
+    let ip = match tunnel.listen_address {
+        Some(ip) => ip,
+        None => tunnel_addr(idx)?,
+    };
+    let listen_port = tunnel.listen_port.unwrap_or(tunnel.port);
+    let addr = SocketAddrV4::new(ip, listen_port);
+
+    let protocol = tunnel.protocol.unwrap_or(TunnelProtocol::Tcp);
+    let name = format!("tunnel:{}:{}", tunnel.host, tunnel.port);
+
+    let task = match protocol {
+        TunnelProtocol::Tcp => {
+            let proxy = EnclaveTunnel::bind(addr, tunnel.host.clone(), tunnel.port).await?;
+            let policy = policy.clone();
+            let cancellation = cancellation.clone();
+            tokio::task::spawn(async move {
+                let serve = proxy.serve(HTTP_EGRESS_VSOCK_PORT, policy, cancellation);
+                metrics::RUNTIME.forwarder(name, serve).await;
+            })
+        }
+        TunnelProtocol::Udp => {
+            let relay = EnclaveUdpRelay::bind(addr, tunnel.host.clone(), tunnel.port).await?;
+            let cancellation = cancellation.clone();
+            tokio::task::spawn(async move {
+                let serve = async {
+                    tokio::select! {
+                        _ = relay.serve(UDP_EGRESS_VSOCK_PORT) => {},
+                        _ = cancellation.cancelled() => {},
+                    }
+                };
+                metrics::RUNTIME.forwarder(name, serve).await;
+            })
+        }
+    };
+
+    if tunnel.host.parse::<std::net::IpAddr>().is_err() {
+        add_hosts_entry(ip, &tunnel.host).await?;
+    }
+
+    info!(
+        "Tunneling {addr} ({protocol:?}) to {}:{}",
+        tunnel.host, tunnel.port
+    );
+
+    Ok(task)
+}
+
+// 127.0.1.1 onwards
+fn tunnel_addr(idx: usize) -> Result<Ipv4Addr> {
+    let n = u32::try_from(idx + 1)?;
+    if n >= 0xffff {
+        return Err(anyhow!("too many egress tunnels"));
+    }
+
+    Ok(Ipv4Addr::from(u32::from(Ipv4Addr::new(127, 0, 1, 0)) + n))
+}
+
+// The addresses tunnels listen on in place of their destination are added to
+// lo, once each since tunnels on different ports may share one. Connections to
+// them are kept from the transparent proxy, which would otherwise take them for
+// connections to the outside.
+async fn add_tunnel_addresses<'a>(
+    tunnels: impl Iterator<Item = &'a EgressTunnel>,
+    transparent: bool,
+) -> Result<()> {
+    let mut addrs: Vec<Ipv4Addr> = tunnels.filter_map(|t| t.listen_address).collect();
+    addrs.sort();
+    addrs.dedup();
+
+    for ip in addrs {
+        if ip.is_loopback() {
+            continue;
+        }
+
+        add_lo_address(ip).await?;
+        if transparent {
+            let dest = ip.to_string();
+            run_iptables(&["-t", "nat", "-I", "OUTPUT", "-d", &dest, "-j", "RETURN"]).await?;
+        }
+    }
+
+    Ok(())
+}
+
+async fn add_lo_address(ip: Ipv4Addr) -> Result<()> {
+    netlink_request(|handle| handle.address().add(LO_INDEX, ip.into(), 32).execute())
+        .await
+        .map_err(|err| anyhow!("failed to add {ip} to lo: {err}"))
+}
+
+async fn add_hosts_entry(ip: Ipv4Addr, host: &str) -> Result<()> {
+    let mut hosts = tokio::fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(ETC_HOSTS)
+        .await?;
+
+    hosts
+        .write_all(format!("{ip}\t{host}\n").as_bytes())
+        .await?;
+    Ok(())
+}
+
+// The enclave only has a loopback interface. Route everything over it
+// so that connect() to an outside address does not fail right away, and
+// have netfilter redirect those connections to the transparent proxy.
+async fn redirect_outbound_tcp(port: u16) -> Result<()> {
+    add_default_route().await?;
+
+    let port = port.to_string();
+    run_iptables(&[
+        "-t",
+        "nat",
+        "-A",
+        "OUTPUT",
+        "-p",
+        "tcp",
+        "!",
+        "-d",
+        "127.0.0.0/8",
+        "-j",
+        "REDIRECT",
+        "--to-ports",
+        &port,
+    ])
+    .await
+}
+
+async fn add_default_route() -> Result<()> {
+    netlink_request(|handle| {
+        handle
+            .route()
+            .add()
+            .v4()
+            .output_interface(LO_INDEX)
+            .execute()
+    })
+    .await
+}
+
+async fn run_iptables(args: &[&str]) -> Result<()> {
+    let output = Command::new("iptables")
+        .args(args)
+        .output()
+        .await
+        .map_err(|err| {
+            anyhow!("failed to execute iptables (required for transparent egress): {err}")
+        })?;
+
+    if output.status.success() {
+        Ok(())
+    } else {
+        Err(anyhow!(
+            "iptables failed: {}",
+            String::from_utf8_lossy(&output.stderr)
+        ))
+    }
+}
+
+// Once the proxy is gone, for what is started afterwards
+pub fn clear_proxy_env_vars() {
+    for var in [
+        "http_proxy",
+        "https_proxy",
+        "HTTP_PROXY",
+        "HTTPS_PROXY",
+        "all_proxy",
+        "ALL_PROXY",
+        "no_proxy",
+        "NO_PROXY",
+    ] {
+        std::env::remove_var(var);
     }
 }
 
@@ -48,6 +387,11 @@ fn set_proxy_env_var(value: &str) {
     std::env::set_var("HTTP_PROXY", value);
     std::env::set_var("HTTPS_PROXY", value);
 
+    // For tools that speak SOCKS but not HTTP CONNECT (served on the same port)
+    let socks_value = value.replacen("http://", "socks5h://", 1);
+    std::env::set_var("all_proxy", &socks_value);
+    std::env::set_var("ALL_PROXY", &socks_value);
+
     const NO_PROXY: &str = "localhost,127.0.0.1";
     std::env::set_var("no_proxy", NO_PROXY);
     std::env::set_var("NO_PROXY", NO_PROXY);
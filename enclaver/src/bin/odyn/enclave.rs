@@ -1,13 +1,19 @@
+use std::future::Future;
 use std::sync::Arc;
+use std::time::Duration;
 
 use anyhow::Result;
-use log::info;
-use rtnetlink::LinkHandle;
+use log::{debug, info, warn};
+use rtnetlink::{Handle, LinkHandle};
+use tokio::task::JoinHandle;
 
 use enclaver::nsm::Nsm;
 
 const DEV_RANDOM: &str = "/dev/random";
 
+// Assume that lo interface is one and only
+pub const LO_INDEX: u32 = 1;
+
 pub async fn bootstrap(nsm: Arc<Nsm>) -> Result<()> {
     info!("Bringing up loopback interface");
     lo_up().await?;
@@ -18,14 +24,44 @@ pub async fn bootstrap(nsm: Arc<Nsm>) -> Result<()> {
     Ok(())
 }
 
+// The seed at boot is all the entropy from outside the enclave the kernel gets
+// otherwise, which long lived enclaves would like more of
+pub fn start_reseeding(nsm: Arc<Nsm>, interval: Duration) -> JoinHandle<()> {
+    tokio::task::spawn(async move {
+        let mut ticks = tokio::time::interval(interval);
+
+        // The first tick is right away, and the seed at boot is still fresh
+        ticks.tick().await;
+
+        loop {
+            ticks.tick().await;
+
+            let nsm = nsm.clone();
+            match tokio::task::spawn_blocking(move || seed_rng(&nsm)).await {
+                Ok(Ok(())) => debug!("Reseeded {} with entropy from nsm device", DEV_RANDOM),
+                Ok(Err(err)) => warn!("Failed to reseed {}: {err}", DEV_RANDOM),
+                Err(err) => warn!("Failed to reseed {}: {err}", DEV_RANDOM),
+            }
+        }
+    })
+}
+
 async fn lo_up() -> Result<()> {
+    netlink_request(|handle| LinkHandle::new(handle).set(LO_INDEX).up().execute()).await
+}
+
+// Make a single rtnetlink request, over a connection that is only open for it.
+pub async fn netlink_request<F, Fut>(request: F) -> Result<()>
+where
+    F: FnOnce(Handle) -> Fut,
+    Fut: Future<Output = Result<(), rtnetlink::Error>>,
+{
     let (conn, handle, _receiver) = rtnetlink::new_connection()?;
 
     // this starts the background task of reading from the rtnetlink socket
     let conn_task = tokio::spawn(conn);
 
-    // Assume that lo interface is one and only
-    let result = LinkHandle::new(handle).set(1).up().execute().await;
+    let result = request(handle).await;
 
     // cancel the socket reading
     conn_task.abort();
@@ -1,43 +1,90 @@
+use std::sync::Arc;
+
 use anyhow::Result;
 use log::info;
 use tokio::task::JoinHandle;
+use tokio_util::sync::CancellationToken;
 
 use crate::config::{Configuration, ListenerConfig};
+use enclaver::metrics;
+use enclaver::nsm::{AttestationProvider, KeyRotator, Nsm, NsmAttestationProvider};
 use enclaver::proxy::ingress::EnclaveProxy;
+use enclaver::tls;
 
 pub struct IngressService {
     proxies: Vec<JoinHandle<()>>,
+    cancellation: CancellationToken,
+    key_rotators: Vec<Arc<KeyRotator>>,
 }
 
 impl IngressService {
-    pub fn start(config: &Configuration) -> Result<Self> {
+    pub fn start(config: &Configuration, nsm: Arc<Nsm>) -> Result<Self> {
         let mut tasks = Vec::new();
+        let cancellation = CancellationToken::new();
+        let attester: Arc<dyn AttestationProvider + Send + Sync> =
+            Arc::new(NsmAttestationProvider::new(nsm));
+        let mut key_rotators = Vec::new();
 
         for (port, cfg) in &config.listener_configs {
             match cfg {
                 ListenerConfig::TCP => {
                     info!("Startng TCP ingress on port {}", *port);
-                    let proxy = EnclaveProxy::bind(*port)?;
-                    tasks.push(tokio::spawn(proxy.serve()));
+                    let proxy = EnclaveProxy::bind(*port, config.backlog(*port))?
+                        .with_timeouts(config.timeouts(*port))
+                        .with_proxy_protocol(config.proxy_protocol(*port))
+                        .with_max_connections(config.max_connections(*port));
+                    tasks.push(spawn(*port, proxy, cancellation.clone()));
                 }
                 ListenerConfig::TLS(tls_cfg) => {
                     info!("Startng TLS ingress on port {}", *port);
-                    let proxy = EnclaveProxy::bind_tls(*port, tls_cfg.clone())?;
-                    tasks.push(tokio::spawn(proxy.serve()));
+                    let proxy =
+                        EnclaveProxy::bind_tls(*port, config.backlog(*port), tls_cfg.clone())?
+                            .with_timeouts(config.timeouts(*port))
+                            .with_proxy_protocol(config.proxy_protocol(*port))
+                            .with_max_connections(config.max_connections(*port));
+                    tasks.push(spawn(*port, proxy, cancellation.clone()));
+                }
+                ListenerConfig::AttestedTLS(dns_names, key_type) => {
+                    info!("Startng attested TLS ingress on port {}", *port);
+                    // A key that never leaves the enclave, attested for
+                    // clients to trust
+                    let rotator = Arc::new(KeyRotator::new(*key_type, attester.clone())?);
+                    let current = rotator.clone();
+                    let tls_cfg =
+                        tls::rotating_attested_server_config(dns_names, move || current.current());
+                    key_rotators.push(rotator);
+                    let proxy = EnclaveProxy::bind_tls(*port, config.backlog(*port), tls_cfg)?
+                        .with_timeouts(config.timeouts(*port))
+                        .with_proxy_protocol(config.proxy_protocol(*port))
+                        .with_max_connections(config.max_connections(*port));
+                    tasks.push(spawn(*port, proxy, cancellation.clone()));
                 }
             }
         }
 
-        Ok(Self { proxies: tasks })
+        Ok(Self {
+            proxies: tasks,
+            cancellation,
+            key_rotators,
+        })
+    }
+
+    // Of the attested TLS keys
+    pub fn key_rotators(&self) -> Vec<Arc<KeyRotator>> {
+        self.key_rotators.clone()
     }
 
     pub async fn stop(self) {
-        for p in &self.proxies {
-            p.abort();
-        }
+        self.cancellation.cancel();
 
         for p in self.proxies {
             _ = p.await;
         }
     }
 }
+
+// Marked up in the metrics until it stops
+fn spawn(port: u16, proxy: EnclaveProxy, cancellation: CancellationToken) -> JoinHandle<()> {
+    let name = format!("ingress:{port}");
+    tokio::spawn(metrics::RUNTIME.forwarder(name, proxy.serve(cancellation)))
+}
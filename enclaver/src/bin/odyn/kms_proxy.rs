@@ -1,19 +1,20 @@
 use std::sync::Arc;
 
 use anyhow::{anyhow, Result};
-use aws_types::credentials::ProvideCredentials;
 use log::{error, info};
 use tokio::task::JoinHandle;
 
+use enclaver::constants::CREDENTIALS_VSOCK_PORT;
+use enclaver::credentials::HostCredentialsProvider;
 use enclaver::http_util::HttpServer;
 use enclaver::keypair::KeyPair;
+use enclaver::metrics;
 use enclaver::nsm::{Nsm, NsmAttestationProvider};
-use enclaver::proxy::aws_util;
 use enclaver::proxy::kms::{KmsProxyConfig, KmsProxyHandler};
 
 use crate::config::Configuration;
 
-const NO_EGRESS_ERROR: &str = "KMS proxy is configured but egress is not. Configure egress allow policy to access the IMDS at 169.254.169.254 and the AWS KMS endpoint";
+const NO_EGRESS_ERROR: &str = "KMS proxy is configured but egress is not. Configure egress allow policy to access the AWS KMS endpoint";
 
 pub struct KmsProxyService {
     proxy: Option<JoinHandle<()>>,
@@ -30,15 +31,13 @@ impl KmsProxyService {
                 info!("Generating public/private keypair");
                 let keypair = Arc::new(KeyPair::generate()?);
 
-                let imds = aws_util::imds_client_with_proxy(proxy_uri.clone()).await?;
-
-                info!("Fetching credentials from IMDSv2");
-                let sdk_config = aws_util::load_config_from_imds(imds).await?;
-                let credentials = sdk_config
-                    .credentials_provider()
-                    .ok_or(anyhow!("credentials provider is missing"))?
-                    .provide_credentials()
-                    .await?;
+                // By way of the wrapper, which reaches IMDS where the enclave
+                // cannot
+                info!("Fetching credentials from the wrapper");
+                let credentials = HostCredentialsProvider::new(CREDENTIALS_VSOCK_PORT)
+                    .fetch()
+                    .await?
+                    .credentials();
                 info!("Credentials fetched");
 
                 let client = Box::new(enclaver::http_client::new_http_proxy_client(proxy_uri));
@@ -57,7 +56,11 @@ impl KmsProxyService {
                 std::env::set_var("AWS_KMS_ENDPOINT", format!("http://127.0.0.1:{port}"));
 
                 Some(tokio::task::spawn(async move {
-                    if let Err(err) = proxy.serve(handler).await {
+                    let serve = proxy.serve(handler);
+                    if let Err(err) = metrics::RUNTIME
+                        .forwarder("kms_proxy".to_string(), serve)
+                        .await
+                    {
                         error!("Error serving KMS proxy: {err}");
                     }
                 }))
@@ -27,8 +27,7 @@ impl std::fmt::Display for ExitStatus {
     }
 }
 
-// runs the child and reaps all of its children as well
-pub fn run_child(argv: &[OsString], creds: &Credentials) -> Result<ExitStatus> {
+fn spawn(argv: &[OsString], creds: &Credentials) -> Result<Pid> {
     // Don't use tokio::process::Command because it wants to reap the process.
     // However we need to run waitpid() ourselves to reap the zombies and it'll
     // end up picking up the spawned child as well.
@@ -40,14 +39,36 @@ pub fn run_child(argv: &[OsString], creds: &Credentials) -> Result<ExitStatus> {
         .spawn()?;
 
     debug!("Child process started");
-    let child_pid = Pid::from_raw(child.id() as i32);
+    Ok(Pid::from_raw(child.id() as i32))
+}
+
+// Replaces the runtime with the entrypoint, which then runs as PID 1. Only
+// returns if that failed.
+pub fn exec(argv: &[OsString], creds: &Credentials) -> anyhow::Error {
+    let err = Command::new(&argv[0])
+        .args(&argv[1..])
+        .uid(creds.uid)
+        .gid(creds.gid)
+        .exec();
+
+    anyhow!("failed to exec {:?}: {err}", argv[0])
+}
 
-    reap(child_pid)
+// runs the child and reaps all of its children as well. Along with the task,
+// returns the PID of the child, which leads a process group of its own.
+pub fn start_child(
+    argv: Vec<OsString>,
+    creds: Credentials,
+) -> Result<(Pid, JoinHandle<Result<ExitStatus>>)> {
+    let child_pid = spawn(&argv, &creds)?;
+    let task = tokio::task::spawn_blocking(move || reap(child_pid));
+    Ok((child_pid, task))
 }
 
-// runs the child and reaps all of its children as well
-pub fn start_child(argv: Vec<OsString>, creds: Credentials) -> JoinHandle<Result<ExitStatus>> {
-    tokio::task::spawn_blocking(move || run_child(&argv, &creds))
+// Asks the child and its process group to exit, as on SIGTERM to a container
+pub fn terminate_child(child_pid: Pid) -> Result<()> {
+    nix::sys::signal::killpg(child_pid, Signal::SIGTERM)
+        .map_err(|e| anyhow!("failed to signal the entrypoint: {}", e))
 }
 
 // Reap processes until a process with sentinel pid exits.
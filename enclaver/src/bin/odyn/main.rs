@@ -6,15 +6,26 @@ pub mod enclave;
 pub mod ingress;
 pub mod kms_proxy;
 pub mod launcher;
+pub mod runtime_files;
+pub mod secrets;
 
 use anyhow::Result;
 use clap::Parser;
-use log::{error, info};
+use log::{error, info, warn};
 use std::ffi::OsString;
+use std::path::PathBuf;
 use std::sync::Arc;
+use std::time::{Duration, Instant};
 
-use enclaver::constants::{APP_LOG_PORT, STATUS_PORT};
+use enclaver::clock_sync::{self, TrustedClock};
+use enclaver::constants::{
+    APP_LOG_PORT, CLOCK_SYNC_PORT, HEARTBEAT_PORT, SHUTDOWN_PORT, STATUS_PORT,
+};
+use enclaver::heartbeat::{self, Event};
+use enclaver::mock_nsm::MockNsm;
 use enclaver::nsm::Nsm;
+use enclaver::shutdown::{self, ShutdownHooks};
+use enclaver::vsock::ListenConfig;
 
 use api::ApiService;
 use config::Configuration;
@@ -23,6 +34,12 @@ use egress::EgressService;
 use ingress::IngressService;
 use kms_proxy::KmsProxyService;
 
+// How long to wait for the wrapper to sync the clock before exec'ing the app
+const CLOCK_SYNC_WAIT: Duration = Duration::from_secs(10);
+
+// How long to wait for the wrapper to pick up the status before exec'ing the app
+const STATUS_SENT_WAIT: Duration = Duration::from_secs(10);
+
 #[derive(Parser)]
 struct CliArgs {
     #[clap(long = "no-bootstrap", action)]
@@ -34,44 +51,238 @@ struct CliArgs {
     #[clap(long = "config-dir")]
     config_dir: String,
 
+    // In place of the manifest in config-dir
+    #[clap(long = "manifest")]
+    manifest: Option<PathBuf>,
+
+    // Leaves out the egress, ingress and KMS proxies, for when the app is
+    // wired up to the world some other way
+    #[clap(long = "no-forwarders", action)]
+    no_forwarders: bool,
+
+    // As RUST_LOG would, which it overrides
+    #[clap(long = "log-level")]
+    log_level: Option<String>,
+
+    // Outside of an enclave, where there is no NSM. Attestations are signed
+    // by a CA made up at startup, which is logged.
+    #[clap(long = "mock-nsm", action)]
+    mock_nsm: bool,
+
+    // Where to dial the wrapper, in place of VMADDR_CID_HOST. An enclave
+    // simulated on the host reaches it at VMADDR_CID_LOCAL.
+    #[clap(long = "host-cid")]
+    host_cid: Option<u32>,
+
+    // Execs the entrypoint once the enclave is set up, rather than running it
+    // as a child. Passed by enclaver build for manifests with launch_mode: exec.
+    #[clap(long = "exec", action)]
+    exec: bool,
+
     #[clap(required = true)]
     entrypoint: Vec<OsString>,
 }
 
-async fn launch(args: &CliArgs) -> Result<launcher::ExitStatus> {
-    let config = Arc::new(Configuration::load(&args.config_dir).await?);
+async fn load_config(args: &CliArgs) -> Result<Arc<Configuration>> {
+    let config = match args.manifest {
+        Some(ref path) => Configuration::load_with_manifest(&args.config_dir, path.clone()).await?,
+        None => Configuration::load(&args.config_dir).await?,
+    };
+    Ok(Arc::new(config))
+}
+
+fn open_nsm(args: &CliArgs) -> Result<Arc<Nsm>> {
+    if args.mock_nsm {
+        let mock = MockNsm::new()?;
+        warn!("Using a mock NSM, attestations will not verify against the AWS Nitro root");
+        info!(
+            "Mock NSM CA:\n{}",
+            enclaver::x509::pem("CERTIFICATE", mock.ca_certificate())
+        );
+        Ok(Arc::new(Nsm::mock(mock)))
+    } else {
+        Ok(Arc::new(Nsm::new()))
+    }
+}
 
-    let nsm = Arc::new(Nsm::new());
+async fn launch(
+    args: &CliArgs,
+    hooks: &ShutdownHooks,
+    clock: TrustedClock,
+) -> Result<launcher::ExitStatus> {
+    let config = load_config(args).await?;
+    let nsm = open_nsm(args)?;
 
+    let mut reseed_task = None;
     if !args.no_bootstrap {
         enclave::bootstrap(nsm.clone()).await?;
         info!("Enclave initialized");
+
+        reseed_task = config
+            .entropy_reseed_interval()
+            .map(|interval| enclave::start_reseeding(nsm.clone(), interval));
+    }
+
+    let mut forwarders = None;
+    let mut key_rotators = Vec::new();
+    if !args.no_forwarders {
+        let egress = EgressService::start(&config).await?;
+        let ingress = IngressService::start(&config, nsm.clone())?;
+        let kms_proxy = KmsProxyService::start(config.clone(), nsm.clone()).await?;
+        key_rotators = ingress.key_rotators();
+        forwarders = Some((egress, ingress, kms_proxy));
     }
+    let api = ApiService::start(&config, nsm.clone(), key_rotators, clock)?;
 
-    let egress = EgressService::start(&config).await?;
-    let ingress = IngressService::start(&config)?;
-    let kms_proxy = KmsProxyService::start(config.clone(), nsm.clone()).await?;
-    let api = ApiService::start(&config, nsm.clone())?;
+    // Before the app, which may read them as soon as it starts
+    secrets::bootstrap(&config, nsm.clone(), !args.no_bootstrap).await?;
 
     let creds = launcher::Credentials { uid: 0, gid: 0 };
 
     info!("Starting {:?}", args.entrypoint);
-    let exit_status = launcher::start_child(args.entrypoint.clone(), creds).await??;
+    let (child_pid, child) = launcher::start_child(args.entrypoint.clone(), creds)?;
+
+    // As docker stop would, the app gets a SIGTERM and until the deadline to
+    // exit, the runtime staying up meanwhile to serve it
+    let (exited_tx, exited_rx) = tokio::sync::oneshot::channel::<()>();
+    hooks.on_shutdown(move |_| async move {
+        if let Err(err) = launcher::terminate_child(child_pid) {
+            warn!("{err}");
+        }
+        _ = exited_rx.await;
+    });
+
+    let exit_status = child.await??;
+    _ = exited_tx.send(());
     info!("Entrypoint {}", exit_status);
 
     api.stop().await;
-    kms_proxy.stop().await;
-    ingress.stop().await;
-    egress.stop().await;
+    if let Some((egress, ingress, kms_proxy)) = forwarders {
+        kms_proxy.stop().await;
+        ingress.stop().await;
+        egress.stop().await;
+    }
+
+    if let Some(task) = reseed_task {
+        task.abort();
+        _ = task.await;
+    }
 
     Ok(exit_status)
 }
 
+// The app carries on either way, but without the wrapper it is cut off from
+// the outside world
+fn on_wrapper_heartbeat(event: Event) {
+    match event {
+        Event::Up => info!("Heartbeats from the wrapper started"),
+        Event::Restored { missed } => {
+            info!("Heartbeats from the wrapper resumed after {missed} missed")
+        }
+        Event::Restarted => warn!("The wrapper restarted"),
+        Event::Dead { missed, err } if missed == heartbeat::MISS_LIMIT => {
+            warn!("The wrapper stopped sending heartbeats: {err}")
+        }
+        _ => {}
+    }
+}
+
+// Sets up the enclave as for launch, then gets out of the way: the app is
+// exec'd in place of the runtime, with nothing of it left running. So there
+// is no heartbeat or console for the wrapper, and the egress proxy is only
+// there to fetch secrets with. The status is served until the exec, for the
+// wrapper to know the enclave was set up within its boot timeout.
+async fn bootstrap_and_exec(args: &CliArgs) -> Result<()> {
+    let app_status = AppStatus::new();
+    let app_status_task = app_status.start_serving(STATUS_PORT);
+    let clock = TrustedClock::new();
+    let clock_sync_task = clock_sync::start_serving(CLOCK_SYNC_PORT, clock.clone());
+
+    let res = bootstrap_for_exec(args, &clock).await;
+    match res {
+        Ok(()) => app_status.exec(),
+        Err(ref err) => app_status.fatal(err.to_string()),
+    }
+    if tokio::time::timeout(STATUS_SENT_WAIT, app_status.sent())
+        .await
+        .is_err()
+    {
+        warn!("The wrapper did not pick up the status within {STATUS_SENT_WAIT:?}");
+    }
+
+    clock_sync_task.abort();
+    _ = clock_sync_task.await;
+
+    app_status_task.abort();
+    _ = app_status_task.await;
+
+    res?;
+
+    info!("Executing {:?}", args.entrypoint);
+    let creds = launcher::Credentials { uid: 0, gid: 0 };
+    Err(launcher::exec(&args.entrypoint, &creds))
+}
+
+async fn bootstrap_for_exec(args: &CliArgs, clock: &TrustedClock) -> Result<()> {
+    let config = load_config(args).await?;
+    let nsm = open_nsm(args)?;
+
+    if !args.no_bootstrap {
+        enclave::bootstrap(nsm.clone()).await?;
+        info!("Enclave initialized");
+    }
+
+    let needs_egress = config
+        .manifest
+        .secrets
+        .as_ref()
+        .map_or(false, |secrets| !secrets.is_empty());
+    let egress_service = if needs_egress {
+        Some(EgressService::start(&config).await?)
+    } else {
+        None
+    };
+    secrets::bootstrap(&config, nsm, !args.no_bootstrap).await?;
+    if let Some(egress_service) = egress_service {
+        egress_service.stop().await;
+        egress::clear_proxy_env_vars();
+    }
+
+    // The clock is only set by the wrapper until the runtime is gone, so
+    // the app should at least start out with the right time
+    if !args.no_bootstrap {
+        wait_for_clock_sync(clock).await;
+    }
+
+    Ok(())
+}
+
+async fn wait_for_clock_sync(clock: &TrustedClock) {
+    let started = Instant::now();
+    while clock.now().is_err() {
+        if started.elapsed() > CLOCK_SYNC_WAIT {
+            warn!("The wrapper did not sync the clock within {CLOCK_SYNC_WAIT:?}");
+            return;
+        }
+        tokio::time::sleep(Duration::from_millis(100)).await;
+    }
+}
+
 async fn run(args: &CliArgs) -> Result<()> {
+    if args.exec {
+        return bootstrap_and_exec(args).await;
+    }
+
     // Start the status and logs listeners ASAP so that if we fail to
     // initialize, we can communicate the status and stream the logs
     let app_status = AppStatus::new();
     let app_status_task = app_status.start_serving(STATUS_PORT);
+    let heartbeat_task =
+        heartbeat::start_serving(ListenConfig::new(HEARTBEAT_PORT), on_wrapper_heartbeat);
+    let clock = TrustedClock::new();
+    let clock_sync_task = clock_sync::start_serving(CLOCK_SYNC_PORT, clock.clone());
+    let hooks = ShutdownHooks::new();
+    let shutdown_task = shutdown::start_serving(SHUTDOWN_PORT, hooks.clone());
 
     let mut console_task = None;
     if !args.no_console {
@@ -79,13 +290,22 @@ async fn run(args: &CliArgs) -> Result<()> {
         console_task = Some(app_log.start_serving(APP_LOG_PORT));
     }
 
-    match launch(args).await {
+    match launch(args, &hooks, clock).await {
         Ok(exit_status) => app_status.exited(exit_status),
         Err(err) => app_status.fatal(err.to_string()),
     };
 
     app_status_task.await??;
 
+    heartbeat_task.abort();
+    _ = heartbeat_task.await;
+
+    clock_sync_task.abort();
+    _ = clock_sync_task.await;
+
+    shutdown_task.abort();
+    _ = shutdown_task.await;
+
     if let Some(task) = console_task {
         task.abort();
         _ = task.await;
@@ -96,8 +316,15 @@ async fn run(args: &CliArgs) -> Result<()> {
 
 #[tokio::main]
 async fn main() {
-    enclaver::utils::init_logging();
     let args = CliArgs::parse();
+    if let Some(ref level) = args.log_level {
+        std::env::set_var("RUST_LOG", level);
+    }
+    enclaver::utils::init_logging();
+
+    if let Some(cid) = args.host_cid {
+        enclaver::vsock::set_host_cid(cid);
+    }
 
     if let Err(err) = run(&args).await {
         error!("Error: {err:#}");
@@ -0,0 +1,103 @@
+use std::io::Write;
+use std::os::unix::fs::OpenOptionsExt;
+use std::path::Path;
+use std::sync::Arc;
+
+use anyhow::{anyhow, Result};
+use log::{debug, info};
+use tokio::net::UnixListener;
+use tokio::task::JoinHandle;
+
+use enclaver::api::ApiHandler;
+use enclaver::http_util;
+use enclaver::keypair::{KeyPair, KeyType};
+use enclaver::nsm::{AttestationParams, AttestationProvider};
+use enclaver::x509;
+
+// In the runtime files dir. The attestation document binds the public key, so
+// that whoever the app hands it to can encrypt to the app, e.g. KMS.
+pub const ATTESTATION_FILE: &str = "attestation.cbor";
+pub const PUBLIC_KEY_FILE: &str = "public_key.pem";
+pub const PRIVATE_KEY_FILE: &str = "private_key.pem";
+// The API, as on its TCP port, for fresh documents with nonces of the app's
+pub const API_SOCKET_FILE: &str = "api.sock";
+
+// For apps without an SDK, e.g. in Python or Node, that would rather read
+// files and speak HTTP over a Unix socket. Told where by ENCLAVER_RUNTIME_DIR.
+pub struct RuntimeFiles {
+    task: JoinHandle<()>,
+}
+
+impl RuntimeFiles {
+    pub fn write(
+        dir: &Path,
+        key_type: KeyType,
+        attester: &dyn AttestationProvider,
+        handler: ApiHandler,
+    ) -> Result<Self> {
+        std::fs::create_dir_all(dir)
+            .map_err(|err| anyhow!("failed to create {}: {err}", dir.display()))?;
+
+        let key = KeyPair::generate_with(key_type)?;
+        let attestation = attester.attestation(AttestationParams {
+            nonce: None,
+            user_data: None,
+            public_key: Some(key.public_key_as_der()?),
+        })?;
+
+        write_file(&dir.join(ATTESTATION_FILE), &attestation, 0o644)?;
+        write_file(
+            &dir.join(PUBLIC_KEY_FILE),
+            key.public_key_as_pem()?.as_bytes(),
+            0o644,
+        )?;
+        let private_key = x509::pem("PRIVATE KEY", &key.private_key_as_der()?);
+        write_file(&dir.join(PRIVATE_KEY_FILE), private_key.as_bytes(), 0o600)?;
+
+        // Left over by an earlier run, if the runtime restarted
+        let socket = dir.join(API_SOCKET_FILE);
+        _ = std::fs::remove_file(&socket);
+        let listener = UnixListener::bind(&socket)
+            .map_err(|err| anyhow!("failed to listen on {}: {err}", socket.display()))?;
+
+        std::env::set_var("ENCLAVER_RUNTIME_DIR", dir);
+        info!("Runtime files written to {}", dir.display());
+
+        let handler = Arc::new(handler);
+        let task = tokio::task::spawn(async move {
+            loop {
+                let conn = match listener.accept().await {
+                    Ok((conn, _)) => conn,
+                    Err(err) => {
+                        debug!("API socket accept failed: {err}");
+                        continue;
+                    }
+                };
+                let handler = handler.clone();
+                tokio::task::spawn(async move {
+                    _ = http_util::serve_connection(conn, handler).await;
+                });
+            }
+        });
+
+        Ok(Self { task })
+    }
+
+    pub async fn stop(self) {
+        self.task.abort();
+        _ = self.task.await;
+    }
+}
+
+fn write_file(path: &Path, contents: &[u8], mode: u32) -> Result<()> {
+    let mut file = std::fs::OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .mode(mode)
+        .open(path)
+        .map_err(|err| anyhow!("failed to create {}: {err}", path.display()))?;
+    file.write_all(contents)?;
+
+    Ok(())
+}
@@ -0,0 +1,133 @@
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+use anyhow::{anyhow, Result};
+use log::info;
+use nix::mount::MsFlags;
+use tokio::io::AsyncWriteExt;
+
+use enclaver::constants::CREDENTIALS_VSOCK_PORT;
+use enclaver::credentials::HostCredentialsProvider;
+use enclaver::keypair::KeyPair;
+use enclaver::nsm::{Nsm, NsmAttestationProvider};
+use enclaver::proxy::kms::{KmsClient, KmsProxyConfig};
+use enclaver::proxy::secrets::SecretsFetcher;
+
+use crate::config::Configuration;
+
+// Where secrets go that name neither an env var nor a file
+const SECRETS_DIR: &str = "/run/secrets";
+
+const NO_EGRESS_ERROR: &str = "secrets are configured but egress is not. Configure egress allow policy to access the Secrets Manager, SSM or KMS endpoints";
+
+// Fetches the secrets of the manifest and hands them to the app, which is yet
+// to start. With mount_tmpfs, a tmpfs of its own is mounted on SECRETS_DIR
+// first, which is only done when bootstrapping the enclave.
+pub async fn bootstrap(
+    config: &Arc<Configuration>,
+    nsm: Arc<Nsm>,
+    mount_tmpfs: bool,
+) -> Result<()> {
+    let secrets = match config.manifest.secrets {
+        Some(ref secrets) if !secrets.is_empty() => secrets,
+        _ => return Ok(()),
+    };
+
+    let proxy_uri = config.egress_proxy_uri().ok_or(anyhow!(NO_EGRESS_ERROR))?;
+
+    info!("Fetching credentials from the wrapper");
+    let host_credentials = HostCredentialsProvider::new(CREDENTIALS_VSOCK_PORT)
+        .fetch()
+        .await?;
+    let region = host_credentials.region.clone().ok_or(anyhow!(
+        "the wrapper did not say which AWS region to fetch secrets from"
+    ))?;
+    let credentials = host_credentials.credentials();
+
+    let client = Box::new(enclaver::http_client::new_http_proxy_client(
+        proxy_uri.clone(),
+    ));
+    let mut fetcher = SecretsFetcher::new(client, credentials.clone(), &region);
+
+    if secrets.iter().any(|secret| secret.kms_ciphertext.is_some()) {
+        let kms_config = KmsProxyConfig {
+            client: Box::new(enclaver::http_client::new_http_proxy_client(proxy_uri)),
+            credentials,
+            keypair: Arc::new(KeyPair::generate()?.seal()),
+            attester: Box::new(NsmAttestationProvider::new(nsm)),
+            endpoints: config.clone(),
+        };
+        fetcher = fetcher.with_kms(KmsClient::new(kms_config, &region));
+    }
+
+    if mount_tmpfs
+        && secrets
+            .iter()
+            .any(|secret| secret.env.is_none() && secret.file.is_none())
+    {
+        mount_secrets_dir()?;
+    }
+
+    for secret in secrets {
+        let value = fetcher
+            .fetch(secret)
+            .await
+            .map_err(|err| anyhow!("failed to fetch secret {}: {err}", secret.name))?;
+
+        if let Some(ref env) = secret.env {
+            let value = String::from_utf8(value.clone()).map_err(|_| {
+                anyhow!("secret {} is not UTF-8, so cannot go in {env}", secret.name)
+            })?;
+            std::env::set_var(env, value);
+        }
+
+        if secret.env.is_none() || secret.file.is_some() {
+            let path = match secret.file {
+                Some(ref file) => PathBuf::from(file),
+                None => Path::new(SECRETS_DIR).join(&secret.name),
+            };
+            write_secret(&path, &value).await?;
+        }
+
+        info!("Secret {} fetched", secret.name);
+    }
+
+    Ok(())
+}
+
+fn mount_secrets_dir() -> Result<()> {
+    std::fs::create_dir_all(SECRETS_DIR)?;
+    std::fs::set_permissions(SECRETS_DIR, std::fs::Permissions::from_mode(0o700))?;
+
+    let flags = MsFlags::MS_NOSUID | MsFlags::MS_NODEV | MsFlags::MS_NOEXEC;
+    nix::mount::mount(
+        Some("tmpfs"),
+        SECRETS_DIR,
+        Some("tmpfs"),
+        flags,
+        Some("mode=0700"),
+    )
+    .map_err(|err| anyhow!("failed to mount tmpfs on {SECRETS_DIR}: {err}"))?;
+
+    Ok(())
+}
+
+// Readable by the owner only, which is the app as it runs as root too
+async fn write_secret(path: &Path, value: &[u8]) -> Result<()> {
+    if let Some(dir) = path.parent() {
+        tokio::fs::create_dir_all(dir).await?;
+    }
+
+    let mut file = tokio::fs::OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .mode(0o400)
+        .open(path)
+        .await
+        .map_err(|err| anyhow!("failed to create {}: {err}", path.display()))?;
+    file.write_all(value).await?;
+
+    Ok(())
+}
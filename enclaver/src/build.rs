@@ -2,7 +2,7 @@ use crate::constants::{
     EIF_FILE_NAME, ENCLAVE_CONFIG_DIR, ENCLAVE_ODYN_PATH, MANIFEST_FILE_NAME, RELEASE_BUNDLE_DIR,
 };
 use crate::images::{FileBuilder, FileSource, ImageManager, ImageRef, LayerBuilder};
-use crate::manifest::{load_manifest, Manifest};
+use crate::manifest::{load_manifest, LaunchMode, Manifest};
 use crate::nitro_cli::{EIFInfo, KnownIssue};
 use anyhow::{anyhow, Result};
 use bollard::container::{Config, LogOutput, LogsOptions, WaitContainerOptions};
@@ -19,6 +19,11 @@ use uuid::Uuid;
 const ENCLAVE_OVERLAY_CHOWN: &str = "0:0";
 const RELEASE_OVERLAY_CHOWN: &str = "0:0";
 
+// For odyn to run in a plain container rather than an enclave: with a mock
+// NSM, without bootstrapping the enclave, and dialling the wrapper at
+// VMADDR_CID_LOCAL over vsock loopback
+const SIMULATION_ODYN_ARGS: &[&str] = &["--mock-nsm", "--no-bootstrap", "--host-cid", "1"];
+
 const NITRO_CLI_IMAGE: &str = "registry.edgebit.io/nitro-cli:latest";
 const ODYN_IMAGE: &str = "registry.edgebit.io/odyn:latest";
 const ODYN_IMAGE_BINARY_PATH: &str = "/usr/local/bin/odyn";
@@ -74,6 +79,24 @@ impl EnclaveArtifactBuilder {
         Ok((ibr.eif_info, canonicalize(dst_path).await?))
     }
 
+    /// Build the image of the enclave as a container to run next to the release image, for
+    /// `enclaver run --simulate`. It is amended as for the EIF, but odyn runs with a mock NSM.
+    pub async fn build_simulation(&self, manifest_path: &str) -> Result<ImageRef> {
+        let manifest = load_manifest(manifest_path).await?;
+
+        self.analyze_manifest(&manifest);
+
+        let resolved_sources = self.resolve_sources(&manifest).await?;
+
+        let simulation_img = self
+            .amend_source_image(&resolved_sources, &manifest, manifest_path, true)
+            .await?;
+
+        info!("built simulation image: {}", simulation_img);
+
+        Ok(simulation_img)
+    }
+
     /// Load the referenced manifest, amend the image it references to match what we expect in
     /// an enclave, then convert the resulting image to an EIF.
     async fn common_build(&self, manifest_path: &str) -> Result<IntermediateBuildResult> {
@@ -84,7 +107,7 @@ impl EnclaveArtifactBuilder {
         let resolved_sources = self.resolve_sources(&manifest).await?;
 
         let amended_img = self
-            .amend_source_image(&resolved_sources, manifest_path)
+            .amend_source_image(&resolved_sources, &manifest, manifest_path, false)
             .await?;
 
         info!("built intermediate image: {}", amended_img);
@@ -104,11 +127,13 @@ impl EnclaveArtifactBuilder {
     }
 
     /// Amend a source image by adding one or more layers containing the files we expect
-    /// to have within the enclave.
+    /// to have within the enclave. With `simulate`, odyn is set up to run outside of one.
     async fn amend_source_image(
         &self,
         sources: &ResolvedSources,
+        manifest: &Manifest,
         manifest_path: &str,
+        simulate: bool,
     ) -> Result<ImageRef> {
         let img_config = self
             .docker
@@ -143,8 +168,14 @@ impl EnclaveArtifactBuilder {
             String::from(ENCLAVE_ODYN_PATH),
             String::from("--config-dir"),
             String::from("/etc/enclaver"),
-            String::from("--"),
         ];
+        if manifest.launch_mode == Some(LaunchMode::Exec) {
+            odyn_command.push(String::from("--exec"));
+        }
+        if simulate {
+            odyn_command.extend(SIMULATION_ODYN_ARGS.iter().map(|arg| arg.to_string()));
+        }
+        odyn_command.push(String::from("--"));
 
         odyn_command.append(&mut entrypoint);
         odyn_command.append(&mut cmd);
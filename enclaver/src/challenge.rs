@@ -0,0 +1,365 @@
+use std::collections::{BTreeMap, HashMap};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, Result};
+use rand::RngCore;
+
+use crate::attestation_doc::{AttestationDoc, CoseSign1};
+use crate::pcr_policy::PcrPolicy;
+use crate::x509;
+
+const NONCE_LEN: usize = 32;
+
+// How long after the challenge the document may have been made
+const DEFAULT_MAX_AGE: Duration = Duration::from_secs(5 * 60);
+
+// For enclaves with clocks running ahead of the verifier's
+const CLOCK_SKEW: Duration = Duration::from_secs(60);
+
+// ES384, the one signature algorithm of NSM documents
+const COSE_ALG_ES384: i128 = -35;
+
+// The name of the NSM's hash, which PCRs are the size of
+const DIGEST_SHA384: &str = "SHA384";
+
+// A freshness challenge from a relying party: a random nonce for the enclave
+// to have the NSM bind into an attestation document, which proves that the
+// document was made after the challenge and not replayed. The enclave side
+// needs nothing of its own, the nonce goes to POST /v1/attestation (or to
+// `enclaver attest fetch` through the wrapper).
+pub struct Challenge {
+    nonce: Vec<u8>,
+    issued_at: SystemTime,
+}
+
+impl Challenge {
+    pub fn new() -> Self {
+        let mut nonce = vec![0; NONCE_LEN];
+        rand::rngs::OsRng.fill_bytes(&mut nonce);
+
+        Self {
+            nonce,
+            issued_at: SystemTime::now(),
+        }
+    }
+
+    pub fn nonce(&self) -> &[u8] {
+        &self.nonce
+    }
+}
+
+// What a verified document attests to
+#[derive(Debug, Clone)]
+pub struct Attestation {
+    pub module_id: String,
+    pub timestamp: SystemTime,
+    pub pcrs: BTreeMap<u16, Vec<u8>>,
+    pub public_key: Option<Vec<u8>>,
+    pub user_data: Option<Vec<u8>>,
+    pub nonce: Option<Vec<u8>>,
+}
+
+// Remembers the nonces of documents verified, so that each is accepted once,
+// e.g. in a store shared by the instances of a service. A nonce may be
+// forgotten once it expires, as its document is then too old to be accepted
+// anyway; with no expiry, it has to be kept.
+pub trait ReplayCache: Send + Sync {
+    // False if the nonce was seen before
+    fn insert(&self, nonce: &[u8], expires: Option<SystemTime>) -> bool;
+}
+
+// A ReplayCache of the one process
+#[derive(Default)]
+pub struct MemoryReplayCache {
+    seen: Mutex<HashMap<Vec<u8>, Option<SystemTime>>>,
+}
+
+impl MemoryReplayCache {
+    pub fn new() -> Self {
+        Self::default()
+    }
+}
+
+impl ReplayCache for MemoryReplayCache {
+    fn insert(&self, nonce: &[u8], expires: Option<SystemTime>) -> bool {
+        let now = SystemTime::now();
+        let mut seen = self.seen.lock().unwrap();
+        seen.retain(|_, expires| expires.map_or(true, |expires| expires > now));
+
+        seen.insert(nonce.to_vec(), expires).is_none()
+    }
+}
+
+// Checks the answers to challenges: that the document is signed by the NSM,
+// as certified by a chain up to the root given (the AWS Nitro Enclaves root,
+// or the CA of a mock NSM in tests), that it carries the nonce of the
+// challenge and was made soon after it, and that the PCRs match the policy.
+pub struct Verifier {
+    root: Vec<u8>,
+    max_age: Duration,
+    max_document_age: Option<Duration>,
+    require_nonce: bool,
+    replay_cache: Option<Arc<dyn ReplayCache>>,
+    policy: PcrPolicy,
+}
+
+impl Verifier {
+    // The root certificate in DER
+    pub fn new(root: Vec<u8>) -> Self {
+        Self {
+            root,
+            max_age: DEFAULT_MAX_AGE,
+            max_document_age: None,
+            require_nonce: false,
+            replay_cache: None,
+            policy: PcrPolicy::new(),
+        }
+    }
+
+    pub fn with_max_age(mut self, max_age: Duration) -> Self {
+        self.max_age = max_age;
+        self
+    }
+
+    // Rejects documents made longer ago than that, going by the clock here
+    pub fn with_max_document_age(mut self, max_age: Duration) -> Self {
+        self.max_document_age = Some(max_age);
+        self
+    }
+
+    // Has verify_document reject documents when no nonce is given to match
+    pub fn with_required_nonce(mut self) -> Self {
+        self.require_nonce = true;
+        self
+    }
+
+    // Rejects documents whose nonce was seen before. Without a max document
+    // age, the nonces never expire.
+    pub fn with_replay_cache(mut self, cache: Arc<dyn ReplayCache>) -> Self {
+        self.replay_cache = Some(cache);
+        self
+    }
+
+    // Requires the PCR to have the value, e.g. PCR0 that of `enclaver build`
+    pub fn with_pcr(mut self, index: u16, value: Vec<u8>) -> Self {
+        self.policy = self.policy.with_pcr(index, value);
+        self
+    }
+
+    // Requires the image to have been signed with the certificate (in DER),
+    // as PCR8 attests
+    pub fn with_signing_cert(mut self, cert: &[u8]) -> Self {
+        self.policy = self.policy.with_signing_cert(cert);
+        self
+    }
+
+    pub fn with_policy(mut self, policy: PcrPolicy) -> Self {
+        self.policy = policy;
+        self
+    }
+
+    pub fn verify(&self, challenge: &Challenge, doc: &[u8]) -> Result<Attestation> {
+        let attestation = self.check_document(doc, Some(challenge.nonce()))?;
+
+        if attestation.timestamp + CLOCK_SKEW < challenge.issued_at {
+            return Err(anyhow!("the document was made before the challenge"));
+        }
+        if attestation.timestamp > challenge.issued_at + self.max_age + CLOCK_SKEW {
+            return Err(anyhow!(
+                "the document was made more than {}s after the challenge",
+                self.max_age.as_secs()
+            ));
+        }
+
+        self.check_freshness(&attestation)?;
+        Ok(attestation)
+    }
+
+    // For documents fetched by someone else, so without a challenge to check
+    // the freshness against: a replayed document only fails if the nonce it
+    // was asked for is given.
+    pub fn verify_document(&self, doc: &[u8], nonce: Option<&[u8]>) -> Result<Attestation> {
+        if self.require_nonce && nonce.is_none() {
+            return Err(anyhow!("a nonce is required to verify the document"));
+        }
+
+        let attestation = self.check_document(doc, nonce)?;
+        self.check_freshness(&attestation)?;
+        Ok(attestation)
+    }
+
+    fn check_document(&self, doc: &[u8], nonce: Option<&[u8]>) -> Result<Attestation> {
+        let doc = self.verify_signature(doc)?;
+
+        let attestation = Attestation {
+            module_id: doc.module_id,
+            timestamp: doc.timestamp,
+            pcrs: doc.pcrs,
+            public_key: doc.public_key,
+            user_data: doc.user_data,
+            nonce: doc.nonce,
+        };
+
+        if nonce.is_some() && attestation.nonce.as_deref() != nonce {
+            return Err(anyhow!(
+                "the document does not carry the nonce of the challenge"
+            ));
+        }
+
+        self.policy.matches(&attestation)?;
+        Ok(attestation)
+    }
+
+    // Last, so that documents failing other checks do not use up their nonce
+    fn check_freshness(&self, attestation: &Attestation) -> Result<()> {
+        let mut expires = None;
+        if let Some(max_age) = self.max_document_age {
+            let now = SystemTime::now();
+            if attestation.timestamp > now + CLOCK_SKEW {
+                return Err(anyhow!("the document was made in the future"));
+            }
+            if attestation.timestamp + max_age + CLOCK_SKEW < now {
+                return Err(anyhow!(
+                    "the document is more than {}s old",
+                    max_age.as_secs()
+                ));
+            }
+            expires = Some(attestation.timestamp + max_age + CLOCK_SKEW);
+        }
+
+        if let (Some(cache), Some(nonce)) = (&self.replay_cache, &attestation.nonce) {
+            if !cache.insert(nonce, expires) {
+                return Err(anyhow!("the document was verified before, a replay"));
+            }
+        }
+
+        Ok(())
+    }
+
+    // The payload of the COSE_Sign1 document, once its signature and the
+    // certificate chain check out
+    fn verify_signature(&self, doc: &[u8]) -> Result<AttestationDoc> {
+        let cose = CoseSign1::decode(doc)?;
+        if cose.alg()? != Some(COSE_ALG_ES384) {
+            return Err(anyhow!("the document is not signed with ES384"));
+        }
+
+        let parsed = AttestationDoc::from_payload(&cose.payload)?;
+        if parsed.digest != DIGEST_SHA384 {
+            return Err(anyhow!("unexpected digest {}", parsed.digest));
+        }
+
+        // The bundle starts from the root, which is trusted as it is given
+        // here rather than as it is in the document
+        let intermediates: Vec<&[u8]> = parsed
+            .cabundle
+            .iter()
+            .skip(1)
+            .map(|cert| cert.as_slice())
+            .collect();
+        let anchors = [webpki::TrustAnchor::try_from_cert_der(&self.root)
+            .map_err(|err| anyhow!("invalid root certificate: {err}"))?];
+        let cert = webpki::EndEntityCert::try_from(parsed.certificate.as_slice())
+            .map_err(|err| anyhow!("invalid certificate in the document: {err}"))?;
+
+        let timestamp = parsed.timestamp.duration_since(UNIX_EPOCH)?;
+        let time = webpki::Time::from_seconds_since_unix_epoch(timestamp.as_secs());
+        cert.verify_is_valid_tls_server_cert(
+            &[&webpki::ECDSA_P384_SHA384],
+            &webpki::TlsServerTrustAnchors(&anchors),
+            &intermediates,
+            time,
+        )
+        .map_err(|err| anyhow!("the certificate of the document does not verify: {err}"))?;
+
+        cert.verify_signature(
+            &webpki::ECDSA_P384_SHA384,
+            &cose.signed_data()?,
+            &x509::ecdsa_signature_der(&cose.signature),
+        )
+        .map_err(|err| anyhow!("the signature of the document does not verify: {err}"))?;
+
+        Ok(parsed)
+    }
+}
+
+#[cfg(all(test, feature = "odyn"))]
+mod tests {
+    use super::{Challenge, MemoryReplayCache, Verifier};
+    use crate::mock_nsm::MockNsm;
+    use crate::nsm::{AttestationParams, Nsm};
+    use crate::pcr_policy::PcrPolicy;
+    use assert2::assert;
+    use std::sync::Arc;
+    use std::time::Duration;
+
+    fn attest(nsm: &Nsm, nonce: &[u8]) -> Vec<u8> {
+        nsm.attestation(AttestationParams {
+            nonce: Some(nonce.to_vec()),
+            user_data: Some(b"user data".to_vec()),
+            public_key: None,
+        })
+        .unwrap()
+    }
+
+    #[test]
+    fn test_verify() {
+        let mock = MockNsm::new().unwrap();
+        let ca = mock.ca_certificate().to_vec();
+        let nsm = Nsm::mock(mock);
+
+        // The mock's PCRs are zero, as in debug mode
+        let policy = PcrPolicy::new().with_debug(true).with_pcr(16, vec![0; 48]);
+        let verifier = Verifier::new(ca.clone()).with_policy(policy.clone());
+        let challenge = Challenge::new();
+        let doc = attest(&nsm, challenge.nonce());
+        let attestation = verifier.verify(&challenge, &doc).unwrap();
+        assert!(attestation.user_data.as_deref() == Some(&b"user data"[..]));
+
+        // A replay, answering an earlier challenge
+        let err = verifier.verify(&Challenge::new(), &doc).unwrap_err();
+        assert!(err.to_string().contains("nonce"));
+
+        let verifier = Verifier::new(ca.clone()).with_policy(policy.with_pcr(16, vec![1; 48]));
+        let err = verifier.verify(&challenge, &doc).unwrap_err();
+        assert!(err.to_string().contains("PCR16"));
+
+        let err = Verifier::new(ca).verify(&challenge, &doc).unwrap_err();
+        assert!(err.to_string().contains("debug mode"));
+
+        // Signed by another mock than the one trusted
+        let other = MockNsm::new().unwrap().ca_certificate().to_vec();
+        let err = Verifier::new(other).verify(&challenge, &doc).unwrap_err();
+        assert!(err.to_string().contains("does not verify"));
+    }
+
+    #[test]
+    fn test_freshness() {
+        let mock = MockNsm::new().unwrap();
+        let ca = mock.ca_certificate().to_vec();
+        let nsm = Nsm::mock(mock);
+        let policy = PcrPolicy::new().with_debug(true);
+        let doc = attest(&nsm, b"nonce");
+
+        let verifier = Verifier::new(ca.clone())
+            .with_policy(policy.clone())
+            .with_required_nonce();
+        let err = verifier.verify_document(&doc, None).unwrap_err();
+        assert!(err.to_string().contains("nonce is required"));
+        assert!(verifier.verify_document(&doc, Some(b"nonce")).is_ok());
+
+        let verifier = Verifier::new(ca.clone())
+            .with_policy(policy.clone())
+            .with_max_document_age(Duration::from_secs(60));
+        assert!(verifier.verify_document(&doc, None).is_ok());
+
+        let verifier = Verifier::new(ca)
+            .with_policy(policy)
+            .with_max_document_age(Duration::from_secs(60))
+            .with_replay_cache(Arc::new(MemoryReplayCache::new()));
+        assert!(verifier.verify_document(&doc, None).is_ok());
+        let err = verifier.verify_document(&doc, None).unwrap_err();
+        assert!(err.to_string().contains("replay"));
+    }
+}
@@ -0,0 +1,373 @@
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, Result};
+use futures::{SinkExt, StreamExt};
+use log::{debug, info, warn};
+use serde::{Deserialize, Serialize};
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio::task::JoinHandle;
+use tokio_util::codec::{Framed, LinesCodec};
+use tokio_vsock::VsockStream;
+
+const MAX_LINE_LEN: usize = 1024;
+
+// Drift below this is left alone, stepping the clock for every
+// little difference does more harm than good.
+const MAX_DRIFT: Duration = Duration::from_millis(100);
+
+// Drift reported by the enclave above which the host logs a warning.
+const WARN_DRIFT: Duration = Duration::from_secs(1);
+
+// How far the monotonic clock of the enclave may run off between pushes, well
+// above what the clocks of instances drift
+const MAX_DRIFT_PPM: u32 = 500;
+
+#[derive(Serialize, Deserialize)]
+struct TimeSync {
+    seq: u64,
+    host_time_ns: u64,
+    // The round trip of the previous push, none for the first on a connection
+    rtt_ns: Option<u64>,
+}
+
+#[derive(Serialize, Deserialize)]
+struct TimeSyncAck {
+    seq: u64,
+    // Enclave clock prior to any adjustment
+    enclave_time_ns: u64,
+    adjusted: bool,
+}
+
+fn now_ns() -> Result<u64> {
+    Ok(SystemTime::now().duration_since(UNIX_EPOCH)?.as_nanos() as u64)
+}
+
+// Signed difference a - b, in nanoseconds.
+fn diff_ns(a: u64, b: u64) -> i64 {
+    (a as i128 - b as i128) as i64
+}
+
+// What the time is, as far as the enclave can tell: somewhere between
+// earliest and latest by the clock of the host
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct TrustedTime {
+    pub earliest: SystemTime,
+    pub latest: SystemTime,
+    // Since the push the bounds are from
+    pub last_sync_age: Duration,
+}
+
+impl TrustedTime {
+    // The middle of the bounds
+    pub fn now(&self) -> SystemTime {
+        self.earliest + self.uncertainty() / 2
+    }
+
+    pub fn uncertainty(&self) -> Duration {
+        self.latest
+            .duration_since(self.earliest)
+            .unwrap_or_default()
+    }
+
+    // Whether t has passed for sure, e.g. the expiry of a token
+    pub fn is_after(&self, t: SystemTime) -> bool {
+        self.earliest > t
+    }
+
+    // Whether t is still to come for sure, e.g. the not-before of a certificate
+    pub fn is_before(&self, t: SystemTime) -> bool {
+        self.latest < t
+    }
+}
+
+#[derive(Debug, Clone, Copy)]
+struct SyncPoint {
+    host_time_ns: u64,
+    rtt: Duration,
+    received: Instant,
+}
+
+// The time of the host as of the last push, carried forward by the monotonic
+// clock of the enclave. Unlike the enclave clock, which the app and the
+// pushes can set at any moment, the bounds say how much to make of it: the
+// push took at most the round trip to arrive, and the monotonic clock may
+// have drifted since. It is only as good as the clock of the host, though,
+// which the enclave has no way to check.
+#[derive(Debug, Clone, Default)]
+pub struct TrustedClock {
+    last_sync: Arc<Mutex<Option<SyncPoint>>>,
+}
+
+impl TrustedClock {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    fn record(&self, host_time_ns: u64, rtt: Duration, received: Instant) {
+        *self.last_sync.lock().unwrap() = Some(SyncPoint {
+            host_time_ns,
+            rtt,
+            received,
+        });
+    }
+
+    pub fn now(&self) -> Result<TrustedTime> {
+        let last_sync = *self.last_sync.lock().unwrap();
+        let sync = last_sync.ok_or(anyhow!("the clock has not been synced with the host yet"))?;
+
+        let age = sync.received.elapsed();
+        let drift = age * MAX_DRIFT_PPM / 1_000_000;
+        let host_time = UNIX_EPOCH + Duration::from_nanos(sync.host_time_ns) + age;
+
+        Ok(TrustedTime {
+            earliest: host_time - drift,
+            latest: host_time + sync.rtt + drift,
+            last_sync_age: age,
+        })
+    }
+}
+
+// The runtime (odyn) side: accepts time pushes from the host and steps the
+// enclave clock whenever it has drifted too far. Pushes that tell their
+// round trip also go into the clock.
+pub fn start_serving(port: u32, clock: TrustedClock) -> JoinHandle<Result<()>> {
+    match crate::vsock::ListenConfig::new(port).listen() {
+        Ok(mut incoming) => tokio::task::spawn(async move {
+            while let Some(sock) = incoming.next().await {
+                let clock = clock.clone();
+                tokio::task::spawn(async move {
+                    if let Err(err) = respond(sock, set_clock, &clock).await {
+                        debug!("clock sync connection failed: {err}");
+                    }
+                });
+            }
+            Ok(())
+        }),
+        Err(e) => tokio::task::spawn(async move { Err(e) }),
+    }
+}
+
+fn set_clock(time_ns: u64) -> Result<()> {
+    use nix::sys::time::TimeSpec;
+    use nix::time::{clock_settime, ClockId};
+
+    clock_settime(
+        ClockId::CLOCK_REALTIME,
+        TimeSpec::from(Duration::from_nanos(time_ns)),
+    )?;
+    Ok(())
+}
+
+async fn respond<S, F>(sock: S, set_clock: F, clock: &TrustedClock) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite + Unpin,
+    F: Fn(u64) -> Result<()>,
+{
+    let mut framed = Framed::new(sock, LinesCodec::new_with_max_length(MAX_LINE_LEN));
+
+    while let Some(line) = framed.next().await {
+        let received = Instant::now();
+        let sync: TimeSync = serde_json::from_str(&line?)?;
+        if let Some(rtt_ns) = sync.rtt_ns {
+            clock.record(sync.host_time_ns, Duration::from_nanos(rtt_ns), received);
+        }
+
+        let enclave_time_ns = now_ns()?;
+        let drift = diff_ns(enclave_time_ns, sync.host_time_ns);
+
+        let adjusted = drift.unsigned_abs() > MAX_DRIFT.as_nanos() as u64;
+        if adjusted {
+            info!("enclave clock is off by {drift}ns, setting it to host time");
+            set_clock(sync.host_time_ns)?;
+        }
+
+        framed
+            .send(serde_json::to_string(&TimeSyncAck {
+                seq: sync.seq,
+                enclave_time_ns,
+                adjusted,
+            })?)
+            .await?;
+    }
+
+    Ok(())
+}
+
+// The outcome of a single time push.
+#[derive(Debug)]
+pub struct SyncResult {
+    // Enclave clock minus host clock (at the midpoint of the round trip), in nanoseconds
+    pub drift_ns: i64,
+    pub rtt: Duration,
+    pub adjusted: bool,
+}
+
+// The wrapper side. Pushes the host time into the enclave and measures how far
+// the enclave clock had drifted.
+pub struct ClockSyncClient {
+    cid: u32,
+    port: u32,
+    conn: Option<Framed<VsockStream, LinesCodec>>,
+    seq: u64,
+    last_rtt: Option<Duration>,
+}
+
+impl ClockSyncClient {
+    pub fn new(cid: u32, port: u32) -> Self {
+        Self {
+            cid,
+            port,
+            conn: None,
+            seq: 0,
+            last_rtt: None,
+        }
+    }
+
+    pub async fn sync(&mut self, timeout: Duration) -> Result<SyncResult> {
+        match tokio::time::timeout(timeout, self.sync_inner()).await {
+            Ok(Ok(res)) => Ok(res),
+            Ok(Err(err)) => {
+                self.conn = None;
+                Err(err)
+            }
+            Err(_) => {
+                self.conn = None;
+                Err(anyhow!("no clock sync response within {timeout:?}"))
+            }
+        }
+    }
+
+    async fn sync_inner(&mut self) -> Result<SyncResult> {
+        if self.conn.is_none() {
+            let sock = VsockStream::connect(self.cid, self.port).await?;
+            self.conn = Some(Framed::new(
+                sock,
+                LinesCodec::new_with_max_length(MAX_LINE_LEN),
+            ));
+            self.last_rtt = None;
+        }
+
+        // The first push on a connection has no round trip to tell, so the
+        // enclave gets its time bounds from a second one right after
+        if self.last_rtt.is_none() {
+            let first = self.push().await?;
+            self.push().await?;
+            return Ok(first);
+        }
+
+        self.push().await
+    }
+
+    async fn push(&mut self) -> Result<SyncResult> {
+        self.seq += 1;
+        let conn = self.conn.as_mut().unwrap();
+
+        let res = exchange(conn, self.seq, self.last_rtt).await?;
+        self.last_rtt = Some(res.rtt);
+        Ok(res)
+    }
+}
+
+async fn exchange<S: AsyncRead + AsyncWrite + Unpin>(
+    conn: &mut Framed<S, LinesCodec>,
+    seq: u64,
+    last_rtt: Option<Duration>,
+) -> Result<SyncResult> {
+    let sent_ns = now_ns()?;
+    conn.send(serde_json::to_string(&TimeSync {
+        seq,
+        host_time_ns: sent_ns,
+        rtt_ns: last_rtt.map(|rtt| rtt.as_nanos() as u64),
+    })?)
+    .await?;
+
+    loop {
+        let line = match conn.next().await {
+            Some(line) => line?,
+            None => return Err(anyhow!("clock sync connection closed")),
+        };
+
+        let ack: TimeSyncAck = serde_json::from_str(&line)?;
+        if ack.seq != seq {
+            continue;
+        }
+
+        let recv_ns = now_ns()?;
+        let midpoint_ns = sent_ns + recv_ns.saturating_sub(sent_ns) / 2;
+
+        return Ok(SyncResult {
+            drift_ns: diff_ns(ack.enclave_time_ns, midpoint_ns),
+            rtt: Duration::from_nanos(recv_ns.saturating_sub(sent_ns)),
+            adjusted: ack.adjusted,
+        });
+    }
+}
+
+// Log the outcome of a sync at a level matching how bad the drift was.
+pub fn log_result(res: &SyncResult) {
+    let drift = Duration::from_nanos(res.drift_ns.unsigned_abs());
+    if drift > WARN_DRIFT {
+        warn!(
+            "enclave clock drifted by {}ms (rtt {:?}, adjusted: {})",
+            res.drift_ns / 1_000_000,
+            res.rtt,
+            res.adjusted
+        );
+    } else {
+        debug!(
+            "enclave clock drift {}us (rtt {:?}, adjusted: {})",
+            res.drift_ns / 1_000,
+            res.rtt,
+            res.adjusted
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{exchange, respond, TrustedClock};
+    use anyhow::Result;
+    use assert2::assert;
+    use std::sync::{Arc, Mutex};
+    use std::time::{Duration, SystemTime};
+    use tokio_util::codec::{Framed, LinesCodec};
+
+    #[tokio::test]
+    async fn test_clock_sync() {
+        let (client, server) = tokio::io::duplex(1024);
+
+        let set_to = Arc::new(Mutex::new(None));
+        let set_to_clone = set_to.clone();
+        let clock = TrustedClock::new();
+        let server_clock = clock.clone();
+        let server_task = tokio::task::spawn(async move {
+            let set_clock = move |ns| -> Result<()> {
+                *set_to_clone.lock().unwrap() = Some(ns);
+                Ok(())
+            };
+            respond(server, set_clock, &server_clock).await
+        });
+
+        // Both ends share a clock so there should be no adjustment
+        let mut conn = Framed::new(client, LinesCodec::new());
+        let res = exchange(&mut conn, 1, None).await.unwrap();
+        assert!(!res.adjusted);
+        assert!(res.drift_ns.unsigned_abs() < super::MAX_DRIFT.as_nanos() as u64);
+        assert!(set_to.lock().unwrap().is_none());
+
+        // Nor any bounds without a round trip
+        assert!(clock.now().is_err());
+        exchange(&mut conn, 2, Some(res.rtt)).await.unwrap();
+
+        let now = clock.now().unwrap();
+        let system_now = SystemTime::now();
+        assert!(now.earliest <= system_now);
+        assert!(now.uncertainty() >= res.rtt);
+        assert!(!now.is_after(system_now + Duration::from_secs(1)));
+        assert!(now.is_after(system_now - Duration::from_secs(1)));
+
+        drop(conn);
+        server_task.await.unwrap().unwrap();
+    }
+}
@@ -7,16 +7,35 @@ pub const ENCLAVE_ODYN_PATH: &str = "/sbin/odyn";
 
 pub const RELEASE_BUNDLE_DIR: &str = "/enclave";
 
+// Where the runtime writes its files for the app, unless the manifest says
+pub const RUNTIME_FILES_DIR: &str = "/run/enclaver";
+
 // Port Constants
 
-// start "internal" ports above the 16-bit boundary (reserved for proxying TCP)
+// "Internal" vsock ports, which ingress cannot use (see ports::WELL_KNOWN)
 pub const STATUS_PORT: u32 = 17000;
 pub const APP_LOG_PORT: u32 = 17001;
 pub const HTTP_EGRESS_VSOCK_PORT: u32 = 17002;
+pub const API_VSOCK_PORT: u32 = 17003;
+pub const HEARTBEAT_PORT: u32 = 17004;
+pub const CLOCK_SYNC_PORT: u32 = 17005;
+pub const UDP_EGRESS_VSOCK_PORT: u32 = 17006;
+pub const DNS_VSOCK_PORT: u32 = 17007;
+pub const EGRESS_MUX_VSOCK_PORT: u32 = 17008;
+pub const CREDENTIALS_VSOCK_PORT: u32 = 17009;
+pub const SHUTDOWN_PORT: u32 = 17010;
 
 // Default TCP Port that the egress proxy listens on inside the enclave, if not
 // specified in the manifest.
 pub const HTTP_EGRESS_PROXY_PORT: u16 = 9000;
 
+// TCP Port that outbound connections get redirected to inside the enclave
+// when transparent egress is enabled.
+pub const TRANSPARENT_EGRESS_PORT: u16 = 9001;
+
+// UDP Port the DNS stub resolver listens on inside the enclave when egress DNS
+// is enabled.
+pub const DNS_STUB_PORT: u16 = 53;
+
 // The hostname to refer to the host side from inside the enclave.
 pub const OUTSIDE_HOST: &str = "host";
@@ -0,0 +1,219 @@
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, Result};
+use aws_sdk_s3::types::ByteStream;
+use log::{debug, info};
+use serde::Serialize;
+
+use crate::nitro_cli::EnclaveInfo;
+
+// Where crash bundles get written to.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum CrashTarget {
+    Dir(PathBuf),
+
+    // s3://bucket/prefix, uploaded with the usual credential chain
+    // of the host.
+    S3(String),
+}
+
+impl FromStr for CrashTarget {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        if s.starts_with("s3://") {
+            if s.len() == "s3://".len() {
+                return Err(anyhow!("missing bucket name in {s}"));
+            }
+            Ok(Self::S3(s.trim_end_matches('/').to_string()))
+        } else {
+            Ok(Self::Dir(PathBuf::from(s)))
+        }
+    }
+}
+
+#[derive(Serialize)]
+struct Summary<'a> {
+    enclave_id: &'a str,
+    cid: u32,
+    debug_mode: bool,
+    exit: &'a str,
+    timestamp: u64,
+}
+
+// Everything known about an enclave at the time it failed.
+pub struct CrashReport<'a> {
+    pub enclave_info: &'a EnclaveInfo,
+    pub debug_mode: bool,
+    pub exit: String,
+    pub console: Vec<String>,
+    pub logs: Vec<String>,
+    pub describe_enclaves: Result<Vec<EnclaveInfo>>,
+}
+
+impl<'a> CrashReport<'a> {
+    // Write the bundle to the target and return where it ended up.
+    pub async fn save(&self, target: &CrashTarget) -> Result<String> {
+        let timestamp = SystemTime::now().duration_since(UNIX_EPOCH)?.as_secs();
+        let name = format!("{}-{timestamp}", self.enclave_info.id);
+
+        match target {
+            CrashTarget::Dir(dir) => {
+                let path = dir.join(&name);
+                self.write_to(&path, timestamp).await?;
+                Ok(path.display().to_string())
+            }
+            CrashTarget::S3(prefix) => {
+                let staging = tempfile::tempdir()?;
+                self.write_to(staging.path(), timestamp).await?;
+
+                let dest = format!("{prefix}/{name}/");
+                upload_to_s3(staging.path(), &dest).await?;
+                Ok(dest)
+            }
+        }
+    }
+
+    async fn write_to(&self, dir: &Path, timestamp: u64) -> Result<()> {
+        tokio::fs::create_dir_all(dir).await?;
+
+        let summary = Summary {
+            enclave_id: &self.enclave_info.id,
+            cid: self.enclave_info.cid,
+            debug_mode: self.debug_mode,
+            exit: &self.exit,
+            timestamp,
+        };
+        tokio::fs::write(
+            dir.join("summary.json"),
+            serde_json::to_vec_pretty(&summary)?,
+        )
+        .await?;
+
+        // The console is only available in debug mode
+        if self.debug_mode {
+            tokio::fs::write(dir.join("console.log"), join_lines(&self.console)).await?;
+        }
+
+        tokio::fs::write(dir.join("enclave.log"), join_lines(&self.logs)).await?;
+
+        let describe = match self.describe_enclaves {
+            Ok(ref enclaves) => serde_json::to_vec_pretty(enclaves)?,
+            Err(ref err) => format!("describe-enclaves failed: {err}\n").into_bytes(),
+        };
+        tokio::fs::write(dir.join("describe-enclaves.json"), describe).await?;
+
+        debug!("wrote crash bundle to {}", dir.display());
+
+        Ok(())
+    }
+}
+
+fn join_lines(lines: &[String]) -> String {
+    let mut out = lines.join("\n");
+    out.push('\n');
+    out
+}
+
+// Split s3://bucket/prefix into the bucket and the key prefix.
+fn split_s3_url(url: &str) -> (&str, &str) {
+    let path = url.trim_start_matches("s3://");
+    match path.split_once('/') {
+        Some((bucket, prefix)) => (bucket, prefix),
+        None => (path, ""),
+    }
+}
+
+async fn upload_to_s3(dir: &Path, dest: &str) -> Result<()> {
+    info!("uploading crash bundle to {dest}");
+
+    let (bucket, prefix) = split_s3_url(dest);
+    let sdk_config = aws_config::load_from_env().await;
+    let client = aws_sdk_s3::Client::new(&sdk_config);
+
+    let mut entries = tokio::fs::read_dir(dir).await?;
+    while let Some(entry) = entries.next_entry().await? {
+        let key = format!("{prefix}{}", entry.file_name().to_string_lossy());
+        let body = ByteStream::from(tokio::fs::read(entry.path()).await?);
+
+        client
+            .put_object()
+            .bucket(bucket)
+            .key(&key)
+            .body(body)
+            .send()
+            .await
+            .map_err(|err| anyhow!("failed to upload s3://{bucket}/{key}: {err}"))?;
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{split_s3_url, CrashReport, CrashTarget};
+    use crate::nitro_cli::EnclaveInfo;
+    use assert2::assert;
+    use std::path::PathBuf;
+
+    #[test]
+    fn test_parse_target() {
+        assert!(
+            "/var/crash".parse::<CrashTarget>().unwrap()
+                == CrashTarget::Dir(PathBuf::from("/var/crash"))
+        );
+        assert!(
+            "s3://bucket/crashes/".parse::<CrashTarget>().unwrap()
+                == CrashTarget::S3("s3://bucket/crashes".to_string())
+        );
+        assert!("s3://".parse::<CrashTarget>().is_err());
+    }
+
+    #[test]
+    fn test_split_s3_url() {
+        assert!(split_s3_url("s3://bucket/crashes/i-0123/") == ("bucket", "crashes/i-0123/"));
+        assert!(split_s3_url("s3://bucket/i-0123/") == ("bucket", "i-0123/"));
+        assert!(split_s3_url("s3://bucket") == ("bucket", ""));
+    }
+
+    #[tokio::test]
+    async fn test_save_to_dir() {
+        let dir = tempfile::tempdir().unwrap();
+        let info = EnclaveInfo {
+            name: "test".to_string(),
+            id: "i-0123-enc4567".to_string(),
+            process_id: 1,
+            cid: 16,
+            state: None,
+            flags: None,
+            memory_mib: None,
+        };
+
+        let report = CrashReport {
+            enclave_info: &info,
+            debug_mode: true,
+            exit: "died: kernel_panic".to_string(),
+            console: vec!["Kernel panic - not syncing".to_string()],
+            logs: vec!["odyn: starting".to_string()],
+            describe_enclaves: Ok(vec![]),
+        };
+
+        let target = CrashTarget::Dir(dir.path().to_path_buf());
+        let path = PathBuf::from(report.save(&target).await.unwrap());
+
+        assert!(path.starts_with(dir.path()));
+        for file in [
+            "summary.json",
+            "console.log",
+            "enclave.log",
+            "describe-enclaves.json",
+        ] {
+            assert!(path.join(file).exists());
+        }
+
+        let console = std::fs::read_to_string(path.join("console.log")).unwrap();
+        assert!(console == "Kernel panic - not syncing\n");
+    }
+}
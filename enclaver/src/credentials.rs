@@ -0,0 +1,202 @@
+use std::sync::Arc;
+use std::time::{Duration, UNIX_EPOCH};
+
+use anyhow::{anyhow, Result};
+use async_trait::async_trait;
+use aws_types::credentials::{future, Credentials, CredentialsError, ProvideCredentials};
+use aws_types::sdk_config::SdkConfig;
+use futures::StreamExt;
+use log::{debug, warn};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use crate::rpc;
+use crate::vsock::{self, DialOptions, ListenConfig};
+
+// AWS credentials for the enclave, from the wrapper. The enclave cannot reach
+// IMDS itself other than through egress, which would have to allow it, so the
+// wrapper gets the credentials of the instance (or whatever its environment
+// provides) and hands them in over vsock.
+
+const METHOD: &str = "credentials";
+
+const PROVIDER_NAME: &str = "EnclaverHost";
+
+const DIAL_TIMEOUT: Duration = Duration::from_secs(5);
+
+// As sent over vsock. Also the format of the container credentials endpoint
+// the AWS SDKs read, see api::ApiHandler.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct HostCredentials {
+    pub access_key_id: String,
+    pub secret_access_key: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub token: Option<String>,
+    // Seconds since the epoch
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expiration: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub region: Option<String>,
+}
+
+impl HostCredentials {
+    fn new(credentials: &Credentials, region: Option<String>) -> Self {
+        let expiration = credentials
+            .expiry()
+            .and_then(|expiry| expiry.duration_since(UNIX_EPOCH).ok())
+            .map(|expiry| expiry.as_secs());
+
+        Self {
+            access_key_id: credentials.access_key_id().to_string(),
+            secret_access_key: credentials.secret_access_key().to_string(),
+            token: credentials.session_token().map(str::to_string),
+            expiration,
+            region,
+        }
+    }
+
+    pub fn credentials(&self) -> Credentials {
+        Credentials::new(
+            &self.access_key_id,
+            &self.secret_access_key,
+            self.token.clone(),
+            self.expiration
+                .map(|secs| UNIX_EPOCH + Duration::from_secs(secs)),
+            PROVIDER_NAME,
+        )
+    }
+}
+
+// Serves the credentials of sdk_config to the enclave, asking its provider
+// anew on every request (the providers of aws_config cache them).
+pub struct HostCredentialsServer {
+    incoming: Box<dyn futures::Stream<Item = vsock::Connection> + Unpin + Send>,
+    handler: Arc<Handler>,
+}
+
+impl HostCredentialsServer {
+    pub fn bind(port: u32, sdk_config: SdkConfig) -> Result<Self> {
+        Ok(Self {
+            incoming: Box::new(ListenConfig::new(port).listen()?),
+            handler: Arc::new(Handler { sdk_config }),
+        })
+    }
+
+    pub async fn serve(mut self) {
+        while let Some(conn) = self.incoming.next().await {
+            let handler = self.handler.clone();
+            tokio::task::spawn(async move {
+                if let Err(err) = rpc::serve(conn, handler).await {
+                    debug!("credentials connection failed: {err}");
+                }
+            });
+        }
+    }
+}
+
+struct Handler {
+    sdk_config: SdkConfig,
+}
+
+#[async_trait]
+impl rpc::Handler for Handler {
+    async fn handle(&self, method: &str, _params: Value) -> Result<Value> {
+        if method != METHOD {
+            return Err(anyhow!("unknown method {method}"));
+        }
+
+        let provider = self
+            .sdk_config
+            .credentials_provider()
+            .ok_or(anyhow!("the wrapper has no AWS credentials"))?;
+        let credentials = provider.provide_credentials().await.map_err(|err| {
+            warn!("failed to get AWS credentials for the enclave: {err}");
+            err
+        })?;
+
+        let region = self.sdk_config.region().map(|region| region.to_string());
+        Ok(serde_json::to_value(HostCredentials::new(
+            &credentials,
+            region,
+        ))?)
+    }
+}
+
+// Asks the wrapper for credentials, each time they are needed. For the AWS
+// SDK inside the enclave, in place of the IMDS provider.
+#[derive(Debug, Clone)]
+pub struct HostCredentialsProvider {
+    port: u32,
+}
+
+impl HostCredentialsProvider {
+    pub fn new(port: u32) -> Self {
+        Self { port }
+    }
+
+    // Along with the region of the wrapper, if it knows it
+    pub async fn fetch(&self) -> Result<HostCredentials> {
+        let opts = DialOptions::default().with_timeout(DIAL_TIMEOUT);
+        let conn = vsock::connect(vsock::host_cid(), self.port, &opts).await?;
+        rpc::Client::new(conn).call(METHOD, &()).await
+    }
+}
+
+impl ProvideCredentials for HostCredentialsProvider {
+    fn provide_credentials<'a>(&'a self) -> future::ProvideCredentials<'a>
+    where
+        Self: 'a,
+    {
+        future::ProvideCredentials::new(async move {
+            self.fetch()
+                .await
+                .map(|credentials| credentials.credentials())
+                .map_err(CredentialsError::provider_error)
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{Handler, HostCredentials, METHOD};
+    use crate::rpc::Handler as _;
+    use assert2::assert;
+    use aws_types::credentials::{Credentials, SharedCredentialsProvider};
+    use aws_types::region::Region;
+    use aws_types::sdk_config::SdkConfig;
+    use std::time::{Duration, UNIX_EPOCH};
+
+    #[tokio::test]
+    async fn test_handler() {
+        let expiry = UNIX_EPOCH + Duration::from_secs(1_700_000_000);
+        let credentials =
+            Credentials::new("AKID", "SECRET", Some("TOKEN".into()), Some(expiry), "test");
+        let handler = Handler {
+            sdk_config: SdkConfig::builder()
+                .credentials_provider(SharedCredentialsProvider::new(credentials))
+                .region(Region::new("us-east-1"))
+                .build(),
+        };
+
+        let resp = handler
+            .handle(METHOD, serde_json::Value::Null)
+            .await
+            .unwrap();
+        assert!(resp["AccessKeyId"] == "AKID");
+        assert!(resp["Expiration"] == 1_700_000_000);
+
+        let host_credentials: HostCredentials = serde_json::from_value(resp).unwrap();
+        assert!(host_credentials.region.as_deref() == Some("us-east-1"));
+
+        let credentials = host_credentials.credentials();
+        assert!(credentials.secret_access_key() == "SECRET");
+        assert!(credentials.session_token() == Some("TOKEN"));
+        assert!(credentials.expiry() == Some(expiry));
+
+        assert!(handler
+            .handle("other", serde_json::Value::Null)
+            .await
+            .is_err());
+    }
+}
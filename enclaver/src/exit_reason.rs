@@ -0,0 +1,141 @@
+use std::collections::VecDeque;
+use std::fmt;
+use std::sync::{Arc, Mutex};
+
+// The last lines written to the enclave console (or log stream), kept
+// around to explain why an enclave went away.
+#[derive(Clone)]
+pub struct LineTail {
+    lines: Arc<Mutex<VecDeque<String>>>,
+    capacity: usize,
+}
+
+impl LineTail {
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            lines: Arc::new(Mutex::new(VecDeque::with_capacity(capacity))),
+            capacity,
+        }
+    }
+
+    pub fn push(&self, line: &str) {
+        let mut lines = self.lines.lock().unwrap();
+        if lines.len() == self.capacity {
+            lines.pop_front();
+        }
+        lines.push_back(line.to_string());
+    }
+
+    pub fn lines(&self) -> Vec<String> {
+        self.lines.lock().unwrap().iter().cloned().collect()
+    }
+
+    pub fn clear(&self) {
+        self.lines.lock().unwrap().clear();
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ExitReason {
+    OutOfMemory,
+    KernelPanic,
+    CleanShutdown,
+    Unknown,
+}
+
+impl ExitReason {
+    // Classify the exit based on the tail of the console output.
+    // The console is only available in debug mode, without it
+    // the reason is always Unknown.
+    pub fn from_console(lines: &[String]) -> Self {
+        // Look at the most recent lines first, a panic or a power down
+        // is the last thing the kernel logs.
+        for line in lines.iter().rev() {
+            if line.contains("Kernel panic") {
+                // OOM with panic_on_oom shows up as a panic, check the preceding lines
+                if lines.iter().any(|l| is_oom(l)) {
+                    return Self::OutOfMemory;
+                }
+                return Self::KernelPanic;
+            }
+
+            if is_oom(line) {
+                return Self::OutOfMemory;
+            }
+
+            if line.contains("reboot: Power down") || line.contains("reboot: Restarting system") {
+                return Self::CleanShutdown;
+            }
+        }
+
+        Self::Unknown
+    }
+}
+
+fn is_oom(line: &str) -> bool {
+    line.contains("Out of memory") || line.contains("oom-kill")
+}
+
+impl fmt::Display for ExitReason {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ExitReason::OutOfMemory => write!(f, "out_of_memory"),
+            ExitReason::KernelPanic => write!(f, "kernel_panic"),
+            ExitReason::CleanShutdown => write!(f, "clean_shutdown"),
+            ExitReason::Unknown => write!(f, "unknown"),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{ExitReason, LineTail};
+    use assert2::assert;
+
+    fn lines(ls: &[&str]) -> Vec<String> {
+        ls.iter().map(|l| l.to_string()).collect()
+    }
+
+    #[test]
+    fn test_exit_reason() {
+        assert!(ExitReason::from_console(&[]) == ExitReason::Unknown);
+
+        assert!(
+            ExitReason::from_console(&lines(&[
+                "[   10.1] Out of memory: Killed process 123 (python) total-vm:1000kB",
+                "[   10.2] oom_reaper: reaped process 123 (python)",
+            ])) == ExitReason::OutOfMemory
+        );
+
+        assert!(
+            ExitReason::from_console(&lines(&[
+                "[    3.0] odyn: starting",
+                "[    4.1] Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000100",
+            ])) == ExitReason::KernelPanic
+        );
+
+        assert!(
+            ExitReason::from_console(&lines(&[
+                "[    4.0] Out of memory: Killed process 1 (odyn)",
+                "[    4.1] Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000009",
+            ])) == ExitReason::OutOfMemory
+        );
+
+        assert!(
+            ExitReason::from_console(&lines(&["[    9.0] reboot: Power down"]))
+                == ExitReason::CleanShutdown
+        );
+    }
+
+    #[test]
+    fn test_line_tail() {
+        let tail = LineTail::new(100);
+        for i in 0..110 {
+            tail.push(&format!("line {i}"));
+        }
+
+        let lines = tail.lines();
+        assert!(lines.len() == 100);
+        assert!(lines[0] == "line 10");
+    }
+}
@@ -0,0 +1,388 @@
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, Result};
+use futures::{SinkExt, StreamExt};
+use lazy_static::lazy_static;
+use log::debug;
+use serde::{Deserialize, Serialize};
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio::task::JoinHandle;
+use tokio_util::codec::{Framed, LinesCodec};
+use uuid::Uuid;
+
+use crate::vsock::{self, Connection, DialOptions};
+
+// The wrapper pings the runtime this often, and waits this long for a pong
+pub const INTERVAL: Duration = Duration::from_secs(5);
+pub const TIMEOUT: Duration = Duration::from_secs(3);
+
+// Heartbeats missed in a row before the peer is considered dead
+pub const MISS_LIMIT: u32 = 3;
+
+const MAX_LINE_LEN: usize = 1024;
+
+lazy_static! {
+    // Tells this process apart from the one that ran before it, so that the
+    // peer can tell it was restarted
+    static ref BOOT_ID: String = Uuid::new_v4().to_string();
+}
+
+// Boot ids are left out by older peers
+#[derive(Serialize, Deserialize)]
+struct Ping {
+    seq: u64,
+    #[serde(default)]
+    boot_id: Option<String>,
+}
+
+#[derive(Serialize, Deserialize)]
+struct Pong {
+    seq: u64,
+    #[serde(default)]
+    boot_id: Option<String>,
+}
+
+// What the latest heartbeat (or its absence) shows about the peer
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Event {
+    // The first heartbeat
+    Up,
+    Alive,
+    // Heartbeat again, after some were missed
+    Restored { missed: u32 },
+    // Heartbeat from another boot of the peer than before. It may have come
+    // back too quickly for any heartbeat to be missed.
+    Restarted,
+    // None seen yet
+    Down { err: String },
+    Missed { missed: u32, err: String },
+    // Missed MISS_LIMIT in a row, or more
+    Dead { missed: u32, err: String },
+}
+
+// Turns heartbeats into events, for either side
+struct Liveness {
+    miss_limit: u32,
+    up: bool,
+    missed: u32,
+    boot_id: Option<String>,
+}
+
+impl Liveness {
+    fn new(miss_limit: u32) -> Self {
+        Self {
+            miss_limit,
+            up: false,
+            missed: 0,
+            boot_id: None,
+        }
+    }
+
+    fn beat(&mut self, boot_id: Option<String>) -> Event {
+        let missed = std::mem::take(&mut self.missed);
+        let restarted = match (&self.boot_id, &boot_id) {
+            (Some(prev), Some(boot_id)) => prev != boot_id,
+            _ => false,
+        };
+        if boot_id.is_some() {
+            self.boot_id = boot_id;
+        }
+
+        if !self.up {
+            self.up = true;
+            Event::Up
+        } else if restarted {
+            Event::Restarted
+        } else if missed > 0 {
+            Event::Restored { missed }
+        } else {
+            Event::Alive
+        }
+    }
+
+    fn miss(&mut self, err: String) -> Event {
+        if !self.up {
+            return Event::Down { err };
+        }
+
+        self.missed += 1;
+        if self.missed >= self.miss_limit {
+            Event::Dead {
+                missed: self.missed,
+                err,
+            }
+        } else {
+            Event::Missed {
+                missed: self.missed,
+                err,
+            }
+        }
+    }
+}
+
+// The runtime (odyn) side: answers every ping with a pong carrying the same
+// sequence number. A pong therefore shows that the runtime is scheduling
+// tasks, not merely that the enclave VM exists. The pings of the wrapper are
+// watched in turn, and on_event told what they show about it.
+pub fn start_serving<F>(listen: vsock::ListenConfig, on_event: F) -> JoinHandle<Result<()>>
+where
+    F: Fn(Event) + Send + Sync + 'static,
+{
+    let mut incoming = match listen.listen() {
+        Ok(incoming) => incoming,
+        Err(e) => return tokio::task::spawn(async move { Err(e) }),
+    };
+
+    tokio::task::spawn(async move {
+        let on_event = Arc::new(on_event);
+        let watch = Arc::new(Mutex::new(Watch {
+            liveness: Liveness::new(MISS_LIMIT),
+            pinged: false,
+        }));
+        let watchdog = tokio::task::spawn(watch_pings(watch.clone(), on_event.clone()));
+
+        while let Some(sock) = incoming.next().await {
+            let watch = watch.clone();
+            let on_event = on_event.clone();
+            tokio::task::spawn(async move {
+                let on_ping = |boot_id| {
+                    let event = {
+                        let mut watch = watch.lock().unwrap();
+                        watch.pinged = true;
+                        watch.liveness.beat(boot_id)
+                    };
+                    on_event(event);
+                };
+                if let Err(err) = respond(sock, on_ping).await {
+                    debug!("heartbeat connection failed: {err}");
+                }
+            });
+        }
+
+        watchdog.abort();
+        Ok(())
+    })
+}
+
+struct Watch {
+    liveness: Liveness,
+    // Since the last check
+    pinged: bool,
+}
+
+// Checked less often than the wrapper pings, so that a ping that is merely
+// late does not count as missed
+async fn watch_pings<F: Fn(Event)>(watch: Arc<Mutex<Watch>>, on_event: Arc<F>) {
+    let period = INTERVAL * 2;
+    let mut interval = tokio::time::interval_at(tokio::time::Instant::now() + period, period);
+
+    loop {
+        interval.tick().await;
+
+        let event = {
+            let mut watch = watch.lock().unwrap();
+            if std::mem::take(&mut watch.pinged) {
+                continue;
+            }
+            watch.liveness.miss(format!("no ping within {period:?}"))
+        };
+        on_event(event);
+    }
+}
+
+async fn respond<S, F>(sock: S, mut on_ping: F) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite + Unpin,
+    F: FnMut(Option<String>),
+{
+    let mut framed = Framed::new(sock, LinesCodec::new_with_max_length(MAX_LINE_LEN));
+
+    while let Some(line) = framed.next().await {
+        let ping: Ping = serde_json::from_str(&line?)?;
+        on_ping(ping.boot_id);
+
+        let pong = Pong {
+            seq: ping.seq,
+            boot_id: Some(BOOT_ID.clone()),
+        };
+        framed.send(serde_json::to_string(&pong)?).await?;
+    }
+
+    Ok(())
+}
+
+// The wrapper side. Pings the runtime every INTERVAL, for next to tell what
+// became of it.
+pub struct Monitor {
+    client: HeartbeatClient,
+    interval: tokio::time::Interval,
+    liveness: Liveness,
+}
+
+impl Monitor {
+    pub fn new(client: HeartbeatClient) -> Self {
+        Self {
+            client,
+            interval: tokio::time::interval(INTERVAL),
+            liveness: Liveness::new(MISS_LIMIT),
+        }
+    }
+
+    pub async fn next(&mut self) -> Event {
+        self.interval.tick().await;
+
+        match self.client.ping(TIMEOUT).await {
+            Ok((_, boot_id)) => self.liveness.beat(boot_id),
+            Err(err) => self.liveness.miss(err.to_string()),
+        }
+    }
+}
+
+// Keeps a connection open to the runtime and re-establishes it after any
+// failure.
+pub struct HeartbeatClient {
+    cid: u32,
+    port: u32,
+    conn: Option<Framed<Connection, LinesCodec>>,
+    seq: u64,
+}
+
+impl HeartbeatClient {
+    pub fn new(cid: u32, port: u32) -> Self {
+        Self {
+            cid,
+            port,
+            conn: None,
+            seq: 0,
+        }
+    }
+
+    // Send a ping and wait for the matching pong. Returns the round trip time,
+    // and the boot id of the runtime if it sent one.
+    pub async fn ping(&mut self, timeout: Duration) -> Result<(Duration, Option<String>)> {
+        let start = Instant::now();
+
+        match tokio::time::timeout(timeout, self.ping_inner()).await {
+            Ok(Ok(boot_id)) => Ok((start.elapsed(), boot_id)),
+            Ok(Err(err)) => {
+                self.conn = None;
+                Err(err)
+            }
+            Err(_) => {
+                self.conn = None;
+                Err(anyhow!("no heartbeat response within {timeout:?}"))
+            }
+        }
+    }
+
+    async fn ping_inner(&mut self) -> Result<Option<String>> {
+        if self.conn.is_none() {
+            let sock = vsock::connect(self.cid, self.port, &DialOptions::default()).await?;
+            self.conn = Some(Framed::new(
+                sock,
+                LinesCodec::new_with_max_length(MAX_LINE_LEN),
+            ));
+        }
+
+        self.seq += 1;
+        let seq = self.seq;
+        let conn = self.conn.as_mut().unwrap();
+
+        exchange(conn, seq).await
+    }
+}
+
+async fn exchange<S: AsyncRead + AsyncWrite + Unpin>(
+    conn: &mut Framed<S, LinesCodec>,
+    seq: u64,
+) -> Result<Option<String>> {
+    let ping = Ping {
+        seq,
+        boot_id: Some(BOOT_ID.clone()),
+    };
+    conn.send(serde_json::to_string(&ping)?).await?;
+
+    // Skip over any stale pongs from pings that previously timed out
+    loop {
+        match conn.next().await {
+            Some(line) => {
+                let pong: Pong = serde_json::from_str(&line?)?;
+                if pong.seq == seq {
+                    return Ok(pong.boot_id);
+                }
+            }
+            None => return Err(anyhow!("heartbeat connection closed")),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{exchange, respond, start_serving, Event, HeartbeatClient, Liveness, Monitor};
+    use super::{BOOT_ID, TIMEOUT};
+    use crate::vsock::{ListenConfig, VMADDR_CID_MEMORY};
+    use assert2::assert;
+    use tokio_util::codec::{Framed, LinesCodec};
+
+    #[tokio::test]
+    async fn test_ping_pong() {
+        let (client, server) = tokio::io::duplex(1024);
+
+        let server_task = tokio::task::spawn(async move {
+            let mut pings = 0;
+            respond(server, |boot_id| {
+                assert!(boot_id.as_deref() == Some(BOOT_ID.as_str()));
+                pings += 1;
+            })
+            .await
+            .unwrap();
+            pings
+        });
+
+        let mut conn = Framed::new(client, LinesCodec::new());
+        for seq in 1..10 {
+            let boot_id = exchange(&mut conn, seq).await.unwrap();
+            assert!(boot_id.as_deref() == Some(BOOT_ID.as_str()));
+        }
+
+        drop(conn);
+        assert!(server_task.await.unwrap() == 9);
+    }
+
+    #[tokio::test]
+    async fn test_monitor() {
+        let port = 17930;
+        let mut monitor = Monitor::new(HeartbeatClient::new(VMADDR_CID_MEMORY, port));
+        assert!(let Event::Down { .. } = monitor.next().await);
+
+        let listen = ListenConfig::new(port).with_cid(VMADDR_CID_MEMORY);
+        let server_task = start_serving(listen, |_| {});
+
+        let mut client = HeartbeatClient::new(VMADDR_CID_MEMORY, port);
+        let (_, boot_id) = client.ping(TIMEOUT).await.unwrap();
+        assert!(boot_id.as_deref() == Some(BOOT_ID.as_str()));
+
+        server_task.abort();
+    }
+
+    #[test]
+    fn test_liveness() {
+        let mut liveness = Liveness::new(2);
+        let err = || "timed out".to_string();
+
+        assert!(let Event::Down { .. } = liveness.miss(err()));
+        assert!(liveness.beat(Some("a".to_string())) == Event::Up);
+        assert!(liveness.beat(Some("a".to_string())) == Event::Alive);
+
+        assert!(let Event::Missed { missed: 1, .. } = liveness.miss(err()));
+        assert!(let Event::Dead { missed: 2, .. } = liveness.miss(err()));
+        assert!(let Event::Dead { missed: 3, .. } = liveness.miss(err()));
+        assert!(liveness.beat(Some("a".to_string())) == Event::Restored { missed: 3 });
+
+        // A restart is told by the boot id, missed heartbeats or not
+        assert!(liveness.beat(Some("b".to_string())) == Event::Restarted);
+        assert!(liveness.beat(None) == Event::Alive);
+        assert!(liveness.beat(Some("b".to_string())) == Event::Alive);
+    }
+}
@@ -0,0 +1,125 @@
+use ::hpke::aead::AesGcm256;
+use ::hpke::kdf::HkdfSha256;
+use ::hpke::kem::X25519HkdfSha256;
+use ::hpke::{Deserializable, Kem, OpModeR, OpModeS, Serializable};
+use anyhow::{anyhow, Result};
+use rand::rngs::OsRng;
+
+use crate::challenge::Attestation;
+
+// HPKE (RFC 9180) in base mode, to send data one way into an enclave without
+// KMS: whoever verified an attestation of the enclave's key seals to it, and
+// only the enclave can open the message.
+type KemSuite = X25519HkdfSha256;
+type KdfSuite = HkdfSha256;
+type AeadSuite = AesGcm256;
+
+// Keeps messages sealed here from being opened as anything else
+const INFO: &[u8] = b"enclaver-hpke-v1";
+
+// A message sealed to an enclave: the encapsulated key and the ciphertext
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SealedMessage {
+    pub enc: Vec<u8>,
+    pub ciphertext: Vec<u8>,
+}
+
+impl SealedMessage {
+    // As POST /v1/hpke/open takes it
+    pub fn to_json(&self) -> serde_json::Value {
+        serde_json::json!({
+            "enc": base64::encode(&self.enc),
+            "ciphertext": base64::encode(&self.ciphertext),
+        })
+    }
+}
+
+// The enclave side, with a key made at boot that never leaves the enclave
+pub struct HpkeKeyPair {
+    private_key: <KemSuite as Kem>::PrivateKey,
+    public_key: <KemSuite as Kem>::PublicKey,
+}
+
+impl HpkeKeyPair {
+    pub fn generate() -> Self {
+        let (private_key, public_key) = KemSuite::gen_keypair(&mut OsRng);
+        Self {
+            private_key,
+            public_key,
+        }
+    }
+
+    // The raw X25519 key, as bound into attestation documents
+    pub fn public_key(&self) -> Vec<u8> {
+        self.public_key.to_bytes().to_vec()
+    }
+
+    pub fn open(&self, message: &SealedMessage, aad: &[u8]) -> Result<Vec<u8>> {
+        let enc = <KemSuite as Kem>::EncappedKey::from_bytes(&message.enc)
+            .map_err(|err| anyhow!("invalid encapsulated key: {err}"))?;
+
+        ::hpke::single_shot_open::<AeadSuite, KdfSuite, KemSuite>(
+            &OpModeR::Base,
+            &self.private_key,
+            &enc,
+            INFO,
+            &message.ciphertext,
+            aad,
+        )
+        .map_err(|err| anyhow!("the message does not open: {err}"))
+    }
+}
+
+// The sender side, outside the enclave. The key must come from a document
+// that was verified, or anyone could have made it.
+pub fn seal(public_key: &[u8], plaintext: &[u8], aad: &[u8]) -> Result<SealedMessage> {
+    let public_key = <KemSuite as Kem>::PublicKey::from_bytes(public_key)
+        .map_err(|err| anyhow!("not an X25519 public key: {err}"))?;
+
+    let (enc, ciphertext) = ::hpke::single_shot_seal::<AeadSuite, KdfSuite, KemSuite, _>(
+        &OpModeS::Base,
+        &public_key,
+        INFO,
+        plaintext,
+        aad,
+        &mut OsRng,
+    )
+    .map_err(|err| anyhow!("failed to seal the message: {err}"))?;
+
+    Ok(SealedMessage {
+        enc: enc.to_bytes().to_vec(),
+        ciphertext,
+    })
+}
+
+// To the key of a document verified with challenge::Verifier, e.g. one from
+// GET /v1/hpke/attestation
+pub fn seal_to(attestation: &Attestation, plaintext: &[u8], aad: &[u8]) -> Result<SealedMessage> {
+    let public_key = attestation
+        .public_key
+        .as_deref()
+        .ok_or_else(|| anyhow!("the document does not bind a public key"))?;
+    seal(public_key, plaintext, aad)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{seal, HpkeKeyPair};
+    use assert2::assert;
+
+    #[test]
+    fn test_seal_open() {
+        let key = HpkeKeyPair::generate();
+        let mut message = seal(&key.public_key(), b"secret", b"aad").unwrap();
+        assert!(message.ciphertext != b"secret");
+        assert!(key.open(&message, b"aad").unwrap() == b"secret");
+
+        assert!(key.open(&message, b"other aad").is_err());
+        assert!(HpkeKeyPair::generate().open(&message, b"aad").is_err());
+
+        message.ciphertext[0] ^= 1;
+        assert!(key.open(&message, b"aad").is_err());
+
+        assert!(seal(b"short", b"secret", b"").is_err());
+    }
+}
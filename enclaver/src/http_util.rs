@@ -4,7 +4,9 @@ use std::sync::Arc;
 
 use anyhow::Result;
 use async_trait::async_trait;
-use hyper::{server::conn::AddrIncoming, Body, Request, Response, Server, StatusCode};
+use hyper::server::conn::{AddrIncoming, Http};
+use hyper::{Body, Request, Response, Server, StatusCode};
+use tokio::io::{AsyncRead, AsyncWrite};
 
 #[async_trait]
 pub trait HttpHandler {
@@ -49,6 +51,28 @@ impl HttpServer {
     }
 }
 
+// Serve a single, already accepted connection (e.g. a vsock or a unix socket).
+pub async fn serve_connection<S, H>(conn: S, handler: Arc<H>) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite + Unpin + Send + 'static,
+    H: HttpHandler + Send + Sync + 'static,
+{
+    let svc = hyper::service::service_fn(move |req: Request<Body>| {
+        let handler = handler.clone();
+        async move {
+            let resp = handler
+                .handle(req)
+                .await
+                .unwrap_or_else(|err| internal_srv_err(err.to_string()));
+
+            Result::<_, Infallible>::Ok(resp)
+        }
+    });
+
+    Http::new().serve_connection(conn, svc).await?;
+    Ok(())
+}
+
 pub fn internal_srv_err(msg: String) -> Response<Body> {
     Response::builder()
         .status(StatusCode::INTERNAL_SERVER_ERROR)
@@ -63,6 +87,20 @@ pub fn bad_request(msg: String) -> Response<Body> {
         .unwrap()
 }
 
+pub fn conflict(msg: String) -> Response<Body> {
+    Response::builder()
+        .status(StatusCode::CONFLICT)
+        .body(Body::from(msg))
+        .unwrap()
+}
+
+pub fn service_unavailable(msg: String) -> Response<Body> {
+    Response::builder()
+        .status(StatusCode::SERVICE_UNAVAILABLE)
+        .body(Body::from(msg))
+        .unwrap()
+}
+
 pub fn method_not_allowed() -> Response<Body> {
     Response::builder()
         .status(StatusCode::METHOD_NOT_ALLOWED)
@@ -0,0 +1,110 @@
+use anyhow::{anyhow, Result};
+use ring::hkdf;
+
+// Keeps keys derived here apart from any other use of the same data key
+const INFO_PREFIX: &[u8] = b"enclaver-kdf-v1";
+
+// What HKDF-SHA384 can expand to
+pub const MAX_KEY_LEN: usize = 255 * 48;
+
+// What a derived key is for: the measurement of the enclave (its PCR0) and
+// labels of the app, e.g. "db-encryption" and a tenant ID. Keys derived for
+// other labels, or in another image, are unrelated even from the same data
+// key, so one leaking gives nothing away about the others.
+#[derive(Debug, Clone)]
+pub struct KeyContext {
+    measurement: Vec<u8>,
+    labels: Vec<String>,
+}
+
+impl KeyContext {
+    pub fn new(measurement: Vec<u8>) -> Self {
+        Self {
+            measurement,
+            labels: Vec::new(),
+        }
+    }
+
+    pub fn with_label(mut self, label: &str) -> Self {
+        self.labels.push(label.to_string());
+        self
+    }
+
+    // Every part is length prefixed, so that labels "ab" and "c" do not
+    // derive the key of "a" and "bc"
+    fn info(&self) -> Vec<u8> {
+        let mut info = INFO_PREFIX.to_vec();
+        for part in std::iter::once(self.measurement.as_slice())
+            .chain(self.labels.iter().map(|label| label.as_bytes()))
+        {
+            info.extend_from_slice(&(part.len() as u32).to_be_bytes());
+            info.extend_from_slice(part);
+        }
+        info
+    }
+}
+
+// HKDF-SHA384 of the data key, e.g. the plaintext of a KMS GenerateDataKey.
+// The data key is the one secret, so it must come from a source of its own
+// like KMS rather than be a password.
+pub fn derive_key(data_key: &[u8], context: &KeyContext, len: usize) -> Result<Vec<u8>> {
+    if len == 0 || len > MAX_KEY_LEN {
+        return Err(anyhow!(
+            "keys of {len} bytes cannot be derived, at most {MAX_KEY_LEN}"
+        ));
+    }
+
+    let info = context.info();
+    let prk = hkdf::Salt::new(hkdf::HKDF_SHA384, &[]).extract(data_key);
+    let okm = prk
+        .expand(&[&info], KeyLen(len))
+        .map_err(|_| anyhow!("failed to derive the key"))?;
+
+    let mut key = vec![0; len];
+    okm.fill(&mut key)
+        .map_err(|_| anyhow!("failed to derive the key"))?;
+    Ok(key)
+}
+
+struct KeyLen(usize);
+
+impl hkdf::KeyType for KeyLen {
+    fn len(&self) -> usize {
+        self.0
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{derive_key, KeyContext, MAX_KEY_LEN};
+    use assert2::assert;
+
+    #[test]
+    fn test_derive_key() {
+        let data_key = [7; 32];
+        let context = KeyContext::new(vec![1; 48]).with_label("db");
+
+        let key = derive_key(&data_key, &context, 32).unwrap();
+        assert!(key.len() == 32);
+        assert!(derive_key(&data_key, &context, 32).unwrap() == key);
+
+        let other_label = KeyContext::new(vec![1; 48]).with_label("files");
+        assert!(derive_key(&data_key, &other_label, 32).unwrap() != key);
+
+        let other_image = KeyContext::new(vec![2; 48]).with_label("db");
+        assert!(derive_key(&data_key, &other_image, 32).unwrap() != key);
+
+        let split = |labels: &[&str]| {
+            let context = labels
+                .iter()
+                .fold(KeyContext::new(vec![1; 48]), |context, label| {
+                    context.with_label(label)
+                });
+            derive_key(&data_key, &context, 32).unwrap()
+        };
+        assert!(split(&["ab", "c"]) != split(&["a", "bc"]));
+
+        assert!(derive_key(&data_key, &context, 0).is_err());
+        assert!(derive_key(&data_key, &context, MAX_KEY_LEN + 1).is_err());
+    }
+}
@@ -1,35 +1,457 @@
-use anyhow::Result;
-use rsa::pkcs8::{EncodePublicKey, LineEnding};
+use std::sync::Arc;
+use std::time::Instant;
+
+use anyhow::{anyhow, Result};
+use p384::pkcs8::DecodePrivateKey;
+use ring::rand::SystemRandom;
+use ring::signature::{EcdsaKeyPair, Ed25519KeyPair, KeyPair as _, ECDSA_P384_SHA384_ASN1_SIGNING};
+use rsa::padding::PaddingScheme;
+use rsa::pkcs8::{EncodePrivateKey, EncodePublicKey, LineEnding};
 use rsa::{RsaPrivateKey, RsaPublicKey};
+use serde::{Deserialize, Serialize};
+use sha2::digest::DynDigest;
+use sha2::{Digest, Sha256, Sha384, Sha512};
+
+use crate::metrics;
 
 const RSA_KEY_LEN: usize = 2048;
 
+// DigestInfo for SHA-256, which precedes the digest in PKCS#1 v1.5 signatures
+const SHA256_DIGEST_INFO: &[u8] = &[
+    0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05,
+    0x00, 0x04, 0x20,
+];
+
+// What precedes the public key in a SubjectPublicKeyInfo: the algorithm
+// (id-ecPublicKey on secp384r1, and id-Ed25519) and the BIT STRING header
+const P384_SPKI_PREFIX: &[u8] = &[
+    0x30, 0x76, 0x30, 0x10, 0x06, 0x07, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x02, 0x01, 0x06, 0x05, 0x2b,
+    0x81, 0x04, 0x00, 0x22, 0x03, 0x62, 0x00,
+];
+const ED25519_SPKI_PREFIX: &[u8] = &[
+    0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00,
+];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum KeyType {
+    Rsa2048,
+    EcdsaP384,
+    Ed25519,
+}
+
+impl Default for KeyType {
+    fn default() -> Self {
+        Self::Rsa2048
+    }
+}
+
+impl KeyType {
+    // As in manifests
+    pub fn name(&self) -> &'static str {
+        match self {
+            Self::Rsa2048 => "rsa2048",
+            Self::EcdsaP384 => "ecdsa_p384",
+            Self::Ed25519 => "ed25519",
+        }
+    }
+}
+
+// A key pair along with the attestation document of its public key
+pub struct AttestedKey {
+    pub key: KeyPair,
+    pub attestation: Vec<u8>,
+}
+
 #[derive(Clone)]
 pub struct KeyPair {
-    pub private: RsaPrivateKey,
-    pub public: RsaPublicKey,
+    key: Key,
+}
+
+// ring keys can neither be cloned nor give back their PKCS#8, so that is kept
+// alongside
+#[derive(Clone)]
+enum Key {
+    Rsa(RsaPrivateKey, RsaPublicKey),
+    EcdsaP384(Vec<u8>, Arc<EcdsaKeyPair>),
+    Ed25519(Vec<u8>, Arc<Ed25519KeyPair>),
 }
 
 impl KeyPair {
+    // An RSA key, as KMS requires of recipients
     pub fn generate() -> Result<Self> {
-        let mut rng = rand::thread_rng();
-        let private = RsaPrivateKey::new(&mut rng, RSA_KEY_LEN)?;
-        let public = RsaPublicKey::from(&private);
+        Self::generate_with(KeyType::Rsa2048)
+    }
+
+    pub fn generate_with(key_type: KeyType) -> Result<Self> {
+        let start = Instant::now();
+        let rng = SystemRandom::new();
+        let key = match key_type {
+            KeyType::Rsa2048 => {
+                let private = RsaPrivateKey::new(&mut rand::thread_rng(), RSA_KEY_LEN)?;
+                let public = RsaPublicKey::from(&private);
+                Key::Rsa(private, public)
+            }
+            KeyType::EcdsaP384 => {
+                let pkcs8 = EcdsaKeyPair::generate_pkcs8(&ECDSA_P384_SHA384_ASN1_SIGNING, &rng)
+                    .map_err(|_| anyhow!("failed to generate a P-384 key"))?;
+                let key = EcdsaKeyPair::from_pkcs8(&ECDSA_P384_SHA384_ASN1_SIGNING, pkcs8.as_ref())
+                    .map_err(|err| anyhow!("generated P-384 key rejected: {err}"))?;
+                Key::EcdsaP384(pkcs8.as_ref().to_vec(), Arc::new(key))
+            }
+            KeyType::Ed25519 => {
+                let pkcs8 = Ed25519KeyPair::generate_pkcs8(&rng)
+                    .map_err(|_| anyhow!("failed to generate an Ed25519 key"))?;
+                let key = Ed25519KeyPair::from_pkcs8(pkcs8.as_ref())
+                    .map_err(|err| anyhow!("generated Ed25519 key rejected: {err}"))?;
+                Key::Ed25519(pkcs8.as_ref().to_vec(), Arc::new(key))
+            }
+        };
+        metrics::RUNTIME.key_generated(key_type.name(), start.elapsed());
 
-        Ok(KeyPair { private, public })
+        Ok(Self { key })
     }
 
     pub fn from_private(private: RsaPrivateKey) -> Self {
         let public = private.to_public_key();
 
-        Self { private, public }
+        Self {
+            key: Key::Rsa(private, public),
+        }
     }
 
+    // Of any key type, in PKCS#8 DER as private_key_as_der() gives it
+    pub fn from_pkcs8_der(der: &[u8]) -> Result<Self> {
+        if let Ok(private) = RsaPrivateKey::from_pkcs8_der(der) {
+            return Ok(Self::from_private(private));
+        }
+        if let Ok(key) = EcdsaKeyPair::from_pkcs8(&ECDSA_P384_SHA384_ASN1_SIGNING, der) {
+            return Ok(Self {
+                key: Key::EcdsaP384(der.to_vec(), Arc::new(key)),
+            });
+        }
+        // Without the public key too, as OpenSSL writes it
+        match Ed25519KeyPair::from_pkcs8_maybe_unchecked(der) {
+            Ok(key) => Ok(Self {
+                key: Key::Ed25519(der.to_vec(), Arc::new(key)),
+            }),
+            Err(_) => Err(anyhow!("not an RSA, P-384 or Ed25519 private key")),
+        }
+    }
+
+    pub fn key_type(&self) -> KeyType {
+        match self.key {
+            Key::Rsa(..) => KeyType::Rsa2048,
+            Key::EcdsaP384(..) => KeyType::EcdsaP384,
+            Key::Ed25519(..) => KeyType::Ed25519,
+        }
+    }
+
+    // A SubjectPublicKeyInfo, whatever the key type, as the attestation
+    // public_key and certificates carry it
     pub fn public_key_as_der(&self) -> Result<Vec<u8>> {
-        Ok(self.public.to_public_key_der()?.into_vec())
+        match self.key {
+            Key::Rsa(_, ref public) => Ok(public.to_public_key_der()?.into_vec()),
+            Key::EcdsaP384(_, ref key) => {
+                Ok([P384_SPKI_PREFIX, key.public_key().as_ref()].concat())
+            }
+            Key::Ed25519(_, ref key) => {
+                Ok([ED25519_SPKI_PREFIX, key.public_key().as_ref()].concat())
+            }
+        }
     }
 
     pub fn public_key_as_pem(&self) -> Result<String> {
-        Ok(self.public.to_public_key_pem(LineEnding::LF)?)
+        match self.key {
+            Key::Rsa(_, ref public) => Ok(public.to_public_key_pem(LineEnding::LF)?),
+            _ => Ok(crate::x509::pem("PUBLIC KEY", &self.public_key_as_der()?)),
+        }
+    }
+
+    // In PKCS#8 DER, as rustls expects
+    pub fn private_key_as_der(&self) -> Result<Vec<u8>> {
+        match self.key {
+            Key::Rsa(ref private, _) => Ok(private.to_pkcs8_der()?.as_bytes().to_vec()),
+            Key::EcdsaP384(ref pkcs8, _) | Key::Ed25519(ref pkcs8, _) => Ok(pkcs8.clone()),
+        }
+    }
+
+    // Signs with RSA PKCS#1 v1.5 over SHA-256, ECDSA over SHA-384 (DER
+    // encoded) or Ed25519, by key type
+    pub fn sign(&self, msg: &[u8]) -> Result<Vec<u8>> {
+        match self.key {
+            Key::Rsa(ref private, _) => {
+                let mut digest_info = SHA256_DIGEST_INFO.to_vec();
+                digest_info.extend_from_slice(&Sha256::digest(msg));
+                Ok(private.sign(PaddingScheme::new_pkcs1v15_sign_raw(), &digest_info)?)
+            }
+            Key::EcdsaP384(_, ref key) => {
+                let signature = key
+                    .sign(&SystemRandom::new(), msg)
+                    .map_err(|_| anyhow!("failed to sign with the P-384 key"))?;
+                Ok(signature.as_ref().to_vec())
+            }
+            Key::Ed25519(_, ref key) => Ok(key.sign(msg).as_ref().to_vec()),
+        }
+    }
+
+    // RSA-OAEP over SHA-256, with MGF1 over SHA-256, as KMS encrypts to
+    // recipients. Only RSA keys decrypt.
+    pub fn decrypt(&self, ciphertext: &[u8]) -> Result<Vec<u8>> {
+        self.decrypt_oaep(ciphertext, OaepParams::default())
+    }
+
+    // RSA-OAEP with the hashes the sender chose, e.g. as the parameters of a
+    // CMS recipient say
+    pub fn decrypt_oaep(&self, ciphertext: &[u8], params: OaepParams) -> Result<Vec<u8>> {
+        match self.key {
+            Key::Rsa(ref private, _) => {
+                let padding = PaddingScheme::OAEP {
+                    digest: params.hash.digest(),
+                    mgf_digest: params.mgf_hash.digest(),
+                    label: None,
+                };
+                // One error for any failure, as which one it is would be an
+                // oracle of the plaintext
+                private
+                    .decrypt(padding, ciphertext)
+                    .map_err(|_| anyhow!("the ciphertext does not decrypt with the key"))
+            }
+            _ => Err(anyhow!("{:?} keys cannot decrypt", self.key_type())),
+        }
+    }
+
+    // The ECDH shared secret (the x-coordinate) with the peer's public key, a
+    // point as SEC1 encodes it, e.g. for a CMS KeyAgreeRecipientInfo. Only
+    // P-384 keys agree.
+    pub fn ecdh(&self, public_key: &[u8]) -> Result<Vec<u8>> {
+        match self.key {
+            Key::EcdsaP384(ref pkcs8, _) => {
+                let secret = p384::SecretKey::from_pkcs8_der(pkcs8)
+                    .map_err(|err| anyhow!("invalid P-384 key: {err}"))?;
+                let public_key = p384::PublicKey::from_sec1_bytes(public_key)
+                    .map_err(|_| anyhow!("not a P-384 public key"))?;
+                let shared =
+                    p384::ecdh::diffie_hellman(secret.to_nonzero_scalar(), public_key.as_affine());
+                Ok(shared.raw_secret_bytes().to_vec())
+            }
+            _ => Err(anyhow!("{:?} keys cannot agree on keys", self.key_type())),
+        }
+    }
+
+    // Only usable through Signer and Decrypter from then on
+    pub fn seal(self) -> SealedKey {
+        SealedKey(self)
+    }
+}
+
+// Signs without handing out the private key, so that the key can be plugged
+// into JWT signing, CSRs or TLS (see tls::signing_key()). Signatures are as
+// made by KeyPair::sign().
+pub trait Signer: Send + Sync {
+    fn key_type(&self) -> KeyType;
+    fn public_key_as_der(&self) -> Result<Vec<u8>>;
+    fn sign(&self, msg: &[u8]) -> Result<Vec<u8>>;
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum OaepHash {
+    Sha256,
+    Sha384,
+    Sha512,
+}
+
+impl OaepHash {
+    fn digest(self) -> Box<dyn DynDigest + Send + Sync> {
+        match self {
+            Self::Sha256 => Box::new(Sha256::new()),
+            Self::Sha384 => Box::new(Sha384::new()),
+            Self::Sha512 => Box::new(Sha512::new()),
+        }
+    }
+}
+
+// The hash of RSA-OAEP and that of its MGF1, SHA-256 for both by default
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct OaepParams {
+    pub hash: OaepHash,
+    pub mgf_hash: OaepHash,
+}
+
+impl Default for OaepParams {
+    fn default() -> Self {
+        Self {
+            hash: OaepHash::Sha256,
+            mgf_hash: OaepHash::Sha256,
+        }
+    }
+}
+
+// Decrypts what was encrypted to the public key, as KeyPair::decrypt_oaep()
+// and KeyPair::ecdh() do. The public key tells senders' recipient identifiers
+// apart.
+pub trait Decrypter: Send + Sync {
+    fn public_key_as_der(&self) -> Result<Vec<u8>>;
+
+    fn decrypt_oaep(&self, ciphertext: &[u8], params: OaepParams) -> Result<Vec<u8>>;
+
+    fn ecdh(&self, public_key: &[u8]) -> Result<Vec<u8>>;
+
+    fn decrypt(&self, ciphertext: &[u8]) -> Result<Vec<u8>> {
+        self.decrypt_oaep(ciphertext, OaepParams::default())
+    }
+}
+
+impl Signer for KeyPair {
+    fn key_type(&self) -> KeyType {
+        KeyPair::key_type(self)
+    }
+
+    fn public_key_as_der(&self) -> Result<Vec<u8>> {
+        KeyPair::public_key_as_der(self)
+    }
+
+    fn sign(&self, msg: &[u8]) -> Result<Vec<u8>> {
+        KeyPair::sign(self, msg)
+    }
+}
+
+impl Decrypter for KeyPair {
+    fn public_key_as_der(&self) -> Result<Vec<u8>> {
+        KeyPair::public_key_as_der(self)
+    }
+
+    fn decrypt_oaep(&self, ciphertext: &[u8], params: OaepParams) -> Result<Vec<u8>> {
+        KeyPair::decrypt_oaep(self, ciphertext, params)
+    }
+
+    fn ecdh(&self, public_key: &[u8]) -> Result<Vec<u8>> {
+        KeyPair::ecdh(self, public_key)
+    }
+}
+
+// A key pair that no longer gives out its private key, for code that only
+// has to sign or decrypt with it
+#[derive(Clone)]
+pub struct SealedKey(KeyPair);
+
+// Both Signer and Decrypter have it
+impl SealedKey {
+    pub fn public_key_as_der(&self) -> Result<Vec<u8>> {
+        self.0.public_key_as_der()
+    }
+}
+
+impl Signer for SealedKey {
+    fn key_type(&self) -> KeyType {
+        self.0.key_type()
+    }
+
+    fn public_key_as_der(&self) -> Result<Vec<u8>> {
+        self.0.public_key_as_der()
+    }
+
+    fn sign(&self, msg: &[u8]) -> Result<Vec<u8>> {
+        self.0.sign(msg)
+    }
+}
+
+impl Decrypter for SealedKey {
+    fn public_key_as_der(&self) -> Result<Vec<u8>> {
+        self.0.public_key_as_der()
+    }
+
+    fn decrypt_oaep(&self, ciphertext: &[u8], params: OaepParams) -> Result<Vec<u8>> {
+        self.0.decrypt_oaep(ciphertext, params)
+    }
+
+    fn ecdh(&self, public_key: &[u8]) -> Result<Vec<u8>> {
+        self.0.ecdh(public_key)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{
+        Decrypter, KeyPair, KeyType, OaepHash, OaepParams, Signer, ED25519_SPKI_PREFIX,
+        P384_SPKI_PREFIX,
+    };
+    use assert2::assert;
+    use ring::signature::{UnparsedPublicKey, ECDSA_P384_SHA384_ASN1, ED25519};
+    use rsa::padding::PaddingScheme;
+    use rsa::pkcs8::DecodePublicKey;
+    use rsa::{PublicKey, RsaPublicKey};
+    use sha2::{Sha256, Sha384};
+
+    #[test]
+    fn test_signer() {
+        let msg = b"to be signed";
+
+        let sealed = KeyPair::generate_with(KeyType::EcdsaP384).unwrap().seal();
+        let signature = sealed.sign(msg).unwrap();
+        let public_key = sealed.public_key_as_der().unwrap();
+        let point = &public_key[P384_SPKI_PREFIX.len()..];
+        let verified =
+            UnparsedPublicKey::new(&ECDSA_P384_SHA384_ASN1, point).verify(msg, &signature);
+        assert!(verified.is_ok());
+
+        let sealed = KeyPair::generate_with(KeyType::Ed25519).unwrap().seal();
+        let signature = sealed.sign(msg).unwrap();
+        let public_key = sealed.public_key_as_der().unwrap();
+        let point = &public_key[ED25519_SPKI_PREFIX.len()..];
+        let verified = UnparsedPublicKey::new(&ED25519, point).verify(msg, &signature);
+        assert!(verified.is_ok());
+    }
+
+    #[test]
+    fn test_from_pkcs8_der() {
+        for key_type in [KeyType::Rsa2048, KeyType::EcdsaP384, KeyType::Ed25519] {
+            let key = KeyPair::generate_with(key_type).unwrap();
+            let der = key.private_key_as_der().unwrap();
+            let parsed = KeyPair::from_pkcs8_der(&der).unwrap();
+            assert!(parsed.key_type() == key_type);
+            assert!(parsed.public_key_as_der().unwrap() == key.public_key_as_der().unwrap());
+        }
+
+        assert!(KeyPair::from_pkcs8_der(b"not a key").is_err());
+    }
+
+    #[test]
+    fn test_decrypter() {
+        let key = KeyPair::generate().unwrap();
+        let public_key =
+            RsaPublicKey::from_public_key_der(&key.public_key_as_der().unwrap()).unwrap();
+        let padding = PaddingScheme::new_oaep_with_mgf_hash::<Sha256, Sha256>();
+        let ciphertext = public_key
+            .encrypt(&mut rand::thread_rng(), padding, b"secret")
+            .unwrap();
+
+        let padding = PaddingScheme::new_oaep_with_mgf_hash::<Sha384, Sha256>();
+        let ciphertext_384 = public_key
+            .encrypt(&mut rand::thread_rng(), padding, b"secret")
+            .unwrap();
+
+        let sealed = key.seal();
+        assert!(sealed.decrypt(&ciphertext).unwrap() == b"secret");
+
+        let params = OaepParams {
+            hash: OaepHash::Sha384,
+            mgf_hash: OaepHash::Sha256,
+        };
+        assert!(sealed.decrypt_oaep(&ciphertext_384, params).unwrap() == b"secret");
+        assert!(sealed.decrypt(&ciphertext_384).is_err());
+
+        // Only RSA keys decrypt
+        let key = KeyPair::generate_with(KeyType::Ed25519).unwrap();
+        assert!(Decrypter::decrypt(&key, &ciphertext).is_err());
+
+        // and only P-384 keys agree, on the same secret from both sides
+        let first = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        let second = KeyPair::generate_with(KeyType::EcdsaP384).unwrap().seal();
+        let first_point = first.public_key_as_der().unwrap()[P384_SPKI_PREFIX.len()..].to_vec();
+        let second_point = second.public_key_as_der().unwrap()[P384_SPKI_PREFIX.len()..].to_vec();
+        let shared = first.ecdh(&second_point).unwrap();
+        assert!(second.ecdh(&first_point).unwrap() == shared);
+        assert!(key.ecdh(&second_point).is_err());
     }
 }
@@ -0,0 +1,117 @@
+use anyhow::{anyhow, Result};
+use log::info;
+use serde_json::{json, Value};
+
+use crate::pcr_policy::PcrPolicy;
+
+// The Sid of the statement written to key policies, so that applying it again
+// (e.g. for a new build) replaces it rather than piling up statements
+pub const STATEMENT_ID: &str = "EnclaverAttestation";
+
+// Those the KMS proxy of the runtime attaches the attestation of the enclave to
+pub const ENCLAVE_ACTIONS: &[&str] = &["kms:Decrypt", "kms:GenerateDataKey", "kms:GenerateRandom"];
+
+// Keys only have the one policy, by this name
+const KEY_POLICY_NAME: &str = "default";
+
+// A key policy statement that allows the principal (e.g. the ARN of the role
+// of the instances) the actions, but only from enclaves matching the policy
+pub fn statement(policy: &PcrPolicy, principal: &str) -> Value {
+    json!({
+        "Sid": STATEMENT_ID,
+        "Effect": "Allow",
+        "Principal": { "AWS": principal },
+        "Action": ENCLAVE_ACTIONS,
+        "Resource": "*",
+        "Condition": policy.kms_condition(),
+    })
+}
+
+// The key policy with the statement in it, in place of the one with the same
+// Sid if there is one. The other statements are left as they are.
+pub fn merge(key_policy: &str, statement: Value) -> Result<String> {
+    let mut key_policy: Value = serde_json::from_str(key_policy)?;
+    let statements = key_policy
+        .get_mut("Statement")
+        .and_then(Value::as_array_mut)
+        .ok_or(anyhow!("the key policy has no statements"))?;
+
+    match statements
+        .iter_mut()
+        .find(|existing| existing["Sid"] == statement["Sid"])
+    {
+        Some(existing) => *existing = statement,
+        None => statements.push(statement),
+    }
+
+    Ok(serde_json::to_string_pretty(&key_policy)?)
+}
+
+// Merges the statement into the policy of the key, with the credentials and
+// region of the environment, as the AWS CLI would
+pub async fn apply(key_id: &str, statement: Value) -> Result<()> {
+    let sdk_config = aws_config::load_from_env().await;
+    let client = aws_sdk_kms::Client::new(&sdk_config);
+
+    let output = client
+        .get_key_policy()
+        .key_id(key_id)
+        .policy_name(KEY_POLICY_NAME)
+        .send()
+        .await?;
+    let key_policy = output
+        .policy()
+        .ok_or(anyhow!("key {key_id} has no policy"))?;
+
+    client
+        .put_key_policy()
+        .key_id(key_id)
+        .policy_name(KEY_POLICY_NAME)
+        .policy(merge(key_policy, statement)?)
+        .send()
+        .await?;
+
+    info!("Updated the policy of key {key_id}");
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{merge, statement, STATEMENT_ID};
+    use crate::pcr_policy::PcrPolicy;
+    use assert2::assert;
+    use serde_json::Value;
+
+    const KEY_POLICY: &str = r#"{
+        "Version": "2012-10-17",
+        "Statement": [
+            {
+                "Sid": "Enable IAM User Permissions",
+                "Effect": "Allow",
+                "Principal": { "AWS": "arn:aws:iam::111122223333:root" },
+                "Action": "kms:*",
+                "Resource": "*"
+            }
+        ]
+    }"#;
+
+    #[test]
+    fn test_merge() {
+        let role = "arn:aws:iam::111122223333:role/enclave";
+        let first = statement(&PcrPolicy::new().with_pcr(0, vec![1; 48]), role);
+        let key_policy = merge(KEY_POLICY, first).unwrap();
+
+        // Applying another build's replaces the statement of the first
+        let second = statement(&PcrPolicy::new().with_pcr(0, vec![2; 48]), role);
+        let key_policy: Value = serde_json::from_str(&merge(&key_policy, second).unwrap()).unwrap();
+
+        let statements = key_policy["Statement"].as_array().unwrap();
+        assert!(statements.len() == 2);
+        assert!(statements[0]["Sid"] == "Enable IAM User Permissions");
+        assert!(statements[1]["Sid"] == STATEMENT_ID);
+
+        let image = &statements[1]["Condition"]["StringEqualsIgnoreCase"]
+            ["kms:RecipientAttestation:ImageSha384"];
+        assert!(image == &Value::String("02".repeat(48)));
+    }
+}
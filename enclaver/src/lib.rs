@@ -1,6 +1,10 @@
 extern crate core;
 
+pub mod access_log;
+pub mod admin_client;
+pub mod attestation_doc;
 pub mod build;
+pub mod challenge;
 
 mod images;
 
@@ -10,17 +14,35 @@ pub mod nitro_cli;
 
 pub mod manifest;
 
+pub mod hpke;
 pub mod http_client;
+pub mod kdf;
 pub mod keypair;
+pub mod kms_policy;
+pub mod metrics;
+pub mod pcr_policy;
 pub mod policy;
+pub mod ports;
 pub mod run_container;
 
 #[cfg(feature = "run_enclave")]
 pub mod run;
 
+#[cfg(feature = "run_enclave")]
+pub mod admin;
+
+#[cfg(feature = "run_enclave")]
+pub mod exit_reason;
+
+#[cfg(feature = "run_enclave")]
+pub mod crash;
+
 #[cfg(feature = "odyn")]
 pub mod nsm;
 
+#[cfg(feature = "odyn")]
+pub mod mock_nsm;
+
 #[cfg(feature = "odyn")]
 pub mod api;
 
@@ -30,9 +52,26 @@ pub mod proxy;
 #[cfg(feature = "vsock")]
 pub mod vsock;
 
+#[cfg(feature = "vsock")]
+pub mod heartbeat;
+
+#[cfg(feature = "vsock")]
+pub mod clock_sync;
+
+#[cfg(feature = "vsock")]
+pub mod rpc;
+
+#[cfg(feature = "vsock")]
+pub mod credentials;
+
+#[cfg(feature = "vsock")]
+pub mod shutdown;
+
 #[cfg(feature = "proxy")]
 pub mod tls;
 
+pub mod user_data;
 pub mod utils;
+pub mod x509;
 
 pub mod http_util;
@@ -1,4 +1,5 @@
 use std::collections::HashMap;
+use std::net::{IpAddr, Ipv4Addr};
 
 use anyhow::{anyhow, Result};
 use serde::{Deserialize, Serialize};
@@ -7,6 +8,9 @@ use tokio::fs::File;
 
 use tokio::io::AsyncReadExt;
 
+use crate::keypair::KeyType;
+use crate::policy::upstream::UpstreamProxy;
+
 #[derive(Debug, Eq, PartialEq, Serialize, Deserialize)]
 #[serde(deny_unknown_fields)]
 pub struct Manifest {
@@ -19,6 +23,10 @@ pub struct Manifest {
     pub defaults: Option<Defaults>,
     pub kms_proxy: Option<KmsProxy>,
     pub api: Option<Api>,
+    pub entropy: Option<Entropy>,
+    pub secrets: Option<Vec<Secret>>,
+    pub runtime_files: Option<RuntimeFiles>,
+    pub launch_mode: Option<LaunchMode>,
 }
 
 #[derive(Debug, Eq, PartialEq, Serialize, Deserialize)]
@@ -33,7 +41,17 @@ pub struct Sources {
 #[serde(deny_unknown_fields)]
 pub struct Ingress {
     pub listen_port: u16,
+    pub listen_address: Option<IpAddr>,
+    pub listen_socket: Option<String>,
     pub tls: Option<ServerTls>,
+    pub host_tls: Option<ServerTls>,
+    pub attested_tls: Option<AttestedTls>,
+    pub access_log: Option<AccessLogSpec>,
+    pub timeouts: Option<ProxyTimeouts>,
+    pub buffer_kb: Option<u32>,
+    pub proxy_protocol: Option<bool>,
+    pub max_connections: Option<u32>,
+    pub backlog: Option<u32>,
 }
 
 #[derive(Debug, Eq, PartialEq, Serialize, Deserialize)]
@@ -43,12 +61,137 @@ pub struct ServerTls {
     pub cert_file: String,
 }
 
-#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+// TLS terminated inside the enclave with a key generated at startup, and a
+// self-signed certificate carrying the attestation document of the enclave.
+#[derive(Debug, Eq, PartialEq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct AttestedTls {
+    pub dns_names: Option<Vec<String>>,
+    pub key_type: Option<KeyType>,
+}
+
+#[derive(Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
 #[serde(deny_unknown_fields)]
 pub struct Egress {
     pub proxy_port: Option<u16>,
+    pub transparent: Option<bool>,
+    pub dns: Option<bool>,
     pub allow: Option<Vec<String>>,
     pub deny: Option<Vec<String>>,
+    pub tunnels: Option<Vec<EgressTunnel>>,
+    pub access_log: Option<AccessLogSpec>,
+    pub limits: Option<EgressLimits>,
+    pub timeouts: Option<ProxyTimeouts>,
+    pub buffer_kb: Option<u32>,
+    pub vsock_pool: Option<VsockPoolSpec>,
+    pub vsock_mux: Option<bool>,
+    pub upstream_proxy: Option<UpstreamProxySpec>,
+    pub enforce_sni: Option<bool>,
+    pub mitm: Option<MitmSpec>,
+    pub middleware: Option<Vec<MiddlewareSpec>>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct EgressLimits {
+    pub max_connections: Option<u32>,
+    pub connections_per_second: Option<u32>,
+    pub burst: Option<u32>,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ProxyTimeouts {
+    pub dial_secs: Option<u64>,
+    pub idle_secs: Option<u64>,
+    pub max_lifetime_secs: Option<u64>,
+    pub drain_secs: Option<u64>,
+    pub keepalive_secs: Option<u64>,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct VsockPoolSpec {
+    pub size: u32,
+    pub max_idle_secs: Option<u64>,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct UpstreamProxySpec {
+    pub url: String,
+    pub no_proxy: Option<Vec<String>>,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct MitmSpec {
+    pub hosts: Vec<String>,
+    pub ca_cert_path: Option<String>,
+    pub trusted_ca_path: Option<String>,
+    pub strip_request_headers: Option<Vec<String>>,
+    pub strip_response_headers: Option<Vec<String>>,
+}
+
+// A step of the chain egress HTTP requests go through before being proxied.
+// Each sets exactly one of its fields.
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct MiddlewareSpec {
+    pub request_id: Option<RequestIdSpec>,
+    pub headers: Option<HeaderFilterSpec>,
+    pub auth: Option<ProxyAuthSpec>,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct RequestIdSpec {
+    pub header: Option<String>,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct HeaderFilterSpec {
+    pub allow: Option<Vec<String>>,
+    pub strip: Option<Vec<String>>,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ProxyAuthSpec {
+    pub tokens_file: String,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct EgressTunnel {
+    pub host: String,
+    pub port: u16,
+    pub listen_port: Option<u16>,
+    // For apps with the address of the destination built in
+    pub listen_address: Option<Ipv4Addr>,
+    pub protocol: Option<TunnelProtocol>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TunnelProtocol {
+    Tcp,
+    Udp,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct AccessLogSpec {
+    pub format: Option<AccessLogFormat>,
+    pub sample_percent: Option<u8>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum AccessLogFormat {
+    Json,
+    Clf,
 }
 
 #[derive(Debug, Eq, PartialEq, Serialize, Deserialize)]
@@ -69,11 +212,140 @@ pub struct KmsProxy {
 #[serde(deny_unknown_fields)]
 pub struct Api {
     pub listen_port: u16,
+    pub attestation_cache_secs: Option<u64>,
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Entropy {
+    pub reseed_secs: Option<u64>,
+}
+
+// Fetched by the runtime before the app starts, from exactly one source, and
+// handed to the app in an environment variable or a file
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Secret {
+    pub name: String,
+    pub secrets_manager: Option<String>,
+    pub parameter_store: Option<String>,
+    pub kms_ciphertext: Option<String>,
+    pub env: Option<String>,
+    pub file: Option<String>,
+}
+
+// Written by the runtime before the app starts, for apps that would rather
+// read files than speak to the API
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct RuntimeFiles {
+    pub dir: Option<String>,
+    pub key_type: Option<KeyType>,
+}
+
+// How the runtime starts the app: as a child it supervises, or by exec'ing it
+// once the enclave is set up, which leaves nothing of the runtime running
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum LaunchMode {
+    Supervise,
+    Exec,
 }
 
 fn parse_manifest(buf: &[u8]) -> Result<Manifest> {
     let manifest: Manifest = serde_yaml::from_slice(buf)?;
 
+    for ingress in manifest.ingress.iter().flatten() {
+        let modes = [
+            ingress.tls.is_some(),
+            ingress.host_tls.is_some(),
+            ingress.attested_tls.is_some(),
+        ];
+
+        // TLS is terminated in exactly one place, if at all
+        if modes.iter().filter(|set| **set).count() > 1 {
+            return Err(anyhow!(
+                "ingress on port {}: only one of tls, host_tls and attested_tls may be set",
+                ingress.listen_port
+            ));
+        }
+
+        // Clients of a Unix socket have no address, to listen on or to pass on
+        if ingress.listen_socket.is_some()
+            && (ingress.listen_address.is_some() || ingress.proxy_protocol == Some(true))
+        {
+            return Err(anyhow!(
+                "ingress on port {}: listen_socket cannot be combined with listen_address or proxy_protocol",
+                ingress.listen_port
+            ));
+        }
+    }
+
+    let middleware = manifest
+        .egress
+        .as_ref()
+        .and_then(|egress| egress.middleware.as_ref());
+    for spec in middleware.into_iter().flatten() {
+        let set = [
+            spec.request_id.is_some(),
+            spec.headers.is_some(),
+            spec.auth.is_some(),
+        ];
+        if set.iter().filter(|set| **set).count() != 1 {
+            return Err(anyhow!(
+                "egress middleware: each entry sets exactly one of request_id, headers and auth"
+            ));
+        }
+    }
+
+    for secret in manifest.secrets.iter().flatten() {
+        let sources = [
+            secret.secrets_manager.is_some(),
+            secret.parameter_store.is_some(),
+            secret.kms_ciphertext.is_some(),
+        ];
+        if sources.iter().filter(|set| **set).count() != 1 {
+            return Err(anyhow!(
+                "secret {}: exactly one of secrets_manager, parameter_store and kms_ciphertext must be set",
+                secret.name
+            ));
+        }
+    }
+
+    if let Some(dir) = manifest.runtime_files.as_ref().and_then(|f| f.dir.as_ref()) {
+        if !Path::new(dir).is_absolute() {
+            return Err(anyhow!("runtime_files: dir {dir} is not an absolute path"));
+        }
+    }
+
+    if manifest.launch_mode == Some(LaunchMode::Exec) {
+        let served = [
+            ("ingress", manifest.ingress.is_some()),
+            ("kms_proxy", manifest.kms_proxy.is_some()),
+            ("api", manifest.api.is_some()),
+            ("runtime_files", manifest.runtime_files.is_some()),
+            (
+                "transparent egress",
+                manifest.egress.as_ref().and_then(|e| e.transparent) == Some(true),
+            ),
+        ];
+        if let Some((name, _)) = served.iter().find(|(_, set)| *set) {
+            return Err(anyhow!(
+                "launch_mode exec: {name} cannot be set, as the runtime is gone once the app runs"
+            ));
+        }
+    }
+
+    let upstream_proxy = manifest
+        .egress
+        .as_ref()
+        .and_then(|egress| egress.upstream_proxy.as_ref());
+    if let Some(spec) = upstream_proxy {
+        UpstreamProxy::new(spec)?;
+    }
+
+    crate::ports::Registry::from_manifest(&manifest)?;
+
     Ok(manifest)
 }
 
@@ -105,7 +377,8 @@ pub async fn load_manifest<P: AsRef<Path>>(path: P) -> Result<Manifest> {
 
 #[cfg(test)]
 mod tests {
-    use crate::manifest::parse_manifest;
+    use crate::keypair::KeyType;
+    use crate::manifest::{parse_manifest, LaunchMode};
 
     #[test]
     fn test_parse_manifest_with_unknown_fields() {
@@ -129,4 +402,301 @@ sources:
         assert_eq!(manifest.target, "target-image:latest");
         assert_eq!(manifest.sources.app, "app-image:latest");
     }
+
+    #[test]
+    fn test_parse_manifest_with_several_tls() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+ingress:
+  - listen_port: 443
+    tls:
+      key_file: key.pem
+      cert_file: cert.pem
+    host_tls:
+      key_file: /etc/enclaver/key.pem
+      cert_file: /etc/enclaver/cert.pem
+"#;
+
+        assert!(parse_manifest(raw_manifest).is_err());
+    }
+
+    #[test]
+    fn test_parse_manifest_with_listen_address() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+ingress:
+  - listen_port: 8080
+    listen_address: 127.0.0.1
+"#;
+
+        let manifest = parse_manifest(raw_manifest).unwrap();
+        let ingress = &manifest.ingress.unwrap()[0];
+        assert!(ingress.listen_address == Some("127.0.0.1".parse().unwrap()));
+
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+ingress:
+  - listen_port: 8080
+    listen_address: localhost
+"#;
+
+        assert!(parse_manifest(raw_manifest).is_err());
+    }
+
+    #[test]
+    fn test_parse_manifest_with_listen_socket() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+ingress:
+  - listen_port: 8080
+    listen_socket: /run/enclaver/app.sock
+"#;
+
+        let manifest = parse_manifest(raw_manifest).unwrap();
+        let ingress = &manifest.ingress.unwrap()[0];
+        assert!(ingress.listen_socket == Some("/run/enclaver/app.sock".to_string()));
+
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+ingress:
+  - listen_port: 8080
+    listen_socket: /run/enclaver/app.sock
+    proxy_protocol: true
+"#;
+
+        assert!(parse_manifest(raw_manifest).is_err());
+    }
+
+    #[test]
+    fn test_parse_manifest_with_tunnel_listen_address() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+egress:
+  allow:
+    - 10.0.4.12:7000
+  tunnels:
+    - host: 10.0.4.12
+      port: 7000
+      listen_address: 10.0.4.12
+"#;
+
+        let manifest = parse_manifest(raw_manifest).unwrap();
+        let tunnel = &manifest.egress.unwrap().tunnels.unwrap()[0];
+        assert!(tunnel.listen_address == Some("10.0.4.12".parse().unwrap()));
+        assert!(tunnel.listen_port == None);
+
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+egress:
+  tunnels:
+    - host: db.internal
+      port: 5432
+      listen_address: "fd00::1"
+"#;
+
+        assert!(parse_manifest(raw_manifest).is_err());
+    }
+
+    #[test]
+    fn test_parse_manifest_with_middleware() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+egress:
+  allow:
+    - "**"
+  middleware:
+    - auth:
+        tokens_file: /etc/enclaver/proxy-tokens
+    - headers:
+        strip: [cookie]
+    - request_id: {}
+"#;
+
+        let manifest = parse_manifest(raw_manifest).unwrap();
+        let middleware = manifest.egress.unwrap().middleware.unwrap();
+        assert!(middleware.len() == 3);
+        assert!(middleware[2].request_id.is_some());
+
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+egress:
+  middleware:
+    - request_id: {}
+      headers:
+        strip: [cookie]
+"#;
+
+        assert!(parse_manifest(raw_manifest).is_err());
+    }
+
+    #[test]
+    fn test_parse_manifest_with_secrets() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+secrets:
+  - name: db_password
+    secrets_manager: arn:aws:secretsmanager:us-east-1:123456789012:secret:db
+    env: DB_PASSWORD
+  - name: api_key
+    parameter_store: /app/api_key
+    file: /run/secrets/api_key
+"#;
+
+        let manifest = parse_manifest(raw_manifest).unwrap();
+        let secrets = manifest.secrets.unwrap();
+        assert!(secrets.len() == 2);
+        assert!(secrets[1].parameter_store.as_deref() == Some("/app/api_key"));
+
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+secrets:
+  - name: db_password
+    secrets_manager: db
+    kms_ciphertext: AQICAHh
+"#;
+
+        assert!(parse_manifest(raw_manifest).is_err());
+    }
+
+    #[test]
+    fn test_parse_manifest_with_runtime_files() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+runtime_files:
+  key_type: ecdsa_p384
+"#;
+
+        let manifest = parse_manifest(raw_manifest).unwrap();
+        let files = manifest.runtime_files.unwrap();
+        assert!(files.dir.is_none());
+        assert!(files.key_type == Some(KeyType::EcdsaP384));
+
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+runtime_files:
+  dir: run/enclaver
+"#;
+
+        assert!(parse_manifest(raw_manifest).is_err());
+    }
+
+    #[test]
+    fn test_parse_manifest_with_launch_mode() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+launch_mode: exec
+egress:
+  allow:
+    - secretsmanager.us-east-1.amazonaws.com
+"#;
+
+        let manifest = parse_manifest(raw_manifest).unwrap();
+        assert!(manifest.launch_mode == Some(LaunchMode::Exec));
+
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+launch_mode: exec
+api:
+  listen_port: 9000
+"#;
+
+        let err = parse_manifest(raw_manifest).unwrap_err();
+        assert!(err.to_string().contains("api"));
+    }
+
+    #[test]
+    fn test_parse_manifest_with_upstream_proxy() {
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+egress:
+  allow:
+    - example.com
+  upstream_proxy:
+    url: http://proxy.corp:3128
+    no_proxy:
+      - .internal.corp
+"#;
+
+        let manifest = parse_manifest(raw_manifest).unwrap();
+        let upstream = manifest.egress.unwrap().upstream_proxy.unwrap();
+        assert!(upstream.url == "http://proxy.corp:3128");
+        assert!(upstream.no_proxy == Some(vec![".internal.corp".to_string()]));
+
+        let raw_manifest = br#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+egress:
+  upstream_proxy:
+    url: https://proxy.corp:3128
+"#;
+
+        assert!(parse_manifest(raw_manifest).is_err());
+    }
 }
@@ -0,0 +1,706 @@
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::future::Future;
+use std::sync::atomic::{AtomicI64, AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use lazy_static::lazy_static;
+use serde_json::Value;
+
+// Upper bounds (in seconds) of the dial latency buckets
+const LATENCY_BUCKETS: &[f64] = &[
+    0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0,
+];
+
+// and of those of how long connections stay open, which ranges from a single
+// request to the lifetime of the enclave
+const DURATION_BUCKETS: &[f64] = &[
+    0.01, 0.1, 1.0, 10.0, 60.0, 300.0, 1800.0, 3600.0, 21600.0, 86400.0,
+];
+
+lazy_static! {
+    // Instruments the proxies running in this process: the egress and
+    // ingress proxies on the host in the wrapper, their enclave side
+    // counterparts in odyn.
+    pub static ref PROXY: ProxyMetrics = ProxyMetrics::new();
+
+    // Instruments odyn itself: the NSM, attestations, keys and which of its
+    // forwarders are running.
+    pub static ref RUNTIME: RuntimeMetrics = RuntimeMetrics::new();
+}
+
+#[derive(Default)]
+pub struct Counter(AtomicU64);
+
+impl Counter {
+    pub fn inc(&self) {
+        self.add(1);
+    }
+
+    pub fn add(&self, n: u64) {
+        self.0.fetch_add(n, Ordering::Relaxed);
+    }
+
+    pub fn get(&self) -> u64 {
+        self.0.load(Ordering::Relaxed)
+    }
+}
+
+#[derive(Default)]
+pub struct Gauge(AtomicI64);
+
+impl Gauge {
+    pub fn inc(&self) {
+        self.0.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn dec(&self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+
+    pub fn get(&self) -> i64 {
+        self.0.load(Ordering::Relaxed)
+    }
+}
+
+pub struct Histogram {
+    bounds: &'static [f64],
+    // Not cumulative, that is done when rendering
+    buckets: Vec<AtomicU64>,
+    sum_us: AtomicU64,
+    count: AtomicU64,
+}
+
+impl Default for Histogram {
+    fn default() -> Self {
+        Self::new(LATENCY_BUCKETS)
+    }
+}
+
+impl Histogram {
+    fn new(bounds: &'static [f64]) -> Self {
+        Self {
+            bounds,
+            buckets: bounds.iter().map(|_| AtomicU64::new(0)).collect(),
+            sum_us: AtomicU64::new(0),
+            count: AtomicU64::new(0),
+        }
+    }
+
+    fn durations() -> Self {
+        Self::new(DURATION_BUCKETS)
+    }
+
+    pub fn observe(&self, d: Duration) {
+        let secs = d.as_secs_f64();
+        if let Some(idx) = self.bounds.iter().position(|le| secs <= *le) {
+            self.buckets[idx].fetch_add(1, Ordering::Relaxed);
+        }
+
+        self.sum_us
+            .fetch_add(d.as_micros() as u64, Ordering::Relaxed);
+        self.count.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn count(&self) -> u64 {
+        self.count.load(Ordering::Relaxed)
+    }
+}
+
+trait Metric: Default {
+    const TYPE: &'static str;
+
+    fn render(&self, out: &mut String, name: &str, labels: &str);
+
+    // For the JSON snapshot
+    fn snapshot(&self) -> Value;
+}
+
+impl Metric for Counter {
+    const TYPE: &'static str = "counter";
+
+    fn render(&self, out: &mut String, name: &str, labels: &str) {
+        _ = writeln!(out, "{name}{} {}", braced(labels), self.get());
+    }
+
+    fn snapshot(&self) -> Value {
+        self.get().into()
+    }
+}
+
+impl Metric for Gauge {
+    const TYPE: &'static str = "gauge";
+
+    fn render(&self, out: &mut String, name: &str, labels: &str) {
+        _ = writeln!(out, "{name}{} {}", braced(labels), self.get());
+    }
+
+    fn snapshot(&self) -> Value {
+        self.get().into()
+    }
+}
+
+impl Metric for Histogram {
+    const TYPE: &'static str = "histogram";
+
+    fn render(&self, out: &mut String, name: &str, labels: &str) {
+        let sep = if labels.is_empty() { "" } else { "," };
+
+        let mut cumulative = 0;
+        for (le, bucket) in self.bounds.iter().zip(&self.buckets) {
+            cumulative += bucket.load(Ordering::Relaxed);
+            _ = writeln!(
+                out,
+                "{name}_bucket{{{labels}{sep}le=\"{le}\"}} {cumulative}"
+            );
+        }
+
+        let count = self.count();
+        _ = writeln!(out, "{name}_bucket{{{labels}{sep}le=\"+Inf\"}} {count}");
+
+        let sum = self.sum_us.load(Ordering::Relaxed) as f64 / 1_000_000.0;
+        _ = writeln!(out, "{name}_sum{} {sum}", braced(labels));
+        _ = writeln!(out, "{name}_count{} {count}", braced(labels));
+    }
+
+    fn snapshot(&self) -> Value {
+        let sum = self.sum_us.load(Ordering::Relaxed) as f64 / 1_000_000.0;
+        serde_json::json!({ "count": self.count(), "sum_seconds": sum })
+    }
+}
+
+// A metric broken down by a fixed set of labels. A child metric is created
+// the first time a combination of label values is seen.
+struct Family<M> {
+    name: &'static str,
+    help: &'static str,
+    label_names: &'static [&'static str],
+    // Creates the child metrics
+    make: fn() -> M,
+    children: Mutex<BTreeMap<Vec<String>, Arc<M>>>,
+}
+
+impl<M: Metric> Family<M> {
+    fn new(name: &'static str, help: &'static str, label_names: &'static [&'static str]) -> Self {
+        Self {
+            name,
+            help,
+            label_names,
+            make: M::default,
+            children: Mutex::new(BTreeMap::new()),
+        }
+    }
+
+    fn with_make(mut self, make: fn() -> M) -> Self {
+        self.make = make;
+        self
+    }
+
+    fn with(&self, label_values: &[&str]) -> Arc<M> {
+        assert_eq!(label_values.len(), self.label_names.len());
+
+        let key: Vec<String> = label_values.iter().map(|v| v.to_string()).collect();
+        self.children
+            .lock()
+            .unwrap()
+            .entry(key)
+            .or_insert_with(|| Arc::new((self.make)()))
+            .clone()
+    }
+
+    fn render(&self, out: &mut String, namespace: &str) {
+        let name = format!("{namespace}_{}", self.name);
+        _ = writeln!(out, "# HELP {name} {}", self.help);
+        _ = writeln!(out, "# TYPE {name} {}", M::TYPE);
+
+        for (values, metric) in self.children.lock().unwrap().iter() {
+            let labels = self
+                .label_names
+                .iter()
+                .zip(values)
+                .map(|(name, value)| format!("{name}=\"{}\"", escape(value)))
+                .collect::<Vec<_>>()
+                .join(",");
+
+            metric.render(out, &name, &labels);
+        }
+    }
+
+    // By the label values, joined with commas
+    fn snapshot(&self) -> Value {
+        let children = self.children.lock().unwrap();
+        let map = children
+            .iter()
+            .map(|(values, metric)| (values.join(","), metric.snapshot()))
+            .collect::<serde_json::Map<_, _>>();
+        Value::Object(map)
+    }
+}
+
+fn braced(labels: &str) -> String {
+    if labels.is_empty() {
+        String::new()
+    } else {
+        format!("{{{labels}}}")
+    }
+}
+
+fn escape(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+pub struct ProxyMetrics {
+    connections_active: Family<Gauge>,
+    connections: Family<Counter>,
+    bytes: Family<Counter>,
+    dial_duration: Family<Histogram>,
+    dial_errors: Family<Counter>,
+    dns_cache: Family<Counter>,
+    vsock_connections_active: Family<Gauge>,
+    vsock_connections: Family<Counter>,
+    vsock_bytes: Family<Counter>,
+    vsock_connection_duration: Family<Histogram>,
+    vsock_dial_duration: Family<Histogram>,
+    vsock_dial_errors: Family<Counter>,
+    vsock_accept_queue: Family<Gauge>,
+    vsock_shed: Family<Counter>,
+}
+
+impl ProxyMetrics {
+    fn new() -> Self {
+        Self {
+            connections_active: Family::new(
+                "proxy_connections_active",
+                "Connections currently being proxied.",
+                &["proxy"],
+            ),
+            connections: Family::new(
+                "proxy_connections_total",
+                "Connections accepted by the proxy.",
+                &["proxy"],
+            ),
+            bytes: Family::new(
+                "proxy_bytes_total",
+                "Bytes proxied, upstream (towards the destination) or downstream.",
+                &["proxy", "direction"],
+            ),
+            dial_duration: Family::new(
+                "proxy_dial_duration_seconds",
+                "Time taken to connect to the destination.",
+                &["proxy"],
+            ),
+            dial_errors: Family::new(
+                "proxy_dial_errors_total",
+                "Failed attempts to connect to the destination.",
+                &["proxy", "destination"],
+            ),
+            dns_cache: Family::new(
+                "proxy_dns_cache_lookups_total",
+                "Destination names looked up by the host, by whether they were cached (hit, miss or stale).",
+                &["result"],
+            ),
+            vsock_connections_active: Family::new(
+                "vsock_connections_active",
+                "Vsock connections currently open, by port.",
+                &["port"],
+            ),
+            vsock_connections: Family::new(
+                "vsock_connections_total",
+                "Vsock connections opened, by port and whether they were accepted or dialed.",
+                &["port", "side"],
+            ),
+            vsock_bytes: Family::new(
+                "vsock_bytes_total",
+                "Bytes sent or received over vsock connections, by port.",
+                &["port", "direction"],
+            ),
+            vsock_connection_duration: Family::new(
+                "vsock_connection_duration_seconds",
+                "How long vsock connections stayed open, by port.",
+                &["port"],
+            )
+            .with_make(Histogram::durations),
+            vsock_dial_duration: Family::new(
+                "vsock_dial_duration_seconds",
+                "Time taken to dial vsock connections, by port.",
+                &["port"],
+            ),
+            vsock_dial_errors: Family::new(
+                "vsock_dial_errors_total",
+                "Failed vsock dials, by port.",
+                &["port"],
+            ),
+            vsock_accept_queue: Family::new(
+                "vsock_accept_queue",
+                "Accepted vsock connections waiting to be served, by port.",
+                &["port"],
+            ),
+            vsock_shed: Family::new(
+                "vsock_connections_shed_total",
+                "Vsock connections closed as soon as accepted, as the accept queue of their port was full.",
+                &["port"],
+            ),
+        }
+    }
+
+    // Counts a connection as active until the guard is dropped.
+    pub fn connection(&self, proxy: &'static str) -> ConnectionGuard {
+        self.connections.with(&[proxy]).inc();
+
+        let active = self.connections_active.with(&[proxy]);
+        active.inc();
+
+        ConnectionGuard { active }
+    }
+
+    // Times connecting to the destination, counting the failures.
+    pub async fn dial<F, T, E>(
+        &self,
+        proxy: &'static str,
+        destination: &str,
+        dial: F,
+    ) -> Result<T, E>
+    where
+        F: Future<Output = Result<T, E>>,
+    {
+        let start = Instant::now();
+        let res = dial.await;
+        self.dial_duration.with(&[proxy]).observe(start.elapsed());
+
+        if res.is_err() {
+            self.dial_errors.with(&[proxy, destination]).inc();
+        }
+
+        res
+    }
+
+    pub fn dns_cache(&self, result: &'static str) {
+        self.dns_cache.with(&[result]).inc();
+    }
+
+    // Records the result of tokio::io::copy_bidirectional(client, destination)
+    pub fn transferred(&self, proxy: &'static str, res: &std::io::Result<(u64, u64)>) {
+        if let Ok((upstream, downstream)) = res {
+            self.bytes.with(&[proxy, "upstream"]).add(*upstream);
+            self.bytes.with(&[proxy, "downstream"]).add(*downstream);
+        }
+    }
+
+    // Counts a vsock connection as open until the returned metrics are
+    // dropped, and keeps its bytes and duration under its port.
+    pub fn vsock_connection(&self, port: u32, side: &'static str) -> VsockConnMetrics {
+        let port = port.to_string();
+        self.vsock_connections.with(&[&port, side]).inc();
+
+        let active = self.vsock_connections_active.with(&[&port]);
+        active.inc();
+
+        VsockConnMetrics {
+            sent: self.vsock_bytes.with(&[&port, "sent"]),
+            received: self.vsock_bytes.with(&[&port, "received"]),
+            duration: self.vsock_connection_duration.with(&[&port]),
+            active,
+            since: Instant::now(),
+        }
+    }
+
+    pub async fn vsock_dial<F, T, E>(&self, port: u32, dial: F) -> Result<T, E>
+    where
+        F: Future<Output = Result<T, E>>,
+    {
+        let port = port.to_string();
+        let start = Instant::now();
+        let res = dial.await;
+        self.vsock_dial_duration
+            .with(&[&port])
+            .observe(start.elapsed());
+
+        if res.is_err() {
+            self.vsock_dial_errors.with(&[&port]).inc();
+        }
+
+        res
+    }
+
+    pub fn vsock_accept_queue(&self, port: u32) -> Arc<Gauge> {
+        self.vsock_accept_queue.with(&[&port.to_string()])
+    }
+
+    pub fn vsock_shed(&self, port: u32) {
+        self.vsock_shed.with(&[&port.to_string()]).inc();
+    }
+
+    // Renders in the Prometheus text exposition format
+    pub fn render(&self, namespace: &str) -> String {
+        let mut out = String::new();
+        self.connections_active.render(&mut out, namespace);
+        self.connections.render(&mut out, namespace);
+        self.bytes.render(&mut out, namespace);
+        self.dial_duration.render(&mut out, namespace);
+        self.dial_errors.render(&mut out, namespace);
+        self.dns_cache.render(&mut out, namespace);
+        self.vsock_connections_active.render(&mut out, namespace);
+        self.vsock_connections.render(&mut out, namespace);
+        self.vsock_bytes.render(&mut out, namespace);
+        self.vsock_connection_duration.render(&mut out, namespace);
+        self.vsock_dial_duration.render(&mut out, namespace);
+        self.vsock_dial_errors.render(&mut out, namespace);
+        self.vsock_accept_queue.render(&mut out, namespace);
+        self.vsock_shed.render(&mut out, namespace);
+        out
+    }
+}
+
+pub struct RuntimeMetrics {
+    started: Instant,
+    nsm_requests: Family<Counter>,
+    nsm_request_errors: Family<Counter>,
+    nsm_request_duration: Family<Histogram>,
+    nsm_reopens: Family<Counter>,
+    attestation_cache: Family<Counter>,
+    key_generation_duration: Family<Histogram>,
+    forwarders_up: Family<Gauge>,
+}
+
+impl RuntimeMetrics {
+    fn new() -> Self {
+        Self {
+            started: Instant::now(),
+            nsm_requests: Family::new(
+                "nsm_requests_total",
+                "Requests made to the NSM, by type.",
+                &["request"],
+            ),
+            nsm_request_errors: Family::new(
+                "nsm_request_errors_total",
+                "Requests the NSM answered with an error, by type.",
+                &["request"],
+            ),
+            nsm_request_duration: Family::new(
+                "nsm_request_duration_seconds",
+                "Time taken by the NSM to answer, by type of request.",
+                &["request"],
+            ),
+            nsm_reopens: Family::new(
+                "nsm_session_reopens_total",
+                "Times the NSM device was found closed and opened again, by result (ok or error).",
+                &["result"],
+            ),
+            attestation_cache: Family::new(
+                "attestation_cache_lookups_total",
+                "Attestations asked of the cache, by whether a fresh one was cached (hit or miss).",
+                &["result"],
+            ),
+            key_generation_duration: Family::new(
+                "key_generation_duration_seconds",
+                "Time taken to generate key pairs, by key type.",
+                &["key_type"],
+            ),
+            forwarders_up: Family::new(
+                "forwarder_up",
+                "Whether each forwarder (proxy, listener or tunnel) is running.",
+                &["forwarder"],
+            ),
+        }
+    }
+
+    // Times a request to the NSM, counting those answered with an error.
+    pub fn nsm_request<T, E>(
+        &self,
+        request: &'static str,
+        f: impl FnOnce() -> Result<T, E>,
+    ) -> Result<T, E> {
+        self.nsm_requests.with(&[request]).inc();
+
+        let start = Instant::now();
+        let res = f();
+        self.nsm_request_duration
+            .with(&[request])
+            .observe(start.elapsed());
+
+        if res.is_err() {
+            self.nsm_request_errors.with(&[request]).inc();
+        }
+
+        res
+    }
+
+    pub fn nsm_reopened(&self, ok: bool) {
+        let result = if ok { "ok" } else { "error" };
+        self.nsm_reopens.with(&[result]).inc();
+    }
+
+    pub fn attestation_cache(&self, result: &'static str) {
+        self.attestation_cache.with(&[result]).inc();
+    }
+
+    pub fn key_generated(&self, key_type: &'static str, took: Duration) {
+        self.key_generation_duration.with(&[key_type]).observe(took);
+    }
+
+    // Marks the forwarder as up for as long as fut runs, which is until it
+    // completes or is dropped (e.g. its task aborted).
+    pub async fn forwarder<F: Future>(&self, name: String, fut: F) -> F::Output {
+        let up = self.forwarders_up.with(&[&name]);
+        up.inc();
+        let _guard = ConnectionGuard { active: up };
+
+        fut.await
+    }
+
+    pub fn render(&self, namespace: &str) -> String {
+        let mut out = String::new();
+        self.nsm_requests.render(&mut out, namespace);
+        self.nsm_request_errors.render(&mut out, namespace);
+        self.nsm_request_duration.render(&mut out, namespace);
+        self.nsm_reopens.render(&mut out, namespace);
+        self.attestation_cache.render(&mut out, namespace);
+        self.key_generation_duration.render(&mut out, namespace);
+        self.forwarders_up.render(&mut out, namespace);
+        out
+    }
+
+    // The same as render() in JSON, for people rather than Prometheus
+    pub fn snapshot(&self) -> Value {
+        serde_json::json!({
+            "uptime_seconds": self.started.elapsed().as_secs(),
+            "nsm_requests": self.nsm_requests.snapshot(),
+            "nsm_request_errors": self.nsm_request_errors.snapshot(),
+            "nsm_request_duration": self.nsm_request_duration.snapshot(),
+            "nsm_reopens": self.nsm_reopens.snapshot(),
+            "attestation_cache": self.attestation_cache.snapshot(),
+            "key_generation_duration": self.key_generation_duration.snapshot(),
+            "forwarders_up": self.forwarders_up.snapshot(),
+        })
+    }
+}
+
+pub struct ConnectionGuard {
+    active: Arc<Gauge>,
+}
+
+impl Drop for ConnectionGuard {
+    fn drop(&mut self) {
+        self.active.dec();
+    }
+}
+
+pub struct VsockConnMetrics {
+    pub sent: Arc<Counter>,
+    pub received: Arc<Counter>,
+    duration: Arc<Histogram>,
+    active: Arc<Gauge>,
+    since: Instant,
+}
+
+impl Drop for VsockConnMetrics {
+    fn drop(&mut self) {
+        self.duration.observe(self.since.elapsed());
+        self.active.dec();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{ProxyMetrics, RuntimeMetrics};
+    use assert2::assert;
+    use std::time::Duration;
+
+    #[tokio::test]
+    async fn test_render() {
+        let metrics = ProxyMetrics::new();
+
+        let conn = metrics.connection("ingress");
+        metrics.transferred("ingress", &Ok((10, 2000)));
+
+        let res: Result<(), ()> = metrics
+            .dial("ingress", "127.0.0.1:8080", async {
+                tokio::time::sleep(Duration::from_millis(20)).await;
+                Err(())
+            })
+            .await;
+        assert!(res.is_err());
+
+        let out = metrics.render("enclaver_host");
+        assert!(out.contains("# TYPE enclaver_host_proxy_connections_active gauge\n"));
+        assert!(out.contains("enclaver_host_proxy_connections_active{proxy=\"ingress\"} 1\n"));
+        assert!(out.contains(
+            "enclaver_host_proxy_bytes_total{proxy=\"ingress\",direction=\"downstream\"} 2000\n"
+        ));
+        assert!(out.contains(
+            "enclaver_host_proxy_dial_duration_seconds_bucket{proxy=\"ingress\",le=\"0.01\"} 0\n"
+        ));
+        assert!(out.contains(
+            "enclaver_host_proxy_dial_duration_seconds_bucket{proxy=\"ingress\",le=\"+Inf\"} 1\n"
+        ));
+        assert!(out.contains("enclaver_host_proxy_dial_errors_total{proxy=\"ingress\",destination=\"127.0.0.1:8080\"} 1\n"));
+
+        drop(conn);
+        let out = metrics.render("enclaver_host");
+        assert!(out.contains("enclaver_host_proxy_connections_active{proxy=\"ingress\"} 0\n"));
+        assert!(out.contains("enclaver_host_proxy_connections_total{proxy=\"ingress\"} 1\n"));
+    }
+
+    #[tokio::test]
+    async fn test_render_vsock() {
+        let metrics = ProxyMetrics::new();
+
+        let conn = metrics.vsock_connection(8001, "accepted");
+        conn.sent.add(10);
+        conn.received.add(20);
+
+        let res: Result<(), ()> = metrics.vsock_dial(8001, async { Err(()) }).await;
+        assert!(res.is_err());
+
+        let out = metrics.render("enclaver_enclave");
+        assert!(out.contains("enclaver_enclave_vsock_connections_active{port=\"8001\"} 1\n"));
+        assert!(out.contains(
+            "enclaver_enclave_vsock_connections_total{port=\"8001\",side=\"accepted\"} 1\n"
+        ));
+        assert!(out.contains(
+            "enclaver_enclave_vsock_bytes_total{port=\"8001\",direction=\"received\"} 20\n"
+        ));
+        assert!(out.contains("enclaver_enclave_vsock_dial_errors_total{port=\"8001\"} 1\n"));
+
+        // Durations are counted once connections close, in buckets of their own
+        assert!(out.contains(
+            "enclaver_enclave_vsock_connection_duration_seconds_count{port=\"8001\"} 0\n"
+        ));
+        drop(conn);
+        let out = metrics.render("enclaver_enclave");
+        assert!(out.contains("enclaver_enclave_vsock_connections_active{port=\"8001\"} 0\n"));
+        assert!(out.contains(
+            "enclaver_enclave_vsock_connection_duration_seconds_bucket{port=\"8001\",le=\"86400\"} 1\n"
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_runtime_snapshot() {
+        let metrics = RuntimeMetrics::new();
+
+        let res: Result<(), ()> = metrics.nsm_request("attestation", || Err(()));
+        assert!(res.is_err());
+        metrics.attestation_cache("hit");
+        metrics.key_generated("rsa2048", Duration::from_millis(300));
+        metrics
+            .forwarder("egress".to_string(), async {
+                let snapshot = metrics.snapshot();
+                assert!(snapshot["forwarders_up"]["egress"] == 1);
+            })
+            .await;
+
+        let snapshot = metrics.snapshot();
+        assert!(snapshot["nsm_requests"]["attestation"] == 1);
+        assert!(snapshot["nsm_request_errors"]["attestation"] == 1);
+        assert!(snapshot["attestation_cache"]["hit"] == 1);
+        assert!(snapshot["key_generation_duration"]["rsa2048"]["count"] == 1);
+        assert!(snapshot["forwarders_up"]["egress"] == 0);
+
+        let out = metrics.render("enclaver_enclave");
+        assert!(out.contains("enclaver_enclave_forwarder_up{forwarder=\"egress\"} 0\n"));
+    }
+}
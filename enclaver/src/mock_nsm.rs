@@ -0,0 +1,320 @@
+use std::collections::{BTreeMap, BTreeSet};
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, Result};
+use rand::rngs::OsRng;
+use rand::RngCore;
+use ring::signature::{EcdsaKeyPair, ECDSA_P384_SHA384_FIXED_SIGNING};
+use serde::Serialize;
+use serde_bytes::ByteBuf;
+use sha2::{Digest as _, Sha384};
+
+use crate::keypair::{KeyPair, KeyType};
+use crate::nsm::{Digest, ErrorCode, Request, Response};
+use crate::x509::{self, CertificateParams};
+
+const MODULE_ID: &str = "i-00000000000000000-enc0000000000000000";
+
+const CA_NAME: &str = "Enclaver Mock NSM CA";
+
+const SIGNER_NAME: &str = "Enclaver Mock NSM";
+
+const MAX_PCRS: u16 = 32;
+
+// 0 to 15 are locked at boot, as on the real NSM
+const BOOT_LOCKED_PCRS: u16 = 16;
+
+const PCR_LEN: usize = 48;
+
+const RANDOM_LEN: usize = 256;
+
+const CERT_VALIDITY: Duration = Duration::from_secs(365 * 24 * 60 * 60);
+
+// ES384, the one signature algorithm of NSM documents
+const COSE_ALG_ES384: i64 = -35;
+
+// A stand-in for the NSM, for running the runtime outside of an enclave: on
+// laptops and in CI. Attestation documents are the NSM's own format, with all
+// PCRs zero (as in debug mode), but signed by a CA of the mock's own, which
+// verifiers must be told to trust in place of the AWS Nitro root. Randomness
+// comes from the OS.
+pub struct MockNsm {
+    ca_certificate: Vec<u8>,
+    certificate: Vec<u8>,
+    signer: EcdsaKeyPair,
+    pcrs: Mutex<Vec<Pcr>>,
+}
+
+#[derive(Clone)]
+struct Pcr {
+    locked: bool,
+    value: Vec<u8>,
+}
+
+// As the NSM encodes the payload of its documents
+#[derive(Serialize)]
+struct AttestationDoc {
+    module_id: String,
+    digest: Digest,
+    timestamp: u64,
+    pcrs: BTreeMap<u16, ByteBuf>,
+    certificate: ByteBuf,
+    cabundle: Vec<ByteBuf>,
+    public_key: Option<ByteBuf>,
+    user_data: Option<ByteBuf>,
+    nonce: Option<ByteBuf>,
+}
+
+impl MockNsm {
+    pub fn new() -> Result<Self> {
+        let now = SystemTime::now();
+        let mut params = CertificateParams {
+            common_name: CA_NAME.to_string(),
+            dns_names: Vec::new(),
+            not_before: now,
+            not_after: now + CERT_VALIDITY,
+            extensions: vec![x509::ca_extension()],
+        };
+        let ca_key = KeyPair::generate_with(KeyType::EcdsaP384)?;
+        let (ca_certificate, _) = x509::self_signed(&params, &ca_key)?;
+
+        params.common_name = SIGNER_NAME.to_string();
+        params.extensions.clear();
+        let key = KeyPair::generate_with(KeyType::EcdsaP384)?;
+        let (certificate, pkcs8) = x509::issue(&params, &key, CA_NAME, &ca_key)?;
+
+        // COSE wants the signature as r and s, where KeyPair signs in DER
+        let signer = EcdsaKeyPair::from_pkcs8(&ECDSA_P384_SHA384_FIXED_SIGNING, &pkcs8)
+            .map_err(|err| anyhow!("mock NSM key rejected: {err}"))?;
+
+        let pcrs = (0..MAX_PCRS)
+            .map(|index| Pcr {
+                locked: index < BOOT_LOCKED_PCRS,
+                value: vec![0; PCR_LEN],
+            })
+            .collect();
+
+        Ok(Self {
+            ca_certificate,
+            certificate,
+            signer,
+            pcrs: Mutex::new(pcrs),
+        })
+    }
+
+    // In DER, for verifiers to trust the documents with
+    pub fn ca_certificate(&self) -> &[u8] {
+        &self.ca_certificate
+    }
+
+    pub fn process_request(&self, req: Request) -> Response {
+        match self.handle(req) {
+            Ok(resp) => resp,
+            Err(err) => Response::Error(err),
+        }
+    }
+
+    fn handle(&self, req: Request) -> std::result::Result<Response, ErrorCode> {
+        match req {
+            Request::DescribePCR { index } => {
+                let pcr = self.pcr(index)?;
+                Ok(Response::DescribePCR {
+                    lock: pcr.locked,
+                    data: pcr.value,
+                })
+            }
+            Request::ExtendPCR { index, data } => {
+                let mut pcrs = self.pcrs.lock().unwrap();
+                let pcr = pcrs
+                    .get_mut(index as usize)
+                    .ok_or(ErrorCode::InvalidIndex)?;
+                if pcr.locked {
+                    return Err(ErrorCode::ReadOnlyIndex);
+                }
+
+                let mut hasher = Sha384::new();
+                hasher.update(&pcr.value);
+                hasher.update(&data);
+                pcr.value = hasher.finalize().to_vec();
+                Ok(Response::ExtendPCR {
+                    data: pcr.value.clone(),
+                })
+            }
+            Request::LockPCR { index } => {
+                let mut pcrs = self.pcrs.lock().unwrap();
+                let pcr = pcrs
+                    .get_mut(index as usize)
+                    .ok_or(ErrorCode::InvalidIndex)?;
+                pcr.locked = true;
+                Ok(Response::LockPCR)
+            }
+            Request::LockPCRs { range } => {
+                if range > MAX_PCRS {
+                    return Err(ErrorCode::InvalidIndex);
+                }
+                let mut pcrs = self.pcrs.lock().unwrap();
+                for pcr in pcrs.iter_mut().take(range as usize) {
+                    pcr.locked = true;
+                }
+                Ok(Response::LockPCRs)
+            }
+            Request::DescribeNSM => {
+                let pcrs = self.pcrs.lock().unwrap();
+                let locked_pcrs: BTreeSet<u16> = (0..MAX_PCRS)
+                    .filter(|index| pcrs[*index as usize].locked)
+                    .collect();
+                Ok(Response::DescribeNSM {
+                    version_major: 1,
+                    version_minor: 0,
+                    version_patch: 0,
+                    module_id: MODULE_ID.to_string(),
+                    max_pcrs: MAX_PCRS,
+                    locked_pcrs,
+                    digest: Digest::SHA384,
+                })
+            }
+            Request::Attestation {
+                user_data,
+                nonce,
+                public_key,
+            } => {
+                let document = self
+                    .attestation(user_data, nonce, public_key)
+                    .map_err(|_| ErrorCode::InternalError)?;
+                Ok(Response::Attestation { document })
+            }
+            Request::GetRandom {} => {
+                let mut random = vec![0; RANDOM_LEN];
+                OsRng.fill_bytes(&mut random);
+                Ok(Response::GetRandom { random })
+            }
+        }
+    }
+
+    fn pcr(&self, index: u16) -> std::result::Result<Pcr, ErrorCode> {
+        let pcrs = self.pcrs.lock().unwrap();
+        pcrs.get(index as usize)
+            .cloned()
+            .ok_or(ErrorCode::InvalidIndex)
+    }
+
+    // A COSE_Sign1 of the document, untagged as from the NSM
+    fn attestation(
+        &self,
+        user_data: Option<ByteBuf>,
+        nonce: Option<ByteBuf>,
+        public_key: Option<ByteBuf>,
+    ) -> Result<Vec<u8>> {
+        let pcrs = self
+            .pcrs
+            .lock()
+            .unwrap()
+            .iter()
+            .enumerate()
+            .map(|(index, pcr)| (index as u16, ByteBuf::from(pcr.value.clone())))
+            .collect();
+
+        let doc = AttestationDoc {
+            module_id: MODULE_ID.to_string(),
+            digest: Digest::SHA384,
+            timestamp: SystemTime::now().duration_since(UNIX_EPOCH)?.as_millis() as u64,
+            pcrs,
+            certificate: ByteBuf::from(self.certificate.clone()),
+            cabundle: vec![ByteBuf::from(self.ca_certificate.clone())],
+            public_key,
+            user_data,
+            nonce,
+        };
+        let payload = serde_cbor::to_vec(&doc)?;
+
+        let protected = serde_cbor::to_vec(&BTreeMap::from([(1_i64, COSE_ALG_ES384)]))?;
+        let signed = sig_structure(&protected, &payload)?;
+        let signature = self
+            .signer
+            .sign(&ring::rand::SystemRandom::new(), &signed)
+            .map_err(|_| anyhow!("failed to sign the attestation document"))?;
+
+        let unprotected: BTreeMap<i64, ByteBuf> = BTreeMap::new();
+        Ok(serde_cbor::to_vec(&(
+            ByteBuf::from(protected),
+            unprotected,
+            ByteBuf::from(payload),
+            ByteBuf::from(signature.as_ref().to_vec()),
+        ))?)
+    }
+}
+
+// What COSE_Sign1 signs (RFC 8152, section 4.4), with no external data
+fn sig_structure(protected: &[u8], payload: &[u8]) -> Result<Vec<u8>> {
+    Ok(serde_cbor::to_vec(&(
+        "Signature1",
+        ByteBuf::from(protected.to_vec()),
+        ByteBuf::new(),
+        ByteBuf::from(payload.to_vec()),
+    ))?)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{sig_structure, MockNsm, PCR_LEN, RANDOM_LEN};
+    use crate::nsm::{AttestationParams, ErrorCode, Nsm, NsmError};
+    use assert2::assert;
+    use ring::signature::{KeyPair as _, UnparsedPublicKey, ECDSA_P384_SHA384_FIXED};
+    use serde_bytes::ByteBuf;
+    use serde_cbor::Value;
+    use std::collections::BTreeMap;
+
+    #[test]
+    fn test_attestation() {
+        let mock = MockNsm::new().unwrap();
+        let public_key = mock.signer.public_key().as_ref().to_vec();
+        let nsm = Nsm::mock(mock);
+
+        let params = AttestationParams {
+            nonce: Some(b"nonce".to_vec()),
+            user_data: None,
+            public_key: None,
+        };
+        let doc = nsm.attestation(params).unwrap();
+
+        let (protected, _, payload, signature): (
+            ByteBuf,
+            BTreeMap<i64, ByteBuf>,
+            ByteBuf,
+            ByteBuf,
+        ) = serde_cbor::from_slice(&doc).unwrap();
+        let signed = sig_structure(&protected, &payload).unwrap();
+        let verified = UnparsedPublicKey::new(&ECDSA_P384_SHA384_FIXED, public_key)
+            .verify(&signed, &signature);
+        assert!(verified.is_ok());
+
+        let payload: BTreeMap<String, Value> = serde_cbor::from_slice(&payload).unwrap();
+        assert!(payload["nonce"] == Value::Bytes(b"nonce".to_vec()));
+        assert!(payload["user_data"] == Value::Null);
+        assert!(payload["digest"] == Value::Text("SHA384".to_string()));
+    }
+
+    #[test]
+    fn test_pcrs() {
+        let nsm = Nsm::mock(MockNsm::new().unwrap());
+
+        let value = nsm.extend_pcr(16, b"config").unwrap();
+        assert!(value.len() == PCR_LEN);
+        assert!(nsm.describe_pcr(16).unwrap().value == value);
+
+        nsm.lock_pcr(16).unwrap();
+        let err = nsm.extend_pcr(16, b"config").unwrap_err();
+        let read_only = matches!(
+            err.downcast_ref::<NsmError>(),
+            Some(NsmError(ErrorCode::ReadOnlyIndex))
+        );
+        assert!(read_only);
+
+        // Locked at boot
+        assert!(nsm.describe_pcr(0).unwrap().locked);
+        assert!(nsm.describe().unwrap().locked_pcrs.len() == 17);
+
+        assert!(nsm.get_random().unwrap().len() == RANDOM_LEN);
+    }
+}
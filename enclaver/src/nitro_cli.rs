@@ -1,5 +1,6 @@
 #![allow(dead_code)]
 
+use crate::pcr_policy::PcrPolicy;
 use anyhow::{anyhow, Result};
 use log::debug;
 use serde::{Deserialize, Serialize};
@@ -19,6 +20,12 @@ impl NitroCLI {
         }
     }
 
+    // Another program than the nitro-cli of the PATH, e.g. a stand-in in tests
+    pub fn with_program(mut self, program: &str) -> Self {
+        self.program = program.to_string();
+        self
+    }
+
     pub async fn run_and_deserialize_output<T>(&self, args: impl NitroCLIArgs) -> Result<T>
     where
         T: serde::de::DeserializeOwned,
@@ -112,6 +119,17 @@ pub struct EIFMeasurements {
     pcr2: String,
 }
 
+impl EIFInfo {
+    // The PCRs that enclaves started from the EIF have: those of the image,
+    // the kernel and the application
+    pub fn pcr_policy(&self) -> Result<PcrPolicy> {
+        PcrPolicy::new()
+            .with_hex(0, &self.measurements.pcr0)?
+            .with_hex(1, &self.measurements.pcr1)?
+            .with_hex(2, &self.measurements.pcr2)
+    }
+}
+
 #[derive(Debug, Eq, PartialEq, Clone, Serialize, Deserialize)]
 pub struct EnclaveInfo {
     #[serde(rename = "EnclaveName")]
@@ -125,6 +143,22 @@ pub struct EnclaveInfo {
 
     #[serde(rename = "EnclaveCID")]
     pub cid: u32,
+
+    // Only reported by describe-enclaves
+    #[serde(rename = "State", default, skip_serializing_if = "Option::is_none")]
+    pub state: Option<String>,
+
+    #[serde(rename = "Flags", default, skip_serializing_if = "Option::is_none")]
+    pub flags: Option<String>,
+
+    #[serde(rename = "MemoryMiB", default, skip_serializing_if = "Option::is_none")]
+    pub memory_mib: Option<u64>,
+}
+
+impl EnclaveInfo {
+    pub fn is_terminating(&self) -> bool {
+        matches!(self.state.as_deref(), Some("TERMINATING"))
+    }
 }
 
 #[derive(Debug, Eq, PartialEq, Serialize, Deserialize)]
@@ -279,6 +313,30 @@ old images in your local Docker engine."#
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_parse_describe_enclaves() {
+        let out = br#"[
+  {
+    "EnclaveName": "application",
+    "EnclaveID": "i-0a1b2c3d4e5f60718-enc183c1dd2a9f5b1",
+    "ProcessID": 977,
+    "EnclaveCID": 16,
+    "NumberOfCPUs": 2,
+    "CPUIDs": [1, 3],
+    "MemoryMiB": 4096,
+    "State": "RUNNING",
+    "Flags": "DEBUG_MODE"
+  }
+]"#;
+
+        let enclaves: Vec<EnclaveInfo> = serde_json::from_slice(out).unwrap();
+        assert_eq!(enclaves.len(), 1);
+        assert_eq!(enclaves[0].cid, 16);
+        assert_eq!(enclaves[0].state.as_deref(), Some("RUNNING"));
+        assert_eq!(enclaves[0].memory_mib, Some(4096));
+        assert!(!enclaves[0].is_terminating());
+    }
+
     #[test]
     fn test_detect_known_issues() {
         assert_eq!(KnownIssue::detect("foobar"), None);
@@ -1,24 +1,190 @@
-use std::sync::Arc;
+use std::collections::{BTreeMap, BTreeSet};
+use std::fmt;
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::{Duration, Instant};
 
 use anyhow::{anyhow, Result};
+use log::{info, warn};
+use rand::rngs::{OsRng, StdRng};
+use rand::{CryptoRng, RngCore, SeedableRng};
 use serde_bytes::ByteBuf;
 
-pub use aws_nitro_enclaves_nsm_api::api::{Request, Response};
+use crate::kdf::KeyContext;
+use crate::keypair::{AttestedKey, KeyPair, KeyType};
+use crate::metrics;
+use crate::mock_nsm::MockNsm;
+use crate::pcr_policy;
 
+// The PCRs Nitro measures the enclave into: the image, the kernel and boot,
+// the app, the IAM role, the instance and the signing certificate
+const MEASURED_PCRS: [u16; 6] = [0, 1, 2, 3, 4, 8];
+
+// How long the key replaced by a rotation is kept by default
+const DEFAULT_ROTATION_GRACE: Duration = Duration::from_secs(5 * 60);
+
+pub use aws_nitro_enclaves_nsm_api::api::{Digest, ErrorCode, Request, Response};
+
+#[derive(Debug, Clone, PartialEq, Eq)]
 pub struct AttestationParams {
     pub nonce: Option<Vec<u8>>,
     pub user_data: Option<Vec<u8>>,
     pub public_key: Option<Vec<u8>>,
 }
 
+// What the NSM answered a request with, other than success. Returned inside
+// anyhow errors, for callers to downcast.
+#[derive(Debug)]
+pub struct NsmError(pub ErrorCode);
+
+impl fmt::Display for NsmError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let reason = match self.0 {
+            ErrorCode::InvalidArgument => "invalid argument",
+            ErrorCode::InvalidIndex => "no PCR with that index",
+            ErrorCode::InvalidResponse => "invalid response",
+            ErrorCode::ReadOnlyIndex => "the PCR is locked",
+            ErrorCode::InvalidOperation => "invalid operation",
+            ErrorCode::BufferTooSmall => "buffer too small",
+            ErrorCode::InputTooLarge => "input too large",
+            ErrorCode::InternalError => "internal error",
+            ErrorCode::Success => "success",
+        };
+        write!(f, "nsm request failed: {reason}")
+    }
+}
+
+impl std::error::Error for NsmError {}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Pcr {
+    pub locked: bool,
+    pub value: Vec<u8>,
+}
+
+#[derive(Debug, Clone)]
+pub struct NsmDescription {
+    pub module_id: String,
+    pub version: (u16, u16, u16),
+    pub max_pcrs: u16,
+    pub locked_pcrs: BTreeSet<u16>,
+    // The hash PCRs are extended with
+    pub digest: Digest,
+}
+
 pub struct Nsm {
+    backend: Backend,
+}
+
+enum Backend {
+    Device(Session),
+    Mock(MockNsm),
+}
+
+// The open /dev/nsm. Requests take turns on it, which lets a request find it
+// closed (or its fd taken over by another file) and open it again before use,
+// without another request using it half way. Requests are not retried, as
+// extending a PCR twice would not do.
+struct Session {
+    device: Mutex<Option<Device>>,
+}
+
+struct Device {
     fd: i32,
+    // To tell it apart from a file that took over the fd
+    rdev: nix::libc::dev_t,
+}
+
+impl Session {
+    fn open() -> Self {
+        let device = Device::open();
+        if device.is_none() {
+            warn!("Failed to open the NSM, will try again on the first request");
+        }
+
+        Self {
+            device: Mutex::new(device),
+        }
+    }
+
+    fn process_request(&self, req: Request) -> Response {
+        let mut device = self.device.lock().unwrap();
+
+        if !device.as_ref().map_or(false, Device::is_open) {
+            warn!("The NSM is not open, opening it again");
+            *device = Device::open();
+            metrics::RUNTIME.nsm_reopened(device.is_some());
+        }
+
+        match *device {
+            Some(ref open) => aws_nitro_enclaves_nsm_api::driver::nsm_process_request(open.fd, req),
+            None => Response::Error(ErrorCode::InternalError),
+        }
+    }
+}
+
+impl Device {
+    fn open() -> Option<Self> {
+        let fd = aws_nitro_enclaves_nsm_api::driver::nsm_init();
+        if fd < 0 {
+            return None;
+        }
+
+        match nix::sys::stat::fstat(fd) {
+            Ok(stat) => Some(Self {
+                fd,
+                rdev: stat.st_rdev,
+            }),
+            Err(_) => None,
+        }
+    }
+
+    fn is_open(&self) -> bool {
+        nix::sys::stat::fstat(self.fd).map_or(false, |stat| stat.st_rdev == self.rdev)
+    }
+}
+
+impl Drop for Device {
+    fn drop(&mut self) {
+        // Not to close a file that took over the fd
+        if self.is_open() {
+            aws_nitro_enclaves_nsm_api::driver::nsm_exit(self.fd);
+        }
+    }
+}
+
+// What the enclave is measured as, read from the NSM once at boot, for the
+// app to go by its own identity, e.g. to refuse to run in debug mode. These
+// PCRs are locked, so they do not change after.
+#[derive(Debug, Clone)]
+pub struct Measurements {
+    pub pcrs: BTreeMap<u16, Vec<u8>>,
+}
+
+impl Measurements {
+    pub fn read(nsm: &Nsm) -> Result<Self> {
+        let pcrs = MEASURED_PCRS
+            .iter()
+            .map(|index| Ok((*index, nsm.describe_pcr(*index)?.value)))
+            .collect::<Result<_>>()?;
+        Ok(Self { pcrs })
+    }
+
+    pub fn is_debug(&self) -> bool {
+        pcr_policy::is_debug(&self.pcrs)
+    }
 }
 
 impl Nsm {
     pub fn new() -> Self {
         Self {
-            fd: aws_nitro_enclaves_nsm_api::driver::nsm_init(),
+            backend: Backend::Device(Session::open()),
+        }
+    }
+
+    // Outside of an enclave, see MockNsm
+    pub fn mock(mock: MockNsm) -> Self {
+        Self {
+            backend: Backend::Mock(mock),
         }
     }
 
@@ -43,20 +209,228 @@ impl Nsm {
         }
     }
 
+    pub fn describe_pcr(&self, index: u16) -> Result<Pcr> {
+        match self.process_request(Request::DescribePCR { index })? {
+            Response::DescribePCR { lock, data } => Ok(Pcr {
+                locked: lock,
+                value: data,
+            }),
+            _ => Err(anyhow!("unexpected response for DescribePCR")),
+        }
+    }
+
+    // For deriving keys bound to the image the enclave runs, by its PCR0
+    pub fn key_context(&self) -> Result<KeyContext> {
+        Ok(KeyContext::new(self.describe_pcr(0)?.value))
+    }
+
+    // Returns the new value of the PCR. PCRs 0 to 15 are locked at boot,
+    // which leaves the others to apps, e.g. for the hash of their config.
+    pub fn extend_pcr(&self, index: u16, data: &[u8]) -> Result<Vec<u8>> {
+        let req = Request::ExtendPCR {
+            index,
+            data: data.to_vec(),
+        };
+
+        match self.process_request(req)? {
+            Response::ExtendPCR { data } => Ok(data),
+            _ => Err(anyhow!("unexpected response for ExtendPCR")),
+        }
+    }
+
+    // Until the enclave stops
+    pub fn lock_pcr(&self, index: u16) -> Result<()> {
+        match self.process_request(Request::LockPCR { index })? {
+            Response::LockPCR => Ok(()),
+            _ => Err(anyhow!("unexpected response for LockPCR")),
+        }
+    }
+
+    // Locks the PCRs from 0 up to, but not including, range
+    pub fn lock_pcrs(&self, range: u16) -> Result<()> {
+        match self.process_request(Request::LockPCRs { range })? {
+            Response::LockPCRs => Ok(()),
+            _ => Err(anyhow!("unexpected response for LockPCRs")),
+        }
+    }
+
+    pub fn describe(&self) -> Result<NsmDescription> {
+        match self.process_request(Request::DescribeNSM)? {
+            Response::DescribeNSM {
+                version_major,
+                version_minor,
+                version_patch,
+                module_id,
+                max_pcrs,
+                locked_pcrs,
+                digest,
+            } => Ok(NsmDescription {
+                module_id,
+                version: (version_major, version_minor, version_patch),
+                max_pcrs,
+                locked_pcrs,
+                digest,
+            }),
+            _ => Err(anyhow!("unexpected response for DescribeNSM")),
+        }
+    }
+
     fn process_request(&self, req: Request) -> Result<Response> {
-        match aws_nitro_enclaves_nsm_api::driver::nsm_process_request(self.fd, req) {
-            Response::Error(err) => Err(anyhow!("nsm request failed with: {:?}", err)),
-            resp @ _ => Ok(resp),
+        metrics::RUNTIME.nsm_request(request_name(&req), || {
+            let resp = match self.backend {
+                Backend::Device(ref session) => session.process_request(req),
+                Backend::Mock(ref mock) => mock.process_request(req),
+            };
+
+            match resp {
+                Response::Error(err) => Err(NsmError(err).into()),
+                resp @ _ => Ok(resp),
+            }
+        })
+    }
+}
+
+// As the metrics label requests
+fn request_name(req: &Request) -> &'static str {
+    match req {
+        Request::DescribePCR { .. } => "describe_pcr",
+        Request::ExtendPCR { .. } => "extend_pcr",
+        Request::LockPCR { .. } => "lock_pcr",
+        Request::LockPCRs { .. } => "lock_pcrs",
+        Request::DescribeNSM => "describe_nsm",
+        Request::Attestation { .. } => "attestation",
+        Request::GetRandom {} => "get_random",
+    }
+}
+
+// Randomness straight from the NSM, for apps that would rather not rely on
+// the kernel pool of the enclave having been seeded. Panics in fill_bytes if
+// the NSM fails, as RngCore requires; try_fill_bytes does not.
+#[derive(Clone)]
+pub struct NsmRng {
+    nsm: Arc<Nsm>,
+}
+
+impl NsmRng {
+    pub fn new(nsm: Arc<Nsm>) -> Self {
+        Self { nsm }
+    }
+}
+
+impl RngCore for NsmRng {
+    fn next_u32(&mut self) -> u32 {
+        let mut buf = [0u8; 4];
+        self.fill_bytes(&mut buf);
+        u32::from_le_bytes(buf)
+    }
+
+    fn next_u64(&mut self) -> u64 {
+        let mut buf = [0u8; 8];
+        self.fill_bytes(&mut buf);
+        u64::from_le_bytes(buf)
+    }
+
+    fn fill_bytes(&mut self, dest: &mut [u8]) {
+        self.try_fill_bytes(dest)
+            .expect("NSM failed to return random bytes")
+    }
+
+    // The NSM returns a few hundred bytes at a time
+    fn try_fill_bytes(&mut self, dest: &mut [u8]) -> Result<(), rand::Error> {
+        let mut filled = 0;
+        while filled < dest.len() {
+            let random = self.nsm.get_random().map_err(rand::Error::new)?;
+            if random.is_empty() {
+                return Err(rand::Error::new(anyhow!("NSM returned no random bytes")));
+            }
+
+            let n = random.len().min(dest.len() - filled);
+            dest[filled..filled + n].copy_from_slice(&random[..n]);
+            filled += n;
         }
+
+        Ok(())
     }
 }
 
-impl Drop for Nsm {
-    fn drop(&mut self) {
-        aws_nitro_enclaves_nsm_api::driver::nsm_exit(self.fd);
+impl CryptoRng for NsmRng {}
+
+// For what wants bytes from a reader, e.g. to copy them into a file
+impl std::io::Read for NsmRng {
+    fn read(&mut self, buf: &mut [u8]) -> std::io::Result<usize> {
+        self.try_fill_bytes(buf)
+            .map_err(|err| std::io::Error::new(std::io::ErrorKind::Other, err))?;
+        Ok(buf.len())
     }
 }
 
+// The kernel pool mixed with the NSM, for apps whose policy calls for
+// hardware entropy but that would rather not make a request to the NSM for
+// every few bytes. Bytes of OsRng are XORed with a generator seeded from the
+// NSM, which is seeded again once the interval is over, so the output is no
+// weaker than either of them.
+pub struct MixedRng {
+    nsm: NsmRng,
+    stirred: StdRng,
+    interval: Duration,
+    stirred_at: Instant,
+}
+
+impl MixedRng {
+    pub fn new(nsm: Arc<Nsm>, interval: Duration) -> Result<Self> {
+        let mut nsm = NsmRng::new(nsm);
+        let stirred = StdRng::from_rng(&mut nsm)?;
+        Ok(Self {
+            nsm,
+            stirred,
+            interval,
+            stirred_at: Instant::now(),
+        })
+    }
+
+    fn stir(&mut self) -> Result<(), rand::Error> {
+        if self.stirred_at.elapsed() >= self.interval {
+            self.stirred = StdRng::from_rng(&mut self.nsm)?;
+            self.stirred_at = Instant::now();
+        }
+        Ok(())
+    }
+}
+
+impl RngCore for MixedRng {
+    fn next_u32(&mut self) -> u32 {
+        let mut buf = [0u8; 4];
+        self.fill_bytes(&mut buf);
+        u32::from_le_bytes(buf)
+    }
+
+    fn next_u64(&mut self) -> u64 {
+        let mut buf = [0u8; 8];
+        self.fill_bytes(&mut buf);
+        u64::from_le_bytes(buf)
+    }
+
+    fn fill_bytes(&mut self, dest: &mut [u8]) {
+        self.try_fill_bytes(dest)
+            .expect("failed to get random bytes")
+    }
+
+    fn try_fill_bytes(&mut self, dest: &mut [u8]) -> Result<(), rand::Error> {
+        self.stir()?;
+        OsRng.try_fill_bytes(dest)?;
+
+        let mut stirred = vec![0; dest.len()];
+        self.stirred.fill_bytes(&mut stirred);
+        for (byte, mix) in dest.iter_mut().zip(stirred) {
+            *byte ^= mix;
+        }
+
+        Ok(())
+    }
+}
+
+impl CryptoRng for MixedRng {}
+
 pub trait AttestationProvider {
     fn attestation(&self, params: AttestationParams) -> Result<Vec<u8>>;
 }
@@ -77,6 +451,12 @@ impl AttestationProvider for NsmAttestationProvider {
     }
 }
 
+impl<T: AttestationProvider + ?Sized> AttestationProvider for Arc<T> {
+    fn attestation(&self, params: AttestationParams) -> Result<Vec<u8>> {
+        (**self).attestation(params)
+    }
+}
+
 // Always returns the same document, useful to tests
 pub struct StaticAttestationProvider {
     doc: Vec<u8>,
@@ -93,3 +473,281 @@ impl AttestationProvider for StaticAttestationProvider {
         Ok(self.doc.clone())
     }
 }
+
+// Hands out the most recent document again for as long as it is fresh and
+// was made for the same params, since NSM is slow to make one and some apps
+// ask for one on every request. Past half its TTL, a new document is made in
+// the background, so that callers seldom wait on NSM.
+#[derive(Clone)]
+pub struct CachingAttestationProvider {
+    inner: Arc<dyn AttestationProvider + Send + Sync>,
+    ttl: Duration,
+    cached: Arc<Mutex<Option<CachedAttestation>>>,
+}
+
+struct CachedAttestation {
+    params: AttestationParams,
+    doc: Vec<u8>,
+    made_at: Instant,
+    refreshing: bool,
+}
+
+impl CachingAttestationProvider {
+    pub fn new(inner: Arc<dyn AttestationProvider + Send + Sync>, ttl: Duration) -> Self {
+        Self {
+            inner,
+            ttl,
+            cached: Arc::new(Mutex::new(None)),
+        }
+    }
+
+    // The cached document, if fresh. Starts a refresh if it is getting old.
+    fn cached(&self, params: &AttestationParams) -> Option<Vec<u8>> {
+        let mut cached = self.cached.lock().unwrap();
+        let entry = cached.as_mut().filter(|entry| entry.params == *params)?;
+
+        let age = entry.made_at.elapsed();
+        if age >= self.ttl {
+            return None;
+        }
+
+        if age >= self.ttl / 2 && !entry.refreshing {
+            if let Ok(runtime) = tokio::runtime::Handle::try_current() {
+                entry.refreshing = true;
+                let this = self.clone();
+                let params = params.clone();
+                runtime.spawn_blocking(move || this.refresh(params));
+            }
+        }
+
+        Some(entry.doc.clone())
+    }
+
+    fn refresh(&self, params: AttestationParams) {
+        let res = self.inner.attestation(params.clone());
+
+        let mut cached = self.cached.lock().unwrap();
+        // Unless a document for other params was made in the meantime
+        let entry = match cached.as_mut().filter(|entry| entry.params == params) {
+            Some(entry) => entry,
+            None => return,
+        };
+
+        match res {
+            Ok(doc) => *entry = CachedAttestation::new(params, doc),
+            Err(err) => {
+                warn!("Failed to refresh the cached attestation: {err}");
+                entry.refreshing = false;
+            }
+        }
+    }
+}
+
+impl CachedAttestation {
+    fn new(params: AttestationParams, doc: Vec<u8>) -> Self {
+        Self {
+            params,
+            doc,
+            made_at: Instant::now(),
+            refreshing: false,
+        }
+    }
+}
+
+impl AttestationProvider for CachingAttestationProvider {
+    fn attestation(&self, params: AttestationParams) -> Result<Vec<u8>> {
+        if let Some(doc) = self.cached(&params) {
+            metrics::RUNTIME.attestation_cache("hit");
+            return Ok(doc);
+        }
+        metrics::RUNTIME.attestation_cache("miss");
+
+        // Not holding the lock while NSM works, so that fresh documents for
+        // other params are not held up
+        let doc = self.inner.attestation(params.clone())?;
+        *self.cached.lock().unwrap() = Some(CachedAttestation::new(params, doc.clone()));
+        Ok(doc)
+    }
+}
+
+// The attested key of the enclave, which rotate() replaces with a fresh one.
+// The key and its attestation are only ever swapped together, and the key
+// replaced is kept for a grace period, e.g. to decrypt what was encrypted to
+// it in the meantime.
+pub struct KeyRotator {
+    key_type: KeyType,
+    attester: Arc<dyn AttestationProvider + Send + Sync>,
+    grace: Duration,
+    keys: RwLock<RotatedKeys>,
+}
+
+struct RotatedKeys {
+    current: Arc<AttestedKey>,
+    // and when it was replaced
+    previous: Option<(Arc<AttestedKey>, Instant)>,
+}
+
+impl KeyRotator {
+    pub fn new(
+        key_type: KeyType,
+        attester: Arc<dyn AttestationProvider + Send + Sync>,
+    ) -> Result<Self> {
+        let current = Arc::new(attested_key(key_type, attester.as_ref())?);
+        Ok(Self {
+            key_type,
+            attester,
+            grace: DEFAULT_ROTATION_GRACE,
+            keys: RwLock::new(RotatedKeys {
+                current,
+                previous: None,
+            }),
+        })
+    }
+
+    pub fn with_grace(mut self, grace: Duration) -> Self {
+        self.grace = grace;
+        self
+    }
+
+    pub fn current(&self) -> Arc<AttestedKey> {
+        self.keys.read().unwrap().current.clone()
+    }
+
+    // The key replaced last, until its grace period is over
+    pub fn previous(&self) -> Option<Arc<AttestedKey>> {
+        let keys = self.keys.read().unwrap();
+        let (previous, replaced_at) = keys.previous.as_ref()?;
+        (replaced_at.elapsed() < self.grace).then(|| previous.clone())
+    }
+
+    // Generates and attests a new key, which takes over from the current one
+    // once both are done. Returns the key it replaced.
+    pub fn rotate(&self) -> Result<Arc<AttestedKey>> {
+        let new = Arc::new(attested_key(self.key_type, self.attester.as_ref())?);
+
+        let mut keys = self.keys.write().unwrap();
+        let old = std::mem::replace(&mut keys.current, new);
+        keys.previous = Some((old.clone(), Instant::now()));
+        info!("Rotated the attested {:?} key", self.key_type);
+
+        Ok(old)
+    }
+}
+
+fn attested_key(key_type: KeyType, attester: &dyn AttestationProvider) -> Result<AttestedKey> {
+    let key = KeyPair::generate_with(key_type)?;
+    let attestation = attester.attestation(AttestationParams {
+        nonce: None,
+        user_data: None,
+        public_key: Some(key.public_key_as_der()?),
+    })?;
+
+    Ok(AttestedKey { key, attestation })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{
+        AttestationParams, AttestationProvider, CachingAttestationProvider, Device, KeyRotator,
+        MixedRng, Nsm, NsmRng,
+    };
+    use crate::keypair::KeyType;
+    use crate::mock_nsm::MockNsm;
+    use anyhow::Result;
+    use assert2::assert;
+    use rand::RngCore;
+    use std::io::Read;
+    use std::sync::atomic::{AtomicU8, Ordering};
+    use std::sync::Arc;
+    use std::time::Duration;
+
+    // Numbers its documents
+    struct Counting(AtomicU8);
+
+    impl AttestationProvider for Counting {
+        fn attestation(&self, _params: AttestationParams) -> Result<Vec<u8>> {
+            Ok(vec![self.0.fetch_add(1, Ordering::SeqCst)])
+        }
+    }
+
+    fn params(nonce: &[u8]) -> AttestationParams {
+        AttestationParams {
+            nonce: Some(nonce.to_vec()),
+            user_data: None,
+            public_key: None,
+        }
+    }
+
+    #[tokio::test]
+    async fn test_caching_attestation() {
+        let ttl = Duration::from_millis(200);
+        let cache = CachingAttestationProvider::new(Arc::new(Counting(AtomicU8::new(0))), ttl);
+
+        assert!(cache.attestation(params(b"a")).unwrap() == [0]);
+        assert!(cache.attestation(params(b"a")).unwrap() == [0]);
+
+        // Other params make the most recent document
+        assert!(cache.attestation(params(b"b")).unwrap() == [1]);
+        assert!(cache.attestation(params(b"a")).unwrap() == [2]);
+
+        // Half way through, the old document is handed out while a new one is
+        // made
+        tokio::time::sleep(ttl * 3 / 4).await;
+        assert!(cache.attestation(params(b"a")).unwrap() == [2]);
+        tokio::time::sleep(Duration::from_millis(20)).await;
+        assert!(cache.attestation(params(b"a")).unwrap() == [3]);
+    }
+
+    #[test]
+    fn test_key_rotation() {
+        let rotator = KeyRotator::new(KeyType::Ed25519, Arc::new(Counting(AtomicU8::new(0))))
+            .unwrap()
+            .with_grace(Duration::from_millis(50));
+        let first = rotator.current();
+        assert!(first.attestation == [0]);
+        assert!(rotator.previous().is_none());
+
+        let old = rotator.rotate().unwrap();
+        assert!(Arc::ptr_eq(&old, &first));
+
+        // The new key comes with an attestation of its own
+        let current = rotator.current();
+        assert!(current.attestation == [1]);
+        assert!(current.key.public_key_as_der().unwrap() != first.key.public_key_as_der().unwrap());
+
+        // and the old one is kept for a while
+        let previous = rotator.previous().unwrap();
+        assert!(Arc::ptr_eq(&previous, &first));
+        std::thread::sleep(Duration::from_millis(60));
+        assert!(rotator.previous().is_none());
+    }
+
+    #[test]
+    fn test_device_closed() {
+        use std::os::unix::io::IntoRawFd;
+
+        let fd = std::fs::File::open("/dev/null").unwrap().into_raw_fd();
+        let rdev = nix::sys::stat::fstat(fd).unwrap().st_rdev;
+        let device = Device { fd, rdev };
+        assert!(device.is_open());
+
+        // As after a failed call closed it, which has the next request reopen it
+        nix::unistd::close(fd).unwrap();
+        assert!(!device.is_open());
+    }
+
+    #[test]
+    fn test_random() {
+        let nsm = Arc::new(Nsm::mock(MockNsm::new().unwrap()));
+
+        // More than the NSM returns at a time
+        let mut buf = vec![0; 4096];
+        NsmRng::new(nsm.clone()).read_exact(&mut buf).unwrap();
+        assert!(buf.iter().any(|b| *b != 0));
+
+        let mut rng = MixedRng::new(nsm, Duration::ZERO).unwrap();
+        let first = rng.next_u64();
+        let second = rng.next_u64();
+        assert!(first != second);
+    }
+}
@@ -0,0 +1,246 @@
+use std::collections::BTreeMap;
+
+use anyhow::{anyhow, Result};
+use ring::digest;
+
+use crate::challenge::Attestation;
+
+// The PCRs that the NSM reports as zeros for enclaves started in debug mode,
+// as their measurements would not mean anything with the console open
+const DEBUG_ZEROED_PCRS: &[u16] = &[0, 1, 2, 3, 4, 8];
+
+// The measurement of the certificate the EIF was signed with
+const PCR_SIGNING_CERT: u16 = 8;
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Expected {
+    // Only that the document has the PCR
+    Any,
+    Value(Vec<u8>),
+}
+
+// The PCRs a verifier expects of an enclave, for challenge::Verifier, for
+// `enclaver attest verify` and to write KMS key policies with. Enclaves in
+// debug mode fail the policy unless it allows them, in which case the PCRs
+// zeroed in debug mode are not checked.
+#[derive(Debug, Clone, Default)]
+pub struct PcrPolicy {
+    pcrs: BTreeMap<u16, Expected>,
+    allow_debug: bool,
+}
+
+impl PcrPolicy {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn with_pcr(mut self, index: u16, value: Vec<u8>) -> Self {
+        self.pcrs.insert(index, Expected::Value(value));
+        self
+    }
+
+    pub fn with_any(mut self, index: u16) -> Self {
+        self.pcrs.insert(index, Expected::Any);
+        self
+    }
+
+    pub fn with_debug(mut self, allow_debug: bool) -> Self {
+        self.allow_debug = allow_debug;
+        self
+    }
+
+    // Adds a PCR given as <index>=<hex value>, or <index>=any (or *), as
+    // taken on the command line
+    pub fn with_arg(self, arg: &str) -> Result<Self> {
+        let (index, value) = arg
+            .split_once('=')
+            .ok_or(anyhow!("invalid PCR {arg}, expected <index>=<hex value>"))?;
+        let index = index
+            .parse()
+            .map_err(|_| anyhow!("invalid PCR index {index}"))?;
+
+        match value {
+            "any" | "*" => Ok(self.with_any(index)),
+            _ => self.with_hex(index, value),
+        }
+    }
+
+    pub fn with_hex(self, index: u16, value: &str) -> Result<Self> {
+        Ok(self.with_pcr(index, hex_decode(value)?))
+    }
+
+    // Requires the EIF to have been signed with the certificate (in DER), so
+    // that on top of what the image is, it has to come from whoever holds
+    // the key. Unsigned images have no PCR8, and fail.
+    pub fn with_signing_cert(self, cert: &[u8]) -> Self {
+        self.with_pcr(PCR_SIGNING_CERT, signing_cert_pcr(cert))
+    }
+
+    pub fn matches(&self, attestation: &Attestation) -> Result<()> {
+        let debug = is_debug(&attestation.pcrs);
+        if debug && !self.allow_debug {
+            return Err(anyhow!("the enclave runs in debug mode"));
+        }
+
+        for (index, expected) in &self.pcrs {
+            if debug && DEBUG_ZEROED_PCRS.contains(index) {
+                continue;
+            }
+
+            let value = attestation
+                .pcrs
+                .get(index)
+                .ok_or(anyhow!("the document has no PCR{index}"))?;
+            if let Expected::Value(expected) = expected {
+                if value != expected {
+                    return Err(anyhow!(
+                        "PCR{index} is {}, not {}",
+                        hex(value),
+                        hex(expected)
+                    ));
+                }
+            }
+        }
+
+        Ok(())
+    }
+
+    // The Condition of a KMS key policy statement that allows only enclaves
+    // matching the policy, e.g. to kms:Decrypt. KMS has no notion of "any",
+    // so those PCRs are left out. PCR0 goes by ImageSha384, the name KMS has
+    // for the hash of the whole image.
+    pub fn kms_condition(&self) -> serde_json::Value {
+        let pcrs: serde_json::Map<String, serde_json::Value> = self
+            .pcrs
+            .iter()
+            .filter_map(|(index, expected)| match expected {
+                Expected::Value(value) => Some((kms_condition_key(*index), hex(value).into())),
+                Expected::Any => None,
+            })
+            .collect();
+
+        serde_json::json!({ "StringEqualsIgnoreCase": pcrs })
+    }
+}
+
+fn kms_condition_key(index: u16) -> String {
+    match index {
+        0 => "kms:RecipientAttestation:ImageSha384".to_string(),
+        _ => format!("kms:RecipientAttestation:PCR{index}"),
+    }
+}
+
+// PCR8 as nitro-cli measures it: extended once from zeros, with the SHA-384
+// of the certificate
+pub fn signing_cert_pcr(cert: &[u8]) -> Vec<u8> {
+    let cert_digest = digest::digest(&digest::SHA384, cert);
+
+    let mut pcr = digest::Context::new(&digest::SHA384);
+    pcr.update(&[0; 48]);
+    pcr.update(cert_digest.as_ref());
+    pcr.finish().as_ref().to_vec()
+}
+
+// PCR0 is the measurement of the image, which is never all zeros otherwise
+pub fn is_debug(pcrs: &BTreeMap<u16, Vec<u8>>) -> bool {
+    pcrs.get(&0)
+        .map_or(false, |pcr0| pcr0.iter().all(|b| *b == 0))
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{b:02x}")).collect()
+}
+
+fn hex_decode(s: &str) -> Result<Vec<u8>> {
+    if s.len() % 2 != 0 {
+        return Err(anyhow!("invalid PCR value {s}"));
+    }
+
+    (0..s.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(&s[i..i + 2], 16))
+        .collect::<std::result::Result<Vec<u8>, _>>()
+        .map_err(|_| anyhow!("invalid PCR value {s}"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{hex, signing_cert_pcr, PcrPolicy};
+    use crate::challenge::Attestation;
+    use assert2::assert;
+    use std::collections::BTreeMap;
+    use std::time::SystemTime;
+
+    fn attestation(pcr0: u8) -> Attestation {
+        Attestation {
+            module_id: "i-0123-enc4567".to_string(),
+            timestamp: SystemTime::now(),
+            pcrs: BTreeMap::from([(0, vec![pcr0; 48]), (8, vec![pcr0; 48]), (16, vec![7; 48])]),
+            public_key: None,
+            user_data: None,
+            nonce: None,
+        }
+    }
+
+    #[test]
+    fn test_matches() {
+        let policy = PcrPolicy::new()
+            .with_arg(&format!("0={}", "ab".repeat(48)))
+            .unwrap()
+            .with_arg("16=any")
+            .unwrap();
+        assert!(policy.matches(&attestation(0xab)).is_ok());
+
+        let err = policy.matches(&attestation(0xcd)).unwrap_err();
+        assert!(err.to_string().starts_with("PCR0 is cdcd"));
+
+        let policy = policy.with_any(17);
+        assert!(policy.matches(&attestation(0xab)).is_err());
+
+        assert!(PcrPolicy::new().with_arg("0=xyz").is_err());
+        assert!(PcrPolicy::new().with_arg("zero=00").is_err());
+    }
+
+    #[test]
+    fn test_debug_mode() {
+        let policy = PcrPolicy::new()
+            .with_pcr(0, vec![0xab; 48])
+            .with_pcr(16, vec![7; 48]);
+        let err = policy.matches(&attestation(0)).unwrap_err();
+        assert!(err.to_string().contains("debug mode"));
+
+        // PCR0 is not checked, PCR16 still is
+        let policy = policy.with_debug(true);
+        assert!(policy.matches(&attestation(0)).is_ok());
+        let policy = policy.with_pcr(16, vec![8; 48]);
+        assert!(policy.matches(&attestation(0)).is_err());
+    }
+
+    #[test]
+    fn test_signing_cert() {
+        let cert = b"signing certificate";
+        let pcr8 = signing_cert_pcr(cert);
+        assert!(hex(&pcr8) == "3d9dcf8432e4e777e37268418ecb8b57e3774dcb15d18bb27c9e1dd75f241d0df928cf26abe079b5512de918ee2c1c05");
+
+        let mut signed = attestation(0xab);
+        signed.pcrs.insert(8, pcr8);
+        let policy = PcrPolicy::new().with_signing_cert(cert);
+        assert!(policy.matches(&signed).is_ok());
+
+        let other = PcrPolicy::new().with_signing_cert(b"another certificate");
+        let err = other.matches(&signed).unwrap_err();
+        assert!(err.to_string().starts_with("PCR8 is"));
+    }
+
+    #[test]
+    fn test_kms_condition() {
+        let policy = PcrPolicy::new()
+            .with_pcr(0, vec![0xab; 2])
+            .with_pcr(1, vec![0xcd; 2])
+            .with_any(8);
+        let condition = &policy.kms_condition()["StringEqualsIgnoreCase"];
+        assert!(condition["kms:RecipientAttestation:ImageSha384"] == "abab");
+        assert!(condition["kms:RecipientAttestation:PCR1"] == "cdcd");
+        assert!(condition.get("kms:RecipientAttestation:PCR8").is_none());
+    }
+}
@@ -0,0 +1,249 @@
+use std::collections::HashMap;
+use std::fmt;
+use std::net::IpAddr;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use tokio::sync::{OwnedSemaphorePermit, Semaphore};
+
+use crate::manifest::{EgressLimits, ProxyTimeouts};
+
+const DEFAULT_DIAL_TIMEOUT: Duration = Duration::from_secs(30);
+
+// Of each of the two buffers a proxied connection is copied through
+const DEFAULT_BUFFER_SIZE: usize = 16 * 1024;
+const MAX_BUFFER_SIZE: usize = 1024 * 1024;
+
+// Once this many sources are tracked, those with a full bucket are forgotten
+const MAX_TRACKED_SOURCES: usize = 1024;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LimitExceeded {
+    // Too many connections are open already
+    Connections,
+
+    // The source opens connections faster than it is allowed to
+    Rate,
+}
+
+impl fmt::Display for LimitExceeded {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            LimitExceeded::Connections => write!(f, "too many concurrent egress connections"),
+            LimitExceeded::Rate => write!(f, "egress connection rate limit exceeded"),
+        }
+    }
+}
+
+// Held for as long as the connection is open
+pub struct Permit(Option<OwnedSemaphorePermit>);
+
+// Caps on egress connections, to keep a misbehaving app from exhausting the
+// file descriptors and conntrack entries of the host.
+pub struct Limits {
+    connections: Option<Arc<Semaphore>>,
+    rate: Option<RateLimiter>,
+}
+
+impl Limits {
+    pub fn new(spec: Option<&EgressLimits>) -> Self {
+        let spec = match spec {
+            Some(spec) => spec,
+            None => return Self::unlimited(),
+        };
+
+        Self {
+            connections: spec
+                .max_connections
+                .map(|max| Arc::new(Semaphore::new(max as usize))),
+            rate: spec.connections_per_second.map(|rate| {
+                RateLimiter::new(rate as f64, spec.burst.unwrap_or(rate).max(1) as f64)
+            }),
+        }
+    }
+
+    pub fn unlimited() -> Self {
+        Self {
+            connections: None,
+            rate: None,
+        }
+    }
+
+    // Admit a new connection from the given source.
+    pub fn acquire(&self, source: IpAddr) -> Result<Permit, LimitExceeded> {
+        if let Some(ref rate) = self.rate {
+            if !rate.take(source, Instant::now()) {
+                return Err(LimitExceeded::Rate);
+            }
+        }
+
+        self.acquire_connection()
+    }
+
+    // Admit a new connection, subject to the connection cap only.
+    pub fn acquire_connection(&self) -> Result<Permit, LimitExceeded> {
+        match self.connections {
+            Some(ref sem) => match sem.clone().try_acquire_owned() {
+                Ok(permit) => Ok(Permit(Some(permit))),
+                Err(_) => Err(LimitExceeded::Connections),
+            },
+            None => Ok(Permit(None)),
+        }
+    }
+}
+
+// How long a proxied connection may take to establish, sit idle or stay open,
+// how often it is probed, and the size of the buffers it is copied through.
+// Only connecting is limited by default: long lived and mostly idle
+// connections (e.g. to a database) are common enough.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Timeouts {
+    pub dial: Duration,
+    pub idle: Option<Duration>,
+    pub max_lifetime: Option<Duration>,
+    // How long open connections are given to finish once the proxy stops
+    pub drain: Duration,
+    // How often idle TCP connections of the host are probed
+    pub keepalive: Option<Duration>,
+    pub buffer_size: usize,
+}
+
+impl Timeouts {
+    pub fn new(spec: Option<&ProxyTimeouts>) -> Self {
+        let mut timeouts = Self::default();
+
+        if let Some(spec) = spec {
+            if let Some(dial) = spec.dial_secs {
+                timeouts.dial = Duration::from_secs(dial);
+            }
+            timeouts.idle = spec.idle_secs.map(Duration::from_secs);
+            timeouts.max_lifetime = spec.max_lifetime_secs.map(Duration::from_secs);
+            if let Some(drain) = spec.drain_secs {
+                timeouts.drain = Duration::from_secs(drain);
+            }
+            timeouts.keepalive = spec.keepalive_secs.map(Duration::from_secs);
+        }
+
+        timeouts
+    }
+
+    // Larger buffers make for fewer, larger writes to vsock, which helps bulk
+    // transfers, at the cost of memory for every open connection.
+    pub fn with_buffer_kb(mut self, buffer_kb: Option<u32>) -> Self {
+        if let Some(kb) = buffer_kb {
+            self.buffer_size = (kb as usize * 1024).clamp(1024, MAX_BUFFER_SIZE);
+        }
+        self
+    }
+}
+
+impl Default for Timeouts {
+    fn default() -> Self {
+        Self {
+            dial: DEFAULT_DIAL_TIMEOUT,
+            idle: None,
+            max_lifetime: None,
+            drain: Duration::ZERO,
+            keepalive: None,
+            buffer_size: DEFAULT_BUFFER_SIZE,
+        }
+    }
+}
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+// A token bucket per source address
+struct RateLimiter {
+    rate: f64,
+    burst: f64,
+    buckets: Mutex<HashMap<IpAddr, Bucket>>,
+}
+
+impl RateLimiter {
+    fn new(rate: f64, burst: f64) -> Self {
+        Self {
+            rate,
+            burst,
+            buckets: Mutex::new(HashMap::new()),
+        }
+    }
+
+    fn take(&self, source: IpAddr, now: Instant) -> bool {
+        let mut buckets = self.buckets.lock().unwrap();
+
+        if buckets.len() >= MAX_TRACKED_SOURCES && !buckets.contains_key(&source) {
+            buckets.retain(|_, bucket| self.refill(bucket, now) < self.burst);
+        }
+
+        let bucket = buckets.entry(source).or_insert(Bucket {
+            tokens: self.burst,
+            updated: now,
+        });
+
+        let tokens = self.refill(bucket, now);
+        if tokens >= 1.0 {
+            bucket.tokens = tokens - 1.0;
+            bucket.updated = now;
+            true
+        } else {
+            false
+        }
+    }
+
+    // The tokens in the bucket as of now
+    fn refill(&self, bucket: &Bucket, now: Instant) -> f64 {
+        let elapsed = now.saturating_duration_since(bucket.updated).as_secs_f64();
+        (bucket.tokens + elapsed * self.rate).min(self.burst)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{LimitExceeded, Limits, RateLimiter};
+    use crate::manifest::EgressLimits;
+    use assert2::assert;
+    use std::net::IpAddr;
+    use std::time::{Duration, Instant};
+
+    #[test]
+    fn test_rate_limiter() {
+        let limiter = RateLimiter::new(2.0, 3.0);
+        let a: IpAddr = "127.0.0.1".parse().unwrap();
+        let b: IpAddr = "127.0.1.1".parse().unwrap();
+        let now = Instant::now();
+
+        // The burst is available right away
+        for _ in 0..3 {
+            assert!(limiter.take(a, now));
+        }
+        assert!(!limiter.take(a, now));
+
+        // Other sources have buckets of their own
+        assert!(limiter.take(b, now));
+
+        // and it refills at the given rate
+        let later = now + Duration::from_millis(500);
+        assert!(limiter.take(a, later));
+        assert!(!limiter.take(a, later));
+    }
+
+    #[test]
+    fn test_connection_cap() {
+        let limits = Limits::new(Some(&EgressLimits {
+            max_connections: Some(2),
+            connections_per_second: None,
+            burst: None,
+        }));
+        let source: IpAddr = "127.0.0.1".parse().unwrap();
+
+        let first = limits.acquire(source).unwrap();
+        let _second = limits.acquire(source).unwrap();
+        assert!(let Err(LimitExceeded::Connections) = limits.acquire(source));
+
+        drop(first);
+        assert!(limits.acquire(source).is_ok());
+    }
+}
@@ -1,66 +1,585 @@
 pub mod domain_filter;
 pub mod ip_filter;
+pub mod limits;
+pub mod reload;
+pub mod upstream;
 
+use std::collections::HashMap;
+use std::fmt;
 use std::net::IpAddr;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, RwLock};
 
+use serde::Serialize;
+
+use crate::access_log::{AccessLog, Entry, Verdict};
+use crate::manifest::EgressLimits;
 use domain_filter::DomainFilter;
 use ip_filter::IpFilter;
+use limits::{Limits, Timeouts};
+use upstream::UpstreamProxy;
 
-pub struct EgressPolicy {
-    domain_allow: DomainFilter,
-    domain_deny: DomainFilter,
-    ip_allow: IpFilter,
-    ip_deny: IpFilter,
+struct HostFilter {
+    domains: DomainFilter,
+    ips: IpFilter,
 }
 
-impl EgressPolicy {
-    pub fn new(spec: &crate::manifest::Egress) -> Self {
-        let (domain_allow, ip_allow) = load_filters(&spec.allow);
-        let (domain_deny, ip_deny) = load_filters(&spec.deny);
+impl HostFilter {
+    fn new() -> Self {
+        Self {
+            domains: DomainFilter::new(),
+            ips: IpFilter::new(),
+        }
+    }
 
+    fn allow_all() -> Self {
         Self {
-            domain_allow,
-            domain_deny,
-            ip_allow,
-            ip_deny,
+            domains: DomainFilter::allow_all(),
+            ips: IpFilter::allow_all(),
         }
     }
 
-    pub fn allow_all() -> Self {
+    fn add(&mut self, pattern: &str) {
+        if self.ips.add(pattern).is_err() {
+            self.domains.add(pattern);
+        }
+    }
+
+    fn matches(&self, host: &Host) -> bool {
+        match host {
+            Host::Addr(addr) => self.ips.matches(*addr),
+            Host::Name(name) => self.domains.matches(name),
+        }
+    }
+}
+
+// Patterns without a port apply to any port, the rest only to the given one.
+struct RuleSet {
+    any_port: HostFilter,
+    by_port: HashMap<u16, HostFilter>,
+}
+
+impl RuleSet {
+    fn new(opt_spec: &Option<Vec<String>>) -> Self {
+        let mut rules = Self {
+            any_port: HostFilter::new(),
+            by_port: HashMap::new(),
+        };
+
+        if let Some(ref spec) = opt_spec {
+            for pattern in spec {
+                match split_port(pattern) {
+                    (host, Some(port)) => rules
+                        .by_port
+                        .entry(port)
+                        .or_insert_with(HostFilter::new)
+                        .add(host),
+                    (host, None) => rules.any_port.add(host),
+                }
+            }
+        }
+
+        rules
+    }
+
+    fn allow_all() -> Self {
         Self {
-            domain_allow: DomainFilter::allow_all(),
-            domain_deny: DomainFilter::new(),
-            ip_allow: IpFilter::allow_all(),
-            ip_deny: IpFilter::new(),
+            any_port: HostFilter::allow_all(),
+            by_port: HashMap::new(),
         }
     }
 
-    pub fn is_host_allowed(&self, mut host: &str) -> bool {
-        log::trace!("is_host_allowed({host})");
+    fn matches(&self, host: &Host, port: u16) -> bool {
+        self.any_port.matches(host)
+            || self
+                .by_port
+                .get(&port)
+                .map_or(false, |filter| filter.matches(host))
+    }
+
+    // Whether the host is matched on any port at all
+    fn matches_host(&self, host: &Host) -> bool {
+        self.any_port.matches(host) || self.by_port.values().any(|filter| filter.matches(host))
+    }
+}
+
+// Split off an optional ":port" suffix. IPv6 addresses and networks
+// need to be bracketed to carry a port, e.g. "[fd00::/8]:443".
+fn split_port(pattern: &str) -> (&str, Option<u16>) {
+    if let Some(rest) = pattern.strip_prefix('[') {
+        if let Some((host, port)) = rest.split_once("]:") {
+            if let Ok(port) = port.parse() {
+                return (host, Some(port));
+            }
+        }
+        return (rest.strip_suffix(']').unwrap_or(rest), None);
+    }
+
+    match pattern.rsplit_once(':') {
+        Some((host, port)) if !host.contains(':') => match port.parse() {
+            Ok(port) => (host, Some(port)),
+            Err(_) => (pattern, None),
+        },
+        _ => (pattern, None),
+    }
+}
+
+enum Host<'a> {
+    Addr(IpAddr),
+    Name(&'a str),
+}
 
+impl<'a> Host<'a> {
+    fn parse(mut host: &'a str) -> Self {
         // An IPv6 address gets passed with the brackets, e.g. [::1],
         // and need to be stripped before converting to an IpAddr
         host = host.strip_prefix('[').unwrap_or(host);
         host = host.strip_suffix(']').unwrap_or(host);
 
         match host.parse::<IpAddr>() {
-            Ok(addr) => self.ip_allow.matches(addr) && !self.ip_deny.matches(addr),
-            Err(_) => self.domain_allow.matches(host) && !self.domain_deny.matches(host),
+            Ok(addr) => Self::Addr(addr),
+            Err(_) => Self::Name(host),
         }
     }
 }
 
-fn load_filters(opt_spec: &Option<Vec<String>>) -> (DomainFilter, IpFilter) {
-    let mut domains = DomainFilter::new();
-    let mut ips = IpFilter::new();
+// Why a destination was refused.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Denial {
+    // The host is not allowed (or explicitly denied) on any port
+    Host(String),
+
+    // The host is allowed, but not on this port
+    Port(String, u16),
+
+    // The host name resolved to an address that is denied
+    ResolvedAddr(String, IpAddr),
+
+    // A TLS client connected to the host asked for another server name, or
+    // for none at all
+    ServerName(String, Option<String>),
+}
+
+impl fmt::Display for Denial {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Denial::Host(host) => write!(f, "{host} is not allowed by the egress policy"),
+            Denial::Port(host, port) => {
+                write!(
+                    f,
+                    "port {port} is not allowed for {host} by the egress policy"
+                )
+            }
+            Denial::ResolvedAddr(host, addr) => write!(
+                f,
+                "{host} resolves to {addr}, which is denied by the egress policy"
+            ),
+            Denial::ServerName(host, Some(name)) => write!(
+                f,
+                "TLS server name {name} is not allowed for {host} by the egress policy"
+            ),
+            Denial::ServerName(host, None) => {
+                write!(f, "TLS connection to {host} is missing a server name")
+            }
+        }
+    }
+}
+
+#[derive(Default)]
+struct DenialCounters {
+    host: AtomicU64,
+    port: AtomicU64,
+    resolved_addr: AtomicU64,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct DenialStats {
+    pub host: u64,
+    pub port: u64,
+    pub resolved_addr: u64,
+}
+
+// The part of the policy that can be replaced while the proxies run
+struct Rules {
+    allow: RuleSet,
+    deny: RuleSet,
+    limits: Arc<Limits>,
+    // What the limits were made from, to tell whether a reload changes them
+    limits_spec: Option<EgressLimits>,
+}
+
+impl Rules {
+    fn new(spec: &crate::manifest::Egress) -> Self {
+        Self {
+            allow: RuleSet::new(&spec.allow),
+            deny: RuleSet::new(&spec.deny),
+            limits: Arc::new(Limits::new(spec.limits.as_ref())),
+            limits_spec: spec.limits.clone(),
+        }
+    }
+
+    // The rules of spec. Limits it leaves as they were are kept, along with
+    // the connections they count and the buckets of their rate limiter.
+    fn reloaded(&self, spec: &crate::manifest::Egress) -> Self {
+        let limits = if spec.limits == self.limits_spec {
+            self.limits.clone()
+        } else {
+            Arc::new(Limits::new(spec.limits.as_ref()))
+        };
+
+        Self {
+            allow: RuleSet::new(&spec.allow),
+            deny: RuleSet::new(&spec.deny),
+            limits,
+            limits_spec: spec.limits.clone(),
+        }
+    }
+}
+
+pub struct EgressPolicy {
+    rules: RwLock<Arc<Rules>>,
+    denials: DenialCounters,
+    access_log: Option<AccessLog>,
+    timeouts: Timeouts,
+    upstream_proxy: Option<UpstreamProxy>,
+    enforce_sni: bool,
+    intercept: RuleSet,
+}
+
+impl EgressPolicy {
+    pub fn new(spec: &crate::manifest::Egress) -> Self {
+        Self {
+            rules: RwLock::new(Arc::new(Rules::new(spec))),
+            denials: DenialCounters::default(),
+            access_log: spec.access_log.as_ref().map(AccessLog::new),
+            timeouts: Timeouts::new(spec.timeouts.as_ref()).with_buffer_kb(spec.buffer_kb),
+            // Validated along with the manifest
+            upstream_proxy: spec
+                .upstream_proxy
+                .as_ref()
+                .and_then(|spec| UpstreamProxy::new(spec).ok()),
+            enforce_sni: spec.enforce_sni.unwrap_or(false),
+            intercept: RuleSet::new(&spec.mitm.as_ref().map(|mitm| mitm.hosts.clone())),
+        }
+    }
+
+    pub fn allow_all() -> Self {
+        Self {
+            rules: RwLock::new(Arc::new(Rules {
+                allow: RuleSet::allow_all(),
+                deny: RuleSet::new(&None),
+                limits: Arc::new(Limits::unlimited()),
+                limits_spec: None,
+            })),
+            denials: DenialCounters::default(),
+            access_log: None,
+            timeouts: Timeouts::default(),
+            upstream_proxy: None,
+            enforce_sni: false,
+            intercept: RuleSet::new(&None),
+        }
+    }
+
+    pub fn with_upstream_proxy(mut self, upstream_proxy: Option<UpstreamProxy>) -> Self {
+        self.upstream_proxy = upstream_proxy;
+        self
+    }
+
+    // Swap in the allow and deny rules and the limits of spec, atomically.
+    // Checks made from now on follow the new rules, while connections that
+    // are open already are left be. Unchanged limits keep counting them,
+    // only limits that change start over. The rest of the policy stays as
+    // it was.
+    pub fn reload(&self, spec: &crate::manifest::Egress) {
+        let mut rules = self.rules.write().unwrap();
+        *rules = Arc::new(rules.reloaded(spec));
+    }
+
+    fn rules(&self) -> Arc<Rules> {
+        self.rules.read().unwrap().clone()
+    }
+
+    pub fn is_host_allowed(&self, host: &str) -> bool {
+        log::trace!("is_host_allowed({host})");
+
+        let rules = self.rules();
+        let host = Host::parse(host);
+        rules.allow.matches_host(&host) && !rules.deny.any_port.matches(&host)
+    }
+
+    // Check a destination against the policy, counting any denial.
+    pub fn check(&self, host: &str, port: u16) -> Result<(), Denial> {
+        log::trace!("check({host}, {port})");
+
+        let rules = self.rules();
+        let parsed = Host::parse(host);
+
+        let res = if rules.deny.matches(&parsed, port) {
+            Err(Denial::Host(host.to_string()))
+        } else if rules.allow.matches(&parsed, port) {
+            Ok(())
+        } else if rules.allow.matches_host(&parsed) {
+            Err(Denial::Port(host.to_string(), port))
+        } else {
+            Err(Denial::Host(host.to_string()))
+        };
+
+        if let Err(ref denial) = res {
+            self.record(denial);
+        }
 
-    if let Some(ref spec) = opt_spec {
-        for pattern in spec {
-            if ips.add(pattern).is_err() {
-                domains.add(pattern);
+        res
+    }
+
+    // Check an address a host name resolved to. Allowing a name implies allowing
+    // whatever it resolves to, so only the deny rules are consulted.
+    pub fn check_resolved(&self, host: &str, addr: IpAddr, port: u16) -> Result<(), Denial> {
+        if self.rules().deny.matches(&Host::Addr(addr), port) {
+            let denial = Denial::ResolvedAddr(host.to_string(), addr);
+            self.record(&denial);
+            Err(denial)
+        } else {
+            Ok(())
+        }
+    }
+
+    // Whether TLS to the destination is terminated in the enclave, to audit
+    // the requests made. Only ever for host names, which certificates can be
+    // issued for.
+    pub fn intercepts(&self, host: &str, port: u16) -> bool {
+        match Host::parse(host) {
+            Host::Name(_) => self.intercept.matches(&Host::parse(host), port),
+            Host::Addr(_) => false,
+        }
+    }
+
+    pub fn enforces_sni(&self) -> bool {
+        self.enforce_sni
+    }
+
+    // Check the server name of a TLS connection to host, if server names are
+    // enforced. Names have to match the name that was connected to, and when
+    // connecting to an address, be allowed themselves. Otherwise an allowed
+    // address (e.g. of a CDN) could be used to reach any name it serves.
+    pub fn check_server_name(
+        &self,
+        host: &str,
+        port: u16,
+        server_name: Option<&str>,
+    ) -> Result<(), Denial> {
+        if !self.enforce_sni {
+            return Ok(());
+        }
+
+        let allowed = match (Host::parse(host), server_name) {
+            // Clients connecting to an address often send no name
+            (Host::Addr(_), None) => true,
+            (Host::Addr(_), Some(name)) => {
+                let rules = self.rules();
+                let name = Host::parse(name);
+                rules.allow.matches(&name, port) && !rules.deny.matches(&name, port)
             }
+            (Host::Name(host), Some(name)) => host
+                .trim_end_matches('.')
+                .eq_ignore_ascii_case(name.trim_end_matches('.')),
+            (Host::Name(_), None) => false,
+        };
+
+        if allowed {
+            Ok(())
+        } else {
+            Err(Denial::ServerName(
+                host.to_string(),
+                server_name.map(str::to_string),
+            ))
         }
     }
 
-    (domains, ips)
+    pub fn denials(&self) -> DenialStats {
+        DenialStats {
+            host: self.denials.host.load(Ordering::Relaxed),
+            port: self.denials.port.load(Ordering::Relaxed),
+            resolved_addr: self.denials.resolved_addr.load(Ordering::Relaxed),
+        }
+    }
+
+    pub fn limits(&self) -> Arc<Limits> {
+        self.rules().limits.clone()
+    }
+
+    pub fn timeouts(&self) -> &Timeouts {
+        &self.timeouts
+    }
+
+    // The proxy to connect to the destination through, unless it is exempt
+    pub fn upstream_proxy(&self, host: &str) -> Option<&UpstreamProxy> {
+        self.upstream_proxy
+            .as_ref()
+            .filter(|upstream| !upstream.bypass(host))
+    }
+
+    // Log a proxied connection, if access logging is enabled
+    pub fn log_access(&self, entry: Entry, verdict: Verdict) {
+        if let Some(ref access_log) = self.access_log {
+            access_log.finish(entry, verdict);
+        }
+    }
+
+    fn record(&self, denial: &Denial) {
+        let counter = match denial {
+            Denial::Host(..) => &self.denials.host,
+            Denial::Port(..) => &self.denials.port,
+            Denial::ResolvedAddr(..) => &self.denials.resolved_addr,
+            // Only checked in the enclave, where nobody asks for the counts
+            Denial::ServerName(..) => return,
+        };
+        counter.fetch_add(1, Ordering::Relaxed);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use assert2::assert;
+
+    use super::{split_port, Denial, EgressPolicy};
+    use crate::manifest::{Egress, EgressLimits, MitmSpec};
+
+    fn strings(ls: &[&str]) -> Option<Vec<String>> {
+        Some(ls.iter().map(|s| s.to_string()).collect())
+    }
+
+    #[test]
+    fn test_split_port() {
+        assert!(split_port("example.com") == ("example.com", None));
+        assert!(split_port("example.com:443") == ("example.com", Some(443)));
+        assert!(split_port("10.0.0.0/8:5432") == ("10.0.0.0/8", Some(5432)));
+        assert!(split_port("fd00::/8") == ("fd00::/8", None));
+        assert!(split_port("[fd00::/8]:443") == ("fd00::/8", Some(443)));
+        assert!(split_port("[::1]") == ("::1", None));
+    }
+
+    #[test]
+    fn test_check() {
+        let policy = EgressPolicy::new(&Egress {
+            allow: strings(&["**.amazonaws.com", "db.internal:5432", "10.0.0.0/8:443"]),
+            deny: strings(&["169.254.169.254", "secret.internal"]),
+            ..Default::default()
+        });
+
+        assert!(policy.check("kms.us-east-1.amazonaws.com", 443).is_ok());
+        assert!(policy.check("db.internal", 5432).is_ok());
+        assert!(policy.check("10.1.2.3", 443).is_ok());
+
+        assert!(
+            policy.check("db.internal", 22) == Err(Denial::Port("db.internal".to_string(), 22))
+        );
+        assert!(policy.check("10.1.2.3", 80) == Err(Denial::Port("10.1.2.3".to_string(), 80)));
+        assert!(policy.check("example.com", 443) == Err(Denial::Host("example.com".to_string())));
+        assert!(policy.check("169.254.169.254", 80).is_err());
+
+        let addr = "169.254.169.254".parse().unwrap();
+        assert!(policy.check_resolved("db.internal", addr, 5432).is_err());
+        assert!(policy
+            .check_resolved("db.internal", "10.0.0.1".parse().unwrap(), 5432)
+            .is_ok());
+
+        let stats = policy.denials();
+        assert!(stats.host == 2);
+        assert!(stats.port == 2);
+        assert!(stats.resolved_addr == 1);
+
+        assert!(policy.is_host_allowed("db.internal"));
+        assert!(!policy.is_host_allowed("secret.internal"));
+    }
+
+    #[test]
+    fn test_check_server_name() {
+        let policy = EgressPolicy::new(&Egress {
+            allow: strings(&["*.example.com", "example.com", "10.0.0.0/8"]),
+            deny: strings(&["secret.example.com"]),
+            enforce_sni: Some(true),
+            ..Default::default()
+        });
+
+        assert!(policy
+            .check_server_name("example.com", 443, Some("Example.com."))
+            .is_ok());
+        assert!(
+            policy.check_server_name("example.com", 443, Some("evil.com"))
+                == Err(Denial::ServerName(
+                    "example.com".to_string(),
+                    Some("evil.com".to_string())
+                ))
+        );
+        assert!(policy.check_server_name("example.com", 443, None).is_err());
+
+        // Names sent to addresses have to be allowed on their own
+        assert!(policy.check_server_name("10.1.2.3", 443, None).is_ok());
+        assert!(policy
+            .check_server_name("10.1.2.3", 443, Some("api.example.com"))
+            .is_ok());
+        assert!(policy
+            .check_server_name("10.1.2.3", 443, Some("secret.example.com"))
+            .is_err());
+        assert!(policy
+            .check_server_name("10.1.2.3", 443, Some("evil.com"))
+            .is_err());
+
+        // and nothing is checked unless asked to
+        let policy = EgressPolicy::allow_all();
+        assert!(policy.check_server_name("example.com", 443, None).is_ok());
+    }
+
+    #[test]
+    fn test_intercepts() {
+        let policy = EgressPolicy::new(&Egress {
+            allow: strings(&["**"]),
+            mitm: Some(MitmSpec {
+                hosts: vec!["**.example.com:443".to_string(), "10.0.0.0/8".to_string()],
+                ca_cert_path: None,
+                trusted_ca_path: None,
+                strip_request_headers: None,
+                strip_response_headers: None,
+            }),
+            ..Default::default()
+        });
+
+        assert!(policy.intercepts("api.example.com", 443));
+        assert!(!policy.intercepts("api.example.com", 8443));
+        assert!(!policy.intercepts("example.org", 443));
+        assert!(!policy.intercepts("10.0.0.1", 443));
+        assert!(!EgressPolicy::allow_all().intercepts("api.example.com", 443));
+    }
+
+    #[test]
+    fn test_reload() {
+        let spec = |allow: &[&str], max_connections| Egress {
+            allow: strings(allow),
+            limits: Some(EgressLimits {
+                max_connections,
+                connections_per_second: None,
+                burst: None,
+            }),
+            ..Default::default()
+        };
+
+        let policy = EgressPolicy::new(&spec(&["example.com"], Some(1)));
+        assert!(policy.check("example.com", 443).is_ok());
+        assert!(policy.check("example.org", 443).is_err());
+        let permit = policy.limits().acquire_connection().unwrap();
+
+        policy.reload(&spec(&["example.org"], Some(1)));
+        assert!(policy.check("example.com", 443).is_err());
+        assert!(policy.check("example.org", 443).is_ok());
+
+        // Unchanged limits still count the connections open before
+        assert!(policy.limits().acquire_connection().is_err());
+
+        // while new ones start over
+        policy.reload(&spec(&["example.org"], Some(2)));
+        let _second = policy.limits().acquire_connection().unwrap();
+        let _third = policy.limits().acquire_connection().unwrap();
+        assert!(policy.limits().acquire_connection().is_err());
+        drop(permit);
+    }
 }
@@ -0,0 +1,89 @@
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::{Duration, SystemTime};
+
+use anyhow::{anyhow, Result};
+use log::{error, info};
+
+use crate::manifest::load_manifest;
+use crate::policy::EgressPolicy;
+
+// How often the manifest is checked for changes
+const POLL_INTERVAL: Duration = Duration::from_secs(5);
+
+// Replace the rules of the policy with those of the manifest at path. The
+// policy is left as it was if the manifest is invalid or has no egress.
+pub async fn reload(path: &Path, policy: &EgressPolicy) -> Result<()> {
+    let manifest = load_manifest(path).await?;
+    let egress = manifest
+        .egress
+        .ok_or_else(|| anyhow!("{} has no egress section", path.display()))?;
+
+    policy.reload(&egress);
+    info!("reloaded egress rules from {}", path.display());
+    Ok(())
+}
+
+// Reload the policy whenever the manifest at path is modified
+pub async fn watch(path: PathBuf, policy: Arc<EgressPolicy>) {
+    let mut last_modified = modified(&path).await;
+
+    loop {
+        tokio::time::sleep(POLL_INTERVAL).await;
+
+        let modified = modified(&path).await;
+        if modified == last_modified {
+            continue;
+        }
+        last_modified = modified;
+
+        if let Err(err) = reload(&path, &policy).await {
+            error!("failed to reload egress rules, keeping the current ones: {err}");
+        }
+    }
+}
+
+async fn modified(path: &Path) -> Option<SystemTime> {
+    tokio::fs::metadata(path)
+        .await
+        .and_then(|metadata| metadata.modified())
+        .ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::reload;
+    use crate::policy::EgressPolicy;
+    use assert2::assert;
+
+    const MANIFEST: &str = r#"
+version: v1
+name: "test"
+target: "target-image:latest"
+sources:
+  app: "app-image:latest"
+"#;
+
+    #[tokio::test]
+    async fn test_reload() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("enclaver.yaml");
+        let policy = EgressPolicy::allow_all();
+
+        std::fs::write(
+            &path,
+            format!("{MANIFEST}egress:\n  allow: [example.com]\n"),
+        )
+        .unwrap();
+        reload(&path, &policy).await.unwrap();
+        assert!(policy.check("example.com", 443).is_ok());
+        assert!(policy.check("example.org", 443).is_err());
+
+        // Invalid manifests leave the rules be
+        std::fs::write(&path, format!("{MANIFEST}egress:\n  allow: example.org\n")).unwrap();
+        assert!(reload(&path, &policy).await.is_err());
+        std::fs::write(&path, MANIFEST).unwrap();
+        assert!(reload(&path, &policy).await.is_err());
+        assert!(policy.check("example.com", 443).is_ok());
+    }
+}
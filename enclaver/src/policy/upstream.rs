@@ -0,0 +1,209 @@
+use std::net::IpAddr;
+
+use anyhow::{anyhow, Result};
+use http::Uri;
+use ipnetwork::IpNetwork;
+
+use crate::manifest::UpstreamProxySpec;
+
+const DEFAULT_PORT: u16 = 80;
+
+// An HTTP proxy the host has to connect to destinations through, as is
+// common on corporate networks.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct UpstreamProxy {
+    pub host: String,
+    pub port: u16,
+    // The value of the Proxy-Authorization header, from credentials in the URL
+    pub authorization: Option<String>,
+    no_proxy: Vec<NoProxy>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum NoProxy {
+    All,
+    Network(IpNetwork),
+    // Matches the domain and everything below it
+    Domain(String),
+}
+
+impl UpstreamProxy {
+    pub fn new(spec: &UpstreamProxySpec) -> Result<Self> {
+        let mut proxy = Self::parse(&spec.url)?;
+        for entry in spec.no_proxy.iter().flatten() {
+            proxy.no_proxy.extend(NoProxy::parse(entry));
+        }
+        Ok(proxy)
+    }
+
+    // The proxy set by HTTPS_PROXY (or https_proxy) and the exceptions in
+    // NO_PROXY (or no_proxy), the way most tools on the host would use them.
+    pub fn from_env() -> Result<Option<Self>> {
+        let url = match env_var("HTTPS_PROXY") {
+            Some(url) => url,
+            None => return Ok(None),
+        };
+
+        let mut proxy = Self::parse(&url)?;
+        if let Some(no_proxy) = env_var("NO_PROXY") {
+            proxy
+                .no_proxy
+                .extend(no_proxy.split(',').filter_map(NoProxy::parse));
+        }
+        Ok(Some(proxy))
+    }
+
+    pub fn parse(url: &str) -> Result<Self> {
+        // A scheme is often left out of proxy variables
+        let uri: Uri = if url.contains("://") {
+            url.parse()?
+        } else {
+            format!("http://{url}").parse()?
+        };
+
+        if uri.scheme_str() != Some("http") {
+            return Err(anyhow!(
+                "upstream proxy {url}: only http:// proxies are supported"
+            ));
+        }
+
+        let authority = uri
+            .authority()
+            .ok_or_else(|| anyhow!("upstream proxy {url}: missing host"))?;
+
+        let authorization = match authority.as_str().rsplit_once('@') {
+            Some((userinfo, _)) => Some(format!(
+                "Basic {}",
+                base64::encode(percent_decode(userinfo))
+            )),
+            None => None,
+        };
+
+        Ok(Self {
+            host: authority
+                .host()
+                .trim_start_matches('[')
+                .trim_end_matches(']')
+                .to_string(),
+            port: authority.port_u16().unwrap_or(DEFAULT_PORT),
+            authorization,
+            no_proxy: Vec::new(),
+        })
+    }
+
+    // Whether the destination is to be connected to directly instead
+    pub fn bypass(&self, host: &str) -> bool {
+        let host = host.trim_end_matches('.').to_ascii_lowercase();
+        let addr = host.parse::<IpAddr>().ok();
+
+        self.no_proxy.iter().any(|entry| match entry {
+            NoProxy::All => true,
+            NoProxy::Network(net) => addr.map_or(false, |addr| net.contains(addr)),
+            NoProxy::Domain(domain) => {
+                host == *domain
+                    || host
+                        .strip_suffix(domain.as_str())
+                        .map_or(false, |rest| rest.ends_with('.'))
+            }
+        })
+    }
+}
+
+impl NoProxy {
+    fn parse(entry: &str) -> Option<Self> {
+        let entry = entry.trim();
+        if entry.is_empty() {
+            return None;
+        }
+        if entry == "*" {
+            return Some(Self::All);
+        }
+        if let Ok(net) = entry.parse::<IpNetwork>() {
+            return Some(Self::Network(net));
+        }
+
+        // ".example.com" and "example.com" mean the same
+        let domain = entry.trim_start_matches('.').trim_end_matches('.');
+        Some(Self::Domain(domain.to_ascii_lowercase()))
+    }
+}
+
+fn env_var(name: &str) -> Option<String> {
+    std::env::var(name)
+        .or_else(|_| std::env::var(name.to_ascii_lowercase()))
+        .ok()
+        .filter(|value| !value.is_empty())
+}
+
+fn percent_decode(s: &str) -> Vec<u8> {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let hex = bytes
+            .get(i + 1..i + 3)
+            .and_then(|hex| std::str::from_utf8(hex).ok())
+            .and_then(|hex| u8::from_str_radix(hex, 16).ok());
+        match (bytes[i], hex) {
+            (b'%', Some(b)) => {
+                out.push(b);
+                i += 3;
+            }
+            (b, _) => {
+                out.push(b);
+                i += 1;
+            }
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::UpstreamProxy;
+    use crate::manifest::UpstreamProxySpec;
+    use assert2::assert;
+
+    #[test]
+    fn test_parse() {
+        let proxy = UpstreamProxy::parse("http://proxy.corp:3128").unwrap();
+        assert!(proxy.host == "proxy.corp");
+        assert!(proxy.port == 3128);
+        assert!(proxy.authorization == None);
+
+        let proxy = UpstreamProxy::parse("proxy.corp").unwrap();
+        assert!(proxy.port == 80);
+
+        // Credentials are percent-decoded before being encoded again
+        let proxy = UpstreamProxy::parse("http://user:p%40ss@[fd00::1]:8080").unwrap();
+        assert!(proxy.host == "fd00::1");
+        assert!(proxy.authorization == Some(format!("Basic {}", base64::encode("user:p@ss"))));
+
+        assert!(UpstreamProxy::parse("https://proxy.corp:3128").is_err());
+        assert!(UpstreamProxy::parse("socks5://proxy.corp:1080").is_err());
+    }
+
+    #[test]
+    fn test_bypass() {
+        let proxy = UpstreamProxy::new(&UpstreamProxySpec {
+            url: "http://proxy.corp:3128".to_string(),
+            no_proxy: Some(vec![
+                ".internal.corp".to_string(),
+                "example.com".to_string(),
+                "10.0.0.0/8".to_string(),
+                "169.254.169.254".to_string(),
+            ]),
+        })
+        .unwrap();
+
+        assert!(proxy.bypass("internal.corp"));
+        assert!(proxy.bypass("git.internal.corp"));
+        assert!(proxy.bypass("API.Example.com."));
+        assert!(proxy.bypass("10.1.2.3"));
+        assert!(proxy.bypass("169.254.169.254"));
+
+        assert!(!proxy.bypass("notexample.com"));
+        assert!(!proxy.bypass("example.org"));
+        assert!(!proxy.bypass("11.1.2.3"));
+    }
+}
@@ -0,0 +1,199 @@
+use std::collections::BTreeMap;
+use std::net::Ipv4Addr;
+
+use anyhow::{anyhow, Result};
+
+use crate::constants::{
+    API_VSOCK_PORT, APP_LOG_PORT, CLOCK_SYNC_PORT, CREDENTIALS_VSOCK_PORT, DNS_STUB_PORT,
+    DNS_VSOCK_PORT, EGRESS_MUX_VSOCK_PORT, HEARTBEAT_PORT, HTTP_EGRESS_PROXY_PORT,
+    HTTP_EGRESS_VSOCK_PORT, SHUTDOWN_PORT, STATUS_PORT, TRANSPARENT_EGRESS_PORT,
+    UDP_EGRESS_VSOCK_PORT,
+};
+use crate::manifest::{Manifest, TunnelProtocol};
+
+// The vsock ports the wrapper and the runtime talk to each other over. Ingress
+// is forwarded over the vsock port of the same number as the TCP one, so the
+// manifest cannot listen on any of these.
+pub const WELL_KNOWN: &[(u32, &str)] = &[
+    (STATUS_PORT, "app status"),
+    (APP_LOG_PORT, "app log"),
+    (HTTP_EGRESS_VSOCK_PORT, "egress proxy"),
+    (API_VSOCK_PORT, "host-facing API"),
+    (HEARTBEAT_PORT, "heartbeat"),
+    (CLOCK_SYNC_PORT, "clock sync"),
+    (UDP_EGRESS_VSOCK_PORT, "UDP egress"),
+    (DNS_VSOCK_PORT, "DNS"),
+    (EGRESS_MUX_VSOCK_PORT, "egress mux"),
+    (CREDENTIALS_VSOCK_PORT, "AWS credentials"),
+    (SHUTDOWN_PORT, "shutdown"),
+];
+
+// Who uses which vsock port, and which TCP and UDP port inside the enclave.
+// Built from the same manifest, the registries of the wrapper and of the
+// runtime agree on every port.
+#[derive(Debug, Clone, Default)]
+pub struct Registry {
+    vsock: BTreeMap<u32, String>,
+    tcp: BTreeMap<u16, String>,
+    udp: BTreeMap<u16, String>,
+}
+
+impl Registry {
+    // The well-known ports, along with those the manifest listens on. Fails
+    // on the first port that two of them would use.
+    pub fn from_manifest(manifest: &Manifest) -> Result<Self> {
+        let mut ports = Self::default();
+        for (port, owner) in WELL_KNOWN {
+            ports.claim_vsock(*port, owner)?;
+        }
+
+        for ingress in manifest.ingress.iter().flatten() {
+            let owner = format!("ingress on port {}", ingress.listen_port);
+            ports.claim_vsock(ingress.listen_port.into(), &owner)?;
+            // The app listens on it
+            ports.claim_tcp(ingress.listen_port, &owner)?;
+        }
+
+        // The egress proxy only runs when something is allowed
+        let egress = manifest.egress.as_ref().filter(|egress| {
+            egress
+                .allow
+                .as_ref()
+                .map_or(false, |allow| !allow.is_empty())
+        });
+        if let Some(egress) = egress {
+            let port = egress.proxy_port.unwrap_or(HTTP_EGRESS_PROXY_PORT);
+            ports.claim_tcp(port, "egress proxy")?;
+            if egress.transparent == Some(true) {
+                ports.claim_tcp(TRANSPARENT_EGRESS_PORT, "transparent egress")?;
+            }
+            if egress.dns == Some(true) {
+                ports.claim_udp(DNS_STUB_PORT, "DNS stub")?;
+            }
+
+            for tunnel in egress.tunnels.iter().flatten() {
+                let owner = format!("egress tunnel to {}:{}", tunnel.host, tunnel.port);
+                let port = tunnel.listen_port.unwrap_or(tunnel.port);
+                if tunnel.protocol != Some(TunnelProtocol::Udp) {
+                    ports.claim_tcp(port, &owner)?;
+                } else if tunnel.listen_address == Some(Ipv4Addr::LOCALHOST) {
+                    // Others listen on an address of their own, where the DNS
+                    // stub does not
+                    ports.claim_udp(port, &owner)?;
+                }
+            }
+        }
+
+        if let Some(ref kms_proxy) = manifest.kms_proxy {
+            ports.claim_tcp(kms_proxy.listen_port, "KMS proxy")?;
+        }
+        if let Some(ref api) = manifest.api {
+            ports.claim_tcp(api.listen_port, "API")?;
+        }
+
+        Ok(ports)
+    }
+
+    pub fn claim_vsock(&mut self, port: u32, owner: &str) -> Result<()> {
+        match self.vsock.get(&port) {
+            Some(other) => Err(anyhow!(
+                "{owner} cannot use vsock port {port}, which {other} uses"
+            )),
+            None => {
+                self.vsock.insert(port, owner.to_string());
+                Ok(())
+            }
+        }
+    }
+
+    pub fn claim_tcp(&mut self, port: u16, owner: &str) -> Result<()> {
+        match self.tcp.get(&port) {
+            Some(other) => Err(anyhow!(
+                "{owner} cannot use port {port}, which {other} uses"
+            )),
+            None => {
+                self.tcp.insert(port, owner.to_string());
+                Ok(())
+            }
+        }
+    }
+
+    pub fn claim_udp(&mut self, port: u16, owner: &str) -> Result<()> {
+        match self.udp.get(&port) {
+            Some(other) => Err(anyhow!(
+                "{owner} cannot use UDP port {port}, which {other} uses"
+            )),
+            None => {
+                self.udp.insert(port, owner.to_string());
+                Ok(())
+            }
+        }
+    }
+
+    pub fn vsock_owner(&self, port: u32) -> Option<&str> {
+        self.vsock.get(&port).map(String::as_str)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::Registry;
+    use crate::constants::HEARTBEAT_PORT;
+    use crate::manifest::Manifest;
+    use assert2::assert;
+
+    fn manifest(yaml: &str) -> Manifest {
+        serde_yaml::from_str(yaml).unwrap()
+    }
+
+    const BASE: &str = r#"
+version: v1
+name: test
+target: test:latest
+sources:
+  app: app:latest
+"#;
+
+    #[test]
+    fn test_registry() {
+        let ports = Registry::from_manifest(&manifest(&format!(
+            "{BASE}ingress:\n  - listen_port: 8000\negress:\n  allow: [\"*\"]\n"
+        )))
+        .unwrap();
+        assert!(ports.vsock_owner(8000) == Some("ingress on port 8000"));
+        assert!(ports.vsock_owner(HEARTBEAT_PORT) == Some("heartbeat"));
+
+        // Ingress over a vsock port of the runtime
+        let err = Registry::from_manifest(&manifest(&format!(
+            "{BASE}ingress:\n  - listen_port: {HEARTBEAT_PORT}\n"
+        )))
+        .unwrap_err();
+        assert!(err.to_string().contains("which heartbeat uses"));
+
+        // or on the port of the egress proxy
+        let err = Registry::from_manifest(&manifest(&format!(
+            "{BASE}ingress:\n  - listen_port: 9000\negress:\n  allow: [\"*\"]\n"
+        )))
+        .unwrap_err()
+        .to_string();
+        assert!(err.contains("egress proxy cannot use port 9000"));
+    }
+
+    #[test]
+    fn test_dns_stub() {
+        let egress = "egress:\n  allow: [\"*\"]\n  dns: true\n  tunnels:\n";
+        let tunnel = "    - host: 8.8.8.8\n      port: 53\n      protocol: udp\n";
+
+        // A UDP tunnel on port 53 listens on an address of its own
+        let ports = Registry::from_manifest(&manifest(&format!("{BASE}{egress}{tunnel}")));
+        assert!(ports.is_ok());
+
+        // unless told to share the one of the DNS stub
+        let err = Registry::from_manifest(&manifest(&format!(
+            "{BASE}{egress}{tunnel}      listen_address: 127.0.0.1\n"
+        )))
+        .unwrap_err()
+        .to_string();
+        assert!(err.contains("cannot use UDP port 53, which DNS stub uses"));
+    }
+}
@@ -1,16 +1,23 @@
-use anyhow::{anyhow, Result};
+use std::time::SystemTime;
 
-use http::Uri;
+use anyhow::{anyhow, Error, Result};
+
+use http::{Request, Uri};
+use hyper::body::Bytes;
 use hyper::client::HttpConnector;
+use hyper::Body;
 use hyper_proxy::{Intercept, Proxy, ProxyConnector};
+use log::trace;
 
 use aws_config::imds;
 use aws_config::imds::credentials::ImdsCredentialsProvider;
 use aws_config::imds::region::ImdsRegionProvider;
 use aws_config::provider_config::ProviderConfig;
+use aws_sigv4::http_request::{SignableBody, SignableRequest, SigningSettings};
+use aws_sigv4::SigningParams;
 use aws_smithy_client::{bounds::SmithyConnector, erase::DynConnector, hyper_ext};
 use aws_smithy_http::result::ConnectorError;
-use aws_types::credentials::SharedCredentialsProvider;
+use aws_types::credentials::{Credentials, SharedCredentialsProvider};
 use aws_types::sdk_config::SdkConfig;
 
 const IMDS_URL: &str = "http://169.254.169.254:80/";
@@ -59,3 +66,55 @@ pub async fn load_config_from_imds(imds_client: imds::Client) -> Result<SdkConfi
 
     Ok(config)
 }
+
+// Signs req with SigV4 for service, e.g. kms, in region
+pub fn sign_request(
+    mut req: Request<Bytes>,
+    credentials: &Credentials,
+    region: &str,
+    service: &str,
+) -> Result<Request<Body>> {
+    let signing_settings = SigningSettings::default();
+    let mut signing_builder = SigningParams::builder()
+        .access_key(credentials.access_key_id())
+        .secret_key(credentials.secret_access_key())
+        .region(region)
+        .service_name(service)
+        .time(SystemTime::now())
+        .settings(signing_settings);
+
+    if let Some(ref token) = credentials.session_token() {
+        signing_builder = signing_builder.security_token(token);
+    }
+
+    let signing_params = signing_builder.build()?;
+
+    let signable_request = SignableRequest::new(
+        &req.method(),
+        &req.uri(),
+        &req.headers(),
+        SignableBody::Bytes(&req.body()),
+    );
+
+    // Sign and then apply the signature to the request
+    let signed = aws_sigv4::http_request::sign(signable_request, &signing_params)
+        .map_err(|e| Error::msg(e))?;
+
+    let (signing_instructions, _signature) = signed.into_parts();
+    signing_instructions.apply_to_request(&mut req);
+
+    // Convert Request<Bytes> to Request<Body>
+    let (head, bytes_body) = req.into_parts();
+
+    let req = Request::from_parts(head, Body::from(bytes_body));
+
+    trace!(
+        "Signed request auth: {}",
+        req.headers()
+            .get("authorization")
+            .unwrap()
+            .to_str()
+            .unwrap()
+    );
+    Ok(req)
+}
@@ -0,0 +1,84 @@
+use std::sync::Mutex;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum State {
+    Closed { failures: u32 },
+    Open,
+}
+
+// Fails connections right away while their destination is known to be down,
+// rather than have each of them wait for it through retries of its own. Opens
+// after a number of consecutive failures and closes again on the first
+// success, usually that of a probe.
+pub struct CircuitBreaker {
+    threshold: u32,
+    state: Mutex<State>,
+}
+
+impl CircuitBreaker {
+    pub fn new(threshold: u32) -> Self {
+        Self {
+            threshold: threshold.max(1),
+            state: Mutex::new(State::Closed { failures: 0 }),
+        }
+    }
+
+    pub fn is_open(&self) -> bool {
+        *self.state.lock().unwrap() == State::Open
+    }
+
+    // Whether it was this failure that opened the breaker, in which case the
+    // caller is the one to probe for recovery.
+    pub fn record_failure(&self) -> bool {
+        let mut state = self.state.lock().unwrap();
+        match *state {
+            State::Closed { failures } if failures + 1 >= self.threshold => {
+                *state = State::Open;
+                true
+            }
+            State::Closed { failures } => {
+                *state = State::Closed {
+                    failures: failures + 1,
+                };
+                false
+            }
+            State::Open => false,
+        }
+    }
+
+    // Whether the breaker was open until now
+    pub fn record_success(&self) -> bool {
+        let mut state = self.state.lock().unwrap();
+        let was_open = *state == State::Open;
+        *state = State::Closed { failures: 0 };
+        was_open
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::CircuitBreaker;
+    use assert2::assert;
+
+    #[test]
+    fn test_circuit_breaker() {
+        let breaker = CircuitBreaker::new(3);
+
+        // Failures only count while consecutive
+        assert!(!breaker.record_failure());
+        assert!(!breaker.record_failure());
+        assert!(!breaker.record_success());
+        assert!(!breaker.record_failure());
+        assert!(!breaker.record_failure());
+        assert!(!breaker.is_open());
+
+        // Only the failure that opens it says so
+        assert!(breaker.record_failure());
+        assert!(breaker.is_open());
+        assert!(!breaker.record_failure());
+        assert!(breaker.is_open());
+
+        assert!(breaker.record_success());
+        assert!(!breaker.is_open());
+    }
+}
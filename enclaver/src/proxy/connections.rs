@@ -0,0 +1,166 @@
+use std::future::Future;
+use std::time::Duration;
+
+use log::debug;
+use tokio::sync::mpsc;
+use tokio_util::sync::CancellationToken;
+
+// A handle for spawning connection tasks, cheap to clone into the tasks that
+// spawn others (e.g. a CONNECT request upgrading to a tunnel).
+#[derive(Clone)]
+pub struct Tracker {
+    closing: CancellationToken,
+    // Nothing is ever sent: the channel closes once every clone is dropped
+    done: mpsc::Sender<()>,
+}
+
+impl Tracker {
+    // Serve a connection in a task of its own. The connection is dropped,
+    // closing its sockets, if it is still open once the proxy has stopped
+    // and the drain timeout has passed.
+    pub fn spawn<F>(&self, conn: F)
+    where
+        F: Future<Output = ()> + Send + 'static,
+    {
+        let closing = self.closing.clone();
+        let done = self.done.clone();
+
+        tokio::task::spawn(async move {
+            tokio::select! {
+                _ = conn => {},
+                _ = closing.cancelled() => {},
+            }
+            drop(done);
+        });
+    }
+}
+
+// The connections served by a proxy, so that they can be stopped along with
+// it rather than outliving it in detached tasks.
+pub struct Connections {
+    tracker: Tracker,
+    stopping: CancellationToken,
+    drain: Duration,
+    done: mpsc::Receiver<()>,
+}
+
+impl Connections {
+    // The proxy stops accepting connections once cancelled
+    pub fn new(cancellation: CancellationToken) -> Self {
+        let (tx, rx) = mpsc::channel(1);
+        Self {
+            tracker: Tracker {
+                closing: CancellationToken::new(),
+                done: tx,
+            },
+            stopping: cancellation,
+            drain: Duration::ZERO,
+            done: rx,
+        }
+    }
+
+    // Give the open connections this long to finish on their own once the
+    // proxy has stopped, rather than closing them right away.
+    pub fn with_drain(mut self, drain: Duration) -> Self {
+        self.drain = drain;
+        self
+    }
+
+    pub fn tracker(&self) -> Tracker {
+        self.tracker.clone()
+    }
+
+    pub fn spawn<F>(&self, conn: F)
+    where
+        F: Future<Output = ()> + Send + 'static,
+    {
+        self.tracker.spawn(conn)
+    }
+
+    // Resolves to None if the proxy is cancelled first, e.g. to stop an
+    // accept loop.
+    pub async fn until_cancelled<F: Future>(&self, fut: F) -> Option<F::Output> {
+        tokio::select! {
+            out = fut => Some(out),
+            _ = self.stopping.cancelled() => None,
+        }
+    }
+
+    // Wait for every connection task to finish, closing those still open
+    // after the drain timeout. Meant to be called once the proxy has stopped
+    // accepting connections.
+    pub async fn wait(self) {
+        let Self {
+            tracker,
+            drain,
+            mut done,
+            ..
+        } = self;
+        let closing = tracker.closing.clone();
+        drop(tracker);
+
+        if tokio::time::timeout(drain, done.recv()).await.is_err() {
+            debug!("Closing connections still open after {drain:?}");
+            closing.cancel();
+            _ = done.recv().await;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::Connections;
+    use assert2::assert;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::sync::Arc;
+    use std::time::Duration;
+    use tokio_util::sync::CancellationToken;
+
+    #[tokio::test]
+    async fn test_cancel_and_wait() {
+        let cancellation = CancellationToken::new();
+        let connections = Connections::new(cancellation.clone());
+
+        // A connection that never ends on its own, cleaning up when dropped
+        struct Closed(Arc<AtomicBool>);
+        impl Drop for Closed {
+            fn drop(&mut self) {
+                self.0.store(true, Ordering::SeqCst);
+            }
+        }
+
+        let closed = Arc::new(AtomicBool::new(false));
+        let conn = Closed(closed.clone());
+        connections.tracker().spawn(async move {
+            let _conn = conn;
+            std::future::pending::<()>().await;
+        });
+
+        let accept = connections.until_cancelled(std::future::pending::<()>());
+        cancellation.cancel();
+        assert!(accept.await == None);
+
+        tokio::time::timeout(Duration::from_secs(2), connections.wait())
+            .await
+            .expect("connections were not stopped");
+        assert!(closed.load(Ordering::SeqCst));
+    }
+
+    #[tokio::test]
+    async fn test_drain() {
+        let cancellation = CancellationToken::new();
+        let connections = Connections::new(cancellation.clone()).with_drain(Duration::from_secs(2));
+
+        let finished = Arc::new(AtomicBool::new(false));
+        let conn_finished = finished.clone();
+        connections.spawn(async move {
+            tokio::time::sleep(Duration::from_millis(50)).await;
+            conn_finished.store(true, Ordering::SeqCst);
+        });
+
+        // The connection is left to finish on its own
+        cancellation.cancel();
+        connections.wait().await;
+        assert!(finished.load(Ordering::SeqCst));
+    }
+}
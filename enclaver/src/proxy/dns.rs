@@ -0,0 +1,465 @@
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4};
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{anyhow, Result};
+use bytes::Bytes;
+use futures::{SinkExt, Stream, StreamExt};
+use log::{debug, error, warn};
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio::net::UdpSocket;
+use tokio_util::codec::{Framed, LengthDelimitedCodec};
+
+use crate::policy::EgressPolicy;
+use crate::vsock::{self, Connection, DialOptions};
+
+pub const DNS_PORT: u16 = 53;
+
+const QUERY_TIMEOUT: Duration = Duration::from_secs(5);
+
+// Plenty for UDP DNS, which is limited to 512 bytes without EDNS
+const MAX_MESSAGE_LEN: usize = 4096;
+
+const HEADER_LEN: usize = 12;
+const RCODE_FORMERR: u8 = 1;
+const RCODE_SERVFAIL: u8 = 2;
+const RCODE_REFUSED: u8 = 5;
+
+pub(crate) const TYPE_A: u16 = 1;
+pub(crate) const TYPE_AAAA: u16 = 28;
+const CLASS_IN: u16 = 1;
+
+pub(crate) const RESOLV_CONF: &str = "/etc/resolv.conf";
+
+fn framed<S: AsyncRead + AsyncWrite>(stream: S) -> Framed<S, LengthDelimitedCodec> {
+    LengthDelimitedCodec::builder()
+        .length_field_length(2)
+        .max_frame_length(MAX_MESSAGE_LEN)
+        .new_framed(stream)
+}
+
+// The stub resolver inside the enclave. Every query is passed, as is, to the
+// host over a vsock connection of its own.
+pub struct EnclaveDnsStub {
+    socket: Arc<UdpSocket>,
+}
+
+impl EnclaveDnsStub {
+    pub async fn bind(port: u16) -> Result<Self> {
+        let addr = SocketAddrV4::new(Ipv4Addr::LOCALHOST, port);
+        Ok(Self {
+            socket: Arc::new(UdpSocket::bind(addr).await?),
+        })
+    }
+
+    pub async fn serve(self, dns_port: u32) {
+        let mut buf = vec![0u8; MAX_MESSAGE_LEN];
+
+        loop {
+            let (len, client) = match self.socket.recv_from(&mut buf).await {
+                Ok(res) => res,
+                Err(err) => {
+                    error!("DNS receive failed: {err}");
+                    continue;
+                }
+            };
+
+            let query = Bytes::copy_from_slice(&buf[..len]);
+            let socket = self.socket.clone();
+
+            tokio::task::spawn(async move {
+                if let Err(err) = forward_query(&socket, client, query, dns_port).await {
+                    debug!("DNS query from {client} failed: {err}");
+                }
+            });
+        }
+    }
+}
+
+async fn forward_query(
+    socket: &UdpSocket,
+    client: SocketAddr,
+    query: Bytes,
+    dns_port: u32,
+) -> Result<()> {
+    let resp = tokio::time::timeout(QUERY_TIMEOUT, async {
+        let vsock = vsock::connect(vsock::host_cid(), dns_port, &DialOptions::default()).await?;
+        let mut framed = framed(vsock);
+
+        framed.send(query).await?;
+        match framed.next().await {
+            Some(resp) => Ok(resp?),
+            None => Err(anyhow!("DNS stream closed by the host")),
+        }
+    })
+    .await??;
+
+    socket.send_to(&resp, client).await?;
+    Ok(())
+}
+
+// Point the resolver of the enclave at the stub.
+pub async fn write_resolv_conf() -> Result<()> {
+    tokio::fs::write(RESOLV_CONF, "nameserver 127.0.0.1\n").await?;
+    Ok(())
+}
+
+// The host side. Names are checked against the egress policy before the
+// query is passed on to the resolver of the host, so that the enclave cannot
+// use DNS to look up (or exfiltrate data through) names it may not reach.
+pub struct HostDnsResolver {
+    incoming: Box<dyn Stream<Item = Connection> + Unpin + Send>,
+    egress_policy: Arc<EgressPolicy>,
+    upstream: SocketAddr,
+}
+
+impl HostDnsResolver {
+    pub async fn bind(dns_port: u32, egress_policy: Arc<EgressPolicy>) -> Result<Self> {
+        let conf = tokio::fs::read_to_string(RESOLV_CONF).await?;
+        let upstream = upstream_nameserver(&conf)
+            .ok_or_else(|| anyhow!("no nameserver found in {RESOLV_CONF}"))?;
+
+        Ok(Self {
+            incoming: Box::new(crate::vsock::ListenConfig::new(dns_port).listen()?),
+            egress_policy,
+            upstream,
+        })
+    }
+
+    pub async fn serve(self) {
+        let mut incoming = Box::into_pin(self.incoming);
+
+        while let Some(stream) = incoming.next().await {
+            let egress_policy = self.egress_policy.clone();
+            let upstream = self.upstream;
+
+            tokio::task::spawn(async move {
+                if let Err(err) = resolve(stream, &egress_policy, upstream).await {
+                    debug!("DNS query failed: {err}");
+                }
+            });
+        }
+    }
+}
+
+async fn resolve<S>(stream: S, egress_policy: &EgressPolicy, upstream: SocketAddr) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite + Unpin,
+{
+    let mut framed = framed(stream);
+
+    let query = match framed.next().await {
+        Some(query) => query?,
+        None => return Ok(()),
+    };
+
+    // Only a lone question is checked against the policy, anything after it
+    // would be passed upstream unchecked
+    let qdcount = question_count(&query)?;
+    if qdcount != 1 {
+        warn!("DNS query with {qdcount} questions refused");
+        let resp = error_response(&query, HEADER_LEN, RCODE_FORMERR);
+        framed.send(Bytes::from(resp)).await?;
+        return Ok(());
+    }
+
+    let (name, question_end) = parse_question(&query)?;
+
+    let resp = if egress_policy.is_host_allowed(&name) {
+        match query_upstream(&query, upstream).await {
+            Ok(resp) => resp,
+            Err(err) => {
+                warn!("DNS query for {name} failed: {err}");
+                error_response(&query, question_end, RCODE_SERVFAIL)
+            }
+        }
+    } else {
+        warn!("DNS query for {name} denied by the egress policy");
+        error_response(&query, question_end, RCODE_REFUSED)
+    };
+
+    framed.send(Bytes::from(resp)).await?;
+    Ok(())
+}
+
+pub(crate) async fn query_upstream(query: &[u8], upstream: SocketAddr) -> Result<Vec<u8>> {
+    let local: SocketAddr = match upstream {
+        SocketAddr::V4(_) => "0.0.0.0:0".parse()?,
+        SocketAddr::V6(_) => "[::]:0".parse()?,
+    };
+
+    let socket = UdpSocket::bind(local).await?;
+    socket.connect(upstream).await?;
+    socket.send(query).await?;
+
+    let mut buf = vec![0u8; MAX_MESSAGE_LEN];
+    let len = tokio::time::timeout(QUERY_TIMEOUT, socket.recv(&mut buf)).await??;
+    buf.truncate(len);
+
+    Ok(buf)
+}
+
+pub(crate) fn upstream_nameserver(conf: &str) -> Option<SocketAddr> {
+    conf.lines()
+        .filter_map(|line| line.trim().strip_prefix("nameserver"))
+        .filter_map(|addr| addr.trim().parse::<std::net::IpAddr>().ok())
+        .map(|addr| SocketAddr::new(addr, DNS_PORT))
+        .next()
+}
+
+fn question_count(msg: &[u8]) -> Result<u16> {
+    if msg.len() < HEADER_LEN {
+        return Err(anyhow!("DNS message too short"));
+    }
+
+    Ok(u16::from_be_bytes([msg[4], msg[5]]))
+}
+
+// Returns the name in the one question and the offset just past it.
+fn parse_question(msg: &[u8]) -> Result<(String, usize)> {
+    if question_count(msg)? != 1 {
+        return Err(anyhow!("DNS query without exactly one question"));
+    }
+
+    let mut labels = Vec::new();
+    let mut pos = HEADER_LEN;
+
+    loop {
+        let len = *msg.get(pos).ok_or_else(|| anyhow!("truncated DNS name"))? as usize;
+        pos += 1;
+
+        if len == 0 {
+            break;
+        }
+
+        // Compression pointers have no business being in a query
+        if len & 0xc0 != 0 {
+            return Err(anyhow!("unexpected label type in DNS question"));
+        }
+
+        let label = msg
+            .get(pos..pos + len)
+            .ok_or_else(|| anyhow!("truncated DNS name"))?;
+        labels.push(String::from_utf8_lossy(label).into_owned());
+        pos += len;
+    }
+
+    // QTYPE and QCLASS
+    let end = pos + 4;
+    if msg.len() < end {
+        return Err(anyhow!("truncated DNS question"));
+    }
+
+    Ok((labels.join("."), end))
+}
+
+// A recursive query for the records of the given type
+pub(crate) fn build_query(id: u16, name: &str, qtype: u16) -> Vec<u8> {
+    let mut msg = id.to_be_bytes().to_vec();
+    // RD=1, QDCOUNT=1
+    msg.extend_from_slice(&[0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0]);
+
+    for label in name.trim_end_matches('.').split('.') {
+        msg.push(label.len() as u8);
+        msg.extend_from_slice(label.as_bytes());
+    }
+    msg.push(0);
+
+    msg.extend_from_slice(&qtype.to_be_bytes());
+    msg.extend_from_slice(&CLASS_IN.to_be_bytes());
+    msg
+}
+
+// The A and AAAA records answering a query, along with their TTLs. CNAME
+// records are skipped over, the resolver includes the records they lead to.
+pub(crate) fn parse_addresses(msg: &[u8]) -> Result<Vec<(IpAddr, u32)>> {
+    if msg.len() < HEADER_LEN {
+        return Err(anyhow!("DNS message too short"));
+    }
+
+    let rcode = msg[3] & 0x0f;
+    if rcode != 0 {
+        return Err(anyhow!("DNS query failed with rcode {rcode}"));
+    }
+
+    let qdcount = u16::from_be_bytes([msg[4], msg[5]]);
+    let ancount = u16::from_be_bytes([msg[6], msg[7]]);
+
+    let mut pos = HEADER_LEN;
+    for _ in 0..qdcount {
+        // QTYPE and QCLASS follow the name
+        pos = skip_name(msg, pos)? + 4;
+    }
+
+    let mut addrs = Vec::new();
+    for _ in 0..ancount {
+        pos = skip_name(msg, pos)?;
+
+        let fixed = msg
+            .get(pos..pos + 10)
+            .ok_or_else(|| anyhow!("truncated DNS record"))?;
+        let rtype = u16::from_be_bytes([fixed[0], fixed[1]]);
+        let ttl = u32::from_be_bytes([fixed[4], fixed[5], fixed[6], fixed[7]]);
+        let rdlen = u16::from_be_bytes([fixed[8], fixed[9]]) as usize;
+        pos += 10;
+
+        let rdata = msg
+            .get(pos..pos + rdlen)
+            .ok_or_else(|| anyhow!("truncated DNS record"))?;
+        pos += rdlen;
+
+        match (rtype, rdlen) {
+            (TYPE_A, 4) => {
+                let octets: [u8; 4] = rdata.try_into().unwrap();
+                addrs.push((Ipv4Addr::from(octets).into(), ttl));
+            }
+            (TYPE_AAAA, 16) => {
+                let octets: [u8; 16] = rdata.try_into().unwrap();
+                addrs.push((Ipv6Addr::from(octets).into(), ttl));
+            }
+            _ => {}
+        }
+    }
+
+    Ok(addrs)
+}
+
+// The offset just past a (possibly compressed) name
+fn skip_name(msg: &[u8], mut pos: usize) -> Result<usize> {
+    loop {
+        let len = *msg.get(pos).ok_or_else(|| anyhow!("truncated DNS name"))? as usize;
+        match len {
+            0 => return Ok(pos + 1),
+            // A pointer ends the name
+            len if len & 0xc0 == 0xc0 => return Ok(pos + 2),
+            len => pos += 1 + len,
+        }
+    }
+}
+
+// A response carrying just the question, if it ends past the header, and the
+// given error code.
+fn error_response(query: &[u8], question_end: usize, rcode: u8) -> Vec<u8> {
+    let mut resp = query[..question_end].to_vec();
+
+    // QR=1, keep the opcode and RD bit
+    resp[2] = 0x80 | (query[2] & 0x79);
+    // RA=1
+    resp[3] = 0x80 | rcode;
+
+    // QDCOUNT=1 or 0, no answer, authority or additional records
+    let qdcount = (question_end > HEADER_LEN) as u8;
+    resp[4..HEADER_LEN].copy_from_slice(&[0, qdcount, 0, 0, 0, 0, 0, 0]);
+
+    resp
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{
+        build_query, error_response, framed, parse_addresses, parse_question, resolve,
+        upstream_nameserver, RCODE_FORMERR, RCODE_REFUSED, TYPE_A,
+    };
+    use crate::policy::EgressPolicy;
+    use assert2::assert;
+    use bytes::Bytes;
+    use futures::{SinkExt, StreamExt};
+    use std::net::IpAddr;
+
+    fn query(name: &str) -> Vec<u8> {
+        // ID=0x1234, RD=1, QDCOUNT=1
+        let mut msg = vec![0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0];
+        for label in name.split('.') {
+            msg.push(label.len() as u8);
+            msg.extend_from_slice(label.as_bytes());
+        }
+        msg.push(0);
+        // QTYPE=A, QCLASS=IN
+        msg.extend_from_slice(&[0, 1, 0, 1]);
+        msg
+    }
+
+    #[test]
+    fn test_parse_question() {
+        let msg = query("kms.us-east-1.amazonaws.com");
+        let (name, end) = parse_question(&msg).unwrap();
+        assert!(name == "kms.us-east-1.amazonaws.com");
+        assert!(end == msg.len());
+
+        assert!(parse_question(&msg[..msg.len() - 2]).is_err());
+        assert!(parse_question(&msg[..8]).is_err());
+
+        let mut msg = msg;
+        msg[5] = 2;
+        assert!(parse_question(&msg).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_resolve_many_questions() {
+        // An allowed question, followed by one that is not checked
+        let mut msg = query("allowed.example.com");
+        msg.extend_from_slice(&query("denied.example.com")[12..]);
+        msg[5] = 2;
+
+        let (client, server) = tokio::io::duplex(1024);
+        let policy = EgressPolicy::allow_all();
+        let upstream = "127.0.0.1:53".parse().unwrap();
+        let server_task = tokio::task::spawn(async move {
+            resolve(server, &policy, upstream).await.unwrap();
+        });
+
+        let mut client = framed(client);
+        client.send(Bytes::from(msg)).await.unwrap();
+        let resp = client.next().await.unwrap().unwrap();
+        server_task.await.unwrap();
+
+        assert!(resp[0..2] == [0x12, 0x34]);
+        assert!(resp[3] & 0x0f == RCODE_FORMERR);
+        assert!(resp.len() == 12);
+        assert!(resp[4..6] == [0, 0]);
+    }
+
+    #[test]
+    fn test_error_response() {
+        let msg = query("example.com");
+        let resp = error_response(&msg, msg.len(), RCODE_REFUSED);
+
+        assert!(resp[0..2] == [0x12, 0x34]);
+        assert!(resp[2] == 0x81);
+        assert!(resp[3] & 0x0f == RCODE_REFUSED);
+        assert!(resp[12..] == msg[12..]);
+    }
+
+    #[test]
+    fn test_parse_addresses() {
+        let mut resp = build_query(0x1234, "www.example.com", TYPE_A);
+        assert!(resp == query("www.example.com"));
+
+        // QR=1, RA=1, ANCOUNT=2
+        resp[2] |= 0x80;
+        resp[3] |= 0x80;
+        resp[7] = 2;
+
+        // www.example.com CNAME example.com, with the name as a pointer to
+        // the question
+        resp.extend_from_slice(&[0xc0, 12, 0, 5, 0, 1, 0, 0, 0x0e, 0x10, 0, 2, 0xc0, 16]);
+        // example.com A 93.184.216.34, TTL 300
+        resp.extend_from_slice(&[0xc0, 16, 0, 1, 0, 1, 0, 0, 0x01, 0x2c, 0, 4]);
+        resp.extend_from_slice(&[93, 184, 216, 34]);
+
+        let addrs = parse_addresses(&resp).unwrap();
+        assert!(addrs == vec![("93.184.216.34".parse::<IpAddr>().unwrap(), 300)]);
+
+        assert!(parse_addresses(&resp[..resp.len() - 2]).is_err());
+
+        let refused = error_response(&resp, 33, RCODE_REFUSED);
+        assert!(parse_addresses(&refused).is_err());
+    }
+
+    #[test]
+    fn test_upstream_nameserver() {
+        let conf = "# generated\nsearch ec2.internal\nnameserver 10.0.0.2\nnameserver 10.0.0.3\n";
+        assert!(upstream_nameserver(conf) == Some("10.0.0.2:53".parse().unwrap()));
+        assert!(upstream_nameserver("search foo\n") == None);
+    }
+}
@@ -1,7 +1,7 @@
-use std::net::{Ipv4Addr, SocketAddrV4};
+use std::fmt;
+use std::net::{Ipv4Addr, SocketAddr, SocketAddrV4};
 use std::sync::Arc;
 
-use anyhow::anyhow;
 use async_trait::async_trait;
 use futures::{Stream, StreamExt};
 use http::uri::PathAndQuery;
@@ -9,14 +9,32 @@ use hyper::client::conn::Builder;
 use hyper::header::HeaderValue;
 use hyper::server::conn::Http;
 use hyper::service::service_fn;
-use hyper::{Body, Method, Request, Response};
-use log::{debug, error};
+use hyper::{Body, Method, Request, Response, StatusCode, Version};
+use log::{debug, error, warn};
+use nix::errno::Errno;
 use serde::{de::DeserializeOwned, Deserialize, Serialize};
 use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
 use tokio::net::{TcpListener, TcpStream};
-use tokio_vsock::VsockStream;
-
-use crate::policy::EgressPolicy;
+use tokio_util::sync::CancellationToken;
+
+use crate::access_log::{Entry, Verdict};
+use crate::metrics;
+use crate::policy::limits::{LimitExceeded, Permit};
+use crate::policy::{Denial, EgressPolicy};
+use crate::proxy::connections::{Connections, Tracker};
+use crate::proxy::egress_mux;
+use crate::proxy::middleware::{Chain, Rejection};
+use crate::proxy::mitm::Interceptor;
+use crate::proxy::pump::{self, pump};
+use crate::proxy::resolver::{self, RESOLVER};
+use crate::proxy::sni;
+use crate::proxy::socks5;
+use crate::proxy::upstream;
+use crate::proxy::vsock_pool;
+use crate::vsock::Connection;
+
+const METRICS_LABEL: &str = "egress_http";
+const HOST_METRICS_LABEL: &str = "egress";
 
 #[async_trait]
 trait JsonTransport: Sized + Sync {
@@ -60,30 +78,92 @@ struct ConnectRequest {
 
 impl ConnectRequest {
     fn new(host: String, port: u16) -> Self {
-        Self {
-            host: host,
-            port: port,
-        }
+        Self { host, port }
     }
 }
 
 #[derive(Serialize, Deserialize)]
-enum ConnectResponse {
+pub(crate) enum ConnectResponse {
     Ok,
     Err { os_code: i32, message: String },
+    Denied { reason: String },
 }
 
 impl ConnectResponse {
     fn failed(err: &std::io::Error) -> Self {
+        // Dial timeouts of the host come without an OS error of their own
+        let os_code = match (err.raw_os_error(), err.kind()) {
+            (Some(code), _) => code,
+            (None, std::io::ErrorKind::TimedOut) => Errno::ETIMEDOUT as i32,
+            (None, _) => 0,
+        };
         Self::Err {
-            os_code: err.raw_os_error().unwrap_or(0i32),
+            os_code,
             message: err.to_string(),
         }
     }
+
+    fn limited(exceeded: &LimitExceeded) -> Self {
+        Self::Err {
+            os_code: 0,
+            message: exceeded.to_string(),
+        }
+    }
+
+    fn denied(denial: &Denial) -> Self {
+        Self::Denied {
+            reason: denial.to_string(),
+        }
+    }
+}
+
+// The host side refused to connect due to the egress policy
+#[derive(Debug)]
+pub(crate) struct DeniedByHost(pub String);
+
+impl fmt::Display for DeniedByHost {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.0)
+    }
+}
+
+impl std::error::Error for DeniedByHost {}
+
+// The host failed to connect to the destination
+#[derive(Debug)]
+pub(crate) struct FailedByHost {
+    pub os_code: i32,
+    pub message: String,
+}
+
+impl FailedByHost {
+    fn timed_out(&self) -> bool {
+        self.os_code == Errno::ETIMEDOUT as i32
+    }
+}
+
+impl fmt::Display for FailedByHost {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "os_err: {}: {}", self.os_code, self.message)
+    }
+}
+
+impl std::error::Error for FailedByHost {}
+
+// The body of the responses to requests the proxy could not pass on, for
+// clients to tell the reasons apart
+#[derive(Serialize)]
+struct ErrorBody<'a> {
+    error: &'a str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    destination: Option<&'a str>,
+    message: String,
 }
 
 pub struct EnclaveHttpProxy {
     listener: TcpListener,
+    interceptor: Option<Arc<Interceptor>>,
+    middleware: Arc<Chain>,
 }
 
 impl EnclaveHttpProxy {
@@ -91,17 +171,52 @@ impl EnclaveHttpProxy {
         let addr = SocketAddrV4::new(Ipv4Addr::LOCALHOST, port);
         Ok(Self {
             listener: TcpListener::bind(addr).await?,
+            interceptor: None,
+            middleware: Arc::new(Chain::default()),
         })
     }
 
-    pub async fn serve(self, egress_port: u32, egress_policy: Arc<EgressPolicy>) {
-        loop {
-            match self.listener.accept().await {
-                Ok((sock, _)) => {
-                    let egress_policy = egress_policy.clone();
+    // Terminate TLS in the CONNECT tunnels the policy says to intercept
+    pub fn with_interceptor(mut self, interceptor: Arc<Interceptor>) -> Self {
+        self.interceptor = Some(interceptor);
+        self
+    }
+
+    // Run requests through the chain before proxying them
+    pub fn with_middleware(mut self, middleware: Chain) -> Self {
+        self.middleware = Arc::new(middleware);
+        self
+    }
 
-                    tokio::task::spawn(async move {
-                        EnclaveHttpProxy::service_conn(sock, egress_port, egress_policy).await;
+    // Serve until cancelled, then close the listener and every connection,
+    // including the tunnels of CONNECT requests.
+    pub async fn serve(
+        self,
+        egress_port: u32,
+        egress_policy: Arc<EgressPolicy>,
+        cancellation: CancellationToken,
+    ) {
+        let connections = Connections::new(cancellation).with_drain(egress_policy.timeouts().drain);
+
+        while let Some(res) = connections.until_cancelled(self.listener.accept()).await {
+            match res {
+                Ok((sock, peer)) => {
+                    let egress_policy = egress_policy.clone();
+                    let interceptor = self.interceptor.clone();
+                    let middleware = self.middleware.clone();
+                    let tracker = connections.tracker();
+
+                    connections.spawn(async move {
+                        EnclaveHttpProxy::service_conn(
+                            sock,
+                            peer,
+                            egress_port,
+                            egress_policy,
+                            interceptor,
+                            middleware,
+                            tracker,
+                        )
+                        .await;
                     });
                 }
                 Err(err) => {
@@ -109,12 +224,59 @@ impl EnclaveHttpProxy {
                 }
             }
         }
+
+        drop(self.listener);
+        connections.wait().await;
     }
 
-    async fn service_conn(tcp: TcpStream, egress_port: u32, egress_policy: Arc<EgressPolicy>) {
+    async fn service_conn(
+        tcp: TcpStream,
+        peer: SocketAddr,
+        egress_port: u32,
+        egress_policy: Arc<EgressPolicy>,
+        interceptor: Option<Arc<Interceptor>>,
+        middleware: Arc<Chain>,
+        tracker: Tracker,
+    ) {
+        // SOCKS5 is served on the same port, it is told apart by the first byte
+        let mut first = [0u8; 1];
+        if let Ok(1) = tcp.peek(&mut first).await {
+            if first[0] == socks5::SOCKS_VERSION {
+                if let Err(err) = socks5::serve_conn(
+                    tcp,
+                    peer,
+                    egress_port,
+                    &egress_policy,
+                    interceptor,
+                    &middleware,
+                )
+                .await
+                {
+                    error!("Failed to serve SOCKS5 connection: {err}");
+                }
+                return;
+            }
+        }
+
+        let _conn = metrics::PROXY.connection(METRICS_LABEL);
+
         let svc = service_fn(move |req| {
             let egress_policy = egress_policy.clone();
-            async move { proxy(egress_port, req, &egress_policy).await }
+            let interceptor = interceptor.clone();
+            let middleware = middleware.clone();
+            let tracker = tracker.clone();
+            async move {
+                proxy(
+                    egress_port,
+                    peer,
+                    req,
+                    &egress_policy,
+                    interceptor,
+                    &middleware,
+                    &tracker,
+                )
+                .await
+            }
         });
 
         if let Err(err) = Http::new()
@@ -130,83 +292,202 @@ impl EnclaveHttpProxy {
 }
 
 pub struct HostHttpProxy {
-    incoming: Box<dyn Stream<Item = VsockStream> + Unpin + Send>,
+    incoming: Box<dyn Stream<Item = Connection> + Unpin + Send>,
+    egress_policy: Arc<EgressPolicy>,
 }
 
 impl HostHttpProxy {
-    pub fn bind(egress_port: u32) -> anyhow::Result<Self> {
+    pub fn bind(egress_port: u32, egress_policy: Arc<EgressPolicy>) -> anyhow::Result<Self> {
         Ok(Self {
-            incoming: Box::new(crate::vsock::serve(egress_port)?),
+            incoming: Box::new(crate::vsock::ListenConfig::new(egress_port).listen()?),
+            egress_policy,
         })
     }
 
-    pub async fn serve(self) {
+    pub async fn serve(self, cancellation: CancellationToken) {
         let mut incoming = Box::into_pin(self.incoming);
+        let connections =
+            Connections::new(cancellation).with_drain(self.egress_policy.timeouts().drain);
 
-        while let Some(stream) = incoming.next().await {
-            tokio::task::spawn(async move {
-                if let Err(err) = HostHttpProxy::service_conn(stream).await {
-                    error!("{err}");
+        while let Some(Some(stream)) = connections.until_cancelled(incoming.next()).await {
+            let egress_policy = self.egress_policy.clone();
+            let peer = stream.peer_addr();
+
+            connections.spawn(async move {
+                if let Err(err) = HostHttpProxy::service_conn(stream, &egress_policy).await {
+                    error!("{peer}: {err}");
                 }
             });
         }
-    }
 
-    async fn service_conn(mut vsock: VsockStream) -> anyhow::Result<()> {
-        let conn_req = ConnectRequest::recv(&mut vsock).await?;
+        drop(incoming);
+        connections.wait().await;
+    }
 
-        // A special hostname "host" refers to the localhost on the outside
-        // of the enclave.
-        let host = if conn_req
-            .host
-            .eq_ignore_ascii_case(crate::constants::OUTSIDE_HOST)
-        {
-            "127.0.0.1".to_string()
-        } else {
-            conn_req.host
+    async fn service_conn(
+        mut vsock: Connection,
+        egress_policy: &EgressPolicy,
+    ) -> anyhow::Result<()> {
+        let conn_req = match ConnectRequest::recv(&mut vsock).await {
+            Ok(conn_req) => conn_req,
+            // A pooled connection that was closed without being used
+            Err(err) if is_eof(&err) => return Ok(()),
+            Err(err) => return Err(err),
         };
 
-        match TcpStream::connect((host.as_ref(), conn_req.port)).await {
-            Ok(mut tcp) => {
+        match host_connect(egress_policy, &conn_req.host, conn_req.port).await {
+            Ok((mut tcp, _permit)) => {
+                let _conn = metrics::PROXY.connection(HOST_METRICS_LABEL);
                 ConnectResponse::Ok.send(&mut vsock).await?;
 
                 debug!(
-                    "Connected to {}:{}, starting to proxy bytes",
-                    host, conn_req.port
+                    "Connected {} to {}:{}, starting to proxy bytes",
+                    vsock.peer_addr(),
+                    conn_req.host,
+                    conn_req.port
                 );
-                _ = tokio::io::copy_bidirectional(&mut vsock, &mut tcp).await;
-            }
-            Err(err) => {
-                ConnectResponse::failed(&err).send(&mut vsock).await?;
+                let res = pump(&mut vsock, &mut tcp, egress_policy.timeouts()).await;
+                metrics::PROXY.transferred(HOST_METRICS_LABEL, &res);
             }
+            Err(resp) => resp.send(&mut vsock).await?,
         }
 
         Ok(())
     }
 }
 
+// Connect to a destination on behalf of the enclave, if the policy and limits
+// allow it. Otherwise, the response to send back.
+pub(crate) async fn host_connect(
+    egress_policy: &EgressPolicy,
+    host: &str,
+    port: u16,
+) -> Result<(TcpStream, Permit), ConnectResponse> {
+    // The host itself is never reached through the upstream proxy
+    let upstream = if host.eq_ignore_ascii_case(crate::constants::OUTSIDE_HOST) {
+        None
+    } else {
+        egress_policy.upstream_proxy(host)
+    };
+
+    let addrs = match resolve_destination(egress_policy, host, port).await {
+        Ok(Destination::Allowed(addrs)) => addrs,
+        Ok(Destination::Denied(denial)) => return Err(ConnectResponse::denied(&denial)),
+        // Behind a proxy, the host may well be unable to resolve the names
+        // it can reach. The names are still checked against the policy.
+        Err(err) if upstream.is_some() => {
+            debug!("Failed to resolve {host}, leaving it to the upstream proxy: {err}");
+            Vec::new()
+        }
+        Err(err) => return Err(ConnectResponse::failed(&err)),
+    };
+
+    // The enclave enforces the limits too, but cannot be trusted to
+    let permit = match egress_policy.limits().acquire_connection() {
+        Ok(permit) => permit,
+        Err(exceeded) => {
+            warn!("egress connection refused: {exceeded}");
+            return Err(ConnectResponse::limited(&exceeded));
+        }
+    };
+
+    let destination = format!("{host}:{port}");
+    let dial = pump::dial(egress_policy.timeouts(), async {
+        match upstream {
+            Some(upstream) => upstream::connect(upstream, host, port).await,
+            None => resolver::connect_any(&addrs).await,
+        }
+    });
+    match metrics::PROXY
+        .dial(HOST_METRICS_LABEL, &destination, dial)
+        .await
+    {
+        Ok(tcp) => {
+            if let Err(err) = pump::keepalive(&tcp, egress_policy.timeouts()) {
+                warn!("Failed to enable keepalive to {destination}: {err}");
+            }
+            Ok((tcp, permit))
+        }
+        Err(err) => Err(ConnectResponse::failed(&err)),
+    }
+}
+
+pub(crate) enum Destination {
+    Allowed(Vec<SocketAddr>),
+    Denied(Denial),
+}
+
+// Check a destination requested by the enclave against the policy and resolve
+// it to the addresses that may be connected to. The enclave already enforces
+// the policy but it is cheap to check it again here, and only the host can
+// see what a name resolves to.
+pub(crate) async fn resolve_destination(
+    egress_policy: &EgressPolicy,
+    host: &str,
+    port: u16,
+) -> std::io::Result<Destination> {
+    if let Err(denial) = egress_policy.check(host, port) {
+        warn!("egress denied: {denial}");
+        return Ok(Destination::Denied(denial));
+    }
+
+    // A special hostname "host" refers to the localhost on the outside
+    // of the enclave.
+    let lookup_host = if host.eq_ignore_ascii_case(crate::constants::OUTSIDE_HOST) {
+        "127.0.0.1"
+    } else {
+        host
+    };
+
+    let mut allowed = Vec::new();
+    let mut denial = None;
+    for addr in RESOLVER.lookup(lookup_host).await? {
+        match egress_policy.check_resolved(host, addr, port) {
+            Ok(()) => allowed.push(SocketAddr::new(addr, port)),
+            Err(d) => denial = Some(d),
+        }
+    }
+
+    match denial {
+        Some(denial) if allowed.is_empty() => {
+            warn!("egress denied: {denial}");
+            Ok(Destination::Denied(denial))
+        }
+        _ => Ok(Destination::Allowed(allowed)),
+    }
+}
+
 async fn proxy(
     egress_port: u32,
-    req: Request<Body>,
-    egress_policy: &EgressPolicy,
+    peer: SocketAddr,
+    mut req: Request<Body>,
+    egress_policy: &Arc<EgressPolicy>,
+    interceptor: Option<Arc<Interceptor>>,
+    middleware: &Chain,
+    tracker: &Tracker,
 ) -> Result<Response<Body>, hyper::Error> {
+    let destination = req.uri().authority().map(|authority| authority.to_string());
+    if let Err(rejection) = middleware.handle(&mut req, peer) {
+        return Ok(rejected(rejection, destination.as_deref()));
+    }
+
     if Method::CONNECT == req.method() {
-        Ok(handle_connect(egress_port, req, egress_policy).await)
+        Ok(handle_connect(egress_port, peer, req, egress_policy, interceptor, tracker).await)
     } else {
-        match handle_request(egress_port, req, egress_policy).await {
+        match handle_request(egress_port, peer, req, egress_policy, tracker).await {
             Ok(resp) => Ok(resp),
-            Err(err) => Ok(err_resp(
-                http::StatusCode::SERVICE_UNAVAILABLE,
-                err.to_string(),
-            )),
+            Err(err) => Ok(remote_err_resp(err, destination.as_deref())),
         }
     }
 }
 
 async fn handle_connect(
     egress_port: u32,
+    peer: SocketAddr,
     req: Request<Body>,
-    egress_policy: &EgressPolicy,
+    egress_policy: &Arc<EgressPolicy>,
+    interceptor: Option<Arc<Interceptor>>,
+    tracker: &Tracker,
 ) -> Response<Body> {
     match req.uri().authority() {
         Some(authority) => {
@@ -219,30 +500,86 @@ async fn handle_connect(
                 }
             };
 
+            let mut entry = Entry::new(METRICS_LABEL, Some(peer), authority.as_str());
+
             // Check the policy
-            if !egress_policy.is_host_allowed(authority.host()) {
-                return blocked();
+            if let Err(denial) = egress_policy.check(authority.host(), port) {
+                egress_policy.log_access(entry, Verdict::Denied);
+                return blocked(&denial, authority.as_str());
             }
 
+            let permit = match egress_policy.limits().acquire(peer.ip()) {
+                Ok(permit) => permit,
+                Err(exceeded) => return limited(&exceeded, authority.as_str()),
+            };
+
             debug!("Handling CONNECT to {}:{port}", authority.host());
 
             // Connect to remote server before the upgrade so we can return an error if it fails
-            let mut remote = match remote_connect(egress_port, authority.host(), port).await {
+            let timeouts = egress_policy.timeouts();
+            let dial = pump::dial(
+                timeouts,
+                remote_connect(egress_port, authority.host(), port),
+            );
+            let mut remote = match metrics::PROXY
+                .dial(METRICS_LABEL, authority.as_str(), dial)
+                .await
+            {
                 Ok(remote) => remote,
                 Err(err) => {
-                    return err_resp(http::StatusCode::SERVICE_UNAVAILABLE, err.to_string())
+                    egress_policy.log_access(entry, dial_verdict(&err));
+                    return remote_err_resp(err, Some(authority.as_str()));
                 }
             };
 
-            tokio::task::spawn(async move {
-                match hyper::upgrade::on(req).await {
-                    Ok(mut upgraded) => {
-                        _ = tokio::io::copy_bidirectional(&mut upgraded, &mut remote).await;
+            // The tunnel outlives the request, but not the proxy
+            let egress_policy = egress_policy.clone();
+            let host = authority.host().to_string();
+            tracker.spawn(async move {
+                let _permit = permit;
+
+                // Intercepted tunnels need no server name check, the
+                // certificate they get is only good for the host anyway
+                let interceptor = interceptor.filter(|_| egress_policy.intercepts(&host, port));
+
+                let mut verdict = Verdict::Allowed;
+                match (hyper::upgrade::on(req).await, interceptor) {
+                    (Ok(upgraded), Some(interceptor)) => {
+                        if let Err(err) = interceptor.serve(upgraded, remote, &host, peer).await {
+                            debug!("Intercepted tunnel to {host}:{port} closed: {err}");
+                        }
                     }
-                    Err(err) => {
+                    (Ok(mut upgraded), None) => {
+                        match sni::check_tunnel(
+                            &mut upgraded,
+                            &mut remote,
+                            &host,
+                            port,
+                            &egress_policy,
+                        )
+                        .await
+                        {
+                            Ok(Ok(())) => {
+                                let res =
+                                    pump(&mut upgraded, &mut remote, egress_policy.timeouts())
+                                        .await;
+                                metrics::PROXY.transferred(METRICS_LABEL, &res);
+                                entry.transferred(&res);
+                            }
+                            Ok(Err(denial)) => {
+                                warn!("egress denied: {denial}");
+                                verdict = Verdict::Denied;
+                            }
+                            Err(err) => {
+                                debug!("Tunnel to {host}:{port} closed early: {err}");
+                            }
+                        }
+                    }
+                    (Err(err), _) => {
                         error!("Upgrade failed: {err}");
                     }
                 }
+                egress_policy.log_access(entry, verdict);
             });
 
             Response::new(Body::empty())
@@ -257,8 +594,10 @@ async fn handle_connect(
 
 async fn handle_request(
     egress_port: u32,
+    peer: SocketAddr,
     mut req: Request<Body>,
     egress_policy: &EgressPolicy,
+    tracker: &Tracker,
 ) -> anyhow::Result<Response<Body>> {
     let host = match req.uri().host() {
         Some(host) => host,
@@ -266,71 +605,247 @@ async fn handle_request(
     };
     let port = req.uri().port_u16().unwrap_or(80);
 
+    let destination = format!("{host}:{port}");
+    let entry = Entry::new(METRICS_LABEL, Some(peer), &destination);
+
     // Check the policy
-    if !egress_policy.is_host_allowed(host) {
-        return Ok(blocked());
+    if let Err(denial) = egress_policy.check(host, port) {
+        egress_policy.log_access(entry, Verdict::Denied);
+        return Ok(blocked(&denial, &destination));
     }
 
+    let permit = match egress_policy.limits().acquire(peer.ip()) {
+        Ok(permit) => permit,
+        Err(exceeded) => return Ok(limited(&exceeded, &destination)),
+    };
+
     // TODO: pool connections
-    let stream = remote_connect(egress_port, host, port).await?;
+    let timeouts = *egress_policy.timeouts();
+    let dial = pump::dial(&timeouts, remote_connect(egress_port, host, port));
+    let stream = match metrics::PROXY.dial(METRICS_LABEL, &destination, dial).await {
+        Ok(stream) => stream,
+        Err(err) => {
+            egress_policy.log_access(entry, dial_verdict(&err));
+            return Err(err);
+        }
+    };
+
+    // The bytes of plain requests are not counted, only that they were made
+    egress_policy.log_access(entry, Verdict::Allowed);
+
+    // Requests made over HTTP/2 (h2c with prior knowledge, e.g. by gRPC
+    // clients) are forwarded over HTTP/2 as well, keeping the absolute-form
+    // the :authority is taken from. Bodies are streamed frame by frame, with
+    // their trailers, which HTTP/1.1 would not carry.
+    let http2 = req.version() == Version::HTTP_2;
 
-    // Set the Host: header to match the URL
-    let host_hdr = match req.uri().port() {
-        Some(port) => format!("{host}:{port}"),
-        None => host.to_string(),
+    if !http2 {
+        // Set the Host: header to match the URL
+        let host_hdr = match req.uri().port() {
+            Some(port) => format!("{host}:{port}"),
+            None => host.to_string(),
+        };
+        req.headers_mut()
+            .insert(hyper::header::HOST, HeaderValue::from_str(&host_hdr)?);
+
+        // If a proxy receives an OPTIONS request with an absolute-form of
+        // request-target in which the URI has an empty path and no query
+        // component, then the last proxy on the request chain MUST send a
+        // request-target of "*" when it forwards the request to the indicated
+        // origin server.
+        let pq = if req.method() == Method::OPTIONS && is_empty(req.uri().path_and_query()) {
+            PathAndQuery::from_static("*")
+        } else {
+            // Convert the absolute-form into origin-form
+            match req.uri().path_and_query() {
+                Some(pq) => pq.clone(),
+                None => PathAndQuery::from_static("/"),
+            }
+        };
+
+        *req.uri_mut() = http::Uri::builder().path_and_query(pq).build()?;
+    }
+
+    // Requests to switch protocols (websockets, h2c) are forwarded as they
+    // are. If the server agrees, both connections are handed over to a tunnel.
+    let client_upgrade = if wants_upgrade(&req) {
+        Some(hyper::upgrade::on(&mut req))
+    } else {
+        None
     };
-    req.headers_mut()
-        .insert(hyper::header::HOST, HeaderValue::from_str(&host_hdr)?);
-
-    // If a proxy receives an OPTIONS request with an absolute-form of
-    // request-target in which the URI has an empty path and no query
-    // component, then the last proxy on the request chain MUST send a
-    // request-target of "*" when it forwards the request to the indicated
-    // origin server.
-    let pq = if req.method() == Method::OPTIONS && is_empty(req.uri().path_and_query()) {
-        PathAndQuery::from_static("*")
+
+    let mut builder = Builder::new();
+    if http2 {
+        builder.http2_only(true);
     } else {
-        // Convert the absolute-form into origin-form
-        match req.uri().path_and_query() {
-            Some(pq) => pq.clone(),
-            None => PathAndQuery::from_static("/"),
+        builder
+            .http1_preserve_header_case(true)
+            .http1_title_case_headers(true);
+    }
+    let (mut sender, conn) = builder.handshake(stream).await?;
+
+    // The connection has to be driven in a task of its own according to
+    // the docs, it is tracked so that it does not outlive the proxy. It is
+    // over once upgraded, the tunnel holds on to the permit from there on.
+    let permit = Arc::new(permit);
+    let conn_permit = permit.clone();
+    tracker.spawn(async move {
+        let _permit = conn_permit;
+        match timeouts.max_lifetime {
+            Some(lifetime) => _ = tokio::time::timeout(lifetime, conn).await,
+            None => _ = conn.await,
         }
-    };
+    });
 
-    *req.uri_mut() = http::Uri::builder().path_and_query(pq).build()?;
+    let mut resp = sender.send_request(req).await?;
 
-    let (mut sender, conn) = Builder::new()
-        .http1_preserve_header_case(true)
-        .http1_title_case_headers(true)
-        .handshake(stream)
-        .await?;
+    if let Some(client_upgrade) = client_upgrade {
+        if resp.status() == StatusCode::SWITCHING_PROTOCOLS {
+            let remote_upgrade = hyper::upgrade::on(&mut resp);
 
-    // Spawning detached here is not ideal but the right thing to do
-    // according to the docs
-    tokio::task::spawn(async move {
-        _ = conn.await;
-    });
+            tracker.spawn(async move {
+                let _permit = permit;
+
+                match tokio::try_join!(client_upgrade, remote_upgrade) {
+                    Ok((mut client, mut remote)) => {
+                        debug!("Upgraded connection to {destination}, starting to proxy bytes");
+                        let res = pump(&mut client, &mut remote, &timeouts).await;
+                        metrics::PROXY.transferred(METRICS_LABEL, &res);
+                    }
+                    Err(err) => {
+                        error!("Upgrade failed: {err}");
+                    }
+                }
+            });
+        }
+    }
+
+    Ok(resp)
+}
 
-    Ok(sender.send_request(req).await?)
+// Whether the client asks to switch to another protocol on the connection
+fn wants_upgrade<B>(req: &Request<B>) -> bool {
+    let upgrade_token = req
+        .headers()
+        .get_all(hyper::header::CONNECTION)
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(','))
+        .any(|token| token.trim().eq_ignore_ascii_case("upgrade"));
+
+    upgrade_token && req.headers().contains_key(hyper::header::UPGRADE)
 }
 
-fn err_resp(status: http::StatusCode, msg: String) -> Response<Body> {
-    let mut resp = Response::new(Body::from(msg));
+fn err_resp(
+    status: StatusCode,
+    error: &str,
+    destination: Option<&str>,
+    message: String,
+) -> Response<Body> {
+    let body = ErrorBody {
+        error,
+        destination,
+        message,
+    };
+    let mut body = serde_json::to_vec(&body).unwrap_or_default();
+    body.push(b'\n');
+
+    let mut resp = Response::new(Body::from(body));
     *resp.status_mut() = status;
+    resp.headers_mut().insert(
+        hyper::header::CONTENT_TYPE,
+        HeaderValue::from_static("application/json"),
+    );
     resp
 }
 
 fn bad_request(msg: String) -> Response<Body> {
-    err_resp(http::StatusCode::BAD_REQUEST, msg)
+    err_resp(StatusCode::BAD_REQUEST, "bad_request", None, msg)
 }
 
-fn blocked() -> Response<Body> {
+fn blocked(denial: &Denial, destination: &str) -> Response<Body> {
+    warn!("egress denied: {denial}");
     err_resp(
-        http::StatusCode::UNAUTHORIZED,
-        "blocked by egress security policy".to_string(),
+        StatusCode::FORBIDDEN,
+        "denied",
+        Some(destination),
+        format!("blocked by egress security policy: {denial}"),
     )
 }
 
+fn limited(exceeded: &LimitExceeded, destination: &str) -> Response<Body> {
+    warn!("egress connection refused: {exceeded}");
+    let (status, error) = match exceeded {
+        LimitExceeded::Rate => (StatusCode::TOO_MANY_REQUESTS, "rate_limited"),
+        LimitExceeded::Connections => (StatusCode::SERVICE_UNAVAILABLE, "too_many_connections"),
+    };
+    err_resp(status, error, Some(destination), exceeded.to_string())
+}
+
+fn rejected(rejection: Rejection, destination: Option<&str>) -> Response<Body> {
+    warn!("egress request rejected: {}", rejection.message);
+    let mut resp = err_resp(
+        rejection.status,
+        rejection.error,
+        destination,
+        rejection.message,
+    );
+    if rejection.status == StatusCode::PROXY_AUTHENTICATION_REQUIRED {
+        resp.headers_mut().insert(
+            hyper::header::PROXY_AUTHENTICATE,
+            HeaderValue::from_static("Bearer"),
+        );
+    }
+    resp
+}
+
+// Failing to connect to the destination is told apart from failing to reach
+// the host at all: the former is the destination's fault (or the network's),
+// the latter the proxy's.
+fn remote_err_resp(err: anyhow::Error, destination: Option<&str>) -> Response<Body> {
+    if let Some(DeniedByHost(reason)) = err.downcast_ref::<DeniedByHost>() {
+        return err_resp(
+            StatusCode::FORBIDDEN,
+            "denied",
+            destination,
+            format!("blocked by egress security policy: {reason}"),
+        );
+    }
+
+    let (status, error) = match err.downcast_ref::<FailedByHost>() {
+        Some(failed) if failed.timed_out() => (StatusCode::GATEWAY_TIMEOUT, "timeout"),
+        Some(_) => (StatusCode::BAD_GATEWAY, "connect_failed"),
+        None if is_timeout(&err) => (StatusCode::GATEWAY_TIMEOUT, "timeout"),
+        None if err.is::<hyper::Error>() => (StatusCode::BAD_GATEWAY, "upstream_error"),
+        None => (StatusCode::SERVICE_UNAVAILABLE, "unavailable"),
+    };
+
+    err_resp(status, error, destination, err.to_string())
+}
+
+// Whether a failed remote_connect was refused by the host or just failed
+pub(crate) fn dial_verdict(err: &anyhow::Error) -> Verdict {
+    if err.is::<DeniedByHost>() {
+        Verdict::Denied
+    } else {
+        Verdict::Failed
+    }
+}
+
+fn is_timeout(err: &anyhow::Error) -> bool {
+    match err.downcast_ref::<std::io::Error>() {
+        Some(err) => err.kind() == std::io::ErrorKind::TimedOut,
+        None => false,
+    }
+}
+
+fn is_eof(err: &anyhow::Error) -> bool {
+    match err.downcast_ref::<std::io::Error>() {
+        Some(err) => err.kind() == std::io::ErrorKind::UnexpectedEof,
+        None => false,
+    }
+}
+
 fn is_empty(pq: Option<&PathAndQuery>) -> bool {
     if let Some(pq) = pq {
         if pq.path() != "/" {
@@ -346,13 +861,27 @@ fn is_empty(pq: Option<&PathAndQuery>) -> bool {
     }
 }
 
+// A connection to a remote address made through the host
+pub(crate) trait RemoteStream: AsyncRead + AsyncWrite + Unpin + Send {}
+
+impl<T: AsyncRead + AsyncWrite + Unpin + Send> RemoteStream for T {}
+
 // connects to the host via vsock and then asks it to
 // connect to the remote address
-async fn remote_connect(egress_port: u32, host: &str, port: u16) -> anyhow::Result<VsockStream> {
-    let mut vsock = VsockStream::connect(crate::vsock::VMADDR_CID_HOST, egress_port).await?;
+pub(crate) async fn remote_connect(
+    egress_port: u32,
+    host: &str,
+    port: u16,
+) -> anyhow::Result<Box<dyn RemoteStream>> {
+    // A stream of the shared connection to the host, if there is one
+    if let Some(stream) = egress_mux::connect(egress_port, host, port).await? {
+        return Ok(Box::new(stream));
+    }
+
+    let mut vsock = vsock_pool::connect(egress_port).await?;
     debug!(
         "Connected to vsock {}:{}, sending connect request",
-        crate::vsock::VMADDR_CID_HOST,
+        crate::vsock::host_cid(),
         egress_port
     );
 
@@ -362,8 +891,9 @@ async fn remote_connect(egress_port: u32, host: &str, port: u16) -> anyhow::Resu
     debug!("Sent request to connect to {host}:{port}");
 
     match ConnectResponse::recv(&mut vsock).await? {
-        ConnectResponse::Ok => Ok(vsock),
-        ConnectResponse::Err { os_code, message } => Err(anyhow!("os_err: {os_code}: {message}")),
+        ConnectResponse::Ok => Ok(Box::new(vsock)),
+        ConnectResponse::Err { os_code, message } => Err(FailedByHost { os_code, message }.into()),
+        ConnectResponse::Denied { reason } => Err(DeniedByHost(reason).into()),
     }
 }
 
@@ -371,6 +901,8 @@ async fn remote_connect(egress_port: u32, host: &str, port: u16) -> anyhow::Resu
 mod tests {
     use assert2::assert;
     use http::{uri::PathAndQuery, Method, Version};
+    use hyper::body::HttpBody;
+    use hyper::header::HeaderValue;
     use hyper::server::conn::AddrIncoming;
     use hyper::{Body, Request, Response, Server};
     use rand::RngCore;
@@ -378,8 +910,15 @@ mod tests {
     use std::future::Future;
     use std::net::{Ipv4Addr, SocketAddr};
     use std::sync::Arc;
+    use std::time::Duration;
     use tls_listener::TlsListener;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::TcpStream;
     use tokio::task::JoinHandle;
+    use tokio_util::sync::CancellationToken;
+
+    use crate::manifest::{Egress, EgressLimits};
+    use crate::policy::EgressPolicy;
 
     async fn echo(req: Request<Body>) -> Result<Response<Body>, Infallible> {
         assert!(req.method() == Method::POST);
@@ -421,6 +960,71 @@ mod tests {
         Server::builder(incoming).serve(make_svc)
     }
 
+    // Switches to a protocol that echoes back whatever it is sent
+    async fn upgrade_echo(mut req: Request<Body>) -> Result<Response<Body>, Infallible> {
+        assert!(req.headers()[hyper::header::UPGRADE] == "echo");
+
+        tokio::task::spawn(async move {
+            let mut upgraded = hyper::upgrade::on(&mut req).await.unwrap();
+            let (mut r, mut w) = tokio::io::split(&mut upgraded);
+            _ = tokio::io::copy(&mut r, &mut w).await;
+        });
+
+        let resp = Response::builder()
+            .status(http::StatusCode::SWITCHING_PROTOCOLS)
+            .header(hyper::header::CONNECTION, "upgrade")
+            .header(hyper::header::UPGRADE, "echo")
+            .body(Body::empty())
+            .unwrap();
+        Ok(resp)
+    }
+
+    // Answers with the HTTP version the request came in with
+    async fn version_echo(req: Request<Body>) -> Result<Response<Body>, Infallible> {
+        Ok(Response::new(format!("{:?}", req.version()).into()))
+    }
+
+    // Streams every message back as it arrives and ends with trailers, like a
+    // bidirectional streaming gRPC call
+    async fn grpc_echo(req: Request<Body>) -> Result<Response<Body>, Infallible> {
+        let (mut tx, body) = Body::channel();
+        let mut incoming = req.into_body();
+
+        tokio::task::spawn(async move {
+            while let Some(Ok(msg)) = incoming.data().await {
+                if tx.send_data(msg).await.is_err() {
+                    return;
+                }
+            }
+
+            let mut trailers = http::HeaderMap::new();
+            trailers.insert("grpc-status", HeaderValue::from_static("0"));
+            _ = tx.send_trailers(trailers).await;
+        });
+
+        let resp = Response::builder()
+            .header(hyper::header::CONTENT_TYPE, "application/grpc")
+            .body(body)
+            .unwrap();
+        Ok(resp)
+    }
+
+    fn start_server<F, Fut>(port: u16, http2_only: bool, handler: F) -> JoinHandle<()>
+    where
+        F: Fn(Request<Body>) -> Fut + Copy + Send + Sync + 'static,
+        Fut: Future<Output = Result<Response<Body>, Infallible>> + Send + 'static,
+    {
+        let addr = SocketAddr::from((Ipv4Addr::LOCALHOST, port));
+        let make_svc = hyper::service::make_service_fn(move |_conn| async move {
+            Ok::<_, Infallible>(hyper::service::service_fn(handler))
+        });
+
+        let server = Server::bind(&addr).http2_only(http2_only).serve(make_svc);
+        tokio::task::spawn(async move {
+            _ = server.await;
+        })
+    }
+
     fn start_echo_server(port: u16, use_tls: bool) -> JoinHandle<Result<(), hyper::Error>> {
         if !use_tls {
             tokio::task::spawn(echo_server(port))
@@ -429,23 +1033,29 @@ mod tests {
         }
     }
 
-    async fn start_enclave_proxy(proxy_port: u16, egress_port: u32) -> JoinHandle<()> {
+    async fn start_enclave_proxy(
+        proxy_port: u16,
+        egress_port: u32,
+        policy: Arc<EgressPolicy>,
+        cancellation: CancellationToken,
+    ) -> JoinHandle<()> {
         let proxy = super::EnclaveHttpProxy::bind(proxy_port).await.unwrap();
-        let policy = Arc::new(crate::policy::EgressPolicy::allow_all());
         tokio::task::spawn(async move {
-            proxy.serve(egress_port, policy).await;
+            proxy.serve(egress_port, policy, cancellation).await;
         })
     }
 
-    fn start_host_proxy(egress_port: u32) -> JoinHandle<()> {
-        let proxy = super::HostHttpProxy::bind(egress_port).unwrap();
+    fn start_host_proxy(egress_port: u32, cancellation: CancellationToken) -> JoinHandle<()> {
+        let policy = Arc::new(EgressPolicy::allow_all());
+        let proxy = super::HostHttpProxy::bind(egress_port, policy).unwrap();
         tokio::task::spawn(async move {
-            proxy.serve().await;
+            proxy.serve(cancellation).await;
         })
     }
 
     struct HttpProxyFixture {
         base_port: u16,
+        cancellation: CancellationToken,
         host_proxy_task: JoinHandle<()>,
         enclave_proxy_task: JoinHandle<()>,
         echo_task: JoinHandle<Result<(), hyper::Error>>,
@@ -453,13 +1063,27 @@ mod tests {
 
     impl HttpProxyFixture {
         async fn start(base_port: u16, use_tls: bool) -> Self {
+            Self::start_with_policy(base_port, use_tls, EgressPolicy::allow_all()).await
+        }
+
+        async fn start_with_policy(base_port: u16, use_tls: bool, policy: EgressPolicy) -> Self {
             _ = pretty_env_logger::try_init();
 
+            let policy = Arc::new(policy);
+            let cancellation = CancellationToken::new();
+
             return Self {
                 base_port: base_port,
-                enclave_proxy_task: start_enclave_proxy(base_port, base_port as u32).await,
-                host_proxy_task: start_host_proxy(base_port as u32),
+                enclave_proxy_task: start_enclave_proxy(
+                    base_port,
+                    base_port as u32,
+                    policy,
+                    cancellation.clone(),
+                )
+                .await,
+                host_proxy_task: start_host_proxy(base_port as u32, cancellation.clone()),
                 echo_task: start_echo_server(base_port + 1, use_tls),
+                cancellation,
             };
         }
 
@@ -477,10 +1101,9 @@ mod tests {
             self.echo_task.abort();
             _ = self.echo_task.await;
 
-            self.enclave_proxy_task.abort();
+            // The proxies close their listeners and connections, and return
+            self.cancellation.cancel();
             _ = self.enclave_proxy_task.await;
-
-            self.host_proxy_task.abort();
             _ = self.host_proxy_task.await;
         }
     }
@@ -568,4 +1191,243 @@ mod tests {
 
         fixture.stop().await;
     }
+
+    #[tokio::test]
+    async fn test_http_proxy_upgrade() {
+        let fixture = HttpProxyFixture::start(5200, false).await;
+        let server = start_server(5202, false, upgrade_echo);
+
+        let mut client = TcpStream::connect(("127.0.0.1", 5200)).await.unwrap();
+        client
+            .write_all(
+                b"GET http://localhost:5202/ HTTP/1.1\r\n\
+                Host: localhost:5202\r\n\
+                Connection: upgrade\r\n\
+                Upgrade: echo\r\n\r\n",
+            )
+            .await
+            .unwrap();
+
+        let mut head = Vec::new();
+        while !head.ends_with(b"\r\n\r\n") {
+            head.push(client.read_u8().await.unwrap());
+        }
+        assert!(head.starts_with(b"HTTP/1.1 101"));
+
+        // The connection is a tunnel to the server from here on
+        client.write_all(b"ping").await.unwrap();
+        let mut buf = [0u8; 4];
+        client.read_exact(&mut buf).await.unwrap();
+        assert!(&buf == b"ping");
+
+        server.abort();
+        fixture.stop().await;
+    }
+
+    #[tokio::test]
+    async fn test_http_proxy_h2c() {
+        let fixture = HttpProxyFixture::start(5300, false).await;
+        let server = start_server(5302, true, version_echo);
+
+        // HTTP/2 with prior knowledge, to the proxy itself
+        let tcp = TcpStream::connect(("127.0.0.1", 5300)).await.unwrap();
+        let (mut sender, conn) = hyper::client::conn::Builder::new()
+            .http2_only(true)
+            .handshake::<_, Body>(tcp)
+            .await
+            .unwrap();
+        tokio::task::spawn(conn);
+
+        let req = Request::builder()
+            .uri("http://localhost:5302/version")
+            .version(Version::HTTP_2)
+            .body(Body::empty())
+            .unwrap();
+        let resp = sender.send_request(req).await.unwrap();
+        assert!(resp.status() == hyper::StatusCode::OK);
+
+        // and it is passed on as HTTP/2
+        let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+        assert!(&body[..] == b"HTTP/2.0");
+
+        server.abort();
+        fixture.stop().await;
+    }
+
+    #[tokio::test]
+    async fn test_http_proxy_grpc_streaming() {
+        let fixture = HttpProxyFixture::start(5400, false).await;
+        let server = start_server(5402, true, grpc_echo);
+
+        let tcp = TcpStream::connect(("127.0.0.1", 5400)).await.unwrap();
+        let (mut sender, conn) = hyper::client::conn::Builder::new()
+            .http2_only(true)
+            .handshake(tcp)
+            .await
+            .unwrap();
+        tokio::task::spawn(conn);
+
+        let (mut tx, body) = Body::channel();
+        let req = Request::builder()
+            .method(Method::POST)
+            .uri("http://localhost:5402/echo.Echo/Stream")
+            .version(Version::HTTP_2)
+            .header(hyper::header::TE, "trailers")
+            .body(body)
+            .unwrap();
+        let resp = sender.send_request(req).await.unwrap();
+        let mut resp_body = resp.into_body();
+
+        // Each message makes it through before the next one is sent, so
+        // nothing is held back in either direction
+        for msg in ["one", "two", "three"] {
+            tx.send_data(msg.into()).await.unwrap();
+
+            let echoed = tokio::time::timeout(Duration::from_secs(5), resp_body.data())
+                .await
+                .expect("message was buffered")
+                .unwrap()
+                .unwrap();
+            assert!(&echoed[..] == msg.as_bytes());
+        }
+        drop(tx);
+
+        assert!(resp_body.data().await.is_none());
+        let trailers = resp_body.trailers().await.unwrap().unwrap();
+        assert!(trailers["grpc-status"] == "0");
+
+        server.abort();
+        fixture.stop().await;
+    }
+
+    #[tokio::test]
+    async fn test_http_proxy_denied() {
+        let policy = EgressPolicy::new(&Egress {
+            allow: Some(vec!["localhost:5002".to_string()]),
+            ..Default::default()
+        });
+        let fixture = HttpProxyFixture::start_with_policy(5000, false, policy).await;
+
+        let client = reqwest::Client::builder()
+            .proxy(reqwest::Proxy::http(fixture.proxy_uri().to_string()).unwrap())
+            .build()
+            .unwrap();
+
+        // The host is allowed, but not on the port the web server is on
+        let resp = client
+            .post(format!(
+                "http://localhost:{}/echo",
+                fixture.webserver_port()
+            ))
+            .body("hello")
+            .send()
+            .await
+            .unwrap();
+
+        assert!(resp.status() == reqwest::StatusCode::FORBIDDEN);
+        let body = resp.text().await.unwrap();
+        assert!(body.contains("port 5001 is not allowed for localhost"));
+
+        fixture.stop().await;
+    }
+
+    #[tokio::test]
+    async fn test_http_proxy_rate_limited() {
+        let policy = EgressPolicy::new(&Egress {
+            allow: Some(vec!["localhost".to_string()]),
+            limits: Some(EgressLimits {
+                max_connections: None,
+                connections_per_second: Some(1),
+                burst: Some(1),
+            }),
+            ..Default::default()
+        });
+        let fixture = HttpProxyFixture::start_with_policy(5100, false, policy).await;
+
+        let client = reqwest::Client::builder()
+            .proxy(reqwest::Proxy::http(fixture.proxy_uri().to_string()).unwrap())
+            .build()
+            .unwrap();
+
+        let url = format!("http://localhost:{}/echo", fixture.webserver_port());
+
+        let resp = client.post(&url).body("hello").send().await.unwrap();
+        assert!(resp.status() == reqwest::StatusCode::OK);
+
+        // The bucket only holds one token and refills once a second
+        let resp = client.post(&url).body("hello").send().await.unwrap();
+        assert!(resp.status() == reqwest::StatusCode::TOO_MANY_REQUESTS);
+
+        fixture.stop().await;
+    }
+
+    async fn error_body(resp: Response<Body>) -> serde_json::Value {
+        assert!(resp.headers()["content-type"] == "application/json");
+        let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+        serde_json::from_slice(&body).unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_remote_err_resp() {
+        let timed_out = std::io::Error::new(std::io::ErrorKind::TimedOut, "connect timed out");
+        let resp = super::remote_err_resp(timed_out.into(), Some("example.com:443"));
+        assert!(resp.status() == hyper::StatusCode::GATEWAY_TIMEOUT);
+        let body = error_body(resp).await;
+        assert!(body["error"] == "timeout");
+        assert!(body["destination"] == "example.com:443");
+
+        let refused = super::FailedByHost {
+            os_code: 111,
+            message: "Connection refused (os error 111)".to_string(),
+        };
+        let resp = super::remote_err_resp(refused.into(), Some("example.com:443"));
+        assert!(resp.status() == hyper::StatusCode::BAD_GATEWAY);
+        assert!(error_body(resp).await["error"] == "connect_failed");
+
+        let timed_out = super::FailedByHost {
+            os_code: nix::errno::Errno::ETIMEDOUT as i32,
+            message: "connect timed out after 30s".to_string(),
+        };
+        let resp = super::remote_err_resp(timed_out.into(), None);
+        assert!(resp.status() == hyper::StatusCode::GATEWAY_TIMEOUT);
+
+        let denied = super::DeniedByHost("10.0.0.1 is denied".to_string());
+        let resp = super::remote_err_resp(denied.into(), Some("10.0.0.1:80"));
+        assert!(resp.status() == hyper::StatusCode::FORBIDDEN);
+        let body = error_body(resp).await;
+        assert!(body["error"] == "denied");
+        assert!(body["destination"] == "10.0.0.1:80");
+
+        // The enclave could not reach the host at all
+        let unreachable = std::io::Error::from(std::io::ErrorKind::ConnectionReset);
+        let resp = super::remote_err_resp(unreachable.into(), None);
+        assert!(resp.status() == hyper::StatusCode::SERVICE_UNAVAILABLE);
+        let body = error_body(resp).await;
+        assert!(body["error"] == "unavailable");
+        assert!(body.get("destination").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_http_proxy_connect_failed() {
+        let fixture = HttpProxyFixture::start(5500, false).await;
+
+        let client = reqwest::Client::builder()
+            .proxy(reqwest::Proxy::http(fixture.proxy_uri().to_string()).unwrap())
+            .build()
+            .unwrap();
+
+        // Nothing listens there, the host is refused
+        let resp = client
+            .get("http://localhost:5509/echo")
+            .send()
+            .await
+            .unwrap();
+
+        assert!(resp.status() == reqwest::StatusCode::BAD_GATEWAY);
+        let body: serde_json::Value = serde_json::from_str(&resp.text().await.unwrap()).unwrap();
+        assert!(body["error"] == "connect_failed");
+        assert!(body["destination"] == "localhost:5509");
+
+        fixture.stop().await;
+    }
 }
@@ -0,0 +1,334 @@
+use std::collections::HashMap;
+use std::convert::Infallible;
+use std::sync::{Arc, Mutex};
+
+use anyhow::anyhow;
+use futures::future::poll_fn;
+use futures::{Stream, StreamExt};
+use hyper::client::conn::{Builder, SendRequest};
+use hyper::server::conn::Http;
+use hyper::service::service_fn;
+use hyper::upgrade::Upgraded;
+use hyper::{Body, Method, Request, Response, StatusCode};
+use lazy_static::lazy_static;
+use log::{debug, error, warn};
+use nix::errno::Errno;
+use tokio_util::sync::CancellationToken;
+
+use crate::metrics;
+use crate::policy::limits::Timeouts;
+use crate::policy::EgressPolicy;
+use crate::proxy::connections::{Connections, Tracker};
+use crate::proxy::egress_http::{host_connect, ConnectResponse, DeniedByHost, FailedByHost};
+use crate::proxy::pump::pump;
+use crate::vsock::{self, Connection, DialOptions};
+
+const METRICS_LABEL: &str = "egress_mux";
+
+// Egress connections can share a single vsock connection to the host, as
+// HTTP/2 CONNECT streams, rather than each opening one of their own.
+
+lazy_static! {
+    // By the vsock port connections would be made to otherwise
+    static ref MUXES: Mutex<HashMap<u32, Arc<Mux>>> = Mutex::new(HashMap::new());
+}
+
+// From now on, open streams on a connection to the host on mux_port instead
+// of connecting to egress_port.
+pub fn enable(egress_port: u32, mux_port: u32) {
+    let mux = Mux {
+        port: mux_port,
+        conn: tokio::sync::Mutex::new(None),
+    };
+    MUXES.lock().unwrap().insert(egress_port, Arc::new(mux));
+}
+
+pub fn disable(egress_port: u32) {
+    MUXES.lock().unwrap().remove(&egress_port);
+}
+
+// A stream to the destination, through the host. None if multiplexing is not
+// enabled, or there is no connection to the host to be had, in which case the
+// caller makes a connection of its own.
+pub(crate) async fn connect(
+    egress_port: u32,
+    host: &str,
+    port: u16,
+) -> anyhow::Result<Option<Upgraded>> {
+    let mux = MUXES.lock().unwrap().get(&egress_port).cloned();
+    match mux {
+        Some(mux) => mux.connect(host, port).await,
+        None => Ok(None),
+    }
+}
+
+struct Mux {
+    port: u32,
+    // Set up when first needed, and again once lost
+    conn: tokio::sync::Mutex<Option<SendRequest<Body>>>,
+}
+
+impl Mux {
+    async fn connect(&self, host: &str, port: u16) -> anyhow::Result<Option<Upgraded>> {
+        // IPv6 addresses need brackets to be told apart from the port,
+        // unless they already have them
+        let authority = if host.contains(':') && !host.starts_with('[') {
+            format!("[{host}]:{port}")
+        } else {
+            format!("{host}:{port}")
+        };
+
+        let req = Request::builder()
+            .method(Method::CONNECT)
+            .uri(authority)
+            .body(Body::empty())?;
+
+        let resp = {
+            let mut conn = self.conn.lock().await;
+
+            let ready = match *conn {
+                Some(ref mut sender) => poll_fn(|cx| sender.poll_ready(cx)).await.is_ok(),
+                None => false,
+            };
+            if !ready {
+                match self.handshake().await {
+                    Ok(sender) => *conn = Some(sender),
+                    Err(err) => {
+                        warn!("No shared vsock connection to the host, connecting directly: {err}");
+                        *conn = None;
+                        return Ok(None);
+                    }
+                }
+            }
+
+            conn.as_mut().unwrap().send_request(req)
+        };
+
+        let resp = resp.await?;
+        match resp.status() {
+            StatusCode::OK => Ok(Some(hyper::upgrade::on(resp).await?)),
+            StatusCode::FORBIDDEN => Err(DeniedByHost(body_text(resp).await).into()),
+            StatusCode::GATEWAY_TIMEOUT => Err(FailedByHost {
+                os_code: Errno::ETIMEDOUT as i32,
+                message: body_text(resp).await,
+            }
+            .into()),
+            StatusCode::BAD_GATEWAY => Err(FailedByHost {
+                os_code: 0,
+                message: body_text(resp).await,
+            }
+            .into()),
+            _ => Err(anyhow!(body_text(resp).await)),
+        }
+    }
+
+    async fn handshake(&self) -> anyhow::Result<SendRequest<Body>> {
+        let opts = DialOptions::default().with_timeout(Timeouts::default().dial);
+        let vsock = vsock::connect(vsock::host_cid(), self.port, &opts).await?;
+        let (sender, conn) = Builder::new()
+            .http2_only(true)
+            .http2_adaptive_window(true)
+            .handshake(vsock)
+            .await?;
+
+        tokio::task::spawn(async move {
+            if let Err(err) = conn.await {
+                warn!("Shared vsock connection to the host failed: {err}");
+            }
+        });
+
+        debug!("Opened shared vsock connection to the host");
+        Ok(sender)
+    }
+}
+
+async fn body_text(resp: Response<Body>) -> String {
+    match hyper::body::to_bytes(resp.into_body()).await {
+        Ok(body) => String::from_utf8_lossy(&body).into_owned(),
+        Err(err) => err.to_string(),
+    }
+}
+
+// The host side of shared connections. Each CONNECT stream is handled the
+// same way as a connection to HostHttpProxy.
+pub struct HostMuxProxy {
+    incoming: Box<dyn Stream<Item = Connection> + Unpin + Send>,
+    egress_policy: Arc<EgressPolicy>,
+}
+
+impl HostMuxProxy {
+    pub fn bind(port: u32, egress_policy: Arc<EgressPolicy>) -> anyhow::Result<Self> {
+        Ok(Self {
+            incoming: Box::new(crate::vsock::ListenConfig::new(port).listen()?),
+            egress_policy,
+        })
+    }
+
+    pub async fn serve(self, cancellation: CancellationToken) {
+        let mut incoming = Box::into_pin(self.incoming);
+        let connections =
+            Connections::new(cancellation).with_drain(self.egress_policy.timeouts().drain);
+
+        while let Some(Some(stream)) = connections.until_cancelled(incoming.next()).await {
+            let egress_policy = self.egress_policy.clone();
+            let tracker = connections.tracker();
+
+            connections.spawn(async move {
+                let svc = service_fn(move |req| {
+                    let egress_policy = egress_policy.clone();
+                    let tracker = tracker.clone();
+                    async move {
+                        Ok::<_, Infallible>(handle_stream(req, egress_policy, &tracker).await)
+                    }
+                });
+
+                if let Err(err) = Http::new()
+                    .http2_only(true)
+                    .http2_adaptive_window(true)
+                    .serve_connection(stream, svc)
+                    .await
+                {
+                    error!("Failed to serve shared vsock connection: {err}");
+                }
+            });
+        }
+
+        drop(incoming);
+        connections.wait().await;
+    }
+}
+
+async fn handle_stream(
+    req: Request<Body>,
+    egress_policy: Arc<EgressPolicy>,
+    tracker: &Tracker,
+) -> Response<Body> {
+    let authority = match req.uri().authority() {
+        Some(authority) if req.method() == Method::CONNECT => authority.clone(),
+        _ => return respond(StatusCode::BAD_REQUEST, "expected CONNECT".to_string()),
+    };
+    let port = match authority.port_u16() {
+        Some(port) => port,
+        None => return respond(StatusCode::BAD_REQUEST, "missing port".to_string()),
+    };
+    let host = authority
+        .host()
+        .trim_start_matches('[')
+        .trim_end_matches(']');
+
+    let (mut tcp, permit) = match host_connect(&egress_policy, host, port).await {
+        Ok(connected) => connected,
+        Err(ConnectResponse::Denied { reason }) => return respond(StatusCode::FORBIDDEN, reason),
+        Err(ConnectResponse::Err { os_code, message }) => {
+            let status = if os_code == Errno::ETIMEDOUT as i32 {
+                StatusCode::GATEWAY_TIMEOUT
+            } else {
+                StatusCode::BAD_GATEWAY
+            };
+            return respond(status, message);
+        }
+        Err(ConnectResponse::Ok) => unreachable!(),
+    };
+
+    debug!("Connected to {authority}, starting to proxy bytes");
+    tracker.spawn(async move {
+        let _permit = permit;
+        let _conn = metrics::PROXY.connection(METRICS_LABEL);
+
+        match hyper::upgrade::on(req).await {
+            Ok(mut upgraded) => {
+                let res = pump(&mut upgraded, &mut tcp, egress_policy.timeouts()).await;
+                metrics::PROXY.transferred(METRICS_LABEL, &res);
+            }
+            Err(err) => error!("Upgrade failed: {err}"),
+        }
+    });
+
+    Response::new(Body::empty())
+}
+
+fn respond(status: StatusCode, msg: String) -> Response<Body> {
+    let mut resp = Response::new(Body::from(msg));
+    *resp.status_mut() = status;
+    resp
+}
+
+#[cfg(test)]
+mod tests {
+    use super::HostMuxProxy;
+    use crate::manifest::Egress;
+    use crate::policy::EgressPolicy;
+    use crate::proxy::egress_http::{dial_verdict, remote_connect};
+    use assert2::assert;
+    use std::sync::Arc;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::TcpListener;
+    use tokio_util::sync::CancellationToken;
+
+    #[tokio::test]
+    async fn test_mux() {
+        let egress_port = 17911;
+        let mux_port = 17910;
+        let policy = EgressPolicy::new(&Egress {
+            allow: Some(vec!["127.0.0.1:6001".to_string(), "[::1]:6003".to_string()]),
+            ..Default::default()
+        });
+
+        let cancellation = CancellationToken::new();
+        let proxy = HostMuxProxy::bind(mux_port, Arc::new(policy)).unwrap();
+        let proxy_task = tokio::task::spawn(proxy.serve(cancellation.clone()));
+
+        let echo = |listener: TcpListener| async move {
+            loop {
+                let (mut sock, _) = listener.accept().await.unwrap();
+                tokio::task::spawn(async move {
+                    let (mut r, mut w) = sock.split();
+                    _ = tokio::io::copy(&mut r, &mut w).await;
+                });
+            }
+        };
+        let listener = TcpListener::bind("127.0.0.1:6001").await.unwrap();
+        let echo_task = tokio::task::spawn(echo(listener));
+        let listener = TcpListener::bind("[::1]:6003").await.unwrap();
+        let echo6_task = tokio::task::spawn(echo(listener));
+
+        super::enable(egress_port, mux_port);
+
+        // Concurrent streams share the one vsock connection
+        let mut a = remote_connect(egress_port, "127.0.0.1", 6001)
+            .await
+            .unwrap();
+        let mut b = remote_connect(egress_port, "127.0.0.1", 6001)
+            .await
+            .unwrap();
+        for (stream, msg) in [(&mut a, b"one"), (&mut b, b"two")] {
+            stream.write_all(msg).await.unwrap();
+            let mut buf = [0u8; 3];
+            stream.read_exact(&mut buf).await.unwrap();
+            assert!(&buf == msg);
+        }
+
+        // IPv6 addresses, with or without brackets
+        for host in ["::1", "[::1]"] {
+            let mut stream = remote_connect(egress_port, host, 6003).await.unwrap();
+            stream.write_all(b"six").await.unwrap();
+            let mut buf = [0u8; 3];
+            stream.read_exact(&mut buf).await.unwrap();
+            assert!(&buf == b"six");
+        }
+
+        // and the host still enforces the policy
+        let err = remote_connect(egress_port, "127.0.0.1", 6002)
+            .await
+            .err()
+            .unwrap();
+        assert!(let crate::access_log::Verdict::Denied = dial_verdict(&err));
+
+        super::disable(egress_port);
+        cancellation.cancel();
+        drop((a, b));
+        _ = proxy_task.await;
+        echo_task.abort();
+        echo6_task.abort();
+    }
+}
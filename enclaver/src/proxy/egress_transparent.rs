@@ -0,0 +1,296 @@
+use std::net::{Ipv4Addr, SocketAddr, SocketAddrV4};
+use std::os::unix::io::AsRawFd;
+use std::sync::Arc;
+
+use anyhow::Result;
+use log::{debug, error, warn};
+use nix::sys::socket::{getsockopt, sockopt::OriginalDst};
+use tokio::net::{TcpListener, TcpStream};
+use tokio_util::sync::CancellationToken;
+
+use crate::access_log::{Entry, Verdict};
+use crate::metrics;
+use crate::policy::EgressPolicy;
+use crate::proxy::connections::Connections;
+use crate::proxy::egress_http::{dial_verdict, remote_connect};
+use crate::proxy::pump::{self, pump};
+use crate::proxy::sni;
+
+const METRICS_LABEL: &str = "egress_transparent";
+
+// The enclave side of transparent egress. Outbound TCP connections get
+// redirected here by the netfilter rules set up by odyn. The original
+// destination is recovered with SO_ORIGINAL_DST and the connection is
+// tunneled to the host the same way a CONNECT request is.
+pub struct EnclaveTransparentProxy {
+    listener: TcpListener,
+}
+
+impl EnclaveTransparentProxy {
+    pub async fn bind(port: u16) -> Result<Self> {
+        let addr = SocketAddrV4::new(Ipv4Addr::LOCALHOST, port);
+        Ok(Self {
+            listener: TcpListener::bind(addr).await?,
+        })
+    }
+
+    pub async fn serve(
+        self,
+        egress_port: u32,
+        egress_policy: Arc<EgressPolicy>,
+        cancellation: CancellationToken,
+    ) {
+        let connections = Connections::new(cancellation).with_drain(egress_policy.timeouts().drain);
+
+        while let Some(res) = connections.until_cancelled(self.listener.accept()).await {
+            match res {
+                Ok((sock, _)) => {
+                    let egress_policy = egress_policy.clone();
+
+                    connections.spawn(async move {
+                        if let Err(err) = service_conn(sock, egress_port, &egress_policy).await {
+                            debug!("transparent egress connection failed: {err}");
+                        }
+                    });
+                }
+                Err(err) => {
+                    error!("Accept failed: {err}");
+                }
+            }
+        }
+
+        drop(self.listener);
+        connections.wait().await;
+    }
+}
+
+async fn service_conn(
+    tcp: TcpStream,
+    egress_port: u32,
+    egress_policy: &EgressPolicy,
+) -> Result<()> {
+    let _conn = metrics::PROXY.connection(METRICS_LABEL);
+
+    let dest = original_dst(&tcp)?;
+    let mut entry = Entry::new(METRICS_LABEL, tcp.peer_addr().ok(), &dest.to_string());
+
+    let (verdict, res) = tunnel(tcp, dest, egress_port, egress_policy, &mut entry).await;
+    egress_policy.log_access(entry, verdict);
+
+    res
+}
+
+// Tunnel the connection to its original destination, if the policy allows
+// it, and tell the access log how that went.
+async fn tunnel(
+    mut tcp: TcpStream,
+    dest: SocketAddr,
+    egress_port: u32,
+    egress_policy: &EgressPolicy,
+    entry: &mut Entry,
+) -> (Verdict, Result<()>) {
+    let host = dest.ip().to_string();
+
+    // Only the address is known here, so only address based rules can match
+    if let Err(denial) = egress_policy.check(&host, dest.port()) {
+        warn!("egress denied: {denial}");
+        return (Verdict::Denied, Ok(()));
+    }
+
+    debug!("Tunneling connection to {dest}");
+
+    let timeouts = egress_policy.timeouts();
+    let dial = pump::dial(timeouts, remote_connect(egress_port, &host, dest.port()));
+    let mut remote = match metrics::PROXY
+        .dial(METRICS_LABEL, &dest.to_string(), dial)
+        .await
+    {
+        Ok(remote) => remote,
+        Err(err) => return (dial_verdict(&err), Err(err)),
+    };
+
+    // Whatever name a TLS client asks for has to be allowed too
+    match sni::check_tunnel(&mut tcp, &mut remote, &host, dest.port(), egress_policy).await {
+        Ok(Ok(())) => {
+            let res = pump(&mut tcp, &mut remote, timeouts).await;
+            metrics::PROXY.transferred(METRICS_LABEL, &res);
+            entry.transferred(&res);
+        }
+        Ok(Err(denial)) => {
+            warn!("egress denied: {denial}");
+            return (Verdict::Denied, Ok(()));
+        }
+        Err(err) => debug!("Tunnel to {dest} closed early: {err}"),
+    }
+
+    (Verdict::Allowed, Ok(()))
+}
+
+fn original_dst(tcp: &TcpStream) -> Result<SocketAddr> {
+    let sa = getsockopt(tcp.as_raw_fd(), OriginalDst)?;
+
+    // sockaddr_in is in network byte order
+    let addr = Ipv4Addr::from(u32::from_be(sa.sin_addr.s_addr));
+    let port = u16::from_be(sa.sin_port);
+
+    Ok(SocketAddr::V4(SocketAddrV4::new(addr, port)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{tunnel, METRICS_LABEL};
+    use crate::access_log::{Entry, Verdict};
+    use crate::manifest::Egress;
+    use crate::policy::EgressPolicy;
+    use crate::proxy::egress_http::HostHttpProxy;
+    use assert2::assert;
+    use std::convert::TryFrom;
+    use std::net::SocketAddr;
+    use std::sync::Arc;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::{TcpListener, TcpStream};
+    use tokio::task::JoinHandle;
+    use tokio_util::sync::CancellationToken;
+
+    // Both ends of a connection, the one the app made and the one accepted
+    async fn redirected() -> (TcpStream, TcpStream) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let app = TcpStream::connect(listener.local_addr().unwrap())
+            .await
+            .unwrap();
+        let (accepted, _) = listener.accept().await.unwrap();
+        (app, accepted)
+    }
+
+    // The verdict on a connection the app sends the given bytes over, and
+    // what it gets back
+    async fn tunnel_to(
+        dest: SocketAddr,
+        egress_port: u32,
+        policy: &EgressPolicy,
+        sent: &[u8],
+    ) -> (Verdict, Vec<u8>) {
+        let (mut app, accepted) = redirected().await;
+        let mut entry = Entry::new(METRICS_LABEL, None, &dest.to_string());
+
+        let sent = sent.to_vec();
+        let app_task = tokio::task::spawn(async move {
+            _ = app.write_all(&sent).await;
+            _ = app.shutdown().await;
+            let mut buf = Vec::new();
+            _ = app.read_to_end(&mut buf).await;
+            buf
+        });
+
+        let (verdict, _) = tunnel(accepted, dest, egress_port, policy, &mut entry).await;
+        (verdict, app_task.await.unwrap())
+    }
+
+    async fn echo_server(addr: &str) -> JoinHandle<()> {
+        let listener = TcpListener::bind(addr).await.unwrap();
+        tokio::task::spawn(async move {
+            loop {
+                let (mut sock, _) = listener.accept().await.unwrap();
+                tokio::task::spawn(async move {
+                    let (mut r, mut w) = sock.split();
+                    _ = tokio::io::copy(&mut r, &mut w).await;
+                });
+            }
+        })
+    }
+
+    fn start_host_proxy(egress_port: u32, cancellation: CancellationToken) -> JoinHandle<()> {
+        let policy = Arc::new(EgressPolicy::allow_all());
+        let proxy = HostHttpProxy::bind(egress_port, policy).unwrap();
+        tokio::task::spawn(proxy.serve(cancellation))
+    }
+
+    // A real ClientHello, as rustls sends it
+    fn client_hello(server_name: &str) -> Vec<u8> {
+        let config = rustls::ClientConfig::builder()
+            .with_safe_defaults()
+            .with_root_certificates(rustls::RootCertStore::empty())
+            .with_no_client_auth();
+        let name = rustls::ServerName::try_from(server_name).unwrap();
+        let mut conn = rustls::ClientConnection::new(Arc::new(config), name).unwrap();
+
+        let mut hello = Vec::new();
+        conn.write_tls(&mut hello).unwrap();
+        hello
+    }
+
+    #[tokio::test]
+    async fn test_denied() {
+        let policy = EgressPolicy::new(&Egress {
+            allow: Some(vec!["10.0.0.0/8:443".to_string()]),
+            ..Default::default()
+        });
+
+        // Refused before dialing the host, where nothing listens
+        for dest in ["192.168.1.1:443", "10.1.2.3:80"] {
+            let (verdict, received) =
+                tunnel_to(dest.parse().unwrap(), 5800, &policy, b"ping").await;
+            assert!(verdict == Verdict::Denied);
+            assert!(received.is_empty());
+        }
+    }
+
+    #[tokio::test]
+    async fn test_dial_failed() {
+        let policy = EgressPolicy::allow_all();
+        let dest = "127.0.0.1:5811".parse().unwrap();
+        let (verdict, received) = tunnel_to(dest, 5810, &policy, b"ping").await;
+        assert!(verdict == Verdict::Failed);
+        assert!(received.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_allowed() {
+        let echo_task = echo_server("127.0.0.1:5821").await;
+        let cancellation = CancellationToken::new();
+        let host_task = start_host_proxy(5820, cancellation.clone());
+
+        let policy = EgressPolicy::allow_all();
+        let dest = "127.0.0.1:5821".parse().unwrap();
+        let (verdict, received) = tunnel_to(dest, 5820, &policy, b"ping").await;
+        assert!(verdict == Verdict::Allowed);
+        assert!(received == b"ping");
+
+        echo_task.abort();
+        cancellation.cancel();
+        _ = host_task.await;
+    }
+
+    #[tokio::test]
+    async fn test_server_name_enforced() {
+        let echo_task = echo_server("127.0.0.1:5831").await;
+        let cancellation = CancellationToken::new();
+        let host_task = start_host_proxy(5830, cancellation.clone());
+
+        let policy = EgressPolicy::new(&Egress {
+            allow: Some(vec![
+                "127.0.0.1:5831".to_string(),
+                "example.com".to_string(),
+            ]),
+            enforce_sni: Some(true),
+            ..Default::default()
+        });
+        let dest = "127.0.0.1:5831".parse().unwrap();
+
+        let hello = client_hello("example.com");
+        let (verdict, received) = tunnel_to(dest, 5830, &policy, &hello).await;
+        assert!(verdict == Verdict::Allowed);
+        assert!(received == hello);
+
+        // Only the address is allowed, not any name a client asks for there
+        let hello = client_hello("evil.com");
+        let (verdict, received) = tunnel_to(dest, 5830, &policy, &hello).await;
+        assert!(verdict == Verdict::Denied);
+        // a TLS alert
+        assert!(received.first() == Some(&0x15));
+
+        echo_task.abort();
+        cancellation.cancel();
+        _ = host_task.await;
+    }
+}
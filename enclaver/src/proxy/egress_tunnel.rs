@@ -0,0 +1,100 @@
+use std::net::SocketAddrV4;
+use std::sync::Arc;
+
+use anyhow::Result;
+use log::{debug, error};
+use tokio::net::{TcpListener, TcpStream};
+use tokio_util::sync::CancellationToken;
+
+use crate::access_log::{Entry, Verdict};
+use crate::metrics;
+use crate::policy::EgressPolicy;
+use crate::proxy::connections::Connections;
+use crate::proxy::egress_http::{dial_verdict, remote_connect};
+use crate::proxy::pump::{self, pump};
+
+const METRICS_LABEL: &str = "egress_tunnel";
+
+// A fixed destination reachable from inside the enclave without any proxy
+// support in the app: every connection accepted on the local address is
+// tunneled to the host, which connects it to the destination.
+pub struct EnclaveTunnel {
+    listener: TcpListener,
+    host: String,
+    port: u16,
+}
+
+impl EnclaveTunnel {
+    pub async fn bind(addr: SocketAddrV4, host: String, port: u16) -> Result<Self> {
+        Ok(Self {
+            listener: TcpListener::bind(addr).await?,
+            host,
+            port,
+        })
+    }
+
+    pub async fn serve(
+        self,
+        egress_port: u32,
+        egress_policy: Arc<EgressPolicy>,
+        cancellation: CancellationToken,
+    ) {
+        let connections = Connections::new(cancellation).with_drain(egress_policy.timeouts().drain);
+
+        while let Some(res) = connections.until_cancelled(self.listener.accept()).await {
+            match res {
+                Ok((sock, _)) => {
+                    let host = self.host.clone();
+                    let port = self.port;
+                    let egress_policy = egress_policy.clone();
+
+                    connections.spawn(async move {
+                        if let Err(err) =
+                            service_conn(sock, egress_port, &egress_policy, &host, port).await
+                        {
+                            error!("Tunnel to {host}:{port} failed: {err}");
+                        }
+                    });
+                }
+                Err(err) => {
+                    error!("Accept failed: {err}");
+                }
+            }
+        }
+
+        drop(self.listener);
+        connections.wait().await;
+    }
+}
+
+async fn service_conn(
+    mut tcp: TcpStream,
+    egress_port: u32,
+    egress_policy: &EgressPolicy,
+    host: &str,
+    port: u16,
+) -> Result<()> {
+    let _conn = metrics::PROXY.connection(METRICS_LABEL);
+
+    let destination = format!("{host}:{port}");
+    let mut entry = Entry::new(METRICS_LABEL, tcp.peer_addr().ok(), &destination);
+
+    let timeouts = egress_policy.timeouts();
+    let dial = pump::dial(timeouts, remote_connect(egress_port, host, port));
+    let mut remote = match metrics::PROXY.dial(METRICS_LABEL, &destination, dial).await {
+        Ok(remote) => remote,
+        Err(err) => {
+            egress_policy.log_access(entry, dial_verdict(&err));
+            return Err(err);
+        }
+    };
+
+    debug!("Tunneling connection to {destination}");
+    let res = pump(&mut tcp, &mut remote, timeouts).await;
+    metrics::PROXY.transferred(METRICS_LABEL, &res);
+
+    entry.transferred(&res);
+    egress_policy.log_access(entry, Verdict::Allowed);
+
+    Ok(())
+}
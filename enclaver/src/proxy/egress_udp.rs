@@ -0,0 +1,346 @@
+use std::collections::HashMap;
+use std::net::{Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4};
+use std::sync::Arc;
+use std::time::Duration;
+
+use anyhow::{anyhow, Result};
+use bytes::Bytes;
+use futures::{SinkExt, Stream, StreamExt};
+use log::{debug, error};
+use serde::{Deserialize, Serialize};
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio::net::UdpSocket;
+use tokio::sync::mpsc;
+use tokio_util::codec::{Framed, LengthDelimitedCodec};
+
+use crate::policy::limits::Timeouts;
+use crate::policy::EgressPolicy;
+use crate::proxy::egress_http::{resolve_destination, Destination};
+use crate::vsock::datagram::{framed, MAX_DATAGRAM_LEN};
+use crate::vsock::{self, Connection, DialOptions};
+
+// Flows without traffic in either direction for this long are torn down
+const FLOW_IDLE_TIMEOUT: Duration = Duration::from_secs(60);
+
+// Datagrams queued per flow while it is being set up (or the vsock is slow).
+// UDP may drop packets so the overflow is simply dropped.
+const FLOW_QUEUE_LEN: usize = 64;
+
+// Each flow is carried over a vsock stream of its own. The first frame is an
+// OpenRequest (JSON) answered by an OpenResponse, every frame after that is
+// a datagram, framed as by vsock::datagram.
+#[derive(Serialize, Deserialize)]
+struct OpenRequest {
+    host: String,
+    port: u16,
+}
+
+#[derive(Serialize, Deserialize)]
+enum OpenResponse {
+    Ok,
+    Denied { reason: String },
+    Err { message: String },
+}
+
+async fn send_json<S, M>(framed: &mut Framed<S, LengthDelimitedCodec>, msg: &M) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite + Unpin,
+    M: Serialize,
+{
+    framed.send(Bytes::from(serde_json::to_vec(msg)?)).await?;
+    Ok(())
+}
+
+async fn recv_json<S, M>(framed: &mut Framed<S, LengthDelimitedCodec>) -> Result<M>
+where
+    S: AsyncRead + AsyncWrite + Unpin,
+    M: serde::de::DeserializeOwned,
+{
+    match framed.next().await {
+        Some(frame) => Ok(serde_json::from_slice(&frame?)?),
+        None => Err(anyhow!("UDP relay stream closed")),
+    }
+}
+
+// The enclave side of the relay. Datagrams received on the local socket are
+// relayed to a fixed destination, with a flow per client address so that the
+// replies can be sent back to the right client.
+pub struct EnclaveUdpRelay {
+    socket: Arc<UdpSocket>,
+    host: String,
+    port: u16,
+}
+
+impl EnclaveUdpRelay {
+    pub async fn bind(addr: SocketAddrV4, host: String, port: u16) -> Result<Self> {
+        Ok(Self {
+            socket: Arc::new(UdpSocket::bind(addr).await?),
+            host,
+            port,
+        })
+    }
+
+    pub async fn serve(self, egress_port: u32) {
+        let mut flows: HashMap<SocketAddr, mpsc::Sender<Bytes>> = HashMap::new();
+        let mut buf = vec![0u8; MAX_DATAGRAM_LEN];
+
+        loop {
+            let (len, client) = match self.socket.recv_from(&mut buf).await {
+                Ok(res) => res,
+                Err(err) => {
+                    error!("UDP receive failed: {err}");
+                    continue;
+                }
+            };
+
+            let datagram = Bytes::copy_from_slice(&buf[..len]);
+
+            if let Some(tx) = flows.get(&client) {
+                if !tx.is_closed() {
+                    // Dropped if the flow is backed up
+                    _ = tx.try_send(datagram);
+                    continue;
+                }
+            }
+
+            // Forget about expired flows before adding a new one
+            flows.retain(|_, tx| !tx.is_closed());
+
+            let (tx, rx) = mpsc::channel(FLOW_QUEUE_LEN);
+            _ = tx.try_send(datagram);
+            flows.insert(client, tx);
+
+            let socket = self.socket.clone();
+            let host = self.host.clone();
+            let port = self.port;
+
+            tokio::task::spawn(async move {
+                if let Err(err) = run_flow(socket, client, rx, egress_port, &host, port).await {
+                    debug!("UDP flow from {client} to {host}:{port} failed: {err}");
+                }
+            });
+        }
+    }
+}
+
+async fn run_flow(
+    socket: Arc<UdpSocket>,
+    client: SocketAddr,
+    mut rx: mpsc::Receiver<Bytes>,
+    egress_port: u32,
+    host: &str,
+    port: u16,
+) -> Result<()> {
+    let opts = DialOptions::default().with_timeout(Timeouts::default().dial);
+    let vsock = vsock::connect(vsock::host_cid(), egress_port, &opts).await?;
+    let mut framed = framed(vsock);
+
+    send_json(
+        &mut framed,
+        &OpenRequest {
+            host: host.to_string(),
+            port,
+        },
+    )
+    .await?;
+
+    match recv_json(&mut framed).await? {
+        OpenResponse::Ok => {}
+        OpenResponse::Denied { reason } => return Err(anyhow!("{reason}")),
+        OpenResponse::Err { message } => return Err(anyhow!("{message}")),
+    }
+
+    debug!("UDP flow from {client} to {host}:{port} established");
+
+    loop {
+        let res = tokio::time::timeout(FLOW_IDLE_TIMEOUT, async {
+            tokio::select! {
+                datagram = rx.recv() => match datagram {
+                    Some(datagram) => {
+                        framed.send(datagram).await?;
+                        Ok::<_, anyhow::Error>(true)
+                    }
+                    None => Ok(false),
+                },
+                frame = framed.next() => match frame {
+                    Some(frame) => {
+                        socket.send_to(&frame?, client).await?;
+                        Ok(true)
+                    }
+                    None => Ok(false),
+                },
+            }
+        })
+        .await;
+
+        match res {
+            Ok(Ok(true)) => continue,
+            Ok(Ok(false)) => return Ok(()),
+            Ok(Err(err)) => return Err(err),
+            Err(_) => {
+                debug!("UDP flow from {client} to {host}:{port} expired");
+                return Ok(());
+            }
+        }
+    }
+}
+
+// The host side of the relay. Each incoming stream is a flow that gets a
+// UDP socket of its own, connected to the requested destination.
+pub struct HostUdpRelay {
+    incoming: Box<dyn Stream<Item = Connection> + Unpin + Send>,
+    egress_policy: Arc<EgressPolicy>,
+}
+
+impl HostUdpRelay {
+    pub fn bind(egress_port: u32, egress_policy: Arc<EgressPolicy>) -> Result<Self> {
+        Ok(Self {
+            incoming: Box::new(crate::vsock::ListenConfig::new(egress_port).listen()?),
+            egress_policy,
+        })
+    }
+
+    pub async fn serve(self) {
+        let mut incoming = Box::into_pin(self.incoming);
+
+        while let Some(stream) = incoming.next().await {
+            let egress_policy = self.egress_policy.clone();
+            let peer = stream.peer_addr();
+
+            tokio::task::spawn(async move {
+                if let Err(err) = HostUdpRelay::service_conn(stream, &egress_policy).await {
+                    debug!("UDP relay flow from {peer} failed: {err}");
+                }
+            });
+        }
+    }
+
+    async fn service_conn<S>(stream: S, egress_policy: &EgressPolicy) -> Result<()>
+    where
+        S: AsyncRead + AsyncWrite + Unpin,
+    {
+        let mut framed = framed(stream);
+        let req: OpenRequest = recv_json(&mut framed).await?;
+
+        let addrs = match resolve_destination(egress_policy, &req.host, req.port).await {
+            Ok(Destination::Allowed(addrs)) => addrs,
+            Ok(Destination::Denied(denial)) => {
+                let reason = denial.to_string();
+                return send_json(&mut framed, &OpenResponse::Denied { reason }).await;
+            }
+            Err(err) => {
+                let message = err.to_string();
+                return send_json(&mut framed, &OpenResponse::Err { message }).await;
+            }
+        };
+
+        let socket = match connect_udp(&addrs).await {
+            Ok(socket) => socket,
+            Err(err) => {
+                let message = err.to_string();
+                return send_json(&mut framed, &OpenResponse::Err { message }).await;
+            }
+        };
+
+        send_json(&mut framed, &OpenResponse::Ok).await?;
+        debug!("Relaying UDP to {}:{}", req.host, req.port);
+
+        let mut buf = vec![0u8; MAX_DATAGRAM_LEN];
+
+        loop {
+            let res = tokio::time::timeout(FLOW_IDLE_TIMEOUT, async {
+                tokio::select! {
+                    frame = framed.next() => match frame {
+                        Some(frame) => {
+                            socket.send(&frame?).await?;
+                            Ok(true)
+                        }
+                        None => Ok(false),
+                    },
+                    len = socket.recv(&mut buf) => {
+                        let len = len?;
+                        framed.send(Bytes::copy_from_slice(&buf[..len])).await?;
+                        Ok::<_, anyhow::Error>(true)
+                    },
+                }
+            })
+            .await;
+
+            match res {
+                Ok(Ok(true)) => continue,
+                Ok(Ok(false)) | Err(_) => return Ok(()),
+                Ok(Err(err)) => return Err(err),
+            }
+        }
+    }
+}
+
+async fn connect_udp(addrs: &[SocketAddr]) -> Result<UdpSocket> {
+    let addr = addrs
+        .first()
+        .ok_or_else(|| anyhow!("destination did not resolve to any addresses"))?;
+
+    let local: SocketAddr = match addr {
+        SocketAddr::V4(_) => (Ipv4Addr::UNSPECIFIED, 0).into(),
+        SocketAddr::V6(_) => (Ipv6Addr::UNSPECIFIED, 0).into(),
+    };
+
+    let socket = UdpSocket::bind(local).await?;
+    socket.connect(*addr).await?;
+    Ok(socket)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{framed, recv_json, send_json, HostUdpRelay, OpenRequest, OpenResponse};
+    use crate::policy::EgressPolicy;
+    use assert2::assert;
+    use bytes::Bytes;
+    use futures::{SinkExt, StreamExt};
+    use tokio::net::UdpSocket;
+
+    #[tokio::test]
+    async fn test_host_relay() {
+        let echo = UdpSocket::bind("127.0.0.1:0").await.unwrap();
+        let echo_port = echo.local_addr().unwrap().port();
+        let echo_task = tokio::task::spawn(async move {
+            let mut buf = [0u8; 1024];
+            loop {
+                let (len, peer) = echo.recv_from(&mut buf).await.unwrap();
+                echo.send_to(&buf[..len], peer).await.unwrap();
+            }
+        });
+
+        let (client, server) = tokio::io::duplex(4096);
+        let relay_task = tokio::task::spawn(async move {
+            let policy = EgressPolicy::allow_all();
+            HostUdpRelay::service_conn(server, &policy).await
+        });
+
+        let mut client = framed(client);
+        send_json(
+            &mut client,
+            &OpenRequest {
+                host: "127.0.0.1".to_string(),
+                port: echo_port,
+            },
+        )
+        .await
+        .unwrap();
+
+        let resp: OpenResponse = recv_json(&mut client).await.unwrap();
+        assert!(let OpenResponse::Ok = resp);
+
+        for msg in ["one", "two", "three"] {
+            client.send(Bytes::from(msg)).await.unwrap();
+            let reply = client.next().await.unwrap().unwrap();
+            assert!(&reply[..] == msg.as_bytes());
+        }
+
+        drop(client);
+        relay_task.await.unwrap().unwrap();
+
+        echo_task.abort();
+        _ = echo_task.await;
+    }
+}
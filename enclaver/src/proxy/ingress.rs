@@ -1,70 +1,203 @@
-use std::net::{Ipv4Addr, SocketAddrV4};
+use std::future::Future;
+use std::io;
+use std::net::{Ipv4Addr, SocketAddr, SocketAddrV4};
+use std::os::unix::fs::FileTypeExt;
+use std::path::{Path, PathBuf};
 use std::sync::Arc;
+use std::time::Duration;
 
-use crate::vsock;
-use anyhow::Result;
+use crate::vsock::{self, Connection};
+use anyhow::{anyhow, Result};
 use futures::{Stream, StreamExt};
-use log::{debug, error};
+use log::{debug, error, info, warn};
 use rustls::ServerConfig;
-use tokio::io::{AsyncRead, AsyncWrite};
-use tokio::net::{TcpListener, TcpStream};
-use tokio_vsock::VsockStream;
-
-use crate::vsock::TlsServerStream;
+use tokio::io::{AsyncRead, AsyncWrite, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream, UnixListener, UnixStream};
+use tokio::sync::Semaphore;
+use tokio_rustls::TlsAcceptor;
+use tokio_util::sync::CancellationToken;
+
+use crate::access_log::{AccessLog, Entry, Verdict};
+use crate::metrics;
+use crate::policy::limits::Timeouts;
+use crate::proxy::breaker::CircuitBreaker;
+use crate::proxy::connections::Connections;
+use crate::proxy::proxy_protocol::ProxyHeader;
+use crate::proxy::pump::{self, pump};
+
+const METRICS_LABEL: &str = "ingress";
+
+// The enclave may still be booting (or restarting) when the first clients
+// show up, so connecting to it is retried a few times before giving up.
+const VSOCK_DIAL_ATTEMPTS: u32 = 5;
+const VSOCK_DIAL_INITIAL_BACKOFF: Duration = Duration::from_millis(100);
+const VSOCK_DIAL_MAX_BACKOFF: Duration = Duration::from_secs(2);
+
+// Connections that fail to reach the enclave, retries and all, before new
+// ones are turned away until it is reachable again
+const BREAKER_THRESHOLD: u32 = 3;
+
+// How often the enclave is checked for once it is down
+const PROBE_INTERVAL: Duration = Duration::from_secs(1);
+
+// Connections accepted from the host and yet to be served, per port, beyond
+// which more are closed right away
+pub const DEFAULT_BACKLOG: usize = 128;
 
 // The enclave side of the proxy. Listens on a vsock and
 // connects over the localhost to the app. The connection
 // over vsock is over the TLS. EnclaveProxy terminates the
 // TLS and connects out to the app over plain TCP.
-pub struct EnclaveProxy<S> {
-    incoming: Box<dyn Stream<Item = S> + Send>,
+pub struct EnclaveProxy {
+    incoming: Box<dyn Stream<Item = Connection> + Unpin + Send>,
+    tls: Option<TlsAcceptor>,
     port: u16,
+    timeouts: Timeouts,
+    proxy_protocol: bool,
+    max_connections: Option<Arc<Semaphore>>,
 }
 
-impl EnclaveProxy<VsockStream> {
-    pub fn bind(port: u16) -> Result<EnclaveProxy<VsockStream>> {
-        let incoming = vsock::serve(port as u32)?;
+impl EnclaveProxy {
+    pub fn bind(port: u16, backlog: usize) -> Result<Self> {
+        let incoming = vsock::ListenConfig::new(port as u32)
+            .with_backlog(backlog)
+            .listen()?;
         Ok(Self {
             incoming: Box::new(incoming),
+            tls: None,
             port,
+            timeouts: Timeouts::default(),
+            proxy_protocol: false,
+            max_connections: None,
         })
     }
-}
 
-impl EnclaveProxy<TlsServerStream> {
-    pub fn bind_tls(
-        port: u16,
-        tls_config: Arc<ServerConfig>,
-    ) -> Result<EnclaveProxy<TlsServerStream>> {
-        let incoming = vsock::tls_serve(port as u32, tls_config)?;
-        Ok(Self {
-            incoming: Box::new(incoming),
-            port,
-        })
+    // The TLS handshake is done by the connection task, once the PROXY
+    // protocol header (if any) that precedes it has been read.
+    pub fn bind_tls(port: u16, backlog: usize, tls_config: Arc<ServerConfig>) -> Result<Self> {
+        let mut proxy = Self::bind(port, backlog)?;
+        proxy.tls = Some(TlsAcceptor::from(tls_config));
+        Ok(proxy)
     }
-}
 
-impl<S> EnclaveProxy<S>
-where
-    S: AsyncRead + AsyncWrite + Unpin + Send + 'static,
-{
-    pub async fn serve(self) {
+    pub fn with_timeouts(mut self, timeouts: Timeouts) -> Self {
+        self.timeouts = timeouts;
+        self
+    }
+
+    // Expect a PROXY protocol header from the host side and pass it on to
+    // the app.
+    pub fn with_proxy_protocol(mut self, enabled: bool) -> Self {
+        self.proxy_protocol = enabled;
+        self
+    }
+
+    // Serve at most max connections at a time. Those over are left in the
+    // backlog, until it overflows.
+    pub fn with_max_connections(mut self, max: Option<usize>) -> Self {
+        self.max_connections = max.map(|max| Arc::new(Semaphore::new(max.max(1))));
+        self
+    }
+
+    // Serve until cancelled, then close the listener and every connection.
+    pub async fn serve(self, cancellation: CancellationToken) {
         let addr = SocketAddrV4::new(Ipv4Addr::LOCALHOST, self.port);
+        let timeouts = self.timeouts;
+        let proxy_protocol = self.proxy_protocol;
         let mut incoming = Box::into_pin(self.incoming);
-
-        while let Some(stream) = incoming.next().await {
-            tokio::task::spawn(async move {
-                EnclaveProxy::service_conn(stream, addr).await;
+        let connections = Connections::new(cancellation).with_drain(timeouts.drain);
+
+        loop {
+            let permit = match self.max_connections {
+                Some(ref max) => {
+                    let acquire = max.clone().acquire_owned();
+                    match connections.until_cancelled(acquire).await {
+                        Some(Ok(permit)) => Some(permit),
+                        _ => break,
+                    }
+                }
+                None => None,
+            };
+
+            let vsock = match connections.until_cancelled(incoming.next()).await {
+                Some(Some(vsock)) => vsock,
+                _ => break,
+            };
+            let tls = self.tls.clone();
+
+            connections.spawn(async move {
+                EnclaveProxy::service_conn(vsock, tls, addr, &timeouts, proxy_protocol).await;
+                drop(permit);
             });
         }
+
+        drop(incoming);
+        connections.wait().await;
     }
 
-    async fn service_conn(mut vsock: S, target: SocketAddrV4) {
+    async fn service_conn(
+        mut vsock: Connection,
+        tls: Option<TlsAcceptor>,
+        target: SocketAddrV4,
+        timeouts: &Timeouts,
+        proxy_protocol: bool,
+    ) {
+        let _conn = metrics::PROXY.connection(METRICS_LABEL);
+
+        // The host side sends the header ahead of anything else, TLS included
+        let header = if proxy_protocol {
+            match ProxyHeader::read(&mut vsock).await {
+                Ok(header) => header,
+                Err(err) => {
+                    error!("Failed to read the PROXY protocol header: {err}");
+                    return;
+                }
+            }
+        } else {
+            None
+        };
+
+        match tls {
+            Some(acceptor) => match acceptor.accept(vsock).await {
+                Ok(stream) => {
+                    EnclaveProxy::forward(stream, target, timeouts, proxy_protocol, header).await
+                }
+                Err(err) => error!("TLS handshake failed: {err}"),
+            },
+            None => EnclaveProxy::forward(vsock, target, timeouts, proxy_protocol, header).await,
+        }
+    }
+
+    async fn forward<S: AsyncRead + AsyncWrite + Unpin>(
+        mut stream: S,
+        target: SocketAddrV4,
+        timeouts: &Timeouts,
+        proxy_protocol: bool,
+        header: Option<ProxyHeader>,
+    ) {
         debug!("Connecting to {target}");
-        match TcpStream::connect(&target).await {
+        let dial = pump::dial(timeouts, TcpStream::connect(&target));
+        match metrics::PROXY
+            .dial(METRICS_LABEL, &target.to_string(), dial)
+            .await
+        {
             Ok(mut tcp) => {
+                // An app expecting the header wants one on every connection,
+                // even if there are no addresses to pass on
+                if proxy_protocol {
+                    let encoded = match header {
+                        Some(header) => header.encode(),
+                        None => ProxyHeader::encode_local(),
+                    };
+                    if let Err(err) = tcp.write_all(&encoded).await {
+                        error!("Failed to send the PROXY protocol header to {target}: {err}");
+                        return;
+                    }
+                }
+
                 debug!("Connected to {target}, proxying data");
-                _ = tokio::io::copy_bidirectional(&mut vsock, &mut tcp).await;
+                let res = pump(&mut stream, &mut tcp, timeouts).await;
+                metrics::PROXY.transferred(METRICS_LABEL, &res);
             }
             Err(err) => error!("Connection to upstream ({target}) failed: {err}"),
         }
@@ -72,38 +205,319 @@ where
 }
 
 // The host side of the proxy. Listens on the localhost and connects
-// out to the vsock. The proxied connection will be over TLS but HostProxy
-// just proxies raw bytes (no TLS termination)
+// out to the vsock. The proxied connection will usually be over TLS,
+// terminated inside the enclave, in which case HostProxy just proxies
+// raw bytes. It can also terminate TLS itself and pass on plaintext.
 pub struct HostProxy {
-    listener: TcpListener,
+    listener: Listener,
+    tls: Option<TlsAcceptor>,
+    access_log: Option<Arc<AccessLog>>,
+    timeouts: Timeouts,
+    proxy_protocol: bool,
 }
 
 impl HostProxy {
+    // Listens on all interfaces
     pub async fn bind(port: u16) -> Result<Self> {
         let addr = SocketAddrV4::new(Ipv4Addr::UNSPECIFIED, port);
-        Ok(Self {
-            listener: TcpListener::bind(addr).await?,
-        })
+        HostProxy::bind_addr(addr.into()).await
     }
 
-    pub async fn serve(self, target_cid: u32, target_port: u32) {
-        while let Ok((sock, _)) = self.listener.accept().await {
-            // TODO: don't use detached tasks
-            tokio::task::spawn(async move {
-                _ = HostProxy::service_conn(sock, target_cid, target_port).await;
-            });
+    pub async fn bind_addr(addr: SocketAddr) -> Result<Self> {
+        Ok(Self::new(Listener::Tcp(TcpListener::bind(addr).await?)))
+    }
+
+    // Listens on a Unix socket on the host, for local agents to reach the
+    // enclave without a TCP port. A socket left over at the path (e.g. by a
+    // previous run) is replaced, any other file is not.
+    pub fn bind_unix<P: AsRef<Path>>(path: P) -> Result<Self> {
+        let path = path.as_ref();
+        match std::fs::symlink_metadata(path) {
+            Ok(meta) if meta.file_type().is_socket() => std::fs::remove_file(path)?,
+            Ok(_) => return Err(anyhow!("{} exists and is not a socket", path.display())),
+            Err(err) if err.kind() == io::ErrorKind::NotFound => {}
+            Err(err) => return Err(err.into()),
         }
+
+        let listener = UnixListener::bind(path)?;
+        Ok(Self::new(Listener::Unix(listener, path.to_path_buf())))
     }
 
-    async fn service_conn(mut tcp: TcpStream, target_cid: u32, target_port: u32) {
+    fn new(listener: Listener) -> Self {
+        Self {
+            listener,
+            tls: None,
+            access_log: None,
+            timeouts: Timeouts::default(),
+            proxy_protocol: false,
+        }
+    }
+
+    pub fn with_timeouts(mut self, timeouts: Timeouts) -> Self {
+        self.timeouts = timeouts;
+        self
+    }
+
+    pub fn with_access_log(mut self, access_log: AccessLog) -> Self {
+        self.access_log = Some(Arc::new(access_log));
+        self
+    }
+
+    // Terminate TLS on the host, for when the enclave holds no certificate
+    // and the traffic on the host is trusted already.
+    pub fn with_tls(mut self, tls_config: Arc<ServerConfig>) -> Self {
+        self.tls = Some(TlsAcceptor::from(tls_config));
+        self
+    }
+
+    // Send a PROXY protocol (v2) header ahead of every connection, so that
+    // the enclave can tell who the client is.
+    pub fn with_proxy_protocol(mut self, enabled: bool) -> Self {
+        self.proxy_protocol = enabled;
+        self
+    }
+
+    pub async fn serve(self, target_cid: u32, target_port: u32, cancellation: CancellationToken) {
+        let target = Arc::new(Target {
+            cid: target_cid,
+            port: target_port,
+            breaker: CircuitBreaker::new(BREAKER_THRESHOLD),
+            cancellation: cancellation.clone(),
+        });
+        let connections = Connections::new(cancellation).with_drain(self.timeouts.drain);
+
+        while let Some(Ok(accepted)) = connections.until_cancelled(self.listener.accept()).await {
+            let tls = self.tls.clone();
+            let access_log = self.access_log.clone();
+            let timeouts = self.timeouts;
+            let target = target.clone();
+
+            match accepted {
+                Accepted::Tcp(sock, peer) => {
+                    if let Err(err) = pump::keepalive(&sock, &timeouts) {
+                        warn!("Failed to enable keepalive to {peer}: {err}");
+                    }
+                    let header = if self.proxy_protocol {
+                        sock.local_addr()
+                            .ok()
+                            .map(|local| ProxyHeader::new(peer, local))
+                    } else {
+                        None
+                    };
+
+                    connections.spawn(async move {
+                        let conn = (sock, Some(peer));
+                        HostProxy::service_conn(conn, target, &timeouts, header, tls, access_log)
+                            .await;
+                    });
+                }
+                // Clients of Unix sockets have no address to tell the enclave
+                Accepted::Unix(sock) => connections.spawn(async move {
+                    let conn = (sock, None);
+                    HostProxy::service_conn(conn, target, &timeouts, None, tls, access_log).await;
+                }),
+            }
+        }
+
+        if let Listener::Unix(_, ref path) = self.listener {
+            _ = std::fs::remove_file(path);
+        }
+        drop(self.listener);
+        connections.wait().await;
+    }
+
+    async fn service_conn<C: Client>(
+        (mut sock, peer): (C, Option<SocketAddr>),
+        target: Arc<Target>,
+        timeouts: &Timeouts,
+        header: Option<ProxyHeader>,
+        tls: Option<TlsAcceptor>,
+        access_log: Option<Arc<AccessLog>>,
+    ) {
+        let _conn = metrics::PROXY.connection(METRICS_LABEL);
+        let (target_cid, target_port) = (target.cid, target.port);
+        let destination = format!("vsock:{target_cid}:{target_port}");
+        let mut entry = Entry::new(METRICS_LABEL, peer, &destination);
+        let client = match peer {
+            Some(peer) => peer.to_string(),
+            None => "on the Unix socket".to_string(),
+        };
+
+        // No point in having the client wait through the retries
+        if target.breaker.is_open() {
+            debug!("Enclave port {target_port} is down, resetting client {client}");
+            sock.reset();
+            if let Some(access_log) = access_log {
+                access_log.finish(entry, Verdict::Failed);
+            }
+            return;
+        }
+
         debug!("Connecting to CID={target_cid} port={target_port}");
-        match VsockStream::connect(target_cid, target_port).await {
+        let dial = dial_with_retry(&destination, || {
+            let opts = vsock::DialOptions::default()
+                .with_timeout(timeouts.dial)
+                .with_cancellation(target.cancellation.clone());
+            async move { vsock::connect(target_cid, target_port, &opts).await }
+        });
+
+        let verdict = match metrics::PROXY.dial(METRICS_LABEL, &destination, dial).await {
             Ok(mut vsock) => {
+                target.breaker.record_success();
+
+                if let Some(header) = header {
+                    if let Err(err) = vsock.write_all(&header.encode()).await {
+                        error!("Failed to send the PROXY protocol header: {err}");
+                        return;
+                    }
+                }
+
                 debug!("Connected to {target_port}:{target_cid}, proxying data");
-                _ = tokio::io::copy_bidirectional(&mut vsock, &mut tcp).await;
+                let res = match tls {
+                    Some(acceptor) => match acceptor.accept(sock).await {
+                        Ok(mut stream) => Some(pump(&mut stream, &mut vsock, timeouts).await),
+                        Err(err) => {
+                            debug!("TLS handshake with client {client} failed: {err}");
+                            None
+                        }
+                    },
+                    None => Some(pump(&mut sock, &mut vsock, timeouts).await),
+                };
+
+                match res {
+                    Some(res) => {
+                        metrics::PROXY.transferred(METRICS_LABEL, &res);
+                        entry.transferred(&res);
+                        Verdict::Allowed
+                    }
+                    None => Verdict::Failed,
+                }
+            }
+            Err(err) => {
+                error!(
+                    "Connection to upstream vsock ({target_cid}:{target_port}) failed after {VSOCK_DIAL_ATTEMPTS} attempts, resetting client {client}: {err}"
+                );
+
+                // There is no protocol to report the failure in (HostProxy
+                // just passes bytes along), so the closest thing to a 503 is
+                // a reset: the client sees a refused connection rather than
+                // one that was accepted and then closed without a response.
+                sock.reset();
+
+                if target.breaker.record_failure() {
+                    warn!("Enclave port {target_port} is down, turning clients away until it is reachable again");
+                    tokio::task::spawn(target.clone().probe());
+                }
+                Verdict::Failed
+            }
+        };
+
+        if let Some(access_log) = access_log {
+            access_log.finish(entry, verdict);
+        }
+    }
+}
+
+enum Listener {
+    Tcp(TcpListener),
+    // Along with its path, to remove the socket once done
+    Unix(UnixListener, PathBuf),
+}
+
+enum Accepted {
+    Tcp(TcpStream, SocketAddr),
+    Unix(UnixStream),
+}
+
+impl Listener {
+    async fn accept(&self) -> io::Result<Accepted> {
+        match self {
+            Listener::Tcp(listener) => {
+                let (sock, peer) = listener.accept().await?;
+                Ok(Accepted::Tcp(sock, peer))
+            }
+            Listener::Unix(listener, _) => {
+                let (sock, _) = listener.accept().await?;
+                Ok(Accepted::Unix(sock))
             }
+        }
+    }
+}
+
+// A connection accepted by a HostProxy
+trait Client: AsyncRead + AsyncWrite + Unpin + Send + 'static {
+    // Close the connection so that the client sees it refused, if possible
+    fn reset(&self);
+}
+
+impl Client for TcpStream {
+    fn reset(&self) {
+        _ = self.set_linger(Some(Duration::ZERO));
+    }
+}
+
+// Unix sockets have no such thing as a reset, the client just sees the
+// connection closed.
+impl Client for UnixStream {
+    fn reset(&self) {}
+}
+
+// The enclave port a HostProxy forwards connections to, and whether it is up
+struct Target {
+    cid: u32,
+    port: u32,
+    breaker: CircuitBreaker,
+    // Stops the probing once the proxy stops
+    cancellation: CancellationToken,
+}
+
+impl Target {
+    // Connect to the enclave port every so often until it accepts, and close
+    // the breaker then. The enclave sees a client that leaves right away.
+    async fn probe(self: Arc<Self>) {
+        loop {
+            tokio::select! {
+                _ = self.cancellation.cancelled() => return,
+                _ = tokio::time::sleep(PROBE_INTERVAL) => {}
+            }
+
+            let opts = vsock::DialOptions::default()
+                .with_timeout(PROBE_INTERVAL)
+                .with_cancellation(self.cancellation.clone());
+            match vsock::connect(self.cid, self.port, &opts).await {
+                Ok(_) => {
+                    info!("Enclave port {} is reachable again", self.port);
+                    self.breaker.record_success();
+                    return;
+                }
+                Err(err) if err.kind() == io::ErrorKind::ConnectionAborted => return,
+                Err(err) => debug!("Enclave port {} is still down: {err}", self.port),
+            }
+        }
+    }
+}
+
+// Calls connect until it succeeds, backing off exponentially between the
+// attempts. Returns the last error once VSOCK_DIAL_ATTEMPTS are used up.
+async fn dial_with_retry<F, Fut, T>(destination: &str, mut connect: F) -> io::Result<T>
+where
+    F: FnMut() -> Fut,
+    Fut: Future<Output = io::Result<T>>,
+{
+    let mut backoff = VSOCK_DIAL_INITIAL_BACKOFF;
+    let mut attempt = 1;
+
+    loop {
+        match connect().await {
+            Ok(stream) => return Ok(stream),
+            Err(err) if attempt >= VSOCK_DIAL_ATTEMPTS => return Err(err),
             Err(err) => {
-                error!("Connection to upstream vsock ({target_cid}:{target_port}) failed: {err}")
+                warn!(
+                    "Connection to {destination} failed (attempt {attempt}/{VSOCK_DIAL_ATTEMPTS}), retrying in {backoff:?}: {err}"
+                );
+                tokio::time::sleep(backoff).await;
+                backoff = (backoff * 2).min(VSOCK_DIAL_MAX_BACKOFF);
+                attempt += 1;
             }
         }
     }
@@ -121,11 +535,14 @@ mod tests {
     use std::net::{Ipv4Addr, SocketAddrV4};
     use std::sync::Arc;
     use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
-    use tokio::net::{TcpListener, TcpStream};
+    use tokio::net::{TcpListener, TcpStream, UnixStream};
     use tokio::task::JoinHandle;
     use tokio_rustls::TlsConnector;
+    use tokio_util::sync::CancellationToken;
 
-    use super::{EnclaveProxy, HostProxy};
+    use super::{dial_with_retry, EnclaveProxy, HostProxy, DEFAULT_BACKLOG, VSOCK_DIAL_ATTEMPTS};
+    use std::io;
+    use std::sync::atomic::{AtomicU32, Ordering};
 
     struct TcpEchoServer {
         listener: TcpListener,
@@ -155,18 +572,26 @@ mod tests {
         v
     }
 
-    fn start_enclave_proxy(port: u16, cfg: Arc<ServerConfig>) -> JoinHandle<()> {
-        let proxy = EnclaveProxy::bind_tls(port, cfg).unwrap();
+    fn start_enclave_proxy(
+        port: u16,
+        cfg: Arc<ServerConfig>,
+        cancellation: CancellationToken,
+    ) -> JoinHandle<()> {
+        let proxy = EnclaveProxy::bind_tls(port, DEFAULT_BACKLOG, cfg).unwrap();
         tokio::task::spawn(async move {
-            proxy.serve().await;
+            proxy.serve(cancellation).await;
         })
     }
 
-    async fn start_host_proxy(host_port: u16, enclave_port: u32) -> JoinHandle<()> {
+    async fn start_host_proxy(
+        host_port: u16,
+        enclave_port: u32,
+        cancellation: CancellationToken,
+    ) -> JoinHandle<()> {
         let proxy = HostProxy::bind(host_port).await.unwrap();
         tokio::task::spawn(async move {
             proxy
-                .serve(crate::vsock::VMADDR_CID_HOST, enclave_port)
+                .serve(crate::vsock::VMADDR_CID_HOST, enclave_port, cancellation)
                 .await;
         })
     }
@@ -204,7 +629,8 @@ mod tests {
         const PORT: u16 = 7777;
 
         let server_config = crate::tls::test_server_config().unwrap();
-        let proxy_task = start_enclave_proxy(PORT, server_config);
+        let cancellation = CancellationToken::new();
+        let proxy_task = start_enclave_proxy(PORT, server_config, cancellation.clone());
 
         // start a simple TCP echo server
         let mut echo = TcpEchoServer::bind(PORT)
@@ -224,6 +650,7 @@ mod tests {
             PORT as u32,
             server_name,
             client_config,
+            &crate::vsock::DialOptions::default(),
         )
         .await
         .expect("connect failed");
@@ -236,7 +663,7 @@ mod tests {
         echo_task.abort();
         _ = echo_task.await;
 
-        proxy_task.abort();
+        cancellation.cancel();
         _ = proxy_task.await;
     }
 
@@ -261,8 +688,9 @@ mod tests {
         const PORT: u16 = 7787;
 
         let server_config = crate::tls::test_server_config().unwrap();
-        let enclave_proxy_task = start_enclave_proxy(PORT + 1, server_config);
-        let host_proxy_task = start_host_proxy(PORT, (PORT + 1) as u32).await;
+        let cancellation = CancellationToken::new();
+        let enclave_proxy_task = start_enclave_proxy(PORT + 1, server_config, cancellation.clone());
+        let host_proxy_task = start_host_proxy(PORT, (PORT + 1) as u32, cancellation.clone()).await;
 
         // start a simple TCP echo server
         let mut echo = TcpEchoServer::bind(PORT + 1)
@@ -289,10 +717,92 @@ mod tests {
         echo_task.abort();
         _ = echo_task.await;
 
-        enclave_proxy_task.abort();
+        // Both proxies stop on their own, closing their listeners
+        cancellation.cancel();
         _ = enclave_proxy_task.await;
+        _ = host_proxy_task.await;
+    }
 
-        host_proxy_task.abort();
+    #[tokio::test]
+    async fn test_unix_socket_proxy() {
+        const PORT: u16 = 7797;
+
+        let server_config = crate::tls::test_server_config().unwrap();
+        let cancellation = CancellationToken::new();
+        let enclave_proxy_task = start_enclave_proxy(PORT, server_config, cancellation.clone());
+
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("ingress.sock");
+        // A socket left behind is replaced, but no other file
+        std::fs::write(&path, b"").unwrap();
+        assert!(HostProxy::bind_unix(&path).is_err());
+        std::fs::remove_file(&path).unwrap();
+        drop(std::os::unix::net::UnixListener::bind(&path).unwrap());
+
+        let proxy = HostProxy::bind_unix(&path).unwrap();
+        let host_cancellation = cancellation.clone();
+        let host_proxy_task = tokio::task::spawn(async move {
+            proxy
+                .serve(
+                    crate::vsock::VMADDR_CID_HOST,
+                    PORT as u32,
+                    host_cancellation,
+                )
+                .await;
+        });
+
+        let mut echo = TcpEchoServer::bind(PORT)
+            .await
+            .expect("bind for the echo server failed");
+        let echo_task = tokio::task::spawn(async move {
+            echo.serve().await;
+        });
+
+        let client_config =
+            crate::tls::load_insecure_client_config().expect("client config load failed");
+        let server_name = ServerName::try_from("test.local").expect("invalid server name");
+        let stream = UnixStream::connect(&path).await.unwrap();
+        let conn = TlsConnector::from(client_config)
+            .connect(server_name, stream)
+            .await
+            .expect("connect failed");
+        let (r, w) = tokio::io::split(conn);
+
+        let (expected, actual) = tokio::join!(start_source(w), start_sink(r));
+        let (expected, actual) = (expected.unwrap(), actual.unwrap());
+        assert!(expected == actual);
+
+        echo_task.abort();
+        _ = echo_task.await;
+
+        // The socket goes away along with the proxy
+        cancellation.cancel();
+        _ = enclave_proxy_task.await;
         _ = host_proxy_task.await;
+        assert!(!path.exists());
+    }
+
+    #[tokio::test]
+    async fn test_dial_with_retry() {
+        // Succeeds once the "enclave" is up
+        let attempts = &AtomicU32::new(0);
+        let res = dial_with_retry("vsock:3:8080", || async move {
+            match attempts.fetch_add(1, Ordering::Relaxed) {
+                0 | 1 => Err(io::Error::from(io::ErrorKind::ConnectionReset)),
+                n => Ok(n),
+            }
+        })
+        .await;
+        assert!(res.unwrap() == 2);
+
+        // Gives up eventually
+        let attempts = &AtomicU32::new(0);
+        let res: io::Result<()> = dial_with_retry("vsock:3:8080", || async move {
+            attempts.fetch_add(1, Ordering::Relaxed);
+            Err(io::Error::from(io::ErrorKind::ConnectionReset))
+        })
+        .await;
+        assert!(res.is_err());
+        assert!(attempts.load(Ordering::Relaxed) == VSOCK_DIAL_ATTEMPTS);
     }
 }
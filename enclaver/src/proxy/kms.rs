@@ -1,7 +1,5 @@
-use anyhow::{anyhow, Error, Result};
+use anyhow::{anyhow, Result};
 use async_trait::async_trait;
-use aws_sigv4::http_request::{SignableBody, SignableRequest, SigningSettings};
-use aws_sigv4::SigningParams;
 use aws_types::credentials::Credentials;
 use http::header::{HeaderName, HeaderValue};
 use http::uri::{Authority, Scheme};
@@ -13,10 +11,10 @@ use lazy_static::lazy_static;
 use log::{debug, trace};
 use regex::Regex;
 use std::sync::Arc;
-use std::time::SystemTime;
 
+use super::aws_util;
 use crate::http_util::HttpHandler;
-use crate::keypair::KeyPair;
+use crate::keypair::Decrypter;
 use crate::nsm::{AttestationParams, AttestationProvider};
 
 const X_AMZ_TARGET: HeaderName = HeaderName::from_static("x-amz-target");
@@ -181,50 +179,8 @@ impl KmsRequestOutgoing {
         Ok(Self { inner })
     }
 
-    fn sign(mut self, credentials: &Credentials, region: &str) -> Result<Request<Body>> {
-        let signing_settings = SigningSettings::default();
-        let mut signing_builder = SigningParams::builder()
-            .access_key(credentials.access_key_id())
-            .secret_key(credentials.secret_access_key())
-            .region(region)
-            .service_name(KMS_SERVICE_NAME)
-            .time(SystemTime::now())
-            .settings(signing_settings);
-
-        if let Some(ref token) = credentials.session_token() {
-            signing_builder = signing_builder.security_token(token);
-        }
-
-        let signing_params = signing_builder.build()?;
-
-        let signable_request = SignableRequest::new(
-            &self.inner.method(),
-            &self.inner.uri(),
-            &self.inner.headers(),
-            SignableBody::Bytes(&self.inner.body()),
-        );
-
-        // Sign and then apply the signature to the request
-        let signed = aws_sigv4::http_request::sign(signable_request, &signing_params)
-            .map_err(|e| Error::msg(e))?;
-
-        let (signing_instructions, _signature) = signed.into_parts();
-        signing_instructions.apply_to_request(&mut self.inner);
-
-        // Convert Request<Bytes> to Request<Body>
-        let (head, bytes_body) = self.inner.into_parts();
-
-        let req = Request::from_parts(head, Body::from(bytes_body));
-
-        trace!(
-            "Signed request auth: {}",
-            req.headers()
-                .get("authorization")
-                .unwrap()
-                .to_str()
-                .unwrap()
-        );
-        Ok(req)
+    fn sign(self, credentials: &Credentials, region: &str) -> Result<Request<Body>> {
+        aws_util::sign_request(self.inner, credentials, region, KMS_SERVICE_NAME)
     }
 }
 
@@ -235,7 +191,9 @@ pub trait KmsEndpointProvider {
 pub struct KmsProxyConfig {
     pub client: Box<dyn HttpClient + Send + Sync>,
     pub credentials: Credentials,
-    pub keypair: Arc<KeyPair>,
+    // RSA, as KMS encrypts to. Any Decrypter will do, e.g. a SealedKey that
+    // never hands out its private key.
+    pub keypair: Arc<dyn Decrypter>,
     pub attester: Box<dyn AttestationProvider + Send + Sync>,
     pub endpoints: Arc<dyn KmsEndpointProvider + Send + Sync>,
 }
@@ -245,6 +203,43 @@ impl KmsProxyConfig {
         let endpoint = self.endpoints.endpoint(region);
         Authority::from_maybe_shared(endpoint).unwrap()
     }
+
+    // Has KMS encrypt what it returns to the keypair, which only this enclave
+    // holds, instead of returning it in the clear
+    fn recipient(&self) -> Result<JsonValue> {
+        let attestation_doc = self.attester.attestation(AttestationParams {
+            nonce: None,
+            user_data: None,
+            public_key: Some(self.keypair.public_key_as_der()?),
+        })?;
+
+        Ok(object! {
+            "AttestationDocument": json::JsonValue::String(base64::encode(&attestation_doc)),
+            "KeyEncryptionAlgorithm": "RSAES_OAEP_SHA_256",
+        })
+    }
+
+    // Takes CiphertextForRecipient out of a response body and decrypts it
+    fn plaintext_for_recipient(&self, body_obj: &mut json::object::Object) -> Result<Vec<u8>> {
+        let b64ciphertext = body_obj
+            .remove("CiphertextForRecipient")
+            .ok_or(anyhow!("Response body is missing 'CiphertextForRecipient'"))?;
+
+        let b64ciphertext = b64ciphertext
+            .as_str()
+            .ok_or(anyhow!("CiphertextForRecipient is not a string"))?;
+
+        let ciphertext = base64::decode(b64ciphertext)?;
+        let content_info = super::pkcs7::ContentInfo::parse_ber(&ciphertext)?;
+        Ok(content_info.decrypt_content(self.keypair.as_ref())?)
+    }
+
+    async fn send(&self, req: KmsRequestOutgoing, region: &str) -> Result<Response<Body>> {
+        let signed = req.sign(&self.credentials, region)?;
+
+        debug!("Sending Request: {:?}", signed);
+        Ok(self.client.request(signed).await?)
+    }
 }
 
 pub struct KmsProxyHandler {
@@ -268,34 +263,17 @@ impl KmsProxyHandler {
         let authority = self.config.get_authority(&region);
 
         let mut body_obj = req_in.body_as_json()?;
-
-        let attestation_doc = self.get_attestation()?;
-
-        body_obj.insert(
-            "Recipient",
-            object! {
-                "AttestationDocument": json::JsonValue::String(base64::encode(&attestation_doc)),
-                "KeyEncryptionAlgorithm": "RSAES_OAEP_SHA_256",
-            },
-        )?;
+        body_obj.insert("Recipient", self.config.recipient()?)?;
 
         let req_out = KmsRequestOutgoing::new(authority, req_in.target().unwrap(), body_obj)?;
 
         // Send the request to the actual KMS
-        let resp = self.send(req_out, &region).await?;
+        let resp = self.config.send(req_out, &region).await?;
 
         // Decode the response
         self.handle_response(resp).await
     }
 
-    fn get_attestation(&self) -> Result<Vec<u8>> {
-        self.config.attester.attestation(AttestationParams {
-            nonce: None,
-            user_data: None,
-            public_key: Some(self.config.keypair.public_key_as_der()?),
-        })
-    }
-
     async fn handle_response(&self, resp: Response<Body>) -> Result<Response<Body>> {
         let (mut head, body) = resp.into_parts();
         head.headers.remove(hyper::header::CONTENT_LENGTH);
@@ -310,16 +288,7 @@ impl KmsProxyHandler {
         let body_val = json::parse(std::str::from_utf8(&body)?)?;
 
         if let JsonValue::Object(mut body_obj) = body_val {
-            let b64ciphertext = body_obj
-                .remove("CiphertextForRecipient")
-                .ok_or(anyhow!("Response body is missing 'CiphertextForRecipient'"))?;
-
-            let b64ciphertext = b64ciphertext
-                .as_str()
-                .ok_or(anyhow!("CiphertextForRecipient is not a string"))?;
-
-            let ciphertext = base64::decode(b64ciphertext)?;
-            let plaintext = self.decrypt_cms(&ciphertext)?;
+            let plaintext = self.config.plaintext_for_recipient(&mut body_obj)?;
 
             body_obj["Plaintext"] = json::JsonValue::String(base64::encode(&plaintext));
             Ok(json_response(head, JsonValue::Object(body_obj)))
@@ -336,19 +305,7 @@ impl KmsProxyHandler {
         let authority = self.config.get_authority(&region);
 
         let req_out = KmsRequestOutgoing::from_incoming(req_in, authority)?;
-        self.send(req_out, &region).await
-    }
-
-    async fn send(&self, req: KmsRequestOutgoing, region: &str) -> Result<Response<Body>> {
-        let signed = req.sign(&self.config.credentials, region)?;
-
-        debug!("Sending Request: {:?}", signed);
-        Ok(self.config.client.request(signed).await?)
-    }
-
-    fn decrypt_cms(&self, cms: &[u8]) -> Result<Vec<u8>> {
-        let content_info = super::pkcs7::ContentInfo::parse_ber(cms)?;
-        Ok(content_info.decrypt_content(&self.config.keypair.private)?)
+        self.config.send(req_out, &region).await
     }
 }
 
@@ -369,6 +326,93 @@ impl HttpHandler for KmsProxyHandler {
     }
 }
 
+pub struct DataKey {
+    pub key_id: String,
+    pub plaintext: Vec<u8>,
+    // To be stored along with what the key encrypts, and decrypted with
+    // KmsClient::decrypt() when it is needed again
+    pub ciphertext_blob: Vec<u8>,
+}
+
+// Calls KMS itself, attesting the calls that return secrets as the proxy
+// does, for apps in the enclave that link this crate rather than go through
+// the proxy. Plaintexts only ever exist inside the enclave.
+pub struct KmsClient {
+    config: KmsProxyConfig,
+    region: String,
+}
+
+impl KmsClient {
+    pub fn new(config: KmsProxyConfig, region: &str) -> Self {
+        Self {
+            config,
+            region: region.to_string(),
+        }
+    }
+
+    // key_id is required of asymmetric keys only
+    pub async fn decrypt(&self, ciphertext_blob: &[u8], key_id: Option<&str>) -> Result<Vec<u8>> {
+        let mut body = object! { "CiphertextBlob": base64::encode(ciphertext_blob) };
+        if let Some(key_id) = key_id {
+            body.insert("KeyId", key_id)?;
+        }
+
+        let (_, plaintext) = self.call("TrentService.Decrypt", body).await?;
+        Ok(plaintext)
+    }
+
+    // key_spec is AES_256 or AES_128
+    pub async fn generate_data_key(&self, key_id: &str, key_spec: &str) -> Result<DataKey> {
+        let body = object! { "KeyId": key_id, "KeySpec": key_spec };
+        let (resp, plaintext) = self.call("TrentService.GenerateDataKey", body).await?;
+
+        let ciphertext_blob = resp["CiphertextBlob"]
+            .as_str()
+            .ok_or(anyhow!("Response body is missing 'CiphertextBlob'"))?;
+
+        Ok(DataKey {
+            key_id: resp["KeyId"].as_str().unwrap_or(key_id).to_string(),
+            plaintext,
+            ciphertext_blob: base64::decode(ciphertext_blob)?,
+        })
+    }
+
+    pub async fn generate_random(&self, number_of_bytes: u32) -> Result<Vec<u8>> {
+        let body = object! { "NumberOfBytes": number_of_bytes };
+        let (_, random) = self.call("TrentService.GenerateRandom", body).await?;
+        Ok(random)
+    }
+
+    // Returns the rest of the response body along with the plaintext
+    async fn call(
+        &self,
+        action: &'static str,
+        mut body: JsonValue,
+    ) -> Result<(JsonValue, Vec<u8>)> {
+        body.insert("Recipient", self.config.recipient()?)?;
+
+        let authority = self.config.get_authority(&self.region);
+        let action_hdr = HeaderValue::from_static(action);
+        let req = KmsRequestOutgoing::new(authority, &action_hdr, body)?;
+
+        let resp = self.config.send(req, &self.region).await?;
+        let status = resp.status();
+        let body = hyper::body::to_bytes(resp.into_body()).await?;
+        let body = std::str::from_utf8(&body)?;
+        if status != StatusCode::OK {
+            return Err(anyhow!("{action} failed with {status}: {body}"));
+        }
+
+        match json::parse(body)? {
+            JsonValue::Object(mut body_obj) => {
+                let plaintext = self.config.plaintext_for_recipient(&mut body_obj)?;
+                Ok((JsonValue::Object(body_obj), plaintext))
+            }
+            _ => Err(anyhow!("The response body is not a JSON object")),
+        }
+    }
+}
+
 // hyper::client::Client implements tower::Service and would make a perfect
 // trait but it uses `&mut self` and would require a needless mutex.
 #[async_trait]
@@ -424,6 +468,7 @@ fn amz_credential_query(uri: &Uri) -> Option<String> {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::keypair::KeyPair;
     use crate::nsm::StaticAttestationProvider;
     use assert2::assert;
     use pkcs8::DecodePrivateKey;
@@ -470,6 +515,7 @@ mod tests {
             match action {
                 "TrentService.ListKeys" => self.list_keys(req).await,
                 "TrentService.Decrypt" => self.decrypt(req).await,
+                "TrentService.GenerateDataKey" => self.generate_data_key(req).await,
                 _ => panic!("unexpected action"),
             }
         }
@@ -501,6 +547,23 @@ mod tests {
 
             Ok(resp)
         }
+
+        async fn generate_data_key(
+            &self,
+            req: Request<Body>,
+        ) -> std::result::Result<Response<Body>, hyper::Error> {
+            let body = body_as_json(req.into_body()).await.unwrap();
+            assert!(body["Recipient"]["AttestationDocument"].is_string());
+            assert!(body["KeySpec"] == "AES_256");
+
+            let resp = kms_response(object! {
+                "KeyId": KEY_ID,
+                "CiphertextBlob": base64::encode("~~~ ENCRYPTED data key ~~~"),
+                "CiphertextForRecipient": crate::proxy::pkcs7::tests::INPUT,
+            });
+
+            Ok(resp)
+        }
     }
 
     impl KmsEndpointProvider for Mock {
@@ -537,19 +600,23 @@ mod tests {
         Ok(json::parse(std::str::from_utf8(&bytes)?)?)
     }
 
-    fn new_test_handler() -> KmsProxyHandler {
+    fn new_test_config() -> KmsProxyConfig {
         let key_der = base64::decode(crate::proxy::pkcs7::tests::PRIVATE_KEY).unwrap();
         let priv_key = RsaPrivateKey::from_pkcs8_der(&key_der).unwrap();
 
-        let config = KmsProxyConfig {
+        KmsProxyConfig {
             client: Box::new(Mock),
             credentials: Credentials::from_keys("TESTKEY", "TESTSECRET", None),
-            keypair: Arc::new(KeyPair::from_private(priv_key)),
+            keypair: Arc::new(KeyPair::from_private(priv_key).seal()),
             attester: Box::new(StaticAttestationProvider::new(ATTESTATION_DOC.to_vec())),
             endpoints: Arc::new(Mock {}),
-        };
+        }
+    }
 
-        KmsProxyHandler { config }
+    fn new_test_handler() -> KmsProxyHandler {
+        KmsProxyHandler {
+            config: new_test_config(),
+        }
     }
 
     #[test]
@@ -621,4 +688,20 @@ mod tests {
             assert!("DUMMY" == msg);
         }
     }
+
+    #[tokio::test]
+    async fn test_kms_client() {
+        let client = KmsClient::new(new_test_config(), "us-east-1");
+
+        let plaintext = client
+            .decrypt(b"~~~ ENCRYPTED Hello, World ~~~", None)
+            .await
+            .unwrap();
+        assert!(plaintext == b"Hello, World");
+
+        let data_key = client.generate_data_key(KEY_ID, "AES_256").await.unwrap();
+        assert!(data_key.key_id == KEY_ID);
+        assert!(data_key.plaintext == b"Hello, World");
+        assert!(data_key.ciphertext_blob == b"~~~ ENCRYPTED data key ~~~");
+    }
 }
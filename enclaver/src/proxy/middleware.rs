@@ -0,0 +1,342 @@
+use std::collections::HashSet;
+use std::net::SocketAddr;
+use std::sync::Arc;
+
+use anyhow::{anyhow, Result};
+use hyper::header::{HeaderName, HeaderValue, HOST, PROXY_AUTHORIZATION};
+use hyper::{Body, Method, Request, StatusCode};
+use sha2::{Digest, Sha256};
+use uuid::Uuid;
+
+use crate::manifest::{HeaderFilterSpec, MiddlewareSpec, ProxyAuthSpec, RequestIdSpec};
+
+const DEFAULT_REQUEST_ID_HEADER: &str = "x-request-id";
+
+// Why a request was turned away, for the proxy to answer with
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Rejection {
+    pub status: StatusCode,
+    pub error: &'static str,
+    pub message: String,
+}
+
+// Runs on each request made through the egress HTTP proxy, plain or CONNECT,
+// before the policy is checked. It may change the request, or turn it away.
+pub trait Middleware: Send + Sync {
+    fn handle(&self, req: &mut Request<Body>, peer: SocketAddr) -> Result<(), Rejection>;
+
+    // SOCKS5 clients make no request to run on, there is only the password
+    // they authenticated with, if they did. Middleware that turns requests
+    // away by their credentials checks that instead.
+    fn handle_socks(&self, _password: Option<&str>, _peer: SocketAddr) -> Result<(), Rejection> {
+        Ok(())
+    }
+}
+
+// Middleware in the order it runs in. The first rejection ends the chain.
+#[derive(Default, Clone)]
+pub struct Chain {
+    middleware: Vec<Arc<dyn Middleware>>,
+}
+
+impl Chain {
+    pub fn new(specs: &[MiddlewareSpec]) -> Result<Self> {
+        let mut chain = Self::default();
+        for spec in specs {
+            match (&spec.request_id, &spec.headers, &spec.auth) {
+                (Some(spec), None, None) => chain.push(Arc::new(RequestId::new(spec)?)),
+                (None, Some(spec), None) => chain.push(Arc::new(HeaderFilter::new(spec)?)),
+                (None, None, Some(spec)) => chain.push(Arc::new(ProxyAuth::new(spec)?)),
+                _ => {
+                    return Err(anyhow!(
+                        "each middleware entry sets exactly one of request_id, headers and auth"
+                    ))
+                }
+            }
+        }
+        Ok(chain)
+    }
+
+    pub fn push(&mut self, middleware: Arc<dyn Middleware>) {
+        self.middleware.push(middleware);
+    }
+
+    pub fn handle(&self, req: &mut Request<Body>, peer: SocketAddr) -> Result<(), Rejection> {
+        self.middleware
+            .iter()
+            .try_for_each(|middleware| middleware.handle(req, peer))
+    }
+
+    pub fn handle_socks(&self, password: Option<&str>, peer: SocketAddr) -> Result<(), Rejection> {
+        self.middleware
+            .iter()
+            .try_for_each(|middleware| middleware.handle_socks(password, peer))
+    }
+}
+
+// Tags requests with a unique id, unless the app did already, so that they can
+// be told apart in the logs of the destination.
+pub struct RequestId {
+    header: HeaderName,
+}
+
+impl RequestId {
+    pub fn new(spec: &RequestIdSpec) -> Result<Self> {
+        let name = spec.header.as_deref().unwrap_or(DEFAULT_REQUEST_ID_HEADER);
+        Ok(Self {
+            header: header_name(name)?,
+        })
+    }
+}
+
+impl Middleware for RequestId {
+    fn handle(&self, req: &mut Request<Body>, _peer: SocketAddr) -> Result<(), Rejection> {
+        // Tunnels carry requests of their own, which are out of reach
+        if req.method() != Method::CONNECT && !req.headers().contains_key(&self.header) {
+            let id = Uuid::new_v4().to_string();
+            // A UUID is always a valid header value
+            req.headers_mut()
+                .insert(self.header.clone(), HeaderValue::from_str(&id).unwrap());
+        }
+        Ok(())
+    }
+}
+
+// Keeps the headers apps send from leaking more than they should: only those
+// allowed are passed on, if there is an allow list, and never those stripped.
+// Host is always kept, as requests cannot be routed without it.
+pub struct HeaderFilter {
+    allow: Option<HashSet<HeaderName>>,
+    strip: Vec<HeaderName>,
+}
+
+impl HeaderFilter {
+    pub fn new(spec: &HeaderFilterSpec) -> Result<Self> {
+        let allow = match spec.allow {
+            Some(ref names) => Some(
+                names
+                    .iter()
+                    .map(|name| header_name(name))
+                    .collect::<Result<HashSet<_>>>()?,
+            ),
+            None => None,
+        };
+        let strip = spec
+            .strip
+            .iter()
+            .flatten()
+            .map(|name| header_name(name))
+            .collect::<Result<Vec<_>>>()?;
+
+        Ok(Self { allow, strip })
+    }
+}
+
+impl Middleware for HeaderFilter {
+    fn handle(&self, req: &mut Request<Body>, _peer: SocketAddr) -> Result<(), Rejection> {
+        if req.method() == Method::CONNECT {
+            return Ok(());
+        }
+
+        if let Some(ref allow) = self.allow {
+            let disallowed: Vec<HeaderName> = req
+                .headers()
+                .keys()
+                .filter(|name| **name != HOST && !allow.contains(*name))
+                .cloned()
+                .collect();
+            for name in disallowed {
+                req.headers_mut().remove(name);
+            }
+        }
+
+        for name in &self.strip {
+            req.headers_mut().remove(name);
+        }
+
+        Ok(())
+    }
+}
+
+// Requires a bearer token in Proxy-Authorization, from those in a file with
+// one per line. The header is removed once checked, so that the token is
+// never passed on to the destination. SOCKS5 clients send the token as their
+// password.
+pub struct ProxyAuth {
+    // Digests rather than the tokens, so that comparing them takes as long
+    // whatever the token is
+    tokens: HashSet<[u8; 32]>,
+}
+
+impl ProxyAuth {
+    pub fn new(spec: &ProxyAuthSpec) -> Result<Self> {
+        let contents = std::fs::read_to_string(&spec.tokens_file)
+            .map_err(|err| anyhow!("failed to read {}: {err}", spec.tokens_file))?;
+        let tokens: HashSet<[u8; 32]> = contents
+            .lines()
+            .map(str::trim)
+            .filter(|line| !line.is_empty() && !line.starts_with('#'))
+            .map(digest)
+            .collect();
+
+        if tokens.is_empty() {
+            return Err(anyhow!("no tokens in {}", spec.tokens_file));
+        }
+        Ok(Self { tokens })
+    }
+
+    fn check(&self, token: Option<&str>) -> Result<(), Rejection> {
+        match token {
+            Some(token) if self.tokens.contains(&digest(token)) => Ok(()),
+            Some(_) => Err(unauthorized("invalid proxy token")),
+            None => Err(unauthorized("missing proxy token")),
+        }
+    }
+}
+
+impl Middleware for ProxyAuth {
+    fn handle(&self, req: &mut Request<Body>, _peer: SocketAddr) -> Result<(), Rejection> {
+        let token = req
+            .headers_mut()
+            .remove(PROXY_AUTHORIZATION)
+            .and_then(|value| {
+                let value = value.to_str().ok()?;
+                let (scheme, token) = value.split_once(' ')?;
+                scheme
+                    .eq_ignore_ascii_case("bearer")
+                    .then(|| token.trim().to_string())
+            });
+
+        self.check(token.as_deref())
+    }
+
+    fn handle_socks(&self, password: Option<&str>, _peer: SocketAddr) -> Result<(), Rejection> {
+        self.check(password)
+    }
+}
+
+fn unauthorized(message: &str) -> Rejection {
+    Rejection {
+        status: StatusCode::PROXY_AUTHENTICATION_REQUIRED,
+        error: "unauthorized",
+        message: message.to_string(),
+    }
+}
+
+fn digest(token: &str) -> [u8; 32] {
+    let mut out = [0u8; 32];
+    out.copy_from_slice(&Sha256::digest(token.as_bytes()));
+    out
+}
+
+fn header_name(name: &str) -> Result<HeaderName> {
+    HeaderName::from_bytes(name.as_bytes()).map_err(|_| anyhow!("invalid header name {name}"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{Chain, Middleware, Rejection};
+    use crate::manifest::{HeaderFilterSpec, MiddlewareSpec, ProxyAuthSpec, RequestIdSpec};
+    use assert2::assert;
+    use hyper::{Body, Request, StatusCode};
+    use std::io::Write;
+    use std::net::SocketAddr;
+    use std::sync::Arc;
+
+    fn peer() -> SocketAddr {
+        "127.0.0.1:1234".parse().unwrap()
+    }
+
+    fn request() -> Request<Body> {
+        Request::builder()
+            .uri("http://example.com/")
+            .header("host", "example.com")
+            .header("x-trace", "1")
+            .header("cookie", "secret")
+            .header("user-agent", "test")
+            .body(Body::empty())
+            .unwrap()
+    }
+
+    fn spec() -> MiddlewareSpec {
+        MiddlewareSpec {
+            request_id: None,
+            headers: None,
+            auth: None,
+        }
+    }
+
+    #[test]
+    fn test_chain() {
+        let mut tokens = tempfile::NamedTempFile::new().unwrap();
+        tokens.write_all(b"# for the app\ns3cret\n").unwrap();
+
+        let chain = Chain::new(&[
+            MiddlewareSpec {
+                auth: Some(ProxyAuthSpec {
+                    tokens_file: tokens.path().display().to_string(),
+                }),
+                ..spec()
+            },
+            MiddlewareSpec {
+                headers: Some(HeaderFilterSpec {
+                    allow: Some(vec!["X-Trace".to_string(), "Cookie".to_string()]),
+                    strip: Some(vec!["cookie".to_string()]),
+                }),
+                ..spec()
+            },
+            MiddlewareSpec {
+                request_id: Some(RequestIdSpec { header: None }),
+                ..spec()
+            },
+        ])
+        .unwrap();
+
+        let mut req = request();
+        let rejection = chain.handle(&mut req, peer()).unwrap_err();
+        assert!(rejection.status == StatusCode::PROXY_AUTHENTICATION_REQUIRED);
+
+        let mut req = request();
+        req.headers_mut()
+            .insert("proxy-authorization", "Bearer nope".parse().unwrap());
+        assert!(chain.handle(&mut req, peer()).is_err());
+
+        let mut req = request();
+        req.headers_mut()
+            .insert("proxy-authorization", "Bearer s3cret".parse().unwrap());
+        assert!(chain.handle(&mut req, peer()).is_ok());
+
+        let headers = req.headers();
+        assert!(headers.get("proxy-authorization").is_none());
+        assert!(headers.get("host").is_some());
+        assert!(headers.get("x-trace").is_some());
+        assert!(headers.get("cookie").is_none());
+        assert!(headers.get("user-agent").is_none());
+        assert!(headers.get("x-request-id").unwrap().len() == 36);
+
+        // Entries set exactly one kind of middleware
+        assert!(Chain::new(&[spec()]).is_err());
+    }
+
+    struct Deny;
+
+    impl Middleware for Deny {
+        fn handle(&self, _req: &mut Request<Body>, _peer: SocketAddr) -> Result<(), Rejection> {
+            Err(Rejection {
+                status: StatusCode::FORBIDDEN,
+                error: "denied",
+                message: "no".to_string(),
+            })
+        }
+    }
+
+    #[test]
+    fn test_chain_custom() {
+        let mut chain = Chain::default();
+        assert!(chain.handle(&mut request(), peer()).is_ok());
+
+        chain.push(Arc::new(Deny));
+        let rejection = chain.handle(&mut request(), peer()).unwrap_err();
+        assert!(rejection.status == StatusCode::FORBIDDEN);
+    }
+}
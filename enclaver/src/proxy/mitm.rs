@@ -0,0 +1,354 @@
+use std::collections::HashMap;
+use std::convert::Infallible;
+use std::fs::File;
+use std::io::BufReader;
+use std::net::SocketAddr;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime};
+
+use anyhow::{anyhow, Result};
+use futures::future::poll_fn;
+use hyper::client::conn::SendRequest;
+use hyper::header::HeaderName;
+use hyper::server::conn::Http;
+use hyper::service::service_fn;
+use hyper::{Body, Request, Response, StatusCode};
+use log::{debug, info};
+use rustls::{Certificate, ClientConfig, PrivateKey, RootCertStore, ServerConfig, ServerName};
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio_rustls::{TlsAcceptor, TlsConnector};
+
+use crate::access_log::Exchange;
+use crate::keypair::KeyPair;
+use crate::manifest::MitmSpec;
+use crate::x509::{self, CertificateParams};
+
+const CA_NAME: &str = "Enclaver Egress CA";
+
+// Where the certificate of the CA is written for the app to trust, by default
+pub const DEFAULT_CA_CERT_PATH: &str = "/etc/enclaver/egress-ca.pem";
+
+// The usual locations of the CA bundle of an image, by distribution
+const CA_BUNDLES: &[&str] = &[
+    "/etc/ssl/certs/ca-certificates.crt",
+    "/etc/pki/tls/certs/ca-bundle.crt",
+    "/etc/ssl/cert.pem",
+];
+
+const VALIDITY: Duration = Duration::from_secs(365 * 24 * 3600);
+
+// For clocks running a little behind the one of the enclave
+const BACKDATE: Duration = Duration::from_secs(3600);
+
+// Only HTTP/1.1 is spoken on either side of intercepted tunnels
+const ALPN_HTTP1: &[u8] = b"http/1.1";
+
+// Terminates TLS in the enclave, with certificates issued on the fly by a CA
+// that lives (and dies) with the enclave, so that requests can be audited and
+// headers filtered before they are encrypted again for the destination.
+pub struct Interceptor {
+    ca_key: KeyPair,
+    ca_cert: Vec<u8>,
+    // Shared by the certificates of every destination
+    key: KeyPair,
+    client_config: Arc<ClientConfig>,
+    strip_request_headers: Vec<HeaderName>,
+    strip_response_headers: Vec<HeaderName>,
+    // By host name, along with when the certificate expires
+    server_configs: Mutex<HashMap<String, (Arc<ServerConfig>, SystemTime)>>,
+}
+
+impl Interceptor {
+    pub fn new(spec: &MitmSpec) -> Result<Self> {
+        let now = SystemTime::now();
+        let ca_key = KeyPair::generate()?;
+        let params = CertificateParams {
+            common_name: CA_NAME.to_string(),
+            dns_names: Vec::new(),
+            not_before: now - BACKDATE,
+            not_after: now + VALIDITY,
+            extensions: vec![x509::ca_extension()],
+        };
+        let (ca_cert, _) = x509::self_signed(&params, &ca_key)?;
+
+        let mut client_config = ClientConfig::builder()
+            .with_safe_defaults()
+            .with_root_certificates(load_roots(spec.trusted_ca_path.as_deref())?)
+            .with_no_client_auth();
+        client_config.alpn_protocols = vec![ALPN_HTTP1.to_vec()];
+
+        Ok(Self {
+            ca_key,
+            ca_cert,
+            key: KeyPair::generate()?,
+            client_config: Arc::new(client_config),
+            strip_request_headers: header_names(&spec.strip_request_headers)?,
+            strip_response_headers: header_names(&spec.strip_response_headers)?,
+            server_configs: Mutex::new(HashMap::new()),
+        })
+    }
+
+    pub fn ca_cert_pem(&self) -> String {
+        x509::pem("CERTIFICATE", &self.ca_cert)
+    }
+
+    // Serve the HTTP requests the client makes in a tunnel to host, passing
+    // them on to the destination over TLS of its own.
+    pub(crate) async fn serve<C, R>(
+        self: Arc<Self>,
+        client: C,
+        remote: R,
+        host: &str,
+        source: SocketAddr,
+    ) -> Result<()>
+    where
+        C: AsyncRead + AsyncWrite + Unpin + 'static,
+        R: AsyncRead + AsyncWrite + Unpin + Send + 'static,
+    {
+        let acceptor = TlsAcceptor::from(self.server_config(host)?);
+        let client = acceptor.accept(client).await?;
+
+        let server_name =
+            ServerName::try_from(host).map_err(|_| anyhow!("invalid server name {host}"))?;
+        let connector = TlsConnector::from(self.client_config.clone());
+        let remote = connector.connect(server_name, remote).await?;
+
+        let (sender, conn) = hyper::client::conn::handshake(remote).await?;
+        // Ends once the requests are done with and the sender is dropped
+        tokio::task::spawn(async move {
+            if let Err(err) = conn.await {
+                debug!("Intercepted connection to the destination failed: {err}");
+            }
+        });
+
+        let host = host.to_string();
+        let svc = service_fn(move |req| {
+            let interceptor = self.clone();
+            let sender = sender.clone();
+            let host = host.clone();
+            async move { Ok::<_, Infallible>(interceptor.exchange(req, sender, &host, source).await) }
+        });
+
+        Http::new()
+            .http1_only(true)
+            .serve_connection(client, svc)
+            .await?;
+        Ok(())
+    }
+
+    async fn exchange(
+        &self,
+        mut req: Request<Body>,
+        mut sender: SendRequest<Body>,
+        host: &str,
+        source: SocketAddr,
+    ) -> Response<Body> {
+        let path = req.uri().path_and_query().map_or("/", |pq| pq.as_str());
+        let exchange = Exchange::new(Some(source), host, req.method().as_str(), path);
+
+        for name in &self.strip_request_headers {
+            req.headers_mut().remove(name);
+        }
+
+        let resp = match poll_fn(|cx| sender.poll_ready(cx)).await {
+            Ok(()) => sender.send_request(req).await,
+            Err(err) => Err(err),
+        };
+
+        match resp {
+            Ok(mut resp) => {
+                for name in &self.strip_response_headers {
+                    resp.headers_mut().remove(name);
+                }
+                exchange.finish(Some(resp.status().as_u16()));
+                resp
+            }
+            Err(err) => {
+                exchange.finish(None);
+                let mut resp = Response::new(Body::from(err.to_string()));
+                *resp.status_mut() = StatusCode::BAD_GATEWAY;
+                resp
+            }
+        }
+    }
+
+    // Issued the first time a host is connected to, and again once expired
+    fn server_config(&self, host: &str) -> Result<Arc<ServerConfig>> {
+        let now = SystemTime::now();
+        let mut configs = self.server_configs.lock().unwrap();
+        if let Some((config, expires)) = configs.get(host) {
+            if *expires > now {
+                return Ok(config.clone());
+            }
+        }
+
+        let params = CertificateParams {
+            common_name: host.to_string(),
+            dns_names: vec![host.to_string()],
+            not_before: now - BACKDATE,
+            not_after: now + VALIDITY,
+            extensions: Vec::new(),
+        };
+        let (cert, key) = x509::issue(&params, &self.key, CA_NAME, &self.ca_key)?;
+
+        let mut config = ServerConfig::builder()
+            .with_safe_defaults()
+            .with_no_client_auth()
+            .with_single_cert(
+                vec![Certificate(cert), Certificate(self.ca_cert.clone())],
+                PrivateKey(key),
+            )?;
+        config.alpn_protocols = vec![ALPN_HTTP1.to_vec()];
+
+        let config = Arc::new(config);
+        configs.insert(host.to_string(), (config.clone(), params.not_after));
+        Ok(config)
+    }
+}
+
+// The CAs destinations are verified with: those in the given bundle, or else
+// those of the image.
+fn load_roots(path: Option<&str>) -> Result<RootCertStore> {
+    let path = match path {
+        Some(path) => path,
+        None => CA_BUNDLES
+            .iter()
+            .copied()
+            .find(|path| std::path::Path::new(path).exists())
+            .ok_or_else(|| anyhow!("no CA bundle to verify destinations with"))?,
+    };
+
+    let certs = rustls_pemfile::certs(&mut BufReader::new(File::open(path)?))
+        .map_err(|err| anyhow!("invalid CA bundle {path}: {err}"))?;
+
+    let mut roots = RootCertStore::empty();
+    let (added, _) = roots.add_parsable_certificates(&certs);
+    info!("Verifying intercepted destinations with {added} CAs from {path}");
+
+    Ok(roots)
+}
+
+fn header_names(names: &Option<Vec<String>>) -> Result<Vec<HeaderName>> {
+    names
+        .iter()
+        .flatten()
+        .map(|name| {
+            HeaderName::from_bytes(name.as_bytes())
+                .map_err(|_| anyhow!("invalid header name {name}"))
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::Interceptor;
+    use crate::keypair::KeyPair;
+    use crate::manifest::MitmSpec;
+    use crate::x509::{self, CertificateParams};
+    use assert2::assert;
+    use hyper::service::service_fn;
+    use hyper::{Body, Request, Response};
+    use std::convert::Infallible;
+    use std::io::Write;
+    use std::sync::Arc;
+    use std::time::{Duration, SystemTime};
+    use tokio::net::{TcpListener, TcpStream};
+
+    async fn destination(req: Request<Body>) -> Result<Response<Body>, Infallible> {
+        let seen = match req.headers().get("x-secret") {
+            Some(_) => "leaked",
+            None => "stripped",
+        };
+        Ok(Response::builder()
+            .header("x-internal", "1")
+            .body(Body::from(seen))
+            .unwrap())
+    }
+
+    #[tokio::test]
+    async fn test_intercept() {
+        // A destination with a certificate of its own, that is trusted
+        let now = SystemTime::now();
+        let params = CertificateParams {
+            common_name: "localhost".to_string(),
+            dns_names: vec!["localhost".to_string()],
+            not_before: now - Duration::from_secs(60),
+            not_after: now + Duration::from_secs(3600),
+            extensions: Vec::new(),
+        };
+        let (cert, key) = x509::self_signed(&params, &KeyPair::generate().unwrap()).unwrap();
+        let mut bundle = tempfile::NamedTempFile::new().unwrap();
+        bundle
+            .write_all(x509::pem("CERTIFICATE", &cert).as_bytes())
+            .unwrap();
+
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        let acceptor: tokio_rustls::TlsAcceptor = crate::tls::server_config_from_der(cert, key)
+            .unwrap()
+            .into();
+        let dest_task = tokio::task::spawn(async move {
+            let (sock, _) = listener.accept().await.unwrap();
+            let tls = acceptor.accept(sock).await.unwrap();
+            _ = hyper::server::conn::Http::new()
+                .serve_connection(tls, service_fn(destination))
+                .await;
+        });
+
+        let interceptor = Arc::new(
+            Interceptor::new(&MitmSpec {
+                hosts: vec!["localhost".to_string()],
+                ca_cert_path: None,
+                trusted_ca_path: Some(bundle.path().display().to_string()),
+                strip_request_headers: Some(vec!["X-Secret".to_string()]),
+                strip_response_headers: Some(vec!["x-internal".to_string()]),
+            })
+            .unwrap(),
+        );
+
+        let (app, tunnel) = tokio::io::duplex(64 * 1024);
+        let remote = TcpStream::connect(addr).await.unwrap();
+        let serve_task = tokio::task::spawn(interceptor.clone().serve(
+            tunnel,
+            remote,
+            "localhost",
+            "127.0.0.1:1234".parse().unwrap(),
+        ));
+
+        // The app trusts the CA of the enclave
+        let ca_certs = rustls_pemfile::certs(&mut interceptor.ca_cert_pem().as_bytes()).unwrap();
+        let mut roots = rustls::RootCertStore::empty();
+        roots
+            .add(&rustls::Certificate(ca_certs[0].clone()))
+            .unwrap();
+        let config = rustls::ClientConfig::builder()
+            .with_safe_defaults()
+            .with_root_certificates(roots)
+            .with_no_client_auth();
+        let connector = tokio_rustls::TlsConnector::from(Arc::new(config));
+        let tls = connector
+            .connect(rustls::ServerName::try_from("localhost").unwrap(), app)
+            .await
+            .unwrap();
+
+        let (mut sender, conn) = hyper::client::conn::handshake(tls).await.unwrap();
+        tokio::task::spawn(conn);
+
+        let req = Request::builder()
+            .uri("/audit")
+            .header("host", "localhost")
+            .header("x-secret", "hunter2")
+            .body(Body::empty())
+            .unwrap();
+        let resp = sender.send_request(req).await.unwrap();
+
+        assert!(resp.status() == 200);
+        assert!(resp.headers().get("x-internal").is_none());
+        let body = hyper::body::to_bytes(resp.into_body()).await.unwrap();
+        assert!(&body[..] == b"stripped");
+
+        drop(sender);
+        _ = serve_task.await;
+        dest_task.abort();
+    }
+}
@@ -1,6 +1,22 @@
 pub mod aws_util;
+pub mod breaker;
+pub mod connections;
+pub mod dns;
 pub mod egress_http;
+pub mod egress_mux;
+pub mod egress_transparent;
+pub mod egress_tunnel;
+pub mod egress_udp;
 pub mod ingress;
 pub mod kms;
-
-mod pkcs7;
+pub mod middleware;
+pub mod mitm;
+pub mod pkcs7;
+pub mod proxy_protocol;
+pub mod pump;
+pub mod resolver;
+pub mod secrets;
+pub mod sni;
+pub mod socks5;
+pub mod upstream;
+pub mod vsock_pool;
@@ -4,19 +4,151 @@ use asn1_rs::{
     Any, Class, FromBer, Integer, OctetString, Oid, OptTaggedParser, SetOf, Tag, Tagged,
 };
 use cbc::cipher::crypto_common::KeyIvInit;
-use cbc::cipher::{block_padding, BlockDecryptMut};
+use cbc::cipher::{
+    block_padding, BlockDecrypt, BlockDecryptMut, BlockEncrypt, BlockEncryptMut, KeyInit,
+};
+use p384::elliptic_curve::sec1::ToEncodedPoint;
+use rand::rngs::OsRng;
+use rand::RngCore;
+use ring::{aead, digest};
 use rsa::padding::PaddingScheme;
-use rsa::RsaPrivateKey;
-use sha2::Sha256;
+use rsa::pkcs8::DecodePublicKey;
+use rsa::{PublicKey, RsaPublicKey};
+use sha2::{Digest, Sha256};
+use std::fmt;
+use std::io::{self, Read};
+use zeroize::Zeroizing;
+
+use crate::keypair::{Decrypter, KeyType, OaepHash, OaepParams, Signer};
+use crate::x509::{self, der};
 
 type Aes256CbcDec = cbc::Decryptor<aes::Aes256>;
+type Aes256CbcEnc = cbc::Encryptor<aes::Aes256>;
+
+const DATA_KEY_LEN: usize = 32;
+const CBC_IV_LEN: usize = 16;
+
+// Of each of the parts before the content when streaming, which are buffered
+const MAX_HEADER_LEN: usize = 256 * 1024;
+// What ContentReader reads from the source at a time
+const STREAM_CHUNK_LEN: usize = 16 * 1024;
+// Of constructed encodings within one another, as asn1-rs allows, for input
+// not to overflow the stack
+const MAX_BER_DEPTH: usize = 50;
+// Of the base 128 number of a high tag, enough for a u32
+const MAX_TAG_NUMBER_LEN: usize = 5;
+
+// The default IV of AES key wrap (RFC 3394, 2.2.3.1)
+const KEY_WRAP_IV: [u8; 8] = [0xa6; 8];
+
+// [0] IMPLICIT, of subjectKeyIdentifier and of encryptedContent
+const TAG_IMPLICIT_0: u8 = 0x80;
 
 const OID_NIST_SHA_256: Oid<'static> = oid!(2.16.840 .1 .101 .3 .4 .2 .1);
+const OID_NIST_SHA_384: Oid<'static> = oid!(2.16.840 .1 .101 .3 .4 .2 .2);
+const OID_NIST_SHA_512: Oid<'static> = oid!(2.16.840 .1 .101 .3 .4 .2 .3);
 const OID_NIST_AES256_CBC: Oid<'static> = oid!(2.16.840 .1 .101 .3 .4 .1 .42);
+const OID_NIST_AES256_GCM: Oid<'static> = oid!(2.16.840 .1 .101 .3 .4 .1 .46);
+const OID_NIST_AES128_WRAP: Oid<'static> = oid!(2.16.840 .1 .101 .3 .4 .1 .5);
+const OID_NIST_AES192_WRAP: Oid<'static> = oid!(2.16.840 .1 .101 .3 .4 .1 .25);
+const OID_NIST_AES256_WRAP: Oid<'static> = oid!(2.16.840 .1 .101 .3 .4 .1 .45);
+const OID_EC_PUBLIC_KEY: Oid<'static> = oid!(1.2.840 .10045 .2 .1);
+const OID_SECP384R1: Oid<'static> = oid!(1.3.132 .0 .34);
+// dhSinglePass-stdDH-sha*kdf-scheme and dhSinglePass-cofactorDH-sha*kdf-scheme
+// (RFC 5753), which are the same on P-384 as its cofactor is 1
+const OID_STD_DH_SHA256_KDF: Oid<'static> = oid!(1.3.132 .1 .11 .1);
+const OID_STD_DH_SHA384_KDF: Oid<'static> = oid!(1.3.132 .1 .11 .2);
+const OID_STD_DH_SHA512_KDF: Oid<'static> = oid!(1.3.132 .1 .11 .3);
+const OID_COFACTOR_DH_SHA256_KDF: Oid<'static> = oid!(1.3.132 .1 .14 .1);
+const OID_COFACTOR_DH_SHA384_KDF: Oid<'static> = oid!(1.3.132 .1 .14 .2);
+const OID_COFACTOR_DH_SHA512_KDF: Oid<'static> = oid!(1.3.132 .1 .14 .3);
 const OID_PKCS1_RSA_OAEP: Oid<'static> = oid!(1.2.840 .113549 .1 .1 .7);
 const OID_PKCS1_MGF: Oid<'static> = oid!(1.2.840 .113549 .1 .1 .8);
 const OID_PKCS7_ENVELOPED_DATA: Oid<'static> = oid!(1.2.840 .113549 .1 .7 .3);
 const OID_PKCS7_DATA: Oid<'static> = oid!(1.2.840 .113549 .1 .7 .1);
+const OID_PKCS7_SIGNED_DATA: Oid<'static> = oid!(1.2.840 .113549 .1 .7 .2);
+const OID_PKCS9_CONTENT_TYPE: Oid<'static> = oid!(1.2.840 .113549 .1 .9 .3);
+const OID_PKCS9_MESSAGE_DIGEST: Oid<'static> = oid!(1.2.840 .113549 .1 .9 .4);
+const OID_PKCS1_RSA_ENCRYPTION: Oid<'static> = oid!(1.2.840 .113549 .1 .1 .1);
+const OID_PKCS1_SHA256_WITH_RSA: Oid<'static> = oid!(1.2.840 .113549 .1 .1 .11);
+const OID_PKCS1_SHA384_WITH_RSA: Oid<'static> = oid!(1.2.840 .113549 .1 .1 .12);
+const OID_PKCS1_SHA512_WITH_RSA: Oid<'static> = oid!(1.2.840 .113549 .1 .1 .13);
+const OID_ECDSA_WITH_SHA256: Oid<'static> = oid!(1.2.840 .10045 .4 .3 .2);
+const OID_ECDSA_WITH_SHA384: Oid<'static> = oid!(1.2.840 .10045 .4 .3 .3);
+const OID_ED25519: Oid<'static> = oid!(1.3.101 .112);
+
+// An algorithm of the sender's that cannot be decrypted here, e.g. RSA-OAEP
+// over SHA-1, for callers to tell apart from malformed input
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct UnsupportedAlgorithm {
+    pub field: &'static str,
+    pub algorithm: String,
+}
+
+impl fmt::Display for UnsupportedAlgorithm {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "unsupported {}: {}", self.field, self.algorithm)
+    }
+}
+
+impl std::error::Error for UnsupportedAlgorithm {}
+
+// Any failure to decrypt with the key: of RSA-OAEP, the key unwrap, the
+// padding or the ICV. Which one is not told, for errors not to be an oracle
+// of the plaintext, e.g. for Bleichenbacher's or Vaudenay's attacks.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct DecryptionFailed;
+
+impl fmt::Display for DecryptionFailed {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "the content does not decrypt with the key")
+    }
+}
+
+impl std::error::Error for DecryptionFailed {}
+
+// The key is none of the recipients, which are these, along with the tags of
+// recipients of other kinds, e.g. 2 for a KEKRecipientInfo
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct NoMatchingRecipient {
+    pub recipients: Vec<RecipientId>,
+    pub unsupported: Vec<u32>,
+}
+
+impl fmt::Display for NoMatchingRecipient {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let mut recipients: Vec<String> = self.recipients.iter().map(|id| id.to_string()).collect();
+        for tag in &self.unsupported {
+            recipients.push(format!("unsupported recipient [{tag}]"));
+        }
+        write!(
+            f,
+            "the key is none of the recipients, which are: {}",
+            recipients.join("; ")
+        )
+    }
+}
+
+impl std::error::Error for NoMatchingRecipient {}
+
+// The input does not parse, or is not as RFC 5652 has it
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MalformedContent(pub String);
+
+impl fmt::Display for MalformedContent {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.0)
+    }
+}
+
+impl std::error::Error for MalformedContent {}
+
+// As anyhow!(), of a MalformedContent
+macro_rules! malformed {
+    ($($arg:tt)*) => {
+        anyhow::Error::from(MalformedContent(format!($($arg)*)))
+    };
+}
 
 /*
 ContentInfo ::= SEQUENCE {
@@ -34,10 +166,11 @@ pub struct ContentInfo<'a> {
 
 impl<'a> ContentInfo<'a> {
     pub fn parse_ber(ber: &'a [u8]) -> Result<Self> {
-        let (rem, ci) = Self::from_ber(&ber)?;
+        let (rem, ci) =
+            Self::from_ber(ber).map_err(|err| malformed!("invalid ContentInfo: {err}"))?;
 
         if !rem.is_empty() {
-            return Err(anyhow!(
+            return Err(malformed!(
                 "trailing {} bytes after parsing ContentInfo",
                 rem.len()
             ));
@@ -50,7 +183,7 @@ impl<'a> ContentInfo<'a> {
 
     fn validate(&self) -> Result<()> {
         if self.content_type != OID_PKCS7_ENVELOPED_DATA {
-            return Err(anyhow!(
+            return Err(malformed!(
                 "unexpected content type: {}, expected {}",
                 self.content_type,
                 OID_PKCS7_ENVELOPED_DATA
@@ -60,28 +193,196 @@ impl<'a> ContentInfo<'a> {
         self.content.validate()
     }
 
-    pub fn decrypt_content(&self, priv_key: &RsaPrivateKey) -> Result<Vec<u8>> {
-        let datakey = self.decrypt_key(priv_key)?;
+    pub fn recipients(&self) -> Result<Vec<RecipientId>> {
+        let mut recipients = Vec::new();
+        for info in self.content.recipient_infos.iter() {
+            match info {
+                RecipientInfo::KeyTrans(ktri) => recipients.push(ktri.recipient_id()?),
+                RecipientInfo::KeyAgree(kari) => {
+                    for rek in kari.recipient_encrypted_keys.iter() {
+                        recipients.push(rek.recipient_id()?);
+                    }
+                }
+                RecipientInfo::Kek(kekri) => recipients.push(kekri.recipient_id()?),
+                RecipientInfo::Other(_) => (),
+            }
+        }
+
+        Ok(recipients)
+    }
+
+    // For the recipient identified by the SHA-256 of the key's
+    // SubjectPublicKeyInfo, as KMS identifies it
+    pub fn decrypt_content(&self, key: &dyn Decrypter) -> Result<Vec<u8>> {
+        self.decrypt_content_for(key, None)
+    }
+
+    // As decrypt_content(), or for the recipient identified by the issuer and
+    // serial number of the key's certificate (in DER)
+    pub fn decrypt_content_with_certificate(
+        &self,
+        key: &dyn Decrypter,
+        cert: &[u8],
+    ) -> Result<Vec<u8>> {
+        self.decrypt_content_for(key, Some(cert))
+    }
+
+    // For the recipient of a key encryption key shared with the sender, e.g.
+    // by an HSM, by the keyIdentifier it is known as
+    pub fn decrypt_content_with_kek(&self, key_id: &[u8], kek: &[u8]) -> Result<Vec<u8>> {
+        let datakey = self.unwrap_key(key_id, kek)?;
+        Ok(self
+            .content
+            .encrypted_content_info
+            .decrypt_content(&datakey)?)
+    }
+
+    fn decrypt_content_for(&self, key: &dyn Decrypter, cert: Option<&[u8]>) -> Result<Vec<u8>> {
+        let datakey = self.decrypt_key(key, cert)?;
         Ok(self
             .content
             .encrypted_content_info
             .decrypt_content(&datakey)?)
     }
 
-    fn decrypt_key(&self, priv_key: &RsaPrivateKey) -> Result<Vec<u8>> {
-        let ciphertext = self
+    fn decrypt_key(&self, key: &dyn Decrypter, cert: Option<&[u8]>) -> Result<Vec<u8>> {
+        let mut ids = vec![RecipientId::SubjectKeyIdentifier(
+            Sha256::digest(key.public_key_as_der()?).to_vec(),
+        )];
+        if let Some(cert) = cert {
+            let (issuer, serial) = x509::issuer_and_serial(cert)?;
+            ids.push(RecipientId::IssuerAndSerialNumber { issuer, serial });
+        }
+
+        for info in self.content.recipient_infos.iter() {
+            match info {
+                RecipientInfo::KeyTrans(ktri) => {
+                    if ids.contains(&ktri.recipient_id()?) {
+                        let params = ktri.oaep_params()?;
+                        // A data key that does not decrypt is replaced with a
+                        // random one, to fail as the content does (RFC 3218, 2.3)
+                        return match key.decrypt_oaep(ktri.encrypted_key.as_ref(), params) {
+                            Ok(datakey) if datakey.len() == DATA_KEY_LEN => Ok(datakey),
+                            _ => Ok(random_data_key()),
+                        };
+                    }
+                }
+                RecipientInfo::KeyAgree(kari) => {
+                    for rek in kari.recipient_encrypted_keys.iter() {
+                        if ids.contains(&rek.recipient_id()?) {
+                            let datakey = kari.unwrap_key(key, rek.encrypted_key.as_ref())?;
+                            if datakey.len() != DATA_KEY_LEN {
+                                return Err(DecryptionFailed.into());
+                            }
+                            return Ok(datakey);
+                        }
+                    }
+                }
+                RecipientInfo::Kek(_) | RecipientInfo::Other(_) => (),
+            }
+        }
+
+        Err(self.no_matching_recipient()?.into())
+    }
+
+    fn unwrap_key(&self, key_id: &[u8], kek: &[u8]) -> Result<Vec<u8>> {
+        for info in self.content.recipient_infos.iter() {
+            if let RecipientInfo::Kek(kekri) = info {
+                if kekri.key_id()? == key_id {
+                    let datakey = kekri.unwrap_key(kek)?;
+                    if datakey.len() != DATA_KEY_LEN {
+                        return Err(DecryptionFailed.into());
+                    }
+                    return Ok(datakey);
+                }
+            }
+        }
+
+        Err(self.no_matching_recipient()?.into())
+    }
+
+    fn no_matching_recipient(&self) -> Result<NoMatchingRecipient> {
+        let unsupported = self
             .content
             .recipient_infos
             .iter()
-            .next()
-            .unwrap()
-            .encrypted_key
-            .as_ref();
+            .filter_map(|info| match info {
+                RecipientInfo::Other(any) => Some(any.header.tag().0),
+                _ => None,
+            })
+            .collect();
+
+        Ok(NoMatchingRecipient {
+            recipients: self.recipients()?,
+            unsupported,
+        })
+    }
+}
+
+// A summary for people, e.g. to see why a key is none of the recipients
+impl<'a> fmt::Display for ContentInfo<'a> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let ed = &self.content;
+        let version = ed.version.as_i32().map_err(|_| fmt::Error)?;
+        writeln!(f, "Content type:  {} (envelopedData)", self.content_type)?;
+        writeln!(f, "Version:       {version}")?;
+
+        writeln!(f, "Recipients:")?;
+        for info in ed.recipient_infos.iter() {
+            match info {
+                RecipientInfo::KeyTrans(ktri) => {
+                    let algorithm = match ktri.oaep_params() {
+                        Ok(params) => format!(
+                            "RSA-OAEP, {:?} with MGF1 {:?}",
+                            params.hash, params.mgf_hash
+                        ),
+                        Err(_) => ktri.key_encryption_algorithm.algorithm.to_string(),
+                    };
+                    write_recipient(f, ktri.recipient_id(), &algorithm)?;
+                }
+                RecipientInfo::KeyAgree(kari) => {
+                    let algorithm = format!("ECDH, {}", kari.key_encryption_algorithm.algorithm);
+                    for rek in kari.recipient_encrypted_keys.iter() {
+                        write_recipient(f, rek.recipient_id(), &algorithm)?;
+                    }
+                }
+                RecipientInfo::Kek(kekri) => {
+                    let algorithm =
+                        format!("AES key wrap, {}", kekri.key_encryption_algorithm.algorithm);
+                    write_recipient(f, kekri.recipient_id(), &algorithm)?;
+                }
+                RecipientInfo::Other(any) => {
+                    writeln!(f, "  unsupported recipient [{}]", any.header.tag().0)?;
+                }
+            }
+        }
 
-        let padding = PaddingScheme::new_oaep_with_mgf_hash::<Sha256, Sha256>();
+        let eci = &ed.encrypted_content_info;
+        let algorithm = &eci.content_encryption_algorithm.algorithm;
+        let cipher = if *algorithm == OID_NIST_AES256_GCM {
+            "AES-256-GCM".to_string()
+        } else if *algorithm == OID_NIST_AES256_CBC {
+            "AES-256-CBC".to_string()
+        } else {
+            algorithm.to_string()
+        };
+        match eci.combined_content() {
+            Ok(content) => writeln!(f, "Content:       {cipher}, {} bytes", content.len()),
+            Err(err) => writeln!(f, "Content:       {cipher}, unreadable ({err})"),
+        }
+    }
+}
 
-        Ok(priv_key.decrypt(padding, ciphertext)?)
+fn write_recipient(
+    f: &mut fmt::Formatter<'_>,
+    id: Result<RecipientId>,
+    algorithm: &str,
+) -> fmt::Result {
+    match id {
+        Ok(id) => writeln!(f, "  {id}")?,
+        Err(err) => writeln!(f, "  unreadable ({err})")?,
     }
+    writeln!(f, "    {algorithm}")
 }
 
 /*
@@ -103,7 +404,7 @@ pub struct EnvelopedData<'a> {
     #[tag_implicit(0)]
     pub originator_info: Option<OriginatorInfo<'a>>,
 
-    pub recipient_infos: SetOf<KeyTransRecipientInfo<'a>>,
+    pub recipient_infos: SetOf<RecipientInfo<'a>>,
 
     pub encrypted_content_info: EncryptedContentInfo<'a>,
 
@@ -114,21 +415,23 @@ pub struct EnvelopedData<'a> {
 
 impl<'a> EnvelopedData<'a> {
     fn validate(&self) -> Result<()> {
+        // 0 if all recipients are KeyTransRecipientInfo by issuerAndSerialNumber
         let ver = self.version.as_i32()?;
-        if ver != 2 {
-            return Err(anyhow!(
-                "unexpected EnvelopedData.version: {ver}, expected 2"
+        if ver != 0 && ver != 2 {
+            return Err(malformed!(
+                "unexpected EnvelopedData.version: {ver}, expected 0 or 2"
             ));
         }
 
-        if self.recipient_infos.len() != 1 {
-            return Err(anyhow!(
-                "unexpected EnvelopedData.recipient_infos length: {}, expected 1",
-                self.recipient_infos.len()
+        if self.recipient_infos.is_empty() {
+            return Err(malformed!(
+                "unexpected EnvelopedData.recipient_infos length: 0, expected at least 1"
             ));
         }
 
-        self.recipient_infos.iter().next().unwrap().validate()?;
+        for recipient in self.recipient_infos.iter() {
+            recipient.validate()?;
+        }
 
         self.encrypted_content_info.validate()
     }
@@ -168,6 +471,44 @@ KeyTransRecipientInfo ::= SEQUENCE {
   encryptedKey EncryptedKey }
 */
 
+// Recipients of other kinds are kept as is, for the key to be any of the
+// others
+#[derive(Debug)]
+pub enum RecipientInfo<'a> {
+    KeyTrans(KeyTransRecipientInfo<'a>),
+    KeyAgree(KeyAgreeRecipientInfo<'a>),
+    Kek(KekRecipientInfo<'a>),
+    Other(Any<'a>),
+}
+
+impl<'a> RecipientInfo<'a> {
+    fn validate(&self) -> Result<()> {
+        match self {
+            Self::KeyTrans(ktri) => ktri.validate(),
+            Self::KeyAgree(kari) => kari.validate(),
+            Self::Kek(kekri) => kekri.validate(),
+            Self::Other(_) => Ok(()),
+        }
+    }
+}
+
+impl<'a> TryFrom<Any<'a>> for RecipientInfo<'a> {
+    type Error = asn1_rs::Error;
+
+    fn try_from(value: Any<'a>) -> Result<Self, Self::Error> {
+        let (class, tag) = (value.header.class(), value.header.tag());
+        if class == Class::Universal && tag == Tag::Sequence {
+            Ok(Self::KeyTrans(value.try_into()?))
+        } else if class == Class::ContextSpecific && tag.0 == 1 {
+            Ok(Self::KeyAgree(KeyAgreeRecipientInfo::parse(value.data)?))
+        } else if class == Class::ContextSpecific && tag.0 == 2 {
+            Ok(Self::Kek(KekRecipientInfo::parse(value.data)?))
+        } else {
+            Ok(Self::Other(value))
+        }
+    }
+}
+
 #[derive(BerSequence, Debug)]
 pub struct KeyTransRecipientInfo<'a> {
     pub version: Integer<'a>,
@@ -178,250 +519,2079 @@ pub struct KeyTransRecipientInfo<'a> {
 
 impl<'a> KeyTransRecipientInfo<'a> {
     fn validate(&self) -> Result<()> {
+        // 0 for issuerAndSerialNumber, 2 for subjectKeyIdentifier
         let ver = self.version.as_i32()?;
-        if ver != 2 {
-            return Err(anyhow!(
-                "unexpected KeyTransRecipientInfo.version: {ver}, expected 2"
+        if ver != 0 && ver != 2 {
+            return Err(malformed!(
+                "unexpected KeyTransRecipientInfo.version: {ver}, expected 0 or 2"
             ));
         }
 
+        self.recipient_id()?;
+
         let key_algo = &self.key_encryption_algorithm;
 
         if key_algo.algorithm != OID_PKCS1_RSA_OAEP {
-            return Err(anyhow!("unexpected KeyTransRecipientInfo.key_encryption_algorithm.algorithm: {}, expected {OID_PKCS1_RSA_OAEP}",
-                key_algo.algorithm));
+            return Err(UnsupportedAlgorithm {
+                field: "KeyTransRecipientInfo.key_encryption_algorithm",
+                algorithm: key_algo.algorithm.to_string(),
+            }
+            .into());
         }
 
-        if let Some(ref params) = key_algo.parameters {
-            let rsa_oaep_params: RsaesOaepParameters<'a> = params.clone().try_into()?;
-            rsa_oaep_params.validate()?;
-        } else {
-            return Err(anyhow!(
+        self.oaep_params()?;
+        Ok(())
+    }
+
+    fn oaep_params(&self) -> Result<OaepParams> {
+        match self.key_encryption_algorithm.parameters {
+            Some(ref params) => {
+                let rsa_oaep_params: RsaesOaepParameters<'a> = params.clone().try_into()?;
+                rsa_oaep_params.oaep_params()
+            }
+            None => Err(malformed!(
                 "Missing KeyTransRecipientInfo.key_encryption_algorithm.parameters"
-            ));
+            )),
         }
+    }
 
-        Ok(())
+    fn recipient_id(&self) -> Result<RecipientId> {
+        RecipientId::parse(&self.rid)
     }
 }
 
 /*
-RecipientIdentifier ::= CHOICE {
+KeyAgreeRecipientInfo ::= SEQUENCE {
+  version CMSVersion,  -- always set to 3
+  originator [0] EXPLICIT OriginatorIdentifierOrKey,
+  ukm [1] EXPLICIT UserKeyingMaterial OPTIONAL,
+  keyEncryptionAlgorithm KeyEncryptionAlgorithmIdentifier,
+  recipientEncryptedKeys RecipientEncryptedKeys }
+
+OriginatorIdentifierOrKey ::= CHOICE {
   issuerAndSerialNumber IssuerAndSerialNumber,
-  subjectKeyIdentifier [0] SubjectKeyIdentifier }
+  subjectKeyIdentifier [0] SubjectKeyIdentifier,
+  originatorKey [1] OriginatorPublicKey }
 
-AlgorithmIdentifier{ALGORITHM-TYPE, ALGORITHM-TYPE:AlgorithmSet} ::=
-  SEQUENCE {
-    algorithm   ALGORITHM-TYPE.&id({AlgorithmSet}),
-      parameters  ALGORITHM-TYPE.
-             &Params({AlgorithmSet}{@algorithm}) OPTIONAL
-  }
+OriginatorPublicKey ::= SEQUENCE {
+  algorithm AlgorithmIdentifier,
+  publicKey BIT STRING }
 
-EncryptedKey ::= OCTET STRING
+RecipientEncryptedKeys ::= SEQUENCE OF RecipientEncryptedKey
 */
 
-#[derive(BerSequence, Debug)]
-pub struct AlgorithmIdentifier<'a> {
-    pub algorithm: Oid<'a>,
-
-    #[optional]
-    pub parameters: Option<Any<'a>>,
+// As RFC 5753 has it, with an ephemeral key of the sender's for ECDH on
+// P-384, an X9.63 KDF and AES key wrap
+#[derive(Debug)]
+pub struct KeyAgreeRecipientInfo<'a> {
+    pub version: Integer<'a>,
+    pub originator: Any<'a>,
+    pub ukm: Option<OctetString<'a>>,
+    pub key_encryption_algorithm: AlgorithmIdentifier<'a>,
+    pub recipient_encrypted_keys: Vec<RecipientEncryptedKey<'a>>,
 }
 
-/*
-RSAES-OAEP-params  ::=  SEQUENCE  {
-  hashFunc    [0] AlgorithmIdentifier DEFAULT sha1Identifier,
-  maskGenFunc [1] AlgorithmIdentifier DEFAULT mgf1SHA1Identifier,
-  pSourceFunc [2] AlgorithmIdentifier DEFAULT
-                    pSpecifiedEmptyIdentifier  }
-*/
+impl<'a> KeyAgreeRecipientInfo<'a> {
+    // The content of the [1] IMPLICIT it is tagged with
+    fn parse(i: &'a [u8]) -> Result<Self, asn1_rs::Error> {
+        let (i, version) = Integer::from_ber(i)?;
+        let (i, originator) = Any::from_ber(i)?;
+        let (i, ukm) = OptTaggedParser::new(Class::ContextSpecific, Tag(1))
+            .parse_ber(i, |_, inner| OctetString::from_ber(inner))?;
+        let (i, key_encryption_algorithm) = AlgorithmIdentifier::from_ber(i)?;
+        let (_, recipient_encrypted_keys) = <Vec<RecipientEncryptedKey>>::from_ber(i)?;
 
-#[derive(Debug)]
-pub struct RsaesOaepParameters<'a> {
-    hash_alg: Option<AlgorithmIdentifier<'a>>,
-    mask_gen_alg: Option<AlgorithmIdentifier<'a>>,
-    _p_source_alg: Option<AlgorithmIdentifier<'a>>,
-}
+        Ok(Self {
+            version,
+            originator,
+            ukm,
+            key_encryption_algorithm,
+            recipient_encrypted_keys,
+        })
+    }
 
-impl<'a> RsaesOaepParameters<'a> {
     fn validate(&self) -> Result<()> {
-        if let Some(ref alg) = self.hash_alg {
-            if alg.algorithm != OID_NIST_SHA_256 {
-                return Err(anyhow!("unexpected KeyTransRecipientInfo.key_encryption_algorithm.hash_func: {}, expected {OID_NIST_SHA_256}",
-                    alg.algorithm));
+        let ver = self.version.as_i32()?;
+        if ver != 3 {
+            return Err(malformed!(
+                "unexpected KeyAgreeRecipientInfo.version: {ver}, expected 3"
+            ));
+        }
+
+        self.originator_key()?;
+        self.kdf_hash()?;
+        self.key_wrap_algorithm()?;
+        for rek in self.recipient_encrypted_keys.iter() {
+            rek.recipient_id()?;
+        }
+
+        Ok(())
+    }
+
+    // The point of the sender's ephemeral key, which is all RFC 5753 allows
+    fn originator_key(&self) -> Result<&'a [u8]> {
+        if self.originator.header.class() != Class::ContextSpecific
+            || self.originator.header.tag().0 != 0
+        {
+            return Err(malformed!(
+                "unexpected KeyAgreeRecipientInfo.originator tag, expected [0]"
+            ));
+        }
+
+        let (_, key) = Any::from_ber(self.originator.data)?;
+        if key.header.class() != Class::ContextSpecific || key.header.tag().0 != 1 {
+            return Err(UnsupportedAlgorithm {
+                field: "key_agree_recipient_info.originator",
+                algorithm: "an originator identified by its certificate".to_string(),
             }
-        } else {
-            return Err(anyhow!("missing KeyTransRecipientInfo.key_encryption_algorithm.hash_func, expected {OID_NIST_SHA_256}"));
+            .into());
+        }
+
+        let (i, algorithm) = AlgorithmIdentifier::from_ber(key.data)?;
+        if algorithm.algorithm != OID_EC_PUBLIC_KEY {
+            return Err(UnsupportedAlgorithm {
+                field: "key_agree_recipient_info.originator.algorithm",
+                algorithm: algorithm.algorithm.to_string(),
+            }
+            .into());
+        }
+
+        // The BIT STRING has no unused bits
+        let (_, public_key) = der::Reader(i).expect(0x03)?;
+        match public_key.split_first() {
+            Some((0, point)) => Ok(point),
+            _ => Err(malformed!(
+                "invalid KeyAgreeRecipientInfo.originator public key"
+            )),
         }
+    }
 
-        if let Some(ref alg) = self.mask_gen_alg {
-            if alg.algorithm != OID_PKCS1_MGF {
-                return Err(anyhow!("unexpected KeyTransRecipientInfo.key_encryption_algorithm.mask_gen_func: {}, expected {OID_PKCS1_MGF}",
-                    alg.algorithm));
+    fn kdf_hash(&self) -> Result<&'static digest::Algorithm> {
+        let oid = &self.key_encryption_algorithm.algorithm;
+        if *oid == OID_STD_DH_SHA256_KDF || *oid == OID_COFACTOR_DH_SHA256_KDF {
+            Ok(&digest::SHA256)
+        } else if *oid == OID_STD_DH_SHA384_KDF || *oid == OID_COFACTOR_DH_SHA384_KDF {
+            Ok(&digest::SHA384)
+        } else if *oid == OID_STD_DH_SHA512_KDF || *oid == OID_COFACTOR_DH_SHA512_KDF {
+            Ok(&digest::SHA512)
+        } else {
+            Err(UnsupportedAlgorithm {
+                field: "key_agree_recipient_info.key_encryption_algorithm",
+                algorithm: oid.to_string(),
             }
+            .into())
+        }
+    }
 
-            if let Some(ref params) = alg.parameters {
-                let (_, mgf_hash) = Oid::from_ber(params.as_bytes())?;
-                if mgf_hash != OID_NIST_SHA_256 {
-                    return Err(anyhow!("unexpected KeyTransRecipientInfo.key_encryption_algorithm.mask_gen_func.hash: {}, expected {OID_NIST_SHA_256}",
-                        mgf_hash));
-                }
-            } else {
-                return Err(anyhow!("missing KeyTransRecipientInfo.key_encryption_algorithm.mask_gen_func.parameters"));
+    // The algorithm, and the length of its key
+    fn key_wrap_algorithm(&self) -> Result<(Oid<'a>, usize)> {
+        let params = match self.key_encryption_algorithm.parameters {
+            Some(ref params) => params,
+            None => {
+                return Err(malformed!(
+                    "missing KeyAgreeRecipientInfo.key_encryption_algorithm.parameters"
+                ))
             }
+        };
+
+        let wrap: AlgorithmIdentifier<'a> = params.clone().try_into()?;
+        if wrap.algorithm == OID_NIST_AES128_WRAP {
+            Ok((wrap.algorithm, 16))
+        } else if wrap.algorithm == OID_NIST_AES256_WRAP {
+            Ok((wrap.algorithm, 32))
         } else {
-            return Err(anyhow!("missing KeyTransRecipientInfo.key_encryption_algorithm.parameters.mask_gen_func, expected {OID_PKCS1_MGF}"));
+            Err(UnsupportedAlgorithm {
+                field: "key_agree_recipient_info.key_encryption_algorithm.key_wrap",
+                algorithm: wrap.algorithm.to_string(),
+            }
+            .into())
         }
+    }
 
-        Ok(())
+    fn unwrap_key(&self, key: &dyn Decrypter, encrypted_key: &[u8]) -> Result<Vec<u8>> {
+        let (wrap, kek_len) = self.key_wrap_algorithm()?;
+        let shared = Zeroizing::new(key.ecdh(self.originator_key()?)?);
+        let ukm: Option<&[u8]> = self.ukm.as_ref().map(|ukm| ukm.as_ref());
+        let shared_info = ecc_cms_shared_info(&wrap, ukm, kek_len);
+        let kek = x963_kdf(self.kdf_hash()?, &shared, &shared_info, kek_len);
+
+        aes_key_unwrap(&Kek::new(&kek)?, encrypted_key).map_err(|_| DecryptionFailed.into())
     }
 }
 
-impl<'a> TryFrom<Any<'a>> for RsaesOaepParameters<'a> {
-    type Error = asn1_rs::Error;
+/*
+RecipientEncryptedKey ::= SEQUENCE {
+  rid KeyAgreeRecipientIdentifier,
+  encryptedKey EncryptedKey }
+*/
 
-    fn try_from(value: Any<'a>) -> Result<Self, Self::Error> {
-        Self::try_from(&value)
-    }
+#[derive(BerSequence, Debug)]
+pub struct RecipientEncryptedKey<'a> {
+    pub rid: Any<'a>,
+    pub encrypted_key: OctetString<'a>,
 }
 
-//     hashFunc          [0] AlgorithmIdentifier DEFAULT
-//                              sha1Identifier,
-//     maskGenFunc       [1] AlgorithmIdentifier DEFAULT
-//                              mgf1SHA1Identifier,
-//     pSourceFunc       [2] AlgorithmIdentifier DEFAULT
-//                              pSpecifiedEmptyIdentifier  }
-impl<'a, 'b> TryFrom<&'b Any<'a>> for RsaesOaepParameters<'a> {
-    type Error = asn1_rs::Error;
+impl<'a> RecipientEncryptedKey<'a> {
+    fn recipient_id(&self) -> Result<RecipientId> {
+        RecipientId::parse_key_agree(&self.rid)
+    }
+}
 
-    fn try_from(value: &'b Any<'a>) -> Result<Self, Self::Error> {
-        value.tag().assert_eq(Tag::Sequence)?;
-        let i = &value.data;
+/*
+KEKRecipientInfo ::= SEQUENCE {
+  version CMSVersion,  -- always set to 4
+  kekid KEKIdentifier,
+  keyEncryptionAlgorithm KeyEncryptionAlgorithmIdentifier,
+  encryptedKey EncryptedKey }
 
-        let (i, hash_alg) = OptTaggedParser::new(Class::ContextSpecific, Tag(0))
-            .parse_ber(i, |_, inner| AlgorithmIdentifier::from_ber(inner))?;
+KEKIdentifier ::= SEQUENCE {
+  keyIdentifier OCTET STRING,
+  date GeneralizedTime OPTIONAL,
+  other OtherKeyAttribute OPTIONAL }
+*/
 
-        let (i, mask_gen_alg) = OptTaggedParser::new(Class::ContextSpecific, Tag(1))
-            .parse_ber(i, |_, inner| AlgorithmIdentifier::from_ber(inner))?;
+// The data key wrapped with AES key wrap by a key the sender already shares
+// with the recipient, as HSMs do
+#[derive(Debug)]
+pub struct KekRecipientInfo<'a> {
+    pub version: Integer<'a>,
+    pub kekid: Any<'a>,
+    pub key_encryption_algorithm: AlgorithmIdentifier<'a>,
+    pub encrypted_key: OctetString<'a>,
+}
 
-        let (_, p_source_alg) = OptTaggedParser::new(Class::ContextSpecific, Tag(2))
-            .parse_ber(i, |_, inner| AlgorithmIdentifier::from_ber(inner))?;
+impl<'a> KekRecipientInfo<'a> {
+    // The content of the [2] IMPLICIT it is tagged with
+    fn parse(i: &'a [u8]) -> Result<Self, asn1_rs::Error> {
+        let (i, version) = Integer::from_ber(i)?;
+        let (i, kekid) = Any::from_ber(i)?;
+        let (i, key_encryption_algorithm) = AlgorithmIdentifier::from_ber(i)?;
+        let (_, encrypted_key) = OctetString::from_ber(i)?;
 
         Ok(Self {
-            hash_alg,
-            mask_gen_alg,
-            _p_source_alg: p_source_alg,
+            version,
+            kekid,
+            key_encryption_algorithm,
+            encrypted_key,
         })
     }
-}
-
-pub type Aes256CBCParameter<'a> = OctetString<'a>;
 
-/*
-EncryptedContentInfo ::= SEQUENCE {
-  contentType ContentType,
-  contentEncryptionAlgorithm ContentEncryptionAlgorithmIdentifier,
-  encryptedContent [0] IMPLICIT EncryptedContent OPTIONAL }
-*/
+    fn validate(&self) -> Result<()> {
+        let ver = self.version.as_i32()?;
+        if ver != 4 {
+            return Err(malformed!(
+                "unexpected KEKRecipientInfo.version: {ver}, expected 4"
+            ));
+        }
 
-#[derive(BerSequence, Debug)]
-pub struct EncryptedContentInfo<'a> {
-    pub content_type: Oid<'a>,
-    pub content_encryption_algorithm: AlgorithmIdentifier<'a>,
-    pub encrypted_content: Any<'a>,
-}
+        self.key_id()?;
+        self.kek_len()?;
+        Ok(())
+    }
 
-impl<'a> EncryptedContentInfo<'a> {
-    fn validate(&self) -> Result<()> {
-        if self.content_type != OID_PKCS7_DATA {
-            return Err(anyhow!(
-                "unexpected EncryptedContentInfo.content_type: {}, expected {OID_PKCS7_DATA}",
-                self.content_type
+    // The keyIdentifier, as the date and other attributes only tell apart
+    // versions of the same key
+    fn key_id(&self) -> Result<&'a [u8]> {
+        if self.kekid.header.class() != Class::Universal || self.kekid.header.tag() != Tag::Sequence
+        {
+            return Err(malformed!(
+                "unexpected KEKRecipientInfo.kekid tag, expected SEQUENCE"
             ));
         }
 
-        if self.content_encryption_algorithm.algorithm != OID_NIST_AES256_CBC {
-            return Err(anyhow!("unexpected EncryptedContentInfo.content_encryption_algorithm: {}, expected {OID_NIST_AES256_CBC}",
-                    self.content_encryption_algorithm.algorithm));
+        let (_, key_id) = der::Reader(self.kekid.data).expect(0x04)?;
+        Ok(key_id)
+    }
+
+    fn kek_len(&self) -> Result<usize> {
+        let oid = &self.key_encryption_algorithm.algorithm;
+        if *oid == OID_NIST_AES128_WRAP {
+            Ok(16)
+        } else if *oid == OID_NIST_AES192_WRAP {
+            Ok(24)
+        } else if *oid == OID_NIST_AES256_WRAP {
+            Ok(32)
+        } else {
+            Err(UnsupportedAlgorithm {
+                field: "kek_recipient_info.key_encryption_algorithm",
+                algorithm: oid.to_string(),
+            }
+            .into())
         }
+    }
 
-        // Ignoring the OPTIONAL directive, it should always be there in our use case
-        let any = &self.encrypted_content;
+    fn recipient_id(&self) -> Result<RecipientId> {
+        Ok(RecipientId::KekIdentifier(self.key_id()?.to_vec()))
+    }
 
-        if any.header.class() != Class::ContextSpecific {
+    fn unwrap_key(&self, kek: &[u8]) -> Result<Vec<u8>> {
+        let kek_len = self.kek_len()?;
+        if kek.len() != kek_len {
             return Err(anyhow!(
-                "unexpected EncryptedContentInfo.encrypted_content.class: {}, expected {}",
-                any.header.class(),
-                Class::ContextSpecific
+                "the key encryption key is of {} bytes, expected {kek_len}",
+                kek.len()
+            ));
+        }
+
+        aes_key_unwrap(&Kek::new(kek)?, self.encrypted_key.as_ref())
+            .map_err(|_| DecryptionFailed.into())
+    }
+}
+
+/*
+RecipientIdentifier ::= CHOICE {
+  issuerAndSerialNumber IssuerAndSerialNumber,
+  subjectKeyIdentifier [0] SubjectKeyIdentifier }
+
+IssuerAndSerialNumber ::= SEQUENCE {
+  issuer Name,
+  serialNumber CertificateSerialNumber }
+*/
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum RecipientId {
+    SubjectKeyIdentifier(Vec<u8>),
+    // The Name in DER, and the content of the INTEGER
+    IssuerAndSerialNumber { issuer: Vec<u8>, serial: Vec<u8> },
+    // The keyIdentifier of a KEKRecipientInfo
+    KekIdentifier(Vec<u8>),
+}
+
+impl RecipientId {
+    fn parse(rid: &Any) -> Result<Self> {
+        let (class, tag) = (rid.header.class(), rid.header.tag());
+        if class == Class::ContextSpecific && tag.0 == 0 {
+            return Ok(Self::SubjectKeyIdentifier(rid.data.to_vec()));
+        }
+        if class != Class::Universal || tag != Tag::Sequence {
+            return Err(malformed!(
+                "unexpected KeyTransRecipientInfo.rid: {class:?} {tag:?}, expected issuerAndSerialNumber or subjectKeyIdentifier"
+            ));
+        }
+
+        let mut reader = der::Reader(rid.data);
+        let (issuer, _) = reader.expect(0x30)?;
+        let (_, serial) = reader.expect(0x02)?;
+        Ok(Self::IssuerAndSerialNumber {
+            issuer: issuer.to_vec(),
+            serial: serial.to_vec(),
+        })
+    }
+
+    /*
+    KeyAgreeRecipientIdentifier ::= CHOICE {
+      issuerAndSerialNumber IssuerAndSerialNumber,
+      rKeyId [0] IMPLICIT RecipientKeyIdentifier }
+
+    RecipientKeyIdentifier ::= SEQUENCE {
+      subjectKeyIdentifier SubjectKeyIdentifier,
+      date GeneralizedTime OPTIONAL,
+      other OtherKeyAttribute OPTIONAL }
+    */
+    fn parse_key_agree(rid: &Any) -> Result<Self> {
+        if rid.header.class() != Class::ContextSpecific || rid.header.tag().0 != 0 {
+            return Self::parse(rid);
+        }
+
+        let (_, ski) = der::Reader(rid.data).expect(0x04)?;
+        Ok(Self::SubjectKeyIdentifier(ski.to_vec()))
+    }
+
+    fn to_key_agree_der(&self) -> Vec<u8> {
+        match self {
+            Self::SubjectKeyIdentifier(ski) => der::explicit(0, &der::octet_string(ski)),
+            Self::IssuerAndSerialNumber { .. } | Self::KekIdentifier(_) => self.to_der(),
+        }
+    }
+
+    fn to_der(&self) -> Vec<u8> {
+        match self {
+            Self::SubjectKeyIdentifier(ski) => der::tlv(TAG_IMPLICIT_0, ski),
+            Self::IssuerAndSerialNumber { issuer, serial } => {
+                der::sequence(&[issuer.clone(), der::tlv(0x02, serial)])
+            }
+            Self::KekIdentifier(key_id) => der::sequence(&[der::octet_string(key_id)]),
+        }
+    }
+}
+
+// For errors on keys that are none of the recipients
+impl fmt::Display for RecipientId {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::SubjectKeyIdentifier(ski) => write!(f, "subject key {}", to_hex(ski)),
+            Self::IssuerAndSerialNumber { issuer, serial } => {
+                let name = der::Reader(issuer)
+                    .expect(0x30)
+                    .and_then(|(_, name)| x509::distinguished_name_string(name))
+                    .unwrap_or_else(|_| to_hex(issuer));
+                write!(f, "issuer {name}, serial {}", to_hex(serial))
+            }
+            Self::KekIdentifier(key_id) => write!(f, "key encryption key {}", to_hex(key_id)),
+        }
+    }
+}
+
+/*
+RecipientIdentifier ::= CHOICE {
+  issuerAndSerialNumber IssuerAndSerialNumber,
+  subjectKeyIdentifier [0] SubjectKeyIdentifier }
+
+AlgorithmIdentifier{ALGORITHM-TYPE, ALGORITHM-TYPE:AlgorithmSet} ::=
+  SEQUENCE {
+    algorithm   ALGORITHM-TYPE.&id({AlgorithmSet}),
+      parameters  ALGORITHM-TYPE.
+             &Params({AlgorithmSet}{@algorithm}) OPTIONAL
+  }
+
+EncryptedKey ::= OCTET STRING
+*/
+
+#[derive(BerSequence, Debug)]
+pub struct AlgorithmIdentifier<'a> {
+    pub algorithm: Oid<'a>,
+
+    #[optional]
+    pub parameters: Option<Any<'a>>,
+}
+
+/*
+RSAES-OAEP-params  ::=  SEQUENCE  {
+  hashFunc    [0] AlgorithmIdentifier DEFAULT sha1Identifier,
+  maskGenFunc [1] AlgorithmIdentifier DEFAULT mgf1SHA1Identifier,
+  pSourceFunc [2] AlgorithmIdentifier DEFAULT
+                    pSpecifiedEmptyIdentifier  }
+*/
+
+#[derive(Debug)]
+pub struct RsaesOaepParameters<'a> {
+    hash_alg: Option<AlgorithmIdentifier<'a>>,
+    mask_gen_alg: Option<AlgorithmIdentifier<'a>>,
+    _p_source_alg: Option<AlgorithmIdentifier<'a>>,
+}
+
+impl<'a> RsaesOaepParameters<'a> {
+    // The defaults of SHA-1 are not supported, so both hashes must be given
+    fn oaep_params(&self) -> Result<OaepParams> {
+        let hash = match self.hash_alg {
+            Some(ref alg) => oaep_hash("key_encryption_algorithm.hash_func", &alg.algorithm)?,
+            None => {
+                return Err(UnsupportedAlgorithm {
+                    field: "key_encryption_algorithm.hash_func",
+                    algorithm: "SHA-1 (the default)".to_string(),
+                }
+                .into())
+            }
+        };
+
+        let mgf_hash = match self.mask_gen_alg {
+            Some(ref alg) => {
+                if alg.algorithm != OID_PKCS1_MGF {
+                    return Err(UnsupportedAlgorithm {
+                        field: "key_encryption_algorithm.mask_gen_func",
+                        algorithm: alg.algorithm.to_string(),
+                    }
+                    .into());
+                }
+
+                if let Some(ref params) = alg.parameters {
+                    let (_, mgf_hash) = Oid::from_ber(params.as_bytes())?;
+                    oaep_hash("key_encryption_algorithm.mask_gen_func.hash", &mgf_hash)?
+                } else {
+                    return Err(malformed!("missing KeyTransRecipientInfo.key_encryption_algorithm.mask_gen_func.parameters"));
+                }
+            }
+            None => {
+                return Err(UnsupportedAlgorithm {
+                    field: "key_encryption_algorithm.mask_gen_func",
+                    algorithm: "MGF1 with SHA-1 (the default)".to_string(),
+                }
+                .into())
+            }
+        };
+
+        Ok(OaepParams { hash, mgf_hash })
+    }
+}
+
+fn oaep_hash(field: &'static str, oid: &Oid) -> Result<OaepHash> {
+    if *oid == OID_NIST_SHA_256 {
+        Ok(OaepHash::Sha256)
+    } else if *oid == OID_NIST_SHA_384 {
+        Ok(OaepHash::Sha384)
+    } else if *oid == OID_NIST_SHA_512 {
+        Ok(OaepHash::Sha512)
+    } else {
+        Err(UnsupportedAlgorithm {
+            field,
+            algorithm: oid.to_string(),
+        }
+        .into())
+    }
+}
+
+impl<'a> TryFrom<Any<'a>> for RsaesOaepParameters<'a> {
+    type Error = asn1_rs::Error;
+
+    fn try_from(value: Any<'a>) -> Result<Self, Self::Error> {
+        Self::try_from(&value)
+    }
+}
+
+//     hashFunc          [0] AlgorithmIdentifier DEFAULT
+//                              sha1Identifier,
+//     maskGenFunc       [1] AlgorithmIdentifier DEFAULT
+//                              mgf1SHA1Identifier,
+//     pSourceFunc       [2] AlgorithmIdentifier DEFAULT
+//                              pSpecifiedEmptyIdentifier  }
+impl<'a, 'b> TryFrom<&'b Any<'a>> for RsaesOaepParameters<'a> {
+    type Error = asn1_rs::Error;
+
+    fn try_from(value: &'b Any<'a>) -> Result<Self, Self::Error> {
+        value.tag().assert_eq(Tag::Sequence)?;
+        let i = &value.data;
+
+        let (i, hash_alg) = OptTaggedParser::new(Class::ContextSpecific, Tag(0))
+            .parse_ber(i, |_, inner| AlgorithmIdentifier::from_ber(inner))?;
+
+        let (i, mask_gen_alg) = OptTaggedParser::new(Class::ContextSpecific, Tag(1))
+            .parse_ber(i, |_, inner| AlgorithmIdentifier::from_ber(inner))?;
+
+        let (_, p_source_alg) = OptTaggedParser::new(Class::ContextSpecific, Tag(2))
+            .parse_ber(i, |_, inner| AlgorithmIdentifier::from_ber(inner))?;
+
+        Ok(Self {
+            hash_alg,
+            mask_gen_alg,
+            _p_source_alg: p_source_alg,
+        })
+    }
+}
+
+pub type Aes256CBCParameter<'a> = OctetString<'a>;
+
+/*
+GCMParameters ::= SEQUENCE {
+  aes-nonce        OCTET STRING, -- recommended size is 12 octets
+  aes-ICVlen       AES-GCM-ICVlen DEFAULT 12 }
+
+AES-GCM-ICVlen ::= INTEGER (12 | 13 | 14 | 15 | 16)
+*/
+
+#[derive(BerSequence, Debug)]
+pub struct GcmParameters<'a> {
+    pub nonce: OctetString<'a>,
+
+    #[optional]
+    pub icv_len: Option<Integer<'a>>,
+}
+
+impl<'a> GcmParameters<'a> {
+    // What ring supports, which is also what senders use in practice
+    fn validate(&self) -> Result<()> {
+        if self.nonce.as_ref().len() != aead::NONCE_LEN {
+            return Err(malformed!(
+                "unexpected GCMParameters.aes_nonce length: {}, expected {}",
+                self.nonce.as_ref().len(),
+                aead::NONCE_LEN
+            ));
+        }
+
+        let icv_len = match self.icv_len {
+            Some(ref icv_len) => icv_len.as_u32()?,
+            None => 12,
+        };
+        if icv_len as usize != aead::AES_256_GCM.tag_len() {
+            return Err(malformed!(
+                "unexpected GCMParameters.aes_ICVlen: {icv_len}, expected {}",
+                aead::AES_256_GCM.tag_len()
+            ));
+        }
+
+        Ok(())
+    }
+}
+
+/*
+EncryptedContentInfo ::= SEQUENCE {
+  contentType ContentType,
+  contentEncryptionAlgorithm ContentEncryptionAlgorithmIdentifier,
+  encryptedContent [0] IMPLICIT EncryptedContent OPTIONAL }
+*/
+
+#[derive(BerSequence, Debug)]
+pub struct EncryptedContentInfo<'a> {
+    pub content_type: Oid<'a>,
+    pub content_encryption_algorithm: AlgorithmIdentifier<'a>,
+    pub encrypted_content: Any<'a>,
+}
+
+impl<'a> EncryptedContentInfo<'a> {
+    fn validate(&self) -> Result<()> {
+        if self.content_type != OID_PKCS7_DATA {
+            return Err(malformed!(
+                "unexpected EncryptedContentInfo.content_type: {}, expected {OID_PKCS7_DATA}",
+                self.content_type
+            ));
+        }
+
+        let algo = &self.content_encryption_algorithm;
+        if algo.algorithm == OID_NIST_AES256_GCM {
+            match algo.parameters {
+                Some(ref params) => {
+                    let gcm_params: GcmParameters<'a> = params.clone().try_into()?;
+                    gcm_params.validate()?;
+                }
+                None => {
+                    return Err(malformed!(
+                        "missing EncryptedContentInfo.content_encryption_algorithm.parameters"
+                    ))
+                }
+            }
+        } else if algo.algorithm != OID_NIST_AES256_CBC {
+            return Err(UnsupportedAlgorithm {
+                field: "EncryptedContentInfo.content_encryption_algorithm",
+                algorithm: algo.algorithm.to_string(),
+            }
+            .into());
+        }
+
+        // Ignoring the OPTIONAL directive, it should always be there in our use case
+        let any = &self.encrypted_content;
+
+        if any.header.class() != Class::ContextSpecific {
+            return Err(malformed!(
+                "unexpected EncryptedContentInfo.encrypted_content.class: {}, expected {}",
+                any.header.class(),
+                Class::ContextSpecific
             ));
         }
 
         if any.header.tag().0 != 0 {
-            return Err(anyhow!(
+            return Err(malformed!(
                 "unexpected EncryptedContentInfo.encrypted_content.tag: {}, expected 0",
                 any.header.tag().0
             ));
         }
 
-        Ok(())
+        Ok(())
+    }
+
+    fn decrypt_content(&self, datakey: &[u8]) -> Result<Vec<u8>> {
+        if self.content_encryption_algorithm.algorithm == OID_NIST_AES256_GCM {
+            self.decrypt_gcm(datakey)
+        } else {
+            self.decrypt_cbc(datakey)
+        }
+    }
+
+    fn decrypt_cbc(&self, datakey: &[u8]) -> Result<Vec<u8>> {
+        let iv = self.cbc_iv()?;
+
+        let ciphertext = self.combined_content()?;
+        if ciphertext.is_empty() || ciphertext.len() % CBC_IV_LEN != 0 {
+            return Err(DecryptionFailed.into());
+        }
+        let dec = Aes256CbcDec::new(datakey.into(), iv[..].into());
+        let mut plaintext = dec
+            .decrypt_padded_vec_mut::<block_padding::NoPadding>(&ciphertext)
+            .map_err(|_| DecryptionFailed)?;
+
+        let last: [u8; CBC_IV_LEN] = plaintext[plaintext.len() - CBC_IV_LEN..]
+            .try_into()
+            .unwrap();
+        let pad = cbc_padding_len(&last)?;
+        plaintext.truncate(plaintext.len() - pad);
+        Ok(plaintext)
+    }
+
+    fn decrypt_gcm(&self, datakey: &[u8]) -> Result<Vec<u8>> {
+        let mut content = self.combined_content()?;
+        open_gcm(datakey, &self.gcm_nonce()?, &mut content)
+    }
+
+    fn cbc_iv(&self) -> Result<Vec<u8>> {
+        let iv: Aes256CBCParameter = match self.content_encryption_algorithm.parameters {
+            Some(ref params) => params.try_into()?,
+            None => return Err(malformed!("missing CBC IV")),
+        };
+        if iv.as_ref().len() != CBC_IV_LEN {
+            return Err(malformed!("invalid CBC IV length: {}", iv.as_ref().len()));
+        }
+
+        Ok(iv.as_ref().to_vec())
+    }
+
+    fn gcm_nonce(&self) -> Result<Vec<u8>> {
+        let params: GcmParameters = match self.content_encryption_algorithm.parameters {
+            Some(ref params) => params.clone().try_into()?,
+            None => return Err(malformed!("missing GCM parameters")),
+        };
+
+        Ok(params.nonce.as_ref().to_vec())
+    }
+
+    fn combined_content(&self) -> Result<Vec<u8>> {
+        // Ignoring the OPTIONAL directive, it should always be there in our use case
+        octet_string_content(&self.encrypted_content)
+    }
+}
+
+// The octets of an OCTET STRING, which BER may split into parts, and those
+// into parts again
+fn octet_string_content(any: &Any) -> Result<Vec<u8>> {
+    let mut combined = Vec::new();
+    append_octets(any, &mut combined, 0)?;
+    Ok(combined)
+}
+
+fn append_octets(any: &Any, combined: &mut Vec<u8>, depth: usize) -> Result<()> {
+    if !any.header.is_constructed() {
+        combined.extend_from_slice(any.data);
+        return Ok(());
+    }
+    if depth == MAX_BER_DEPTH {
+        return Err(malformed!(
+            "OCTET STRING parts nested over {MAX_BER_DEPTH} deep"
+        ));
+    }
+
+    let mut data = any.data;
+    while !data.is_empty() {
+        let (rem, part) =
+            Any::from_ber(data).map_err(|err| malformed!("invalid OCTET STRING part: {err}"))?;
+        if part.header.class() != Class::Universal || part.tag() != Tag::OctetString {
+            return Err(malformed!(
+                "unexpected OCTET STRING part: {:?} {:?}",
+                part.header.class(),
+                part.tag()
+            ));
+        }
+        append_octets(&part, combined, depth + 1)?;
+        data = rem;
+    }
+
+    Ok(())
+}
+
+// The ICV is appended to the ciphertext, and there is no AAD
+fn open_gcm(datakey: &[u8], nonce: &[u8], content: &mut [u8]) -> Result<Vec<u8>> {
+    let nonce = aead::Nonce::try_assume_unique_for_key(nonce)
+        .map_err(|_| malformed!("invalid GCM nonce"))?;
+    let key = aead::UnboundKey::new(&aead::AES_256_GCM, datakey).map_err(|_| DecryptionFailed)?;
+
+    let plaintext = aead::LessSafeKey::new(key)
+        .open_in_place(nonce, aead::Aad::empty(), content)
+        .map_err(|_| DecryptionFailed)?;
+    Ok(plaintext.to_vec())
+}
+
+// The length of the PKCS #7 padding of the last block, which is checked in
+// the same time whatever the plaintext, as the padding would be an oracle of
+// it otherwise
+fn cbc_padding_len(last: &[u8; CBC_IV_LEN]) -> Result<usize> {
+    let pad = last[CBC_IV_LEN - 1];
+    let mut valid = !ct_lt(pad, 1) & ct_lt(pad, CBC_IV_LEN as u8 + 1);
+    for (i, b) in last.iter().enumerate() {
+        let in_padding = ct_lt((CBC_IV_LEN - 1 - i) as u8, pad);
+        valid &= !in_padding | ct_eq(*b, pad);
+    }
+
+    if valid == 0xff {
+        Ok(pad as usize)
+    } else {
+        Err(DecryptionFailed.into())
+    }
+}
+
+// 0xff if a < b and 0 if not, without branching
+fn ct_lt(a: u8, b: u8) -> u8 {
+    ((a as u16).wrapping_sub(b as u16) >> 8) as u8
+}
+
+fn ct_eq(a: u8, b: u8) -> u8 {
+    ct_lt(a ^ b, 1)
+}
+
+fn random_data_key() -> Vec<u8> {
+    let mut datakey = vec![0u8; DATA_KEY_LEN];
+    OsRng.fill_bytes(&mut datakey);
+    datakey
+}
+
+// Decrypts a ContentInfo as it is read, for envelopes too large to be held in
+// memory whole, e.g. in an enclave. The parts before the content, such as the
+// recipients, are read and checked first, which is when the data key is
+// decrypted, and CBC content is then decrypted as it comes. GCM content is
+// read whole still, as none of it can be given out before the ICV is checked.
+pub struct ContentReader<R> {
+    content: ContentStream<R>,
+    cipher: ContentCipher,
+    // Ciphertext short of a block
+    pending: Vec<u8>,
+    plaintext: Vec<u8>,
+    pos: usize,
+    done: bool,
+}
+
+enum ContentCipher {
+    // The last block, which is held back until it is known whether it is
+    // the one with the padding
+    Cbc {
+        dec: Box<Aes256CbcDec>,
+        last: Option<[u8; CBC_IV_LEN]>,
+    },
+    Gcm {
+        datakey: Zeroizing<Vec<u8>>,
+        nonce: Vec<u8>,
+    },
+}
+
+impl<R: Read> ContentReader<R> {
+    pub fn new(source: R, key: &dyn Decrypter) -> Result<Self> {
+        Self::start(source, |ci| ci.decrypt_key(key, None))
+    }
+
+    // As ContentInfo::decrypt_content_with_certificate()
+    pub fn with_certificate(source: R, key: &dyn Decrypter, cert: &[u8]) -> Result<Self> {
+        Self::start(source, |ci| ci.decrypt_key(key, Some(cert)))
+    }
+
+    // As ContentInfo::decrypt_content_with_kek()
+    pub fn with_kek(source: R, key_id: &[u8], kek: &[u8]) -> Result<Self> {
+        Self::start(source, |ci| ci.unwrap_key(key_id, kek))
+    }
+
+    // With the data key, as the recipient gets it from the ContentInfo
+    fn start<F>(source: R, datakey: F) -> Result<Self>
+    where
+        F: FnOnce(&ContentInfo) -> Result<Vec<u8>>,
+    {
+        let mut ber = BerStream {
+            inner: source,
+            position: 0,
+        };
+
+        // ContentInfo, and the EnvelopedData in its [0]
+        ber.expect_header(0x30)?;
+        let content_type = ber.read_tlv()?;
+        ber.expect_header(0xa0)?;
+        ber.expect_header(0x30)?;
+        let version = ber.read_tlv()?;
+        let mut originator_info = Vec::new();
+        let mut recipient_infos = ber.read_tlv()?;
+        if recipient_infos.first() == Some(&0xa0) {
+            originator_info = recipient_infos;
+            recipient_infos = ber.read_tlv()?;
+        }
+
+        // EncryptedContentInfo, up to its encryptedContent
+        ber.expect_header(0x30)?;
+        let encrypted_content_type = ber.read_tlv()?;
+        let algorithm = ber.read_tlv()?;
+        let (tag, len) = ber.header(None)?;
+
+        // All but the content, to be checked and decrypted as a whole
+        let encrypted_content_info = der::sequence(&[
+            encrypted_content_type,
+            algorithm,
+            der::tlv(TAG_IMPLICIT_0, &[]),
+        ]);
+        let enveloped_data = der::sequence(&[
+            version,
+            originator_info,
+            recipient_infos,
+            encrypted_content_info,
+        ]);
+        let ber_headers = der::sequence(&[content_type, der::explicit(0, &enveloped_data)]);
+        let ci = ContentInfo::parse_ber(&ber_headers)?;
+
+        let datakey = Zeroizing::new(datakey(&ci)?);
+        let eci = &ci.content.encrypted_content_info;
+        let cipher = if eci.content_encryption_algorithm.algorithm == OID_NIST_AES256_GCM {
+            ContentCipher::Gcm {
+                nonce: eci.gcm_nonce()?,
+                datakey,
+            }
+        } else {
+            let dec = Aes256CbcDec::new(datakey[..].into(), eci.cbc_iv()?[..].into());
+            ContentCipher::Cbc {
+                dec: Box::new(dec),
+                last: None,
+            }
+        };
+
+        let content = match (tag, len) {
+            (TAG_IMPLICIT_0, Some(len)) => ContentStream::Primitive {
+                ber,
+                remaining: len,
+            },
+            (0xa0, len) => ContentStream::Constructed {
+                ends: vec![len.map(|len| ber.position + len as u64)],
+                ber,
+                remaining: 0,
+            },
+            _ => return Err(malformed!("unexpected encryptedContent tag: {tag:#04x}")),
+        };
+
+        Ok(Self {
+            content,
+            cipher,
+            pending: Vec::new(),
+            plaintext: Vec::new(),
+            pos: 0,
+            done: false,
+        })
+    }
+
+    // Decrypts the next chunk of content into plaintext
+    fn fill(&mut self) -> Result<()> {
+        self.plaintext.clear();
+        self.pos = 0;
+
+        match self.cipher {
+            ContentCipher::Cbc {
+                ref mut dec,
+                ref mut last,
+            } => {
+                let mut chunk = vec![0u8; STREAM_CHUNK_LEN];
+                let n = self.content.read(&mut chunk)?;
+                if n == 0 {
+                    self.done = true;
+                    // Not a whole number of blocks, or none
+                    let last = match last.take() {
+                        Some(last) if self.pending.is_empty() => last,
+                        _ => return Err(DecryptionFailed.into()),
+                    };
+                    let pad = cbc_padding_len(&last)?;
+                    self.plaintext.extend_from_slice(&last[..CBC_IV_LEN - pad]);
+                    return Ok(());
+                }
+
+                self.pending.extend_from_slice(&chunk[..n]);
+                let whole = self.pending.len() - self.pending.len() % CBC_IV_LEN;
+                for block in self.pending[..whole].chunks(CBC_IV_LEN) {
+                    let mut block: [u8; CBC_IV_LEN] = block.try_into().unwrap();
+                    dec.decrypt_block_mut(aes::Block::from_mut_slice(&mut block));
+                    if let Some(previous) = last.replace(block) {
+                        self.plaintext.extend_from_slice(&previous);
+                    }
+                }
+                self.pending.drain(..whole);
+            }
+            ContentCipher::Gcm {
+                ref datakey,
+                ref nonce,
+            } => {
+                let mut content = Vec::new();
+                self.content.read_to_end(&mut content)?;
+                self.plaintext = open_gcm(datakey, nonce, &mut content)?;
+                self.done = true;
+            }
+        }
+
+        Ok(())
+    }
+}
+
+impl<R: Read> Read for ContentReader<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        while self.pos == self.plaintext.len() && !self.done {
+            if let Err(err) = self.fill() {
+                // Nothing after an error can be trusted
+                self.done = true;
+                self.plaintext.clear();
+                return Err(io::Error::new(io::ErrorKind::InvalidData, err));
+            }
+        }
+
+        let n = buf.len().min(self.plaintext.len() - self.pos);
+        buf[..n].copy_from_slice(&self.plaintext[self.pos..self.pos + n]);
+        self.pos += n;
+        Ok(n)
+    }
+}
+
+// The ciphertext of an encryptedContent, which BER may split into OCTET
+// STRINGs of a constructed [0], as KMS does
+enum ContentStream<R> {
+    Primitive {
+        ber: BerStream<R>,
+        remaining: usize,
+    },
+    Constructed {
+        ber: BerStream<R>,
+        // Of the [0] and of the constructed OCTET STRINGs within it, from the
+        // outermost in, None for those of indefinite length
+        ends: Vec<Option<u64>>,
+        // Of the current primitive OCTET STRING
+        remaining: usize,
+    },
+    Done,
+}
+
+impl<R: Read> ContentStream<R> {
+    // 0 once at the end
+    fn read(&mut self, buf: &mut [u8]) -> Result<usize> {
+        loop {
+            match self {
+                Self::Primitive { ber, remaining } | Self::Constructed { ber, remaining, .. }
+                    if *remaining > 0 =>
+                {
+                    let n = buf.len().min(*remaining);
+                    ber.read_exact(&mut buf[..n])?;
+                    *remaining -= n;
+                    return Ok(n);
+                }
+                Self::Primitive { .. } => *self = Self::Done,
+                Self::Constructed {
+                    ber,
+                    ends,
+                    remaining,
+                } => {
+                    match ends.last().copied() {
+                        None => *self = Self::Done,
+                        Some(Some(end)) if end == ber.position => {
+                            ends.pop();
+                        }
+                        Some(Some(end)) if end < ber.position => {
+                            return Err(malformed!("encryptedContent part past its end"));
+                        }
+                        Some(end) => match ber.header(None)? {
+                            // End of contents, of an indefinite length
+                            (0x00, Some(0)) if end.is_none() => {
+                                ends.pop();
+                            }
+                            (0x04, Some(len)) => *remaining = len,
+                            (0x24, len) if ends.len() < MAX_BER_DEPTH => {
+                                ends.push(len.map(|len| ber.position + len as u64));
+                            }
+                            (tag, _) => {
+                                return Err(malformed!(
+                                    "unexpected encryptedContent part: {tag:#04x}"
+                                ))
+                            }
+                        },
+                    }
+                }
+                Self::Done => return Ok(0),
+            }
+        }
+    }
+
+    fn read_to_end(&mut self, out: &mut Vec<u8>) -> Result<()> {
+        let mut chunk = vec![0u8; STREAM_CHUNK_LEN];
+        loop {
+            match self.read(&mut chunk)? {
+                0 => return Ok(()),
+                n => out.extend_from_slice(&chunk[..n]),
+            }
+        }
+    }
+}
+
+// Enough of BER to read a ContentInfo as it comes: definite or indefinite
+// lengths, and tags of any number, though only those of one byte are told
+// apart (by the first byte, which is all that is returned of a tag)
+struct BerStream<R> {
+    inner: R,
+    // Bytes read so far
+    position: u64,
+}
+
+impl<R: Read> BerStream<R> {
+    fn read_exact(&mut self, buf: &mut [u8]) -> Result<()> {
+        self.inner.read_exact(buf).map_err(|err| match err.kind() {
+            io::ErrorKind::UnexpectedEof => malformed!("truncated ContentInfo"),
+            _ => err.into(),
+        })?;
+        self.position += buf.len() as u64;
+        Ok(())
+    }
+
+    fn read_byte(&mut self, raw: &mut Option<&mut Vec<u8>>) -> Result<u8> {
+        let mut byte = [0u8];
+        self.read_exact(&mut byte)?;
+        if let Some(raw) = raw {
+            raw.push(byte[0]);
+        }
+        Ok(byte[0])
+    }
+
+    // The tag, and the length unless indefinite. What is read is appended to
+    // raw, if given.
+    fn header(&mut self, mut raw: Option<&mut Vec<u8>>) -> Result<(u8, Option<usize>)> {
+        let tag = self.read_byte(&mut raw)?;
+        if tag & 0x1f == 0x1f {
+            // The number follows in base 128, the last byte without 0x80
+            let mut len = 1;
+            while self.read_byte(&mut raw)? & 0x80 != 0 {
+                len += 1;
+                if len > MAX_TAG_NUMBER_LEN {
+                    return Err(malformed!("tag number over {MAX_TAG_NUMBER_LEN} bytes"));
+                }
+            }
+        }
+
+        let first = self.read_byte(&mut raw)?;
+        let len = match first {
+            // Only constructed encodings may be of indefinite length
+            0x80 if tag & 0x20 == 0 => {
+                return Err(malformed!(
+                    "indefinite length of a primitive encoding: {tag:#04x}"
+                ))
+            }
+            0x80 => None,
+            0xff => return Err(malformed!("invalid length")),
+            len if len < 0x80 => Some(len as usize),
+            len => {
+                let mut value = 0usize;
+                for _ in 0..(len & 0x7f) {
+                    let byte = self.read_byte(&mut raw)?;
+                    value = value
+                        .checked_mul(256)
+                        .ok_or_else(|| malformed!("invalid length"))?
+                        + byte as usize;
+                }
+                Some(value)
+            }
+        };
+
+        Ok((tag, len))
+    }
+
+    fn expect_header(&mut self, expected: u8) -> Result<Option<usize>> {
+        let (tag, len) = self.header(None)?;
+        if tag != expected {
+            return Err(malformed!(
+                "unexpected tag: {tag:#04x}, expected {expected:#04x}"
+            ));
+        }
+        Ok(len)
+    }
+
+    // A whole TLV, as is
+    fn read_tlv(&mut self) -> Result<Vec<u8>> {
+        let mut raw = Vec::new();
+        self.read_raw(&mut raw, 0)?;
+        Ok(raw)
+    }
+
+    fn read_raw(&mut self, raw: &mut Vec<u8>, depth: usize) -> Result<(u8, Option<usize>)> {
+        let (tag, len) = self.header(Some(&mut *raw))?;
+        match len {
+            Some(len) => {
+                if raw.len().saturating_add(len) > MAX_HEADER_LEN {
+                    return Err(malformed!("ContentInfo part over {MAX_HEADER_LEN} bytes"));
+                }
+                let start = raw.len();
+                raw.resize(start + len, 0);
+                self.read_exact(&mut raw[start..])?;
+            }
+            // Up to the end of contents, which is 0x00 0x00
+            None => loop {
+                if raw.len() > MAX_HEADER_LEN {
+                    return Err(malformed!("ContentInfo part over {MAX_HEADER_LEN} bytes"));
+                }
+                if depth == MAX_BER_DEPTH {
+                    return Err(malformed!(
+                        "ContentInfo part nested over {MAX_BER_DEPTH} deep"
+                    ));
+                }
+                if self.read_raw(raw, depth + 1)? == (0x00, Some(0)) {
+                    break;
+                }
+            },
+        }
+
+        Ok((tag, len))
+    }
+}
+
+// How the content of an EnvelopedData is encrypted, with a fresh AES-256 key
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ContentEncryption {
+    Aes256Cbc,
+    Aes256Gcm,
+}
+
+// The inverse of ContentInfo::decrypt_content(), for enclaves to answer in the
+// format they receive: a ContentInfo in DER with an EnvelopedData that each
+// of the RSA or P-384 keys (SubjectPublicKeyInfo in DER) decrypts. The data
+// key is encrypted with RSA-OAEP over SHA-256, as KMS does, or wrapped with a
+// key agreed on with an ephemeral P-384 key (ECDH, the X9.63 KDF over SHA-384
+// and AES-256 key wrap). Recipients are identified by the SHA-256 of their key.
+pub fn encrypt(
+    plaintext: &[u8],
+    recipients: &[&[u8]],
+    content_encryption: ContentEncryption,
+) -> Result<Vec<u8>> {
+    let recipients = recipients
+        .iter()
+        .map(|spki| {
+            let ski = RecipientId::SubjectKeyIdentifier(Sha256::digest(spki).to_vec());
+            (*spki, ski)
+        })
+        .collect::<Vec<_>>();
+    envelop(plaintext, &recipients, content_encryption)
+}
+
+// Each recipient by its key and how it is identified
+fn envelop(
+    plaintext: &[u8],
+    recipients: &[(&[u8], RecipientId)],
+    content_encryption: ContentEncryption,
+) -> Result<Vec<u8>> {
+    if recipients.is_empty() {
+        return Err(anyhow!("at least one recipient is required"));
+    }
+
+    let mut datakey = Zeroizing::new([0u8; DATA_KEY_LEN]);
+    OsRng.fill_bytes(&mut datakey[..]);
+
+    // 0 only if all recipients are KeyTransRecipientInfo by issuerAndSerialNumber
+    let mut version = 0;
+    let mut recipient_infos = Vec::new();
+    for (spki, rid) in recipients {
+        let info = match p384::PublicKey::from_public_key_der(spki) {
+            Ok(public_key) => {
+                version = 2;
+                key_agree_recipient_info(&public_key, rid, &datakey[..])?
+            }
+            Err(_) => {
+                if let RecipientId::SubjectKeyIdentifier(_) = rid {
+                    version = 2;
+                }
+                key_trans_recipient_info(spki, rid, &datakey[..])?
+            }
+        };
+        recipient_infos.push(info);
+    }
+    // DER has the elements of a SET OF in order
+    recipient_infos.sort();
+
+    let enveloped_data = der::sequence(&[
+        der::integer(&[version]),
+        der::set(&recipient_infos),
+        encrypted_content_info(plaintext, &datakey[..], content_encryption)?,
+    ]);
+    Ok(der::sequence(&[
+        oid(&OID_PKCS7_ENVELOPED_DATA),
+        der::explicit(0, &enveloped_data),
+    ]))
+}
+
+fn key_trans_recipient_info(spki: &[u8], rid: &RecipientId, datakey: &[u8]) -> Result<Vec<u8>> {
+    let public_key = RsaPublicKey::from_public_key_der(spki)
+        .map_err(|err| anyhow!("invalid RSA public key of a recipient: {err}"))?;
+    let padding = PaddingScheme::new_oaep_with_mgf_hash::<Sha256, Sha256>();
+    let encrypted_key = public_key.encrypt(&mut OsRng, padding, datakey)?;
+
+    let sha256 = der::sequence(&[oid(&OID_NIST_SHA_256), der::null()]);
+    let mgf = der::sequence(&[oid(&OID_PKCS1_MGF), sha256.clone()]);
+    let oaep_params = der::sequence(&[der::explicit(0, &sha256), der::explicit(1, &mgf)]);
+
+    let version = match rid {
+        RecipientId::IssuerAndSerialNumber { .. } => 0,
+        _ => 2,
+    };
+
+    Ok(der::sequence(&[
+        der::integer(&[version]),
+        rid.to_der(),
+        der::sequence(&[oid(&OID_PKCS1_RSA_OAEP), oaep_params]),
+        der::octet_string(&encrypted_key),
+    ]))
+}
+
+fn key_agree_recipient_info(
+    public_key: &p384::PublicKey,
+    rid: &RecipientId,
+    datakey: &[u8],
+) -> Result<Vec<u8>> {
+    let ephemeral = p384::ecdh::EphemeralSecret::random(&mut OsRng);
+    let shared = ephemeral.diffie_hellman(public_key);
+    let point = ephemeral.public_key().to_encoded_point(false);
+
+    let shared_info = ecc_cms_shared_info(&OID_NIST_AES256_WRAP, None, DATA_KEY_LEN);
+    let kek = x963_kdf(
+        &digest::SHA384,
+        shared.raw_secret_bytes(),
+        &shared_info,
+        DATA_KEY_LEN,
+    );
+    let encrypted_key = aes_key_wrap(&Kek::new(&kek)?, datakey)?;
+
+    let algorithm = der::sequence(&[oid(&OID_EC_PUBLIC_KEY), oid(&OID_SECP384R1)]);
+    let originator_key = der::tlv(
+        0xa1,
+        &[algorithm, der::bit_string(point.as_bytes())].concat(),
+    );
+    let key_wrap = der::sequence(&[oid(&OID_NIST_AES256_WRAP)]);
+
+    let kari = [
+        der::integer(&[3]),
+        der::explicit(0, &originator_key),
+        der::sequence(&[oid(&OID_STD_DH_SHA384_KDF), key_wrap]),
+        der::sequence(&[der::sequence(&[
+            rid.to_key_agree_der(),
+            der::octet_string(&encrypted_key),
+        ])]),
+    ];
+    Ok(der::explicit(1, &kari.concat()))
+}
+
+/*
+ECC-CMS-SharedInfo ::= SEQUENCE {
+  keyInfo AlgorithmIdentifier,
+  entityUInfo [0] EXPLICIT OCTET STRING OPTIONAL,
+  suppPubInfo [2] EXPLICIT OCTET STRING }
+*/
+fn ecc_cms_shared_info(key_wrap: &Oid, ukm: Option<&[u8]>, kek_len: usize) -> Vec<u8> {
+    let mut parts = vec![der::sequence(&[oid(key_wrap)])];
+    if let Some(ukm) = ukm {
+        parts.push(der::explicit(0, &der::octet_string(ukm)));
+    }
+    // The length of the key in bits
+    let bits = (kek_len as u32 * 8).to_be_bytes();
+    parts.push(der::explicit(2, &der::octet_string(&bits)));
+
+    der::sequence(&parts)
+}
+
+// ANSI X9.63, as SEC 1 (3.6.1) has it
+fn x963_kdf(
+    hash: &'static digest::Algorithm,
+    shared: &[u8],
+    shared_info: &[u8],
+    len: usize,
+) -> Zeroizing<Vec<u8>> {
+    let mut out = Zeroizing::new(Vec::new());
+    let mut counter = 1u32;
+    while out.len() < len {
+        let mut ctx = digest::Context::new(hash);
+        ctx.update(shared);
+        ctx.update(&counter.to_be_bytes());
+        ctx.update(shared_info);
+        out.extend_from_slice(ctx.finish().as_ref());
+        counter += 1;
+    }
+
+    out.truncate(len);
+    out
+}
+
+// The key encryption key of AES key wrap
+enum Kek {
+    Aes128(aes::Aes128),
+    Aes192(aes::Aes192),
+    Aes256(aes::Aes256),
+}
+
+impl Kek {
+    fn new(key: &[u8]) -> Result<Self> {
+        match key.len() {
+            16 => Ok(Self::Aes128(aes::Aes128::new(key.into()))),
+            24 => Ok(Self::Aes192(aes::Aes192::new(key.into()))),
+            32 => Ok(Self::Aes256(aes::Aes256::new(key.into()))),
+            len => Err(anyhow!("invalid key encryption key length: {len}")),
+        }
+    }
+
+    fn encrypt(&self, block: &mut [u8; 16]) {
+        let block = aes::Block::from_mut_slice(block);
+        match self {
+            Self::Aes128(cipher) => cipher.encrypt_block(block),
+            Self::Aes192(cipher) => cipher.encrypt_block(block),
+            Self::Aes256(cipher) => cipher.encrypt_block(block),
+        }
+    }
+
+    fn decrypt(&self, block: &mut [u8; 16]) {
+        let block = aes::Block::from_mut_slice(block);
+        match self {
+            Self::Aes128(cipher) => cipher.decrypt_block(block),
+            Self::Aes192(cipher) => cipher.decrypt_block(block),
+            Self::Aes256(cipher) => cipher.decrypt_block(block),
+        }
+    }
+}
+
+// RFC 3394, 2.2.1
+fn aes_key_wrap(kek: &Kek, key: &[u8]) -> Result<Vec<u8>> {
+    if key.len() % 8 != 0 || key.len() < 16 {
+        return Err(anyhow!("cannot wrap a key of {} bytes", key.len()));
+    }
+
+    let mut a = KEY_WRAP_IV;
+    let mut r: Vec<[u8; 8]> = key.chunks(8).map(|c| c.try_into().unwrap()).collect();
+    let n = r.len();
+    for j in 0..6 {
+        for (i, ri) in r.iter_mut().enumerate() {
+            let mut block = [0u8; 16];
+            block[..8].copy_from_slice(&a);
+            block[8..].copy_from_slice(ri);
+            kek.encrypt(&mut block);
+
+            let t = (n * j + i + 1) as u64;
+            let msb = u64::from_be_bytes(block[..8].try_into().unwrap());
+            a = (msb ^ t).to_be_bytes();
+            ri.copy_from_slice(&block[8..]);
+        }
+    }
+
+    Ok([&a[..], &r.concat()[..]].concat())
+}
+
+// RFC 3394, 2.2.2
+fn aes_key_unwrap(kek: &Kek, wrapped: &[u8]) -> Result<Vec<u8>> {
+    if wrapped.len() % 8 != 0 || wrapped.len() < 24 {
+        return Err(anyhow!("invalid wrapped key length: {}", wrapped.len()));
+    }
+
+    let mut a: [u8; 8] = wrapped[..8].try_into().unwrap();
+    let mut r: Vec<[u8; 8]> = wrapped[8..]
+        .chunks(8)
+        .map(|c| c.try_into().unwrap())
+        .collect();
+    let n = r.len();
+    for j in (0..6).rev() {
+        for (i, ri) in r.iter_mut().enumerate().rev() {
+            let t = (n * j + i + 1) as u64;
+            let mut block = [0u8; 16];
+            block[..8].copy_from_slice(&(u64::from_be_bytes(a) ^ t).to_be_bytes());
+            block[8..].copy_from_slice(ri);
+            kek.decrypt(&mut block);
+
+            a.copy_from_slice(&block[..8]);
+            ri.copy_from_slice(&block[8..]);
+        }
+    }
+
+    if ring::constant_time::verify_slices_are_equal(&a, &KEY_WRAP_IV).is_err() {
+        return Err(DecryptionFailed.into());
+    }
+
+    Ok(r.concat())
+}
+
+fn encrypted_content_info(
+    plaintext: &[u8],
+    datakey: &[u8],
+    content_encryption: ContentEncryption,
+) -> Result<Vec<u8>> {
+    let (algorithm, ciphertext) = match content_encryption {
+        ContentEncryption::Aes256Cbc => {
+            let mut iv = [0u8; CBC_IV_LEN];
+            OsRng.fill_bytes(&mut iv);
+
+            let enc = Aes256CbcEnc::new(datakey.into(), (&iv[..]).into());
+            let ciphertext = enc.encrypt_padded_vec_mut::<block_padding::Pkcs7>(plaintext);
+            let algorithm = der::sequence(&[oid(&OID_NIST_AES256_CBC), der::octet_string(&iv)]);
+            (algorithm, ciphertext)
+        }
+        ContentEncryption::Aes256Gcm => {
+            let mut nonce = [0u8; aead::NONCE_LEN];
+            OsRng.fill_bytes(&mut nonce);
+
+            let key = aead::UnboundKey::new(&aead::AES_256_GCM, datakey)
+                .map_err(|_| anyhow!("invalid AES-256 data key"))?;
+            let mut ciphertext = plaintext.to_vec();
+            aead::LessSafeKey::new(key)
+                .seal_in_place_append_tag(
+                    aead::Nonce::assume_unique_for_key(nonce),
+                    aead::Aad::empty(),
+                    &mut ciphertext,
+                )
+                .map_err(|_| anyhow!("failed to encrypt the content"))?;
+
+            let params = der::sequence(&[
+                der::octet_string(&nonce),
+                der::integer(&[aead::AES_256_GCM.tag_len() as u8]),
+            ]);
+            let algorithm = der::sequence(&[oid(&OID_NIST_AES256_GCM), params]);
+            (algorithm, ciphertext)
+        }
+    };
+
+    Ok(der::sequence(&[
+        oid(&OID_PKCS7_DATA),
+        algorithm,
+        der::tlv(TAG_IMPLICIT_0, &ciphertext),
+    ]))
+}
+
+fn oid(oid: &Oid) -> Vec<u8> {
+    der::tlv(0x06, oid.as_bytes())
+}
+
+fn to_hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{b:02x}")).collect()
+}
+
+/*
+Attribute ::= SEQUENCE {
+  attrType OBJECT IDENTIFIER,
+  attrValues SET OF AttributeValue }
+*/
+
+#[derive(BerSequence, Debug)]
+pub struct Attribute<'a> {
+    pub attr_type: Oid<'a>,
+    pub attr_values: SetOf<Any<'a>>,
+}
+
+/*
+ContentInfo ::= SEQUENCE {
+  contentType ContentType,
+  content [0] EXPLICIT ANY DEFINED BY contentType }
+
+SignedData ::= SEQUENCE {
+  version CMSVersion,
+  digestAlgorithms DigestAlgorithmIdentifiers,
+  encapContentInfo EncapsulatedContentInfo,
+  certificates [0] IMPLICIT CertificateSet OPTIONAL,
+  crls [1] IMPLICIT RevocationInfoChoices OPTIONAL,
+  signerInfos SignerInfos }
+*/
+
+#[derive(BerSequence, Debug)]
+pub struct SignedContentInfo<'a> {
+    pub content_type: Oid<'a>,
+
+    #[tag_explicit(0)]
+    pub content: SignedData<'a>,
+}
+
+impl<'a> SignedContentInfo<'a> {
+    pub fn parse_ber(ber: &'a [u8]) -> Result<Self> {
+        let (rem, ci) =
+            Self::from_ber(ber).map_err(|err| malformed!("invalid ContentInfo: {err}"))?;
+
+        if !rem.is_empty() {
+            return Err(malformed!(
+                "trailing {} bytes after parsing ContentInfo",
+                rem.len()
+            ));
+        }
+
+        ci.validate()?;
+
+        Ok(ci)
     }
 
-    fn decrypt_content(&self, datakey: &[u8]) -> Result<Vec<u8>> {
-        let iv: Aes256CBCParameter = self
-            .content_encryption_algorithm
-            .parameters
-            .as_ref()
-            .unwrap()
-            .try_into()
-            .unwrap();
+    fn validate(&self) -> Result<()> {
+        if self.content_type != OID_PKCS7_SIGNED_DATA {
+            return Err(malformed!(
+                "unexpected content type: {}, expected {}",
+                self.content_type,
+                OID_PKCS7_SIGNED_DATA
+            ));
+        }
 
-        let ciphertext = self.combined_content()?;
-        let dec = Aes256CbcDec::new(datakey.into(), iv.as_ref().into());
-        Ok(dec
-            .decrypt_padded_vec_mut::<block_padding::Pkcs7>(&ciphertext)
-            .unwrap())
+        self.content.validate()
     }
 
-    fn combined_content(&self) -> Result<Vec<u8>> {
-        // Ignoring the OPTIONAL directive, it should always be there in our use case
-        let any = &self.encrypted_content;
+    // None if the content is detached, i.e. was sent apart
+    pub fn content(&self) -> Result<Option<Vec<u8>>> {
+        match &self.content.encap_content_info.e_content {
+            Some(content) => Ok(Some(octet_string_content(content)?)),
+            None => Ok(None),
+        }
+    }
+
+    // The X.509 certificates that came along, in DER
+    pub fn certificates(&self) -> Vec<Vec<u8>> {
+        self.content
+            .certificates
+            .iter()
+            .flat_map(|certs| certs.iter())
+            .filter(|cert| {
+                cert.header.class() == Class::Universal && cert.header.tag() == Tag::Sequence
+            })
+            .map(|cert| der::tlv(0x30, cert.data))
+            .collect()
+    }
 
-        if any.header.is_constructed() {
-            let mut data = any.data;
-            let mut combined = Vec::new();
+    // Verifies the signature of every signer over the content, and returns
+    // their signed attributes. A signer is trusted if its certificate is one
+    // of the given ones (in DER), or came along and was signed by one of them.
+    // Validity periods are not checked, as the enclave's clock is the host's.
+    pub fn verify(&self, trusted: &[&[u8]]) -> Result<Vec<VerifiedSigner>> {
+        let content = self
+            .content()?
+            .ok_or_else(|| anyhow!("the content is detached, and must be given"))?;
+        self.verify_detached(&content, trusted)
+    }
 
-            while !data.is_empty() {
-                // concatentate the inner parts
-                let (rem, part) = OctetString::from_ber(data)?;
-                combined.extend_from_slice(part.as_ref());
-                data = rem;
-            }
+    // As verify(), of content that was sent apart
+    pub fn verify_detached(
+        &self,
+        content: &[u8],
+        trusted: &[&[u8]],
+    ) -> Result<Vec<VerifiedSigner>> {
+        let embedded = self.certificates();
+        let content_type = &self.content.encap_content_info.e_content_type;
+
+        self.content
+            .signer_infos
+            .iter()
+            .map(|signer| signer.verify(content_type, content, trusted, &embedded))
+            .collect()
+    }
+}
 
-            Ok(combined)
-        } else {
-            let octets: OctetString = any.try_into()?;
-            Ok(octets.as_ref().to_vec())
+#[derive(BerSequence, Debug)]
+pub struct SignedData<'a> {
+    pub version: Integer<'a>,
+
+    pub digest_algorithms: SetOf<AlgorithmIdentifier<'a>>,
+
+    pub encap_content_info: EncapsulatedContentInfo<'a>,
+
+    #[optional]
+    #[tag_implicit(0)]
+    pub certificates: Option<SetOf<Any<'a>>>,
+
+    #[optional]
+    #[tag_implicit(1)]
+    pub crls: Option<SetOf<Any<'a>>>,
+
+    pub signer_infos: SetOf<SignerInfo<'a>>,
+}
+
+impl<'a> SignedData<'a> {
+    fn validate(&self) -> Result<()> {
+        let ver = self.version.as_i32()?;
+        if ![1, 3, 4, 5].contains(&ver) {
+            return Err(malformed!(
+                "unexpected SignedData.version: {ver}, expected 1, 3, 4 or 5"
+            ));
         }
+
+        if self.signer_infos.is_empty() {
+            return Err(malformed!(
+                "unexpected SignedData.signer_infos length: 0, expected at least 1"
+            ));
+        }
+
+        for signer in self.signer_infos.iter() {
+            signer.validate()?;
+        }
+
+        Ok(())
     }
 }
+
 /*
-Attribute ::= SEQUENCE {
-  attrType OBJECT IDENTIFIER,
-  attrValues SET OF AttributeValue }
+EncapsulatedContentInfo ::= SEQUENCE {
+  eContentType ContentType,
+  eContent [0] EXPLICIT OCTET STRING OPTIONAL }
 */
 
 #[derive(BerSequence, Debug)]
-pub struct Attribute<'a> {
-    pub attr_type: Oid<'a>,
-    pub attr_values: SetOf<Any<'a>>,
+pub struct EncapsulatedContentInfo<'a> {
+    pub e_content_type: Oid<'a>,
+
+    #[optional]
+    #[tag_explicit(0)]
+    pub e_content: Option<Any<'a>>,
+}
+
+/*
+SignerInfo ::= SEQUENCE {
+  version CMSVersion,
+  sid SignerIdentifier,
+  digestAlgorithm DigestAlgorithmIdentifier,
+  signedAttrs [0] IMPLICIT SignedAttributes OPTIONAL,
+  signatureAlgorithm SignatureAlgorithmIdentifier,
+  signature SignatureValue,
+  unsignedAttrs [1] IMPLICIT UnsignedAttributes OPTIONAL }
+
+SignerIdentifier ::= CHOICE {
+  issuerAndSerialNumber IssuerAndSerialNumber,
+  subjectKeyIdentifier [0] SubjectKeyIdentifier }
+*/
+
+#[derive(Debug)]
+pub struct SignerInfo<'a> {
+    pub version: Integer<'a>,
+    pub sid: Any<'a>,
+    pub digest_algorithm: AlgorithmIdentifier<'a>,
+    // As is, since the signature is over their DER
+    pub signed_attrs: Option<&'a [u8]>,
+    pub signature_algorithm: AlgorithmIdentifier<'a>,
+    pub signature: OctetString<'a>,
+}
+
+impl<'a> SignerInfo<'a> {
+    fn validate(&self) -> Result<()> {
+        // 1 if the sid is issuerAndSerialNumber, 3 if subjectKeyIdentifier
+        let ver = self.version.as_i32()?;
+        if ver != 1 && ver != 3 {
+            return Err(malformed!(
+                "unexpected SignerInfo.version: {ver}, expected 1 or 3"
+            ));
+        }
+
+        RecipientId::parse(&self.sid)?;
+        Ok(())
+    }
+
+    fn verify(
+        &self,
+        content_type: &Oid,
+        content: &[u8],
+        trusted: &[&[u8]],
+        embedded: &[Vec<u8>],
+    ) -> Result<VerifiedSigner> {
+        let sid = RecipientId::parse(&self.sid)?;
+        let certificate = signer_certificate(&sid, trusted, embedded)?;
+        let digest_algorithm = &self.digest_algorithm.algorithm;
+        let algorithms = signature_algorithms(
+            "SignerInfo.signatureAlgorithm",
+            &self.signature_algorithm.algorithm,
+            Some(digest_algorithm),
+        )?;
+
+        let (message, attributes) = match self.signed_attrs {
+            Some(signed_attrs) => {
+                let attributes = signed_attributes(signed_attrs)?;
+                let digest = digest::digest(message_digest_algorithm(digest_algorithm)?, content);
+                check_attribute(&attributes, &OID_PKCS9_CONTENT_TYPE, &oid(content_type))?;
+                check_attribute(
+                    &attributes,
+                    &OID_PKCS9_MESSAGE_DIGEST,
+                    &der::octet_string(digest.as_ref()),
+                )?;
+
+                // Over the DER of the attributes as a SET OF, not [0] IMPLICIT
+                (der::tlv(0x31, signed_attrs), attributes)
+            }
+            None => {
+                // Without attributes, nothing says it is of any other type
+                if *content_type != OID_PKCS7_DATA {
+                    return Err(malformed!(
+                        "the signature of {sid} has no signed attributes, but the content type is {content_type}"
+                    ));
+                }
+                (content.to_vec(), Vec::new())
+            }
+        };
+
+        verify_signature(&certificate, &algorithms, &message, self.signature.as_ref())
+            .map_err(|err| anyhow!("the signature of {sid} does not verify: {err}"))?;
+
+        Ok(VerifiedSigner {
+            certificate,
+            attributes,
+        })
+    }
+}
+
+impl<'a> TryFrom<Any<'a>> for SignerInfo<'a> {
+    type Error = asn1_rs::Error;
+
+    fn try_from(value: Any<'a>) -> Result<Self, Self::Error> {
+        value.tag().assert_eq(Tag::Sequence)?;
+        let i = value.data;
+
+        let (i, version) = Integer::from_ber(i)?;
+        let (i, sid) = Any::from_ber(i)?;
+        let (i, digest_algorithm) = AlgorithmIdentifier::from_ber(i)?;
+
+        let (rem, next) = Any::from_ber(i)?;
+        let (i, signed_attrs) =
+            if next.header.class() == Class::ContextSpecific && next.header.tag().0 == 0 {
+                (rem, Some(next.data))
+            } else {
+                (i, None)
+            };
+
+        let (i, signature_algorithm) = AlgorithmIdentifier::from_ber(i)?;
+        // unsignedAttrs, if any, are not kept
+        let (_, signature) = OctetString::from_ber(i)?;
+
+        Ok(Self {
+            version,
+            sid,
+            digest_algorithm,
+            signed_attrs,
+            signature_algorithm,
+            signature,
+        })
+    }
+}
+
+// A signer whose signature verified, with the certificate it verified with
+// (in DER) and what it signed along with the content, e.g. signingTime
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VerifiedSigner {
+    pub certificate: Vec<u8>,
+    pub attributes: Vec<SignedAttribute>,
+}
+
+impl VerifiedSigner {
+    // By the dotted OID, e.g. "1.2.840.113549.1.9.5" for signingTime
+    pub fn attribute(&self, oid: &str) -> Option<&SignedAttribute> {
+        self.attributes
+            .iter()
+            .find(|attribute| attribute.oid == oid)
+    }
+}
+
+// Each value in DER
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SignedAttribute {
+    pub oid: String,
+    pub values: Vec<Vec<u8>>,
+}
+
+// signedAttrs must be DER, so are read as such
+fn signed_attributes(signed_attrs: &[u8]) -> Result<Vec<SignedAttribute>> {
+    let mut attributes = Vec::new();
+    let mut reader = der::Reader(signed_attrs);
+    while !reader.0.is_empty() {
+        let (_, attribute) = reader.expect(0x30)?;
+        let mut attribute = der::Reader(attribute);
+        let (_, oid) = attribute.expect(0x06)?;
+        let (_, values) = attribute.expect(0x31)?;
+
+        let mut values = der::Reader(values);
+        let mut attribute = SignedAttribute {
+            oid: der::oid_string(oid),
+            values: Vec::new(),
+        };
+        while !values.0.is_empty() {
+            let (_, value, _) = values.next()?;
+            attribute.values.push(value.to_vec());
+        }
+        attributes.push(attribute);
+    }
+
+    Ok(attributes)
+}
+
+// The attribute must be there with just the value, as DER
+fn check_attribute(attributes: &[SignedAttribute], attr_type: &Oid, expected: &[u8]) -> Result<()> {
+    let oid = attr_type.to_id_string();
+    match attributes.iter().find(|attribute| attribute.oid == oid) {
+        Some(attribute) if attribute.values.len() == 1 && attribute.values[0] == expected => Ok(()),
+        Some(_) => Err(anyhow!(
+            "the signed attribute {oid} does not match the content"
+        )),
+        None => Err(malformed!("the signed attribute {oid} is missing")),
+    }
+}
+
+// The certificate of the signer, if it is trusted
+fn signer_certificate(
+    sid: &RecipientId,
+    trusted: &[&[u8]],
+    embedded: &[Vec<u8>],
+) -> Result<Vec<u8>> {
+    if let Some(cert) = trusted.iter().find(|cert| identifies(sid, cert)) {
+        return Ok(cert.to_vec());
+    }
+
+    match embedded.iter().find(|cert| identifies(sid, cert)) {
+        Some(cert) if trusted.iter().any(|issuer| issued_by(cert, issuer)) => Ok(cert.clone()),
+        Some(_) => Err(anyhow!(
+            "the certificate of {sid} was signed by none of the trusted certificates"
+        )),
+        None => Err(anyhow!("no certificate for {sid}")),
+    }
+}
+
+fn identifies(sid: &RecipientId, cert: &[u8]) -> bool {
+    match sid {
+        RecipientId::IssuerAndSerialNumber { issuer, serial } => {
+            matches!(x509::issuer_and_serial(cert), Ok((i, s)) if i == *issuer && s == *serial)
+        }
+        RecipientId::SubjectKeyIdentifier(ski) => {
+            matches!(x509::subject_key_identifier(cert), Ok(Some(id)) if id == *ski)
+        }
+        RecipientId::KekIdentifier(_) => false,
+    }
+}
+
+// Only that the issuer's key signed the certificate, not the names or that
+// the issuer is a CA, as the issuer is trusted by the caller
+fn issued_by(cert: &[u8], issuer: &[u8]) -> bool {
+    let check = || -> Result<()> {
+        let (_, cert) = der::Reader(cert).expect(0x30)?;
+        let mut cert = der::Reader(cert);
+        let (tbs, _) = cert.expect(0x30)?;
+        let (_, algorithm) = cert.expect(0x30)?;
+        let (_, signature) = cert.expect(0x03)?;
+
+        let (algorithm, _) = der::Reader(algorithm).expect(0x06)?;
+        let (_, algorithm) = Oid::from_ber(algorithm)?;
+        let algorithms = signature_algorithms("Certificate.signatureAlgorithm", &algorithm, None)?;
+        // No unused bits
+        match signature.split_first() {
+            Some((0, signature)) => verify_signature(issuer, &algorithms, tbs, signature),
+            _ => Err(anyhow!("invalid certificate signature")),
+        }
+    };
+    check().is_ok()
+}
+
+fn verify_signature(
+    cert: &[u8],
+    algorithms: &[&'static webpki::SignatureAlgorithm],
+    message: &[u8],
+    signature: &[u8],
+) -> Result<()> {
+    let cert = webpki::EndEntityCert::try_from(cert)
+        .map_err(|err| anyhow!("invalid certificate: {err}"))?;
+    // An ECDSA key is on one of the curves, which the algorithm is specific to
+    if algorithms
+        .iter()
+        .any(|algorithm| cert.verify_signature(algorithm, message, signature).is_ok())
+    {
+        Ok(())
+    } else {
+        Err(anyhow!("invalid signature"))
+    }
+}
+
+fn message_digest_algorithm(oid: &Oid) -> Result<&'static digest::Algorithm> {
+    if *oid == OID_NIST_SHA_256 {
+        Ok(&digest::SHA256)
+    } else if *oid == OID_NIST_SHA_384 {
+        Ok(&digest::SHA384)
+    } else if *oid == OID_NIST_SHA_512 {
+        Ok(&digest::SHA512)
+    } else {
+        Err(UnsupportedAlgorithm {
+            field: "SignerInfo.digestAlgorithm",
+            algorithm: oid.to_string(),
+        }
+        .into())
+    }
+}
+
+// The digest is given for signers that name the key's algorithm instead, e.g.
+// rsaEncryption, which CMS allows
+fn signature_algorithms(
+    field: &'static str,
+    algorithm: &Oid,
+    digest: Option<&Oid>,
+) -> Result<Vec<&'static webpki::SignatureAlgorithm>> {
+    let digest_is = |expected: &Oid| matches!(digest, Some(digest) if *digest == *expected);
+    let rsa = *algorithm == OID_PKCS1_RSA_ENCRYPTION;
+    let ecdsa = *algorithm == OID_EC_PUBLIC_KEY;
+
+    if *algorithm == OID_PKCS1_SHA256_WITH_RSA || (rsa && digest_is(&OID_NIST_SHA_256)) {
+        Ok(vec![&webpki::RSA_PKCS1_2048_8192_SHA256])
+    } else if *algorithm == OID_PKCS1_SHA384_WITH_RSA || (rsa && digest_is(&OID_NIST_SHA_384)) {
+        Ok(vec![&webpki::RSA_PKCS1_2048_8192_SHA384])
+    } else if *algorithm == OID_PKCS1_SHA512_WITH_RSA || (rsa && digest_is(&OID_NIST_SHA_512)) {
+        Ok(vec![&webpki::RSA_PKCS1_2048_8192_SHA512])
+    } else if *algorithm == OID_ECDSA_WITH_SHA256 || (ecdsa && digest_is(&OID_NIST_SHA_256)) {
+        Ok(vec![&webpki::ECDSA_P256_SHA256, &webpki::ECDSA_P384_SHA256])
+    } else if *algorithm == OID_ECDSA_WITH_SHA384 || (ecdsa && digest_is(&OID_NIST_SHA_384)) {
+        Ok(vec![&webpki::ECDSA_P384_SHA384, &webpki::ECDSA_P256_SHA384])
+    } else if *algorithm == OID_ED25519 {
+        Ok(vec![&webpki::ED25519])
+    } else {
+        Err(UnsupportedAlgorithm {
+            field,
+            algorithm: algorithm.to_string(),
+        }
+        .into())
+    }
+}
+
+// The inverse of SignedContentInfo::verify(), for enclaves to sign what they
+// send so that standard CMS tooling verifies it: a ContentInfo in DER with a
+// SignedData of the content, the certificate of the key (in DER), and the
+// contentType and messageDigest attributes. The digest is SHA-256 for RSA
+// keys, SHA-384 for P-384 keys and SHA-512 for Ed25519 keys (RFC 8419).
+pub fn sign(content: &[u8], key: &dyn Signer, certificate: &[u8]) -> Result<Vec<u8>> {
+    let (digest_algorithm, digest_oid, signature_algorithm) = match key.key_type() {
+        KeyType::Rsa2048 => (
+            &digest::SHA256,
+            OID_NIST_SHA_256,
+            der::sequence(&[oid(&OID_PKCS1_SHA256_WITH_RSA), der::null()]),
+        ),
+        KeyType::EcdsaP384 => (
+            &digest::SHA384,
+            OID_NIST_SHA_384,
+            der::sequence(&[oid(&OID_ECDSA_WITH_SHA384)]),
+        ),
+        KeyType::Ed25519 => (
+            &digest::SHA512,
+            OID_NIST_SHA_512,
+            der::sequence(&[oid(&OID_ED25519)]),
+        ),
+    };
+    // The parameters of SHA-2 are absent (RFC 5754)
+    let digest_algorithm_id = der::sequence(&[oid(&digest_oid)]);
+
+    let message_digest = digest::digest(digest_algorithm, content);
+    let mut attributes = vec![
+        der::sequence(&[
+            oid(&OID_PKCS9_CONTENT_TYPE),
+            der::set(&[oid(&OID_PKCS7_DATA)]),
+        ]),
+        der::sequence(&[
+            oid(&OID_PKCS9_MESSAGE_DIGEST),
+            der::set(&[der::octet_string(message_digest.as_ref())]),
+        ]),
+    ];
+    // DER has the elements of a SET OF in order
+    attributes.sort();
+    let signature = key.sign(&der::set(&attributes))?;
+
+    let (issuer, serial) = x509::issuer_and_serial(certificate)?;
+    let sid = RecipientId::IssuerAndSerialNumber { issuer, serial };
+    let signer_info = der::sequence(&[
+        der::integer(&[1]),
+        sid.to_der(),
+        digest_algorithm_id.clone(),
+        der::tlv(0xa0, &attributes.concat()),
+        signature_algorithm,
+        der::octet_string(&signature),
+    ]);
+
+    // 1, as the content is data and the signer is by issuerAndSerialNumber
+    let signed_data = der::sequence(&[
+        der::integer(&[1]),
+        der::set(&[digest_algorithm_id]),
+        der::sequence(&[
+            oid(&OID_PKCS7_DATA),
+            der::explicit(0, &der::octet_string(content)),
+        ]),
+        der::tlv(0xa0, certificate),
+        der::set(&[signer_info]),
+    ]);
+    Ok(der::sequence(&[
+        oid(&OID_PKCS7_SIGNED_DATA),
+        der::explicit(0, &signed_data),
+    ]))
 }
 
 #[cfg(test)]
 pub(crate) mod tests {
-    use super::ContentInfo;
+    use super::{
+        aes_key_unwrap, aes_key_wrap, cbc_padding_len, encrypt, encrypted_content_info, envelop,
+        oaep_hash, oid, sign, Aes256CbcEnc, BerStream, ContentEncryption, ContentInfo,
+        ContentReader, DecryptionFailed, EncryptedContentInfo, Kek, MalformedContent,
+        NoMatchingRecipient, RecipientId, SignedContentInfo, UnsupportedAlgorithm, CBC_IV_LEN,
+        OID_NIST_AES192_WRAP, OID_NIST_SHA_384, OID_PKCS1_MGF, OID_PKCS7_ENVELOPED_DATA,
+    };
+    use crate::keypair::{KeyPair, KeyType, OaepHash};
+    use crate::x509::{self, der, CertificateParams};
+    use asn1_rs::FromBer;
     use assert2::assert;
+    use cbc::cipher::crypto_common::KeyIvInit;
+    use cbc::cipher::{block_padding, BlockEncryptMut};
     use pkcs8::DecodePrivateKey;
+    use ring::aead;
     use rsa::RsaPrivateKey;
+    use std::io::Read;
 
     pub(crate) const INPUT: &str = "\
 MIAGCSqGSIb3DQEHA6CAMIACAQIxggFrMIIBZwIBAoAg+wnprylA3c8NK79jWMmDr0b8X9ztv\
@@ -472,9 +2642,566 @@ UBYkWlVgulDg28KBqahr9r04";
         let key_der = base64::decode(PRIVATE_KEY).unwrap();
         let priv_key = RsaPrivateKey::from_pkcs8_der(&key_der).unwrap();
 
-        let plaintext = ci.decrypt_content(&priv_key).unwrap();
+        let plaintext = ci
+            .decrypt_content(&KeyPair::from_private(priv_key).seal())
+            .unwrap();
         let msg = std::str::from_utf8(&plaintext).unwrap();
 
         assert!(msg == "Hello, World");
+
+        let summary = ci.to_string();
+        assert!(summary.contains("  subject key fb09e9af"));
+        assert!(summary.contains("    RSA-OAEP, Sha256 with MGF1 Sha256"));
+        assert!(summary.contains("Content:       AES-256-CBC, 16 bytes"));
+
+        let is_malformed = |ber: &[u8]| match ContentInfo::parse_ber(ber) {
+            Err(err) => err.downcast_ref::<MalformedContent>().is_some(),
+            Ok(_) => false,
+        };
+        assert!(is_malformed(&ber[..ber.len() - 20]));
+        assert!(is_malformed(b"not BER"));
+        // A SignedData
+        let key = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        let now = std::time::SystemTime::now();
+        let params = CertificateParams {
+            common_name: "signer.local".to_string(),
+            dns_names: vec![],
+            not_before: now,
+            not_after: now + std::time::Duration::from_secs(3600),
+            extensions: vec![],
+        };
+        let (cert, _) = x509::self_signed(&params, &key).unwrap();
+        assert!(is_malformed(&sign(b"Hello, World", &key, &cert).unwrap()));
+    }
+
+    #[test]
+    fn test_encrypt() {
+        let key_der = base64::decode(PRIVATE_KEY).unwrap();
+        let first = KeyPair::from_private(RsaPrivateKey::from_pkcs8_der(&key_der).unwrap());
+        let second = KeyPair::generate().unwrap();
+        let ec = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        let first_spki = first.public_key_as_der().unwrap();
+        let second_spki = second.public_key_as_der().unwrap();
+        let ec_spki = ec.public_key_as_der().unwrap();
+
+        for content_encryption in [ContentEncryption::Aes256Cbc, ContentEncryption::Aes256Gcm] {
+            let der = encrypt(
+                b"Hello, World",
+                &[
+                    first_spki.as_slice(),
+                    second_spki.as_slice(),
+                    ec_spki.as_slice(),
+                ],
+                content_encryption,
+            )
+            .unwrap();
+
+            let ci = ContentInfo::parse_ber(&der).unwrap();
+            assert!(ci.recipients().unwrap().len() == 3);
+            for key in [&first, &second, &ec] {
+                let plaintext = ci.decrypt_content(key).unwrap();
+                assert!(plaintext == b"Hello, World");
+            }
+        }
+
+        let der = encrypt(
+            b"Hello, World",
+            &[second_spki.as_slice()],
+            ContentEncryption::Aes256Gcm,
+        )
+        .unwrap();
+        let ci = ContentInfo::parse_ber(&der).unwrap();
+        assert!(ci.decrypt_content(&first).is_err());
+
+        assert!(encrypt(b"Hello, World", &[], ContentEncryption::Aes256Gcm).is_err());
+    }
+
+    #[test]
+    fn test_recipient_selection() {
+        let key = KeyPair::generate().unwrap();
+        let other = KeyPair::generate().unwrap();
+        let now = std::time::SystemTime::now();
+        let params = CertificateParams {
+            common_name: "recipient.local".to_string(),
+            dns_names: vec![],
+            not_before: now,
+            not_after: now + std::time::Duration::from_secs(3600),
+            extensions: vec![],
+        };
+        let (cert, _) = x509::self_signed(&params, &key).unwrap();
+        let (issuer, serial) = x509::issuer_and_serial(&cert).unwrap();
+
+        let spki = key.public_key_as_der().unwrap();
+        let other_spki = other.public_key_as_der().unwrap();
+        let by_cert = RecipientId::IssuerAndSerialNumber { issuer, serial };
+        let by_key = RecipientId::SubjectKeyIdentifier(vec![0; 32]);
+        let der = envelop(
+            b"Hello, World",
+            &[
+                (other_spki.as_slice(), by_key),
+                (spki.as_slice(), by_cert.clone()),
+            ],
+            ContentEncryption::Aes256Gcm,
+        )
+        .unwrap();
+
+        let ci = ContentInfo::parse_ber(&der).unwrap();
+        let recipients = ci.recipients().unwrap();
+        assert!(recipients.len() == 2);
+        assert!(recipients.contains(&by_cert));
+
+        let plaintext = ci.decrypt_content_with_certificate(&key, &cert).unwrap();
+        assert!(plaintext == b"Hello, World");
+
+        // By its own key, the key is none of them
+        let err = ci.decrypt_content(&key).unwrap_err();
+        let no_match = err.downcast_ref::<NoMatchingRecipient>().unwrap();
+        assert!(no_match.recipients == recipients);
+        let err = err.to_string();
+        assert!(err.contains("issuer CN=recipient.local, serial "));
+        assert!(err.contains(&format!("subject key {}", "00".repeat(32))));
+    }
+
+    #[test]
+    fn test_content_reader() {
+        let key_der = base64::decode(PRIVATE_KEY).unwrap();
+        let key = KeyPair::from_private(RsaPrivateKey::from_pkcs8_der(&key_der).unwrap());
+
+        // As KMS sends it, with indefinite lengths
+        let ber = base64::decode(INPUT).unwrap();
+        let mut msg = String::new();
+        ContentReader::new(ber.as_slice(), &key)
+            .unwrap()
+            .read_to_string(&mut msg)
+            .unwrap();
+        assert!(msg == "Hello, World");
+
+        let message: Vec<u8> = (0..100_000).map(|i| i as u8).collect();
+        let spki = key.public_key_as_der().unwrap();
+        for content_encryption in [ContentEncryption::Aes256Cbc, ContentEncryption::Aes256Gcm] {
+            let der = encrypt(&message, &[spki.as_slice()], content_encryption).unwrap();
+
+            let mut reader = ContentReader::new(der.as_slice(), &key).unwrap();
+            let mut plaintext = Vec::new();
+            let mut buf = [0u8; 1000];
+            loop {
+                let n = reader.read(&mut buf).unwrap();
+                if n == 0 {
+                    break;
+                }
+                plaintext.extend_from_slice(&buf[..n]);
+            }
+            assert!(plaintext == message);
+
+            let truncated = &der[..der.len() - 100];
+            let mut reader = ContentReader::new(truncated, &key).unwrap();
+            let result = reader.read_to_end(&mut Vec::new());
+            assert!(result.is_err());
+        }
+
+        let other = KeyPair::generate().unwrap();
+        let der = encrypt(&message, &[spki.as_slice()], ContentEncryption::Aes256Cbc).unwrap();
+        assert!(ContentReader::new(der.as_slice(), &other).is_err());
+    }
+
+    // RFC 3394, 4.6
+    #[test]
+    fn test_key_wrap() {
+        let kek = Kek::new(&hex(
+            "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+        ))
+        .unwrap();
+        let key = hex("00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f");
+        let wrapped =
+            hex("28c9f404c4b810f4cbccb35cfb87f8263f5786e2d80ed326cbc7f0e71a99f43bfb988b9b7a02dd21");
+
+        assert!(aes_key_wrap(&kek, &key).unwrap() == wrapped);
+        assert!(aes_key_unwrap(&kek, &wrapped).unwrap() == key);
+
+        let mut tampered = wrapped.clone();
+        tampered[0] ^= 1;
+        assert!(aes_key_unwrap(&kek, &tampered).is_err());
+    }
+
+    #[test]
+    fn test_oaep_hash() {
+        assert!(oaep_hash("hash", &OID_NIST_SHA_384).unwrap() == OaepHash::Sha384);
+
+        let err = oaep_hash("hash", &OID_PKCS1_MGF).unwrap_err();
+        let unsupported = err.downcast_ref::<UnsupportedAlgorithm>();
+        assert!(unsupported.map(|err| err.field) == Some("hash"));
+    }
+
+    // Short form lengths only, which is all the test needs
+    fn tlv(tag: u8, content: &[u8]) -> Vec<u8> {
+        let mut out = vec![tag, content.len() as u8];
+        out.extend_from_slice(content);
+        out
+    }
+
+    #[test]
+    fn test_gcm_content() {
+        let datakey = [7; 32];
+        let nonce = [1; 12];
+
+        let key = aead::UnboundKey::new(&aead::AES_256_GCM, &datakey).unwrap();
+        let mut content = b"Hello, World".to_vec();
+        aead::LessSafeKey::new(key)
+            .seal_in_place_append_tag(
+                aead::Nonce::assume_unique_for_key(nonce),
+                aead::Aad::empty(),
+                &mut content,
+            )
+            .unwrap();
+
+        let encrypted_content_info = |icv_len: u8, content: &[u8]| {
+            // id-data, id-aes256-GCM and its GCMParameters
+            let data = hex("06092a864886f70d010701");
+            let gcm_oid = hex("060960864801650304012e");
+            let params = tlv(0x30, &[tlv(0x04, &nonce), tlv(0x02, &[icv_len])].concat());
+            let algo = tlv(0x30, &[gcm_oid, params].concat());
+            tlv(0x30, &[data, algo, tlv(0x80, content)].concat())
+        };
+
+        let ber = encrypted_content_info(16, &content);
+        let (_, info) = EncryptedContentInfo::from_ber(&ber).unwrap();
+        info.validate().unwrap();
+        assert!(info.decrypt_content(&datakey).unwrap() == b"Hello, World");
+        assert!(info.decrypt_content(&[8; 32]).is_err());
+
+        let mut tampered = content.clone();
+        tampered[0] ^= 1;
+        let ber = encrypted_content_info(16, &tampered);
+        let (_, info) = EncryptedContentInfo::from_ber(&ber).unwrap();
+        assert!(info.decrypt_content(&datakey).is_err());
+
+        // ring only has 16 byte tags
+        let ber = encrypted_content_info(12, &content);
+        let (_, info) = EncryptedContentInfo::from_ber(&ber).unwrap();
+        assert!(info.validate().is_err());
+    }
+
+    #[test]
+    fn test_signed_data() {
+        let now = std::time::SystemTime::now();
+        let params = |common_name: &str, extensions| CertificateParams {
+            common_name: common_name.to_string(),
+            dns_names: vec![],
+            not_before: now,
+            not_after: now + std::time::Duration::from_secs(3600),
+            extensions,
+        };
+        let ca = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        let ca_params = params("ca.local", vec![x509::ca_extension()]);
+        let (ca_cert, _) = x509::self_signed(&ca_params, &ca).unwrap();
+        // By the same name, but another key
+        let impostor = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        let (impostor_cert, _) = x509::self_signed(&ca_params, &impostor).unwrap();
+
+        for key_type in [KeyType::Rsa2048, KeyType::EcdsaP384, KeyType::Ed25519] {
+            let key = KeyPair::generate_with(key_type).unwrap();
+            let (cert, _) =
+                x509::issue(&params("signer.local", vec![]), &key, "ca.local", &ca).unwrap();
+            let der = sign(b"Hello, World", &key, &cert).unwrap();
+
+            let ci = SignedContentInfo::parse_ber(&der).unwrap();
+            assert!(ci.content().unwrap() == Some(b"Hello, World".to_vec()));
+            assert!(ci.certificates() == vec![cert.clone()]);
+
+            let signers = ci.verify(&[&ca_cert]).unwrap();
+            assert!(signers.len() == 1);
+            assert!(signers[0].certificate == cert);
+            let message_digest = signers[0].attribute("1.2.840.113549.1.9.4").unwrap();
+            assert!(message_digest.values.len() == 1);
+
+            // The signer's own certificate is trusted as well
+            let signers = ci.verify(&[&cert]).unwrap();
+            assert!(signers[0].certificate == cert);
+
+            assert!(ci.verify(&[&impostor_cert]).is_err());
+            assert!(ci.verify(&[]).is_err());
+            assert!(ci.verify_detached(b"Hello, World", &[&ca_cert]).is_ok());
+            assert!(ci.verify_detached(b"Goodbye", &[&ca_cert]).is_err());
+
+            let mut tampered = der.clone();
+            let at = tampered
+                .windows(12)
+                .position(|w| w == b"Hello, World")
+                .unwrap();
+            tampered[at] ^= 1;
+            let ci = SignedContentInfo::parse_ber(&tampered).unwrap();
+            assert!(ci.verify(&[&ca_cert]).is_err());
+        }
+
+        // Not a SignedData
+        let ber = base64::decode(INPUT).unwrap();
+        assert!(SignedContentInfo::parse_ber(&ber).is_err());
+    }
+
+    #[test]
+    fn test_cbc_padding() {
+        for pad in 1..=16u8 {
+            let mut block = [0xaa; 16];
+            block[16 - pad as usize..].fill(pad);
+            assert!(cbc_padding_len(&block).unwrap() == pad as usize);
+        }
+
+        let mut block = [0x03; 16];
+        for last in [0, 17, 0xff] {
+            block[15] = last;
+            assert!(cbc_padding_len(&block).is_err());
+        }
+
+        // One byte of the padding is off
+        let mut block = [0x04; 16];
+        block[12] = 0x05;
+        assert!(cbc_padding_len(&block).is_err());
+    }
+
+    #[test]
+    fn test_decryption_failures() {
+        let is_failure = |result: anyhow::Result<Vec<u8>>| match result {
+            Err(err) => err.downcast_ref::<DecryptionFailed>().is_some(),
+            Ok(_) => false,
+        };
+
+        // Crafted CBC content, with the padding left to the test
+        let datakey = [7; 32];
+        let iv = [1; 16];
+        let cbc = |plaintext: &[u8]| {
+            Aes256CbcEnc::new(datakey[..].into(), iv[..].into())
+                .encrypt_padded_vec_mut::<block_padding::NoPadding>(plaintext)
+        };
+        let decrypt = |content: &[u8]| {
+            // id-data, id-aes256-CBC and its IV
+            let data = hex("06092a864886f70d010701");
+            let cbc_oid = hex("060960864801650304012a");
+            let algo = tlv(0x30, &[cbc_oid, tlv(0x04, &iv)].concat());
+            let ber = tlv(0x30, &[data, algo, tlv(0x80, content)].concat());
+            let (_, info) = EncryptedContentInfo::from_ber(&ber).unwrap();
+            info.decrypt_content(&datakey)
+        };
+
+        let valid = cbc(b"Hello, World\x04\x04\x04\x04");
+        assert!(decrypt(&valid).unwrap() == b"Hello, World");
+        for plaintext in [
+            b"Hello, World\x04\x04\x04\x00",
+            b"Hello, World\x04\x04\x03\x04",
+            b"Hello, World\x11\x11\x11\x11",
+        ] {
+            assert!(is_failure(decrypt(&cbc(plaintext))));
+        }
+        assert!(is_failure(decrypt(&valid[..15])));
+        assert!(is_failure(decrypt(&[])));
+
+        let key_der = base64::decode(PRIVATE_KEY).unwrap();
+        let key = KeyPair::from_private(RsaPrivateKey::from_pkcs8_der(&key_der).unwrap());
+        let spki = key.public_key_as_der().unwrap();
+        // Whole blocks, so that the padding is a block of its own
+        let message = [0x5a; 64];
+
+        // An encrypted key that does not decrypt fails as the content does
+        let der = encrypt(&message, &[spki.as_slice()], ContentEncryption::Aes256Gcm).unwrap();
+        let mut bad_key = der.clone();
+        let at = bad_key
+            .windows(4)
+            .position(|w| w == [0x04, 0x82, 0x01, 0x00])
+            .unwrap();
+        bad_key[at + 100] ^= 1;
+        let result = ContentInfo::parse_ber(&bad_key)
+            .unwrap()
+            .decrypt_content(&key);
+        assert!(is_failure(result));
+
+        // The last byte of the padding, by way of the block before it
+        let der = encrypt(&message, &[spki.as_slice()], ContentEncryption::Aes256Cbc).unwrap();
+        let mut bad_padding = der.clone();
+        let at = bad_padding.len() - CBC_IV_LEN - 1;
+        bad_padding[at] ^= 1;
+        let result = ContentInfo::parse_ber(&bad_padding)
+            .unwrap()
+            .decrypt_content(&key);
+        assert!(is_failure(result));
+
+        let mut reader = ContentReader::new(bad_padding.as_slice(), &key).unwrap();
+        let err = reader.read_to_end(&mut Vec::new()).unwrap_err();
+        assert!(err.to_string() == DecryptionFailed.to_string());
+    }
+
+    #[test]
+    fn test_kek_recipient() {
+        let kek = [7u8; 24];
+        let datakey = [9u8; 32];
+        let wrapped = aes_key_wrap(&Kek::new(&kek).unwrap(), &datakey).unwrap();
+        let kekri = [
+            der::integer(&[4]),
+            der::sequence(&[der::octet_string(b"hsm-key-1")]),
+            der::sequence(&[oid(&OID_NIST_AES192_WRAP)]),
+            der::octet_string(&wrapped),
+        ];
+        let content = b"Hello, World";
+        let eci = encrypted_content_info(content, &datakey, ContentEncryption::Aes256Gcm).unwrap();
+        let enveloped_data = der::sequence(&[
+            der::integer(&[2]),
+            der::set(&[der::explicit(2, &kekri.concat())]),
+            eci,
+        ]);
+        let der = der::sequence(&[
+            oid(&OID_PKCS7_ENVELOPED_DATA),
+            der::explicit(0, &enveloped_data),
+        ]);
+
+        let ci = ContentInfo::parse_ber(&der).unwrap();
+        let recipients = ci.recipients().unwrap();
+        assert!(recipients == vec![RecipientId::KekIdentifier(b"hsm-key-1".to_vec())]);
+        assert!(ci.decrypt_content_with_kek(b"hsm-key-1", &kek).unwrap() == content);
+        let mut msg = Vec::new();
+        ContentReader::with_kek(der.as_slice(), b"hsm-key-1", &kek)
+            .unwrap()
+            .read_to_end(&mut msg)
+            .unwrap();
+        assert!(msg == content);
+
+        // Another key by the same identifier
+        let err = ci
+            .decrypt_content_with_kek(b"hsm-key-1", &[8u8; 24])
+            .unwrap_err();
+        assert!(err.downcast_ref::<DecryptionFailed>().is_some());
+        let short = ci.decrypt_content_with_kek(b"hsm-key-1", &[7u8; 16]);
+        assert!(short.is_err());
+
+        // Or another identifier, or a private key
+        let err = ci.decrypt_content_with_kek(b"hsm-key-2", &kek).unwrap_err();
+        let no_match = err.downcast_ref::<NoMatchingRecipient>().unwrap();
+        assert!(no_match.recipients == recipients);
+        let key = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        let err = ci.decrypt_content(&key).unwrap_err();
+        assert!(err.downcast_ref::<NoMatchingRecipient>().is_some());
+    }
+
+    #[test]
+    fn test_nested_octet_strings() {
+        let key_der = base64::decode(PRIVATE_KEY).unwrap();
+        let key = KeyPair::from_private(RsaPrivateKey::from_pkcs8_der(&key_der).unwrap());
+
+        // The encryptedContent, of indefinite length around one OCTET STRING,
+        // with the ciphertext split into parts within parts instead
+        let ber = base64::decode(INPUT).unwrap();
+        let at = ber
+            .windows(4)
+            .position(|w| w == [0xa0, 0x80, 0x04, 0x10])
+            .unwrap()
+            + 2;
+        let ciphertext = &ber[at + 2..at + 18];
+        let parts = [
+            der::tlv(0x04, &ciphertext[..5]),
+            vec![0x24, 0x80],
+            der::tlv(0x04, &ciphertext[5..11]),
+            der::tlv(0x24, &der::tlv(0x04, &ciphertext[11..])),
+            vec![0x00, 0x00],
+        ]
+        .concat();
+        let nested = [&ber[..at], &parts, &ber[at + 18..]].concat();
+
+        let plaintext = ContentInfo::parse_ber(&nested)
+            .unwrap()
+            .decrypt_content(&key)
+            .unwrap();
+        assert!(plaintext == b"Hello, World");
+        let mut msg = Vec::new();
+        ContentReader::new(nested.as_slice(), &key)
+            .unwrap()
+            .read_to_end(&mut msg)
+            .unwrap();
+        assert!(msg == b"Hello, World");
+
+        // Parts that are not OCTET STRINGs
+        let part = der::tlv(0x24, &der::tlv(0x02, ciphertext));
+        let other = [&ber[..at], &part, &ber[at + 18..]].concat();
+        let result = ContentInfo::parse_ber(&other).and_then(|ci| ci.decrypt_content(&key));
+        assert!(result.is_err());
+        let mut reader = ContentReader::new(other.as_slice(), &key).unwrap();
+        assert!(reader.read_to_end(&mut msg).is_err());
+    }
+
+    #[test]
+    fn test_ber_stream() {
+        let read_tlv = |ber: &[u8]| {
+            BerStream {
+                inner: ber,
+                position: 0,
+            }
+            .read_tlv()
+        };
+
+        // [APPLICATION 129], a tag number of two bytes
+        let high = [0x5f, 0x81, 0x01, 0x02, 0xaa, 0xbb];
+        assert!(read_tlv(&high).unwrap() == high);
+        assert!(read_tlv(&[0x5f, 0x81, 0x81, 0x81, 0x81, 0x81, 0x01, 0x00]).is_err());
+
+        // Only constructed encodings are of indefinite length
+        assert!(read_tlv(&[0x30, 0x80, 0x04, 0x01, 0xaa, 0x00, 0x00]).is_ok());
+        assert!(read_tlv(&[0x04, 0x80, 0x04, 0x01, 0xaa, 0x00, 0x00]).is_err());
+        assert!(read_tlv(&[0x04, 0xff]).is_err());
+
+        // Nested too deep to follow, rather than overflowing the stack
+        let deep = [0x30, 0x80].repeat(100_000);
+        let err = read_tlv(&deep).unwrap_err();
+        assert!(err.downcast_ref::<MalformedContent>().is_some());
+        let key = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        assert!(ContentReader::new(deep.as_slice(), &key).is_err());
+        assert!(ContentInfo::parse_ber(&deep).is_err());
+    }
+
+    // Each byte set to a few values of note, and each truncation. A quick
+    // pass at what the fuzz targets look for, with no decryption.
+    fn mutations(input: &[u8]) -> impl Iterator<Item = Vec<u8>> + '_ {
+        let set = (0..input.len()).flat_map(move |i| {
+            [0x00, 0x80, 0xff, input[i] ^ 1].map(|b| {
+                let mut mutated = input.to_vec();
+                mutated[i] = b;
+                mutated
+            })
+        });
+        set.chain((0..input.len()).map(|len| input[..len].to_vec()))
+    }
+
+    #[test]
+    fn test_mutations() {
+        for ber in mutations(&base64::decode(INPUT).unwrap()) {
+            if let Ok(ci) = ContentInfo::parse_ber(&ber) {
+                _ = ci.recipients();
+            }
+            let mut stream = BerStream {
+                inner: ber.as_slice(),
+                position: 0,
+            };
+            while stream.read_tlv().is_ok() {}
+        }
+
+        let key = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        let now = std::time::SystemTime::now();
+        let params = CertificateParams {
+            common_name: "signer.local".to_string(),
+            dns_names: vec![],
+            not_before: now,
+            not_after: now + std::time::Duration::from_secs(3600),
+            extensions: vec![],
+        };
+        let (cert, _) = x509::self_signed(&params, &key).unwrap();
+        let signed = sign(b"Hello, World", &key, &cert).unwrap();
+        for der in mutations(&signed) {
+            if let Ok(ci) = SignedContentInfo::parse_ber(&der) {
+                _ = ci.content();
+                _ = ci.certificates();
+            }
+        }
+    }
+
+    fn hex(s: &str) -> Vec<u8> {
+        (0..s.len())
+            .step_by(2)
+            .map(|i| u8::from_str_radix(&s[i..i + 2], 16).unwrap())
+            .collect()
     }
 }
@@ -0,0 +1,181 @@
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr};
+
+use anyhow::{anyhow, Result};
+use tokio::io::{AsyncRead, AsyncReadExt};
+
+// https://www.haproxy.org/download/2.6/doc/proxy-protocol.txt, section 2.2
+const SIGNATURE: [u8; 12] = *b"\r\n\r\n\0\r\nQUIT\n";
+const HEADER_LEN: usize = 16;
+
+const VERSION: u8 = 0x20;
+const CMD_LOCAL: u8 = 0x00;
+const CMD_PROXY: u8 = 0x01;
+
+const FAMILY_TCP4: u8 = 0x11;
+const FAMILY_TCP6: u8 = 0x21;
+
+const TCP4_ADDRS_LEN: usize = 12;
+const TCP6_ADDRS_LEN: usize = 36;
+
+// The original endpoints of a proxied TCP connection, as seen by the wrapper.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ProxyHeader {
+    pub source: SocketAddr,
+    pub destination: SocketAddr,
+}
+
+impl ProxyHeader {
+    pub fn new(source: SocketAddr, destination: SocketAddr) -> Self {
+        Self {
+            source,
+            destination,
+        }
+    }
+
+    // Encodes a version 2 header. Both addresses are given as IPv6 unless
+    // they are both IPv4, as the protocol has no mixed family.
+    pub fn encode(&self) -> Vec<u8> {
+        let mut buf = Vec::with_capacity(HEADER_LEN + TCP6_ADDRS_LEN);
+        buf.extend_from_slice(&SIGNATURE);
+        buf.push(VERSION | CMD_PROXY);
+
+        match (self.source.ip(), self.destination.ip()) {
+            (IpAddr::V4(src), IpAddr::V4(dst)) => {
+                buf.push(FAMILY_TCP4);
+                buf.extend_from_slice(&(TCP4_ADDRS_LEN as u16).to_be_bytes());
+                buf.extend_from_slice(&src.octets());
+                buf.extend_from_slice(&dst.octets());
+            }
+            (src, dst) => {
+                buf.push(FAMILY_TCP6);
+                buf.extend_from_slice(&(TCP6_ADDRS_LEN as u16).to_be_bytes());
+                buf.extend_from_slice(&to_ipv6(src).octets());
+                buf.extend_from_slice(&to_ipv6(dst).octets());
+            }
+        }
+
+        buf.extend_from_slice(&self.source.port().to_be_bytes());
+        buf.extend_from_slice(&self.destination.port().to_be_bytes());
+        buf
+    }
+
+    // A LOCAL header, for connections that were not proxied on behalf of
+    // anyone. It carries no addresses.
+    pub fn encode_local() -> Vec<u8> {
+        let mut buf = SIGNATURE.to_vec();
+        buf.extend_from_slice(&[VERSION | CMD_LOCAL, 0x00, 0x00, 0x00]);
+        buf
+    }
+
+    // Reads a version 2 header off the start of a stream, leaving the rest of
+    // it alone. Returns None for headers that carry no usable addresses, e.g.
+    // LOCAL ones sent by health checks.
+    pub async fn read<R: AsyncRead + Unpin>(r: &mut R) -> Result<Option<Self>> {
+        let mut header = [0u8; HEADER_LEN];
+        r.read_exact(&mut header).await?;
+
+        if header[..12] != SIGNATURE {
+            return Err(anyhow!("missing PROXY protocol signature"));
+        }
+
+        let (version, command) = (header[12] & 0xf0, header[12] & 0x0f);
+        if version != VERSION {
+            return Err(anyhow!(
+                "unsupported PROXY protocol version {}",
+                version >> 4
+            ));
+        }
+
+        // The address block may carry TLVs past the addresses, those are skipped
+        let len = u16::from_be_bytes([header[14], header[15]]) as usize;
+        let mut addrs = vec![0u8; len];
+        r.read_exact(&mut addrs).await?;
+
+        match command {
+            CMD_LOCAL => Ok(None),
+            CMD_PROXY => Ok(Self::parse_addrs(header[13], &addrs)),
+            _ => Err(anyhow!("unknown PROXY protocol command {command}")),
+        }
+    }
+
+    fn parse_addrs(family: u8, addrs: &[u8]) -> Option<Self> {
+        let port = |at: usize| u16::from_be_bytes([addrs[at], addrs[at + 1]]);
+
+        match family {
+            FAMILY_TCP4 if addrs.len() >= TCP4_ADDRS_LEN => {
+                let src = Ipv4Addr::new(addrs[0], addrs[1], addrs[2], addrs[3]);
+                let dst = Ipv4Addr::new(addrs[4], addrs[5], addrs[6], addrs[7]);
+                Some(Self::new(
+                    SocketAddr::new(src.into(), port(8)),
+                    SocketAddr::new(dst.into(), port(10)),
+                ))
+            }
+            FAMILY_TCP6 if addrs.len() >= TCP6_ADDRS_LEN => {
+                let src: [u8; 16] = addrs[0..16].try_into().unwrap();
+                let dst: [u8; 16] = addrs[16..32].try_into().unwrap();
+                Some(Self::new(
+                    SocketAddr::new(Ipv6Addr::from(src).into(), port(32)),
+                    SocketAddr::new(Ipv6Addr::from(dst).into(), port(34)),
+                ))
+            }
+            // UNIX sockets, UDP or unspecified
+            _ => None,
+        }
+    }
+}
+
+fn to_ipv6(addr: IpAddr) -> Ipv6Addr {
+    match addr {
+        IpAddr::V4(addr) => addr.to_ipv6_mapped(),
+        IpAddr::V6(addr) => addr,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::ProxyHeader;
+    use assert2::assert;
+    use std::net::SocketAddr;
+
+    #[tokio::test]
+    async fn test_roundtrip_v4() {
+        let header = ProxyHeader::new(
+            "203.0.113.7:51234".parse().unwrap(),
+            "10.0.0.5:443".parse().unwrap(),
+        );
+
+        let mut encoded = header.encode();
+        assert!(encoded.len() == 28);
+        assert!(encoded[12..14] == [0x21, 0x11]);
+
+        // Whatever follows the header is left for the application
+        encoded.extend_from_slice(b"hello");
+        let mut r = &encoded[..];
+        assert!(ProxyHeader::read(&mut r).await.unwrap() == Some(header));
+        assert!(r == b"hello");
+    }
+
+    #[tokio::test]
+    async fn test_mixed_families() {
+        let header = ProxyHeader::new(
+            "[2001:db8::1]:51234".parse().unwrap(),
+            "10.0.0.5:443".parse().unwrap(),
+        );
+
+        let encoded = header.encode();
+        assert!(encoded.len() == 52);
+
+        let decoded = ProxyHeader::read(&mut &encoded[..]).await.unwrap().unwrap();
+        assert!(decoded.source == header.source);
+        assert!(decoded.destination == "[::ffff:10.0.0.5]:443".parse::<SocketAddr>().unwrap());
+    }
+
+    #[tokio::test]
+    async fn test_local_and_invalid() {
+        let local = ProxyHeader::encode_local();
+        assert!(ProxyHeader::read(&mut &local[..]).await.unwrap() == None);
+
+        let plain = b"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n";
+        assert!(ProxyHeader::read(&mut &plain[..]).await.is_err());
+    }
+}
@@ -0,0 +1,527 @@
+use std::collections::HashMap;
+use std::future::Future;
+use std::io;
+use std::os::unix::io::{AsRawFd, RawFd};
+use std::pin::Pin;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+use std::task::{Context, Poll};
+use std::time::Duration;
+
+use futures::future::poll_fn;
+use futures::ready;
+use lazy_static::lazy_static;
+use log::debug;
+use nix::sys::socket::{setsockopt, sockopt};
+use tokio::io::{AsyncRead, AsyncWrite, ReadBuf};
+use tokio::net::TcpStream;
+use tokio::time::Instant;
+
+use crate::policy::limits::Timeouts;
+
+// Unanswered probes after which the peer is taken to be gone
+#[cfg(target_os = "linux")]
+const KEEPALIVE_PROBES: u32 = 3;
+
+// Buffers kept for reuse, of each size, once the connections they were
+// taken for are over. Beyond this they are freed.
+const MAX_POOLED_BUFFERS: usize = 256;
+
+lazy_static! {
+    static ref BUFFERS: BufferPool = BufferPool::default();
+}
+
+// Connect to a destination, giving up after the dial timeout.
+pub async fn dial<F, T, E>(timeouts: &Timeouts, dial: F) -> Result<T, E>
+where
+    F: Future<Output = Result<T, E>>,
+    E: From<io::Error>,
+{
+    match tokio::time::timeout(timeouts.dial, dial).await {
+        Ok(res) => res,
+        Err(_) => Err(io::Error::new(
+            io::ErrorKind::TimedOut,
+            format!("connect timed out after {}s", timeouts.dial.as_secs()),
+        )
+        .into()),
+    }
+}
+
+// Have the kernel probe the peer of a connection once it has been idle for the
+// keepalive interval. If the peer went away without closing the connection (a
+// host that rebooted, a NAT that dropped the flow), reads and writes fail after
+// a few unanswered probes, ending the pump and closing the other leg with it.
+// vsock has no probes of its own: its connections end when the proxy on the
+// other side gives up on its TCP leg.
+pub fn keepalive(sock: &TcpStream, timeouts: &Timeouts) -> io::Result<()> {
+    let interval = match timeouts.keepalive {
+        Some(interval) => interval,
+        None => return Ok(()),
+    };
+
+    setsockopt(sock.as_raw_fd(), sockopt::KeepAlive, &true)?;
+    keepalive_interval(sock.as_raw_fd(), interval)
+}
+
+#[cfg(target_os = "linux")]
+fn keepalive_interval(fd: RawFd, interval: Duration) -> io::Result<()> {
+    let secs = interval.as_secs().clamp(1, i32::MAX as u64) as u32;
+    setsockopt(fd, sockopt::TcpKeepIdle, &secs)?;
+    setsockopt(fd, sockopt::TcpKeepInterval, &secs)?;
+    setsockopt(fd, sockopt::TcpKeepCount, &KEEPALIVE_PROBES)?;
+    Ok(())
+}
+
+// The system defaults apply elsewhere
+#[cfg(not(target_os = "linux"))]
+fn keepalive_interval(_fd: RawFd, _interval: Duration) -> io::Result<()> {
+    Ok(())
+}
+
+// Copy data in both directions until either side closes, the connection sits
+// idle for too long or reaches its maximum lifetime. Returns the number of
+// bytes sent upstream (a to b) and downstream (b to a). Hitting one of the
+// timeouts is not an error: the connection is simply over.
+pub async fn pump<A, B>(a: &mut A, b: &mut B, timeouts: &Timeouts) -> io::Result<(u64, u64)>
+where
+    A: AsyncRead + AsyncWrite + Unpin + ?Sized,
+    B: AsyncRead + AsyncWrite + Unpin + ?Sized,
+{
+    let activity = Activity::new();
+    let mut a = Tracked {
+        inner: a,
+        activity: &activity,
+        count: &activity.upstream,
+    };
+    let mut b = Tracked {
+        inner: b,
+        activity: &activity,
+        count: &activity.downstream,
+    };
+
+    let copy = copy_bidirectional(&mut a, &mut b, timeouts.buffer_size);
+    activity
+        .run(copy, timeouts)
+        .await
+        .map(|_| activity.counts())
+}
+
+// Like tokio::io::copy_bidirectional, with buffers of the given size taken
+// from the pool. Each direction is shut down once the other end of it closes,
+// and the buffer of that direction is handed back right away.
+async fn copy_bidirectional<A, B>(a: &mut A, b: &mut B, buffer_size: usize) -> io::Result<()>
+where
+    A: AsyncRead + AsyncWrite + Unpin,
+    B: AsyncRead + AsyncWrite + Unpin,
+{
+    let mut a_to_b = Direction::Copying(CopyBuffer::new(buffer_size));
+    let mut b_to_a = Direction::Copying(CopyBuffer::new(buffer_size));
+
+    poll_fn(|cx| {
+        let upstream = a_to_b.poll(cx, &mut *a, &mut *b)?;
+        let downstream = b_to_a.poll(cx, &mut *b, &mut *a)?;
+        match (upstream, downstream) {
+            (Poll::Ready(()), Poll::Ready(())) => Poll::Ready(Ok(())),
+            _ => Poll::Pending,
+        }
+    })
+    .await
+}
+
+enum Direction {
+    Copying(CopyBuffer),
+    ShuttingDown,
+    Done,
+}
+
+impl Direction {
+    fn poll<R, W>(&mut self, cx: &mut Context<'_>, r: &mut R, w: &mut W) -> Poll<io::Result<()>>
+    where
+        R: AsyncRead + Unpin,
+        W: AsyncWrite + Unpin,
+    {
+        loop {
+            match self {
+                Direction::Copying(buf) => {
+                    ready!(buf.poll_copy(cx, Pin::new(&mut *r), Pin::new(&mut *w)))?;
+                    *self = Direction::ShuttingDown;
+                }
+                Direction::ShuttingDown => {
+                    ready!(Pin::new(&mut *w).poll_shutdown(cx))?;
+                    *self = Direction::Done;
+                }
+                Direction::Done => return Poll::Ready(Ok(())),
+            }
+        }
+    }
+}
+
+struct CopyBuffer {
+    buf: PooledBuffer,
+    // What is left to write of the last read
+    pos: usize,
+    cap: usize,
+    read_done: bool,
+    need_flush: bool,
+}
+
+impl CopyBuffer {
+    fn new(size: usize) -> Self {
+        Self {
+            buf: BUFFERS.take(size),
+            pos: 0,
+            cap: 0,
+            read_done: false,
+            need_flush: false,
+        }
+    }
+
+    // Completes once the reader is done and everything read has been written
+    fn poll_copy<R, W>(
+        &mut self,
+        cx: &mut Context<'_>,
+        mut reader: Pin<&mut R>,
+        mut writer: Pin<&mut W>,
+    ) -> Poll<io::Result<()>>
+    where
+        R: AsyncRead + ?Sized,
+        W: AsyncWrite + ?Sized,
+    {
+        loop {
+            if self.pos == self.cap && !self.read_done {
+                let mut buf = ReadBuf::new(self.buf.as_mut());
+                match reader.as_mut().poll_read(cx, &mut buf) {
+                    Poll::Ready(res) => res?,
+                    Poll::Pending => {
+                        // Nothing more to write for now, what was written
+                        // should not sit in the writer
+                        if self.need_flush {
+                            ready!(writer.as_mut().poll_flush(cx))?;
+                            self.need_flush = false;
+                        }
+                        return Poll::Pending;
+                    }
+                }
+
+                let n = buf.filled().len();
+                if n == 0 {
+                    self.read_done = true;
+                } else {
+                    self.pos = 0;
+                    self.cap = n;
+                }
+            }
+
+            while self.pos < self.cap {
+                let n = ready!(writer
+                    .as_mut()
+                    .poll_write(cx, &self.buf.as_mut()[self.pos..self.cap]))?;
+                if n == 0 {
+                    return Poll::Ready(Err(io::Error::new(
+                        io::ErrorKind::WriteZero,
+                        "write zero bytes into writer",
+                    )));
+                }
+                self.pos += n;
+                self.need_flush = true;
+            }
+
+            if self.read_done {
+                ready!(writer.as_mut().poll_flush(cx))?;
+                return Poll::Ready(Ok(()));
+            }
+        }
+    }
+}
+
+// Copy buffers are taken from here rather than allocated for every connection,
+// as tunnels come and go at high rates.
+#[derive(Default)]
+struct BufferPool {
+    free: Mutex<HashMap<usize, Vec<Box<[u8]>>>>,
+}
+
+impl BufferPool {
+    fn take(&'static self, size: usize) -> PooledBuffer {
+        let buf = self
+            .free
+            .lock()
+            .unwrap()
+            .get_mut(&size)
+            .and_then(|free| free.pop())
+            .unwrap_or_else(|| vec![0u8; size].into_boxed_slice());
+
+        PooledBuffer {
+            buf: Some(buf),
+            pool: self,
+        }
+    }
+
+    fn give_back(&self, buf: Box<[u8]>) {
+        let mut free = self.free.lock().unwrap();
+        let free = free.entry(buf.len()).or_default();
+        if free.len() < MAX_POOLED_BUFFERS {
+            free.push(buf);
+        }
+    }
+
+    #[cfg(test)]
+    fn free(&self, size: usize) -> usize {
+        self.free.lock().unwrap().get(&size).map_or(0, Vec::len)
+    }
+}
+
+// Goes back to the pool when dropped
+struct PooledBuffer {
+    buf: Option<Box<[u8]>>,
+    pool: &'static BufferPool,
+}
+
+impl PooledBuffer {
+    fn as_mut(&mut self) -> &mut [u8] {
+        self.buf.as_mut().unwrap()
+    }
+}
+
+impl Drop for PooledBuffer {
+    fn drop(&mut self) {
+        if let Some(buf) = self.buf.take() {
+            self.pool.give_back(buf);
+        }
+    }
+}
+
+struct Activity {
+    start: Instant,
+    // Milliseconds since start
+    last: AtomicU64,
+    upstream: AtomicU64,
+    downstream: AtomicU64,
+}
+
+impl Activity {
+    fn new() -> Self {
+        Self {
+            start: Instant::now(),
+            last: AtomicU64::new(0),
+            upstream: AtomicU64::new(0),
+            downstream: AtomicU64::new(0),
+        }
+    }
+
+    // Run the copy until it is done, the connection sits idle for too long or
+    // reaches its maximum lifetime.
+    async fn run<F>(&self, copy: F, timeouts: &Timeouts) -> io::Result<()>
+    where
+        F: Future<Output = io::Result<()>>,
+    {
+        let copy = async {
+            tokio::select! {
+                res = copy => res,
+                _ = self.idle(timeouts.idle) => {
+                    debug!("closing connection idle for longer than {:?}", timeouts.idle);
+                    Ok(())
+                }
+            }
+        };
+
+        match timeouts.max_lifetime {
+            Some(lifetime) => match tokio::time::timeout(lifetime, copy).await {
+                Ok(res) => res,
+                Err(_) => {
+                    debug!("closing connection open for longer than {lifetime:?}");
+                    Ok(())
+                }
+            },
+            None => copy.await,
+        }
+    }
+
+    fn touch(&self) {
+        let now = self.start.elapsed().as_millis() as u64;
+        self.last.store(now, Ordering::Relaxed);
+    }
+
+    // Completes once nothing has been read for the given duration, never
+    // if there is no idle timeout.
+    async fn idle(&self, timeout: Option<Duration>) {
+        let timeout = match timeout {
+            Some(timeout) => timeout,
+            None => return std::future::pending().await,
+        };
+
+        loop {
+            let last = self.start + Duration::from_millis(self.last.load(Ordering::Relaxed));
+            let deadline = last + timeout;
+            if Instant::now() >= deadline {
+                return;
+            }
+            tokio::time::sleep_until(deadline).await;
+        }
+    }
+
+    fn counts(&self) -> (u64, u64) {
+        (
+            self.upstream.load(Ordering::Relaxed),
+            self.downstream.load(Ordering::Relaxed),
+        )
+    }
+}
+
+// Records reads from the wrapped stream
+struct Tracked<'a, S: ?Sized> {
+    inner: &'a mut S,
+    activity: &'a Activity,
+    count: &'a AtomicU64,
+}
+
+impl<'a, S: AsyncRead + Unpin + ?Sized> AsyncRead for Tracked<'a, S> {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+        let before = buf.filled().len();
+
+        let res = Pin::new(&mut *this.inner).poll_read(cx, buf);
+        if let Poll::Ready(Ok(())) = res {
+            let n = buf.filled().len() - before;
+            if n > 0 {
+                this.count.fetch_add(n as u64, Ordering::Relaxed);
+                this.activity.touch();
+            }
+        }
+
+        res
+    }
+}
+
+impl<'a, S: AsyncWrite + Unpin + ?Sized> AsyncWrite for Tracked<'a, S> {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        Pin::new(&mut *self.get_mut().inner).poll_write(cx, buf)
+    }
+
+    fn poll_flush(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut *self.get_mut().inner).poll_flush(cx)
+    }
+
+    fn poll_shutdown(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut *self.get_mut().inner).poll_shutdown(cx)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{keepalive, pump, BUFFERS};
+    use crate::policy::limits::Timeouts;
+    use assert2::assert;
+    use std::time::Duration;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::{TcpListener, TcpStream};
+
+    #[tokio::test]
+    async fn test_pump_counts() {
+        let (mut client, mut a) = tokio::io::duplex(1024);
+        let (mut b, mut server) = tokio::io::duplex(1024);
+
+        let pump_task =
+            tokio::task::spawn(async move { pump(&mut a, &mut b, &Timeouts::default()).await });
+
+        client.write_all(b"ping").await.unwrap();
+        let mut buf = [0u8; 4];
+        server.read_exact(&mut buf).await.unwrap();
+        server.write_all(b"pong!").await.unwrap();
+        let mut buf = [0u8; 5];
+        client.read_exact(&mut buf).await.unwrap();
+
+        drop(client);
+        drop(server);
+
+        assert!(pump_task.await.unwrap().unwrap() == (4, 5));
+    }
+
+    #[tokio::test]
+    async fn test_pump_idle_timeout() {
+        let (mut client, mut a) = tokio::io::duplex(1024);
+        let (mut b, _server) = tokio::io::duplex(1024);
+
+        let timeouts = Timeouts {
+            idle: Some(Duration::from_millis(100)),
+            ..Timeouts::default()
+        };
+
+        let pump_task = tokio::task::spawn(async move { pump(&mut a, &mut b, &timeouts).await });
+
+        client.write_all(b"hello").await.unwrap();
+
+        // Neither side closes, the pump gives up on its own
+        let res = tokio::time::timeout(Duration::from_secs(2), pump_task)
+            .await
+            .expect("idle connection was not reaped");
+        assert!(res.unwrap().unwrap() == (5, 0));
+    }
+
+    #[tokio::test]
+    async fn test_pump_buffers() {
+        // A size no other test uses, as the pool is shared
+        let timeouts = Timeouts::default().with_buffer_kb(Some(3));
+        let (mut client, mut a) = tokio::io::duplex(64 * 1024);
+        let (mut b, mut server) = tokio::io::duplex(64 * 1024);
+
+        let pump_task = tokio::task::spawn(async move { pump(&mut a, &mut b, &timeouts).await });
+
+        // Larger than a buffer, so that it takes several reads
+        let data: Vec<u8> = (0..10_000u32).map(|i| i as u8).collect();
+        client.write_all(&data).await.unwrap();
+        let mut buf = vec![0u8; data.len()];
+        server.read_exact(&mut buf).await.unwrap();
+        assert!(buf == data);
+
+        // Closing one end leaves the other direction open
+        client.shutdown().await.unwrap();
+        assert!(server.read(&mut buf).await.unwrap() == 0);
+        server.write_all(b"bye").await.unwrap();
+        let mut bye = [0u8; 3];
+        client.read_exact(&mut bye).await.unwrap();
+        assert!(&bye == b"bye");
+
+        drop(server);
+        assert!(pump_task.await.unwrap().unwrap() == (10_000, 3));
+
+        // Both buffers are handed back for the next connection
+        assert!(BUFFERS.free(3 * 1024) == 2);
+    }
+
+    async fn tcp_pair() -> (TcpStream, TcpStream) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let client = TcpStream::connect(listener.local_addr().unwrap())
+            .await
+            .unwrap();
+        let (server, _) = listener.accept().await.unwrap();
+        (client, server)
+    }
+
+    #[tokio::test]
+    async fn test_keepalive() {
+        use nix::sys::socket::{getsockopt, sockopt};
+        use std::os::unix::io::AsRawFd;
+
+        let (client, _server) = tcp_pair().await;
+        keepalive(&client, &Timeouts::default()).unwrap();
+        assert!(!getsockopt(client.as_raw_fd(), sockopt::KeepAlive).unwrap());
+
+        let timeouts = Timeouts {
+            keepalive: Some(Duration::from_secs(15)),
+            ..Timeouts::default()
+        };
+        keepalive(&client, &timeouts).unwrap();
+        assert!(getsockopt(client.as_raw_fd(), sockopt::KeepAlive).unwrap());
+        #[cfg(target_os = "linux")]
+        assert!(getsockopt(client.as_raw_fd(), sockopt::TcpKeepIdle).unwrap() == 15);
+    }
+}
@@ -0,0 +1,276 @@
+use std::collections::HashMap;
+use std::io;
+use std::net::{IpAddr, SocketAddr};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+use futures::stream::FuturesUnordered;
+use futures::StreamExt;
+use lazy_static::lazy_static;
+use log::{debug, warn};
+use tokio::net::TcpStream;
+
+use crate::metrics;
+use crate::proxy::dns::{self, TYPE_A, TYPE_AAAA};
+
+// Bounds on how long answers are cached for, whatever their TTL
+const MIN_TTL: Duration = Duration::from_secs(5);
+const MAX_TTL: Duration = Duration::from_secs(300);
+
+// For answers from the system resolver, which come without a TTL
+const SYSTEM_TTL: Duration = Duration::from_secs(30);
+
+// Once this many names are cached, the expired ones are forgotten
+const MAX_CACHED_NAMES: usize = 1024;
+
+// How long to wait on a connection attempt before starting the next one
+// in parallel (RFC 8305, section 5)
+const CONNECTION_ATTEMPT_DELAY: Duration = Duration::from_millis(250);
+
+lazy_static! {
+    // Used by the host to resolve the destinations of the enclave
+    pub static ref RESOLVER: Resolver = Resolver::new(
+        std::fs::read_to_string(dns::RESOLV_CONF)
+            .ok()
+            .and_then(|conf| dns::upstream_nameserver(&conf)),
+    );
+}
+
+struct Cached {
+    addrs: Vec<IpAddr>,
+    expires: Instant,
+}
+
+// Caches the addresses of names for as long as their records say. Names are
+// looked up with the nameserver of the host directly, to learn the TTLs, and
+// with the system resolver if that fails (e.g. for names in /etc/hosts, or
+// ones that rely on search domains).
+pub struct Resolver {
+    nameserver: Option<SocketAddr>,
+    cache: Mutex<HashMap<String, Cached>>,
+}
+
+impl Resolver {
+    pub fn new(nameserver: Option<SocketAddr>) -> Self {
+        Self {
+            nameserver,
+            cache: Mutex::new(HashMap::new()),
+        }
+    }
+
+    pub async fn lookup(&self, host: &str) -> io::Result<Vec<IpAddr>> {
+        if let Ok(addr) = host.parse::<IpAddr>() {
+            return Ok(vec![addr]);
+        }
+
+        let key = host.to_ascii_lowercase();
+        if let Some(addrs) = self.cached(&key, false) {
+            metrics::PROXY.dns_cache("hit");
+            return Ok(addrs);
+        }
+        metrics::PROXY.dns_cache("miss");
+
+        match self.resolve(host).await {
+            Ok((addrs, ttl)) => {
+                self.insert(key, addrs.clone(), ttl);
+                Ok(addrs)
+            }
+            // Better stale than nothing at all during an outage
+            Err(err) => match self.cached(&key, true) {
+                Some(addrs) => {
+                    warn!("Failed to resolve {host}, using stale addresses: {err}");
+                    metrics::PROXY.dns_cache("stale");
+                    Ok(addrs)
+                }
+                None => Err(err),
+            },
+        }
+    }
+
+    fn cached(&self, key: &str, stale: bool) -> Option<Vec<IpAddr>> {
+        let cache = self.cache.lock().unwrap();
+        cache
+            .get(key)
+            .filter(|cached| stale || cached.expires > Instant::now())
+            .map(|cached| cached.addrs.clone())
+    }
+
+    fn insert(&self, key: String, addrs: Vec<IpAddr>, ttl: Duration) {
+        let mut cache = self.cache.lock().unwrap();
+        let now = Instant::now();
+
+        if cache.len() >= MAX_CACHED_NAMES && !cache.contains_key(&key) {
+            cache.retain(|_, cached| cached.expires > now);
+        }
+
+        cache.insert(
+            key,
+            Cached {
+                addrs,
+                expires: now + ttl,
+            },
+        );
+    }
+
+    async fn resolve(&self, host: &str) -> io::Result<(Vec<IpAddr>, Duration)> {
+        if let Some(nameserver) = self.nameserver {
+            match query(host, nameserver).await {
+                Ok(answers) if !answers.is_empty() => {
+                    let ttl = answers.iter().map(|(_, ttl)| *ttl).min().unwrap_or(0);
+                    let ttl = Duration::from_secs(ttl as u64).clamp(MIN_TTL, MAX_TTL);
+                    let addrs = answers.into_iter().map(|(addr, _)| addr).collect();
+                    return Ok((addrs, ttl));
+                }
+                Ok(_) => debug!("No addresses for {host} from {nameserver}"),
+                Err(err) => debug!("Failed to query {nameserver} for {host}: {err}"),
+            }
+        }
+
+        let addrs: Vec<IpAddr> = tokio::net::lookup_host((host, 0))
+            .await?
+            .map(|addr| addr.ip())
+            .collect();
+        Ok((addrs, SYSTEM_TTL))
+    }
+}
+
+// The A and AAAA records of a name, asked for at the same time
+async fn query(host: &str, nameserver: SocketAddr) -> anyhow::Result<Vec<(IpAddr, u32)>> {
+    let v4 = dns::build_query(rand::random(), host, TYPE_A);
+    let v6 = dns::build_query(rand::random(), host, TYPE_AAAA);
+
+    let (v4, v6) = tokio::join!(
+        dns::query_upstream(&v4, nameserver),
+        dns::query_upstream(&v6, nameserver)
+    );
+
+    // One family failing is no reason to ignore the other
+    let mut answers = Vec::new();
+    let mut err = None;
+    for resp in [v4, v6] {
+        match resp.and_then(|resp| dns::parse_addresses(&resp)) {
+            Ok(addrs) => answers.extend(addrs),
+            Err(e) => err = Some(e),
+        }
+    }
+
+    match err {
+        Some(err) if answers.is_empty() => Err(err),
+        _ => Ok(answers),
+    }
+}
+
+// Connect to whichever of the addresses answers first. Attempts are made in
+// turn, alternating between address families, and the next one is started
+// whenever the previous fails or is slow to complete ("happy eyeballs").
+pub async fn connect_any(addrs: &[SocketAddr]) -> io::Result<TcpStream> {
+    let mut pending = interleave(addrs).into_iter().peekable();
+    let mut attempts = FuturesUnordered::new();
+    let mut last_err = None;
+
+    loop {
+        if attempts.is_empty() {
+            match pending.next() {
+                Some(addr) => attempts.push(TcpStream::connect(addr)),
+                None => {
+                    return Err(last_err.unwrap_or_else(|| {
+                        io::Error::new(io::ErrorKind::NotFound, "no addresses to connect to")
+                    }))
+                }
+            }
+        }
+
+        let more = pending.peek().is_some();
+        tokio::select! {
+            Some(res) = attempts.next() => match res {
+                Ok(stream) => return Ok(stream),
+                Err(err) => {
+                    last_err = Some(err);
+                    if let Some(addr) = pending.next() {
+                        attempts.push(TcpStream::connect(addr));
+                    }
+                }
+            },
+            _ = tokio::time::sleep(CONNECTION_ATTEMPT_DELAY), if more => {
+                attempts.push(TcpStream::connect(pending.next().unwrap()));
+            }
+        }
+    }
+}
+
+// Alternate between the families, starting with that of the first address
+fn interleave(addrs: &[SocketAddr]) -> Vec<SocketAddr> {
+    let first_v4 = match addrs.first() {
+        Some(addr) => addr.is_ipv4(),
+        None => return Vec::new(),
+    };
+
+    let (first, second): (Vec<_>, Vec<_>) = addrs
+        .iter()
+        .copied()
+        .partition(|addr| addr.is_ipv4() == first_v4);
+
+    let mut out = Vec::with_capacity(addrs.len());
+    let (mut first, mut second) = (first.into_iter(), second.into_iter());
+    loop {
+        match (first.next(), second.next()) {
+            (None, None) => return out,
+            (a, b) => {
+                out.extend(a);
+                out.extend(b);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{connect_any, interleave, Resolver};
+    use assert2::assert;
+    use std::net::{IpAddr, SocketAddr};
+    use tokio::net::TcpListener;
+
+    fn addrs(addrs: &[&str]) -> Vec<SocketAddr> {
+        addrs.iter().map(|addr| addr.parse().unwrap()).collect()
+    }
+
+    #[test]
+    fn test_interleave() {
+        let mixed = addrs(&["[::1]:80", "[::2]:80", "10.0.0.1:80"]);
+        let expected = addrs(&["[::1]:80", "10.0.0.1:80", "[::2]:80"]);
+        assert!(interleave(&mixed) == expected);
+        assert!(interleave(&[]).is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_connect_any() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let open = listener.local_addr().unwrap();
+
+        // Nothing listens on the first one, the second one is tried right
+        // after it is refused
+        let closed = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let refused = closed.local_addr().unwrap();
+        drop(closed);
+
+        let stream = connect_any(&[refused, open]).await.unwrap();
+        assert!(stream.peer_addr().unwrap() == open);
+
+        assert!(connect_any(&[refused]).await.is_err());
+        assert!(connect_any(&[]).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_lookup_cached() {
+        let resolver = Resolver::new(None);
+
+        let addrs = resolver.lookup("localhost").await.unwrap();
+        assert!(addrs.contains(&"127.0.0.1".parse::<IpAddr>().unwrap()));
+        assert!(resolver.cached("localhost", false) == Some(addrs));
+
+        // Addresses are not looked up at all
+        let addrs = resolver.lookup("10.1.2.3").await.unwrap();
+        assert!(addrs == vec!["10.1.2.3".parse::<IpAddr>().unwrap()]);
+        assert!(resolver.cached("10.1.2.3", true) == None);
+    }
+}
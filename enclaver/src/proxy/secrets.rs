@@ -0,0 +1,206 @@
+use anyhow::{anyhow, Result};
+use aws_types::credentials::Credentials;
+use http::uri::{Authority, Scheme};
+use http::Uri;
+use hyper::body::Bytes;
+use hyper::{Method, Request, StatusCode};
+use serde_json::Value;
+
+use super::aws_util;
+use super::kms::{HttpClient, KmsClient};
+use crate::manifest::Secret;
+
+const X_AMZ_TARGET: &str = "x-amz-target";
+
+const X_AMZ_JSON: &str = "application/x-amz-json-1.1";
+
+// Fetches the secrets of the manifest from Secrets Manager and Parameter
+// Store, through the egress proxy, for the runtime to hand to the app before
+// it starts. Ciphertexts are decrypted by KMS with an attestation, so that
+// only the enclave can decrypt them.
+pub struct SecretsFetcher {
+    client: Box<dyn HttpClient + Send + Sync>,
+    credentials: Credentials,
+    region: String,
+    kms: Option<KmsClient>,
+}
+
+impl SecretsFetcher {
+    pub fn new(
+        client: Box<dyn HttpClient + Send + Sync>,
+        credentials: Credentials,
+        region: &str,
+    ) -> Self {
+        Self {
+            client,
+            credentials,
+            region: region.to_string(),
+            kms: None,
+        }
+    }
+
+    // For kms_ciphertext secrets, which fail to fetch without it
+    pub fn with_kms(mut self, kms: KmsClient) -> Self {
+        self.kms = Some(kms);
+        self
+    }
+
+    pub async fn fetch(&self, secret: &Secret) -> Result<Vec<u8>> {
+        if let Some(ref secret_id) = secret.secrets_manager {
+            self.get_secret_value(secret_id).await
+        } else if let Some(ref name) = secret.parameter_store {
+            self.get_parameter(name).await
+        } else if let Some(ref ciphertext) = secret.kms_ciphertext {
+            let kms = self
+                .kms
+                .as_ref()
+                .ok_or(anyhow!("KMS is not available to decrypt the secret"))?;
+            kms.decrypt(&base64::decode(ciphertext)?, None).await
+        } else {
+            Err(anyhow!("secret {} has no source", secret.name))
+        }
+    }
+
+    async fn get_secret_value(&self, secret_id: &str) -> Result<Vec<u8>> {
+        let body = serde_json::json!({ "SecretId": secret_id });
+        let resp = self
+            .call("secretsmanager", "secretsmanager.GetSecretValue", body)
+            .await?;
+
+        if let Some(value) = resp["SecretString"].as_str() {
+            Ok(value.as_bytes().to_vec())
+        } else if let Some(value) = resp["SecretBinary"].as_str() {
+            Ok(base64::decode(value)?)
+        } else {
+            Err(anyhow!("secret {secret_id} has no value"))
+        }
+    }
+
+    // SecureString parameters are decrypted by Parameter Store
+    async fn get_parameter(&self, name: &str) -> Result<Vec<u8>> {
+        let body = serde_json::json!({ "Name": name, "WithDecryption": true });
+        let resp = self.call("ssm", "AmazonSSM.GetParameter", body).await?;
+
+        let value = resp["Parameter"]["Value"]
+            .as_str()
+            .ok_or(anyhow!("parameter {name} has no value"))?;
+        Ok(value.as_bytes().to_vec())
+    }
+
+    async fn call(&self, service: &str, target: &str, body: Value) -> Result<Value> {
+        let authority =
+            Authority::from_maybe_shared(format!("{service}.{}.amazonaws.com", self.region))?;
+        let uri = Uri::builder()
+            .scheme(Scheme::HTTPS)
+            .authority(authority)
+            .path_and_query("/")
+            .build()?;
+
+        let req = Request::builder()
+            .method(Method::POST)
+            .uri(uri)
+            .header(X_AMZ_TARGET, target)
+            .header(hyper::header::CONTENT_TYPE, X_AMZ_JSON)
+            .body(Bytes::from(body.to_string()))?;
+        let req = aws_util::sign_request(req, &self.credentials, &self.region, service)?;
+
+        let resp = self.client.request(req).await?;
+        let status = resp.status();
+        let body = hyper::body::to_bytes(resp.into_body()).await?;
+        if status != StatusCode::OK {
+            return Err(anyhow!(
+                "{target} failed with {status}: {}",
+                String::from_utf8_lossy(&body)
+            ));
+        }
+
+        Ok(serde_json::from_slice(&body)?)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{SecretsFetcher, X_AMZ_TARGET};
+    use crate::manifest::Secret;
+    use crate::proxy::kms::HttpClient;
+    use assert2::assert;
+    use async_trait::async_trait;
+    use aws_types::credentials::Credentials;
+    use hyper::{Body, Request, Response, StatusCode};
+
+    struct Mock;
+
+    #[async_trait]
+    impl HttpClient for Mock {
+        async fn request(
+            &self,
+            req: Request<Body>,
+        ) -> std::result::Result<Response<Body>, hyper::Error> {
+            let authz = req.headers()[hyper::header::AUTHORIZATION]
+                .to_str()
+                .unwrap();
+            assert!(authz.starts_with("AWS4-HMAC-SHA256 Credential="));
+
+            let target = req.headers()[X_AMZ_TARGET].to_str().unwrap().to_string();
+            let host = req.uri().host().unwrap().to_string();
+            let body = hyper::body::to_bytes(req.into_body()).await?;
+            let body: serde_json::Value = serde_json::from_slice(&body).unwrap();
+
+            let resp = match target.as_str() {
+                "secretsmanager.GetSecretValue" if body["SecretId"] == "db" => {
+                    assert!(host == "secretsmanager.us-east-1.amazonaws.com");
+                    serde_json::json!({ "SecretString": "hunter2" })
+                }
+                "AmazonSSM.GetParameter" if body["Name"] == "/app/api_key" => {
+                    assert!(host == "ssm.us-east-1.amazonaws.com");
+                    serde_json::json!({ "Parameter": { "Value": "s3cr3t" } })
+                }
+                _ => {
+                    return Ok(Response::builder()
+                        .status(StatusCode::BAD_REQUEST)
+                        .body(Body::from("ResourceNotFoundException"))
+                        .unwrap())
+                }
+            };
+
+            Ok(Response::new(Body::from(resp.to_string())))
+        }
+    }
+
+    fn secret(secrets_manager: Option<&str>, parameter_store: Option<&str>) -> Secret {
+        Secret {
+            name: "test".to_string(),
+            secrets_manager: secrets_manager.map(str::to_string),
+            parameter_store: parameter_store.map(str::to_string),
+            kms_ciphertext: None,
+            env: None,
+            file: None,
+        }
+    }
+
+    #[tokio::test]
+    async fn test_fetch() {
+        let credentials = Credentials::from_keys("TESTKEY", "TESTSECRET", None);
+        let fetcher = SecretsFetcher::new(Box::new(Mock), credentials, "us-east-1");
+
+        let value = fetcher.fetch(&secret(Some("db"), None)).await.unwrap();
+        assert!(value == b"hunter2");
+
+        let value = fetcher
+            .fetch(&secret(None, Some("/app/api_key")))
+            .await
+            .unwrap();
+        assert!(value == b"s3cr3t");
+
+        let err = fetcher
+            .fetch(&secret(Some("other"), None))
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("ResourceNotFoundException"));
+
+        // Without a KmsClient to decrypt with
+        let mut ciphertext = secret(None, None);
+        ciphertext.kms_ciphertext = Some(base64::encode("ciphertext"));
+        assert!(fetcher.fetch(&ciphertext).await.is_err());
+    }
+}
@@ -0,0 +1,285 @@
+use std::io;
+use std::time::Duration;
+
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+
+use crate::policy::{Denial, EgressPolicy};
+
+// The server name TLS clients ask for (RFC 6066, section 3) is read off the
+// start of tunnels, without terminating TLS, so that it can be checked against
+// the destination the tunnel was opened to.
+
+const CONTENT_HANDSHAKE: u8 = 0x16;
+const HANDSHAKE_CLIENT_HELLO: u8 = 0x01;
+const EXT_SERVER_NAME: u16 = 0x0000;
+const NAME_TYPE_HOST: u8 = 0x00;
+
+const RECORD_HEADER_LEN: usize = 5;
+
+// ClientHellos are well under this, even with post-quantum key shares
+const MAX_HELLO_LEN: usize = 64 * 1024;
+
+// For the rest of a ClientHello, once it has started
+const HELLO_TIMEOUT: Duration = Duration::from_secs(10);
+
+// A fatal access_denied alert, for clients to report something better than a
+// closed connection
+const ACCESS_DENIED_ALERT: [u8; 7] = [0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x31];
+
+// Wait for whichever end of a tunnel speaks first, and pass on what it said.
+// If it is the client starting a TLS handshake, its server name is checked
+// first, and nothing is passed on if the policy does not allow it. Protocols
+// where the server speaks first (e.g. SMTP) are let through unchecked.
+pub(crate) async fn check_tunnel<C, R>(
+    client: &mut C,
+    remote: &mut R,
+    host: &str,
+    port: u16,
+    egress_policy: &EgressPolicy,
+) -> io::Result<Result<(), Denial>>
+where
+    C: AsyncRead + AsyncWrite + Unpin,
+    R: AsyncRead + AsyncWrite + Unpin,
+{
+    if !egress_policy.enforces_sni() {
+        return Ok(Ok(()));
+    }
+
+    let mut first = [0u8; 1];
+    let mut from_remote = vec![0u8; 4096];
+
+    tokio::select! {
+        n = client.read(&mut first) => {
+            if n? == 0 {
+                return Ok(Ok(()));
+            }
+            if first[0] != CONTENT_HANDSHAKE {
+                remote.write_all(&first).await?;
+                return Ok(Ok(()));
+            }
+
+            let mut r = (&first[..]).chain(&mut *client);
+            let (raw, handshake) =
+                match tokio::time::timeout(HELLO_TIMEOUT, read_handshake(&mut r)).await {
+                    Ok(res) => res?,
+                    Err(_) => {
+                        return Err(io::Error::new(
+                            io::ErrorKind::TimedOut,
+                            "timed out reading TLS ClientHello",
+                        ))
+                    }
+                };
+
+            let server_name = parse_server_name(&handshake)?;
+            if let Err(denial) =
+                egress_policy.check_server_name(host, port, server_name.as_deref())
+            {
+                _ = client.write_all(&ACCESS_DENIED_ALERT).await;
+                return Ok(Err(denial));
+            }
+
+            remote.write_all(&raw).await?;
+        }
+        n = remote.read(&mut from_remote) => {
+            client.write_all(&from_remote[..n?]).await?;
+        }
+    }
+
+    Ok(Ok(()))
+}
+
+// Read the records that make up the first handshake message. Returns them as
+// they were read, to be passed on, and the message they carry.
+async fn read_handshake<R: AsyncRead + Unpin>(r: &mut R) -> io::Result<(Vec<u8>, Vec<u8>)> {
+    let mut raw = Vec::new();
+    let mut handshake = Vec::new();
+
+    loop {
+        let mut header = [0u8; RECORD_HEADER_LEN];
+        r.read_exact(&mut header).await?;
+
+        let len = u16::from_be_bytes([header[3], header[4]]) as usize;
+        if header[0] != CONTENT_HANDSHAKE || raw.len() + RECORD_HEADER_LEN + len > MAX_HELLO_LEN {
+            return Err(invalid("not a TLS ClientHello"));
+        }
+
+        raw.extend_from_slice(&header);
+        let start = raw.len();
+        raw.resize(start + len, 0);
+        r.read_exact(&mut raw[start..]).await?;
+        handshake.extend_from_slice(&raw[start..]);
+
+        // A message may be split across several records
+        if handshake.len() >= 4 {
+            let msg_len = u32::from_be_bytes([0, handshake[1], handshake[2], handshake[3]]);
+            if handshake.len() >= 4 + msg_len as usize {
+                return Ok((raw, handshake));
+            }
+        }
+    }
+}
+
+// The host name in the server_name extension of a ClientHello, if any
+fn parse_server_name(handshake: &[u8]) -> io::Result<Option<String>> {
+    let mut msg = Reader(handshake);
+    if msg.u8()? != HANDSHAKE_CLIENT_HELLO {
+        return Err(invalid("not a TLS ClientHello"));
+    }
+    let len = msg.u24()?;
+    let mut hello = Reader(msg.take(len)?);
+
+    // legacy_version, random
+    hello.take(2 + 32)?;
+    let len = hello.u8()? as usize;
+    hello.take(len)?; // legacy_session_id
+    let len = hello.u16()? as usize;
+    hello.take(len)?; // cipher_suites
+    let len = hello.u8()? as usize;
+    hello.take(len)?; // legacy_compression_methods
+
+    // Extensions are optional in older versions
+    if hello.0.is_empty() {
+        return Ok(None);
+    }
+
+    let len = hello.u16()? as usize;
+    let mut extensions = Reader(hello.take(len)?);
+    while !extensions.0.is_empty() {
+        let ext_type = extensions.u16()?;
+        let len = extensions.u16()? as usize;
+        let mut ext = Reader(extensions.take(len)?);
+        if ext_type != EXT_SERVER_NAME {
+            continue;
+        }
+
+        let len = ext.u16()? as usize;
+        let mut names = Reader(ext.take(len)?);
+        while !names.0.is_empty() {
+            let name_type = names.u8()?;
+            let len = names.u16()? as usize;
+            let name = names.take(len)?;
+            if name_type == NAME_TYPE_HOST {
+                return match std::str::from_utf8(name) {
+                    Ok(name) => Ok(Some(name.to_string())),
+                    Err(_) => Err(invalid("server name is not valid UTF-8")),
+                };
+            }
+        }
+    }
+
+    Ok(None)
+}
+
+struct Reader<'a>(&'a [u8]);
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, n: usize) -> io::Result<&'a [u8]> {
+        if self.0.len() < n {
+            return Err(invalid("truncated TLS ClientHello"));
+        }
+        let (head, rest) = self.0.split_at(n);
+        self.0 = rest;
+        Ok(head)
+    }
+
+    fn u8(&mut self) -> io::Result<u8> {
+        Ok(self.take(1)?[0])
+    }
+
+    fn u16(&mut self) -> io::Result<u16> {
+        let b = self.take(2)?;
+        Ok(u16::from_be_bytes([b[0], b[1]]))
+    }
+
+    fn u24(&mut self) -> io::Result<usize> {
+        let b = self.take(3)?;
+        Ok(u32::from_be_bytes([0, b[0], b[1], b[2]]) as usize)
+    }
+}
+
+fn invalid(msg: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, msg.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{check_tunnel, parse_server_name, read_handshake, ACCESS_DENIED_ALERT};
+    use crate::manifest::Egress;
+    use crate::policy::EgressPolicy;
+    use assert2::assert;
+    use std::convert::TryFrom;
+    use std::sync::Arc;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    // A real ClientHello, as rustls sends it
+    fn client_hello(server_name: &str) -> Vec<u8> {
+        let config = rustls::ClientConfig::builder()
+            .with_safe_defaults()
+            .with_root_certificates(rustls::RootCertStore::empty())
+            .with_no_client_auth();
+        let name = rustls::ServerName::try_from(server_name).unwrap();
+        let mut conn = rustls::ClientConnection::new(Arc::new(config), name).unwrap();
+
+        let mut hello = Vec::new();
+        conn.write_tls(&mut hello).unwrap();
+        hello
+    }
+
+    fn enforcing_policy() -> EgressPolicy {
+        EgressPolicy::new(&Egress {
+            allow: Some(vec!["example.com".to_string()]),
+            enforce_sni: Some(true),
+            ..Default::default()
+        })
+    }
+
+    #[tokio::test]
+    async fn test_parse_server_name() {
+        let hello = client_hello("example.com");
+        let (raw, handshake) = read_handshake(&mut &hello[..]).await.unwrap();
+        assert!(raw == hello);
+        assert!(parse_server_name(&handshake).unwrap() == Some("example.com".to_string()));
+
+        assert!(parse_server_name(&handshake[..40]).is_err());
+        let plain = b"GET / HTTP/1.1\r\n";
+        assert!(read_handshake(&mut &plain[..]).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_check_tunnel() {
+        let policy = enforcing_policy();
+
+        // The ClientHello is passed on as is
+        let (mut client, mut client_end) = tokio::io::duplex(64 * 1024);
+        let (mut remote, mut remote_end) = tokio::io::duplex(64 * 1024);
+        let hello = client_hello("example.com");
+        client_end.write_all(&hello).await.unwrap();
+
+        let res = check_tunnel(&mut client, &mut remote, "example.com", 443, &policy).await;
+        assert!(let Ok(Ok(())) = res);
+        let mut buf = vec![0u8; hello.len()];
+        remote_end.read_exact(&mut buf).await.unwrap();
+        assert!(buf == hello);
+
+        // unless it asks for another name than the one connected to
+        let (mut client, mut client_end) = tokio::io::duplex(64 * 1024);
+        let hello = client_hello("evil.com");
+        client_end.write_all(&hello).await.unwrap();
+
+        let res = check_tunnel(&mut client, &mut remote, "example.com", 443, &policy).await;
+        assert!(let Ok(Err(_)) = res);
+        let mut alert = [0u8; 7];
+        client_end.read_exact(&mut alert).await.unwrap();
+        assert!(alert == ACCESS_DENIED_ALERT);
+
+        // Servers that speak first are not held up
+        let (mut client, mut client_end) = tokio::io::duplex(64 * 1024);
+        remote_end.write_all(b"220 smtp ready\r\n").await.unwrap();
+
+        let res = check_tunnel(&mut client, &mut remote, "example.com", 25, &policy).await;
+        assert!(let Ok(Ok(())) = res);
+        let mut greeting = [0u8; 16];
+        client_end.read_exact(&mut greeting).await.unwrap();
+        assert!(&greeting == b"220 smtp ready\r\n");
+    }
+}
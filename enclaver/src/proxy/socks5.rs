@@ -0,0 +1,402 @@
+use std::net::{Ipv4Addr, Ipv6Addr, SocketAddr};
+use std::sync::Arc;
+
+use anyhow::{anyhow, Result};
+use log::{debug, warn};
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+
+use crate::access_log::{Entry, Verdict};
+use crate::metrics;
+use crate::policy::EgressPolicy;
+use crate::proxy::egress_http::{dial_verdict, remote_connect};
+use crate::proxy::middleware::Chain;
+use crate::proxy::mitm::Interceptor;
+use crate::proxy::pump::{self, pump};
+use crate::proxy::sni;
+
+const METRICS_LABEL: &str = "egress_socks5";
+
+pub const SOCKS_VERSION: u8 = 0x05;
+
+const AUTH_NONE: u8 = 0x00;
+const AUTH_USERNAME_PASSWORD: u8 = 0x02;
+const AUTH_NO_ACCEPTABLE: u8 = 0xff;
+
+const USERNAME_PASSWORD_VERSION: u8 = 0x01;
+const USERNAME_PASSWORD_SUCCESS: u8 = 0x00;
+const USERNAME_PASSWORD_FAILURE: u8 = 0x01;
+
+const CMD_CONNECT: u8 = 0x01;
+
+const ATYP_IPV4: u8 = 0x01;
+const ATYP_DOMAIN: u8 = 0x03;
+const ATYP_IPV6: u8 = 0x04;
+
+const REPLY_SUCCEEDED: u8 = 0x00;
+const REPLY_GENERAL_FAILURE: u8 = 0x01;
+const REPLY_NOT_ALLOWED: u8 = 0x02;
+const REPLY_HOST_UNREACHABLE: u8 = 0x04;
+const REPLY_COMMAND_NOT_SUPPORTED: u8 = 0x07;
+const REPLY_ADDRESS_NOT_SUPPORTED: u8 = 0x08;
+
+// Serve a SOCKS5 (RFC 1928) client on the in-enclave forwarder. Only CONNECT
+// is supported. The connection is tunneled to the host just like an HTTP
+// CONNECT request would be, intercepted the same way and held to the same
+// middleware, as far as it has credentials to check.
+pub async fn serve_conn<S>(
+    mut sock: S,
+    source: SocketAddr,
+    egress_port: u32,
+    egress_policy: &EgressPolicy,
+    interceptor: Option<Arc<Interceptor>>,
+    middleware: &Chain,
+) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite + Unpin + 'static,
+{
+    let _conn = metrics::PROXY.connection(METRICS_LABEL);
+
+    let (host, port) = match handshake(&mut sock, middleware, source).await? {
+        Some(dest) => dest,
+        None => return Ok(()),
+    };
+
+    let destination = format!("{host}:{port}");
+    let mut entry = Entry::new(METRICS_LABEL, Some(source), &destination);
+
+    if let Err(denial) = egress_policy.check(&host, port) {
+        warn!("egress denied: {denial}");
+        egress_policy.log_access(entry, Verdict::Denied);
+        return reply(&mut sock, REPLY_NOT_ALLOWED).await;
+    }
+
+    let _permit = match egress_policy.limits().acquire(source.ip()) {
+        Ok(permit) => permit,
+        Err(exceeded) => {
+            warn!("egress connection refused: {exceeded}");
+            return reply(&mut sock, REPLY_GENERAL_FAILURE).await;
+        }
+    };
+
+    debug!("Handling SOCKS5 CONNECT to {host}:{port}");
+
+    let timeouts = egress_policy.timeouts();
+    let dial = pump::dial(timeouts, remote_connect(egress_port, &host, port));
+    let mut remote = match metrics::PROXY.dial(METRICS_LABEL, &destination, dial).await {
+        Ok(remote) => remote,
+        Err(err) => {
+            debug!("SOCKS5 connect to {host}:{port} failed: {err}");
+            let verdict = dial_verdict(&err);
+            egress_policy.log_access(entry, verdict);
+
+            let code = match verdict {
+                Verdict::Denied => REPLY_NOT_ALLOWED,
+                _ => REPLY_HOST_UNREACHABLE,
+            };
+            return reply(&mut sock, code).await;
+        }
+    };
+
+    reply(&mut sock, REPLY_SUCCEEDED).await?;
+
+    // Hosts that are audited are not to be reached around the interceptor
+    let interceptor = interceptor.filter(|_| egress_policy.intercepts(&host, port));
+    if let Some(interceptor) = interceptor {
+        if let Err(err) = interceptor.serve(sock, remote, &host, source).await {
+            debug!("Intercepted SOCKS5 tunnel to {host}:{port} closed: {err}");
+        }
+        egress_policy.log_access(entry, Verdict::Allowed);
+        return Ok(());
+    }
+
+    match sni::check_tunnel(&mut sock, &mut remote, &host, port, egress_policy).await {
+        Ok(Ok(())) => {
+            let res = pump(&mut sock, &mut remote, timeouts).await;
+            metrics::PROXY.transferred(METRICS_LABEL, &res);
+            entry.transferred(&res);
+        }
+        Ok(Err(denial)) => {
+            warn!("egress denied: {denial}");
+            egress_policy.log_access(entry, Verdict::Denied);
+            return Ok(());
+        }
+        Err(err) => debug!("SOCKS5 tunnel to {host}:{port} closed early: {err}"),
+    }
+
+    egress_policy.log_access(entry, Verdict::Allowed);
+
+    Ok(())
+}
+
+// Negotiate the authentication method, have the middleware check the
+// credentials and read the request. Returns None if the request was refused,
+// in which case the client has already been told.
+async fn handshake<S>(
+    sock: &mut S,
+    middleware: &Chain,
+    source: SocketAddr,
+) -> Result<Option<(String, u16)>>
+where
+    S: AsyncRead + AsyncWrite + Unpin,
+{
+    let mut hdr = [0u8; 2];
+    sock.read_exact(&mut hdr).await?;
+    if hdr[0] != SOCKS_VERSION {
+        return Err(anyhow!("unsupported SOCKS version {}", hdr[0]));
+    }
+
+    let mut methods = vec![0u8; hdr[1] as usize];
+    sock.read_exact(&mut methods).await?;
+
+    // Credentials are preferred when offered, for the middleware to check
+    // them. Without any, only middleware that requires none lets the client
+    // through, and it is told so in reply to its request.
+    let password = if methods.contains(&AUTH_USERNAME_PASSWORD) {
+        sock.write_all(&[SOCKS_VERSION, AUTH_USERNAME_PASSWORD])
+            .await?;
+        let password = read_credentials(sock).await?;
+
+        if let Err(rejection) = middleware.handle_socks(Some(&password), source) {
+            warn!("SOCKS5 client rejected: {}", rejection.message);
+            sock.write_all(&[USERNAME_PASSWORD_VERSION, USERNAME_PASSWORD_FAILURE])
+                .await?;
+            return Ok(None);
+        }
+        sock.write_all(&[USERNAME_PASSWORD_VERSION, USERNAME_PASSWORD_SUCCESS])
+            .await?;
+        Some(password)
+    } else if methods.contains(&AUTH_NONE) {
+        sock.write_all(&[SOCKS_VERSION, AUTH_NONE]).await?;
+        None
+    } else {
+        sock.write_all(&[SOCKS_VERSION, AUTH_NO_ACCEPTABLE]).await?;
+        return Ok(None);
+    };
+
+    let mut req = [0u8; 4];
+    sock.read_exact(&mut req).await?;
+    if req[0] != SOCKS_VERSION {
+        return Err(anyhow!("unsupported SOCKS version {}", req[0]));
+    }
+
+    let host = match req[3] {
+        ATYP_IPV4 => {
+            let mut addr = [0u8; 4];
+            sock.read_exact(&mut addr).await?;
+            Ipv4Addr::from(addr).to_string()
+        }
+        ATYP_IPV6 => {
+            let mut addr = [0u8; 16];
+            sock.read_exact(&mut addr).await?;
+            // bracketed the same way it would be in a CONNECT authority
+            format!("[{}]", Ipv6Addr::from(addr))
+        }
+        ATYP_DOMAIN => {
+            let len = sock.read_u8().await?;
+            let mut name = vec![0u8; len as usize];
+            sock.read_exact(&mut name).await?;
+            String::from_utf8(name)?
+        }
+        _ => {
+            reply(sock, REPLY_ADDRESS_NOT_SUPPORTED).await?;
+            return Ok(None);
+        }
+    };
+
+    let port = sock.read_u16().await?;
+
+    if req[1] != CMD_CONNECT {
+        reply(sock, REPLY_COMMAND_NOT_SUPPORTED).await?;
+        return Ok(None);
+    }
+
+    if password.is_none() {
+        if let Err(rejection) = middleware.handle_socks(None, source) {
+            warn!("SOCKS5 client rejected: {}", rejection.message);
+            reply(sock, REPLY_NOT_ALLOWED).await?;
+            return Ok(None);
+        }
+    }
+
+    Ok(Some((host, port)))
+}
+
+// RFC 1929 sub-negotiation. Returns the password, the username is of no use.
+async fn read_credentials<S: AsyncRead + Unpin>(sock: &mut S) -> Result<String> {
+    let ver = sock.read_u8().await?;
+    if ver != USERNAME_PASSWORD_VERSION {
+        return Err(anyhow!("unsupported username/password auth version {ver}"));
+    }
+
+    let mut fields = Vec::new();
+    for _ in 0..2 {
+        let len = sock.read_u8().await?;
+        let mut field = vec![0u8; len as usize];
+        sock.read_exact(&mut field).await?;
+        fields.push(field);
+    }
+
+    Ok(String::from_utf8_lossy(&fields[1]).into_owned())
+}
+
+async fn reply<S: AsyncWrite + Unpin>(sock: &mut S, code: u8) -> Result<()> {
+    // The bound address is of no use to anyone through a tunnel, report 0.0.0.0:0
+    sock.write_all(&[SOCKS_VERSION, code, 0x00, ATYP_IPV4, 0, 0, 0, 0, 0, 0])
+        .await?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::handshake;
+    use crate::manifest::ProxyAuthSpec;
+    use crate::proxy::middleware::{Chain, ProxyAuth};
+    use assert2::assert;
+    use std::io::Write;
+    use std::net::SocketAddr;
+    use std::sync::Arc;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    fn source() -> SocketAddr {
+        "127.0.0.1:1234".parse().unwrap()
+    }
+
+    fn authenticating_chain(token: &str) -> Chain {
+        let mut tokens = tempfile::NamedTempFile::new().unwrap();
+        writeln!(tokens, "{token}").unwrap();
+
+        let auth = ProxyAuth::new(&ProxyAuthSpec {
+            tokens_file: tokens.path().display().to_string(),
+        })
+        .unwrap();
+        let mut chain = Chain::default();
+        chain.push(Arc::new(auth));
+        chain
+    }
+
+    #[tokio::test]
+    async fn test_handshake_no_auth() {
+        let (mut client, mut server) = tokio::io::duplex(1024);
+
+        let chain = Chain::default();
+        let server_task =
+            tokio::task::spawn(async move { handshake(&mut server, &chain, source()).await });
+
+        client.write_all(&[0x05, 0x01, 0x00]).await.unwrap();
+        let mut method = [0u8; 2];
+        client.read_exact(&mut method).await.unwrap();
+        assert!(method == [0x05, 0x00]);
+
+        let mut req = vec![0x05, 0x01, 0x00, 0x03, 11];
+        req.extend_from_slice(b"example.com");
+        req.extend_from_slice(&443u16.to_be_bytes());
+        client.write_all(&req).await.unwrap();
+
+        let dest = server_task.await.unwrap().unwrap();
+        assert!(dest == Some(("example.com".to_string(), 443)));
+    }
+
+    #[tokio::test]
+    async fn test_handshake_username_password() {
+        let (mut client, mut server) = tokio::io::duplex(1024);
+
+        let chain = Chain::default();
+        let server_task =
+            tokio::task::spawn(async move { handshake(&mut server, &chain, source()).await });
+
+        client.write_all(&[0x05, 0x01, 0x02]).await.unwrap();
+        let mut method = [0u8; 2];
+        client.read_exact(&mut method).await.unwrap();
+        assert!(method == [0x05, 0x02]);
+
+        client
+            .write_all(&[0x01, 4, b'u', b's', b'e', b'r', 2, b'p', b'w'])
+            .await
+            .unwrap();
+        let mut status = [0u8; 2];
+        client.read_exact(&mut status).await.unwrap();
+        assert!(status == [0x01, 0x00]);
+
+        let mut req = vec![0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1];
+        req.extend_from_slice(&5432u16.to_be_bytes());
+        client.write_all(&req).await.unwrap();
+
+        let dest = server_task.await.unwrap().unwrap();
+        assert!(dest == Some(("10.0.0.1".to_string(), 5432)));
+    }
+
+    #[tokio::test]
+    async fn test_handshake_unsupported_command() {
+        let (mut client, mut server) = tokio::io::duplex(1024);
+
+        let chain = Chain::default();
+        let server_task =
+            tokio::task::spawn(async move { handshake(&mut server, &chain, source()).await });
+
+        client.write_all(&[0x05, 0x01, 0x00]).await.unwrap();
+        let mut method = [0u8; 2];
+        client.read_exact(&mut method).await.unwrap();
+
+        // BIND
+        let mut req = vec![0x05, 0x02, 0x00, 0x01, 10, 0, 0, 1];
+        req.extend_from_slice(&80u16.to_be_bytes());
+        client.write_all(&req).await.unwrap();
+
+        let mut reply = [0u8; 10];
+        client.read_exact(&mut reply).await.unwrap();
+        assert!(reply[1] == 0x07);
+
+        assert!(server_task.await.unwrap().unwrap() == None);
+    }
+
+    #[tokio::test]
+    async fn test_handshake_proxy_auth() {
+        // Without credentials, the request is refused
+        let (mut client, mut server) = tokio::io::duplex(1024);
+        let chain = authenticating_chain("s3cret");
+        let server_task =
+            tokio::task::spawn(async move { handshake(&mut server, &chain, source()).await });
+
+        client.write_all(&[0x05, 0x01, 0x00]).await.unwrap();
+        let mut method = [0u8; 2];
+        client.read_exact(&mut method).await.unwrap();
+        assert!(method == [0x05, 0x00]);
+
+        let mut req = vec![0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1];
+        req.extend_from_slice(&443u16.to_be_bytes());
+        client.write_all(&req).await.unwrap();
+
+        let mut reply = [0u8; 10];
+        client.read_exact(&mut reply).await.unwrap();
+        assert!(reply[1] == 0x02);
+        assert!(server_task.await.unwrap().unwrap() == None);
+
+        // and so are credentials with another password than a token
+        for (password, status) in [(&b"nope"[..], 0x01), (&b"s3cret"[..], 0x00)] {
+            let (mut client, mut server) = tokio::io::duplex(1024);
+            let chain = authenticating_chain("s3cret");
+            let server_task =
+                tokio::task::spawn(async move { handshake(&mut server, &chain, source()).await });
+
+            client.write_all(&[0x05, 0x02, 0x00, 0x02]).await.unwrap();
+            let mut method = [0u8; 2];
+            client.read_exact(&mut method).await.unwrap();
+            assert!(method == [0x05, 0x02]);
+
+            let mut auth = vec![0x01, 3, b'a', b'p', b'p', password.len() as u8];
+            auth.extend_from_slice(password);
+            client.write_all(&auth).await.unwrap();
+            let mut res = [0u8; 2];
+            client.read_exact(&mut res).await.unwrap();
+            assert!(res == [0x01, status]);
+
+            if status == 0x00 {
+                client.write_all(&req).await.unwrap();
+                let dest = server_task.await.unwrap().unwrap();
+                assert!(dest == Some(("10.0.0.1".to_string(), 443)));
+            } else {
+                assert!(server_task.await.unwrap().unwrap() == None);
+            }
+        }
+    }
+}
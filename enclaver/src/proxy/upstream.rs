@@ -0,0 +1,130 @@
+use std::io;
+use std::net::SocketAddr;
+
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWriteExt};
+use tokio::net::TcpStream;
+
+use crate::policy::upstream::UpstreamProxy;
+use crate::proxy::resolver::{self, RESOLVER};
+
+// Generous for a response to CONNECT, which has no body and few headers
+const MAX_HEAD_LEN: usize = 16 * 1024;
+
+// Open a tunnel to the destination through the upstream proxy. The stream is
+// handed back once the proxy has accepted the CONNECT, so it can be used as if
+// connected to the destination directly.
+pub async fn connect(upstream: &UpstreamProxy, host: &str, port: u16) -> io::Result<TcpStream> {
+    let addrs: Vec<SocketAddr> = RESOLVER
+        .lookup(&upstream.host)
+        .await?
+        .into_iter()
+        .map(|addr| SocketAddr::new(addr, upstream.port))
+        .collect();
+    let mut stream = resolver::connect_any(&addrs).await?;
+
+    // IPv6 addresses need brackets to be told apart from the port
+    let authority = if host.contains(':') {
+        format!("[{host}]:{port}")
+    } else {
+        format!("{host}:{port}")
+    };
+
+    let mut req = format!("CONNECT {authority} HTTP/1.1\r\nHost: {authority}\r\n");
+    if let Some(ref authorization) = upstream.authorization {
+        req.push_str(&format!("Proxy-Authorization: {authorization}\r\n"));
+    }
+    req.push_str("\r\n");
+    stream.write_all(req.as_bytes()).await?;
+
+    let head = read_head(&mut stream).await?;
+    let status_line = head.lines().next().unwrap_or_default();
+    let status = status_line
+        .split_whitespace()
+        .nth(1)
+        .and_then(|code| code.parse::<u16>().ok());
+
+    match status {
+        Some(200..=299) => Ok(stream),
+        Some(_) => Err(io::Error::new(
+            io::ErrorKind::ConnectionRefused,
+            format!(
+                "upstream proxy {}:{} refused to connect to {authority}: {status_line}",
+                upstream.host, upstream.port
+            ),
+        )),
+        None => Err(io::Error::new(
+            io::ErrorKind::InvalidData,
+            format!("invalid response from upstream proxy: {status_line}"),
+        )),
+    }
+}
+
+// Read up to the end of the response head, a byte at a time so that nothing
+// the destination sends right after it is consumed.
+async fn read_head<R: AsyncRead + Unpin>(r: &mut R) -> io::Result<String> {
+    let mut head = Vec::new();
+    while !head.ends_with(b"\r\n\r\n") {
+        if head.len() >= MAX_HEAD_LEN {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                "response from upstream proxy is too long",
+            ));
+        }
+        head.push(r.read_u8().await?);
+    }
+    Ok(String::from_utf8_lossy(&head).into_owned())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::connect;
+    use crate::policy::upstream::UpstreamProxy;
+    use assert2::assert;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::TcpListener;
+
+    // A proxy that accepts the first CONNECT it gets and refuses the rest,
+    // handing the requests it saw back
+    async fn fake_proxy(listener: TcpListener) -> Vec<String> {
+        let mut requests = Vec::new();
+        for i in 0..2 {
+            let (mut sock, _) = listener.accept().await.unwrap();
+            let req = super::read_head(&mut sock).await.unwrap();
+            requests.push(req);
+
+            if i == 0 {
+                sock.write_all(b"HTTP/1.1 200 Connection established\r\n\r\nhello")
+                    .await
+                    .unwrap();
+            } else {
+                sock.write_all(b"HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+                    .await
+                    .unwrap();
+            }
+        }
+        requests
+    }
+
+    #[tokio::test]
+    async fn test_connect() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        let proxy_task = tokio::task::spawn(fake_proxy(listener));
+
+        let upstream = UpstreamProxy::parse(&format!("http://user:secret@{addr}")).unwrap();
+
+        // What follows the response head comes from the destination
+        let mut stream = connect(&upstream, "example.com", 443).await.unwrap();
+        let mut buf = [0u8; 5];
+        stream.read_exact(&mut buf).await.unwrap();
+        assert!(&buf == b"hello");
+
+        let err = connect(&upstream, "2001:db8::1", 443).await.unwrap_err();
+        assert!(err.kind() == std::io::ErrorKind::ConnectionRefused);
+
+        let requests = proxy_task.await.unwrap();
+        assert!(requests[0].starts_with("CONNECT example.com:443 HTTP/1.1\r\n"));
+        assert!(requests[0].contains("Proxy-Authorization: Basic dXNlcjpzZWNyZXQ=\r\n"));
+        assert!(requests[1].starts_with("CONNECT [2001:db8::1]:443 HTTP/1.1\r\n"));
+    }
+}
@@ -0,0 +1,192 @@
+use std::collections::{HashMap, VecDeque};
+use std::io;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use futures::FutureExt;
+use lazy_static::lazy_static;
+use log::debug;
+use tokio::io::AsyncReadExt;
+use tokio::sync::Notify;
+use tokio::task::JoinHandle;
+use tokio::time::Instant;
+use tokio_util::sync::CancellationToken;
+
+use crate::manifest::VsockPoolSpec;
+use crate::vsock::{self, Connection, DialOptions};
+
+const DEFAULT_MAX_IDLE: Duration = Duration::from_secs(60);
+const RECONNECT_INTERVAL: Duration = Duration::from_secs(1);
+
+lazy_static! {
+    // By vsock port of the host
+    static ref POOLS: Mutex<HashMap<u32, Arc<Pool>>> = Mutex::new(HashMap::new());
+}
+
+// Start keeping connections to the host on the given port open ahead of time,
+// for connect() to hand out, until cancelled.
+pub fn start(port: u32, spec: &VsockPoolSpec, cancellation: CancellationToken) -> JoinHandle<()> {
+    let pool = Arc::new(Pool {
+        port,
+        size: spec.size as usize,
+        max_idle: spec
+            .max_idle_secs
+            .map(Duration::from_secs)
+            .unwrap_or(DEFAULT_MAX_IDLE),
+        idle: Mutex::new(VecDeque::new()),
+        taken: Notify::new(),
+    });
+
+    POOLS.lock().unwrap().insert(port, pool.clone());
+
+    tokio::task::spawn(async move {
+        tokio::select! {
+            _ = pool.fill() => {}
+            _ = cancellation.cancelled() => {}
+        }
+        POOLS.lock().unwrap().remove(&port);
+    })
+}
+
+// Connect to the host on the given port, with a pooled connection if there is
+// one ready.
+pub async fn connect(port: u32) -> io::Result<Connection> {
+    let pool = POOLS.lock().unwrap().get(&port).cloned();
+
+    if let Some(stream) = pool.and_then(|pool| pool.take()) {
+        return Ok(stream);
+    }
+
+    vsock::connect(vsock::host_cid(), port, &DialOptions::default()).await
+}
+
+struct Idle {
+    stream: Connection,
+    since: Instant,
+}
+
+struct Pool {
+    port: u32,
+    size: usize,
+    // Connections idle for longer may have been given up on by the host
+    max_idle: Duration,
+    idle: Mutex<VecDeque<Idle>>,
+    taken: Notify,
+}
+
+impl Pool {
+    fn take(&self) -> Option<Connection> {
+        let mut idle = self.idle.lock().unwrap();
+        self.taken.notify_one();
+
+        while let Some(mut conn) = idle.pop_front() {
+            if conn.since.elapsed() < self.max_idle && is_open(&mut conn.stream) {
+                return Some(conn.stream);
+            }
+        }
+
+        None
+    }
+
+    fn len(&self) -> usize {
+        self.idle.lock().unwrap().len()
+    }
+
+    // Drop the connections that are too old or were closed by the host
+    fn prune(&self) {
+        self.idle
+            .lock()
+            .unwrap()
+            .retain_mut(|conn| conn.since.elapsed() < self.max_idle && is_open(&mut conn.stream));
+    }
+
+    async fn fill(&self) {
+        loop {
+            self.prune();
+
+            while self.len() < self.size {
+                match vsock::connect(vsock::host_cid(), self.port, &DialOptions::default()).await {
+                    Ok(stream) => self.idle.lock().unwrap().push_back(Idle {
+                        stream,
+                        since: Instant::now(),
+                    }),
+                    Err(err) => {
+                        debug!("Failed to open pooled vsock connection: {err}");
+                        tokio::time::sleep(RECONNECT_INTERVAL).await;
+                    }
+                }
+            }
+
+            // Until a connection is taken, or the pooled ones are due a check
+            _ = tokio::time::timeout(self.max_idle, self.taken.notified()).await;
+        }
+    }
+}
+
+// The host sends nothing before it is asked to connect somewhere, so a
+// connection that can be read from has been closed (or is broken).
+fn is_open(stream: &mut Connection) -> bool {
+    let mut buf = [0u8; 1];
+    stream.read(&mut buf).now_or_never().is_none()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{connect, start, POOLS};
+    use crate::manifest::VsockPoolSpec;
+    use assert2::assert;
+    use futures::StreamExt;
+    use std::time::Duration;
+    use tokio_util::sync::CancellationToken;
+
+    fn pooled(port: u32) -> Option<usize> {
+        POOLS.lock().unwrap().get(&port).map(|pool| pool.len())
+    }
+
+    #[tokio::test]
+    async fn test_pool() {
+        let port = 17900;
+        let mut incoming = crate::vsock::ListenConfig::new(port).listen().unwrap();
+        let accepted = tokio::task::spawn(async move {
+            let mut streams = Vec::new();
+            while let Some(stream) = incoming.next().await {
+                streams.push(stream);
+            }
+        });
+
+        let cancellation = CancellationToken::new();
+        let spec = VsockPoolSpec {
+            size: 2,
+            max_idle_secs: None,
+        };
+        let filler = start(port, &spec, cancellation.clone());
+
+        let filled = async {
+            while pooled(port) != Some(2) {
+                tokio::time::sleep(Duration::from_millis(10)).await;
+            }
+        };
+        tokio::time::timeout(Duration::from_secs(2), filled)
+            .await
+            .expect("pool was not filled");
+
+        // Taking a connection has it replaced
+        let _stream = connect(port).await.unwrap();
+        assert!(pooled(port) == Some(1));
+
+        let refilled = async {
+            while pooled(port) != Some(2) {
+                tokio::time::sleep(Duration::from_millis(10)).await;
+            }
+        };
+        tokio::time::timeout(Duration::from_secs(2), refilled)
+            .await
+            .expect("pool was not refilled");
+
+        cancellation.cancel();
+        filler.await.unwrap();
+        assert!(pooled(port) == None);
+
+        accepted.abort();
+    }
+}
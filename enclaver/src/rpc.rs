@@ -0,0 +1,315 @@
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use anyhow::{anyhow, Result};
+use async_trait::async_trait;
+use bytes::Bytes;
+use futures::stream::{SplitSink, SplitStream};
+use futures::{SinkExt, StreamExt};
+use log::{debug, warn};
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio::sync::{mpsc, oneshot};
+use tokio::task::JoinHandle;
+use tokio_util::codec::{Framed, LengthDelimitedCodec};
+
+// Request/response messaging between the wrapper and the runtime. Each frame
+// is a JSON message prefixed with a 4 byte length. Requests carry an id that
+// their response repeats, so that several can be in flight on a connection
+// and be answered in any order.
+
+// Plenty for attestation documents, which are the largest messages
+const MAX_FRAME_LEN: usize = 1024 * 1024;
+
+const DEFAULT_TIMEOUT: Duration = Duration::from_secs(10);
+
+// Frames waiting to be written, per connection
+const QUEUE_LEN: usize = 32;
+
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(untagged)]
+enum Frame {
+    Request {
+        id: u64,
+        method: String,
+        #[serde(default)]
+        params: Value,
+    },
+    Response {
+        id: u64,
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        result: Option<Value>,
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        error: Option<String>,
+    },
+}
+
+type Framer<S> = Framed<S, LengthDelimitedCodec>;
+
+fn framed<S: AsyncRead + AsyncWrite>(stream: S) -> Framer<S> {
+    LengthDelimitedCodec::builder()
+        .length_field_length(4)
+        .max_frame_length(MAX_FRAME_LEN)
+        .new_framed(stream)
+}
+
+// Writes the frames queued on rx until every sender is gone
+fn spawn_writer<S>(mut sink: SplitSink<Framer<S>, Bytes>) -> (mpsc::Sender<Bytes>, JoinHandle<()>)
+where
+    S: AsyncRead + AsyncWrite + Send + 'static,
+{
+    let (tx, mut rx) = mpsc::channel::<Bytes>(QUEUE_LEN);
+    let task = tokio::task::spawn(async move {
+        while let Some(frame) = rx.recv().await {
+            if let Err(err) = sink.send(frame).await {
+                debug!("rpc connection failed: {err}");
+                return;
+            }
+        }
+    });
+    (tx, task)
+}
+
+// Serves the methods of an RPC server
+#[async_trait]
+pub trait Handler: Send + Sync {
+    async fn handle(&self, method: &str, params: Value) -> Result<Value>;
+}
+
+// Answer the requests made over stream until it is closed. Requests are
+// handled concurrently, each response written once it is ready.
+pub async fn serve<S, H>(stream: S, handler: Arc<H>) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite + Send + 'static,
+    H: Handler + 'static,
+{
+    let (sink, mut frames) = framed(stream).split();
+    let (tx, writer) = spawn_writer(sink);
+
+    while let Some(frame) = frames.next().await {
+        let (id, method, params) = match serde_json::from_slice(&frame?)? {
+            Frame::Request { id, method, params } => (id, method, params),
+            Frame::Response { id, .. } => {
+                warn!("rpc server got a response (id {id}), ignoring it");
+                continue;
+            }
+        };
+
+        let handler = handler.clone();
+        let tx = tx.clone();
+        tokio::task::spawn(async move {
+            let resp = match handler.handle(&method, params).await {
+                Ok(result) => Frame::Response {
+                    id,
+                    result: Some(result),
+                    error: None,
+                },
+                Err(err) => Frame::Response {
+                    id,
+                    result: None,
+                    error: Some(err.to_string()),
+                },
+            };
+
+            match serde_json::to_vec(&resp) {
+                Ok(resp) => {
+                    _ = tx.send(resp.into()).await;
+                }
+                Err(err) => warn!("failed to encode the response to {method}: {err}"),
+            }
+        });
+    }
+
+    drop(tx);
+    _ = writer.await;
+    Ok(())
+}
+
+// The calls waiting for a response, by request id. None once the connection
+// is closed.
+type Pending = Arc<Mutex<Option<HashMap<u64, oneshot::Sender<Result<Value, String>>>>>>;
+
+// Makes requests over a connection to an RPC server. Calls fail once the
+// timeout expires, or the connection is closed.
+pub struct Client {
+    next_id: AtomicU64,
+    pending: Pending,
+    tx: mpsc::Sender<Bytes>,
+    reader: JoinHandle<()>,
+    timeout: Duration,
+}
+
+impl Client {
+    pub fn new<S>(stream: S) -> Self
+    where
+        S: AsyncRead + AsyncWrite + Send + 'static,
+    {
+        let (sink, frames) = framed(stream).split();
+        let (tx, _) = spawn_writer(sink);
+        let pending = Arc::new(Mutex::new(Some(HashMap::new())));
+        let reader = tokio::task::spawn(read_responses(frames, pending.clone()));
+
+        Self {
+            next_id: AtomicU64::new(1),
+            pending,
+            tx,
+            reader,
+            timeout: DEFAULT_TIMEOUT,
+        }
+    }
+
+    pub fn with_timeout(mut self, timeout: Duration) -> Self {
+        self.timeout = timeout;
+        self
+    }
+
+    pub async fn call<P, R>(&self, method: &str, params: &P) -> Result<R>
+    where
+        P: Serialize,
+        R: DeserializeOwned,
+    {
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+        let req = serde_json::to_vec(&Frame::Request {
+            id,
+            method: method.to_string(),
+            params: serde_json::to_value(params)?,
+        })?;
+
+        let (resp_tx, resp_rx) = oneshot::channel();
+        match *self.pending.lock().unwrap() {
+            Some(ref mut pending) => pending.insert(id, resp_tx),
+            None => return Err(anyhow!("rpc connection closed")),
+        };
+
+        let call = async {
+            self.tx
+                .send(req.into())
+                .await
+                .map_err(|_| anyhow!("rpc connection closed"))?;
+            resp_rx.await.map_err(|_| anyhow!("rpc connection closed"))
+        };
+
+        let resp = tokio::time::timeout(self.timeout, call).await;
+        if let Some(ref mut pending) = *self.pending.lock().unwrap() {
+            pending.remove(&id);
+        }
+
+        match resp {
+            Ok(Ok(Ok(result))) => Ok(serde_json::from_value(result)?),
+            Ok(Ok(Err(err))) => Err(anyhow!("{method} failed: {err}")),
+            Ok(Err(err)) => Err(err),
+            Err(_) => Err(anyhow!("{method} timed out after {:?}", self.timeout)),
+        }
+    }
+}
+
+impl Drop for Client {
+    fn drop(&mut self) {
+        self.reader.abort();
+    }
+}
+
+// Hands each response to the call waiting for it. The calls still waiting
+// once the connection is closed fail with it, as do those made after.
+async fn read_responses<S>(mut frames: SplitStream<Framer<S>>, pending: Pending)
+where
+    S: AsyncRead + AsyncWrite,
+{
+    while let Some(frame) = frames.next().await {
+        let frame = match frame {
+            Ok(frame) => frame,
+            Err(err) => {
+                debug!("rpc connection failed: {err}");
+                break;
+            }
+        };
+
+        match serde_json::from_slice(&frame) {
+            Ok(Frame::Response { id, result, error }) => {
+                let resp = match error {
+                    Some(err) => Err(err),
+                    None => Ok(result.unwrap_or(Value::Null)),
+                };
+                // Gone if the call timed out in the meantime
+                let tx = pending.lock().unwrap().as_mut().and_then(|p| p.remove(&id));
+                if let Some(tx) = tx {
+                    _ = tx.send(resp);
+                }
+            }
+            Ok(Frame::Request { method, .. }) => {
+                warn!("rpc client got a request ({method}), ignoring it")
+            }
+            Err(err) => warn!("invalid rpc response: {err}"),
+        }
+    }
+
+    pending.lock().unwrap().take();
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{serve, Client, Handler};
+    use anyhow::{anyhow, Result};
+    use assert2::assert;
+    use async_trait::async_trait;
+    use serde_json::{json, Value};
+    use std::sync::Arc;
+    use std::time::Duration;
+
+    struct Echo;
+
+    #[async_trait]
+    impl Handler for Echo {
+        async fn handle(&self, method: &str, params: Value) -> Result<Value> {
+            match method {
+                "echo" => Ok(params),
+                "sleep" => {
+                    tokio::time::sleep(Duration::from_millis(params.as_u64().unwrap())).await;
+                    Ok(params)
+                }
+                _ => Err(anyhow!("no such method")),
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_rpc() {
+        let (client, server) = tokio::io::duplex(64 * 1024);
+        let server_task = tokio::task::spawn(serve(server, Arc::new(Echo)));
+        let client = Client::new(client).with_timeout(Duration::from_millis(500));
+
+        let resp: Value = client.call("echo", &json!({"n": 1})).await.unwrap();
+        assert!(resp == json!({"n": 1}));
+
+        let err = client.call::<_, Value>("nope", &()).await.unwrap_err();
+        assert!(err.to_string() == "nope failed: no such method");
+
+        // Requests are answered as they are done with, not in order
+        let (slow, fast) = tokio::join!(
+            client.call::<_, u64>("sleep", &200),
+            client.call::<_, u64>("sleep", &10)
+        );
+        assert!(slow.unwrap() == 200);
+        assert!(fast.unwrap() == 10);
+
+        let err = client.call::<_, u64>("sleep", &1000).await.unwrap_err();
+        assert!(err.to_string().contains("timed out"));
+
+        drop(client);
+        assert!(let Ok(Ok(())) = server_task.await);
+    }
+
+    #[tokio::test]
+    async fn test_rpc_closed() {
+        let (client, server) = tokio::io::duplex(64 * 1024);
+        let client = Client::new(client);
+        drop(server);
+
+        let err = client.call::<_, Value>("echo", &()).await.unwrap_err();
+        assert!(err.to_string() == "rpc connection closed");
+    }
+}
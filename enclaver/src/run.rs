@@ -1,28 +1,58 @@
+use crate::access_log::AccessLog;
+use crate::admin::EnclaveHandle;
+use crate::clock_sync::{self, ClockSyncClient};
 use crate::constants::{
-    APP_LOG_PORT, EIF_FILE_NAME, HTTP_EGRESS_VSOCK_PORT, MANIFEST_FILE_NAME, RELEASE_BUNDLE_DIR,
-    STATUS_PORT,
+    APP_LOG_PORT, CLOCK_SYNC_PORT, CREDENTIALS_VSOCK_PORT, DNS_VSOCK_PORT, EGRESS_MUX_VSOCK_PORT,
+    EIF_FILE_NAME, HEARTBEAT_PORT, HTTP_EGRESS_VSOCK_PORT, MANIFEST_FILE_NAME, RELEASE_BUNDLE_DIR,
+    SHUTDOWN_PORT, STATUS_PORT, UDP_EGRESS_VSOCK_PORT,
 };
-use crate::manifest::{load_manifest, Defaults, Manifest};
+use crate::crash::{CrashReport, CrashTarget};
+use crate::credentials::HostCredentialsServer;
+use crate::exit_reason::{ExitReason, LineTail};
+use crate::heartbeat::{self, HeartbeatClient, Monitor};
+use crate::manifest::{load_manifest, Defaults, LaunchMode, Manifest};
+use crate::policy::limits::Timeouts;
+use crate::policy::reload;
+use crate::policy::upstream::UpstreamProxy;
+use crate::policy::EgressPolicy;
+use crate::shutdown;
+use crate::tls;
 use crate::utils;
+use crate::vsock::reconnect::{self, Backoff, Reconnector};
+use crate::vsock::{self, DialOptions, VMADDR_CID_LOCAL};
 use anyhow::{anyhow, Result};
 use futures_util::stream::StreamExt;
-use log::{debug, error, info};
+use log::{debug, error, info, warn};
 use serde::{Deserialize, Serialize};
+use std::net::SocketAddr;
 use std::path::PathBuf;
+use std::sync::Arc;
 use std::time::Duration;
 use tokio::fs::File;
 use tokio_util::codec::{FramedRead, LinesCodec};
 use tokio_util::sync::CancellationToken;
-use tokio_vsock::VsockStream;
 
 use crate::nitro_cli::{EnclaveInfo, NitroCLI, RunEnclaveArgs};
+use crate::proxy::dns::HostDnsResolver;
 use crate::proxy::egress_http::HostHttpProxy;
+use crate::proxy::egress_mux::HostMuxProxy;
+use crate::proxy::egress_udp::HostUdpRelay;
 use crate::proxy::ingress::HostProxy;
 
 const LOG_VSOCK_RETRY_INTERVAL: Duration = Duration::from_millis(250);
+const LOG_VSOCK_MAX_RETRY_INTERVAL: Duration = Duration::from_secs(5);
 const STATUS_VSOCK_RETRY_INTERVAL: Duration = Duration::from_millis(250);
 const STATUS_VSOCK_RETRY_LIMIT: i32 = 100;
 
+const CLOCK_SYNC_INTERVAL: Duration = Duration::from_secs(60);
+const CLOCK_SYNC_RETRY_INTERVAL: Duration = Duration::from_secs(1);
+const CLOCK_SYNC_TIMEOUT: Duration = Duration::from_secs(3);
+
+const CONSOLE_TAIL_LINES: usize = 200;
+const LOG_TAIL_LINES: usize = 500;
+
+const DEFAULT_BOOT_TIMEOUT: Duration = Duration::from_secs(120);
+
 const DEFAULT_CPU_COUNT: i32 = 2;
 const DEFAULT_MEMORY_MB: i32 = 4096;
 
@@ -32,17 +62,37 @@ pub struct EnclaveOpts {
     pub cpu_count: Option<i32>,
     pub memory_mb: Option<i32>,
     pub debug_mode: bool,
+    pub boot_timeout: Option<Duration>,
+    pub crash_target: Option<CrashTarget>,
+    pub watch_manifest: bool,
+    pub shutdown_grace: Option<Duration>,
+    // Rather than starting the EIF, wait for the runtime in a container on
+    // this host, as enclaver run --simulate starts it
+    pub simulate: bool,
 }
 
 pub struct Enclave {
     cli: NitroCLI,
     eif_path: PathBuf,
     manifest: Manifest,
+    manifest_path: PathBuf,
+    watch_manifest: bool,
     cpu_count: i32,
     memory_mb: i32,
     debug_mode: bool,
+    simulate: bool,
+    egress_policy: Option<Arc<EgressPolicy>>,
+    boot_timeout: Duration,
+    shutdown_grace: Duration,
+    crash_target: Option<CrashTarget>,
     enclave_info: Option<EnclaveInfo>,
+    handle: EnclaveHandle,
+    console_tail: LineTail,
+    log_tail: LineTail,
     tasks: Vec<tokio::task::JoinHandle<()>>,
+    instance_tasks: Vec<tokio::task::JoinHandle<()>>,
+    proxies: ProxyTasks,
+    instance_proxies: ProxyTasks,
 }
 
 impl Enclave {
@@ -52,10 +102,12 @@ impl Enclave {
             None => PathBuf::from(RELEASE_BUNDLE_DIR).join(EIF_FILE_NAME),
         };
 
-        // Test that the EIF exists
-        let _ = File::open(&eif_path)
-            .await
-            .map_err(|e| anyhow!("failed to open EIF file at {}: {e}", eif_path.display()))?;
+        // Test that the EIF exists, unless there is no need for it
+        if !opts.simulate {
+            let _ = File::open(&eif_path)
+                .await
+                .map_err(|e| anyhow!("failed to open EIF file at {}: {e}", eif_path.display()))?;
+        }
 
         let manifest_path = match opts.manifest_path {
             Some(manifest_path) => manifest_path,
@@ -100,18 +152,48 @@ impl Enclave {
             }
         };
 
+        let egress_policy = match manifest.egress {
+            Some(ref egress) => {
+                let mut policy = EgressPolicy::new(egress);
+                // The manifest takes precedence over the environment
+                if egress.upstream_proxy.is_none() {
+                    policy = policy.with_upstream_proxy(UpstreamProxy::from_env()?);
+                }
+                Some(Arc::new(policy))
+            }
+            None => None,
+        };
+
         Ok(Self {
             cli: NitroCLI::new(),
             eif_path: eif_path.to_path_buf(),
-            manifest: load_manifest(&manifest_path).await?,
+            manifest,
+            manifest_path: manifest_path.clone(),
+            watch_manifest: opts.watch_manifest,
             cpu_count,
             memory_mb,
             debug_mode: opts.debug_mode,
+            simulate: opts.simulate,
+            egress_policy: egress_policy.clone(),
+            boot_timeout: opts.boot_timeout.unwrap_or(DEFAULT_BOOT_TIMEOUT),
+            shutdown_grace: opts.shutdown_grace.unwrap_or(shutdown::DEFAULT_GRACE),
+            crash_target: opts.crash_target,
             enclave_info: None,
+            handle: EnclaveHandle::new(egress_policy).with_manifest_path(manifest_path),
+            console_tail: LineTail::new(CONSOLE_TAIL_LINES),
+            log_tail: LineTail::new(LOG_TAIL_LINES),
             tasks: Vec::new(),
+            instance_tasks: Vec::new(),
+            proxies: ProxyTasks::new(),
+            instance_proxies: ProxyTasks::new(),
         })
     }
 
+    // A handle to observe the state of the enclave and request restarts.
+    pub fn handle(&self) -> EnclaveHandle {
+        self.handle.clone()
+    }
+
     // Start the enclave and run it until it either exits or is interrupted via
     // the passed in cancellation token. Terminates the enclave prior to returning.
     pub async fn run(mut self, cancellation: CancellationToken) -> Result<EnclaveExitStatus> {
@@ -122,55 +204,125 @@ impl Enclave {
         // Start the egress proxy before starting the enclave, to avoid (unlikely) race conditions
         // where something inside the enclave attempts egress before the proxy is ready.
         self.start_egress_proxy().await?;
+        self.start_credentials_server().await?;
+
+        let exit_res = loop {
+            match self.run_instance(&cancellation).await {
+                Ok(Some(status)) => break Ok(status),
+                Ok(None) => {
+                    info!("restarting enclave");
+                    self.handle.set_restarting();
+                }
+                Err(err) => {
+                    if let Err(stop_err) = self.stop_instance().await {
+                        error!("error terminating enclave: {stop_err}");
+                    }
+                    break Err(err);
+                }
+            }
+        };
+
+        self.handle.set_stopped();
+        self.cleanup().await;
+
+        match exit_res {
+            Ok(EnclaveExitStatus::Exited(code)) => info!("enclave exited with code {code}"),
+            Ok(EnclaveExitStatus::Signaled(signal)) => {
+                info!("enclave stopped due to signal {signal}")
+            }
+            Ok(EnclaveExitStatus::Fatal(ref error)) => {
+                info!("enclave exited due to fatal error: {error}")
+            }
+            Ok(EnclaveExitStatus::Died(ref reason)) => {
+                error!("enclave died unexpectedly: reason={reason}")
+            }
+            Ok(EnclaveExitStatus::BootTimeout(timeout)) => {
+                error!("enclave did not finish booting within {timeout:?}")
+            }
+            Ok(EnclaveExitStatus::Cancelled) => (),
+            Err(ref err) => error!("error waing for enclave exit: {err}"),
+        };
+
+        exit_res
+    }
+
+    // Run a single instance of the enclave until it exits, the run is cancelled
+    // or a restart is requested. Returns None in the latter case.
+    async fn run_instance(
+        &mut self,
+        cancellation: &CancellationToken,
+    ) -> Result<Option<EnclaveExitStatus>> {
+        self.handle.set_starting();
+        self.console_tail.clear();
+        self.log_tail.clear();
 
-        info!("starting enclave");
-        let enclave_info = self
-            .cli
-            .run_enclave(RunEnclaveArgs {
-                cpu_count: self.cpu_count,
-                memory_mb: self.memory_mb,
-                eif_path: self.eif_path.clone(),
-                cid: None,
-                debug_mode: self.debug_mode,
-            })
-            .await?;
+        let enclave_info = if self.simulate {
+            info!("waiting for the simulated enclave at CID {VMADDR_CID_LOCAL}");
+            self.simulated_enclave_info()
+        } else {
+            info!("starting enclave");
+            self.cli
+                .run_enclave(RunEnclaveArgs {
+                    cpu_count: self.cpu_count,
+                    memory_mb: self.memory_mb,
+                    eif_path: self.eif_path.clone(),
+                    cid: None,
+                    debug_mode: self.debug_mode,
+                })
+                .await?
+        };
 
         self.enclave_info = Some(enclave_info.clone());
+        self.handle.set_running(&enclave_info);
 
         info!("started enclave {}", enclave_info.id);
 
-        if self.debug_mode {
+        // A simulated enclave has no console, its container has the output
+        if self.debug_mode && !self.simulate {
             // TODO: Should we let an an EOF from the console terminate run?
             self.attach_debug_console(&enclave_info.id).await?;
         }
 
-        self.start_odyn_log_stream(enclave_info.cid);
+        // Once the app is exec'd, the runtime no longer streams logs, sends
+        // heartbeats or syncs the clock
+        let exec_mode = self.exec_mode();
+        if !exec_mode {
+            self.start_odyn_log_stream(enclave_info.cid);
+        }
+
+        self.start_clock_sync(enclave_info.cid, exec_mode);
 
         self.start_ingress_proxies(enclave_info.cid).await?;
 
         let exit_res = tokio::select! {
-            exit_res = Enclave::await_exit(enclave_info.cid) =>
-                exit_res,
+            exit_res = self.await_exit(&enclave_info) =>
+                exit_res.map(Some),
+
+            exit_status = self.monitor_heartbeat(&enclave_info), if !exec_mode =>
+                Ok(Some(exit_status)),
 
             _ = cancellation.cancelled() =>
-                Ok(EnclaveExitStatus::Cancelled),
+                Ok(Some(EnclaveExitStatus::Cancelled)),
+
+            _ = self.handle.restart_requested() =>
+                Ok(None),
         };
 
-        if let Err(err) = self.cleanup().await {
-            error!("error terminating enclave: {err}");
+        // Stopped from out here, while it was running fine, so the app gets to
+        // wind down first
+        let stopped = matches!(exit_res, Ok(None) | Ok(Some(EnclaveExitStatus::Cancelled)));
+        if stopped && !exec_mode {
+            self.request_shutdown(enclave_info.cid).await;
         }
 
-        match exit_res {
-            Ok(EnclaveExitStatus::Exited(code)) => info!("enclave exited with code {code}"),
-            Ok(EnclaveExitStatus::Signaled(signal)) => {
-                info!("enclave stopped due to signal {signal}")
-            }
-            Ok(EnclaveExitStatus::Fatal(ref error)) => {
-                info!("enclave exited due to fatal error: {error}")
-            }
-            Ok(EnclaveExitStatus::Cancelled) => (),
-            Err(ref err) => error!("error waing for enclave exit: {err}"),
-        };
+        // Collect what we can while the enclave is still around
+        if let Some(failure) = describe_failure(&exit_res) {
+            self.save_crash_report(&enclave_info, failure).await;
+        }
+
+        if let Err(err) = self.stop_instance().await {
+            error!("error terminating enclave: {err}");
+        }
 
         exit_res
     }
@@ -186,10 +338,37 @@ impl Enclave {
 
         for item in ingress {
             let listen_port = item.listen_port;
-            info!("starting ingress proxy on port {listen_port}");
-            let proxy = HostProxy::bind(listen_port).await?;
-            self.tasks.push(tokio::task::spawn(async move {
-                proxy.serve(cid, listen_port.into()).await;
+            let mut proxy = match (&item.listen_socket, item.listen_address) {
+                (Some(path), _) => {
+                    info!("starting ingress proxy on {path} for port {listen_port}");
+                    HostProxy::bind_unix(path)?
+                }
+                (None, Some(addr)) => {
+                    info!("starting ingress proxy on {addr} port {listen_port}");
+                    HostProxy::bind_addr(SocketAddr::new(addr, listen_port)).await?
+                }
+                (None, None) => {
+                    info!("starting ingress proxy on port {listen_port}");
+                    HostProxy::bind(listen_port).await?
+                }
+            };
+            if let Some(ref host_tls) = item.host_tls {
+                info!("terminating TLS for ingress port {listen_port} on the host");
+                proxy = proxy.with_tls(tls::load_server_config(
+                    &host_tls.key_file,
+                    &host_tls.cert_file,
+                )?);
+            }
+            if let Some(ref spec) = item.access_log {
+                proxy = proxy.with_access_log(AccessLog::new(spec));
+            }
+            proxy = proxy
+                .with_timeouts(Timeouts::new(item.timeouts.as_ref()).with_buffer_kb(item.buffer_kb))
+                .with_proxy_protocol(item.proxy_protocol.unwrap_or(false));
+
+            let cancellation = self.instance_proxies.cancellation();
+            self.instance_proxies.push(tokio::task::spawn(async move {
+                proxy.serve(cid, listen_port.into(), cancellation).await;
             }))
         }
 
@@ -199,54 +378,182 @@ impl Enclave {
     async fn start_egress_proxy(&mut self) -> Result<()> {
         // Note: we _could_ start the egress proxy no matter what, but there is no sense in it,
         // and skipping it seems (barely) safer - so we may as well.
-        if self.manifest.egress.is_none() {
-            info!("no egress defined, no egress proxy will be started");
+        let egress_policy = match self.egress_policy {
+            Some(ref policy) => policy.clone(),
+            None => {
+                info!("no egress defined, no egress proxy will be started");
+                return Ok(());
+            }
+        };
+
+        info!("starting egress proxy on vsock port {HTTP_EGRESS_VSOCK_PORT}");
+        let proxy = HostHttpProxy::bind(HTTP_EGRESS_VSOCK_PORT, egress_policy.clone())?;
+        let cancellation = self.proxies.cancellation();
+        self.proxies.push(tokio::task::spawn(async move {
+            proxy.serve(cancellation).await;
+        }));
+
+        // Used by the enclave if it is configured to, otherwise idle
+        info!("starting egress mux on vsock port {EGRESS_MUX_VSOCK_PORT}");
+        let mux = HostMuxProxy::bind(EGRESS_MUX_VSOCK_PORT, egress_policy.clone())?;
+        let cancellation = self.proxies.cancellation();
+        self.proxies.push(tokio::task::spawn(async move {
+            mux.serve(cancellation).await;
+        }));
+
+        info!("starting UDP relay on vsock port {UDP_EGRESS_VSOCK_PORT}");
+        let relay = HostUdpRelay::bind(UDP_EGRESS_VSOCK_PORT, egress_policy.clone())?;
+        self.tasks.push(tokio::task::spawn(async move {
+            relay.serve().await;
+        }));
+
+        if self.watch_manifest {
+            info!(
+                "reloading egress rules when {} changes",
+                self.manifest_path.display()
+            );
+            let watch = reload::watch(self.manifest_path.clone(), egress_policy.clone());
+            self.tasks.push(tokio::task::spawn(watch));
+        }
+
+        let dns_enabled = self
+            .manifest
+            .egress
+            .as_ref()
+            .and_then(|egress| egress.dns)
+            .unwrap_or(false);
+
+        if dns_enabled {
+            info!("starting DNS resolver on vsock port {DNS_VSOCK_PORT}");
+            let resolver = HostDnsResolver::bind(DNS_VSOCK_PORT, egress_policy).await?;
+            self.tasks.push(tokio::task::spawn(async move {
+                resolver.serve().await;
+            }));
+        }
+
+        Ok(())
+    }
+
+    // The KMS proxy and the API inside the enclave get their AWS credentials
+    // from here, since the enclave cannot reach IMDS
+    async fn start_credentials_server(&mut self) -> Result<()> {
+        if self.manifest.kms_proxy.is_none() && self.manifest.api.is_none() {
             return Ok(());
         }
 
-        info!("starting egress proxy on vsock port {HTTP_EGRESS_VSOCK_PORT}");
-        let proxy = HostHttpProxy::bind(HTTP_EGRESS_VSOCK_PORT)?;
+        info!("serving AWS credentials on vsock port {CREDENTIALS_VSOCK_PORT}");
+        let sdk_config = aws_config::load_from_env().await;
+        let server = HostCredentialsServer::bind(CREDENTIALS_VSOCK_PORT, sdk_config)?;
         self.tasks.push(tokio::task::spawn(async move {
-            proxy.serve().await;
+            server.serve().await;
         }));
 
         Ok(())
     }
 
     fn start_odyn_log_stream(&mut self, cid: u32) {
-        self.tasks.push(tokio::task::spawn(async move {
+        let log_tail = self.log_tail.clone();
+
+        self.instance_tasks.push(tokio::task::spawn(async move {
             info!("waiting for enclave to boot to stream logs");
-            let conn = loop {
-                match VsockStream::connect(cid, APP_LOG_PORT).await {
-                    Ok(conn) => break conn,
+            let mut logs = Reconnector::new(cid, APP_LOG_PORT)
+                .with_backoff(Backoff::new(
+                    LOG_VSOCK_RETRY_INTERVAL,
+                    LOG_VSOCK_MAX_RETRY_INTERVAL,
+                ))
+                .on_event(|event| match event {
+                    reconnect::Event::Connected { .. } => {
+                        info!("connected to enclave, starting log stream")
+                    }
+                    reconnect::Event::Lost => info!("enclave log stream closed, reconnecting"),
+                    reconnect::Event::Failed { .. } => {}
+                });
 
-                    // TODO: improve the polling frequency / backoff / timeout
-                    Err(_) => {
-                        tokio::time::sleep(LOG_VSOCK_RETRY_INTERVAL).await;
+            // Nothing cancels it, so it never fails
+            while let Ok(conn) = logs.connect().await {
+                let mut framed = FramedRead::new(
+                    conn,
+                    LinesCodec::new_with_max_length(utils::LOG_LINE_MAX_LEN),
+                );
+
+                while let Some(line_res) = framed.next().await {
+                    match line_res {
+                        Ok(line) => {
+                            info!(target: "enclave", "{line}");
+                            log_tail.push(&line);
+                        }
+                        Err(e) => info!(target: "enclave", "error reading log stream: {e}"),
                     }
                 }
-            };
+            }
+        }));
+    }
+
+    // Periodically push the host time into the enclave. The enclave has no
+    // time source of its own and its clock drifts over time, which eventually
+    // breaks TLS certificate and token expiry checks.
+    // With once, only until the first sync, which the runtime waits for
+    // before it execs the app
+    fn start_clock_sync(&mut self, cid: u32, once: bool) {
+        self.instance_tasks.push(tokio::task::spawn(async move {
+            let mut client = ClockSyncClient::new(cid, CLOCK_SYNC_PORT);
+            let mut synced = false;
+
+            loop {
+                match client.sync(CLOCK_SYNC_TIMEOUT).await {
+                    Ok(res) => {
+                        if !synced {
+                            info!("enclave clock synchronized with host");
+                            synced = true;
+                        }
+                        clock_sync::log_result(&res);
+                        if once {
+                            break;
+                        }
+                        tokio::time::sleep(CLOCK_SYNC_INTERVAL).await;
+                    }
 
-            info!("connected to enclave, starting log stream");
-            if let Err(e) = utils::log_lines_from_stream("enclave", conn).await {
-                error!("error reading log lines from enclave: {e}");
+                    // Keep trying until the enclave has booted
+                    Err(_) if !synced => {
+                        tokio::time::sleep(CLOCK_SYNC_RETRY_INTERVAL).await;
+                    }
+
+                    Err(err) => {
+                        warn!("failed to synchronize enclave clock: {err}");
+                        tokio::time::sleep(CLOCK_SYNC_INTERVAL).await;
+                    }
+                }
             }
         }));
     }
 
-    async fn await_exit(cid: u32) -> Result<EnclaveExitStatus> {
+    // In exec mode, this is also where the boot timeout is kept: there are
+    // no heartbeats, and the runtime only says it is done setting up the
+    // enclave, right before it execs the app.
+    async fn await_exit(&self, enclave_info: &EnclaveInfo) -> Result<EnclaveExitStatus> {
+        let cid = enclave_info.cid;
         let mut failed_attempts = 0;
+        let boot_deadline = tokio::time::Instant::now() + self.boot_timeout;
+        let mut booting = self.exec_mode();
 
         loop {
-            let conn = match VsockStream::connect(cid, STATUS_PORT).await {
+            if booting && tokio::time::Instant::now() >= boot_deadline {
+                return Ok(self.exec_boot_timeout(enclave_info));
+            }
+
+            let conn = match vsock::connect(cid, STATUS_PORT, &DialOptions::default()).await {
                 Ok(conn) => conn,
 
+                // How long to wait for the enclave to boot is up to monitor_heartbeat
+                // (or the deadline above), only check every so often that the enclave
+                // is still there.
                 Err(_) => {
                     failed_attempts += 1;
                     if failed_attempts >= STATUS_VSOCK_RETRY_LIMIT {
-                        return Err(anyhow!(
-                            "failed to connect to enclave status port after {STATUS_VSOCK_RETRY_LIMIT} attempts"
-                        ));
+                        if let Some(reason) = self.diagnose_exit(enclave_info).await {
+                            return Ok(EnclaveExitStatus::Died(reason));
+                        }
+                        failed_attempts = 0;
                     }
                     tokio::time::sleep(STATUS_VSOCK_RETRY_INTERVAL).await;
                     continue;
@@ -257,13 +564,23 @@ impl Enclave {
 
             let mut framed = FramedRead::new(conn, LinesCodec::new_with_max_length(1024));
 
-            while let Some(line_res) = framed.next().await {
-                let line = match line_res {
-                    Ok(line) => line,
-                    Err(e) => {
+            loop {
+                let next = if booting {
+                    match tokio::time::timeout_at(boot_deadline, framed.next()).await {
+                        Ok(next) => next,
+                        Err(_) => return Ok(self.exec_boot_timeout(enclave_info)),
+                    }
+                } else {
+                    framed.next().await
+                };
+
+                let line = match next {
+                    Some(Ok(line)) => line,
+                    Some(Err(e)) => {
                         error!("error reading from status port: {e}");
                         continue;
                     }
+                    None => break,
                 };
 
                 let status: EnclaveProcessStatus = match serde_json::from_str(&line) {
@@ -284,13 +601,152 @@ impl Enclave {
                     EnclaveProcessStatus::Fatal { error } => {
                         return Ok(EnclaveExitStatus::Fatal(error));
                     }
+                    EnclaveProcessStatus::Exec => {
+                        info!("enclave set up, the runtime is handing over to the app");
+                        self.handle.set_healthy(true);
+                        booting = false;
+                    }
                     _ => {
                         debug!("enclave status: {status:#?}");
                     }
                 }
             }
 
-            error!("enclave status port closed unexpectedly");
+            // Nothing serves the status once the app is exec'd, all that is
+            // left is to check that the enclave is still there
+            if !self.exec_mode() {
+                error!("enclave status port closed unexpectedly");
+            }
+
+            if let Some(reason) = self.diagnose_exit(enclave_info).await {
+                return Ok(EnclaveExitStatus::Died(reason));
+            }
+        }
+    }
+
+    fn exec_boot_timeout(&self, enclave_info: &EnclaveInfo) -> EnclaveExitStatus {
+        error!(
+            "enclave {} was not set up within {:?}",
+            enclave_info.id, self.boot_timeout
+        );
+        EnclaveExitStatus::BootTimeout(self.boot_timeout)
+    }
+
+    // Ping the runtime inside the enclave and only return once the enclave is
+    // known to be gone, or if it never answers within the boot timeout.
+    // Missed heartbeats alone mark the enclave as unhealthy; whether it is
+    // actually dead is decided by asking nitro-cli.
+    async fn monitor_heartbeat(&self, enclave_info: &EnclaveInfo) -> EnclaveExitStatus {
+        let boot_started = std::time::Instant::now();
+        let mut monitor = Monitor::new(HeartbeatClient::new(enclave_info.cid, HEARTBEAT_PORT));
+
+        loop {
+            match monitor.next().await {
+                heartbeat::Event::Up => {
+                    debug!(
+                        "first heartbeat received after {:?}",
+                        boot_started.elapsed()
+                    );
+                    self.handle.set_healthy(true);
+                }
+
+                heartbeat::Event::Alive => self.handle.set_healthy(true),
+
+                heartbeat::Event::Restored { missed } => {
+                    info!("enclave heartbeat restored after {missed} missed");
+                    self.handle.set_healthy(true);
+                }
+
+                // The enclave is still up, as far as nitro-cli is concerned,
+                // but the runtime is not the one that answered before
+                heartbeat::Event::Restarted => {
+                    warn!("the runtime in enclave {} restarted", enclave_info.id);
+                    self.handle.set_healthy(true);
+                }
+
+                // Nothing to monitor until the runtime has come up
+                heartbeat::Event::Down { err } => {
+                    if boot_started.elapsed() >= self.boot_timeout {
+                        error!(
+                            "no heartbeat from enclave {} within {:?}: {err}",
+                            enclave_info.id, self.boot_timeout
+                        );
+                        return EnclaveExitStatus::BootTimeout(self.boot_timeout);
+                    }
+                }
+
+                heartbeat::Event::Missed { err, .. } => {
+                    debug!("missed enclave heartbeat: {err}");
+                }
+
+                heartbeat::Event::Dead { missed, err } => {
+                    warn!("enclave missed {missed} heartbeats: {err}");
+                    self.handle.set_healthy(false);
+
+                    if let Some(reason) = self.diagnose_exit(enclave_info).await {
+                        return EnclaveExitStatus::Died(reason);
+                    }
+                }
+            }
+        }
+    }
+
+    // Called when the enclave stops responding. Returns None if nitro-cli
+    // still considers the enclave to be running, otherwise the best guess
+    // as to why it went away.
+    async fn diagnose_exit(&self, enclave_info: &EnclaveInfo) -> Option<ExitReason> {
+        // There is no nitro-cli to ask, the simulated enclave is only known
+        // by its runtime
+        if self.simulate {
+            error!("simulated enclave {} is no longer running", enclave_info.id);
+            return Some(ExitReason::Unknown);
+        }
+
+        let enclaves = match self.cli.describe_enclaves().await {
+            Ok(enclaves) => enclaves,
+            Err(err) => {
+                error!("failed to describe enclaves: {err}");
+                return None;
+            }
+        };
+
+        let state = match enclaves.iter().find(|e| e.id == enclave_info.id) {
+            Some(info) if !info.is_terminating() => return None,
+            Some(info) => info.state.clone().unwrap_or_default(),
+            None => "GONE".to_string(),
+        };
+
+        let console = self.console_tail.lines();
+        let reason = ExitReason::from_console(&console);
+
+        error!(
+            "enclave {} is no longer running: reason={reason}, state={state}, debug_mode={}, last_console_line={:?}",
+            enclave_info.id,
+            self.debug_mode,
+            console.last().map(String::as_str).unwrap_or("")
+        );
+
+        Some(reason)
+    }
+
+    async fn save_crash_report(&self, enclave_info: &EnclaveInfo, exit: String) {
+        let target = match self.crash_target {
+            Some(ref target) => target,
+            None => return,
+        };
+
+        let report = CrashReport {
+            enclave_info,
+            debug_mode: self.debug_mode,
+            exit,
+            console: self.console_tail.lines(),
+            logs: self.log_tail.lines(),
+            describe_enclaves: self.cli.describe_enclaves().await,
+        };
+
+        match report.save(target).await {
+            Ok(location) => info!("saved crash report to {location}"),
+            Err(err) => error!("failed to save crash report: {err}"),
         }
     }
 
@@ -298,35 +754,139 @@ impl Enclave {
         info!("attaching to debug console");
 
         let stdout = self.cli.console(enclave_id).await?;
+        let console_tail = self.console_tail.clone();
 
-        self.tasks.push(tokio::task::spawn(async move {
-            if let Err(e) = utils::log_lines_from_stream("nitro-cli::console", stdout).await {
-                error!("error reading log lines from debug console: {e}");
+        self.instance_tasks.push(tokio::task::spawn(async move {
+            let mut framed = FramedRead::new(stdout, LinesCodec::new_with_max_length(4096));
+
+            while let Some(line_res) = framed.next().await {
+                match line_res {
+                    Ok(line) => {
+                        info!(target: "nitro-cli::console", "{line}");
+                        console_tail.push(&line);
+                    }
+                    Err(e) => {
+                        error!("error reading log lines from debug console: {e}");
+                        break;
+                    }
+                }
             }
         }));
 
         Ok(())
     }
 
-    async fn cleanup(self) -> Result<()> {
-        if let Some(enclave_info) = self.enclave_info {
-            debug!("terminating enclave");
-            self.cli.terminate_enclave(&enclave_info.id).await?;
+    async fn request_shutdown(&self, cid: u32) {
+        let grace = self.shutdown_grace;
+        debug!("asking the enclave to shut down within {grace:?}");
+        if let Err(err) = shutdown::request(cid, SHUTDOWN_PORT, grace).await {
+            warn!("the enclave did not shut down gracefully: {err}");
+        }
+    }
+
+    // Stands in for what nitro-cli run-enclave reports. The container of a
+    // simulated enclave is started again along with its runtime, at the
+    // same CID.
+    fn simulated_enclave_info(&self) -> EnclaveInfo {
+        EnclaveInfo {
+            name: self.manifest.name.clone(),
+            id: format!("simulated-{}", self.manifest.name),
+            process_id: 0,
+            cid: VMADDR_CID_LOCAL,
+            state: None,
+            flags: None,
+            memory_mib: None,
+        }
+    }
+
+    fn exec_mode(&self) -> bool {
+        self.manifest.launch_mode == Some(LaunchMode::Exec)
+    }
+
+    // Terminate the running enclave and stop the tasks tied to it.
+    async fn stop_instance(&mut self) -> Result<()> {
+        self.instance_proxies.stop().await;
+        abort_tasks(self.instance_tasks.drain(..)).await;
+
+        if let Some(enclave_info) = self.enclave_info.take() {
+            if !self.simulate {
+                debug!("terminating enclave");
+                self.cli.terminate_enclave(&enclave_info.id).await?;
+            }
         } else {
             debug!("no enclave to stop");
         }
 
-        for task in self.tasks {
-            task.abort();
-            match task.await {
-                Ok(_) => {}
-                Err(e) => {
-                    debug!("task terminated with error {e}");
-                }
-            };
+        Ok(())
+    }
+
+    async fn cleanup(mut self) {
+        self.proxies.stop().await;
+        abort_tasks(self.tasks.into_iter()).await;
+    }
+}
+
+// Proxies are stopped by cancelling them rather than aborting their tasks, so
+// that they get to close their listeners and connections before returning.
+struct ProxyTasks {
+    cancellation: CancellationToken,
+    tasks: Vec<tokio::task::JoinHandle<()>>,
+}
+
+impl ProxyTasks {
+    fn new() -> Self {
+        Self {
+            cancellation: CancellationToken::new(),
+            tasks: Vec::new(),
         }
+    }
 
-        Ok(())
+    fn cancellation(&self) -> CancellationToken {
+        self.cancellation.clone()
+    }
+
+    fn push(&mut self, task: tokio::task::JoinHandle<()>) {
+        self.tasks.push(task);
+    }
+
+    // Stop the proxies and wait for them to wind down. Proxies started
+    // afterwards get a fresh token.
+    async fn stop(&mut self) {
+        self.cancellation.cancel();
+        for task in self.tasks.drain(..) {
+            if let Err(e) = task.await {
+                debug!("proxy task terminated with error {e}");
+            }
+        }
+        self.cancellation = CancellationToken::new();
+    }
+}
+
+// A description of the exit if the enclave did not stop the way it was supposed to.
+fn describe_failure(exit_res: &Result<Option<EnclaveExitStatus>>) -> Option<String> {
+    match exit_res {
+        Ok(Some(EnclaveExitStatus::Died(reason))) => Some(format!("died: {reason}")),
+        Ok(Some(EnclaveExitStatus::BootTimeout(timeout))) => {
+            Some(format!("boot timeout after {timeout:?}"))
+        }
+        Ok(Some(EnclaveExitStatus::Fatal(error))) => Some(format!("fatal: {error}")),
+        Ok(Some(EnclaveExitStatus::Exited(code))) if *code != 0 => {
+            Some(format!("exited with code {code}"))
+        }
+        Err(err) => Some(format!("error: {err}")),
+        _ => None,
+    }
+}
+
+async fn abort_tasks(tasks: impl Iterator<Item = tokio::task::JoinHandle<()>>) {
+    for task in tasks {
+        task.abort();
+        match task.await {
+            Ok(_) => {}
+            Err(e) => {
+                debug!("task terminated with error {e}");
+            }
+        };
     }
 }
 
@@ -344,6 +904,9 @@ enum EnclaveProcessStatus {
 
     #[serde(rename = "fatal")]
     Fatal { error: String },
+
+    #[serde(rename = "exec")]
+    Exec,
 }
 
 #[derive(Debug)]
@@ -352,4 +915,148 @@ pub enum EnclaveExitStatus {
     Exited(i32),
     Signaled(i32),
     Fatal(String),
-}
\ No newline at end of file
+    Died(ExitReason),
+    BootTimeout(Duration),
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{describe_failure, Enclave, EnclaveExitStatus, EnclaveOpts};
+    use crate::constants::STATUS_PORT;
+    use crate::nitro_cli::NitroCLI;
+    use crate::vsock::{ListenConfig, VMADDR_CID_MEMORY};
+    use assert2::assert;
+    use futures_util::stream::StreamExt;
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::Path;
+    use std::time::Duration;
+    use tokio::io::AsyncWriteExt;
+    use tokio_util::sync::CancellationToken;
+
+    const MANIFEST: &str =
+        "version: v1\nname: test\ntarget: test:enclave\nsources:\n  app: test:latest\n";
+
+    // Stands in for nitro-cli, with an enclave at VMADDR_CID_MEMORY that
+    // only answers what a test serves there, and records how it was called
+    const NITRO_CLI: &str = r#"#!/bin/sh
+echo "$@" >> "$(dirname "$0")/calls"
+case "$1" in
+run-enclave) echo '{"EnclaveName":"test","EnclaveID":"i-test-enc","ProcessID":1,"EnclaveCID":4294967294}' ;;
+terminate-enclave) echo '{"EnclaveID":"i-test-enc","Terminated":true}' ;;
+describe-enclaves) echo '[]' ;;
+esac
+"#;
+
+    // An enclave of the given manifest, run with the stand-in nitro-cli
+    async fn enclave(dir: &Path, manifest: &str, boot_timeout: Duration) -> Enclave {
+        let eif_path = dir.join("application.eif");
+        std::fs::write(&eif_path, b"eif").unwrap();
+        let manifest_path = dir.join("enclaver.yaml");
+        std::fs::write(&manifest_path, manifest).unwrap();
+        let nitro_cli = dir.join("nitro-cli");
+        std::fs::write(&nitro_cli, NITRO_CLI).unwrap();
+        std::fs::set_permissions(&nitro_cli, std::fs::Permissions::from_mode(0o755)).unwrap();
+
+        let mut enclave = Enclave::new(EnclaveOpts {
+            eif_path: Some(eif_path),
+            manifest_path: Some(manifest_path),
+            cpu_count: None,
+            memory_mb: None,
+            debug_mode: false,
+            boot_timeout: Some(boot_timeout),
+            crash_target: None,
+            watch_manifest: false,
+            shutdown_grace: None,
+            simulate: false,
+        })
+        .await
+        .unwrap();
+        enclave.cli = NitroCLI::new().with_program(nitro_cli.to_str().unwrap());
+        enclave
+    }
+
+    #[tokio::test]
+    async fn test_boot_timeout() {
+        let dir = tempfile::tempdir().unwrap();
+        let enclave = enclave(dir.path(), MANIFEST, Duration::ZERO).await;
+
+        // Given up on at the first heartbeat missed, and terminated
+        let status = enclave.run(CancellationToken::new()).await.unwrap();
+        assert!(let EnclaveExitStatus::BootTimeout(_) = status);
+        let calls = std::fs::read_to_string(dir.path().join("calls")).unwrap();
+        assert!(calls.contains("terminate-enclave --enclave-id i-test-enc"));
+    }
+
+    #[tokio::test]
+    async fn test_exec_boot_timeout() {
+        let dir = tempfile::tempdir().unwrap();
+        let manifest = format!("{MANIFEST}launch_mode: exec\n");
+        let enclave = enclave(dir.path(), &manifest, Duration::ZERO).await;
+
+        // No heartbeats in exec mode, but never set up all the same
+        let status = enclave.run(CancellationToken::new()).await.unwrap();
+        assert!(let EnclaveExitStatus::BootTimeout(_) = status);
+        let calls = std::fs::read_to_string(dir.path().join("calls")).unwrap();
+        assert!(calls.contains("terminate-enclave --enclave-id i-test-enc"));
+    }
+
+    #[tokio::test]
+    async fn test_exec_set_up() {
+        let dir = tempfile::tempdir().unwrap();
+        let manifest = format!("{MANIFEST}launch_mode: exec\n");
+        let enclave = enclave(dir.path(), &manifest, Duration::from_secs(5)).await;
+
+        // The runtime says it is set up, then goes away as it execs the app
+        let mut incoming = ListenConfig::new(STATUS_PORT)
+            .with_cid(VMADDR_CID_MEMORY)
+            .listen()
+            .unwrap();
+        let runtime = tokio::task::spawn(async move {
+            while let Some(mut conn) = incoming.next().await {
+                _ = conn.write_all(b"{\"status\": \"exec\"}\n").await;
+            }
+        });
+
+        // Past the boot, only nitro-cli tells that the enclave is gone
+        let status = enclave.run(CancellationToken::new()).await.unwrap();
+        assert!(let EnclaveExitStatus::Died(_) = status);
+
+        runtime.abort();
+        _ = runtime.await;
+    }
+
+    #[tokio::test]
+    async fn test_simulate_boot_timeout() {
+        let dir = tempfile::tempdir().unwrap();
+        let manifest_path = dir.path().join("enclaver.yaml");
+        std::fs::write(&manifest_path, MANIFEST).unwrap();
+
+        // No EIF, and no nitro-cli to start or terminate it with
+        let mut enclave = Enclave::new(EnclaveOpts {
+            eif_path: Some(dir.path().join("application.eif")),
+            manifest_path: Some(manifest_path),
+            cpu_count: None,
+            memory_mb: None,
+            debug_mode: false,
+            boot_timeout: Some(Duration::ZERO),
+            crash_target: None,
+            watch_manifest: false,
+            shutdown_grace: None,
+            simulate: true,
+        })
+        .await
+        .unwrap();
+        enclave.cli = NitroCLI::new().with_program(dir.path().join("nitro-cli").to_str().unwrap());
+
+        let status = enclave.run(CancellationToken::new()).await.unwrap();
+        assert!(let EnclaveExitStatus::BootTimeout(_) = status);
+    }
+
+    #[test]
+    fn test_describe_failure() {
+        let exited = |code| Ok(Some(EnclaveExitStatus::Exited(code)));
+        assert!(describe_failure(&exited(0)) == None);
+        assert!(describe_failure(&exited(1)) == Some("exited with code 1".to_string()));
+        assert!(describe_failure(&Ok(None)) == None);
+    }
+}
@@ -1,6 +1,10 @@
 use anyhow::{anyhow, Result};
-use bollard::container::{Config, LogOutput, LogsOptions, WaitContainerOptions};
-use bollard::models::{DeviceMapping, HostConfig, PortBinding, PortMap};
+use bollard::container::{
+    Config, LogOutput, LogsOptions, RemoveContainerOptions, WaitContainerOptions,
+};
+use bollard::models::{
+    DeviceMapping, HostConfig, PortBinding, PortMap, RestartPolicy, RestartPolicyNameEnum,
+};
 use bollard::Docker;
 use futures_util::stream::{StreamExt, TryStreamExt};
 use std::collections::HashMap;
@@ -10,6 +14,7 @@ use tokio::io::AsyncWriteExt;
 pub struct RunWrapper {
     docker: Arc<Docker>,
     container_id: Option<String>,
+    enclave_container_id: Option<String>,
     stream_task: Option<tokio::task::JoinHandle<()>>,
 }
 
@@ -23,6 +28,7 @@ impl RunWrapper {
         Ok(Self {
             docker: docker_client,
             container_id: None,
+            enclave_container_id: None,
             stream_task: None,
         })
     }
@@ -31,6 +37,48 @@ impl RunWrapper {
         &mut self,
         image_name: &str,
         port_forwards: Vec<String>,
+    ) -> Result<()> {
+        let devices = vec![DeviceMapping {
+            path_on_host: Some(String::from("/dev/nitro_enclaves")),
+            path_in_container: Some(String::from("/dev/nitro_enclaves")),
+            cgroup_permissions: Some(String::from("rwm")),
+        }];
+
+        self.start_wrapper(image_name, vec![], devices, port_forwards)
+            .await?;
+        self.wait_wrapper().await
+    }
+
+    /// Run an Enclaver image against a simulated enclave: the image of the enclave, as
+    /// EnclaveArtifactBuilder::build_simulation made it, in a container of its own. The wrapper
+    /// and odyn talk over vsock loopback, so this needs Linux with the vsock_loopback module.
+    pub async fn run_simulated_image(
+        &mut self,
+        image_name: &str,
+        simulation_image: &str,
+        port_forwards: Vec<String>,
+    ) -> Result<()> {
+        self.start_wrapper(
+            image_name,
+            vec![String::from("--simulate")],
+            vec![],
+            port_forwards,
+        )
+        .await?;
+        self.start_simulated_enclave(simulation_image).await?;
+
+        let res = self.wait_wrapper().await;
+        self.remove_simulated_enclave().await?;
+
+        res
+    }
+
+    async fn start_wrapper(
+        &mut self,
+        image_name: &str,
+        args: Vec<String>,
+        devices: Vec<DeviceMapping>,
+        port_forwards: Vec<String>,
     ) -> Result<()> {
         if self.container_id.is_some() {
             return Err(anyhow!("container already running"));
@@ -66,15 +114,11 @@ impl RunWrapper {
                 None,
                 Config {
                     image: Some(image_name.to_string()),
-                    cmd: Some(vec![]), // TODO(russell_h): pass through additional args
+                    cmd: Some(args),
                     attach_stderr: Some(true),
                     attach_stdout: Some(true),
                     host_config: Some(HostConfig {
-                        devices: Some(vec![DeviceMapping {
-                            path_on_host: Some(String::from("/dev/nitro_enclaves")),
-                            path_in_container: Some(String::from("/dev/nitro_enclaves")),
-                            cgroup_permissions: Some(String::from("rwm")),
-                        }]),
+                        devices: Some(devices),
                         port_bindings: Some(port_bindings),
                         ..Default::default()
                     }),
@@ -91,7 +135,16 @@ impl RunWrapper {
             .start_container::<String>(&container_id, None)
             .await?;
 
-        self.start_output_stream_task(container_id.clone()).await?;
+        self.start_output_stream_task(container_id).await?;
+
+        Ok(())
+    }
+
+    async fn wait_wrapper(&mut self) -> Result<()> {
+        let container_id = self
+            .container_id
+            .clone()
+            .ok_or_else(|| anyhow!("container not running"))?;
 
         let status_code = self
             .docker
@@ -114,6 +167,59 @@ impl RunWrapper {
         Ok(())
     }
 
+    // The enclave has no network of its own, only vsock, which is not namespaced, so the
+    // wrapper reaches it all the same. Its output comes through the wrapper, as it would
+    // from an enclave.
+    async fn start_simulated_enclave(&mut self, simulation_image: &str) -> Result<()> {
+        let container_id = self
+            .docker
+            .create_container::<String, String>(
+                None,
+                Config {
+                    image: Some(simulation_image.to_string()),
+                    host_config: Some(HostConfig {
+                        network_mode: Some(String::from("none")),
+                        // For the addresses, routes and iptables rules odyn sets up for egress
+                        cap_add: Some(vec![String::from("NET_ADMIN")]),
+                        // odyn exits when the wrapper restarts the enclave, which comes back
+                        // the way nitro-cli would start it again
+                        restart_policy: Some(RestartPolicy {
+                            name: Some(RestartPolicyNameEnum::ALWAYS),
+                            maximum_retry_count: None,
+                        }),
+                        ..Default::default()
+                    }),
+                    ..Default::default()
+                },
+            )
+            .await?
+            .id;
+
+        self.enclave_container_id = Some(container_id.clone());
+
+        self.docker
+            .start_container::<String>(&container_id, None)
+            .await?;
+
+        Ok(())
+    }
+
+    async fn remove_simulated_enclave(&mut self) -> Result<()> {
+        if let Some(container_id) = self.enclave_container_id.take() {
+            self.docker
+                .remove_container(
+                    &container_id,
+                    Some(RemoveContainerOptions {
+                        force: true,
+                        ..Default::default()
+                    }),
+                )
+                .await?;
+        }
+
+        Ok(())
+    }
+
     async fn start_output_stream_task(&mut self, container_id: String) -> Result<()> {
         let mut stdout = tokio::io::stdout();
         let mut stderr = tokio::io::stderr();
@@ -148,6 +254,8 @@ impl RunWrapper {
             self.docker.remove_container(&container_id, None).await?;
         }
 
+        self.remove_simulated_enclave().await?;
+
         if let Some(stream_task) = self.stream_task.take() {
             stream_task.await?;
         }
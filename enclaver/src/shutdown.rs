@@ -0,0 +1,163 @@
+use std::future::Future;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, Result};
+use async_trait::async_trait;
+use futures::future::BoxFuture;
+use futures::StreamExt;
+use log::{debug, info, warn};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use tokio::task::JoinHandle;
+
+use crate::rpc;
+use crate::vsock::{self, DialOptions, ListenConfig};
+
+// Before terminating the enclave, the wrapper asks the runtime to shut down
+// and waits for it to answer, for at most the grace period it gives. The
+// runtime runs its shutdown hooks in the meantime, which the enclave is torn
+// down after either way.
+
+const METHOD: &str = "shutdown";
+
+// Within the 10s docker stop gives the wrapper, with the margin
+pub const DEFAULT_GRACE: Duration = Duration::from_secs(5);
+
+// For the answer to make it back once the hooks are done or given up on
+const REPLY_MARGIN: Duration = Duration::from_secs(2);
+
+const DIAL_TIMEOUT: Duration = Duration::from_secs(2);
+
+#[derive(Debug, Serialize, Deserialize)]
+struct ShutdownParams {
+    grace_ms: u64,
+}
+
+type Hook = Box<dyn FnOnce(Instant) -> BoxFuture<'static, ()> + Send>;
+
+// What runs when the wrapper is about to terminate the enclave, e.g. to have
+// the app flush its state or to zeroize keys. Hooks are given the deadline to
+// be done by.
+#[derive(Clone, Default)]
+pub struct ShutdownHooks {
+    hooks: Arc<Mutex<Vec<Hook>>>,
+}
+
+impl ShutdownHooks {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn on_shutdown<F, Fut>(&self, hook: F)
+    where
+        F: FnOnce(Instant) -> Fut + Send + 'static,
+        Fut: Future<Output = ()> + Send + 'static,
+    {
+        let hook: Hook = Box::new(move |deadline| Box::pin(hook(deadline)));
+        self.hooks.lock().unwrap().push(hook);
+    }
+
+    // Runs the hooks all at once, until they are done or the grace period is
+    // over. Hooks only run on the first shutdown.
+    pub async fn run(&self, grace: Duration) {
+        let hooks = std::mem::take(&mut *self.hooks.lock().unwrap());
+        let deadline = Instant::now() + grace;
+        let running = futures::future::join_all(hooks.into_iter().map(|hook| hook(deadline)));
+
+        if tokio::time::timeout(grace, running).await.is_err() {
+            warn!("Shutdown hooks still running after {grace:?}, giving up on them");
+        }
+    }
+}
+
+struct Handler {
+    hooks: ShutdownHooks,
+}
+
+#[async_trait]
+impl rpc::Handler for Handler {
+    async fn handle(&self, method: &str, params: Value) -> Result<Value> {
+        if method != METHOD {
+            return Err(anyhow!("unknown method {method}"));
+        }
+
+        let params: ShutdownParams = serde_json::from_value(params)?;
+        let grace = Duration::from_millis(params.grace_ms);
+        info!("The wrapper is shutting down the enclave, {grace:?} to go");
+
+        self.hooks.run(grace).await;
+        Ok(Value::Null)
+    }
+}
+
+// The runtime (odyn) side
+pub fn start_serving(port: u32, hooks: ShutdownHooks) -> JoinHandle<Result<()>> {
+    let mut incoming = match ListenConfig::new(port).listen() {
+        Ok(incoming) => incoming,
+        Err(e) => return tokio::task::spawn(async move { Err(e) }),
+    };
+
+    tokio::task::spawn(async move {
+        let handler = Arc::new(Handler { hooks });
+        while let Some(conn) = incoming.next().await {
+            let handler = handler.clone();
+            tokio::task::spawn(async move {
+                if let Err(err) = rpc::serve(conn, handler).await {
+                    debug!("shutdown connection failed: {err}");
+                }
+            });
+        }
+
+        Ok(())
+    })
+}
+
+// The wrapper side. Returns once the runtime is done with its hooks, or has
+// had the grace period for them.
+pub async fn request(cid: u32, port: u32, grace: Duration) -> Result<()> {
+    let opts = DialOptions::default().with_timeout(DIAL_TIMEOUT);
+    let conn = vsock::connect(cid, port, &opts).await?;
+
+    let params = ShutdownParams {
+        grace_ms: grace.as_millis() as u64,
+    };
+    let _: Value = rpc::Client::new(conn)
+        .with_timeout(grace + REPLY_MARGIN)
+        .call(METHOD, &params)
+        .await?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::ShutdownHooks;
+    use assert2::assert;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::sync::Arc;
+    use std::time::{Duration, Instant};
+
+    #[tokio::test]
+    async fn test_hooks() {
+        let hooks = ShutdownHooks::new();
+        let flushed = Arc::new(AtomicBool::new(false));
+
+        let done = flushed.clone();
+        hooks.on_shutdown(|_| async move { done.store(true, Ordering::SeqCst) });
+        // Never done, so given up on at the deadline
+        hooks.on_shutdown(|deadline| async move {
+            tokio::time::sleep_until((deadline + Duration::from_secs(60)).into()).await
+        });
+
+        let started = Instant::now();
+        hooks.run(Duration::from_millis(100)).await;
+        assert!(flushed.load(Ordering::SeqCst));
+        assert!(started.elapsed() < Duration::from_secs(5));
+
+        // Nothing left to run
+        flushed.store(false, Ordering::SeqCst);
+        hooks.run(Duration::from_millis(100)).await;
+        assert!(!flushed.load(Ordering::SeqCst));
+    }
+}
@@ -1,11 +1,19 @@
 use anyhow::{anyhow, Result};
-use log::info;
+use log::{error, info};
 use rustls::client::{ServerCertVerified, ServerCertVerifier};
-use rustls::{Certificate, ClientConfig, PrivateKey, RootCertStore, ServerConfig};
+use rustls::server::{ClientHello, ResolvesServerCert};
+use rustls::sign::{CertifiedKey, SigningKey};
+use rustls::{
+    Certificate, ClientConfig, PrivateKey, RootCertStore, ServerConfig, SignatureAlgorithm,
+    SignatureScheme,
+};
 use std::fs::File;
 use std::io::BufReader;
 use std::path::Path;
-use std::sync::Arc;
+use std::sync::{Arc, Mutex};
+
+use crate::keypair::{AttestedKey, KeyPair, KeyType, Signer};
+use crate::x509;
 
 fn load_certs(path: &Path) -> Result<Vec<Certificate>> {
     rustls_pemfile::certs(&mut BufReader::new(File::open(path)?))
@@ -39,6 +47,16 @@ pub fn load_server_config(
     ))
 }
 
+// From a certificate and PKCS#8 private key, both in DER
+pub fn server_config_from_der(cert: Vec<u8>, key: Vec<u8>) -> Result<Arc<ServerConfig>> {
+    Ok(Arc::new(
+        rustls::ServerConfig::builder()
+            .with_safe_defaults()
+            .with_no_client_auth()
+            .with_single_cert(vec![Certificate(cert)], PrivateKey(key))?,
+    ))
+}
+
 pub fn load_client_config(cert: impl AsRef<Path>) -> Result<Arc<ClientConfig>> {
     let mut roots = RootCertStore::empty();
     let certs = load_certs(cert.as_ref())?;
@@ -83,6 +101,184 @@ pub fn load_insecure_client_config() -> Result<Arc<ClientConfig>> {
     Ok(Arc::new(cfg))
 }
 
+// Serves the certificate x509::attested() makes for the key, which clients
+// trust through AttestedCertVerifier
+pub fn attested_server_config(
+    dns_names: &[String],
+    key: &KeyPair,
+    attestation: Vec<u8>,
+) -> Result<Arc<ServerConfig>> {
+    let (cert, private_key) = x509::attested(dns_names, key, attestation)?;
+    server_config_from_der(cert, private_key)
+}
+
+// As attested_server_config(), for whichever key current() returns at the
+// time of each handshake, so that the key can be rotated while listening
+pub fn rotating_attested_server_config<F>(dns_names: &[String], current: F) -> Arc<ServerConfig>
+where
+    F: Fn() -> Arc<AttestedKey> + Send + Sync + 'static,
+{
+    let resolver = AttestedCertResolver {
+        dns_names: dns_names.to_vec(),
+        current: Box::new(current),
+        issued: Mutex::new(None),
+    };
+
+    Arc::new(
+        rustls::ServerConfig::builder()
+            .with_safe_defaults()
+            .with_no_client_auth()
+            .with_cert_resolver(Arc::new(resolver)),
+    )
+}
+
+struct AttestedCertResolver {
+    dns_names: Vec<String>,
+    current: Box<dyn Fn() -> Arc<AttestedKey> + Send + Sync>,
+    // The certificate of the key it was issued for, until there is a new key
+    issued: Mutex<Option<(Arc<AttestedKey>, Arc<CertifiedKey>)>>,
+}
+
+impl AttestedCertResolver {
+    fn issue(&self, key: &AttestedKey) -> Result<Arc<CertifiedKey>> {
+        let (cert, private_key) =
+            x509::attested(&self.dns_names, &key.key, key.attestation.clone())?;
+        let signing_key = rustls::sign::any_supported_type(&PrivateKey(private_key))
+            .map_err(|_| anyhow!("attested key is not supported by rustls"))?;
+
+        Ok(Arc::new(CertifiedKey::new(
+            vec![Certificate(cert)],
+            signing_key,
+        )))
+    }
+}
+
+impl ResolvesServerCert for AttestedCertResolver {
+    fn resolve(&self, _client_hello: ClientHello) -> Option<Arc<CertifiedKey>> {
+        let key = (self.current)();
+
+        let mut issued = self.issued.lock().unwrap();
+        match *issued {
+            Some((ref issued_for, ref cert)) if Arc::ptr_eq(issued_for, &key) => Some(cert.clone()),
+            _ => match self.issue(&key) {
+                Ok(cert) => {
+                    *issued = Some((key, cert.clone()));
+                    Some(cert)
+                }
+                Err(err) => {
+                    error!("Failed to issue the attested certificate: {err}");
+                    None
+                }
+            },
+        }
+    }
+}
+
+// For TLS with a key that is only reachable through a Signer, as in a
+// CertifiedKey. RSA keys only sign with PKCS#1 v1.5, which limits them to
+// TLS 1.2.
+pub fn signing_key(signer: Arc<dyn Signer>) -> Arc<dyn SigningKey> {
+    Arc::new(TlsSigner(signer))
+}
+
+#[derive(Clone)]
+struct TlsSigner(Arc<dyn Signer>);
+
+impl TlsSigner {
+    fn tls_scheme(&self) -> SignatureScheme {
+        match self.0.key_type() {
+            KeyType::Rsa2048 => SignatureScheme::RSA_PKCS1_SHA256,
+            KeyType::EcdsaP384 => SignatureScheme::ECDSA_NISTP384_SHA384,
+            KeyType::Ed25519 => SignatureScheme::ED25519,
+        }
+    }
+}
+
+impl SigningKey for TlsSigner {
+    fn choose_scheme(&self, offered: &[SignatureScheme]) -> Option<Box<dyn rustls::sign::Signer>> {
+        offered
+            .contains(&self.tls_scheme())
+            .then(|| Box::new(self.clone()) as Box<dyn rustls::sign::Signer>)
+    }
+
+    fn algorithm(&self) -> SignatureAlgorithm {
+        match self.0.key_type() {
+            KeyType::Rsa2048 => SignatureAlgorithm::RSA,
+            KeyType::EcdsaP384 => SignatureAlgorithm::ECDSA,
+            KeyType::Ed25519 => SignatureAlgorithm::ED25519,
+        }
+    }
+}
+
+impl rustls::sign::Signer for TlsSigner {
+    fn sign(&self, message: &[u8]) -> Result<Vec<u8>, rustls::Error> {
+        self.0
+            .sign(message)
+            .map_err(|err| rustls::Error::General(err.to_string()))
+    }
+
+    fn scheme(&self) -> SignatureScheme {
+        self.tls_scheme()
+    }
+}
+
+// Checks that an attestation document is genuine, that it is of an enclave to
+// be trusted, and that it attests the given public key (a SubjectPublicKeyInfo,
+// in DER).
+pub trait AttestationVerifier: Send + Sync {
+    fn verify(&self, attestation: &[u8], public_key: &[u8]) -> Result<()>;
+}
+
+// Trusts the certificates of attested TLS servers, whatever their name, if the
+// verifier accepts the attestation document they embed. That the server holds
+// the attested key is then up to the handshake, as with any certificate.
+pub struct AttestedCertVerifier {
+    verifier: Arc<dyn AttestationVerifier>,
+}
+
+impl AttestedCertVerifier {
+    pub fn new(verifier: Arc<dyn AttestationVerifier>) -> Self {
+        Self { verifier }
+    }
+}
+
+impl ServerCertVerifier for AttestedCertVerifier {
+    fn verify_server_cert(
+        &self,
+        end_entity: &rustls::Certificate,
+        _intermediates: &[rustls::Certificate],
+        _server_name: &rustls::ServerName,
+        _scts: &mut dyn Iterator<Item = &[u8]>,
+        _ocsp: &[u8],
+        _now: std::time::SystemTime,
+    ) -> Result<ServerCertVerified, rustls::Error> {
+        let invalid = |msg: String| rustls::Error::InvalidCertificateData(msg);
+
+        let (public_key, attestation) =
+            x509::attested_public_key(&end_entity.0).map_err(|err| invalid(err.to_string()))?;
+        let attestation =
+            attestation.ok_or_else(|| invalid("certificate is not attested".to_string()))?;
+        self.verifier
+            .verify(&attestation, &public_key)
+            .map_err(|err| invalid(format!("attestation rejected: {err}")))?;
+
+        Ok(ServerCertVerified::assertion())
+    }
+}
+
+// For connecting to attested TLS servers, such as the enclave is over vsock
+pub fn attested_client_config(verifier: Arc<dyn AttestationVerifier>) -> Arc<ClientConfig> {
+    let mut cfg = ClientConfig::builder()
+        .with_safe_defaults()
+        .with_root_certificates(RootCertStore::empty())
+        .with_no_client_auth();
+
+    cfg.dangerous()
+        .set_certificate_verifier(Arc::new(AttestedCertVerifier::new(verifier)));
+
+    Arc::new(cfg)
+}
+
 #[cfg(test)]
 fn data_file(name: &str) -> Result<std::path::PathBuf> {
     let mut path = std::path::PathBuf::from(file!()).canonicalize()?;
@@ -95,3 +291,153 @@ fn data_file(name: &str) -> Result<std::path::PathBuf> {
 pub fn test_server_config() -> Result<Arc<ServerConfig>> {
     load_server_config(data_file("test.key")?, data_file("test.crt")?)
 }
+
+#[cfg(test)]
+mod tests {
+    use super::{
+        attested_client_config, attested_server_config, rotating_attested_server_config,
+        signing_key, AttestationVerifier,
+    };
+    use crate::keypair::{AttestedKey, KeyPair, KeyType};
+    use crate::vsock::{self, DialOptions, ListenConfig, VMADDR_CID_MEMORY};
+    use anyhow::{anyhow, Result};
+    use assert2::assert;
+    use futures::StreamExt;
+    use rustls::ServerName;
+    use std::convert::TryFrom;
+    use std::sync::{Arc, Mutex};
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    struct Expected {
+        attestation: Vec<u8>,
+        public_key: Vec<u8>,
+    }
+
+    impl AttestationVerifier for Expected {
+        fn verify(&self, attestation: &[u8], public_key: &[u8]) -> Result<()> {
+            if attestation != self.attestation || public_key != self.public_key {
+                return Err(anyhow!("not the expected enclave"));
+            }
+            Ok(())
+        }
+    }
+
+    #[tokio::test]
+    async fn test_attested_tls() {
+        let port = 17923;
+        let key = KeyPair::generate().unwrap();
+        let dns_names = vec!["enclave.local".to_string()];
+        let server_config = attested_server_config(&dns_names, &key, b"doc".to_vec()).unwrap();
+
+        let mut incoming = ListenConfig::new(port)
+            .with_cid(VMADDR_CID_MEMORY)
+            .tls_listen(server_config)
+            .unwrap();
+        let server_task = tokio::task::spawn(async move {
+            while let Some(mut tls) = incoming.next().await {
+                _ = tls.write_all(b"hello").await;
+            }
+        });
+
+        let connect = |attestation: &[u8]| {
+            let config = attested_client_config(Arc::new(Expected {
+                attestation: attestation.to_vec(),
+                public_key: key.public_key_as_der().unwrap(),
+            }));
+            let name = ServerName::try_from("enclave.local").unwrap();
+            async move {
+                let opts = DialOptions::default();
+                vsock::tls_connect(VMADDR_CID_MEMORY, port, name, config, &opts).await
+            }
+        };
+
+        let mut tls = connect(b"doc").await.unwrap();
+        let mut buf = [0u8; 5];
+        tls.read_exact(&mut buf).await.unwrap();
+        assert!(&buf == b"hello");
+
+        // Enclaves other than the expected one are not trusted
+        assert!(connect(b"other doc").await.is_err());
+
+        server_task.abort();
+    }
+
+    #[tokio::test]
+    async fn test_rotating_attested_tls() {
+        let port = 17926;
+        let attested = |doc: &[u8]| {
+            Arc::new(AttestedKey {
+                key: KeyPair::generate_with(KeyType::EcdsaP384).unwrap(),
+                attestation: doc.to_vec(),
+            })
+        };
+        let current = Arc::new(Mutex::new(attested(b"first")));
+        let server_current = current.clone();
+        let server_config =
+            rotating_attested_server_config(&["enclave.local".to_string()], move || {
+                server_current.lock().unwrap().clone()
+            });
+
+        let mut incoming = ListenConfig::new(port)
+            .with_cid(VMADDR_CID_MEMORY)
+            .tls_listen(server_config)
+            .unwrap();
+        let server_task = tokio::task::spawn(async move {
+            while let Some(mut tls) = incoming.next().await {
+                _ = tls.write_all(b"hello").await;
+            }
+        });
+
+        let connect = |key: &AttestedKey| {
+            let config = attested_client_config(Arc::new(Expected {
+                attestation: key.attestation.clone(),
+                public_key: key.key.public_key_as_der().unwrap(),
+            }));
+            let name = ServerName::try_from("enclave.local").unwrap();
+            async move {
+                let opts = DialOptions::default();
+                let mut tls =
+                    vsock::tls_connect(VMADDR_CID_MEMORY, port, name, config, &opts).await?;
+                let mut buf = [0u8; 5];
+                tls.read_exact(&mut buf).await?;
+                Ok::<_, std::io::Error>(buf)
+            }
+        };
+
+        let first = current.lock().unwrap().clone();
+        assert!(connect(&first).await.unwrap() == *b"hello");
+
+        // New handshakes get the certificate of the new key, and only that
+        let second = attested(b"second");
+        *current.lock().unwrap() = second.clone();
+        assert!(connect(&second).await.unwrap() == *b"hello");
+        assert!(connect(&first).await.is_err());
+
+        server_task.abort();
+    }
+
+    #[test]
+    fn test_signing_key() {
+        use rustls::{SignatureAlgorithm, SignatureScheme};
+
+        let key = KeyPair::generate_with(KeyType::Ed25519).unwrap();
+        let public_key = key.public_key_as_der().unwrap();
+        let signing_key = signing_key(Arc::new(key.seal()));
+        assert!(signing_key.algorithm() == SignatureAlgorithm::ED25519);
+        assert!(signing_key
+            .choose_scheme(&[SignatureScheme::RSA_PSS_SHA256])
+            .is_none());
+
+        let signer = signing_key
+            .choose_scheme(&[SignatureScheme::RSA_PSS_SHA256, SignatureScheme::ED25519])
+            .unwrap();
+        assert!(signer.scheme() == SignatureScheme::ED25519);
+
+        // The 32 bytes at the end of the SubjectPublicKeyInfo are the key
+        let signature = signer.sign(b"handshake").unwrap();
+        let point = &public_key[public_key.len() - 32..];
+        let verified = ring::signature::UnparsedPublicKey::new(&ring::signature::ED25519, point)
+            .verify(b"handshake", &signature);
+        assert!(verified.is_ok());
+    }
+}
@@ -0,0 +1,92 @@
+use anyhow::{anyhow, Result};
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+
+// The most the NSM takes for each field of an attestation request. It
+// answers InputTooLarge past these, which is checked for up front to fail
+// with a clearer error.
+pub const MAX_USER_DATA_LEN: usize = 512;
+pub const MAX_NONCE_LEN: usize = 512;
+pub const MAX_PUBLIC_KEY_LEN: usize = 1024;
+
+// The user data of attestation documents, encoded from and decoded into
+// structured values, so that apps and verifiers agree on what it holds
+// without making up a byte layout of their own. JSON is easier to inspect,
+// CBOR more compact.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Encoding {
+    Json,
+    Cbor,
+}
+
+pub fn encode<T: Serialize>(value: &T, encoding: Encoding) -> Result<Vec<u8>> {
+    let user_data = match encoding {
+        Encoding::Json => serde_json::to_vec(value)?,
+        Encoding::Cbor => serde_cbor::to_vec(value)?,
+    };
+
+    check_len("user_data", &user_data, MAX_USER_DATA_LEN)?;
+    Ok(user_data)
+}
+
+// For verifiers, once they verified the document the user data came in
+pub fn decode<T: DeserializeOwned>(user_data: &[u8], encoding: Encoding) -> Result<T> {
+    let value = match encoding {
+        Encoding::Json => serde_json::from_slice(user_data)?,
+        Encoding::Cbor => serde_cbor::from_slice(user_data)?,
+    };
+
+    Ok(value)
+}
+
+pub fn check_len(field: &str, data: &[u8], max: usize) -> Result<()> {
+    if data.len() > max {
+        return Err(anyhow!(
+            "{field} is {} bytes, more than the {max} the NSM takes",
+            data.len()
+        ));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{decode, encode, Encoding, MAX_USER_DATA_LEN};
+    use assert2::assert;
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Debug, PartialEq, Serialize, Deserialize)]
+    struct Claims {
+        config_hash: String,
+        version: u32,
+    }
+
+    #[test]
+    fn test_round_trip() {
+        let claims = Claims {
+            config_hash: "ab12".to_string(),
+            version: 3,
+        };
+
+        for encoding in [Encoding::Json, Encoding::Cbor] {
+            let user_data = encode(&claims, encoding).unwrap();
+            let decoded: Claims = decode(&user_data, encoding).unwrap();
+            assert!(decoded == claims);
+        }
+
+        let user_data = encode(&claims, Encoding::Json).unwrap();
+        assert!(user_data == br#"{"config_hash":"ab12","version":3}"#);
+        assert!(decode::<Claims>(&user_data, Encoding::Cbor).is_err());
+    }
+
+    #[test]
+    fn test_too_large() {
+        let claims = Claims {
+            config_hash: "a".repeat(MAX_USER_DATA_LEN),
+            version: 1,
+        };
+        let err = encode(&claims, Encoding::Cbor).unwrap_err();
+        assert!(err.to_string().contains("more than the 512"));
+    }
+}
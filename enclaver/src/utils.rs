@@ -7,7 +7,7 @@ use tokio::io::AsyncRead;
 use tokio::signal::unix::{signal, SignalKind};
 use tokio_util::codec::{FramedRead, LinesCodec};
 
-const LOG_LINE_MAX_LEN: usize = 4 * 1024;
+pub const LOG_LINE_MAX_LEN: usize = 4 * 1024;
 
 pub fn init_logging() {
     if std::env::var("RUST_LOG").is_err() {
@@ -0,0 +1,149 @@
+use std::io;
+use std::os::unix::io::{AsRawFd, RawFd};
+
+use log::debug;
+use nix::sys::socket::{
+    bind, recvfrom, sendto, socket, AddressFamily, MsgFlags, SockFlag, SockType, VsockAddr,
+};
+use tokio::io::unix::AsyncFd;
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio_util::codec::{Framed, LengthDelimitedCodec};
+
+use super::VMADDR_CID_ANY;
+
+// Datagrams over vsock, for relaying UDP and for telemetry that had rather
+// be dropped than held up. SOCK_DGRAM only exists on some vsock transports
+// (not that of Nitro Enclaves), so datagrams can also be carried over a
+// stream, each prefixed with its length.
+
+pub const MAX_DATAGRAM_LEN: usize = 65535;
+
+// Whether the vsock transport of this kernel carries datagrams, i.e. whether
+// DatagramSocket can be used rather than framed streams
+pub fn supported() -> bool {
+    match new_socket() {
+        Ok(_) => true,
+        Err(err) => {
+            debug!("vsock datagrams are not supported: {err}");
+            false
+        }
+    }
+}
+
+// Datagrams over a stream: the fallback where SOCK_DGRAM is not supported.
+// Both ends have to use it.
+pub fn framed<S: AsyncRead + AsyncWrite>(stream: S) -> Framed<S, LengthDelimitedCodec> {
+    LengthDelimitedCodec::builder()
+        .length_field_length(2)
+        .max_frame_length(MAX_DATAGRAM_LEN)
+        .new_framed(stream)
+}
+
+struct Fd(RawFd);
+
+impl AsRawFd for Fd {
+    fn as_raw_fd(&self) -> RawFd {
+        self.0
+    }
+}
+
+impl Drop for Fd {
+    fn drop(&mut self) {
+        _ = nix::unistd::close(self.0);
+    }
+}
+
+fn new_socket() -> io::Result<Fd> {
+    let fd = socket(
+        AddressFamily::Vsock,
+        SockType::Datagram,
+        SockFlag::SOCK_NONBLOCK | SockFlag::SOCK_CLOEXEC,
+        None,
+    )?;
+    Ok(Fd(fd))
+}
+
+// A SOCK_DGRAM vsock, bound to a port of its own
+pub struct DatagramSocket {
+    fd: AsyncFd<Fd>,
+}
+
+impl DatagramSocket {
+    pub fn bind(cid: u32, port: u32) -> io::Result<Self> {
+        let fd = new_socket()?;
+        bind(fd.0, &VsockAddr::new(cid, port))?;
+        Ok(Self {
+            fd: AsyncFd::new(fd)?,
+        })
+    }
+
+    pub async fn send_to(&self, buf: &[u8], cid: u32, port: u32) -> io::Result<usize> {
+        let addr = VsockAddr::new(cid, port);
+        loop {
+            let mut ready = self.fd.writable().await?;
+            match ready.try_io(|fd| Ok(sendto(fd.get_ref().0, buf, &addr, MsgFlags::empty())?)) {
+                Ok(res) => return res,
+                Err(_would_block) => continue,
+            }
+        }
+    }
+
+    // Returns the length of the datagram, along with the CID and port it
+    // was sent from
+    pub async fn recv_from(&self, buf: &mut [u8]) -> io::Result<(usize, u32, u32)> {
+        loop {
+            let mut ready = self.fd.readable().await?;
+            match ready.try_io(|fd| Ok(recvfrom::<VsockAddr>(fd.get_ref().0, buf)?)) {
+                Ok(res) => {
+                    let (n, from) = res?;
+                    let (cid, port) = from.map_or((VMADDR_CID_ANY, 0), |a| (a.cid(), a.port()));
+                    return Ok((n, cid, port));
+                }
+                Err(_would_block) => continue,
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{framed, supported, DatagramSocket};
+    use crate::vsock::VMADDR_CID_LOCAL;
+    use assert2::assert;
+    use bytes::Bytes;
+    use futures::{SinkExt, StreamExt};
+
+    #[tokio::test]
+    async fn test_framed() {
+        let (a, b) = tokio::io::duplex(1024);
+        let (mut a, mut b) = (framed(a), framed(b));
+
+        a.send(Bytes::from_static(b"one")).await.unwrap();
+        a.send(Bytes::from_static(b"two")).await.unwrap();
+
+        // Datagrams keep their boundaries
+        assert!(&b.next().await.unwrap().unwrap()[..] == b"one");
+        assert!(&b.next().await.unwrap().unwrap()[..] == b"two");
+    }
+
+    #[tokio::test]
+    #[ignore = "needs vsock_loopback"]
+    async fn test_datagram_socket() {
+        // Not on the transports most CI runs on
+        if !supported() {
+            return;
+        }
+
+        let port = 17925;
+        let socket = DatagramSocket::bind(VMADDR_CID_LOCAL, port).unwrap();
+        socket
+            .send_to(b"ping", VMADDR_CID_LOCAL, port)
+            .await
+            .unwrap();
+
+        let mut buf = [0u8; 16];
+        let (n, _, from_port) = socket.recv_from(&mut buf).await.unwrap();
+        assert!(&buf[..n] == b"ping");
+        assert!(from_port == port);
+    }
+}
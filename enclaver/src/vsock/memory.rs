@@ -0,0 +1,71 @@
+use std::collections::HashMap;
+use std::io;
+use std::sync::atomic::{AtomicU32, Ordering};
+use std::sync::Mutex;
+
+use futures::Stream;
+use lazy_static::lazy_static;
+use tokio::io::DuplexStream;
+use tokio::sync::mpsc;
+
+// Connections to VMADDR_CID_MEMORY never leave the process: each is a pair of
+// in-memory pipes, handed to whoever listens on its port. This lets the
+// proxies, heartbeats and RPC be tested end to end where there is no vsock
+// at all, as in containers and CI.
+
+// Bytes in flight either way, before writes wait for the reader
+const BUFFER_LEN: usize = 64 * 1024;
+
+// Connections waiting to be taken off a listener
+const ACCEPT_QUEUE_LEN: usize = 128;
+
+// Where the ports of dialled connections start, as do those Linux picks
+const EPHEMERAL_PORTS_START: u32 = 49152;
+
+// Each connection along with the port it was dialled from
+type Accepted = (DuplexStream, u32);
+
+lazy_static! {
+    static ref LISTENERS: Mutex<HashMap<u32, mpsc::Sender<Accepted>>> = Mutex::new(HashMap::new());
+}
+
+static NEXT_PORT: AtomicU32 = AtomicU32::new(EPHEMERAL_PORTS_START);
+
+// The connections made to port, and the ports they were dialled from, until
+// the stream is dropped. Only one stream may listen on a port at a time, as
+// with vsock.
+pub(super) fn listen(port: u32) -> io::Result<impl Stream<Item = Accepted> + Send> {
+    let (tx, rx) = mpsc::channel(ACCEPT_QUEUE_LEN);
+
+    let mut listeners = LISTENERS.lock().unwrap();
+    if listeners.get(&port).map_or(false, |tx| !tx.is_closed()) {
+        return Err(io::Error::new(
+            io::ErrorKind::AddrInUse,
+            format!("memory vsock port {port} is in use"),
+        ));
+    }
+    listeners.insert(port, tx);
+
+    Ok(futures::stream::unfold(rx, |mut rx| async move {
+        let accepted = rx.recv().await?;
+        Some((accepted, rx))
+    }))
+}
+
+// Returns the connection along with the port it was dialled from
+pub(super) fn connect(port: u32) -> io::Result<(DuplexStream, u32)> {
+    let refused = || {
+        io::Error::new(
+            io::ErrorKind::ConnectionRefused,
+            format!("nothing listens on memory vsock port {port}"),
+        )
+    };
+
+    let tx = LISTENERS.lock().unwrap().get(&port).cloned();
+    let tx = tx.ok_or_else(refused)?;
+
+    let (client, server) = tokio::io::duplex(BUFFER_LEN);
+    let local_port = NEXT_PORT.fetch_add(1, Ordering::Relaxed);
+    tx.try_send((server, local_port)).map_err(|_| refused())?;
+    Ok((client, local_port))
+}
@@ -0,0 +1,525 @@
+use anyhow::Result;
+use futures::{Stream, StreamExt};
+use log::{debug, error, info};
+use nix::sys::socket::{getpeername, getsockname, VsockAddr};
+use rustls::client::ServerName;
+use rustls::{ClientConfig, ServerConfig};
+use std::fmt;
+use std::io;
+use std::os::unix::io::AsRawFd;
+use std::pin::Pin;
+use std::sync::atomic::{AtomicU32, Ordering};
+use std::sync::Arc;
+use std::task::{Context, Poll};
+use std::time::Duration;
+use tokio::io::{AsyncRead, AsyncWrite, DuplexStream, ReadBuf};
+use tokio::sync::mpsc::{self, error::TrySendError};
+use tokio_rustls::{TlsAcceptor, TlsConnector};
+use tokio_util::sync::CancellationToken;
+use tokio_vsock::{VsockListener, VsockStream};
+
+use crate::metrics::{self, VsockConnMetrics};
+
+pub mod datagram;
+mod memory;
+pub mod reconnect;
+
+pub const VMADDR_CID_ANY: u32 = 0xFFFFFFFF;
+pub const VMADDR_CID_LOCAL: u32 = 1;
+pub const VMADDR_CID_HOST: u32 = 2;
+
+// Not a CID vsock knows of: listening on and connecting to it stays within
+// the process, for tests.
+pub const VMADDR_CID_MEMORY: u32 = 0xFFFFFFFE;
+
+static HOST_CID: AtomicU32 = AtomicU32::new(VMADDR_CID_HOST);
+
+// The CID the enclave dials the wrapper at. VMADDR_CID_HOST, but for an
+// enclave simulated on the host itself, which reaches the wrapper over
+// vsock loopback at VMADDR_CID_LOCAL.
+pub fn host_cid() -> u32 {
+    HOST_CID.load(Ordering::Relaxed)
+}
+
+pub fn set_host_cid(cid: u32) {
+    HOST_CID.store(cid, Ordering::Relaxed);
+}
+
+pub type TlsServerStream = tokio_rustls::server::TlsStream<Connection>;
+pub type TlsClientStream = tokio_rustls::client::TlsStream<Connection>;
+
+// One end of a vsock connection
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct Addr {
+    pub cid: u32,
+    pub port: u32,
+}
+
+impl Addr {
+    pub fn new(cid: u32, port: u32) -> Self {
+        Self { cid, port }
+    }
+}
+
+impl From<VsockAddr> for Addr {
+    fn from(addr: VsockAddr) -> Self {
+        Self::new(addr.cid(), addr.port())
+    }
+}
+
+impl fmt::Display for Addr {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "vsock:{}:{}", self.cid, self.port)
+    }
+}
+
+// A vsock connection that keeps count of the bytes sent and received over it,
+// and of how long it stays open, under the port listened on. On hosts running
+// several enclaves, its addresses tell which enclave it belongs to.
+pub struct Connection {
+    stream: Transport,
+    local: Addr,
+    peer: Addr,
+    metrics: VsockConnMetrics,
+}
+
+enum Transport {
+    Vsock(VsockStream),
+    Memory(DuplexStream),
+}
+
+// A connection accepted, along with its local and peer addresses
+type Accepted = (Transport, Addr, Addr);
+
+impl Connection {
+    fn accepted((stream, local, peer): Accepted) -> Self {
+        Self::new(stream, local, peer, local.port, "accepted")
+    }
+
+    fn dialed(stream: Transport, local: Addr, peer: Addr) -> Self {
+        Self::new(stream, local, peer, peer.port, "dialed")
+    }
+
+    fn new(stream: Transport, local: Addr, peer: Addr, port: u32, side: &'static str) -> Self {
+        Self {
+            stream,
+            local,
+            peer,
+            metrics: metrics::PROXY.vsock_connection(port, side),
+        }
+    }
+
+    pub fn local_addr(&self) -> Addr {
+        self.local
+    }
+
+    pub fn peer_addr(&self) -> Addr {
+        self.peer
+    }
+}
+
+// The addresses the kernel has for both ends of a vsock
+fn vsock_addrs(vsock: &VsockStream) -> io::Result<(Addr, Addr)> {
+    let fd = vsock.as_raw_fd();
+    let local: VsockAddr = getsockname(fd)?;
+    let peer: VsockAddr = getpeername(fd)?;
+    Ok((local.into(), peer.into()))
+}
+
+impl AsyncRead for Connection {
+    fn poll_read(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let filled = buf.filled().len();
+        let res = match self.stream {
+            Transport::Vsock(ref mut s) => Pin::new(s).poll_read(cx, buf),
+            Transport::Memory(ref mut s) => Pin::new(s).poll_read(cx, buf),
+        };
+        if let Poll::Ready(Ok(())) = res {
+            self.metrics
+                .received
+                .add((buf.filled().len() - filled) as u64);
+        }
+        res
+    }
+}
+
+impl AsyncWrite for Connection {
+    fn poll_write(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let res = match self.stream {
+            Transport::Vsock(ref mut s) => Pin::new(s).poll_write(cx, buf),
+            Transport::Memory(ref mut s) => Pin::new(s).poll_write(cx, buf),
+        };
+        if let Poll::Ready(Ok(n)) = res {
+            self.metrics.sent.add(n as u64);
+        }
+        res
+    }
+
+    fn poll_flush(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        match self.stream {
+            Transport::Vsock(ref mut s) => Pin::new(s).poll_flush(cx),
+            Transport::Memory(ref mut s) => Pin::new(s).poll_flush(cx),
+        }
+    }
+
+    fn poll_shutdown(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        match self.stream {
+            Transport::Vsock(ref mut s) => Pin::new(s).poll_shutdown(cx),
+            Transport::Memory(ref mut s) => Pin::new(s).poll_shutdown(cx),
+        }
+    }
+}
+
+// How long connecting may take, and what may cut it short. Neither, by default.
+#[derive(Debug, Clone, Default)]
+pub struct DialOptions {
+    pub timeout: Option<Duration>,
+    pub cancellation: Option<CancellationToken>,
+}
+
+impl DialOptions {
+    pub fn with_timeout(mut self, timeout: Duration) -> Self {
+        self.timeout = Some(timeout);
+        self
+    }
+
+    pub fn with_cancellation(mut self, cancellation: CancellationToken) -> Self {
+        self.cancellation = Some(cancellation);
+        self
+    }
+}
+
+// Connect to the given port of cid, giving up once the timeout expires or the
+// cancellation token is cancelled.
+pub async fn connect(cid: u32, port: u32, opts: &DialOptions) -> io::Result<Connection> {
+    let (stream, local) = metrics::PROXY
+        .vsock_dial(port, dial(cid, port, opts))
+        .await?;
+    Ok(Connection::dialed(stream, local, Addr::new(cid, port)))
+}
+
+// Returns the connection along with its local address
+async fn dial(cid: u32, port: u32, opts: &DialOptions) -> io::Result<(Transport, Addr)> {
+    if cid == VMADDR_CID_MEMORY {
+        let (stream, local_port) = memory::connect(port)?;
+        return Ok((
+            Transport::Memory(stream),
+            Addr::new(VMADDR_CID_MEMORY, local_port),
+        ));
+    }
+
+    let connect = async {
+        match opts.timeout {
+            Some(timeout) => {
+                match tokio::time::timeout(timeout, VsockStream::connect(cid, port)).await {
+                    Ok(res) => res,
+                    Err(_) => Err(io::Error::new(
+                        io::ErrorKind::TimedOut,
+                        format!("vsock connect to {cid}:{port} timed out after {timeout:?}"),
+                    )),
+                }
+            }
+            None => VsockStream::connect(cid, port).await,
+        }
+    };
+
+    match opts.cancellation {
+        // Cancellation wins, so that nothing is dialled once cancelled
+        Some(ref cancellation) => tokio::select! {
+            biased;
+            _ = cancellation.cancelled() => Err(io::Error::new(
+                io::ErrorKind::ConnectionAborted,
+                format!("vsock connect to {cid}:{port} cancelled"),
+            )),
+            res = connect => res,
+        },
+        None => connect.await,
+    }
+    .map(|vsock| {
+        let local = match vsock_addrs(&vsock) {
+            Ok((local, _)) => local,
+            Err(_) => Addr::new(VMADDR_CID_ANY, 0),
+        };
+        (Transport::Vsock(vsock), local)
+    })
+}
+
+pub async fn tls_connect(
+    cid: u32,
+    port: u32,
+    name: ServerName,
+    tls_config: Arc<ClientConfig>,
+    opts: &DialOptions,
+) -> Result<TlsClientStream> {
+    let stream = connect(cid, port, opts).await?;
+    let connector = TlsConnector::from(tls_config);
+    let tls_stream = connector.connect(name, stream).await?;
+    Ok(tls_stream)
+}
+
+// Where to listen, and until when. The streams of connections listen and
+// tls_listen return end once the cancellation token is cancelled, closing the
+// listener. Connections are accepted whatever CID they are addressed to,
+// unless a local CID is given. VMADDR_CID_MEMORY only accepts those made to
+// it from within the process.
+//
+// With a backlog, connections are accepted as soon as they arrive and queued
+// until taken off the stream. Those that arrive while the queue is full are
+// closed right away, rather than have them pile up behind a consumer that is
+// overloaded already.
+pub struct ListenConfig {
+    cid: u32,
+    port: u32,
+    backlog: Option<usize>,
+    cancellation: Option<CancellationToken>,
+}
+
+type Incoming = Pin<Box<dyn Stream<Item = Connection> + Send>>;
+
+impl ListenConfig {
+    pub fn new(port: u32) -> Self {
+        Self {
+            cid: VMADDR_CID_ANY,
+            port,
+            backlog: None,
+            cancellation: None,
+        }
+    }
+
+    pub fn with_cid(mut self, cid: u32) -> Self {
+        self.cid = cid;
+        self
+    }
+
+    pub fn with_backlog(mut self, backlog: usize) -> Self {
+        self.backlog = Some(backlog.max(1));
+        self
+    }
+
+    pub fn with_cancellation(mut self, cancellation: CancellationToken) -> Self {
+        self.cancellation = Some(cancellation);
+        self
+    }
+
+    // Returns a Stream of connected sockets.
+    pub fn listen(self) -> Result<impl Stream<Item = Connection> + Unpin> {
+        let incoming = self.incoming()?;
+        info!("Listening on vsock port {}", self.port);
+
+        Ok(incoming.take_until(self.cancelled()))
+    }
+
+    // Returns a Stream of TLS connected sockets.
+    pub fn tls_listen(
+        self,
+        tls_config: Arc<ServerConfig>,
+    ) -> Result<impl Stream<Item = TlsServerStream>> {
+        let acceptor = TlsAcceptor::from(tls_config);
+        let incoming = self.incoming()?;
+        info!("Listening on TLS vsock port {}", self.port);
+
+        let stream = incoming.filter_map(move |vsock| {
+            let acceptor = acceptor.clone();
+            async move {
+                match acceptor.accept(vsock).await {
+                    Ok(vsock) => Some(vsock),
+                    Err(err) => {
+                        error!("TLS handshake failed: {err}");
+                        None
+                    }
+                }
+            }
+        });
+
+        Ok(stream.take_until(self.cancelled()))
+    }
+
+    fn accepted(&self) -> Result<Pin<Box<dyn Stream<Item = Accepted> + Send>>> {
+        let (cid, port) = (self.cid, self.port);
+        if cid == VMADDR_CID_MEMORY {
+            return Ok(Box::pin(memory::listen(port)?.map(
+                move |(stream, peer_port)| {
+                    (
+                        Transport::Memory(stream),
+                        Addr::new(cid, port),
+                        Addr::new(cid, peer_port),
+                    )
+                },
+            )));
+        }
+
+        let listener = VsockListener::bind(cid, port)?;
+        Ok(Box::pin(listener.incoming().filter_map(move |result| {
+            futures::future::ready(match result {
+                Ok(vsock) => {
+                    let (local, peer) = vsock_addrs(&vsock)
+                        .unwrap_or((Addr::new(cid, port), Addr::new(VMADDR_CID_ANY, 0)));
+                    debug!("Connection accepted on port {port} from {peer}");
+                    Some((Transport::Vsock(vsock), local, peer))
+                }
+
+                Err(err) => {
+                    error!("Failed to accept a vsock: {err}");
+                    None
+                }
+            })
+        })))
+    }
+
+    fn incoming(&self) -> Result<Incoming> {
+        let port = self.port;
+        let mut accepted = self.accepted()?;
+
+        let backlog = match self.backlog {
+            Some(backlog) => backlog,
+            None => return Ok(Box::pin(accepted.map(Connection::accepted))),
+        };
+
+        let (tx, rx) = mpsc::channel(backlog);
+        let queued = metrics::PROXY.vsock_accept_queue(port);
+
+        // Until the stream of queued connections is dropped
+        let accept_queued = queued.clone();
+        tokio::task::spawn(async move {
+            loop {
+                let vsock = tokio::select! {
+                    _ = tx.closed() => return,
+                    vsock = accepted.next() => match vsock {
+                        Some(vsock) => vsock,
+                        None => return,
+                    },
+                };
+
+                match tx.try_reserve() {
+                    Ok(permit) => {
+                        accept_queued.inc();
+                        permit.send(Connection::accepted(vsock));
+                    }
+                    Err(TrySendError::Full(())) => {
+                        metrics::PROXY.vsock_shed(port);
+                        debug!("Accept queue of port {port} is full, closed a connection");
+                    }
+                    Err(TrySendError::Closed(())) => return,
+                }
+            }
+        });
+
+        Ok(Box::pin(futures::stream::unfold(rx, move |mut rx| {
+            let queued = queued.clone();
+            async move {
+                let vsock = rx.recv().await?;
+                queued.dec();
+                Some((vsock, rx))
+            }
+        })))
+    }
+
+    // Never completes without a cancellation token
+    fn cancelled(self) -> Pin<Box<dyn std::future::Future<Output = ()> + Send>> {
+        match self.cancellation {
+            Some(cancellation) => Box::pin(async move { cancellation.cancelled().await }),
+            None => Box::pin(std::future::pending()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{connect, DialOptions, ListenConfig, VMADDR_CID_LOCAL, VMADDR_CID_MEMORY};
+    use assert2::assert;
+    use futures::StreamExt;
+    use std::io::ErrorKind;
+    use std::time::Duration;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio_util::sync::CancellationToken;
+
+    #[tokio::test]
+    #[ignore = "needs vsock_loopback"]
+    async fn test_listen_local_cid() {
+        let port = 17920;
+        let cancellation = CancellationToken::new();
+        let mut incoming = ListenConfig::new(port)
+            .with_cid(VMADDR_CID_LOCAL)
+            .with_cancellation(cancellation.clone())
+            .listen()
+            .unwrap();
+
+        let opts = DialOptions::default().with_timeout(Duration::from_secs(1));
+        let (client, accepted) =
+            tokio::join!(connect(VMADDR_CID_LOCAL, port, &opts), incoming.next());
+        assert!(client.is_ok());
+        assert!(accepted.is_some());
+
+        // Cancelling ends the stream of connections
+        cancellation.cancel();
+        assert!(incoming.next().await.is_none());
+
+        // as it does connects that have yet to complete
+        let cancelled = CancellationToken::new();
+        cancelled.cancel();
+        let opts = DialOptions::default().with_cancellation(cancelled);
+        let err = connect(VMADDR_CID_LOCAL, port + 1, &opts)
+            .await
+            .unwrap_err();
+        assert!(err.kind() == std::io::ErrorKind::ConnectionAborted);
+    }
+
+    #[tokio::test]
+    #[ignore = "needs vsock_loopback"]
+    async fn test_backlog() {
+        let port = 17921;
+        let mut incoming = ListenConfig::new(port)
+            .with_cid(VMADDR_CID_LOCAL)
+            .with_backlog(1)
+            .listen()
+            .unwrap();
+
+        let opts = DialOptions::default().with_timeout(Duration::from_secs(1));
+        let _queued = connect(VMADDR_CID_LOCAL, port, &opts).await.unwrap();
+
+        // Closed as soon as accepted, the queue being full
+        let mut shed = connect(VMADDR_CID_LOCAL, port, &opts).await.unwrap();
+        let mut buf = [0u8; 1];
+        let read = tokio::time::timeout(Duration::from_secs(1), shed.read(&mut buf))
+            .await
+            .expect("connection was not closed");
+        assert!(matches!(read, Ok(0) | Err(_)));
+
+        assert!(incoming.next().await.is_some());
+    }
+
+    #[tokio::test]
+    async fn test_memory() {
+        let port = 17922;
+        let opts = DialOptions::default();
+        let err = connect(VMADDR_CID_MEMORY, port, &opts).await.unwrap_err();
+        assert!(err.kind() == ErrorKind::ConnectionRefused);
+
+        let listen = || ListenConfig::new(port).with_cid(VMADDR_CID_MEMORY).listen();
+        let mut incoming = listen().unwrap();
+        assert!(listen().is_err());
+
+        let mut client = connect(VMADDR_CID_MEMORY, port, &opts).await.unwrap();
+        let mut server = incoming.next().await.unwrap();
+        client.write_all(b"ping").await.unwrap();
+        let mut buf = [0u8; 4];
+        server.read_exact(&mut buf).await.unwrap();
+        assert!(&buf == b"ping");
+        assert!(client.peer_addr() == server.local_addr());
+        assert!(server.peer_addr() == client.local_addr());
+        assert!(server.local_addr().port == port);
+
+        // The port is free again once the listener is dropped
+        drop(incoming);
+        let err = connect(VMADDR_CID_MEMORY, port, &opts).await.unwrap_err();
+        assert!(err.kind() == ErrorKind::ConnectionRefused);
+        assert!(listen().is_ok());
+    }
+}
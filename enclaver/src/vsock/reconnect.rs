@@ -0,0 +1,228 @@
+use std::io;
+use std::time::Duration;
+
+use rand::Rng;
+
+use super::{connect, Connection, DialOptions};
+
+const DEFAULT_INITIAL_BACKOFF: Duration = Duration::from_millis(250);
+const DEFAULT_MAX_BACKOFF: Duration = Duration::from_secs(10);
+
+// Each wait is off by up to this much either way, so that clients that lost
+// their connections at once do not all retry at once
+const JITTER: f64 = 0.25;
+
+// How long to wait before the next attempt: doubling from initial up to max,
+// and back to initial once reset.
+#[derive(Debug, Clone)]
+pub struct Backoff {
+    initial: Duration,
+    max: Duration,
+    next: Duration,
+}
+
+impl Backoff {
+    pub fn new(initial: Duration, max: Duration) -> Self {
+        Self {
+            initial,
+            max: max.max(initial),
+            next: initial,
+        }
+    }
+
+    pub fn next(&mut self) -> Duration {
+        let backoff = self.next;
+        self.next = (self.next * 2).min(self.max);
+        backoff.mul_f64(rand::thread_rng().gen_range(1.0 - JITTER..=1.0 + JITTER))
+    }
+
+    pub fn reset(&mut self) {
+        self.next = self.initial;
+    }
+}
+
+impl Default for Backoff {
+    fn default() -> Self {
+        Self::new(DEFAULT_INITIAL_BACKOFF, DEFAULT_MAX_BACKOFF)
+    }
+}
+
+// What became of the connection of a Reconnector, as told to on_event
+#[derive(Debug)]
+pub enum Event<'a> {
+    Connected {
+        attempts: u32,
+    },
+    Failed {
+        attempt: u32,
+        err: &'a io::Error,
+        retry_in: Duration,
+    },
+    // The connection handed out last was given up on, and is to be replaced
+    Lost,
+}
+
+type OnEvent = Box<dyn Fn(Event) + Send + Sync>;
+
+// Hands out connections to a port, dialling again for as long as it takes,
+// for clients that have to outlive the enclave they talk to restarting.
+pub struct Reconnector {
+    cid: u32,
+    port: u32,
+    opts: DialOptions,
+    backoff: Backoff,
+    on_event: Option<OnEvent>,
+    connected: bool,
+}
+
+impl Reconnector {
+    pub fn new(cid: u32, port: u32) -> Self {
+        Self {
+            cid,
+            port,
+            opts: DialOptions::default(),
+            backoff: Backoff::default(),
+            on_event: None,
+            connected: false,
+        }
+    }
+
+    // For each attempt. Cancelling the token makes connect give up.
+    pub fn with_dial_options(mut self, opts: DialOptions) -> Self {
+        self.opts = opts;
+        self
+    }
+
+    pub fn with_backoff(mut self, backoff: Backoff) -> Self {
+        self.backoff = backoff;
+        self
+    }
+
+    pub fn on_event<F>(mut self, on_event: F) -> Self
+    where
+        F: Fn(Event) + Send + Sync + 'static,
+    {
+        self.on_event = Some(Box::new(on_event));
+        self
+    }
+
+    // A new connection, once one could be made. To be called again whenever
+    // the one it returned is lost. Only fails once cancelled.
+    pub async fn connect(&mut self) -> io::Result<Connection> {
+        if std::mem::take(&mut self.connected) {
+            self.emit(Event::Lost);
+        }
+
+        let mut attempt = 1;
+        loop {
+            let err = match connect(self.cid, self.port, &self.opts).await {
+                Ok(conn) => {
+                    self.connected = true;
+                    self.backoff.reset();
+                    self.emit(Event::Connected { attempts: attempt });
+                    return Ok(conn);
+                }
+                Err(err) if self.cancelled() => return Err(err),
+                Err(err) => err,
+            };
+
+            let retry_in = self.backoff.next();
+            self.emit(Event::Failed {
+                attempt,
+                err: &err,
+                retry_in,
+            });
+
+            match self.opts.cancellation {
+                Some(ref cancellation) => tokio::select! {
+                    _ = cancellation.cancelled() => return Err(err),
+                    _ = tokio::time::sleep(retry_in) => {},
+                },
+                None => tokio::time::sleep(retry_in).await,
+            }
+            attempt += 1;
+        }
+    }
+
+    fn cancelled(&self) -> bool {
+        self.opts
+            .cancellation
+            .as_ref()
+            .map_or(false, |cancellation| cancellation.is_cancelled())
+    }
+
+    fn emit(&self, event: Event) {
+        if let Some(ref on_event) = self.on_event {
+            on_event(event);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{Backoff, Event, Reconnector};
+    use crate::vsock::{ListenConfig, VMADDR_CID_MEMORY};
+    use assert2::assert;
+    use futures::StreamExt;
+    use std::sync::{Arc, Mutex};
+    use std::time::Duration;
+
+    #[test]
+    fn test_backoff() {
+        let mut backoff = Backoff::new(Duration::from_millis(100), Duration::from_millis(400));
+        let waits: Vec<Duration> = (0..4).map(|_| backoff.next()).collect();
+        for (wait, expected) in waits.iter().zip([100, 200, 400, 400]) {
+            assert!(*wait >= Duration::from_millis(expected * 3 / 4));
+            assert!(*wait <= Duration::from_millis(expected * 5 / 4));
+        }
+
+        backoff.reset();
+        assert!(backoff.next() <= Duration::from_millis(125));
+    }
+
+    #[tokio::test]
+    async fn test_reconnect() {
+        let port = 17924;
+        let events = Arc::new(Mutex::new(Vec::new()));
+        let seen = events.clone();
+        let mut reconnector = Reconnector::new(VMADDR_CID_MEMORY, port)
+            .with_backoff(Backoff::new(
+                Duration::from_millis(10),
+                Duration::from_millis(10),
+            ))
+            .on_event(move |event| {
+                let event = match event {
+                    Event::Connected { attempts } => format!("connected after {attempts}"),
+                    Event::Failed { attempt, .. } => format!("failed {attempt}"),
+                    Event::Lost => "lost".to_string(),
+                };
+                seen.lock().unwrap().push(event);
+            });
+
+        // Nothing listens until a little later, as while an enclave boots
+        let listener = tokio::task::spawn(async move {
+            tokio::time::sleep(Duration::from_millis(25)).await;
+            let mut incoming = ListenConfig::new(port)
+                .with_cid(VMADDR_CID_MEMORY)
+                .listen()
+                .unwrap();
+            while let Some(conn) = incoming.next().await {
+                drop(conn);
+            }
+        });
+
+        let conn = reconnector.connect().await.unwrap();
+        drop(conn);
+        let _conn = reconnector.connect().await.unwrap();
+
+        // Retried until the listener was up, and again once the connection
+        // was lost
+        let events = events.lock().unwrap().clone();
+        let n = events.len();
+        assert!(events[0] == "failed 1");
+        assert!(events[n - 3] == format!("connected after {}", n - 2));
+        assert!(events[n - 2..] == ["lost", "connected after 1"]);
+
+        listener.abort();
+    }
+}
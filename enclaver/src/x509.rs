@@ -0,0 +1,668 @@
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, Result};
+
+use crate::access_log::CivilTime;
+use crate::keypair::{KeyPair, KeyType};
+
+// sha256WithRSAEncryption, ecdsa-with-SHA384 and id-Ed25519, as signed by
+// KeyPair::sign()
+const OID_SHA256_WITH_RSA: &[u128] = &[1, 2, 840, 113549, 1, 1, 11];
+const OID_ECDSA_WITH_SHA384: &[u128] = &[1, 2, 840, 10045, 4, 3, 3];
+const OID_ED25519: &[u128] = &[1, 3, 101, 112];
+const OID_COMMON_NAME: &[u128] = &[2, 5, 4, 3];
+const OID_COUNTRY: &[u128] = &[2, 5, 4, 6];
+const OID_LOCALITY: &[u128] = &[2, 5, 4, 7];
+const OID_STATE: &[u128] = &[2, 5, 4, 8];
+const OID_ORGANIZATION: &[u128] = &[2, 5, 4, 10];
+const OID_ORGANIZATIONAL_UNIT: &[u128] = &[2, 5, 4, 11];
+const OID_SUBJECT_KEY_IDENTIFIER: &[u128] = &[2, 5, 29, 14];
+const OID_SUBJECT_ALT_NAME: &[u128] = &[2, 5, 29, 17];
+const OID_BASIC_CONSTRAINTS: &[u128] = &[2, 5, 29, 19];
+
+// The attestation document of the enclave that holds the key of the
+// certificate. A UUID based OID (ITU-T X.667), as there is no registered one.
+pub const OID_NITRO_ATTESTATION: &[u128] = &[2, 25, 43412261988517349903502577750995725319];
+
+const ATTESTED_CERT_VALIDITY: Duration = Duration::from_secs(365 * 24 * 60 * 60);
+
+// Leeway for clients with clocks running behind
+const ATTESTED_CERT_BACKDATE: Duration = Duration::from_secs(60 * 60);
+
+pub struct Extension {
+    pub oid: &'static [u128],
+    pub critical: bool,
+    pub value: Vec<u8>,
+}
+
+// What people want to know of a certificate, e.g. in an attestation document
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CertificateInfo {
+    pub subject: String,
+    pub issuer: String,
+    // In RFC 3339
+    pub not_before: String,
+    pub not_after: String,
+}
+
+pub struct CertificateParams {
+    pub common_name: String,
+    pub dns_names: Vec<String>,
+    pub not_before: SystemTime,
+    pub not_after: SystemTime,
+    pub extensions: Vec<Extension>,
+}
+
+// Marks a certificate as that of a certificate authority, which may issue
+// certificates for others.
+pub fn ca_extension() -> Extension {
+    Extension {
+        oid: OID_BASIC_CONSTRAINTS,
+        critical: true,
+        value: der::sequence(&[der::boolean(true)]),
+    }
+}
+
+// A self-signed certificate for the key pair, in DER, along with the private
+// key in PKCS#8 DER (as expected by rustls).
+pub fn self_signed(params: &CertificateParams, key: &KeyPair) -> Result<(Vec<u8>, Vec<u8>)> {
+    issue(params, key, &params.common_name, key)
+}
+
+// A certificate for the key pair, signed by the issuer with the given common
+// name, and the private key of the subject as with self_signed().
+pub fn issue(
+    params: &CertificateParams,
+    key: &KeyPair,
+    issuer_name: &str,
+    issuer_key: &KeyPair,
+) -> Result<(Vec<u8>, Vec<u8>)> {
+    let algorithm = signature_algorithm(issuer_key.key_type());
+    let subject = distinguished_name(&params.common_name);
+
+    let mut extensions = Vec::new();
+    if !params.dns_names.is_empty() {
+        let names: Vec<Vec<u8>> = params
+            .dns_names
+            .iter()
+            .map(|name| der::tlv(der::TAG_DNS_NAME, name.as_bytes()))
+            .collect();
+        extensions.push(extension(
+            OID_SUBJECT_ALT_NAME,
+            false,
+            &der::sequence(&names),
+        ));
+    }
+    for ext in &params.extensions {
+        extensions.push(extension(ext.oid, ext.critical, &ext.value));
+    }
+
+    let tbs = der::sequence(&[
+        // v3
+        der::explicit(0, &der::integer(&[2])),
+        der::integer(&rand::random::<[u8; 16]>()),
+        algorithm.clone(),
+        distinguished_name(issuer_name),
+        der::sequence(&[der::time(params.not_before), der::time(params.not_after)]),
+        subject,
+        key.public_key_as_der()?,
+        der::explicit(3, &der::sequence(&extensions)),
+    ]);
+
+    let signature = issuer_key.sign(&tbs)?;
+
+    let cert = der::sequence(&[tbs, algorithm, der::bit_string(&signature)]);
+    let private_key = key.private_key_as_der()?;
+
+    Ok((cert, private_key))
+}
+
+// A self-signed certificate for a key that never leaves the enclave, for
+// names to be served over TLS, and its private key as with self_signed(). The
+// certificate embeds the attestation document of the key, which is what
+// clients verify instead of a CA signature: the identity of the server is
+// that of the enclave measured.
+pub fn attested(
+    dns_names: &[String],
+    key: &KeyPair,
+    attestation: Vec<u8>,
+) -> Result<(Vec<u8>, Vec<u8>)> {
+    let now = SystemTime::now();
+    let params = CertificateParams {
+        common_name: dns_names
+            .first()
+            .cloned()
+            .unwrap_or_else(|| "localhost".to_string()),
+        dns_names: dns_names.to_vec(),
+        not_before: now - ATTESTED_CERT_BACKDATE,
+        not_after: now + ATTESTED_CERT_VALIDITY,
+        extensions: vec![Extension {
+            oid: OID_NITRO_ATTESTATION,
+            critical: false,
+            value: attestation,
+        }],
+    };
+
+    self_signed(&params, key)
+}
+
+// In PEM, the way most tools expect certificates on disk
+pub fn pem(label: &str, der: &[u8]) -> String {
+    let mut out = format!("-----BEGIN {label}-----\n");
+    for line in base64::encode(der).as_bytes().chunks(64) {
+        out.push_str(&String::from_utf8_lossy(line));
+        out.push('\n');
+    }
+    out.push_str(&format!("-----END {label}-----\n"));
+    out
+}
+
+// The public key of a certificate (its SubjectPublicKeyInfo, in DER) and the
+// attestation document it embeds, if any
+pub fn attested_public_key(cert: &[u8]) -> Result<(Vec<u8>, Option<Vec<u8>>)> {
+    let (public_key, tbs) = public_key_and_extensions(cert)?;
+    let attestation = extension_value(tbs, OID_NITRO_ATTESTATION)?;
+
+    Ok((public_key.to_vec(), attestation.map(<[u8]>::to_vec)))
+}
+
+// The content of the subjectKeyIdentifier extension, if any, which CMS may
+// identify signers by
+pub(crate) fn subject_key_identifier(cert: &[u8]) -> Result<Option<Vec<u8>>> {
+    let (_, tbs) = public_key_and_extensions(cert)?;
+    match extension_value(tbs, OID_SUBJECT_KEY_IDENTIFIER)? {
+        Some(value) => {
+            let (_, ski) = der::Reader(value).expect(0x04)?;
+            Ok(Some(ski.to_vec()))
+        }
+        None => Ok(None),
+    }
+}
+
+// The SubjectPublicKeyInfo, and what follows it in the TBSCertificate
+fn public_key_and_extensions(cert: &[u8]) -> Result<(&[u8], der::Reader)> {
+    let (_, cert) = der::Reader(cert).expect(0x30)?;
+    let (_, tbs) = der::Reader(cert).expect(0x30)?;
+    let mut tbs = der::Reader(tbs);
+
+    // version, if not v1
+    if tbs.peek() == Some(0xa0) {
+        tbs.next()?;
+    }
+    // serialNumber, signature, issuer, validity, subject
+    for _ in 0..5 {
+        tbs.next()?;
+    }
+    let (public_key, _) = tbs.expect(0x30)?;
+
+    Ok((public_key, tbs))
+}
+
+fn extension_value<'a>(mut tbs: der::Reader<'a>, oid: &[u128]) -> Result<Option<&'a [u8]>> {
+    let oid = der::oid(oid);
+    while !tbs.0.is_empty() {
+        let (tag, _, content) = tbs.next()?;
+        // issuerUniqueID and subjectUniqueID come before the extensions
+        if tag != 0xa3 {
+            continue;
+        }
+
+        let (_, extensions) = der::Reader(content).expect(0x30)?;
+        let mut extensions = der::Reader(extensions);
+        while !extensions.0.is_empty() {
+            let (_, ext) = extensions.expect(0x30)?;
+            let mut ext = der::Reader(ext);
+            let (ext_oid, _) = ext.expect(0x06)?;
+            if ext_oid != oid {
+                continue;
+            }
+            if ext.peek() == Some(0x01) {
+                ext.next()?; // critical
+            }
+            let (_, value) = ext.expect(0x04)?;
+            return Ok(Some(value));
+        }
+    }
+
+    Ok(None)
+}
+
+pub fn describe(cert: &[u8]) -> Result<CertificateInfo> {
+    let (_, cert) = der::Reader(cert).expect(0x30)?;
+    let (_, tbs) = der::Reader(cert).expect(0x30)?;
+    let mut tbs = der::Reader(tbs);
+
+    // version, if not v1
+    if tbs.peek() == Some(0xa0) {
+        tbs.next()?;
+    }
+    // serialNumber, signature
+    for _ in 0..2 {
+        tbs.next()?;
+    }
+    let (_, issuer) = tbs.expect(0x30)?;
+    let (_, validity) = tbs.expect(0x30)?;
+    let (_, subject) = tbs.expect(0x30)?;
+
+    let mut validity = der::Reader(validity);
+    Ok(CertificateInfo {
+        subject: distinguished_name_string(subject)?,
+        issuer: distinguished_name_string(issuer)?,
+        not_before: der::parse_time(&mut validity)?,
+        not_after: der::parse_time(&mut validity)?,
+    })
+}
+
+// The issuer Name in DER and the content of the serialNumber INTEGER, which
+// CMS identifies recipients by
+pub(crate) fn issuer_and_serial(cert: &[u8]) -> Result<(Vec<u8>, Vec<u8>)> {
+    let (_, cert) = der::Reader(cert).expect(0x30)?;
+    let (_, tbs) = der::Reader(cert).expect(0x30)?;
+    let mut tbs = der::Reader(tbs);
+
+    // version, if not v1
+    if tbs.peek() == Some(0xa0) {
+        tbs.next()?;
+    }
+    let (_, serial) = tbs.expect(0x02)?;
+    tbs.next()?; // signature
+    let (issuer, _) = tbs.expect(0x30)?;
+
+    Ok((issuer.to_vec(), serial.to_vec()))
+}
+
+// As in RFC 4514, but in the order of the certificate, e.g. "C=US, O=Amazon,
+// CN=aws.nitro-enclaves". Attributes without a short name go by their OID.
+pub(crate) fn distinguished_name_string(name: &[u8]) -> Result<String> {
+    const NAMES: &[(&[u128], &str)] = &[
+        (OID_COMMON_NAME, "CN"),
+        (OID_COUNTRY, "C"),
+        (OID_LOCALITY, "L"),
+        (OID_STATE, "ST"),
+        (OID_ORGANIZATION, "O"),
+        (OID_ORGANIZATIONAL_UNIT, "OU"),
+    ];
+
+    let mut parts = Vec::new();
+    let mut rdns = der::Reader(name);
+    while !rdns.0.is_empty() {
+        let (_, rdn) = rdns.expect(0x31)?;
+        let mut attributes = der::Reader(rdn);
+        while !attributes.0.is_empty() {
+            let (_, attribute) = attributes.expect(0x30)?;
+            let mut attribute = der::Reader(attribute);
+            let (oid, oid_content) = attribute.expect(0x06)?;
+            let (_, _, value) = attribute.next()?;
+
+            let name = match NAMES.iter().find(|(arcs, _)| der::oid(arcs) == oid) {
+                Some((_, name)) => name.to_string(),
+                None => der::oid_string(oid_content),
+            };
+            parts.push(format!("{name}={}", String::from_utf8_lossy(value)));
+        }
+    }
+
+    Ok(parts.join(", "))
+}
+
+// An ECDSA signature given as r and s of equal size, as COSE has them, in the
+// DER that X.509 signatures are in
+pub fn ecdsa_signature_der(fixed: &[u8]) -> Vec<u8> {
+    let (r, s) = fixed.split_at(fixed.len() / 2);
+    der::sequence(&[der::integer(r), der::integer(s)])
+}
+
+// The parameters are NULL for RSA, and absent for the others
+fn signature_algorithm(key_type: KeyType) -> Vec<u8> {
+    match key_type {
+        KeyType::Rsa2048 => der::sequence(&[der::oid(OID_SHA256_WITH_RSA), der::null()]),
+        KeyType::EcdsaP384 => der::sequence(&[der::oid(OID_ECDSA_WITH_SHA384)]),
+        KeyType::Ed25519 => der::sequence(&[der::oid(OID_ED25519)]),
+    }
+}
+
+fn distinguished_name(common_name: &str) -> Vec<u8> {
+    der::sequence(&[der::set(&[der::sequence(&[
+        der::oid(OID_COMMON_NAME),
+        der::utf8_string(common_name),
+    ])])])
+}
+
+fn extension(oid: &[u128], critical: bool, value: &[u8]) -> Vec<u8> {
+    let mut parts = vec![der::oid(oid)];
+    // DEFAULT FALSE, so only encoded when set
+    if critical {
+        parts.push(der::boolean(true));
+    }
+    parts.push(der::octet_string(value));
+    der::sequence(&parts)
+}
+
+// Just enough of DER to write certificates and CMS envelopes, and to read
+// back what attested TLS and attestation documents need of them
+pub(crate) mod der {
+    use super::*;
+
+    pub const TAG_DNS_NAME: u8 = 0x82;
+
+    pub fn tlv(tag: u8, content: &[u8]) -> Vec<u8> {
+        let mut out = vec![tag];
+        if content.len() < 0x80 {
+            out.push(content.len() as u8);
+        } else {
+            let len = content.len().to_be_bytes();
+            let skip = len.iter().take_while(|b| **b == 0).count();
+            out.push(0x80 | (len.len() - skip) as u8);
+            out.extend_from_slice(&len[skip..]);
+        }
+        out.extend_from_slice(content);
+        out
+    }
+
+    pub fn sequence(parts: &[Vec<u8>]) -> Vec<u8> {
+        tlv(0x30, &parts.concat())
+    }
+
+    pub fn set(parts: &[Vec<u8>]) -> Vec<u8> {
+        tlv(0x31, &parts.concat())
+    }
+
+    pub fn explicit(n: u8, content: &[u8]) -> Vec<u8> {
+        tlv(0xa0 | n, content)
+    }
+
+    pub fn boolean(value: bool) -> Vec<u8> {
+        tlv(0x01, &[if value { 0xff } else { 0x00 }])
+    }
+
+    // A non-negative integer given as big endian bytes
+    pub fn integer(bytes: &[u8]) -> Vec<u8> {
+        let skip = bytes.iter().take_while(|b| **b == 0).count();
+        let mut content = bytes[skip..].to_vec();
+        if content.first().map_or(true, |b| b & 0x80 != 0) {
+            content.insert(0, 0);
+        }
+        tlv(0x02, &content)
+    }
+
+    pub fn null() -> Vec<u8> {
+        tlv(0x05, &[])
+    }
+
+    pub fn bit_string(bytes: &[u8]) -> Vec<u8> {
+        // No unused bits
+        let mut content = vec![0];
+        content.extend_from_slice(bytes);
+        tlv(0x03, &content)
+    }
+
+    pub fn octet_string(bytes: &[u8]) -> Vec<u8> {
+        tlv(0x04, bytes)
+    }
+
+    pub fn utf8_string(s: &str) -> Vec<u8> {
+        tlv(0x0c, s.as_bytes())
+    }
+
+    pub fn oid(arcs: &[u128]) -> Vec<u8> {
+        let mut content = Vec::new();
+        base128(&mut content, arcs[0] * 40 + arcs[1]);
+        for arc in &arcs[2..] {
+            base128(&mut content, *arc);
+        }
+        tlv(0x06, &content)
+    }
+
+    fn base128(out: &mut Vec<u8>, mut n: u128) {
+        let mut digits = vec![(n & 0x7f) as u8];
+        n >>= 7;
+        while n > 0 {
+            digits.push(0x80 | (n & 0x7f) as u8);
+            n >>= 7;
+        }
+        out.extend(digits.iter().rev());
+    }
+
+    pub struct Reader<'a>(pub &'a [u8]);
+
+    impl<'a> Reader<'a> {
+        pub fn peek(&self) -> Option<u8> {
+            self.0.first().copied()
+        }
+
+        // The next TLV: its tag, its encoding in whole and its content
+        pub fn next(&mut self) -> Result<(u8, &'a [u8], &'a [u8])> {
+            let input = self.0;
+            let truncated = || anyhow!("truncated DER");
+            if input.len() < 2 {
+                return Err(truncated());
+            }
+
+            let (header, len) = match input[1] {
+                len if len < 0x80 => (2, len as usize),
+                n => {
+                    let n = (n & 0x7f) as usize;
+                    if n == 0 || n > 4 || input.len() < 2 + n {
+                        return Err(anyhow!("invalid DER length"));
+                    }
+                    let len = input[2..2 + n]
+                        .iter()
+                        .fold(0usize, |len, b| len << 8 | *b as usize);
+                    (2 + n, len)
+                }
+            };
+            if input.len() - header < len {
+                return Err(truncated());
+            }
+
+            let (tlv, rest) = input.split_at(header + len);
+            self.0 = rest;
+            Ok((tlv[0], tlv, &tlv[header..]))
+        }
+
+        // The next TLV, which has to have the given tag: its encoding in whole
+        // and its content
+        pub fn expect(&mut self, tag: u8) -> Result<(&'a [u8], &'a [u8])> {
+            match self.next()? {
+                (t, tlv, content) if t == tag => Ok((tlv, content)),
+                (t, _, _) => Err(anyhow!("expected DER tag {tag:#04x}, got {t:#04x}")),
+            }
+        }
+    }
+
+    // The content of an OID in dotted form
+    pub fn oid_string(content: &[u8]) -> String {
+        let mut arcs: Vec<u128> = Vec::new();
+        let mut n: u128 = 0;
+        for b in content {
+            n = n << 7 | (b & 0x7f) as u128;
+            if b & 0x80 == 0 {
+                arcs.push(n);
+                n = 0;
+            }
+        }
+
+        // The first two arcs share the first number
+        let mut out = match arcs.first() {
+            Some(first) if *first < 80 => format!("{}.{}", first / 40, first % 40),
+            Some(first) => format!("2.{}", first - 80),
+            None => return String::new(),
+        };
+        for arc in &arcs[1..] {
+            out.push_str(&format!(".{arc}"));
+        }
+        out
+    }
+
+    // The next UTCTime or GeneralizedTime, in RFC 3339
+    pub fn parse_time(reader: &mut Reader) -> Result<String> {
+        let (tag, _, content) = reader.next()?;
+        let invalid = || anyhow!("invalid time in certificate");
+
+        let s = std::str::from_utf8(content).map_err(|_| invalid())?;
+        if !s.ends_with('Z') || !s[..s.len() - 1].bytes().all(|b| b.is_ascii_digit()) {
+            return Err(invalid());
+        }
+
+        let (year, rest) = match (tag, s.len()) {
+            (0x17, 13) => {
+                let year: u32 = s[..2].parse().map_err(|_| invalid())?;
+                (if year < 50 { 2000 + year } else { 1900 + year }, &s[2..])
+            }
+            (0x18, 15) => (s[..4].parse().map_err(|_| invalid())?, &s[4..]),
+            _ => return Err(invalid()),
+        };
+
+        Ok(format!(
+            "{year:04}-{}-{}T{}:{}:{}Z",
+            &rest[0..2],
+            &rest[2..4],
+            &rest[4..6],
+            &rest[6..8],
+            &rest[8..10]
+        ))
+    }
+
+    // UTCTime through 2049, GeneralizedTime after that (RFC 5280, 4.1.2.5)
+    pub fn time(t: SystemTime) -> Vec<u8> {
+        let c = CivilTime::from_unix(t.duration_since(UNIX_EPOCH).unwrap_or_default());
+        let rest = format!(
+            "{:02}{:02}{:02}{:02}{:02}Z",
+            c.month, c.day, c.hour, c.min, c.sec
+        );
+
+        if c.year < 2050 {
+            tlv(0x17, format!("{:02}{rest}", c.year % 100).as_bytes())
+        } else {
+            tlv(0x18, format!("{:04}{rest}", c.year).as_bytes())
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{
+        attested_public_key, ca_extension, der, describe, issue, pem, self_signed,
+        CertificateParams, Extension, OID_NITRO_ATTESTATION,
+    };
+    use crate::keypair::{KeyPair, KeyType};
+    use assert2::assert;
+    use std::time::{Duration, UNIX_EPOCH};
+
+    #[test]
+    fn test_der() {
+        assert!(der::integer(&[0, 0, 0x7f]) == [0x02, 0x01, 0x7f]);
+        assert!(der::integer(&[0x80]) == [0x02, 0x02, 0x00, 0x80]);
+        assert!(der::oid(&[1, 2, 840, 113549, 1, 1, 11]) == hex("06092a864886f70d01010b"));
+        assert!(der::tlv(0x04, &[0u8; 300])[..4] == [0x04, 0x82, 0x01, 0x2c]);
+
+        let t = UNIX_EPOCH + Duration::from_secs(1665410136);
+        assert!(der::time(t) == [&[0x17u8, 13][..], &b"221010135536Z"[..]].concat());
+        let t = UNIX_EPOCH + Duration::from_secs(2556143999);
+        assert!(der::time(t) == [&[0x18u8, 15][..], &b"20501231235959Z"[..]].concat());
+
+        let time = der::parse_time(&mut der::Reader(&der::time(t))).unwrap();
+        assert!(time == "2050-12-31T23:59:59Z");
+        let oid = der::oid(&[1, 2, 840, 113549, 1, 1, 11]);
+        assert!(der::oid_string(&oid[2..]) == "1.2.840.113549.1.1.11");
+    }
+
+    #[test]
+    fn test_self_signed() {
+        for key_type in [KeyType::Rsa2048, KeyType::EcdsaP384, KeyType::Ed25519] {
+            check_self_signed(&KeyPair::generate_with(key_type).unwrap());
+        }
+    }
+
+    fn check_self_signed(key: &KeyPair) {
+        let now = std::time::SystemTime::now();
+        let params = CertificateParams {
+            common_name: "enclave.local".to_string(),
+            dns_names: vec!["enclave.local".to_string()],
+            not_before: now,
+            not_after: now + Duration::from_secs(3600),
+            extensions: vec![Extension {
+                oid: OID_NITRO_ATTESTATION,
+                critical: false,
+                value: b"attestation".to_vec(),
+            }],
+        };
+
+        let (cert, private_key) = self_signed(&params, key).unwrap();
+
+        let config = rustls::ServerConfig::builder()
+            .with_safe_defaults()
+            .with_no_client_auth()
+            .with_single_cert(
+                vec![rustls::Certificate(cert.clone())],
+                rustls::PrivateKey(private_key),
+            );
+        assert!(config.is_ok());
+
+        // and the attestation is embedded as is
+        let needle = der::octet_string(b"attestation");
+        assert!(cert.windows(needle.len()).any(|w| w == needle));
+
+        // and read back along with the key it attests
+        let (public_key, attestation) = attested_public_key(&cert).unwrap();
+        assert!(public_key == key.public_key_as_der().unwrap());
+        assert!(attestation.as_deref() == Some(&b"attestation"[..]));
+
+        let info = describe(&cert).unwrap();
+        assert!(info.subject == "CN=enclave.local");
+        assert!(info.issuer == info.subject);
+        assert!(info.not_before < info.not_after);
+    }
+
+    #[test]
+    fn test_issue() {
+        let now = std::time::SystemTime::now();
+        let ca_key = KeyPair::generate().unwrap();
+        let ca_params = CertificateParams {
+            common_name: "Test CA".to_string(),
+            dns_names: Vec::new(),
+            not_before: now,
+            not_after: now + Duration::from_secs(3600),
+            extensions: vec![ca_extension()],
+        };
+        let (ca_cert, _) = self_signed(&ca_params, &ca_key).unwrap();
+
+        // Signed with a key of another type than that of the CA
+        let key = KeyPair::generate_with(KeyType::EcdsaP384).unwrap();
+        let params = CertificateParams {
+            common_name: "example.com".to_string(),
+            dns_names: vec!["example.com".to_string()],
+            not_before: now,
+            not_after: now + Duration::from_secs(3600),
+            extensions: Vec::new(),
+        };
+        let (cert, _) = issue(&params, &key, "Test CA", &ca_key).unwrap();
+        assert!(let Ok((_, None)) = attested_public_key(&cert));
+
+        // Clients that trust the CA trust what it issued
+        let mut roots = rustls::RootCertStore::empty();
+        roots.add(&rustls::Certificate(ca_cert.clone())).unwrap();
+        let verifier = rustls::client::WebPkiVerifier::new(roots, None);
+        let verified = rustls::client::ServerCertVerifier::verify_server_cert(
+            &verifier,
+            &rustls::Certificate(cert),
+            &[],
+            &rustls::ServerName::try_from("example.com").unwrap(),
+            &mut std::iter::empty(),
+            &[],
+            now,
+        );
+        assert!(verified.is_ok());
+
+        let pem = pem("CERTIFICATE", &ca_cert);
+        let parsed = rustls_pemfile::certs(&mut pem.as_bytes()).unwrap();
+        assert!(parsed == vec![ca_cert]);
+    }
+
+    fn hex(s: &str) -> Vec<u8> {
+        (0..s.len())
+            .step_by(2)
+            .map(|i| u8::from_str_radix(&s[i..i + 2], 16).unwrap())
+            .collect()
+    }
+}